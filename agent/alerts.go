@@ -0,0 +1,103 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bbengfort/kekahu/kahu"
+)
+
+// HealthHookTimeout is the maximum amount of time an alert hook may run.
+const HealthHookTimeout = 30 * time.Second
+
+//===========================================================================
+// KeKahu Alerts
+//===========================================================================
+
+// Tracks which health rules are currently alerting so that hooks are only
+// executed when a rule is first crossed rather than on every health check.
+type alertTracker struct {
+	sync.Mutex
+	active map[string]bool
+}
+
+// Update the active alerts and return the alerts that were not previously active.
+func (t *alertTracker) Update(alerts []*kahu.Alert) []*kahu.Alert {
+	t.Lock()
+	defer t.Unlock()
+
+	active := make(map[string]bool)
+	raised := make([]*kahu.Alert, 0)
+	for _, alert := range alerts {
+		active[alert.Rule] = true
+		if !t.active[alert.Rule] {
+			raised = append(raised, alert)
+		}
+	}
+
+	t.active = active
+	return raised
+}
+
+// Evaluates the configured health rules against the status, logging a warning
+// for each alert and executing the health hook for any newly raised alerts.
+func (k *KeKahu) checkAlerts(status *kahu.SystemStatus) error {
+	rules, err := k.conf().GetHealthRules()
+	if err != nil {
+		return err
+	}
+
+	if err = status.Evaluate(rules); err != nil {
+		return err
+	}
+
+	for _, alert := range status.Alerts {
+		warn("health alert: %s", alert.Message)
+	}
+
+	raised := k.alerts.Update(status.Alerts)
+	if len(raised) == 0 || k.conf().HealthHook == "" {
+		return nil
+	}
+
+	return runHealthHook(k.conf().HealthHook, raised)
+}
+
+// Executes the hook script with the alerts as a JSON array on stdin and the
+// number of alerts and their rules in the environment.
+func runHealthHook(path string, alerts []*kahu.Alert) error {
+	data, err := json.Marshal(alerts)
+	if err != nil {
+		return fmt.Errorf("could not encode alerts: %s", err)
+	}
+
+	rules := make([]string, 0, len(alerts))
+	for _, alert := range alerts {
+		rules = append(rules, alert.Rule)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), HealthHookTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, path)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("KEKAHU_ALERTS=%d", len(alerts)),
+		fmt.Sprintf("KEKAHU_ALERT_RULES=%s", strings.Join(rules, ";")),
+	)
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("health hook %s failed: %s", path, err)
+	}
+
+	debug("health hook %s executed for %d alerts: %s", path, len(alerts), bytes.TrimSpace(out))
+	return nil
+}
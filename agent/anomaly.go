@@ -0,0 +1,220 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/bbengfort/kekahu/kahu"
+)
+
+// AnomalyMinSamples is the number of recent successful pings to a host that
+// are required before its latency is compared to the baseline.
+const AnomalyMinSamples = 8
+
+// MinAnomalyStdDev is the smallest standard deviation of the baseline, so that
+// a small increase of a very stable latency is not reported as an anomaly.
+const MinAnomalyStdDev = time.Millisecond
+
+//===========================================================================
+// Latency Anomalies
+//===========================================================================
+
+// LatencyAnomaly describes a round of pings to a host whose mean latency is
+// more standard deviations above the baseline than the configured threshold.
+type LatencyAnomaly struct {
+	Target     string        // the hostname of the target
+	Latency    time.Duration // the mean latency of the round of pings
+	Baseline   time.Duration // the mean of the recent latencies to the target
+	StdDev     time.Duration // the standard deviation of the recent latencies
+	Deviations float64       // standard deviations of the latency above the baseline
+}
+
+// String returns a description of the anomaly for logging.
+func (a *LatencyAnomaly) String() string {
+	return fmt.Sprintf(
+		"latency to %s is %s, %0.1f standard deviations above the baseline of %s (±%s)",
+		a.Target, a.Latency, a.Deviations, a.Baseline, a.StdDev,
+	)
+}
+
+// Baseline returns the mean and standard deviation of the recent successful
+// latencies to the host and false if there are too few of them to compare to.
+func (s *LatencyStats) Baseline() (mean, stddev time.Duration, ok bool) {
+	var total, squares, count float64
+	for _, latency := range s.Recent {
+		if latency > 0 {
+			total += latency
+			squares += latency * latency
+			count++
+		}
+	}
+
+	if count < AnomalyMinSamples {
+		return 0, 0, false
+	}
+
+	mu := total / count
+	variance := (squares / count) - (mu * mu)
+	return castSeconds(mu), castSeconds(math.Sqrt(math.Max(variance, 0))), true
+}
+
+// Anomaly compares the mean of the successful latencies to the host with the
+// baseline of its recent latencies and returns the anomaly if the mean is more
+// than the given number of standard deviations above it. Latencies below the
+// baseline are never anomalous. The latencies must be compared before they
+// are added to the network, otherwise they skew the baseline.
+func (n *Network) Anomaly(host string, latencies []time.Duration, deviations int) *LatencyAnomaly {
+	if deviations <= 0 || !reachable(latencies) {
+		return nil
+	}
+
+	n.RLock()
+	defer n.RUnlock()
+
+	metrics, ok := n.metrics[host]
+	if !ok {
+		return nil
+	}
+
+	baseline, stddev, ok := metrics.Baseline()
+	if !ok {
+		return nil
+	}
+
+	var total time.Duration
+	var count int64
+	for _, latency := range latencies {
+		if latency > 0 {
+			total += latency
+			count++
+		}
+	}
+
+	mean := total / time.Duration(count)
+	spread := stddev
+	if spread < MinAnomalyStdDev {
+		spread = MinAnomalyStdDev
+	}
+
+	score := float64(mean-baseline) / float64(spread)
+	if score <= float64(deviations) {
+		return nil
+	}
+
+	return &LatencyAnomaly{
+		Target: host, Latency: mean, Baseline: baseline, StdDev: stddev, Deviations: score,
+	}
+}
+
+//===========================================================================
+// KeKahu Anomalies
+//===========================================================================
+
+// Tracks the targets that are pinged more often since their latency was
+// anomalous, and until when they are pinged more often.
+type anomalies struct {
+	sync.Mutex
+	until map[string]time.Time
+}
+
+// Watch extends the time the target is pinged more often and returns true if
+// the target was not already being watched.
+func (a *anomalies) Watch(target string, until time.Time) bool {
+	a.Lock()
+	defer a.Unlock()
+
+	if a.until == nil {
+		a.until = make(map[string]time.Time)
+	}
+
+	_, watched := a.until[target]
+	a.until[target] = until
+	return !watched
+}
+
+// Expired returns true and stops watching the target if there has been no
+// anomaly for the duration it was last watched for.
+func (a *anomalies) Expired(target string, now time.Time) bool {
+	a.Lock()
+	defer a.Unlock()
+
+	until, ok := a.until[target]
+	if ok && now.Before(until) {
+		return false
+	}
+
+	delete(a.until, target)
+	return true
+}
+
+// Clear stops watching the target, e.g. when the host becomes inactive.
+func (a *anomalies) Clear(target string) {
+	a.Lock()
+	defer a.Unlock()
+	delete(a.until, target)
+}
+
+// Checks a round of pings to the target for an anomalous latency, logging the
+// anomaly and pinging the target more often for the anomaly duration. Returns
+// nil if the latency is not anomalous or anomaly detection is disabled.
+func (k *KeKahu) checkAnomaly(source string, target *kahu.Neighbor, latencies []time.Duration) *LatencyAnomaly {
+	anomaly := k.network.Anomaly(target.Hostname, latencies, k.conf().AnomalyDeviations)
+	if anomaly == nil {
+		return nil
+	}
+
+	pingLog.warn("%s", anomaly)
+
+	duration, err := k.conf().GetAnomalyDuration()
+	if err != nil || duration <= 0 {
+		return anomaly
+	}
+
+	if k.anomaly.Watch(target.Hostname, time.Now().Add(duration)) {
+		interval, err := k.conf().GetAnomalyInterval()
+		if err != nil || interval <= 0 {
+			return anomaly
+		}
+
+		pingLog.info("pinging %s every %s while its latency is anomalous", target.Hostname, interval)
+		k.schedule(interval, func(ctx context.Context) {
+			k.watchAnomaly(ctx, source, target, interval)
+		})
+	}
+	return anomaly
+}
+
+// Pings a target whose latency was anomalous and reports the latencies to
+// Kahu every interval, independently of the latency interval, until there
+// has been no anomaly for the anomaly duration. Any new anomaly extends the
+// watch through checkAnomaly when the target is measured.
+func (k *KeKahu) watchAnomaly(ctx context.Context, source string, target *kahu.Neighbor, interval time.Duration) {
+	if ctx.Err() != nil {
+		return
+	}
+
+	if k.state.Inactive() {
+		k.anomaly.Clear(target.Hostname)
+		pingLog.debug("host is not active, no longer watching %s", target.Hostname)
+		return
+	}
+
+	if k.anomaly.Expired(target.Hostname, time.Now()) {
+		pingLog.info("latency to %s is no longer anomalous", target.Hostname)
+		return
+	}
+
+	defer k.schedule(interval, func(ctx context.Context) {
+		k.watchAnomaly(ctx, source, target, interval)
+	})
+
+	updates := k.measureTarget(ctx, source, target)
+	if len(updates) > 0 {
+		if err := k.UpdateLatency(ctx, updates); err != nil {
+			k.echan <- pingLog.wrap(err)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package agent
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bbengfort/kekahu/kahu"
+)
+
+//===========================================================================
+// HTTP Exchange Tracing
+//===========================================================================
+
+// MaxTraceBody is the number of bytes of a request or response body that are
+// logged when HTTP exchanges with Kahu are traced, the rest is truncated.
+const MaxTraceBody = 64 * 1024
+
+// Logs HTTP exchanges with the Kahu API.
+var apiLog = &componentLogger{"api"}
+
+// Headers whose values are never logged.
+var redactedHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+	"Set-Cookie":          true,
+	kahu.SignatureHeader:  true,
+}
+
+// Matches the values of JSON fields that hold secrets, e.g. the cluster ping
+// secret returned by heartbeats.
+var secretFieldsRE = regexp.MustCompile(`("(?i:api_key|secret|token|password|signing_key)"\s*:\s*)"[^"]*"`)
+
+// traceTransport logs the sanitized request and response headers and bodies
+// of the HTTP exchanges with Kahu if trace_http is set (at the status level)
+// or the log level is trace. API keys and other secrets are redacted.
+type traceTransport struct {
+	next   http.RoundTripper
+	config *sharedConfig
+}
+
+// RoundTrip sends the request with the next transport, logging the exchange.
+func (t *traceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	logf := apiLog.trace
+	if t.config.Load().TraceHTTP {
+		logf = apiLog.status
+	} else if discardLog(Trace) {
+		return t.next.RoundTrip(req)
+	}
+
+	// The body of a clone is replaced so the request of the caller is unchanged
+	req = req.Clone(req.Context())
+	reqBody, err := t.traceBody(&req.Body, req.Header.Get("Content-Encoding"))
+	if err != nil {
+		return nil, err
+	}
+	logf("> %s %s\n%s%s", req.Method, req.URL, t.headers(req.Header), reqBody)
+
+	start := time.Now()
+	res, err := t.next.RoundTrip(req)
+	if err != nil {
+		logf("< %s %s failed after %s: %s", req.Method, req.URL, time.Since(start), err)
+		return res, err
+	}
+
+	resBody, err := t.traceBody(&res.Body, res.Header.Get("Content-Encoding"))
+	if err != nil {
+		res.Body.Close()
+		return nil, err
+	}
+	logf("< %s %s in %s\n%s%s", res.Proto, res.Status, time.Since(start), t.headers(res.Header), resBody)
+	return res, nil
+}
+
+// Returns the sorted headers, one per line, with the secret values redacted.
+func (t *traceTransport) headers(header http.Header) string {
+	keys := make([]string, 0, len(header))
+	for key := range header {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	buf := new(bytes.Buffer)
+	for _, key := range keys {
+		for _, value := range header[key] {
+			if redactedHeaders[http.CanonicalHeaderKey(key)] {
+				value = "[REDACTED]"
+			}
+			fmt.Fprintf(buf, "%s: %s\n", key, value)
+		}
+	}
+	return buf.String()
+}
+
+// Reads the body so that it can be logged and replaces it so that it can still
+// be read, returning the sanitized body to log.
+func (t *traceTransport) traceBody(body *io.ReadCloser, encoding string) (string, error) {
+	if *body == nil || *body == http.NoBody {
+		return "", nil
+	}
+
+	data, err := ioutil.ReadAll(*body)
+	(*body).Close()
+	if err != nil {
+		return "", fmt.Errorf("could not read body to trace: %s", err)
+	}
+	*body = ioutil.NopCloser(bytes.NewReader(data))
+
+	// Compressed request bodies are logged decompressed
+	if strings.EqualFold(encoding, "gzip") {
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return fmt.Sprintf("\n[%d bytes gzip compressed]", len(data)), nil
+		}
+
+		plain, err := ioutil.ReadAll(gz)
+		if err != nil {
+			return fmt.Sprintf("\n[%d bytes gzip compressed]", len(data)), nil
+		}
+		data = plain
+	}
+
+	if len(data) == 0 {
+		return "", nil
+	}
+	return "\n" + t.sanitize(data), nil
+}
+
+// Redacts the API key and secret JSON fields and truncates the body.
+func (t *traceTransport) sanitize(data []byte) string {
+	var truncated int
+	if len(data) > MaxTraceBody {
+		truncated = len(data) - MaxTraceBody
+		data = data[:MaxTraceBody]
+	}
+
+	body := secretFieldsRE.ReplaceAllString(string(data), `$1"[REDACTED]"`)
+	if key := t.config.Load().APIKey; key != "" {
+		body = strings.Replace(body, key, "[REDACTED]", -1)
+	}
+
+	if truncated > 0 {
+		body += fmt.Sprintf("\n[%d more bytes truncated]", truncated)
+	}
+	return strings.TrimRight(body, "\n")
+}
@@ -0,0 +1,85 @@
+package agent
+
+import (
+	"context"
+	"time"
+
+	"github.com/bbengfort/kekahu/kahu"
+	"github.com/bbengfort/kekahu/ping"
+)
+
+//===========================================================================
+// Bandwidth Measurements
+//===========================================================================
+
+// Bandwidth measures the throughput to each neighbor by streaming data to its
+// echo server for the configured duration, then reports the measurements to
+// Kahu in a single batched request and schedules the next measurement after
+// the bandwidth interval. Neighbors are measured one at a time so that the
+// measurements do not compete with each other for the local link.
+func (k *KeKahu) Bandwidth(ctx context.Context) {
+	interval, err := k.conf().GetBandwidthInterval()
+	if err != nil || interval <= 0 || ctx.Err() != nil {
+		return
+	}
+	defer k.schedule(interval, k.Bandwidth)
+
+	source, targets := k.Neighbors(ctx)
+	if source == "" || len(targets) == 0 {
+		bandwidthLog.debug("no active neighbors to measure bandwidth to")
+		return
+	}
+
+	requests := make(kahu.BandwidthRequests, 0, len(targets))
+	for _, target := range targets {
+		measure, err := k.MeasureBandwidth(ctx, source, target.Hostname, target.IPAddr)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			bandwidthLog.warne(err) // Don't send to echan, the other neighbors are still measured
+			continue
+		}
+		requests = append(requests, measure)
+	}
+
+	if len(requests) > 0 {
+		if err := k.api.ReportBandwidth(ctx, requests); err != nil {
+			k.echan <- bandwidthLog.wrap(err)
+		}
+	}
+}
+
+// MeasureBandwidth streams data to the echo server of the target at addr over
+// gRPC for the configured duration and returns the throughput of the stream.
+// The stream is signed with the cluster secret like a ping.
+func (k *KeKahu) MeasureBandwidth(ctx context.Context, source, target, addr string) (*kahu.BandwidthRequest, error) {
+	duration, err := k.conf().GetBandwidthDuration()
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := k.conf().GetBandwidthPayload()
+	if err != nil {
+		return nil, err
+	}
+
+	addr = resolveAddr(addr)
+	bandwidthLog.debug("streaming %s of data to %s at %s", duration, target, addr)
+
+	header := &ping.Packet{Source: source, Target: target}
+	received, elapsed, err := k.remote.Throughput(ctx, addr, header, payload, duration)
+	if err != nil {
+		return nil, err
+	}
+
+	measure := &kahu.BandwidthRequest{
+		Target:   target,
+		Bytes:    received,
+		Duration: float64(elapsed) / float64(time.Millisecond),
+		Mbps:     float64(received*8) / elapsed.Seconds() / 1e6,
+	}
+
+	bandwidthLog.info("bandwidth from %s to %s is %0.2f Mbps", source, target, measure.Mbps)
+	return measure, nil
+}
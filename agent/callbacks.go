@@ -0,0 +1,100 @@
+package agent
+
+import (
+	"sync"
+
+	"github.com/bbengfort/kekahu/kahu"
+)
+
+// HeartbeatCallback is called after every heartbeat with the response from
+// Kahu, or with the error if the heartbeat could not be sent.
+type HeartbeatCallback func(rep *kahu.HeartbeatResponse, err error)
+
+// ErrorCallback is called with every non-fatal error of the running service
+// and the component it occurred in, e.g. heartbeat, ping, or sync.
+type ErrorCallback func(component string, err error)
+
+// SyncCallback is called after every sync of the peers file with its path
+// and the number of replicas fetched from Kahu, or with the error if the
+// sync failed.
+type SyncCallback func(path string, replicas int, err error)
+
+// OnHeartbeat registers the callback to be called after every heartbeat.
+// Callbacks are called synchronously by the service, so they must return
+// quickly and must not call Stop or Shutdown.
+func (k *KeKahu) OnHeartbeat(callback HeartbeatCallback) {
+	k.notify.Lock()
+	defer k.notify.Unlock()
+	k.notify.heartbeats = append(k.notify.heartbeats, callback)
+}
+
+// OnError registers the callback to be called with the non-fatal errors of
+// the running service after they are logged. Callbacks are called
+// synchronously by the service, so they must return quickly and must not call
+// Stop or Shutdown.
+func (k *KeKahu) OnError(callback ErrorCallback) {
+	k.notify.Lock()
+	defer k.notify.Unlock()
+	k.notify.errors = append(k.notify.errors, callback)
+}
+
+// OnSync registers the callback to be called after every sync of the peers
+// file. Callbacks are called synchronously by the service, so they must
+// return quickly and must not call Stop or Shutdown.
+func (k *KeKahu) OnSync(callback SyncCallback) {
+	k.notify.Lock()
+	defer k.notify.Unlock()
+	k.notify.syncs = append(k.notify.syncs, callback)
+}
+
+//===========================================================================
+// Callback Registry
+//===========================================================================
+
+// The callbacks registered by programs that embed the service. It is
+// thread-safe and a nil registry calls no callbacks.
+type callbacks struct {
+	sync.RWMutex
+	heartbeats []HeartbeatCallback
+	errors     []ErrorCallback
+	syncs      []SyncCallback
+}
+
+// Calls the heartbeat callbacks.
+func (c *callbacks) heartbeat(rep *kahu.HeartbeatResponse, err error) {
+	if c == nil {
+		return
+	}
+
+	c.RLock()
+	defer c.RUnlock()
+	for _, callback := range c.heartbeats {
+		callback(rep, err)
+	}
+}
+
+// Calls the error callbacks.
+func (c *callbacks) error(component string, err error) {
+	if c == nil {
+		return
+	}
+
+	c.RLock()
+	defer c.RUnlock()
+	for _, callback := range c.errors {
+		callback(component, err)
+	}
+}
+
+// Calls the sync callbacks.
+func (c *callbacks) sync(path string, replicas int, err error) {
+	if c == nil {
+		return
+	}
+
+	c.RLock()
+	defer c.RUnlock()
+	for _, callback := range c.syncs {
+		callback(path, replicas, err)
+	}
+}
@@ -0,0 +1,157 @@
+package agent
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/bbengfort/kekahu/kahu"
+)
+
+// KahuClient performs the requests to the Kahu API on behalf of the service.
+// The HTTPClient is used by default; the service can be tested without a
+// live Kahu server by passing a mock client (see the kekahutest package) to
+// the SetClient method of the service.
+type KahuClient = kahu.Client
+
+//===========================================================================
+// HTTP Client
+//===========================================================================
+
+// HTTPClient is the kahu.HTTPClient configured by the kekahu configuration.
+// Requests are authenticated with the configured API key, rate limited, and
+// retried according to the retry policy of the endpoint. If a spool is set,
+// heartbeats and latency reports that fail because Kahu is unreachable are
+// buffered and replayed after the next successful heartbeat.
+type HTTPClient struct {
+	*kahu.HTTPClient
+	config    *sharedConfig     // shared with the service so reloads apply to the next request
+	metrics   *Telemetry        // Records failed requests, may be nil
+	spool     *kahu.Spool       // Buffered reports to replay, nil if disabled
+	transport http.RoundTripper // Traced transport of the requests, kept on reload
+	stats     *kahu.APIStats    // Requests to each endpoint, kept on reload
+}
+
+// Init the client with the configuration, the telemetry to record failed
+// requests to, and the spool to buffer reports in (both may be nil).
+func (c *HTTPClient) Init(config *Config, metrics *Telemetry, spool *kahu.Spool) error {
+	return c.init(newSharedConfig(config), metrics, spool)
+}
+
+// Init the client with the configuration shared with the service.
+func (c *HTTPClient) init(config *sharedConfig, metrics *Telemetry, spool *kahu.Spool) error {
+	transport, err := config.Load().HTTPTransport()
+	if err != nil {
+		return err
+	}
+
+	c.config = config
+	c.metrics = metrics
+	c.spool = spool
+	c.transport = &traceTransport{next: transport, config: config}
+	c.stats = kahu.NewAPIStats()
+	c.HTTPClient = new(kahu.HTTPClient)
+	return c.Reload()
+}
+
+// Reload applies the configuration to the next requests, e.g. the URL, API
+// key, and timeout after the configuration of the service was reloaded. The
+// transport is not replaced, so changes to the proxy and TLS configuration
+// require a restart.
+func (c *HTTPClient) Reload() error {
+	opts, err := c.config.Load().clientOptions()
+	if err != nil {
+		return err
+	}
+
+	opts.Transport = c.transport
+	opts.Spool = c.spool
+	opts.Stats = c.stats
+	if c.metrics != nil {
+		opts.OnError = c.metrics.APIError
+	}
+	return c.HTTPClient.Init(opts)
+}
+
+// Stats returns the statistics of the requests to each endpoint of Kahu.
+func (c *HTTPClient) Stats() *kahu.APIStats {
+	return c.stats
+}
+
+// Returns the options of the requests to the Kahu API from the configuration,
+// without the transport, spool, and error callback of the HTTPClient.
+func (c *Config) clientOptions() (*kahu.Options, error) {
+	timeout, err := c.GetAPITimeout()
+	if err != nil {
+		return nil, err
+	}
+
+	// Heartbeats and latency reports have their own number of attempts
+	retry, err := c.GetRetryPolicy("")
+	if err != nil {
+		return nil, err
+	}
+
+	schema, err := c.GetAPISchema()
+	if err != nil {
+		return nil, err
+	}
+
+	retries := make(map[string]*kahu.RetryPolicy)
+	for _, endpoint := range []string{kahu.HeartbeatEndpoint, kahu.LatencyEndpoint} {
+		if retries[endpoint], err = c.GetRetryPolicy(endpoint); err != nil {
+			return nil, err
+		}
+	}
+
+	opts := &kahu.Options{
+		URL:           c.URL,
+		APIKey:        c.APIKey,
+		UserAgent:     c.GetUserAgent(),
+		Timeout:       timeout,
+		RateLimit:     float64(c.APIRateLimit),
+		RateBurst:     c.APIRateBurst,
+		Gzip:          c.APIGzipRequests,
+		GzipThreshold: c.APIGzipThreshold,
+		SigningKeys:   []string{c.SigningKey, c.SigningKeyAlt},
+		Retry:         retry,
+		Retries:       retries,
+		Schema:        schema,
+	}
+
+	if c.SendFingerprint {
+		opts.Fingerprint = MachineFingerprint()
+	}
+	return opts, nil
+}
+
+//===========================================================================
+// API Statistics
+//===========================================================================
+
+// APIStats returns the statistics of the requests to each endpoint of Kahu,
+// nil if the requests are not made with the HTTP client.
+func (k *KeKahu) APIStats() map[string]*kahu.EndpointStats {
+	client, ok := k.httpClient()
+	if !ok {
+		return nil
+	}
+	return client.Stats().Endpoints()
+}
+
+// Logs the requests, failures, retries, and latency of each endpoint of Kahu.
+func (k *KeKahu) summarizeAPIStats() {
+	stats := k.APIStats()
+	endpoints := make([]string, 0, len(stats))
+	for endpoint := range stats {
+		endpoints = append(endpoints, endpoint)
+	}
+	sort.Strings(endpoints)
+
+	for _, endpoint := range endpoints {
+		s := stats[endpoint]
+		info(
+			"%s: %d requests, %d failed, %d retried, %.1fms mean, %.1fms max",
+			endpoint, s.Requests, s.Failures, s.Retries, s.MeanLatency, s.MaxLatency,
+		)
+	}
+}
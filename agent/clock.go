@@ -0,0 +1,237 @@
+package agent
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bbengfort/kekahu/ping"
+)
+
+// NTPPort is the port that NTP servers listen on if none is specified.
+const NTPPort = "123"
+
+// Seconds between the NTP epoch (1900) and the Unix epoch (1970).
+const ntpEpochOffset = 2208988800
+
+// SkewWindow is the number of pings after which the lowest delay sample used
+// to estimate the clock skew of a host is replaced, so that the estimate
+// follows the drift of the clocks rather than being fixed by an old sample.
+const SkewWindow = 64
+
+// ClockSample is an NTP-style estimate of the clock offset between the local
+// host and an echo server, computed from the four timestamps of a ping: when
+// the client sent it (t1), when the server received it (t2) and replied (t3),
+// and when the client received the reply (t4). The offset assumes that the
+// outbound and inbound paths have the same delay, so the asymmetry of a single
+// sample cannot be separated from the offset; see LatencyStats.Clock.
+type ClockSample struct {
+	Offset   time.Duration // offset of the server's clock from the local clock
+	Delay    time.Duration // round trip delay excluding the server's processing time
+	Outbound time.Duration // apparent one-way delay from the client to the server (t2 - t1)
+	Inbound  time.Duration // apparent one-way delay from the server to the client (t4 - t3)
+}
+
+// NewClockSample computes the clock sample from the reply to a ping and the
+// time the reply was received. It returns false if the ping was not
+// timestamped on both sides, e.g. by an echo server of an older version.
+func NewClockSample(reply *ping.Packet, received time.Time) (*ClockSample, bool) {
+	t1, t2, t3 := reply.GetSent(), reply.GetReceived(), reply.GetReplied()
+	if t1 == 0 || t2 == 0 || t3 == 0 {
+		return nil, false
+	}
+
+	t4 := received.UnixNano()
+	return &ClockSample{
+		Offset:   time.Duration(((t2 - t1) + (t3 - t4)) / 2),
+		Delay:    time.Duration((t4 - t1) - (t3 - t2)),
+		Outbound: time.Duration(t2 - t1),
+		Inbound:  time.Duration(t4 - t3),
+	}, true
+}
+
+// QueryNTP sends a single SNTP (RFC 4330) request to the NTP server and
+// returns the offset of the server's clock from the local clock, computed the
+// same way as the clock samples of pings. The server may include a port,
+// otherwise NTPPort is used.
+func QueryNTP(ctx context.Context, server string) (*ClockSample, error) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, NTPPort)
+	}
+
+	conn, err := new(net.Dialer).DialContext(ctx, "udp", server)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to ntp server %s: %s", server, err)
+	}
+	defer conn.Close()
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(5 * time.Second)
+	}
+	conn.SetDeadline(deadline)
+
+	// LI = 0 (no warning), VN = 4, Mode = 3 (client)
+	req := make([]byte, 48)
+	req[0] = 0x23
+
+	sent := time.Now()
+	if _, err = conn.Write(req); err != nil {
+		return nil, fmt.Errorf("could not query ntp server %s: %s", server, err)
+	}
+
+	rep := make([]byte, 48)
+	if _, err = conn.Read(rep); err != nil {
+		return nil, fmt.Errorf("no reply from ntp server %s: %s", server, err)
+	}
+	received := time.Now()
+
+	// A stratum of zero is a kiss-o'-death packet, e.g. when rate limited
+	if rep[1] == 0 {
+		return nil, fmt.Errorf("ntp server %s refused the request", server)
+	}
+
+	sample, ok := NewClockSample(&ping.Packet{
+		Sent:     sent.UnixNano(),
+		Received: ntpTime(rep[32:40]).UnixNano(),
+		Replied:  ntpTime(rep[40:48]).UnixNano(),
+	}, received)
+	if !ok {
+		return nil, fmt.Errorf("ntp server %s did not timestamp the reply", server)
+	}
+	return sample, nil
+}
+
+// MeasureClock queries the NTP servers concurrently and returns the sample with
+// the lowest delay and the server it is from, since it is the least affected by
+// queueing. An error is only returned if none of the servers replied.
+func MeasureClock(ctx context.Context, servers []string) (*ClockSample, string, error) {
+	if len(servers) == 0 {
+		return nil, "", errors.New("no ntp server is configured")
+	}
+
+	samples := make([]*ClockSample, len(servers))
+	errs := make([]string, len(servers))
+
+	var wg sync.WaitGroup
+	for i, server := range servers {
+		wg.Add(1)
+		go func(i int, server string) {
+			defer wg.Done()
+			sample, err := QueryNTP(ctx, server)
+			if err != nil {
+				errs[i] = err.Error()
+				return
+			}
+			samples[i] = sample
+		}(i, server)
+	}
+	wg.Wait()
+
+	best := -1
+	for i, sample := range samples {
+		if sample != nil && (best < 0 || sample.Delay < samples[best].Delay) {
+			best = i
+		}
+	}
+
+	if best < 0 {
+		return nil, "", errors.New(strings.Join(errs, "; "))
+	}
+	return samples[best], servers[best], nil
+}
+
+// Converts a 64-bit NTP timestamp (seconds and fraction since 1900) to a time.
+func ntpTime(b []byte) time.Time {
+	secs := int64(binary.BigEndian.Uint32(b[:4])) - ntpEpochOffset
+	frac := int64(binary.BigEndian.Uint32(b[4:])) * 1e9 >> 32
+	return time.Unix(secs, frac)
+}
+
+//===========================================================================
+// Local Clock Skew
+//===========================================================================
+
+// Tracks the offset of the local clock from the NTP servers, which is reported
+// to Kahu with heartbeats and health reports, since latencies measured on
+// hosts with skewed clocks cannot be compared with each other.
+type clockSkew struct {
+	sync.RWMutex
+	offset  time.Duration // offset of the NTP server's clock from the local clock
+	server  string        // the NTP server the offset was measured with
+	checked time.Time     // when the offset was last measured, zero if never
+	skewed  bool          // the offset exceeded the warning threshold
+}
+
+// CheckClock measures the offset of the local clock from the configured NTP
+// servers, warning if it exceeds the clock_skew_warn threshold, then schedules
+// the next measurement after the clock interval.
+func (k *KeKahu) CheckClock(ctx context.Context) {
+	interval, err := k.conf().GetClockInterval()
+	if err != nil || interval <= 0 || ctx.Err() != nil {
+		return
+	}
+	defer k.schedule(interval, k.CheckClock)
+
+	threshold, err := k.conf().GetClockSkewWarn()
+	if err != nil {
+		k.echan <- healthLog.wrap(err)
+		return
+	}
+
+	qctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	sample, server, err := MeasureClock(qctx, k.conf().GetNTPServers())
+	cancel()
+	if err != nil {
+		if ctx.Err() == nil {
+			healthLog.warn("could not measure the clock skew: %s", err)
+		}
+		return
+	}
+
+	skewed := absDuration(sample.Offset) > threshold
+	k.clock.Lock()
+	recovered := k.clock.skewed && !skewed
+	k.clock.offset, k.clock.server, k.clock.checked, k.clock.skewed = sample.Offset, server, time.Now(), skewed
+	k.clock.Unlock()
+
+	switch {
+	case skewed:
+		healthLog.warn("clock is off by %s from %s, latencies cannot be compared with other hosts until it is synchronized", sample.Offset, server)
+	case recovered:
+		healthLog.status("clock is synchronized again, off by %s from %s", sample.Offset, server)
+	default:
+		healthLog.debug("clock is off by %s from %s (delay %s)", sample.Offset, server, sample.Delay)
+	}
+}
+
+// ClockSkew returns the offset of the NTP server's clock from the local clock
+// at the last measurement, and false if the clock skew has not been measured.
+func (k *KeKahu) ClockSkew() (time.Duration, bool) {
+	k.clock.RLock()
+	defer k.clock.RUnlock()
+	return k.clock.offset, !k.clock.checked.IsZero()
+}
+
+// Returns the clock skew in milliseconds to report to Kahu, zero if the clock
+// skew has not been measured.
+func (k *KeKahu) skewMS() float64 {
+	skew, ok := k.ClockSkew()
+	if !ok {
+		return 0
+	}
+	return float64(skew) / float64(time.Millisecond)
+}
+
+// Returns the absolute value of the duration.
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
@@ -0,0 +1,1196 @@
+package agent
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/bbengfort/kekahu/doctor"
+	"github.com/bbengfort/kekahu/kahu"
+	knet "github.com/bbengfort/kekahu/net"
+	"github.com/fatih/structs"
+	"github.com/koding/multiconfig"
+)
+
+// IP families that can be preferred when resolving neighbor domains.
+const (
+	IPv4 = "ipv4"
+	IPv6 = "ipv6"
+)
+
+// FindConfigPath returns the first file in path search list that exists.
+func FindConfigPath() (string, error) {
+	// Prepare PATH list
+	paths := make([]string, 0, 3)
+
+	// Look in CWD directory first
+	if path, err := os.Getwd(); err == nil {
+		paths = append(paths, filepath.Join(path, "kekahu"))
+	}
+
+	// Look in user's home directory next
+	if user, err := user.Current(); err == nil {
+		paths = append(paths, filepath.Join(user.HomeDir, ".kekahu"))
+	}
+
+	// Finally look in etc for the global configuration
+	paths = append(paths, "/etc/kekahu")
+
+	for _, path := range paths {
+		for _, ext := range []string{".toml", ".json", ".yml", ".yaml"} {
+			fpath := path + ext
+			if _, err := os.Stat(fpath); !os.IsNotExist(err) {
+				return fpath, nil
+			}
+		}
+	}
+
+	return "", errors.New("no configuration file found")
+}
+
+// Config uses the multiconfig loader and validators to store configuration
+// values required for the kekahu service and to parse complex types.
+type Config struct {
+	Interval          string `default:"2m" validate:"schedule" json:"interval"`              // the delay between heartbeats, or cron expressions or time windows, see ParseSchedule
+	Jitter            string `default:"30s" validate:"duration" json:"jitter"`               // random jitter to add before or after interval
+	LatencyInterval   string `validate:"duration" json:"latency_interval"`                   // Interval between latency measurements, after every heartbeat if empty
+	APIKey            string `required:"true" validate:"apikey" json:"api_key"`              // API Key to access Kahu service, or keychain:[account] or enc:... to keep it secret
+	KeyPassphrase     string `json:"key_passphrase"`                                         // Passphrase that decrypts an enc: api_key, best set with KEKAHU_KEY_PASSPHRASE
+	KeyPassCommand    string `json:"key_pass_command"`                                       // Command that prints the passphrase of an enc: api_key, e.g. to decrypt it with a KMS
+	URL               string `default:"https://kahu.bengfort.com" validate:"url" json:"url"` // Base URL of the Kahu service
+	Profile           string `json:"profile"`                                                // Named profile in the config file to apply, e.g. staging
+	Verbosity         int    `default:"3" validate:"uint" json:"verbosity"`                  // Log verbosity, lower is more verbose
+	LogFormat         string `default:"text" json:"log_format"`                              // Log output format, either text or json
+	LogOutputs        string `default:"stdout" validate:"logoutputs" json:"log_outputs"`     // Destinations of log messages, e.g. "stdout, file:/var/log/kekahu.log@debug"
+	LogMaxSize        int    `default:"100" validate:"uint" json:"log_max_size"`             // Megabytes a log file may grow to before it is rotated, never rotated if 0
+	LogMaxAge         string `validate:"duration" json:"log_max_age"`                        // Time a log file is written to before it is rotated, disabled if empty
+	LogMaxBackups     int    `default:"5" validate:"uint" json:"log_max_backups"`            // Rotated log files to keep, all are kept if 0
+	PeersPath         string `default:"peers.json" validate:"path" json:"peers_path"`        // Path to save peers JSON file
+	PeersFormat       string `default:"json" validate:"peersformat" json:"peers_format"`     // Format of the peers file: json, yaml, toml, hosts, or etcd
+	SyncInterval      string `validate:"duration" json:"sync_interval"`                      // Interval between syncs of the peers file, disabled if empty
+	APITimeout        string `default:"5s" validate:"duration" json:"api_timeout"`           // Timeout for API HTTP requests
+	APIRateLimit      int    `default:"5" validate:"uint" json:"api_rate_limit"`             // Max Kahu API requests per second, unlimited if zero
+	APIRateBurst      int    `default:"10" validate:"uint" json:"api_rate_burst"`            // Max Kahu API requests sent at once before rate limiting
+	APIMaxIdleConns   int    `default:"4" validate:"uint" json:"api_max_idle_conns"`         // Max idle keep-alive connections to Kahu, keep-alives are disabled if zero
+	APIIdleTimeout    string `default:"5m" validate:"duration" json:"api_idle_timeout"`      // Close idle connections to Kahu after this long, should exceed the interval
+	APITLSTimeout     string `default:"10s" validate:"duration" json:"api_tls_timeout"`      // Timeout for the TLS handshake with Kahu
+	APICompression    bool   `default:"true" json:"api_compression"`                         // Request gzip compressed responses from Kahu
+	APIGzipRequests   bool   `default:"false" json:"api_gzip_requests"`                      // Compress large request bodies with gzip, Kahu must accept them
+	APIGzipThreshold  int    `default:"1024" validate:"uint" json:"api_gzip_threshold"`      // Only compress request bodies of at least this many bytes
+	APISchema         string `default:"auto" validate:"schema" json:"api_schema"`            // Schema version of the reports posted to Kahu, negotiated with Kahu if auto
+	TraceHTTP         bool   `default:"false" json:"trace_http"`                             // Log the sanitized HTTP exchanges with Kahu, also logged at the trace level
+	KahuProxy         string `validate:"url" json:"kahu_proxy"`                              // HTTP(S) proxy for Kahu API requests, from the environment if empty
+	KahuCA            string `validate:"path" json:"kahu_ca"`                                // Path to a CA bundle to verify the Kahu server with
+	KahuCert          string `validate:"path" json:"kahu_cert"`                              // Path to a client certificate to present to the Kahu server
+	KahuKey           string `validate:"path" json:"kahu_key"`                               // Path to the private key of the Kahu client certificate
+	KahuInsecure      bool   `default:"false" json:"kahu_insecure"`                          // Skip verification of the Kahu server certificate (insecure!)
+	SigningKey        string `json:"signing_key"`                                            // HMAC key to sign POST requests to Kahu with, requests are not signed if empty
+	SigningKeyAlt     string `json:"signing_key_alt"`                                        // Secondary key requests are also signed with while keys are rotated
+	UserAgent         string `json:"user_agent"`                                             // User-Agent sent to Kahu, the kekahu version and platform if empty
+	SendFingerprint   bool   `default:"true" json:"send_fingerprint"`                        // Send a hash of the machine ID to Kahu to correlate renamed hosts
+	Upstreams         string `validate:"upstreams" json:"upstreams"`                         // Additional Kahu services to report to, e.g. "url key features; ..."
+	PingTimeout       string `default:"10s" validate:"duration" json:"ping_timeout"`         // Timeout for ping GRPC requests
+	PersistLatency    bool   `default:"true" json:"persist_latency"`                         // Save latency metrics to disk to restore on restart
+	LatencyPath       string `validate:"path" json:"latency_path"`                           // Path to save latency metrics to, relative to the state directory, latency.json if empty
+	Checkpoint        string `default:"10m" validate:"duration" json:"checkpoint"`           // Interval between saving latency metrics to disk
+	RecordPath        string `validate:"path" json:"record_path"`                            // File to append every ping result to for offline analysis, disabled if empty
+	RecordFormat      string `default:"csv" validate:"recordformat" json:"record_format"`    // Format of the ping recording, either csv or jsonl
+	RecordMaxSize     int    `default:"100" validate:"uint" json:"record_max_size"`          // Megabytes the recording may grow to before it is rotated, never rotated if 0
+	RecordMaxAge      string `validate:"duration" json:"record_max_age"`                     // Time the recording is written to before it is rotated, disabled if empty
+	RecordMaxBackups  int    `default:"0" validate:"uint" json:"record_max_backups"`         // Rotated recordings to keep, all are kept if 0
+	PingBurst         int    `default:"1" validate:"uint" json:"ping_burst"`                 // Number of pings to stream to each neighbor per heartbeat
+	PingTransport     string `default:"grpc" validate:"transport" json:"ping_transport"`     // Transport to send pings with: grpc, udp, or quic
+	PingSize          int    `default:"0" validate:"uint" json:"ping_size"`                  // Size in bytes of the payload each ping carries to measure the latency of larger messages
+	PingProxies       string `validate:"proxies" json:"ping_proxies"`                        // Proxies to send pings through by target, e.g. "db1=socks5://proxy:1080; *=ssh://user@bastion"
+	EchoTransports    string `default:"grpc" validate:"transports" json:"echo_transports"`   // Comma separated transports the echo server listens for pings on
+	EchoLogging       bool   `default:"true" json:"echo_logging"`                            // Log each gRPC request to the echo server in debug mode
+	EchoMetrics       bool   `default:"true" json:"echo_metrics"`                            // Count the gRPC requests to the echo server by source
+	EchoRecovery      bool   `default:"true" json:"echo_recovery"`                           // Recover from panics while handling gRPC requests
+	PingIdle          string `default:"5m" validate:"duration" json:"ping_idle"`             // Close ping connections that are idle for this long
+	WarmupPings       int    `default:"1" validate:"uint" json:"warmup_pings"`               // Pings on each new connection left out of the latency statistics, disabled if 0
+	WarmupPolicy      string `default:"mark" validate:"warmup" json:"warmup_policy"`         // Whether warm-up pings are reported flagged (mark) or not at all (discard)
+	OutlierFilter     string `validate:"outliers" json:"outlier_filter"`                     // Reject outliers from the latency statistics with mad[:zscore] or trim[:percentile], disabled if empty
+	AnomalyDeviations int    `default:"3" validate:"uint" json:"anomaly_deviations"`         // Standard deviations above the baseline that are anomalous, disabled if zero
+	AnomalyInterval   string `default:"10s" validate:"duration" json:"anomaly_interval"`     // Interval between pings to a target while its latency is anomalous
+	AnomalyDuration   string `default:"2m" validate:"duration" json:"anomaly_duration"`      // How long to keep pinging a target more often after its last anomaly
+	BandwidthInterval string `validate:"duration" json:"bandwidth_interval"`                 // Interval between bandwidth measurements to neighbors, disabled if empty
+	BandwidthDuration string `default:"2s" validate:"duration" json:"bandwidth_duration"`    // How long to stream data to each neighbor to measure bandwidth
+	BandwidthPayload  int    `default:"65536" validate:"uint" json:"bandwidth_payload"`      // Size in bytes of each chunk of data streamed to measure bandwidth
+	GossipLatency     bool   `default:"false" json:"gossip_latency"`                         // Share latency summaries with peers on ping replies and collect theirs
+	GossipInterval    string `validate:"duration" json:"gossip_interval"`                    // Interval between posting the gossiped latency matrix to Kahu, disabled if empty
+	PreferIP          string `validate:"ipfamily" json:"prefer_ip"`                          // Prefer ipv4 or ipv6 addresses when resolving neighbor domains
+	Hostname          string `json:"hostname"`                                               // Hostname reported in heartbeats, the system hostname if empty
+	IPSource          string `default:"public" validate:"ipsource" json:"ip_source"`         // Source of the heartbeat IP: public, static, interface, stun, or metadata
+	IPAddress         string `validate:"ipaddr" json:"ip_address"`                           // IP address reported in heartbeats with the static ip source
+	IPv6Source        string `default:"public" validate:"ip6source" json:"ip6_source"`       // Source of the heartbeat IPv6: public, static, interface, or none
+	IPv6Address       string `validate:"ipaddr" json:"ip6_address"`                          // IPv6 address reported in heartbeats with the static ip6 source
+	IPInterface       string `json:"ip_interface"`                                           // Network interface to report the address of, e.g. eth0
+	STUNServer        string `default:"stun.l.google.com:19302" json:"stun_server"`          // STUN server to discover the address after NAT with
+	MetadataURL       string `validate:"url" json:"metadata_url"`                            // Cloud metadata endpoint that returns the IP as plain text
+	ReportSkew        bool   `default:"false" json:"report_skew"`                            // Include clock skew estimates in latency reports
+	ProbeFallback     bool   `default:"true" json:"probe_fallback"`                          // Probe with TCP connect if the echo server is down
+	NTPServer         string `default:"pool.ntp.org" json:"ntp_server"`                      // Comma separated NTP servers the local clock is compared with
+	ClockInterval     string `validate:"duration" json:"clock_interval"`                     // Interval between measuring the clock skew reported to Kahu, e.g. 15m, disabled if empty
+	ClockSkewWarn     string `default:"100ms" validate:"duration" json:"clock_skew_warn"`    // Clock skew beyond which a warning is logged, latencies are unreliable
+	TargetSelection   string `default:"all" validate:"selection" json:"target_selection"`    // Neighbors to ping each cycle: all, random, hash, or round-robin
+	TargetCount       int    `default:"16" validate:"uint" json:"target_count"`              // Max neighbors pinged each cycle unless target_selection is all
+	TargetRotation    string `default:"1h" validate:"duration" json:"target_rotation"`       // How often the hash target selection picks a new subset
+	DownStates        string `default:"offline,unhealthy,down" json:"down_states"`           // Comma separated neighbor states that Kahu reports for down hosts, which are skipped
+	ProbationInterval string `default:"5m" validate:"duration" json:"probation_interval"`    // Interval between pings to down neighbors, never pinged if zero
+	NeighborFallback  string `validate:"discovery" json:"neighbor_fallback"`                 // Discover neighbors from "peers" or "srv" if Kahu is unreachable
+	NeighborSRV       string `json:"neighbor_srv"`                                           // DNS SRV record to discover neighbors from, e.g. _kekahu._tcp.example.com
+	ProbePort         int    `default:"22" validate:"uint" json:"probe_port"`                // Port to connect to for TCP fallback probes
+	Tags              string `validate:"tags" json:"tags"`                                   // Comma separated key=value labels sent with heartbeats
+	Services          string `validate:"services" json:"services"`                           // Local services sent with heartbeats, e.g. "name port version command; ..."
+	ServiceTimeout    string `default:"2s" validate:"duration" json:"service_timeout"`       // Timeout for checking the ports and versions of local services
+	Maintenance       string `validate:"maintenance" json:"maintenance"`                     // Recurring maintenance windows, e.g. "0 2 * * sun 2h; ..."
+	MaintenanceMode   string `default:"tag" validate:"maintmode" json:"maintenance_mode"`    // Either "tag" or "suppress" heartbeats during maintenance
+	SendHealth        bool   `default:"true" json:"send_health"`                             // Send system health to Kahu
+	HealthEchoStats   bool   `default:"false" json:"health_echo_stats"`                      // Include the pings received by the echo server by source in health reports
+	HealthDelta       bool   `default:"false" json:"health_delta"`                           // Send only the fields of the health report that changed since the last report
+	HealthRefresh     string `default:"1h" validate:"duration" json:"health_refresh"`        // Interval between full health reports when health_delta is enabled
+	HealthScope       string `default:"auto" validate:"healthscope" json:"health_scope"`     // Report memory and CPU of the container (auto if detected) or the host
+	ContainerImage    string `json:"container_image"`                                        // Image of the container kekahu runs in, reported in health reports
+	DryRun            bool   `default:"false" json:"dry_run"`                                // Log reports to Kahu instead of sending them
+	Force             bool   `default:"false" json:"force"`                                  // Replace the PID file of a running process that is not a kekahu service
+	DiskPaths         string `json:"disk_paths"`                                             // Comma separated mount points to report disk usage for
+	HealthRules       string `validate:"healthrules" json:"health_rules"`                    // Comma separated thresholds that raise alerts, e.g. cpu_percent>95
+	HealthHook        string `validate:"path" json:"health_hook"`                            // Script to execute when a health rule is crossed
+	HealthTimeout     string `default:"10s" validate:"duration" json:"health_timeout"`       // Max time to collect the system health, failing components that take longer
+	CPUSample         string `default:"5s" validate:"duration" json:"cpu_sample"`            // Window to measure the CPU utilization of the system health over
+	Hooks             string `validate:"hooks" json:"hooks"`                                 // Commands to run on events, e.g. "failure /path/to/script; inactive ...; ..."
+	HookFailures      int    `default:"3" validate:"uint" json:"hook_failures"`              // Consecutive heartbeat failures that trigger the failure hooks
+	HookLatency       string `validate:"duration" json:"hook_latency"`                       // Latency to a neighbor that triggers the latency hooks, disabled if empty
+	HookTimeout       string `default:"30s" validate:"duration" json:"hook_timeout"`         // Max time a hook may run before it is killed
+	DeadmanFailures   int    `default:"5" validate:"uint" json:"deadman_failures"`           // Consecutive heartbeat failures that trip the dead man's switch, disabled if 0
+	DeadmanPath       string `validate:"path" json:"deadman_path"`                           // Path of the state file written while the switch is tripped, ~/.kekahu.deadman.json if empty
+	TLSCert           string `validate:"path" json:"tls_cert"`                               // Path to the certificate for mutual TLS pings
+	TLSKey            string `validate:"path" json:"tls_key"`                                // Path to the private key for mutual TLS pings
+	TLSCA             string `validate:"path" json:"tls_ca"`                                 // Path to the CA certificate to verify peers
+	PingSecret        string `json:"ping_secret"`                                            // Cluster secret to sign pings with, distributed by Kahu if empty
+	PingAuth          bool   `default:"false" json:"ping_auth"`                              // Reject pings that are not signed with the cluster secret
+	StatusAddr        string `json:"status_addr"`                                            // Address of the local status server, disabled if empty
+	MetricsAddr       string `json:"metrics_addr"`                                           // Address to serve Prometheus metrics on, disabled if empty
+	OTLPEndpoint      string `validate:"otlp" json:"otlp_endpoint"`                          // OpenTelemetry collector to push metrics to, disabled if empty
+	OTLPInterval      string `default:"1m" validate:"duration" json:"otlp_interval"`         // Interval between pushes of metrics to the collector
+	OTLPHeaders       string `validate:"tags" json:"otlp_headers"`                           // Comma separated key=value headers sent to the collector
+	StateDir          string `validate:"path" json:"state_dir"`                              // Directory to keep durable state in, ~/.local/share/kekahu (or the platform equivalent) if empty
+	PidPath           string `validate:"path" json:"pid_path"`                               // Path to write the PID file of the running service, relative to the state directory, kekahu.pid if empty
+	ControlPath       string `validate:"path" json:"control_path"`                           // Path of the control socket of the running service, ~/.kekahu.sock if empty
+	RetryAttempts     int    `default:"3" validate:"uint" json:"retry_attempts"`             // Max attempts for Kahu API requests
+	RetryDelay        string `default:"500ms" validate:"duration" json:"retry_delay"`        // Base delay for exponential backoff between retries
+	RetryMaxDelay     string `default:"30s" validate:"duration" json:"retry_max_delay"`      // Max delay between retries
+	HeartbeatAttempts int    `default:"5" validate:"uint" json:"heartbeat_attempts"`         // Max attempts for heartbeats, overrides retry_attempts
+	HeartbeatActions  string `validate:"hbactions" json:"heartbeat_actions"`                 // Actions on heartbeats Kahu rejects by status, overriding the defaults, e.g. 410=retry,5xx=backoff
+	HeartbeatBackoff  string `default:"30m" validate:"duration" json:"heartbeat_backoff"`    // Max delay between heartbeats while backing off
+	LatencyAttempts   int    `default:"1" validate:"uint" json:"latency_attempts"`           // Max attempts for latency reports, overrides retry_attempts
+	SpoolPath         string `validate:"path" json:"spool_path"`                             // Path to buffer failed reports to replay, relative to the state directory, disabled if empty
+	SpoolSize         int    `default:"1000" validate:"uint" json:"spool_size"`              // Max number of buffered reports, oldest dropped first
+	SpoolTTL          string `default:"24h" validate:"duration" json:"spool_ttl"`            // Max age of buffered reports before they are dropped
+	JournalPath       string `validate:"path" json:"journal_path"`                           // Path to record recent errors to, ~/.kekahu.errors.json if empty
+	JournalSize       int    `default:"100" validate:"uint" json:"journal_size"`             // Max number of recorded errors, disabled if zero
+	IdentityPath      string `validate:"path" json:"identity_path"`                          // Path to save the replica identity assigned by Kahu, relative to the state directory, replica.json if empty
+	UpdateURL         string `validate:"url" json:"update_url"`                              // Release endpoint to check for new versions, GitHub if empty
+	AutoUpdate        bool   `default:"false" json:"auto_update"`                            // Install new releases and restart automatically
+	UpdateInterval    string `default:"24h" validate:"duration" json:"update_interval"`      // Delay between automatic checks for new releases
+	UpdateKey         string `validate:"updatekey" json:"update_key"`                        // Base64 ed25519 public key that releases are signed with if no ReleaseKey is pinned
+}
+
+// Load the configuration from default values, then from a configuration file,
+// and finally from the environment. Validate the configuration on complete.
+func (c *Config) Load() error {
+	if err := c.load(); err != nil {
+		return err
+	}
+
+	// Validate the loaded configuration
+	return c.validate()
+}
+
+// Loads the configuration from the default values, the configuration file,
+// and the environment without validating it.
+func (c *Config) load() error {
+	loaders := []multiconfig.Loader{}
+
+	// Read default values defined via tag fields "default"
+	loaders = append(loaders, &multiconfig.TagLoader{})
+
+	// Find the config path and add the appropriate file loader
+	path, err := FindConfigPath()
+	if err == nil {
+		if strings.HasSuffix(path, "toml") {
+			loaders = append(loaders, &multiconfig.TOMLLoader{Path: path})
+		}
+
+		if strings.HasSuffix(path, "json") {
+			loaders = append(loaders, &multiconfig.JSONLoader{Path: path})
+		}
+
+		if strings.HasSuffix(path, "yml") || strings.HasSuffix(path, "yaml") {
+			loaders = append(loaders, &multiconfig.YAMLLoader{Path: path})
+		}
+	}
+
+	// Apply the selected profile from the config file over its other values
+	loaders = append(loaders, &profileLoader{path: path})
+
+	// Load the environment variable loader
+	env := &multiconfig.EnvironmentLoader{Prefix: "KEKAHU", CamelCase: true}
+	loaders = append(loaders, env)
+
+	loader := multiconfig.MultiLoader(loaders...)
+	return loader.Load(c)
+}
+
+// Update the configuration from another configuration struct
+func (c *Config) Update(o *Config) error {
+	c.update(o)
+
+	// Validate the newly updated config
+	return c.validate()
+}
+
+// Updates the configuration with the non-zero values of the other config
+// without validating it.
+func (c *Config) update(o *Config) {
+	conf := structs.New(c)
+	for _, field := range structs.Fields(o) {
+		if !field.IsZero() {
+			updateField := conf.Field(field.Name())
+			updateField.Set(field.Value())
+		}
+	}
+}
+
+// sharedConfig is the configuration shared by the service and its client. It
+// is replaced rather than modified when the configuration is reloaded, so that
+// the tasks that read it while it is reloaded don't race with the reload. The
+// configuration returned by Load must not be modified.
+type sharedConfig struct {
+	value atomic.Value
+}
+
+// Returns the configuration shared until it is replaced by Store.
+func newSharedConfig(c *Config) *sharedConfig {
+	s := new(sharedConfig)
+	s.Store(c)
+	return s
+}
+
+// Load returns the current configuration.
+func (s *sharedConfig) Load() *Config {
+	return s.value.Load().(*Config)
+}
+
+// Store replaces the configuration.
+func (s *sharedConfig) Store(c *Config) {
+	s.value.Store(c)
+}
+
+// Validates the required and complex fields of the configuration.
+func (c *Config) validate() error {
+	validators := multiconfig.MultiValidator(
+		&multiconfig.RequiredValidator{},
+		&ComplexValidator{},
+	)
+	return validators.Validate(c)
+}
+
+// Validates the configuration without requiring the API key, so that the
+// service can run local-only until the API key is provisioned.
+func (c *Config) validateLocal() error {
+	return new(ComplexValidator).Validate(c)
+}
+
+// GetURL parses the url and returns it
+func (c *Config) GetURL() (*url.URL, error) {
+	return url.Parse(c.URL)
+}
+
+// GetSchedule parses the heartbeat interval and jitter and returns the
+// schedule of the heartbeats, see ParseSchedule for the format.
+func (c *Config) GetSchedule() (Schedule, error) {
+	jitter, err := c.GetJitter()
+	if err != nil {
+		return nil, err
+	}
+	return ParseSchedule(c.Interval, jitter)
+}
+
+// GetJitter parses the jitter duration and returns it
+func (c *Config) GetJitter() (time.Duration, error) {
+	return time.ParseDuration(c.Jitter)
+}
+
+// GetLatencyInterval parses the latency measurement interval and returns it,
+// returning zero if latencies are measured after every heartbeat instead
+func (c *Config) GetLatencyInterval() (time.Duration, error) {
+	if c.LatencyInterval == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(c.LatencyInterval)
+}
+
+// GetSyncInterval parses the peers sync interval and returns it, returning
+// zero if periodic syncs are disabled
+func (c *Config) GetSyncInterval() (time.Duration, error) {
+	if c.SyncInterval == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(c.SyncInterval)
+}
+
+// GetBandwidthInterval parses the bandwidth measurement interval and returns
+// it, returning zero if bandwidth measurements are disabled
+func (c *Config) GetBandwidthInterval() (time.Duration, error) {
+	if c.BandwidthInterval == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(c.BandwidthInterval)
+}
+
+// GetGossipInterval parses the interval between latency matrix reports and
+// returns it, returning zero if the matrix is not reported to Kahu
+func (c *Config) GetGossipInterval() (time.Duration, error) {
+	if c.GossipInterval == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(c.GossipInterval)
+}
+
+// GetBandwidthDuration parses the bandwidth measurement duration and returns it
+func (c *Config) GetBandwidthDuration() (time.Duration, error) {
+	return time.ParseDuration(c.BandwidthDuration)
+}
+
+// GetBandwidthPayload returns the size of the chunks streamed to measure
+// bandwidth, returning an error if the chunks are too large to send.
+func (c *Config) GetBandwidthPayload() (int, error) {
+	if c.BandwidthPayload <= 0 || c.BandwidthPayload > knet.MaxBandwidthPayload {
+		return 0, fmt.Errorf("bandwidth payload must be between 1 and %d bytes", knet.MaxBandwidthPayload)
+	}
+	return c.BandwidthPayload, nil
+}
+
+// GetCheckpoint parses the latency metrics checkpoint interval and returns it
+func (c *Config) GetCheckpoint() (time.Duration, error) {
+	return time.ParseDuration(c.Checkpoint)
+}
+
+// GetNTPServers returns the NTP servers the local clock is compared with.
+func (c *Config) GetNTPServers() []string {
+	servers := make([]string, 0)
+	for _, server := range strings.Split(c.NTPServer, ",") {
+		if server = strings.TrimSpace(server); server != "" {
+			servers = append(servers, server)
+		}
+	}
+	return servers
+}
+
+// GetClockInterval parses the interval between clock skew measurements and
+// returns it, returning zero if the clock skew is not measured
+func (c *Config) GetClockInterval() (time.Duration, error) {
+	if c.ClockInterval == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(c.ClockInterval)
+}
+
+// GetClockSkewWarn parses the clock skew warning threshold and returns it,
+// returning DiagnosisSkewWarn if it is not set
+func (c *Config) GetClockSkewWarn() (time.Duration, error) {
+	if c.ClockSkewWarn == "" {
+		return DiagnosisSkewWarn, nil
+	}
+	return time.ParseDuration(c.ClockSkewWarn)
+}
+
+// GetPingIdle parses the ping connection idle timeout and returns it
+func (c *Config) GetPingIdle() (time.Duration, error) {
+	return time.ParseDuration(c.PingIdle)
+}
+
+// GetSampleFilter returns the filter of the latency samples added to the
+// statistics of each neighbor, or nil if neither warm-up pings nor outliers
+// are left out of the statistics.
+func (c *Config) GetSampleFilter() (*SampleFilter, error) {
+	method, threshold, err := ParseOutlierFilter(c.OutlierFilter)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.WarmupPings <= 0 && method == "" {
+		return nil, nil
+	}
+
+	idle, err := c.GetPingIdle()
+	if err != nil {
+		return nil, err
+	}
+
+	return &SampleFilter{Warmup: c.WarmupPings, Idle: idle, Outliers: method, Threshold: threshold}, nil
+}
+
+// DiscardWarmup returns true if warm-up pings are not reported to Kahu.
+func (c *Config) DiscardWarmup() bool {
+	return strings.ToLower(c.WarmupPolicy) == DiscardWarmup
+}
+
+// GetSpoolTTL parses the spool ttl duration and returns it
+func (c *Config) GetSpoolTTL() (time.Duration, error) {
+	return time.ParseDuration(c.SpoolTTL)
+}
+
+// GetUpdateURL returns the release endpoint, defaulting to GitHub releases
+func (c *Config) GetUpdateURL() string {
+	if c.UpdateURL == "" {
+		return DefaultUpdateURL
+	}
+	return c.UpdateURL
+}
+
+// GetUpdateKey returns the public key that releases must be signed with, the
+// ReleaseKey pinned when kekahu was built or the update_key if none is pinned,
+// so that the configuration can't replace the pinned key
+func (c *Config) GetUpdateKey() (ed25519.PublicKey, error) {
+	value := ReleaseKey
+	if value == "" {
+		value = c.UpdateKey
+	}
+
+	if value == "" {
+		return nil, errors.New("no release signing key is pinned, set update_key")
+	}
+	return parseReleaseKey(value)
+}
+
+// GetControlPath returns the path of the control socket of the running
+// service, defaulting to .kekahu.sock in the user's home directory.
+func (c *Config) GetControlPath() string {
+	if c.ControlPath != "" {
+		return c.ControlPath
+	}
+
+	if user, err := user.Current(); err == nil {
+		return filepath.Join(user.HomeDir, ".kekahu.sock")
+	}
+	return filepath.Join(os.TempDir(), "kekahu.sock")
+}
+
+// GetJournalPath returns the path of the error journal, defaulting to a file
+// in the home directory of the user so the CLI can find it without config.
+func (c *Config) GetJournalPath() string {
+	if c.JournalPath != "" {
+		return c.JournalPath
+	}
+
+	if user, err := user.Current(); err == nil {
+		return filepath.Join(user.HomeDir, ".kekahu.errors.json")
+	}
+	return filepath.Join(os.TempDir(), "kekahu.errors.json")
+}
+
+// GetDeadmanPath returns the path of the state file that is written while the
+// dead man's switch is tripped, defaulting to a file in the home directory.
+func (c *Config) GetDeadmanPath() string {
+	if c.DeadmanPath != "" {
+		return c.DeadmanPath
+	}
+
+	if user, err := user.Current(); err == nil {
+		return filepath.Join(user.HomeDir, ".kekahu.deadman.json")
+	}
+	return filepath.Join(os.TempDir(), "kekahu.deadman.json")
+}
+
+// GetOTLPEndpoint returns the URL of the OTLP/HTTP metrics endpoint of the
+// collector, appending /v1/metrics if the configured endpoint has no path.
+func (c *Config) GetOTLPEndpoint() (string, error) {
+	return otlpEndpoint(c.OTLPEndpoint)
+}
+
+// GetOTLPInterval parses the OTLP export interval and returns it
+func (c *Config) GetOTLPInterval() (time.Duration, error) {
+	return time.ParseDuration(c.OTLPInterval)
+}
+
+// GetOTLPHeaders parses the comma separated key=value headers sent with OTLP
+// exports (e.g. to authenticate with the collector) and returns them.
+func (c *Config) GetOTLPHeaders() (map[string]string, error) {
+	return ParseTags(c.OTLPHeaders)
+}
+
+// GetUpdateInterval parses the auto update check interval and returns it
+func (c *Config) GetUpdateInterval() (time.Duration, error) {
+	return time.ParseDuration(c.UpdateInterval)
+}
+
+// GetDiskPaths returns the mount points to report disk usage for, defaulting
+// to the root or system drive of the host if none are configured.
+func (c *Config) GetDiskPaths() []string {
+	paths := make([]string, 0)
+	for _, path := range strings.Split(c.DiskPaths, ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			paths = append(paths, path)
+		}
+	}
+
+	if len(paths) == 0 {
+		return doctor.DefaultDiskPaths()
+	}
+	return paths
+}
+
+// GetHealthTimeout parses the system health collection timeout and returns it
+func (c *Config) GetHealthTimeout() (time.Duration, error) {
+	return time.ParseDuration(c.HealthTimeout)
+}
+
+// GetHealthRefresh parses the interval between full health reports and returns it
+func (c *Config) GetHealthRefresh() (time.Duration, error) {
+	return time.ParseDuration(c.HealthRefresh)
+}
+
+// GetCPUSample parses the CPU utilization sample window and returns it
+func (c *Config) GetCPUSample() (time.Duration, error) {
+	return time.ParseDuration(c.CPUSample)
+}
+
+// GetAnomalyInterval parses the interval between pings to anomalous targets
+func (c *Config) GetAnomalyInterval() (time.Duration, error) {
+	return time.ParseDuration(c.AnomalyInterval)
+}
+
+// GetAnomalyDuration parses how long anomalous targets are pinged more often
+func (c *Config) GetAnomalyDuration() (time.Duration, error) {
+	return time.ParseDuration(c.AnomalyDuration)
+}
+
+// GetLogOutputs parses the destinations of log messages and returns them, see
+// ParseLogOutputs for the format.
+func (c *Config) GetLogOutputs() ([]*LogOutput, error) {
+	return ParseLogOutputs(c.LogOutputs)
+}
+
+// GetLogRotation returns when log files are rotated and how many are kept.
+func (c *Config) GetLogRotation() (*LogRotation, error) {
+	rotation := &LogRotation{MaxSize: int64(c.LogMaxSize) << 20, MaxBackups: c.LogMaxBackups}
+	if c.LogMaxAge != "" {
+		age, err := time.ParseDuration(c.LogMaxAge)
+		if err != nil {
+			return nil, err
+		}
+		rotation.MaxAge = age
+	}
+	return rotation, nil
+}
+
+// GetRecordRotation returns when the ping recording is rotated and how many
+// rotated recordings are kept.
+func (c *Config) GetRecordRotation() (*LogRotation, error) {
+	rotation := &LogRotation{MaxSize: int64(c.RecordMaxSize) << 20, MaxBackups: c.RecordMaxBackups}
+	if c.RecordMaxAge != "" {
+		age, err := time.ParseDuration(c.RecordMaxAge)
+		if err != nil {
+			return nil, err
+		}
+		rotation.MaxAge = age
+	}
+	return rotation, nil
+}
+
+// GetHooks parses the commands to run on events and returns them, see
+// ParseHooks for the format.
+func (c *Config) GetHooks() ([]*Hook, error) {
+	return ParseHooks(c.Hooks)
+}
+
+// GetHeartbeatActions returns the actions taken on the statuses that Kahu
+// rejects heartbeats with, the DefaultHeartbeatActions overridden by the
+// configured actions.
+func (c *Config) GetHeartbeatActions() (*HeartbeatActions, error) {
+	return ParseHeartbeatActions(DefaultHeartbeatActions + "," + c.HeartbeatActions)
+}
+
+// GetHeartbeatBackoff parses the max delay between heartbeats while they back
+// off and returns it.
+func (c *Config) GetHeartbeatBackoff() (time.Duration, error) {
+	return time.ParseDuration(c.HeartbeatBackoff)
+}
+
+// GetHookLatency parses the latency threshold of the latency hooks and
+// returns it, returning zero if latency hooks are disabled
+func (c *Config) GetHookLatency() (time.Duration, error) {
+	if c.HookLatency == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(c.HookLatency)
+}
+
+// GetHookTimeout parses the maximum time a hook may run and returns it
+func (c *Config) GetHookTimeout() (time.Duration, error) {
+	return time.ParseDuration(c.HookTimeout)
+}
+
+// GetHealthRules parses the comma separated health rules and returns them
+func (c *Config) GetHealthRules() ([]*kahu.HealthRule, error) {
+	return kahu.ParseHealthRules(c.HealthRules)
+}
+
+// GetUpstreams parses the additional Kahu services to report to and returns
+// them, see ParseUpstreams for the format.
+func (c *Config) GetUpstreams() ([]*Upstream, error) {
+	return ParseUpstreams(c.Upstreams)
+}
+
+// GetTargetRotation parses how often the hash target selection is rotated
+func (c *Config) GetTargetRotation() (time.Duration, error) {
+	return time.ParseDuration(c.TargetRotation)
+}
+
+// GetDownStates returns the lowercase neighbor states that indicate the
+// neighbor is down
+func (c *Config) GetDownStates() []string {
+	states := make([]string, 0)
+	for _, state := range strings.Split(c.DownStates, ",") {
+		if state = strings.ToLower(strings.TrimSpace(state)); state != "" {
+			states = append(states, state)
+		}
+	}
+	return states
+}
+
+// GetProbationInterval parses the interval between pings to down neighbors
+// and returns it
+func (c *Config) GetProbationInterval() (time.Duration, error) {
+	if c.ProbationInterval == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(c.ProbationInterval)
+}
+
+// GetEchoInterceptors returns the names of the enabled interceptors of the
+// gRPC echo server in the order they are applied, see Interceptors.
+func (c *Config) GetEchoInterceptors() []string {
+	interceptors := make([]string, 0, 3)
+	if c.EchoLogging {
+		interceptors = append(interceptors, knet.LoggingInterceptor)
+	}
+	if c.EchoMetrics {
+		interceptors = append(interceptors, knet.MetricsInterceptor)
+	}
+	if c.EchoRecovery {
+		interceptors = append(interceptors, knet.RecoveryInterceptor)
+	}
+	return interceptors
+}
+
+// GetPingProxies parses the proxies that pings are sent through by target and
+// returns them, see ParsePingProxies for the format.
+func (c *Config) GetPingProxies() (*knet.PingProxies, error) {
+	return knet.ParsePingProxies(c.PingProxies)
+}
+
+// GetPingSize returns the size of the payload each ping carries, returning an
+// error if the pings are too large to send with the ping transport.
+func (c *Config) GetPingSize() (int, error) {
+	max := knet.MaxPingSize
+	if strings.ToLower(c.PingTransport) == knet.UDPTransport {
+		max = knet.MaxUDPPingSize
+	}
+
+	if c.PingSize < 0 || c.PingSize > max {
+		return 0, fmt.Errorf("ping size must be between 0 and %d bytes", max)
+	}
+	return c.PingSize, nil
+}
+
+// GetEchoTransports parses the transports the echo server listens for pings
+// on and returns them, see ParseTransports for the format.
+func (c *Config) GetEchoTransports() ([]string, error) {
+	return knet.ParseTransports(c.EchoTransports)
+}
+
+// GetServices parses the local services to report with heartbeats and
+// returns them, see ParseServices for the format.
+func (c *Config) GetServices() ([]*LocalService, error) {
+	return ParseServices(c.Services)
+}
+
+// GetServiceTimeout parses the local service probe timeout and returns it
+func (c *Config) GetServiceTimeout() (time.Duration, error) {
+	return time.ParseDuration(c.ServiceTimeout)
+}
+
+// GetMaintenanceWindows parses the recurring maintenance windows and returns them
+func (c *Config) GetMaintenanceWindows() ([]*MaintenanceWindow, error) {
+	return ParseMaintenanceWindows(c.Maintenance)
+}
+
+// GetMaintenanceMode returns whether heartbeats are tagged or suppressed
+// during maintenance, tagging them by default
+func (c *Config) GetMaintenanceMode() string {
+	if strings.EqualFold(c.MaintenanceMode, MaintenanceSuppress) {
+		return MaintenanceSuppress
+	}
+	return MaintenanceTag
+}
+
+// GetHealthScope returns the scope of the memory and CPU fields of the health
+// report, detecting whether kekahu runs in a container by default
+func (c *Config) GetHealthScope() string {
+	switch scope := strings.ToLower(c.HealthScope); scope {
+	case doctor.HostScope, doctor.ContainerScope:
+		return scope
+	default:
+		return doctor.AutoScope
+	}
+}
+
+// GetTags parses the comma separated key=value tags and returns them as a map
+func (c *Config) GetTags() (map[string]string, error) {
+	return ParseTags(c.Tags)
+}
+
+// GetAPIIdleTimeout parses the idle keep-alive connection timeout and returns it
+func (c *Config) GetAPIIdleTimeout() (time.Duration, error) {
+	return time.ParseDuration(c.APIIdleTimeout)
+}
+
+// GetAPITLSTimeout parses the TLS handshake timeout and returns it
+func (c *Config) GetAPITLSTimeout() (time.Duration, error) {
+	return time.ParseDuration(c.APITLSTimeout)
+}
+
+// GetAPITimeout parses the api timeout duration and returns it
+func (c *Config) GetAPITimeout() (time.Duration, error) {
+	return time.ParseDuration(c.APITimeout)
+}
+
+// AutoSchema is the api_schema that negotiates the schema of the reports with
+// Kahu when the service starts.
+const AutoSchema = "auto"
+
+// GetAPISchema returns the schema version of the reports posted to Kahu, zero
+// if it is negotiated with Kahu.
+func (c *Config) GetAPISchema() (int, error) {
+	return ParseAPISchema(c.APISchema)
+}
+
+// ParseAPISchema parses an api_schema, either auto (or empty) to negotiate the
+// schema with Kahu, which is returned as zero, or a schema version to pin.
+func ParseAPISchema(s string) (int, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "" || s == AutoSchema {
+		return 0, nil
+	}
+
+	schema, err := strconv.Atoi(s)
+	if err != nil || schema < kahu.SchemaV1 || schema > kahu.LatestSchema {
+		return 0, fmt.Errorf("'%s' must be %s or a schema version from %d to %d", s, AutoSchema, kahu.SchemaV1, kahu.LatestSchema)
+	}
+	return schema, nil
+}
+
+// GetPingTimeout parses the ping timeout duration and returns it
+func (c *Config) GetPingTimeout() (time.Duration, error) {
+	return time.ParseDuration(c.PingTimeout)
+}
+
+// ParseTags parses a comma separated list of key=value pairs into a map.
+func ParseTags(s string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		parts := strings.SplitN(pair, "=", 2)
+		key := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || key == "" {
+			return nil, fmt.Errorf("tag '%s' is not a key=value pair", pair)
+		}
+		tags[key] = strings.TrimSpace(parts[1])
+	}
+	return tags, nil
+}
+
+//===========================================================================
+// Validators
+//===========================================================================
+
+// ComplexValidator validates complex types that multiconfig doesn't understand
+type ComplexValidator struct {
+	TagName string
+}
+
+// Validate implements the multiconfig.Validator interface.
+func (v *ComplexValidator) Validate(s interface{}) error {
+	if v.TagName == "" {
+		v.TagName = "validate"
+	}
+
+	for _, field := range structs.Fields(s) {
+		if err := v.processField("", field); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (v *ComplexValidator) processField(fieldName string, field *structs.Field) error {
+	fieldName += field.Name()
+	switch field.Kind() {
+	case reflect.Struct:
+		fieldName += "."
+		for _, f := range field.Fields() {
+			if err := v.processField(fieldName, f); err != nil {
+				return err
+			}
+		}
+	default:
+		if field.IsZero() {
+			return nil
+		}
+
+		switch strings.ToLower(field.Tag(v.TagName)) {
+		case "":
+			return nil
+		case "duration":
+			return v.processDurationField(fieldName, field)
+		case "updatekey":
+			return v.processUpdateKeyField(fieldName, field)
+		case "url":
+			return v.processURLField(fieldName, field)
+		case "path":
+			return v.processPathField(fieldName, field)
+		case "uint":
+			return v.processUintField(fieldName, field)
+		case "tags":
+			return v.processTagsField(fieldName, field)
+		case "ipfamily":
+			return v.processIPFamilyField(fieldName, field)
+		case "peersformat":
+			return v.processPeersFormatField(fieldName, field)
+		case "healthrules":
+			return v.processHealthRulesField(fieldName, field)
+		case "upstreams":
+			return v.processUpstreamsField(fieldName, field)
+		case "otlp":
+			return v.processOTLPField(fieldName, field)
+		case "transport":
+			return v.processTransportField(fieldName, field)
+		case "transports":
+			return v.processTransportsField(fieldName, field)
+		case "proxies":
+			return v.processProxiesField(fieldName, field)
+		case "services":
+			return v.processServicesField(fieldName, field)
+		case "discovery":
+			return v.processDiscoveryField(fieldName, field)
+		case "selection":
+			return v.processSelectionField(fieldName, field)
+		case "ipsource":
+			return v.processIPSourceField(fieldName, field)
+		case "ip6source":
+			return v.processIPv6SourceField(fieldName, field)
+		case "ipaddr":
+			return v.processIPAddrField(fieldName, field)
+		case "maintenance":
+			return v.processMaintenanceField(fieldName, field)
+		case "maintmode":
+			return v.processMaintenanceModeField(fieldName, field)
+		case "hooks":
+			return v.processHooksField(fieldName, field)
+		case "hbactions":
+			return v.processHeartbeatActionsField(fieldName, field)
+		case "logoutputs":
+			return v.processLogOutputsField(fieldName, field)
+		case "healthscope":
+			return v.processHealthScopeField(fieldName, field)
+		case "warmup":
+			return v.processWarmupField(fieldName, field)
+		case "schema":
+			return v.processSchemaField(fieldName, field)
+		case "outliers":
+			return v.processOutliersField(fieldName, field)
+		case "recordformat":
+			return v.processRecordFormatField(fieldName, field)
+		case "schedule":
+			return v.processScheduleField(fieldName, field)
+		case "apikey":
+			return v.processAPIKeyField(fieldName, field)
+		default:
+			return fmt.Errorf("cannot validate type '%s'", field.Tag(v.TagName))
+		}
+
+	}
+
+	return nil
+}
+
+func (v *ComplexValidator) processDurationField(fieldName string, field *structs.Field) error {
+	d, err := time.ParseDuration(field.Value().(string))
+	if err != nil {
+		return fmt.Errorf("could not validate %s: %s", fieldName, err.Error())
+	}
+
+	if d < 0 {
+		return fmt.Errorf("%s is less than zero", fieldName)
+	}
+	return nil
+}
+
+func (v *ComplexValidator) processURLField(fieldName string, field *structs.Field) error {
+	if _, err := url.Parse(field.Value().(string)); err != nil {
+		return fmt.Errorf("could not validate %s: %s", fieldName, err.Error())
+	}
+
+	return nil
+}
+
+func (v *ComplexValidator) processPathField(fieldName string, field *structs.Field) error {
+	// No path validation quite yet
+	return nil
+}
+
+func (v *ComplexValidator) processTagsField(fieldName string, field *structs.Field) error {
+	if _, err := ParseTags(field.Value().(string)); err != nil {
+		return fmt.Errorf("could not validate %s: %s", fieldName, err.Error())
+	}
+	return nil
+}
+
+func (v *ComplexValidator) processPeersFormatField(fieldName string, field *structs.Field) error {
+	format := strings.ToLower(field.Value().(string))
+	for _, name := range PeersFormats() {
+		if format == name {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s must be one of %s", fieldName, strings.Join(PeersFormats(), ", "))
+}
+
+func (v *ComplexValidator) processHealthRulesField(fieldName string, field *structs.Field) error {
+	if _, err := kahu.ParseHealthRules(field.Value().(string)); err != nil {
+		return fmt.Errorf("could not validate %s: %s", fieldName, err.Error())
+	}
+	return nil
+}
+
+func (v *ComplexValidator) processUpstreamsField(fieldName string, field *structs.Field) error {
+	if _, err := ParseUpstreams(field.Value().(string)); err != nil {
+		return fmt.Errorf("could not validate %s: %s", fieldName, err.Error())
+	}
+	return nil
+}
+
+func (v *ComplexValidator) processOTLPField(fieldName string, field *structs.Field) error {
+	if _, err := otlpEndpoint(field.Value().(string)); err != nil {
+		return fmt.Errorf("could not validate %s: %s", fieldName, err.Error())
+	}
+	return nil
+}
+
+func (v *ComplexValidator) processTransportField(fieldName string, field *structs.Field) error {
+	if !knet.IsTransport(strings.ToLower(field.Value().(string))) {
+		return fmt.Errorf("%s must be one of %s", fieldName, strings.Join(knet.Transports(), ", "))
+	}
+	return nil
+}
+
+func (v *ComplexValidator) processTransportsField(fieldName string, field *structs.Field) error {
+	if _, err := knet.ParseTransports(field.Value().(string)); err != nil {
+		return fmt.Errorf("could not validate %s: %s", fieldName, err.Error())
+	}
+	return nil
+}
+
+func (v *ComplexValidator) processProxiesField(fieldName string, field *structs.Field) error {
+	if _, err := knet.ParsePingProxies(field.Value().(string)); err != nil {
+		return fmt.Errorf("could not validate %s: %s", fieldName, err.Error())
+	}
+	return nil
+}
+
+func (v *ComplexValidator) processServicesField(fieldName string, field *structs.Field) error {
+	if _, err := ParseServices(field.Value().(string)); err != nil {
+		return fmt.Errorf("could not validate %s: %s", fieldName, err.Error())
+	}
+	return nil
+}
+
+func (v *ComplexValidator) processDiscoveryField(fieldName string, field *structs.Field) error {
+	switch strings.ToLower(field.Value().(string)) {
+	case PeersDiscovery, SRVDiscovery:
+		return nil
+	default:
+		return fmt.Errorf("%s must be either %s or %s", fieldName, PeersDiscovery, SRVDiscovery)
+	}
+}
+
+func (v *ComplexValidator) processMaintenanceField(fieldName string, field *structs.Field) error {
+	if _, err := ParseMaintenanceWindows(field.Value().(string)); err != nil {
+		return fmt.Errorf("could not validate %s: %s", fieldName, err.Error())
+	}
+	return nil
+}
+
+func (v *ComplexValidator) processSelectionField(fieldName string, field *structs.Field) error {
+	selection := strings.ToLower(field.Value().(string))
+	for _, name := range TargetSelections() {
+		if selection == name {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s must be one of %s", fieldName, strings.Join(TargetSelections(), ", "))
+}
+
+func (v *ComplexValidator) processIPSourceField(fieldName string, field *structs.Field) error {
+	source := strings.ToLower(field.Value().(string))
+	for _, name := range IPSources() {
+		if source == name {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s must be one of %s", fieldName, strings.Join(IPSources(), ", "))
+}
+
+func (v *ComplexValidator) processIPv6SourceField(fieldName string, field *structs.Field) error {
+	source := strings.ToLower(field.Value().(string))
+	for _, name := range IPv6Sources() {
+		if source == name {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s must be one of %s", fieldName, strings.Join(IPv6Sources(), ", "))
+}
+
+func (v *ComplexValidator) processIPAddrField(fieldName string, field *structs.Field) error {
+	if net.ParseIP(field.Value().(string)) == nil {
+		return fmt.Errorf("%s must be an IP address", fieldName)
+	}
+	return nil
+}
+
+func (v *ComplexValidator) processMaintenanceModeField(fieldName string, field *structs.Field) error {
+	switch strings.ToLower(field.Value().(string)) {
+	case MaintenanceTag, MaintenanceSuppress:
+		return nil
+	default:
+		return fmt.Errorf("%s must be either %s or %s", fieldName, MaintenanceTag, MaintenanceSuppress)
+	}
+}
+
+func (v *ComplexValidator) processHooksField(fieldName string, field *structs.Field) error {
+	if _, err := ParseHooks(field.Value().(string)); err != nil {
+		return fmt.Errorf("could not validate %s: %s", fieldName, err.Error())
+	}
+	return nil
+}
+
+func (v *ComplexValidator) processHeartbeatActionsField(fieldName string, field *structs.Field) error {
+	if _, err := ParseHeartbeatActions(field.Value().(string)); err != nil {
+		return fmt.Errorf("could not validate %s: %s", fieldName, err.Error())
+	}
+	return nil
+}
+
+func (v *ComplexValidator) processLogOutputsField(fieldName string, field *structs.Field) error {
+	if _, err := ParseLogOutputs(field.Value().(string)); err != nil {
+		return fmt.Errorf("could not validate %s: %s", fieldName, err.Error())
+	}
+	return nil
+}
+
+func (v *ComplexValidator) processRecordFormatField(fieldName string, field *structs.Field) error {
+	if !isRecordFormat(strings.ToLower(field.Value().(string))) {
+		return fmt.Errorf("%s must be one of %s", fieldName, strings.Join(RecordFormats(), ", "))
+	}
+	return nil
+}
+
+func (v *ComplexValidator) processScheduleField(fieldName string, field *structs.Field) error {
+	if _, err := ParseSchedule(field.Value().(string), 0); err != nil {
+		return fmt.Errorf("could not validate %s: %s", fieldName, err)
+	}
+	return nil
+}
+
+func (v *ComplexValidator) processAPIKeyField(fieldName string, field *structs.Field) error {
+	if value := field.Value().(string); strings.HasPrefix(value, EncryptedPrefix) {
+		if _, err := parseSecret(value); err != nil {
+			return fmt.Errorf("could not validate %s: %s", fieldName, err)
+		}
+	}
+	return nil
+}
+
+func (v *ComplexValidator) processUpdateKeyField(fieldName string, field *structs.Field) error {
+	if _, err := parseReleaseKey(field.Value().(string)); err != nil {
+		return fmt.Errorf("could not validate %s: %s", fieldName, err)
+	}
+	return nil
+}
+
+func (v *ComplexValidator) processHealthScopeField(fieldName string, field *structs.Field) error {
+	switch strings.ToLower(field.Value().(string)) {
+	case doctor.AutoScope, doctor.HostScope, doctor.ContainerScope:
+		return nil
+	default:
+		return fmt.Errorf("%s must be %s, %s, or %s", fieldName, doctor.AutoScope, doctor.HostScope, doctor.ContainerScope)
+	}
+}
+
+func (v *ComplexValidator) processWarmupField(fieldName string, field *structs.Field) error {
+	switch strings.ToLower(field.Value().(string)) {
+	case DiscardWarmup, MarkWarmup:
+		return nil
+	default:
+		return fmt.Errorf("%s must be either %s or %s", fieldName, DiscardWarmup, MarkWarmup)
+	}
+}
+
+func (v *ComplexValidator) processSchemaField(fieldName string, field *structs.Field) error {
+	if _, err := ParseAPISchema(field.Value().(string)); err != nil {
+		return fmt.Errorf("could not validate %s: %s", fieldName, err.Error())
+	}
+	return nil
+}
+
+func (v *ComplexValidator) processOutliersField(fieldName string, field *structs.Field) error {
+	if _, _, err := ParseOutlierFilter(field.Value().(string)); err != nil {
+		return fmt.Errorf("could not validate %s: %s", fieldName, err.Error())
+	}
+	return nil
+}
+
+func (v *ComplexValidator) processIPFamilyField(fieldName string, field *structs.Field) error {
+	switch strings.ToLower(field.Value().(string)) {
+	case IPv4, IPv6:
+		return nil
+	default:
+		return fmt.Errorf("%s must be either %s or %s", fieldName, IPv4, IPv6)
+	}
+}
+
+func (v *ComplexValidator) processUintField(fieldName string, field *structs.Field) error {
+	val := field.Value().(int)
+	if val < 0 {
+		return fmt.Errorf("%s is less than zero", fieldName)
+	}
+	return nil
+}
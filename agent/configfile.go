@@ -0,0 +1,401 @@
+// Reads and updates individual values of the configuration file in place.
+
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/fatih/structs"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// ProfileEnv is the environment variable that selects the profile to apply.
+const ProfileEnv = "KEKAHU_PROFILE"
+
+// Matches the key of a key/value line in TOML and YAML configuration files.
+var (
+	tomlKeyRE = regexp.MustCompile(`^\s*([A-Za-z0-9_-]+)\s*=`)
+	yamlKeyRE = regexp.MustCompile(`^([A-Za-z0-9_-]+)\s*:`)
+)
+
+// ConfigKey returns the JSON name of the configuration field that the key
+// refers to. Keys are case-insensitive and may be the JSON name (e.g.
+// ping_timeout), the field name (PingTimeout), or the environment variable
+// (KEKAHU_PING_TIMEOUT) of the field.
+func ConfigKey(key string) (string, error) {
+	field, err := configField(new(Config), key)
+	if err != nil {
+		return "", err
+	}
+	return jsonName(field), nil
+}
+
+// GetConfigValue returns the value of the configuration field from the
+// default values, the configuration file, and the environment. The
+// configuration is not validated so that values can be read even if the
+// configuration is incomplete.
+func GetConfigValue(key string) (interface{}, error) {
+	conf := new(Config)
+	if err := conf.load(); err != nil {
+		return nil, err
+	}
+
+	field, err := configField(conf, key)
+	if err != nil {
+		return nil, err
+	}
+	return field.Value(), nil
+}
+
+// SetConfigValue parses and validates the value of the configuration field,
+// then writes it to the configuration file at path, preserving the format of
+// the file and the other values and comments in it. The file is created if it
+// does not exist and is replaced atomically so that the service never reads a
+// partially written configuration.
+func SetConfigValue(path, key, value string) error {
+	format := ConfigFormat(path)
+	if format == "" {
+		return fmt.Errorf("cannot determine config format of '%s'", path)
+	}
+
+	// Parse the value into the field and validate it
+	field, err := configField(new(Config), key)
+	if err != nil {
+		return err
+	}
+
+	if err = setField(field, value); err != nil {
+		return err
+	}
+
+	validator := &ComplexValidator{TagName: "validate"}
+	if err = validator.processField("", field); err != nil {
+		return err
+	}
+
+	// Read the current configuration file, if there is one
+	perm := os.FileMode(0644)
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("could not read config file: %s", err)
+	}
+
+	if info, err := os.Stat(path); err == nil {
+		perm = info.Mode().Perm()
+	}
+
+	// Update the value of the field in the format of the file
+	switch format {
+	case TOMLFormat:
+		data = setLine(data, tomlKeyRE, field.Name(), formatTOMLField(field), true)
+	case YAMLFormat:
+		data = setLine(data, yamlKeyRE, strings.ToLower(field.Name()), formatYAMLField(field), false)
+	case JSONFormat:
+		if data, err = setJSONKey(data, jsonName(field), field.Value()); err != nil {
+			return err
+		}
+	}
+
+	if err = writeFileAtomic(path, data, perm); err != nil {
+		return fmt.Errorf("could not write config file: %s", err)
+	}
+	return nil
+}
+
+// Returns the field of the config that the key refers to.
+func configField(conf *Config, key string) (*structs.Field, error) {
+	for _, field := range structs.Fields(conf) {
+		if strings.EqualFold(key, jsonName(field)) || strings.EqualFold(key, field.Name()) || strings.EqualFold(key, envVarName(field.Name())) {
+			return field, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown configuration key '%s'", key)
+}
+
+// Returns the JSON name of the field, which is also used in the README.
+func jsonName(field *structs.Field) string {
+	return strings.Split(field.Tag("json"), ",")[0]
+}
+
+// Parses the string value into the field according to its type.
+func setField(field *structs.Field, value string) error {
+	switch field.Kind() {
+	case reflect.String:
+		return field.Set(value)
+	case reflect.Int:
+		val, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%s must be an integer", jsonName(field))
+		}
+		return field.Set(val)
+	case reflect.Bool:
+		val, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%s must be true or false", jsonName(field))
+		}
+		return field.Set(val)
+	default:
+		return fmt.Errorf("cannot set %s of type %s", jsonName(field), field.Kind())
+	}
+}
+
+// Replaces the line of the TOML or YAML file whose key matches the name
+// (case-insensitively) with the line, or adds the line if there is no such
+// key. In TOML files the line is added before the first table so that it is
+// not nested in the table.
+func setLine(data []byte, keyRE *regexp.Regexp, name, line string, tables bool) []byte {
+	lines := make([]string, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+
+	insert := len(lines)
+	for i, text := range lines {
+		if match := keyRE.FindStringSubmatch(text); match != nil && strings.EqualFold(match[1], name) {
+			lines[i] = line
+			return []byte(strings.Join(lines, "\n") + "\n")
+		}
+
+		if tables && insert == len(lines) && strings.HasPrefix(strings.TrimSpace(text), "[") {
+			insert = i
+		}
+	}
+
+	lines = append(lines[:insert], append([]string{line}, lines[insert:]...)...)
+	return []byte(strings.Join(lines, "\n") + "\n")
+}
+
+// Sets the key of the JSON object to the value, preserving the order of the
+// other keys in the object. Keys are matched case-insensitively as they are
+// when the configuration is loaded.
+func setJSONKey(data []byte, name string, value interface{}) ([]byte, error) {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	// Decode the keys and values of the object in order
+	keys := make([]string, 0)
+	values := make(map[string]json.RawMessage)
+	if len(bytes.TrimSpace(data)) > 0 {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+			return nil, fmt.Errorf("could not parse config file: expected a JSON object")
+		}
+
+		for dec.More() {
+			tok, err := dec.Token()
+			if err != nil {
+				return nil, fmt.Errorf("could not parse config file: %s", err)
+			}
+
+			key := tok.(string)
+			var raw json.RawMessage
+			if err := dec.Decode(&raw); err != nil {
+				return nil, fmt.Errorf("could not parse config file: %s", err)
+			}
+
+			keys = append(keys, key)
+			values[key] = raw
+		}
+	}
+
+	// Replace the value of the key or add the key to the end of the object
+	found := false
+	for _, key := range keys {
+		if strings.EqualFold(key, name) {
+			values[key] = encoded
+			found = true
+		}
+	}
+
+	if !found {
+		keys = append(keys, name)
+		values[name] = encoded
+	}
+
+	// Encode the object with the keys in order
+	buf := new(bytes.Buffer)
+	buf.WriteString("{\n")
+	for i, key := range keys {
+		k, _ := json.Marshal(key)
+		v := new(bytes.Buffer)
+		if err := json.Indent(v, values[key], "  ", "  "); err != nil {
+			return nil, fmt.Errorf("could not encode config file: %s", err)
+		}
+
+		fmt.Fprintf(buf, "  %s: %s", k, v)
+		if i < len(keys)-1 {
+			buf.WriteString(",")
+		}
+		buf.WriteString("\n")
+	}
+	buf.WriteString("}\n")
+
+	return buf.Bytes(), nil
+}
+
+// Writes the data to a temporary file and renames it to the path so that
+// readers never see a partially written file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".kekahu-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = tmp.Chmod(perm)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+//===========================================================================
+// Configuration Profiles
+//===========================================================================
+
+// Loads the values of the selected profile from the profiles section of the
+// configuration file, e.g. the [profiles.staging] table of a TOML file, so
+// that a host can switch between Kahu deployments with a single setting. The
+// profile is selected by $KEKAHU_PROFILE or by the profile key of the file.
+// Values in the profile are named as they are in the rest of the file and
+// override them; values in the environment override the profile.
+type profileLoader struct {
+	path string // the configuration file, empty if there is none
+}
+
+// The profiles section of the configuration file.
+type profilesFile struct {
+	Profiles map[string]interface{} `toml:"profiles" yaml:"profiles" json:"profiles"`
+}
+
+// Load the selected profile into the config, if a profile is selected.
+func (l *profileLoader) Load(s interface{}) error {
+	conf, ok := s.(*Config)
+	if !ok {
+		return fmt.Errorf("cannot load profile into %T", s)
+	}
+
+	if name := os.Getenv(ProfileEnv); name != "" {
+		conf.Profile = name
+	}
+
+	if conf.Profile == "" {
+		return nil
+	}
+
+	if l.path == "" {
+		return fmt.Errorf("no configuration file to load profile '%s' from", conf.Profile)
+	}
+
+	data, err := ioutil.ReadFile(l.path)
+	if err != nil {
+		return fmt.Errorf("could not read config file: %s", err)
+	}
+
+	format := ConfigFormat(l.path)
+	profiles := new(profilesFile)
+	if err = unmarshalConfig(format, data, profiles); err != nil {
+		return fmt.Errorf("could not parse profiles in %s: %s", l.path, err)
+	}
+
+	for name, profile := range profiles.Profiles {
+		if !strings.EqualFold(name, conf.Profile) {
+			continue
+		}
+
+		// Encode the profile on its own then decode it over the loaded config so
+		// that only the values set in the profile are changed.
+		if data, err = marshalConfig(format, profile); err != nil {
+			return fmt.Errorf("could not parse profile '%s': %s", name, err)
+		}
+
+		if err = unmarshalConfig(format, data, conf); err != nil {
+			return fmt.Errorf("could not parse profile '%s': %s", name, err)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unknown profile '%s' in %s", conf.Profile, l.path)
+}
+
+// Profiles returns the names of the profiles in the configuration file.
+func Profiles() ([]string, error) {
+	path, err := FindConfigPath()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read config file: %s", err)
+	}
+
+	profiles := new(profilesFile)
+	if err = unmarshalConfig(ConfigFormat(path), data, profiles); err != nil {
+		return nil, fmt.Errorf("could not parse profiles in %s: %s", path, err)
+	}
+
+	names := make([]string, 0, len(profiles.Profiles))
+	for name := range profiles.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Decodes the configuration data in the format into v.
+func unmarshalConfig(format string, data []byte, v interface{}) error {
+	switch format {
+	case TOMLFormat:
+		_, err := toml.Decode(string(data), v)
+		return err
+	case YAMLFormat:
+		return yaml.Unmarshal(data, v)
+	case JSONFormat:
+		return json.Unmarshal(data, v)
+	default:
+		return fmt.Errorf("unknown config format '%s'", format)
+	}
+}
+
+// Encodes v as configuration data in the format.
+func marshalConfig(format string, v interface{}) ([]byte, error) {
+	switch format {
+	case TOMLFormat:
+		buf := new(bytes.Buffer)
+		if err := toml.NewEncoder(buf).Encode(v); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case YAMLFormat:
+		return yaml.Marshal(v)
+	case JSONFormat:
+		return json.Marshal(v)
+	default:
+		return nil, fmt.Errorf("unknown config format '%s'", format)
+	}
+}
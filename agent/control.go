@@ -0,0 +1,253 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Control socket timeouts.
+const (
+	ControlDialTimeout = 2 * time.Second // time to wait to connect to the daemon
+	ControlReadTimeout = 5 * time.Second // time the daemon waits for a request
+)
+
+// Commands served by the control socket of the running service.
+const (
+	StatusCommand           = "status"            // the state of the service
+	MetricsCommand          = "metrics"           // the network latency report
+	HealthCommand           = "health"            // the system health report
+	EchoStatsCommand        = "echo-stats"        // the pings received by the echo server by source
+	PingCommand             = "ping"              // send n pings to the neighbors, then report the metrics
+	TriggerHeartbeatCommand = "trigger-heartbeat" // send a heartbeat now
+	TriggerSyncCommand      = "trigger-sync"      // sync the peers file now
+	SetVerbosityCommand     = "set-verbosity"     // change the log level, temporarily if a duration is given
+	MaintenanceCommand      = "maintenance"       // enter, leave, or report maintenance mode
+)
+
+// ControlRequest is a command sent to the running service on its control
+// socket, with arguments such as the number of pings or the log level.
+type ControlRequest struct {
+	Command string            `json:"command"`        // one of the control commands
+	Args    map[string]string `json:"args,omitempty"` // arguments of the command
+}
+
+// ControlResponse is the result of a command sent to the control socket.
+type ControlResponse struct {
+	Success bool            `json:"success"`          // whether the command succeeded
+	Error   string          `json:"error,omitempty"`  // the error if the command failed
+	Result  json.RawMessage `json:"result,omitempty"` // the JSON result of the command
+}
+
+// Control sends the command to the service running with the control socket
+// at the path and returns the JSON result. An error is returned if the
+// service is not running or if the command failed.
+func Control(path, command string, args map[string]string) (json.RawMessage, error) {
+	conn, err := net.DialTimeout("unix", path, ControlDialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to kekahu control socket: %s", err)
+	}
+	defer conn.Close()
+
+	req := &ControlRequest{Command: command, Args: args}
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, fmt.Errorf("could not send control command: %s", err)
+	}
+
+	rep := new(ControlResponse)
+	if err := json.NewDecoder(conn).Decode(rep); err != nil {
+		return nil, fmt.Errorf("could not read control response: %s", err)
+	}
+
+	if !rep.Success {
+		return nil, errors.New(rep.Error)
+	}
+	return rep.Result, nil
+}
+
+// Controllable returns true if a service is listening on the control socket
+// at the path, so that the CLI can send it commands rather than creating a
+// second client.
+func Controllable(path string) bool {
+	conn, err := net.DialTimeout("unix", path, ControlDialTimeout)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+//===========================================================================
+// Control Server
+//===========================================================================
+
+// Run the control server on the unix socket at the path, replacing the socket
+// of a previous service that was not shut down cleanly. The socket is only
+// accessible by the user running the service.
+func (k *KeKahu) runControlServer(path string) error {
+	if Controllable(path) {
+		return fmt.Errorf("another kekahu service is listening on %s", path)
+	}
+	os.Remove(path)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	sock, err := listenControl(path)
+	if err != nil {
+		return fmt.Errorf("could not listen on '%s': %s", path, err)
+	}
+
+	status("serving control socket on %s", path)
+	k.control = sock
+
+	go func() {
+		for {
+			conn, err := sock.Accept()
+			if err != nil {
+				// The listener is closed on shutdown
+				if k.ctx.Err() == nil {
+					k.echan <- serverLog.wrap(fmt.Errorf("control socket stopped: %s", err))
+				}
+				return
+			}
+			go k.handleControl(conn)
+		}
+	}()
+
+	return nil
+}
+
+// Reads a single command from the connection and writes the response.
+func (k *KeKahu) handleControl(conn net.Conn) {
+	defer conn.Close()
+
+	req := new(ControlRequest)
+	conn.SetReadDeadline(time.Now().Add(ControlReadTimeout))
+	if err := json.NewDecoder(conn).Decode(req); err != nil {
+		// Connections closed without a command check if the service is running
+		if err != io.EOF {
+			serverLog.warn("could not read control command: %s", err)
+		}
+		return
+	}
+
+	serverLog.debug("received %s control command", req.Command)
+	rep := &ControlResponse{Success: true}
+	result, err := k.execControl(k.ctx, req)
+	if err == nil {
+		rep.Result, err = json.Marshal(result)
+	}
+
+	if err != nil {
+		rep.Success = false
+		rep.Error = err.Error()
+		rep.Result = nil
+	}
+
+	if err := json.NewEncoder(conn).Encode(rep); err != nil {
+		serverLog.warn("could not write control response: %s", err)
+	}
+}
+
+// Executes the control command, returning the result to serialize as JSON.
+func (k *KeKahu) execControl(ctx context.Context, req *ControlRequest) (interface{}, error) {
+	switch req.Command {
+	case StatusCommand:
+		return k.statusReport(), nil
+
+	case MetricsCommand:
+		return k.Metrics(), nil
+
+	case HealthCommand:
+		return k.localHealth()
+
+	case EchoStatsCommand:
+		return k.EchoStats(), nil
+
+	case PingCommand:
+		n, err := strconv.ParseUint(req.Args["number"], 10, 64)
+		if err != nil || n == 0 {
+			return nil, fmt.Errorf("could not parse number of pings '%s'", req.Args["number"])
+		}
+
+		// Pings are sent at once unless an interval is passed to pace them
+		var interval time.Duration
+		if req.Args["interval"] != "" {
+			if interval, err = time.ParseDuration(req.Args["interval"]); err != nil {
+				return nil, fmt.Errorf("could not parse ping interval '%s'", req.Args["interval"])
+			}
+		}
+
+		// Pings carry the configured payload unless a size is passed
+		var size int
+		if req.Args["size"] != "" {
+			if size, err = strconv.Atoi(req.Args["size"]); err != nil {
+				return nil, fmt.Errorf("could not parse ping size '%s'", req.Args["size"])
+			}
+		}
+
+		if err := k.PacePings(ctx, n, size, interval, ioutil.Discard); err != nil {
+			return nil, err
+		}
+		return k.Metrics(), nil
+
+	case TriggerHeartbeatCommand:
+		k.spawn(k.sendHeartbeat)
+		return "heartbeat triggered", nil
+
+	case TriggerSyncCommand:
+		if err := k.Sync(ctx, ""); err != nil {
+			return nil, err
+		}
+		return fmt.Sprintf("synchronized peers to %s", k.conf().PeersPath), nil
+
+	case SetVerbosityCommand:
+		if req.Args["level"] == "" {
+			return k.verbose.Status(), nil
+		}
+
+		level, err := ParseLogLevel(req.Args["level"])
+		if err != nil {
+			return nil, err
+		}
+
+		var duration time.Duration
+		if req.Args["duration"] != "" {
+			if duration, err = time.ParseDuration(req.Args["duration"]); err != nil {
+				return nil, fmt.Errorf("could not parse log level duration '%s'", req.Args["duration"])
+			}
+		}
+		return k.SetVerbosity(level, duration)
+
+	case MaintenanceCommand:
+		if req.Args["enabled"] == "" {
+			return k.Maintenance(time.Now()), nil
+		}
+
+		enabled, err := strconv.ParseBool(req.Args["enabled"])
+		if err != nil {
+			return nil, fmt.Errorf("could not parse maintenance mode '%s'", req.Args["enabled"])
+		}
+
+		var duration time.Duration
+		if req.Args["duration"] != "" {
+			if duration, err = time.ParseDuration(req.Args["duration"]); err != nil || duration < 0 {
+				return nil, fmt.Errorf("could not parse maintenance duration '%s'", req.Args["duration"])
+			}
+		}
+		return k.SetMaintenance(enabled, duration), nil
+
+	default:
+		return nil, fmt.Errorf("unknown control command '%s'", req.Command)
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package agent
+
+import (
+	"net"
+	"syscall"
+)
+
+// Listens on the unix socket at the path with a umask that creates the socket
+// accessible only by the user running the service, so that there is no window
+// in which other users can connect to it before its mode is changed.
+func listenControl(path string) (net.Listener, error) {
+	mask := syscall.Umask(0177)
+	defer syscall.Umask(mask)
+	return net.Listen("unix", path)
+}
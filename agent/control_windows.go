@@ -0,0 +1,13 @@
+//go:build windows
+// +build windows
+
+package agent
+
+import "net"
+
+// Listens on the unix socket at the path. Windows has no umask, the socket
+// inherits the permissions of its directory, by default the home directory of
+// the user running the service.
+func listenControl(path string) (net.Listener, error) {
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,150 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//===========================================================================
+// Cron Expressions
+//===========================================================================
+
+// A five field cron expression that matches minutes, evaluated in the local
+// time zone of the host. Each field of the expression may be a *, a value, a
+// range (a-b), or a list of them separated by commas, optionally followed by
+// a step (e.g. */15). Months and days of the week may also be three letter
+// names. It is used for the maintenance windows and heartbeat schedules.
+type cronExpr struct {
+	fields [5]uint64 // bitsets of the minutes, hours, days, months, and weekdays
+	anyDay bool      // the day of month field is a wildcard
+	anyDow bool      // the day of week field is a wildcard
+}
+
+// Bounds and names of the five fields of a cron expression.
+var cronFields = [5]struct {
+	name     string
+	min, max int
+	names    []string
+}{
+	{"minute", 0, 59, nil},
+	{"hour", 0, 23, nil},
+	{"day of month", 1, 31, nil},
+	{"month", 1, 12, []string{"", "jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}},
+	{"day of week", 0, 7, []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}},
+}
+
+// Parses a five field cron expression.
+func parseCronExpr(expr string) (*cronExpr, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, errors.New("must be a five field cron expression")
+	}
+
+	cron := new(cronExpr)
+	for i, field := range fields {
+		var err error
+		if cron.fields[i], err = parseCronField(field, i); err != nil {
+			return nil, err
+		}
+	}
+
+	// Sunday may be either 0 or 7
+	if cron.fields[4]&(1<<7) != 0 {
+		cron.fields[4] |= 1
+	}
+
+	cron.anyDay = strings.HasPrefix(fields[2], "*")
+	cron.anyDow = strings.HasPrefix(fields[4], "*")
+	return cron, nil
+}
+
+// Returns true if the minute of the time is matched by the cron expression.
+// As in cron, if both the day of the month and the day of the week are
+// restricted, the time matches if either of them match.
+func (c *cronExpr) matches(t time.Time) bool {
+	if c.fields[0]&(1<<uint(t.Minute())) == 0 || c.fields[1]&(1<<uint(t.Hour())) == 0 || c.fields[3]&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+
+	day := c.fields[2]&(1<<uint(t.Day())) != 0
+	dow := c.fields[4]&(1<<uint(t.Weekday())) != 0
+	if c.anyDay || c.anyDow {
+		return day && dow
+	}
+	return day || dow
+}
+
+// Returns the first minute after the time that is matched by the expression,
+// or false if no minute within the next year (and a day for leap years) is.
+func (c *cronExpr) next(after time.Time) (time.Time, bool) {
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	for end := t.AddDate(1, 0, 1); t.Before(end); t = t.Add(time.Minute) {
+		if c.matches(t) {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// Parses a field of a cron expression into a bitset of the values it matches.
+func parseCronField(field string, idx int) (uint64, error) {
+	bounds := cronFields[idx]
+	var bits uint64
+
+	for _, part := range strings.Split(field, ",") {
+		expr, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			expr = part[:i]
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step in %s '%s'", bounds.name, part)
+			}
+		}
+
+		lo, hi := bounds.min, bounds.max
+		if expr != "*" {
+			var err error
+			rng := strings.SplitN(expr, "-", 2)
+			if lo, err = parseCronValue(rng[0], idx); err != nil {
+				return 0, err
+			}
+
+			hi = lo
+			if len(rng) == 2 {
+				if hi, err = parseCronValue(rng[1], idx); err != nil {
+					return 0, err
+				}
+			} else if step > 1 {
+				hi = bounds.max
+			}
+
+			if hi < lo {
+				return 0, fmt.Errorf("invalid range in %s '%s'", bounds.name, part)
+			}
+		}
+
+		for val := lo; val <= hi; val += step {
+			bits |= 1 << uint(val)
+		}
+	}
+	return bits, nil
+}
+
+// Parses a number or name in a cron field, checking it is within bounds.
+func parseCronValue(s string, idx int) (int, error) {
+	bounds := cronFields[idx]
+	for val, name := range bounds.names {
+		if name != "" && strings.EqualFold(s, name) {
+			return val, nil
+		}
+	}
+
+	val, err := strconv.Atoi(s)
+	if err != nil || val < bounds.min || val > bounds.max {
+		return 0, fmt.Errorf("invalid %s '%s', must be %d-%d", bounds.name, s, bounds.min, bounds.max)
+	}
+	return val, nil
+}
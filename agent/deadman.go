@@ -0,0 +1,154 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// DeadmanState is written to the deadman_path while the dead man's switch is
+// tripped, so that monitoring tools on the host can check whether kekahu has
+// lost contact with Kahu. The file is removed when a heartbeat succeeds.
+type DeadmanState struct {
+	Tripped   bool      `json:"tripped"`    // always true, the file does not exist otherwise
+	Since     time.Time `json:"since"`      // when the first heartbeat of the streak failed
+	TrippedAt time.Time `json:"tripped_at"` // when the streak reached deadman_failures
+	Updated   time.Time `json:"updated"`    // when the last heartbeat of the streak failed
+	Failures  int       `json:"failures"`   // consecutive heartbeat failures
+	LastError string    `json:"last_error"` // the error of the last failed heartbeat
+}
+
+// LoadDeadman reads the dead man's switch state file, returning nil (and no
+// error) if the file does not exist because the switch is not tripped.
+func LoadDeadman(path string) (*DeadmanState, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	state := new(DeadmanState)
+	if err = json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("could not parse deadman file %s: %s", path, err)
+	}
+	return state, nil
+}
+
+//===========================================================================
+// KeKahu Dead Man's Switch
+//===========================================================================
+
+// Tracks the streak of failed heartbeats and whether it is long enough that
+// the dead man's switch is tripped.
+type deadmanSwitch struct {
+	sync.Mutex
+	since   time.Time // when the first heartbeat of the streak failed
+	tripped time.Time // when the switch was tripped, zero if it is not tripped
+}
+
+// Failure records a failed heartbeat and returns when the streak started and
+// true if the switch was tripped by this failure.
+func (d *deadmanSwitch) Failure(failures, threshold int) (since time.Time, trip bool) {
+	d.Lock()
+	defer d.Unlock()
+
+	now := time.Now()
+	if d.since.IsZero() || failures == 1 {
+		d.since, d.tripped = now, time.Time{}
+	}
+
+	if threshold > 0 && failures >= threshold && d.tripped.IsZero() {
+		d.tripped = now
+		trip = true
+	}
+	return d.since, trip
+}
+
+// Tripped returns when the switch was tripped, zero if it is not tripped.
+func (d *deadmanSwitch) Tripped() time.Time {
+	d.Lock()
+	defer d.Unlock()
+	return d.tripped
+}
+
+// Reset ends the streak and returns true if the switch had been tripped.
+func (d *deadmanSwitch) Reset() bool {
+	d.Lock()
+	defer d.Unlock()
+
+	tripped := !d.tripped.IsZero()
+	d.since, d.tripped = time.Time{}, time.Time{}
+	return tripped
+}
+
+// Records a failed heartbeat. When the number of consecutive failures reaches
+// deadman_failures the switch is tripped: the failure is logged at the error
+// level, the trip is counted, and the deadman hooks are run. While tripped,
+// the state file is rewritten on every failure so that the tooling checking
+// it can see that the service is still running but cannot reach Kahu.
+func (k *KeKahu) deadmanFailure(failures int, err error) {
+	k.metrics.HeartbeatStreak(failures)
+
+	since, trip := k.deadman.Failure(failures, k.conf().DeadmanFailures)
+	if trip {
+		heartbeatLog.error("%d consecutive heartbeats failed since %s, Kahu is unreachable: %s", failures, since.Format(time.RFC3339), err)
+		k.metrics.DeadmanTrip()
+		k.runHooks(NewHookEvent(DeadmanEvent,
+			"FAILURES", fmt.Sprintf("%d", failures),
+			"ERROR", err.Error(),
+			"SINCE", since.Format(time.RFC3339),
+			"DEADMAN_PATH", k.conf().GetDeadmanPath(),
+		))
+	}
+
+	tripped := k.deadman.Tripped()
+	if tripped.IsZero() {
+		return
+	}
+
+	state := &DeadmanState{
+		Tripped: true, Since: since, TrippedAt: tripped, Updated: time.Now(),
+		Failures: failures, LastError: err.Error(),
+	}
+
+	if werr := writeDeadman(k.conf().GetDeadmanPath(), state); werr != nil {
+		k.echan <- heartbeatLog.wrap(werr)
+	}
+}
+
+// Records a successful heartbeat, logging the recovery if the switch was
+// tripped. The state file is removed even if the switch was not tripped in
+// case it was left behind by a previous run of the service.
+func (k *KeKahu) deadmanReset() {
+	k.metrics.HeartbeatStreak(0)
+	if k.deadman.Reset() {
+		heartbeatLog.status("heartbeats to Kahu recovered, dead man's switch reset")
+	}
+
+	if err := os.Remove(k.conf().GetDeadmanPath()); err != nil && !os.IsNotExist(err) {
+		k.echan <- heartbeatLog.wrap(fmt.Errorf("could not remove deadman file: %s", err))
+	}
+}
+
+// Atomically writes the state file so readers never see a partial file.
+func writeDeadman(path string, state *DeadmanState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("could not write deadman file: %s", err)
+	}
+
+	if err = writeFileAtomic(path, data, 0644); err != nil {
+		return fmt.Errorf("could not write deadman file: %s", err)
+	}
+	return nil
+}
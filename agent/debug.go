@@ -0,0 +1,243 @@
+// This file handles how debug and trace messages get passed to the log outputs.
+
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	knet "github.com/bbengfort/kekahu/net"
+)
+
+// Levels for implementing the debug and trace message functionality.
+const (
+	Trace uint8 = iota
+	Debug
+	Info
+	Status
+	Warn
+	Error
+	Silent
+)
+
+// Log output formats, JSON is useful for ingesting logs into journald or ELK.
+const (
+	LogText = "text"
+	LogJSON = "json"
+)
+
+// The log level and format are read by every message and may be changed while
+// messages are logged, e.g. when the configuration is reloaded, so they are
+// only accessed atomically, see currentLogLevel and jsonLogs.
+var logLevel = uint32(Debug)
+var logJSON uint32 // 1 if the log format is JSON
+
+// These variables are initialized in init()
+var logger *log.Logger
+var logLevelStrings = [...]string{"trace", "debug", "info", "status", "warn", "error", "silent"}
+
+// Component loggers add a component field to log messages so that messages
+// can be filtered by the part of the service that emitted them.
+var (
+	heartbeatLog = &componentLogger{"heartbeat"}
+	pingLog      = &componentLogger{"ping"}
+	syncLog      = &componentLogger{"sync"}
+	serverLog    = &componentLogger{"server"}
+	healthLog    = &componentLogger{"health"}
+	updateLog    = &componentLogger{"update"}
+	telemetryLog = &componentLogger{"telemetry"}
+	bandwidthLog = &componentLogger{"bandwidth"}
+	hookLog      = &componentLogger{"hook"}
+	gossipLog    = &componentLogger{"gossip"}
+)
+
+//===========================================================================
+// Interact with debug output
+//===========================================================================
+
+// LogLevel returns a string representation of the current level
+func LogLevel() string {
+	return logLevelStrings[currentLogLevel()]
+}
+
+// SetLogLevel modifies the log level for messages at runtime. Ensures that
+// the highest level that can be set is the trace level.
+func SetLogLevel(level uint8) {
+	if level > Silent {
+		level = Silent
+	}
+
+	atomic.StoreUint32(&logLevel, uint32(level))
+}
+
+// Returns the current log level.
+func currentLogLevel() uint8 {
+	return uint8(atomic.LoadUint32(&logLevel))
+}
+
+// LogFormat returns the current log output format
+func LogFormat() string {
+	if jsonLogs() {
+		return LogJSON
+	}
+	return LogText
+}
+
+// Returns true if the log format is JSON lines.
+func jsonLogs() bool {
+	return atomic.LoadUint32(&logJSON) == 1
+}
+
+// SetLogFormat modifies the log output format to either text or JSON lines.
+func SetLogFormat(format string) error {
+	switch strings.ToLower(format) {
+	case LogText, "":
+		atomic.StoreUint32(&logJSON, 0)
+	case LogJSON:
+		atomic.StoreUint32(&logJSON, 1)
+	default:
+		return fmt.Errorf("unknown log format '%s'", format)
+	}
+
+	logMu.RLock()
+	defer logMu.RUnlock()
+	configureLogger(logger, false)
+	for _, sink := range logSinks {
+		if writer, ok := sink.writer.(*streamWriter); ok {
+			configureLogger(writer.logger, writer.dated)
+		}
+	}
+	return nil
+}
+
+//===========================================================================
+// Debugging output functions
+//===========================================================================
+
+// Print to the standard logger at the specified level. Arguments are handled
+// in the manner of log.Printf, but a newline is appended.
+func print(level uint8, msg string, a ...interface{}) {
+	output(level, "", msg, a...)
+}
+
+// Output the message with the component to the log outputs in the current
+// log format if the level is greater than or equal to the log level of the
+// output, which is the verbosity unless the output has its own level.
+func output(level uint8, component, msg string, a ...interface{}) {
+	if discardLog(level) {
+		return
+	}
+	writeLog(level, component, fmt.Sprintf(msg, a...))
+}
+
+// Returns the message as a JSON log record.
+func jsonRecord(level uint8, component, msg string) string {
+	record := map[string]interface{}{
+		"time":  time.Now().Format(time.RFC3339Nano),
+		"level": logLevelStrings[level],
+		"msg":   strings.TrimSuffix(msg, "\n"),
+	}
+
+	if component != "" {
+		record["component"] = component
+	}
+
+	data, _ := json.Marshal(record)
+	return string(data)
+}
+
+// Prints to the standard logger if level is warn or greater; arguments are
+// handled in the manner of log.Printf, but a newline is appended.
+func warn(msg string, a ...interface{}) {
+	print(Warn, msg, a...)
+}
+
+// Helper function to simply warn about an error received.
+func warne(err error) {
+	warn("%s", err)
+}
+
+// Prints to the standard logger if level is status or greater; arguments are
+// handled in the manner of log.Printf, but a newline is appended.
+func status(msg string, a ...interface{}) {
+	print(Status, msg, a...)
+}
+
+// Prints to the standard logger if level is info or greater; arguments are
+// handled in the manner of log.Printf, but a newline is appended.
+func info(msg string, a ...interface{}) {
+	print(Info, msg, a...)
+}
+
+// Prints to the standard logger if level is debug or greater; arguments are
+// handled in the manner of log.Printf, but a newline is appended.
+func debug(msg string, a ...interface{}) {
+	print(Debug, msg, a...)
+}
+
+// Prints to the standard logger if level is trace or greater; arguments are
+// handled in the manner of log.Printf, but a newline is appended.
+func trace(msg string, a ...interface{}) {
+	print(Trace, msg, a...)
+}
+
+//===========================================================================
+// Component logging
+//===========================================================================
+
+// componentLogger adds the component name to every message it logs.
+type componentLogger struct {
+	component string
+}
+
+func (l *componentLogger) error(msg string, a ...interface{}) {
+	output(Error, l.component, msg, a...)
+}
+
+func (l *componentLogger) warn(msg string, a ...interface{}) {
+	output(Warn, l.component, msg, a...)
+}
+
+func (l *componentLogger) warne(err error) {
+	output(Warn, l.component, "%s", err)
+}
+
+func (l *componentLogger) status(msg string, a ...interface{}) {
+	output(Status, l.component, msg, a...)
+}
+
+func (l *componentLogger) info(msg string, a ...interface{}) {
+	output(Info, l.component, msg, a...)
+}
+
+func (l *componentLogger) debug(msg string, a ...interface{}) {
+	output(Debug, l.component, msg, a...)
+}
+
+func (l *componentLogger) trace(msg string, a ...interface{}) {
+	output(Trace, l.component, msg, a...)
+}
+
+// Wraps the error with the component so that it is logged and recorded in the
+// error journal under the part of the service that caused it.
+func (l *componentLogger) wrap(err error) error {
+	return &ComponentError{Component: l.component, Err: err}
+}
+
+// ComponentError is a non-fatal error from a component of the service, e.g.
+// heartbeat or ping, that is sent to the error channel of the service. It is
+// the error of the echo server and the pingers, see knet.ComponentError.
+type ComponentError = knet.ComponentError
+
+// Returns the component that caused the error, or the default service
+// component if the error was not wrapped by a component logger.
+func errorComponent(err error) string {
+	if cerr, ok := err.(*ComponentError); ok {
+		return cerr.Component
+	}
+	return ServiceComponent
+}
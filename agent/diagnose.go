@@ -0,0 +1,230 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	knet "github.com/bbengfort/kekahu/net"
+)
+
+// Results of the diagnostics run by Diagnose.
+const (
+	DiagnosisPass = "pass" // the check succeeded
+	DiagnosisWarn = "warn" // the check succeeded with problems, or could not be performed
+	DiagnosisFail = "fail" // the check failed and kekahu will not work until it is fixed
+)
+
+// Clock offsets from the NTP server beyond which the clock skew check warns or
+// fails. Large offsets corrupt the timestamps reported to Kahu and the clock
+// skew estimates of the neighbors. The warning threshold is the default of
+// clock_skew_warn.
+const (
+	DiagnosisSkewWarn = 100 * time.Millisecond
+	DiagnosisSkewFail = time.Second
+)
+
+// Diagnosis is the outcome of a single diagnostic check performed by Diagnose
+// with a hint on how to fix the problem if the check did not pass.
+type Diagnosis struct {
+	Check   string `json:"check"`          // the name of the check
+	Result  string `json:"result"`         // pass, warn, or fail
+	Message string `json:"message"`        // details about the result of the check
+	Hint    string `json:"hint,omitempty"` // how to fix the problem, if any
+}
+
+// Diagnose runs connectivity tests to find out why kekahu cannot reach Kahu or
+// its neighbors: it resolves the host of the Kahu URL, connects to it (or to
+// the proxy), checks that the API key is accepted, checks that the echo port
+// can be bound, and compares the local clock to the NTP server. All checks are
+// performed even if earlier ones fail so that every problem is reported.
+func (k *KeKahu) Diagnose(ctx context.Context) []*Diagnosis {
+	results := make([]*Diagnosis, 0, 5)
+	timeout, err := k.conf().GetAPITimeout()
+	if err != nil || timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+
+	for _, check := range []func(context.Context) *Diagnosis{
+		k.diagnoseDNS, k.diagnoseTCP, k.diagnoseAPIKey, k.diagnoseEchoPort, k.diagnoseClock,
+	} {
+		cctx, cancel := context.WithTimeout(ctx, timeout)
+		results = append(results, check(cctx))
+		cancel()
+	}
+	return results
+}
+
+// Resolves the host of the Kahu URL.
+func (k *KeKahu) diagnoseDNS(ctx context.Context) *Diagnosis {
+	result := &Diagnosis{Check: "dns"}
+	host, _, err := kahuHostPort(k.conf().URL)
+	if err != nil {
+		return result.fail(err.Error(), "set url to the base URL of the Kahu service, e.g. https://kahu.bengfort.com")
+	}
+
+	addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		if k.conf().KahuProxy != "" {
+			return result.warn(fmt.Sprintf("could not resolve %s: %s", host, err), "the proxy may resolve the host, check the tcp result")
+		}
+		return result.fail(fmt.Sprintf("could not resolve %s: %s", host, err), "check the DNS servers in /etc/resolv.conf and that the url setting is spelled correctly")
+	}
+	return result.pass(fmt.Sprintf("%s resolved to %s", host, addrs[0]))
+}
+
+// Connects to the Kahu server, or to the proxy if one is configured.
+func (k *KeKahu) diagnoseTCP(ctx context.Context) *Diagnosis {
+	result := &Diagnosis{Check: "tcp"}
+	target := k.conf().URL
+	if k.conf().KahuProxy != "" {
+		target = k.conf().KahuProxy
+	}
+
+	host, port, err := kahuHostPort(target)
+	if err != nil {
+		return result.fail(err.Error(), "set url (and kahu_proxy, if used) to a valid URL")
+	}
+
+	addr := net.JoinHostPort(host, port)
+	start := time.Now()
+	conn, err := new(net.Dialer).DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return result.fail(fmt.Sprintf("could not connect to %s: %s", addr, err), "check that outbound connections to port "+port+" are allowed by the firewall and any security groups")
+	}
+	conn.Close()
+	return result.pass(fmt.Sprintf("connected to %s in %s", addr, time.Since(start).Round(time.Millisecond)))
+}
+
+// Checks that Kahu accepts the API key.
+func (k *KeKahu) diagnoseAPIKey(ctx context.Context) *Diagnosis {
+	result := &Diagnosis{Check: "api key"}
+	hint := "set api_key (or $KEKAHU_API_KEY) to the api key of this host in Kahu"
+
+	client, ok := k.httpClient()
+	if !ok {
+		if _, err := k.api.Replicas(ctx); err != nil {
+			return result.fail(err.Error(), hint)
+		}
+		return result.pass("replicas fetched from Kahu")
+	}
+
+	if rejected, err := client.checkAPIKey(ctx); err != nil {
+		if !rejected {
+			hint = "check that url is the base URL of the Kahu service and the dns and tcp results"
+		}
+		return result.fail(err.Error(), hint)
+	}
+	return result.pass("api key accepted by Kahu")
+}
+
+// Checks that the echo server can listen on its port with each transport. The
+// port is expected to be in use if the kekahu service is already running.
+func (k *KeKahu) diagnoseEchoPort(ctx context.Context) *Diagnosis {
+	result := &Diagnosis{Check: "echo port"}
+	transports, err := k.conf().GetEchoTransports()
+	if err != nil {
+		return result.fail(err.Error(), "set echo_transports to a comma separated list of grpc, udp, and quic")
+	}
+
+	addr := k.server.Addr()
+	for _, transport := range transports {
+		if err = bindable(transport, addr); err != nil {
+			break
+		}
+	}
+
+	if err != nil {
+		if pid, perr := LoadPID(k.conf().GetPidPath()); perr == nil && pid.Running() {
+			return result.pass(fmt.Sprintf("%s is in use by the running kekahu service (pid %d)", addr, pid.PID))
+		}
+		return result.fail(err.Error(), "stop the process that is listening on the port, find it with lsof -i "+addr)
+	}
+	return result.pass(fmt.Sprintf("%s can be bound for %s pings", addr, strings.Join(transports, " and ")))
+}
+
+// Compares the local clock to the NTP servers, using the server with the
+// lowest delay.
+func (k *KeKahu) diagnoseClock(ctx context.Context) *Diagnosis {
+	result := &Diagnosis{Check: "clock skew"}
+	servers := k.conf().GetNTPServers()
+	if len(servers) == 0 {
+		return result.warn("no ntp server is configured", "set ntp_server to compare the clock with, e.g. pool.ntp.org")
+	}
+
+	sample, server, err := MeasureClock(ctx, servers)
+	if err != nil {
+		return result.warn(err.Error(), "outbound UDP to port "+NTPPort+" may be blocked, or set ntp_server to a reachable NTP server")
+	}
+
+	threshold, err := k.conf().GetClockSkewWarn()
+	if err != nil {
+		threshold = DiagnosisSkewWarn
+	}
+
+	skew := absDuration(sample.Offset)
+	hint := "enable time synchronization, e.g. timedatectl set-ntp true, or install chrony"
+	message := fmt.Sprintf("clock is off by %s from %s (delay %s)", sample.Offset, server, sample.Delay)
+	switch {
+	case skew > DiagnosisSkewFail:
+		return result.fail(message, hint)
+	case skew > threshold:
+		return result.warn(message, hint)
+	default:
+		return result.pass(message)
+	}
+}
+
+func (d *Diagnosis) pass(message string) *Diagnosis {
+	d.Result, d.Message = DiagnosisPass, message
+	return d
+}
+
+func (d *Diagnosis) warn(message, hint string) *Diagnosis {
+	d.Result, d.Message, d.Hint = DiagnosisWarn, message, hint
+	return d
+}
+
+func (d *Diagnosis) fail(message, hint string) *Diagnosis {
+	d.Result, d.Message, d.Hint = DiagnosisFail, message, hint
+	return d
+}
+
+// Returns the host and port of the URL, using the default port of the scheme
+// if the URL does not have one.
+func kahuHostPort(rawurl string) (host, port string, err error) {
+	u, err := url.Parse(rawurl)
+	if err != nil || u.Hostname() == "" {
+		return "", "", fmt.Errorf("could not parse url '%s'", rawurl)
+	}
+
+	host, port = u.Hostname(), u.Port()
+	if port == "" {
+		port = "443"
+		if u.Scheme == "http" {
+			port = "80"
+		}
+	}
+	return host, port, nil
+}
+
+// Checks that the address can be listened on with the ping transport.
+func bindable(transport, addr string) error {
+	switch transport {
+	case knet.UDPTransport, knet.QUICTransport:
+		conn, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			return fmt.Errorf("cannot listen for %s pings on %s: %s", transport, addr, err)
+		}
+		return conn.Close()
+	default:
+		sock, err := net.Listen("tcp", addr)
+		if err != nil {
+			return fmt.Errorf("cannot listen for pings on %s: %s", addr, err)
+		}
+		return sock.Close()
+	}
+}
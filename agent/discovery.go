@@ -0,0 +1,123 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/bbengfort/kekahu/kahu"
+	"github.com/bbengfort/x/peers"
+)
+
+// Sources to discover neighbors from when the Kahu neighbors API is
+// unreachable, so that latency measurements continue during Kahu outages.
+const (
+	PeersDiscovery = "peers" // the neighbors are the replicas in the synced peers file
+	SRVDiscovery   = "srv"   // the neighbors are the targets of a DNS SRV record
+)
+
+// DiscoverNeighbors returns the source name of the local host and the
+// neighbors to ping from the configured fallback discovery source. The source
+// is the name last returned by Kahu, or the hostname if Kahu has not been
+// reached since the service started. The local host is never a neighbor.
+func (k *KeKahu) DiscoverNeighbors(ctx context.Context) (source string, targets []*kahu.Neighbor, err error) {
+	k.state.RLock()
+	source = k.state.source
+	k.state.RUnlock()
+
+	if source == "" {
+		if source, err = k.conf().LocalHostname(); err != nil {
+			return "", nil, err
+		}
+	}
+
+	switch strings.ToLower(k.conf().NeighborFallback) {
+	case PeersDiscovery:
+		targets, err = discoverPeers(k.conf().PeersPath, k.conf().PeersFormat)
+	case SRVDiscovery:
+		targets, err = discoverSRV(ctx, k.conf().NeighborSRV)
+	case "":
+		return "", nil, errors.New("neighbor discovery fallback is not enabled")
+	default:
+		return "", nil, fmt.Errorf("unknown neighbor discovery fallback '%s'", k.conf().NeighborFallback)
+	}
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	// Remove the local host from the neighbors
+	neighbors := make([]*kahu.Neighbor, 0, len(targets))
+	for _, target := range targets {
+		if target.Hostname == source {
+			continue
+		}
+		neighbors = append(neighbors, target)
+	}
+	return source, neighbors, nil
+}
+
+// Returns the replicas in the peers file synced from Kahu as neighbors. Only
+// JSON peers files can be read back.
+func discoverPeers(path, format string) ([]*kahu.Neighbor, error) {
+	if strings.ToLower(format) != JSONFormat {
+		return nil, fmt.Errorf("cannot discover neighbors from a %s peers file, only %s", format, JSONFormat)
+	}
+
+	// Fall back to the backup of the previous version if the file is corrupt
+	replicas, err := LoadPeers(path)
+	if err != nil {
+		var berr error
+		if replicas, berr = LoadPeers(path + PeersBackupExt); berr != nil {
+			return nil, fmt.Errorf("could not discover neighbors from %s: %s", path, err)
+		}
+		pingLog.warn("could not load %s, discovering neighbors from the backup: %s", path, err)
+	}
+
+	targets := make([]*kahu.Neighbor, 0, len(replicas.Peers))
+	for _, replica := range replicas.Peers {
+		if replica.IsLocal() {
+			continue
+		}
+
+		targets = append(targets, &kahu.Neighbor{
+			Hostname: replica.Name,
+			IPAddr:   replica.IPAddr,
+			Domain:   replica.Domain,
+		})
+	}
+	return targets, nil
+}
+
+// Returns the targets of the DNS SRV record as neighbors, pinging the echo
+// server on the port of each target. The name of each neighbor is the first
+// label of its domain (e.g. alpha for alpha.example.com), which should match
+// the name of the replica in Kahu for the latencies to be reported.
+func discoverSRV(ctx context.Context, record string) ([]*kahu.Neighbor, error) {
+	if record == "" {
+		return nil, errors.New("specify the dns srv record to discover neighbors from")
+	}
+
+	_, srvs, err := net.DefaultResolver.LookupSRV(ctx, "", "", record)
+	if err != nil {
+		return nil, fmt.Errorf("could not discover neighbors from %s: %s", record, err)
+	}
+
+	targets := make([]*kahu.Neighbor, 0, len(srvs))
+	for _, srv := range srvs {
+		domain := strings.TrimSuffix(srv.Target, ".")
+		if (&peers.Peer{Hostname: domain}).IsLocal() {
+			continue
+		}
+
+		targets = append(targets, &kahu.Neighbor{
+			Hostname: strings.Split(domain, ".")[0],
+			IPAddr:   net.JoinHostPort(domain, strconv.Itoa(int(srv.Port))),
+			Domain:   domain,
+		})
+	}
+	return targets, nil
+}
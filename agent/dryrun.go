@@ -0,0 +1,86 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/bbengfort/kekahu/kahu"
+	"github.com/bbengfort/x/peers"
+)
+
+// DryRunClient wraps a KahuClient so that the service can be run on a new
+// host without modifying Kahu. Heartbeats, latency reports, and health
+// reports are logged as JSON instead of being posted, and every heartbeat is
+// answered as if the host were active so that the latency and health routines
+// are exercised. Neighbors and replicas are still fetched from Kahu since
+// those requests do not modify it.
+type DryRunClient struct {
+	client KahuClient // client to fetch the neighbors and replicas with
+}
+
+// NewDryRunClient wraps the client to log requests instead of posting them.
+func NewDryRunClient(client KahuClient) *DryRunClient {
+	return &DryRunClient{client: client}
+}
+
+// Heartbeat logs the heartbeat and returns a successful, active response.
+func (c *DryRunClient) Heartbeat(ctx context.Context, data *kahu.HeartbeatRequest) (*kahu.HeartbeatResponse, error) {
+	heartbeatLog.status("dry run %s %s", kahu.HeartbeatEndpoint, dryRunPayload(data))
+	return &kahu.HeartbeatResponse{Success: true, Replica: data.Hostname, Active: true}, nil
+}
+
+// Neighbors fetches the neighbors from Kahu with the wrapped client.
+func (c *DryRunClient) Neighbors(ctx context.Context) (*kahu.NeighborsResponse, error) {
+	return c.client.Neighbors(ctx)
+}
+
+// ReportLatency logs the batch of latencies and returns an empty response
+// for each target since no statistics are computed by Kahu.
+func (c *DryRunClient) ReportLatency(ctx context.Context, data kahu.UpdateLatencyRequests) (kahu.UpdateLatencyResponses, error) {
+	pingLog.status("dry run %s %s", kahu.LatencyEndpoint, dryRunPayload(data))
+
+	info := make(kahu.UpdateLatencyResponses, 0, len(data))
+	for _, req := range data {
+		info = append(info, &kahu.UpdateLatencyResponse{Target: req.Target})
+	}
+	return info, nil
+}
+
+// Replicas fetches the replicas from Kahu with the wrapped client.
+func (c *DryRunClient) Replicas(ctx context.Context) ([]*peers.Peer, error) {
+	return c.client.Replicas(ctx)
+}
+
+// Health logs the system health report.
+func (c *DryRunClient) Health(ctx context.Context, health *kahu.SystemStatus) error {
+	status("dry run %s %s", kahu.HealthEndpoint, dryRunPayload(health))
+	return nil
+}
+
+// HealthDelta logs the changes to the system health report.
+func (c *DryRunClient) HealthDelta(ctx context.Context, health *kahu.SystemStatus, delta kahu.HealthDelta) error {
+	status("dry run %s %s", kahu.HealthEndpoint, dryRunPayload(delta))
+	return nil
+}
+
+// ReportBandwidth logs the batch of bandwidth measurements.
+func (c *DryRunClient) ReportBandwidth(ctx context.Context, data kahu.BandwidthRequests) error {
+	bandwidthLog.status("dry run %s %s", kahu.BandwidthEndpoint, dryRunPayload(data))
+	return nil
+}
+
+// ReportMatrix logs the latency matrix.
+func (c *DryRunClient) ReportMatrix(ctx context.Context, data kahu.MatrixRequests) error {
+	gossipLog.status("dry run %s %s", kahu.MatrixEndpoint, dryRunPayload(data))
+	return nil
+}
+
+// Returns the request as indented JSON to log, or the error if it could not
+// be encoded since that would have caused the request to fail.
+func dryRunPayload(data interface{}) string {
+	payload, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return "could not encode request: " + err.Error()
+	}
+	return string(payload)
+}
@@ -0,0 +1,238 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/bbengfort/kekahu/doctor"
+	"github.com/bbengfort/kekahu/kahu"
+	knet "github.com/bbengfort/kekahu/net"
+	"github.com/bbengfort/kekahu/ping"
+)
+
+//===========================================================================
+// Echo Server
+//===========================================================================
+
+// Serve runs the echo server without the KeKahu client, blocking and logging
+// any errors until the process is interrupted. This allows hosts to respond to
+// pings without sending heartbeats to Kahu (e.g. passive measurement targets)
+// and therefore does not require an API key. The config is only used to
+// secure the server with mutual TLS, to select the echo transports and
+// interceptors, and to authenticate pings with the configured ping secret, and
+// may be nil.
+func Serve(addr, name string, conf *Config) (err error) {
+	server := new(knet.Server)
+	server.Init(addr, name)
+	server.Report = func() (*kahu.SystemStatus, error) {
+		status, err := doctor.HealthCheck(context.Background(), true, 0)
+		if status == nil {
+			return nil, err
+		}
+		return status, nil
+	}
+
+	if conf != nil {
+		if server.Creds, err = conf.ServerCredentials(); err != nil {
+			return err
+		}
+
+		if server.TLSConfig, err = conf.ServerTLSConfig(); err != nil {
+			return err
+		}
+
+		if server.Transports, err = conf.GetEchoTransports(); err != nil {
+			return err
+		}
+
+		server.Interceptors = conf.GetEchoInterceptors()
+
+		server.Auth = knet.NewPingAuth(conf.PingSecret, conf.PingAuth)
+		server.Report = func() (*kahu.SystemStatus, error) { return systemHealth(conf) }
+	}
+
+	// Run the OS signal handlers and the server
+	stopped := make(chan error, 1)
+	go func() { stopped <- signalHandler(server.Shutdown, nil) }()
+	echan := make(chan error)
+	if err = server.Run(echan); err != nil {
+		return err
+	}
+
+	// Log errors until the process is interrupted
+	for {
+		select {
+		case err := <-echan:
+			serverLog.warne(err)
+		case err := <-stopped:
+			return err
+		}
+	}
+}
+
+// EchoStats returns the statistics of the pings received by the echo server
+// from each source since the service started, ordered by source.
+func (k *KeKahu) EchoStats() []*kahu.SourceStats {
+	return k.server.Stats()
+}
+
+//===========================================================================
+// Echo Client
+//===========================================================================
+
+// Ping from the specified source to the specified target at the given
+// addr (note that if the addr doesn't contain a port, the knet.DefaultAddr port is
+// appended to the addr). This method returns the latency of the message from
+// one endpoint to the other, or it returns 0 if the message times out.
+//
+// The ping is sent with the configured transport; gRPC connections to the
+// echo servers are reused from the connection pool so that the latency only
+// measures the time it takes to send and receive a message. The ping carries
+// a payload of the configured ping size. Canceling the context aborts the ping.
+func (k *KeKahu) Ping(ctx context.Context, source, target, addr string, seq uint64) (time.Duration, error) {
+	return k.ping(ctx, source, target, addr, seq, k.conf().PingSize)
+}
+
+// PingStream sends n pings from the source to the target at the given addr
+// with the configured transport, starting at the sequence number seq. Each
+// ping waits for the reply before the next is sent so that the latency of
+// every ping is measured (over a single bidirectional stream for gRPC). The
+// latencies are returned in order; if the stream fails, the remaining pings
+// are recorded as timeouts (zero) and the error is returned.
+func (k *KeKahu) PingStream(ctx context.Context, source, target, addr string, seq, n uint64) ([]time.Duration, error) {
+	return k.pingStream(ctx, source, target, addr, seq, n, k.conf().PingSize)
+}
+
+// Sends a ping with a payload of the size, see Ping.
+func (k *KeKahu) ping(ctx context.Context, source, target, addr string, seq uint64, size int) (time.Duration, error) {
+	// First compose the address
+	addr = resolveAddr(addr)
+	pinger := k.pingerFor(target, addr)
+	pingLog.debug("sending %s ping to %s", pinger.Transport(), addr)
+
+	// Create the message, requesting the latencies of the target if gossiping
+	msg := &ping.Packet{
+		Source:   source,
+		Target:   target,
+		Sequence: seq,
+		Gossip:   k.conf().GossipLatency,
+		Payload:  pingPayload(size),
+	}
+
+	reply, latency, err := pinger.Ping(ctx, addr, msg)
+	if err != nil {
+		k.recordPing(pinger.Transport(), msg.Sent, source, target, seq, size, 0)
+		return 0, err
+	}
+
+	k.recordPing(pinger.Transport(), msg.Sent, source, target, seq, size, latency)
+	pingLog.info("ping from %s to %s in %s", source, target, latency)
+	k.updateClock(target, reply, time.Unix(0, msg.Sent).Add(latency))
+	k.collectGossip(target, reply)
+	return latency, nil
+}
+
+// Sends n pings with a payload of the size each, see PingStream.
+func (k *KeKahu) pingStream(ctx context.Context, source, target, addr string, seq, n uint64, size int) ([]time.Duration, error) {
+	addr = resolveAddr(addr)
+	pinger := k.pingerFor(target, addr)
+	latencies := make([]time.Duration, n)
+	pingLog.debug("sending %d %s pings to %s", n, pinger.Transport(), addr)
+
+	payload := pingPayload(size)
+	msgs := make([]*ping.Packet, n)
+	for i := range msgs {
+		msgs[i] = &ping.Packet{Source: source, Target: target, Sequence: seq + uint64(i), Payload: payload}
+	}
+
+	// Only the first ping of the stream requests the latencies of the target
+	if n > 0 {
+		msgs[0].Gossip = k.conf().GossipLatency
+	}
+
+	var i int
+	err := pinger.Stream(ctx, addr, msgs, func(reply *ping.Packet, latency time.Duration) {
+		latencies[i] = latency
+		pingLog.info("ping %d from %s to %s in %s", msgs[i].Sequence, source, target, latency)
+		k.updateClock(target, reply, time.Unix(0, msgs[i].Sent).Add(latency))
+		k.collectGossip(target, reply)
+		k.recordPing(pinger.Transport(), msgs[i].Sent, source, target, msgs[i].Sequence, size, latency)
+		i++
+	})
+
+	// The pings that were not replied to are recorded as timeouts
+	for ; uint64(i) < n; i++ {
+		k.recordPing(pinger.Transport(), msgs[i].Sent, source, target, msgs[i].Sequence, size, 0)
+	}
+
+	return latencies, err
+}
+
+// Returns the pinger that pings the target at the addr, which sends them
+// through the proxy of the target if it has one.
+func (k *KeKahu) pingerFor(target, addr string) knet.Pinger {
+	if pinger := k.proxies.Pinger(target, addr); pinger != nil {
+		return pinger
+	}
+	return k.pinger
+}
+
+// Returns the payload of a ping of the size, nil if the size is zero. The
+// payload is filled with pseudo-random bytes rather than zeros so that it is
+// not shrunk by a compressing proxy or link.
+func pingPayload(size int) []byte {
+	if size <= 0 {
+		return nil
+	}
+
+	payload := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(payload)
+	return payload
+}
+
+// Updates the clock skew estimate of the target from the timestamps of the
+// reply, if the echo server timestamped it.
+func (k *KeKahu) updateClock(target string, reply *ping.Packet, received time.Time) {
+	if sample, ok := NewClockSample(reply, received); ok {
+		k.network.Clock(target, sample)
+		pingLog.debug("clock offset of %s is %s (delay %s)", target, sample.Offset, sample.Delay)
+	}
+}
+
+// Resolves the address by appending the default port if one isn't on it. The
+// address may be a hostname, an IPv4 address, or an IPv6 address with or
+// without brackets (e.g. "2001:db8::1" or "[2001:db8::1]:3284").
+func resolveAddr(addr string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+
+	host := strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+	return net.JoinHostPort(host, strings.TrimPrefix(knet.DefaultAddr, ":"))
+}
+
+// Resolves the domain to an IP address, selecting an address from the
+// preferred IP family ("ipv4" or "ipv6") if one is available.
+func resolveDomain(domain, prefer string) (string, error) {
+	ips, err := net.LookupIP(domain)
+	if err != nil {
+		return "", fmt.Errorf("could not resolve %s: %s", domain, err)
+	}
+
+	if len(ips) == 0 {
+		return "", fmt.Errorf("no addresses found for %s", domain)
+	}
+
+	for _, ip := range ips {
+		isv4 := ip.To4() != nil
+		if (prefer == IPv4 && isv4) || (prefer == IPv6 && !isv4) {
+			return ip.String(), nil
+		}
+	}
+
+	return ips[0].String(), nil
+}
@@ -0,0 +1,95 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/bbengfort/kekahu/kahu"
+)
+
+// EnrollTokenEnv is the environment variable the enroll command reads the
+// enrollment token from if it is not passed as a flag, so that the token is
+// not kept in the shell history or visible in the process list.
+const EnrollTokenEnv = "KEKAHU_ENROLL_TOKEN"
+
+//===========================================================================
+// Enrollment
+//===========================================================================
+
+// Enroll exchanges a short-lived enrollment token that an operator created in
+// Kahu for the permanent API key of the local host, so that hosts can be
+// provisioned without distributing the API key by hand. The host is enrolled
+// by its hostname, tags, and machine fingerprint. The configuration does not
+// need an API key, but the URL of Kahu and the transport of the requests are
+// taken from it. The API key is returned and not stored, see SaveAPIKey.
+func Enroll(ctx context.Context, config *Config, token string) (*kahu.EnrollResponse, error) {
+	if token == "" {
+		return nil, fmt.Errorf("no enrollment token: pass it with --token or set %s", EnrollTokenEnv)
+	}
+
+	if config.URL == "" {
+		return nil, errors.New("no kahu url to enroll with")
+	}
+
+	data := &kahu.EnrollRequest{Fingerprint: MachineFingerprint()}
+
+	var err error
+	if data.Hostname, err = config.LocalHostname(); err != nil {
+		return nil, err
+	}
+
+	if data.Tags, err = config.GetTags(); err != nil {
+		return nil, err
+	}
+
+	client := new(HTTPClient)
+	if err := client.Init(config, nil, nil); err != nil {
+		return nil, err
+	}
+
+	enrolled, err := client.Enroll(ctx, token, data)
+	if err != nil {
+		return nil, err
+	}
+
+	info("enrolled %s with kahu as %s", data.Hostname, enrolled.Replica)
+	return enrolled, nil
+}
+
+// SaveAPIKey stores the API key in the OS keychain under the account, or
+// encrypts it with the passphrase from key_passphrase or key_pass_command if
+// encrypt is true, then sets api_key in the configuration file at the path to
+// refer to it. The API key itself is never written to the configuration file.
+func (c *Config) SaveAPIKey(path, key, account string, encrypt bool) error {
+	if key == "" {
+		return errors.New("no api key to save")
+	}
+
+	var value string
+	if encrypt {
+		passphrase, err := c.GetKeyPassphrase()
+		if err != nil {
+			return err
+		}
+
+		if value, err = EncryptSecret(key, passphrase); err != nil {
+			return err
+		}
+	} else {
+		if account == "" {
+			account = DefaultKeychainAccount
+		}
+
+		if err := StoreKeychain(account, key); err != nil {
+			return err
+		}
+
+		value = KeychainPrefix + account
+		if account == DefaultKeychainAccount {
+			value = KeychainPrefix
+		}
+	}
+
+	return SetConfigValue(path, "api_key", value)
+}
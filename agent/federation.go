@@ -0,0 +1,376 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bbengfort/kekahu/kahu"
+	"github.com/bbengfort/x/peers"
+)
+
+// Features that can be enabled for each additional Kahu upstream.
+const (
+	HeartbeatFeature = "heartbeat" // send heartbeats to the upstream
+	LatencyFeature   = "latency"   // ping the upstream's neighbors and report the latencies and bandwidth
+	HealthFeature    = "health"    // send health reports to the upstream
+)
+
+// Upstream is an additional Kahu service that the host reports to, with its
+// own API key and the features that are enabled for it.
+type Upstream struct {
+	URL      string   // base URL of the Kahu service
+	APIKey   string   // API key of the local host on the Kahu service
+	Features []string // enabled features, all features if empty
+}
+
+// Enabled returns true if the feature is enabled for the upstream.
+func (u *Upstream) Enabled(feature string) bool {
+	return len(u.Features) == 0 || containsString(u.Features, feature)
+}
+
+// ParseUpstreams parses a semicolon separated list of upstreams, each of which
+// is the URL and API key of the Kahu service separated by whitespace and
+// optionally followed by a comma separated list of features, e.g.
+// "https://kahu.example.com key1; https://kahu.example.org key2 heartbeat,health".
+func ParseUpstreams(s string) ([]*Upstream, error) {
+	upstreams := make([]*Upstream, 0)
+	for _, entry := range strings.Split(s, ";") {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("upstream '%s' must be a url and api key optionally followed by features", strings.TrimSpace(entry))
+		}
+
+		if u, err := url.Parse(fields[0]); err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("upstream '%s' is not a valid url", fields[0])
+		}
+
+		upstream := &Upstream{URL: fields[0], APIKey: fields[1]}
+		if len(fields) == 3 {
+			for _, feature := range strings.Split(fields[2], ",") {
+				feature = strings.ToLower(strings.TrimSpace(feature))
+				switch feature {
+				case HeartbeatFeature, LatencyFeature, HealthFeature:
+					upstream.Features = append(upstream.Features, feature)
+				case "":
+				default:
+					return nil, fmt.Errorf("unknown upstream feature '%s'", feature)
+				}
+			}
+		}
+
+		upstreams = append(upstreams, upstream)
+	}
+	return upstreams, nil
+}
+
+//===========================================================================
+// Federated Client
+//===========================================================================
+
+// FederatedClient implements KahuClient by fanning out heartbeats, latency
+// reports, and health reports to additional Kahu upstreams as well as the
+// primary Kahu service. The responses (e.g. whether the host is active) and
+// errors of the primary are returned; errors from the upstreams are logged
+// and tracked per upstream so that one unreachable upstream does not affect
+// the others. Each upstream has its own HTTP client and so its own rate limit
+// and retries, but failed reports are only spooled for the primary.
+//
+// Neighbors are fetched from the primary and from each upstream with latency
+// enabled, and latency reports are only sent to the services that listed the
+// target as a neighbor.
+type FederatedClient struct {
+	sync.Mutex
+	primary   KahuClient              // the configured Kahu service
+	upstreams []*federatedUpstream    // the additional Kahu services
+	targets   map[string][]KahuClient // the services that listed each neighbor
+}
+
+// UpstreamStatus reports the errors of requests to a Kahu upstream.
+type UpstreamStatus struct {
+	URL         string    `json:"url"`                    // base URL of the Kahu service
+	Features    []string  `json:"features"`               // enabled features
+	Requests    uint64    `json:"requests"`               // number of requests made to the upstream
+	Errors      uint64    `json:"errors"`                 // number of failed requests
+	LastError   string    `json:"last_error,omitempty"`   // the last error from the upstream
+	LastSuccess time.Time `json:"last_success,omitempty"` // timestamp of the last successful request
+}
+
+// An upstream with its client and the status of the requests to it.
+type federatedUpstream struct {
+	*Upstream
+	client KahuClient
+	status UpstreamStatus
+}
+
+// NewFederatedClient creates an HTTP client for each upstream using the
+// configuration (e.g. timeouts, retries, and TLS) with the upstream's URL and
+// API key, and fans out requests to them and the primary client.
+func NewFederatedClient(primary KahuClient, config *Config, upstreams []*Upstream) (*FederatedClient, error) {
+	c := &FederatedClient{
+		primary:   primary,
+		upstreams: make([]*federatedUpstream, 0, len(upstreams)),
+		targets:   make(map[string][]KahuClient),
+	}
+
+	for _, upstream := range upstreams {
+		conf := *config
+		conf.URL = upstream.URL
+		conf.APIKey = upstream.APIKey
+
+		// The signing keys are shared with the primary Kahu service only
+		conf.SigningKey, conf.SigningKeyAlt = "", ""
+
+		client := new(HTTPClient)
+		if err := client.Init(&conf, nil, nil); err != nil {
+			return nil, err
+		}
+
+		features := upstream.Features
+		if len(features) == 0 {
+			features = []string{HeartbeatFeature, LatencyFeature, HealthFeature}
+		}
+
+		c.upstreams = append(c.upstreams, &federatedUpstream{
+			Upstream: upstream,
+			client:   client,
+			status:   UpstreamStatus{URL: upstream.URL, Features: features},
+		})
+	}
+
+	return c, nil
+}
+
+// Heartbeat sends the heartbeat to the primary and the upstreams with the
+// heartbeat feature, returning the response of the primary.
+func (c *FederatedClient) Heartbeat(ctx context.Context, data *kahu.HeartbeatRequest) (*kahu.HeartbeatResponse, error) {
+	var hb *kahu.HeartbeatResponse
+	err := c.fanout(ctx, HeartbeatFeature, func(client KahuClient) (err error) {
+		_, err = client.Heartbeat(ctx, data)
+		return err
+	}, func() (err error) {
+		hb, err = c.primary.Heartbeat(ctx, data)
+		return err
+	})
+	return hb, err
+}
+
+// Neighbors fetches the neighbors from the primary and the upstreams with the
+// latency feature, returning the source of the primary and the union of the
+// targets of all of the services.
+func (c *FederatedClient) Neighbors(ctx context.Context) (*kahu.NeighborsResponse, error) {
+	var mu sync.Mutex
+	responses := make(map[KahuClient]*kahu.NeighborsResponse)
+
+	var info *kahu.NeighborsResponse
+	err := c.fanout(ctx, LatencyFeature, func(client KahuClient) error {
+		rep, err := client.Neighbors(ctx)
+		if err == nil {
+			mu.Lock()
+			responses[client] = rep
+			mu.Unlock()
+		}
+		return err
+	}, func() (err error) {
+		info, err = c.primary.Neighbors(ctx)
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	responses[c.primary] = info
+
+	// Merge the targets and record which services listed each target
+	c.Lock()
+	defer c.Unlock()
+
+	c.targets = make(map[string][]KahuClient)
+	merged := &kahu.NeighborsResponse{Source: info.Source, Targets: make([]*kahu.Neighbor, 0, len(info.Targets))}
+	for _, client := range c.clients() {
+		rep, ok := responses[client]
+		if !ok {
+			continue
+		}
+
+		for _, target := range rep.Targets {
+			if _, ok := c.targets[target.Hostname]; !ok {
+				merged.Targets = append(merged.Targets, target)
+			}
+			c.targets[target.Hostname] = append(c.targets[target.Hostname], client)
+		}
+	}
+
+	return merged, nil
+}
+
+// ReportLatency sends the latencies of each target to the services that
+// listed it as a neighbor, returning the responses of the primary.
+func (c *FederatedClient) ReportLatency(ctx context.Context, data kahu.UpdateLatencyRequests) (kahu.UpdateLatencyResponses, error) {
+	// Split the batch by the services that listed the target
+	c.Lock()
+	batches := make(map[KahuClient]kahu.UpdateLatencyRequests)
+	for _, req := range data {
+		clients, ok := c.targets[req.Target]
+		if !ok {
+			clients = []KahuClient{c.primary}
+		}
+
+		for _, client := range clients {
+			batches[client] = append(batches[client], req)
+		}
+	}
+	c.Unlock()
+
+	info := make(kahu.UpdateLatencyResponses, 0)
+	err := c.fanout(ctx, LatencyFeature, func(client KahuClient) error {
+		if batch, ok := batches[client]; ok {
+			_, err := client.ReportLatency(ctx, batch)
+			return err
+		}
+		return nil
+	}, func() (err error) {
+		if batch, ok := batches[c.primary]; ok {
+			info, err = c.primary.ReportLatency(ctx, batch)
+		}
+		return err
+	})
+	return info, err
+}
+
+// Replicas fetches the replicas from the primary only.
+func (c *FederatedClient) Replicas(ctx context.Context) ([]*peers.Peer, error) {
+	return c.primary.Replicas(ctx)
+}
+
+// Health sends the health report to the primary and the upstreams with the
+// health feature.
+func (c *FederatedClient) Health(ctx context.Context, status *kahu.SystemStatus) error {
+	return c.fanout(ctx, HealthFeature, func(client KahuClient) error {
+		return client.Health(ctx, status)
+	}, func() error {
+		return c.primary.Health(ctx, status)
+	})
+}
+
+// HealthDelta sends the changes to the health report to the primary and the
+// full health report to the upstreams with the health feature, since the
+// upstreams may have missed earlier reports that the changes apply to.
+func (c *FederatedClient) HealthDelta(ctx context.Context, status *kahu.SystemStatus, delta kahu.HealthDelta) error {
+	return c.fanout(ctx, HealthFeature, func(client KahuClient) error {
+		return client.Health(ctx, status)
+	}, func() error {
+		return c.primary.HealthDelta(ctx, status, delta)
+	})
+}
+
+// ReportBandwidth sends the bandwidth measurements of each target to the
+// services that listed it as a neighbor.
+func (c *FederatedClient) ReportBandwidth(ctx context.Context, data kahu.BandwidthRequests) error {
+	// Split the batch by the services that listed the target
+	c.Lock()
+	batches := make(map[KahuClient]kahu.BandwidthRequests)
+	for _, req := range data {
+		clients, ok := c.targets[req.Target]
+		if !ok {
+			clients = []KahuClient{c.primary}
+		}
+
+		for _, client := range clients {
+			batches[client] = append(batches[client], req)
+		}
+	}
+	c.Unlock()
+
+	report := func(client KahuClient) error {
+		if batch, ok := batches[client]; ok {
+			return client.ReportBandwidth(ctx, batch)
+		}
+		return nil
+	}
+
+	return c.fanout(ctx, LatencyFeature, report, func() error {
+		return report(c.primary)
+	})
+}
+
+// ReportMatrix sends the latency matrix to the primary and the upstreams with
+// the latency feature.
+func (c *FederatedClient) ReportMatrix(ctx context.Context, data kahu.MatrixRequests) error {
+	return c.fanout(ctx, LatencyFeature, func(client KahuClient) error {
+		return client.ReportMatrix(ctx, data)
+	}, func() error {
+		return c.primary.ReportMatrix(ctx, data)
+	})
+}
+
+// Upstreams returns the status of the requests made to each upstream.
+func (c *FederatedClient) Upstreams() []UpstreamStatus {
+	c.Lock()
+	defer c.Unlock()
+
+	status := make([]UpstreamStatus, 0, len(c.upstreams))
+	for _, upstream := range c.upstreams {
+		status = append(status, upstream.status)
+	}
+	return status
+}
+
+// Sends the request to the upstreams with the feature enabled concurrently
+// with the request to the primary, waiting for all of them to complete. The
+// errors of the upstreams are logged and recorded, and the error of the
+// primary is returned.
+func (c *FederatedClient) fanout(ctx context.Context, feature string, request func(KahuClient) error, primary func() error) error {
+	var wg sync.WaitGroup
+	for _, upstream := range c.upstreams {
+		if !upstream.Enabled(feature) {
+			continue
+		}
+
+		wg.Add(1)
+		go func(upstream *federatedUpstream) {
+			defer wg.Done()
+			err := request(upstream.client)
+			c.record(upstream, err)
+
+			if err != nil && ctx.Err() == nil {
+				warn("kahu upstream %s %s failed: %s", upstream.URL, feature, err)
+			}
+		}(upstream)
+	}
+
+	err := primary()
+	wg.Wait()
+	return err
+}
+
+// Records the result of a request to the upstream.
+func (c *FederatedClient) record(upstream *federatedUpstream, err error) {
+	c.Lock()
+	defer c.Unlock()
+
+	upstream.status.Requests++
+	if err != nil {
+		upstream.status.Errors++
+		upstream.status.LastError = err.Error()
+		return
+	}
+	upstream.status.LastSuccess = time.Now()
+}
+
+// Returns the primary and upstream clients in order (not thread-safe).
+func (c *FederatedClient) clients() []KahuClient {
+	clients := make([]KahuClient, 0, len(c.upstreams)+1)
+	clients = append(clients, c.primary)
+	for _, upstream := range c.upstreams {
+		clients = append(clients, upstream.client)
+	}
+	return clients
+}
@@ -0,0 +1,182 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Policies for the first pings sent to a neighbor on a new connection, which
+// include the connection setup and would inflate the slowest latency and the
+// standard deviation for good.
+const (
+	DiscardWarmup = "discard" // leave warm-up pings out of the statistics and the reports to Kahu
+	MarkWarmup    = "mark"    // leave warm-up pings out of the statistics, report them flagged as warmup
+)
+
+// Methods to reject outliers from the latency statistics.
+const (
+	MADOutliers  = "mad"  // reject latencies too many median absolute deviations above the median
+	TrimOutliers = "trim" // reject latencies above a percentile of the recent latencies
+)
+
+// Default thresholds of the outlier rejection methods.
+const (
+	DefaultMADThreshold   = 3.5 // modified z-score, as recommended by Iglewicz and Hoaglin
+	DefaultTrimPercentile = 99.0
+)
+
+// MinOutlierSamples is the number of recent successful pings to a neighbor
+// needed before outliers are rejected.
+const MinOutlierSamples = 8
+
+// SampleKind classifies a latency sample by whether it is added to the
+// statistics of the neighbor.
+type SampleKind uint8
+
+// Kinds of latency samples.
+const (
+	AcceptedSample SampleKind = iota // added to the statistics (including timeouts)
+	WarmupSample                     // one of the first pings on a new connection
+	OutlierSample                    // rejected by the outlier filter
+)
+
+//===========================================================================
+// Sample Filter
+//===========================================================================
+
+// SampleFilter decides which latency samples are added to the statistics of
+// each neighbor. The first Warmup pings on each new connection are warm-up
+// samples. A connection is new when the service starts, after a ping to the
+// neighbor times out (the connection is then redialed), and after the
+// neighbor hasn't been pinged for longer than Idle (the connection is then
+// closed by the pool). Other samples are rejected as outliers by comparing
+// them to the recent latencies with the Outliers method, if set.
+type SampleFilter struct {
+	Warmup    int           // pings on each new connection that are warm-up samples
+	Idle      time.Duration // a connection unused for longer than this is closed
+	Outliers  string        // mad or trim, outliers are not rejected if empty
+	Threshold float64       // modified z-score for mad, percentile for trim
+}
+
+// ParseOutlierFilter parses the method and optional threshold of the outlier
+// filter, e.g. "mad", "mad:5", or "trim:99.5". An empty string disables
+// outlier rejection.
+func ParseOutlierFilter(s string) (method string, threshold float64, err error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "" {
+		return "", 0, nil
+	}
+
+	parts := strings.SplitN(s, ":", 2)
+	method = strings.TrimSpace(parts[0])
+	switch method {
+	case MADOutliers:
+		threshold = DefaultMADThreshold
+	case TrimOutliers:
+		threshold = DefaultTrimPercentile
+	default:
+		return "", 0, fmt.Errorf("unknown outlier filter '%s', use %s or %s", method, MADOutliers, TrimOutliers)
+	}
+
+	if len(parts) == 2 {
+		if threshold, err = strconv.ParseFloat(strings.TrimSpace(parts[1]), 64); err != nil || threshold <= 0 {
+			return "", 0, fmt.Errorf("could not parse %s outlier threshold '%s'", method, parts[1])
+		}
+
+		if method == TrimOutliers && threshold >= 100 {
+			return "", 0, errors.New("trim outlier percentile must be less than 100")
+		}
+	}
+	return method, threshold, nil
+}
+
+// Classifies the latency sample to the neighbor with the statistics s at the
+// time, updating the state of the connection to the neighbor. A nil filter
+// accepts all samples.
+func (f *SampleFilter) classify(s *LatencyStats, latency time.Duration, now time.Time) SampleKind {
+	if f == nil {
+		return AcceptedSample
+	}
+
+	if s.seen.IsZero() || (f.Idle > 0 && now.Sub(s.seen) > f.Idle) {
+		s.warm = 0
+	}
+	s.seen = now
+
+	// Timeouts are always counted, and the failed connection is redialed
+	if latency == 0 {
+		s.warm = 0
+		return AcceptedSample
+	}
+
+	if s.warm < f.Warmup {
+		s.warm++
+		return WarmupSample
+	}
+
+	if f.outlier(s.Recent, latency.Seconds()) {
+		return OutlierSample
+	}
+	return AcceptedSample
+}
+
+// Returns true if the latency in seconds is an outlier compared to the recent
+// latencies. Only slow latencies are outliers since a path can't be faster
+// than it is. Outliers are rejected relative to the recent latencies rather
+// than the statistics so that a lasting change of the latency is accepted
+// once it is the new normal.
+func (f *SampleFilter) outlier(recent []float64, latency float64) bool {
+	if f.Outliers == "" {
+		return false
+	}
+
+	samples := make([]float64, 0, len(recent))
+	for _, sample := range recent {
+		if sample > 0 {
+			samples = append(samples, sample)
+		}
+	}
+
+	if len(samples) < MinOutlierSamples {
+		return false
+	}
+	sort.Float64s(samples)
+
+	switch f.Outliers {
+	case MADOutliers:
+		median := medianOf(samples)
+		deviations := make([]float64, 0, len(samples))
+		for _, sample := range samples {
+			deviations = append(deviations, math.Abs(sample-median))
+		}
+		sort.Float64s(deviations)
+
+		mad := medianOf(deviations)
+		if mad == 0 {
+			return false
+		}
+		return 0.6745*(latency-median)/mad > f.Threshold
+	case TrimOutliers:
+		rank := int(math.Ceil(f.Threshold / 100 * float64(len(samples))))
+		if rank < 1 {
+			rank = 1
+		}
+		return latency > samples[rank-1]
+	default:
+		return false
+	}
+}
+
+// Returns the median of the sorted values.
+func medianOf(sorted []float64) float64 {
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[mid-1] + sorted[mid]) / 2
+	}
+	return sorted[mid]
+}
@@ -0,0 +1,58 @@
+package agent
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// DefaultUserAgent returns the User-Agent sent to Kahu if none is configured,
+// which identifies the version of kekahu and the platform it runs on so that
+// Kahu can detect version skew across the fleet, e.g.
+// "kekahu/1.2 (linux; amd64) go1.10".
+func DefaultUserAgent() string {
+	return fmt.Sprintf("kekahu/%s (%s; %s) %s", PackageVersion, runtime.GOOS, runtime.GOARCH, runtime.Version())
+}
+
+// GetUserAgent returns the User-Agent sent with requests to Kahu.
+func (c *Config) GetUserAgent() string {
+	if c.UserAgent != "" {
+		return c.UserAgent
+	}
+	return DefaultUserAgent()
+}
+
+//===========================================================================
+// Machine Fingerprint
+//===========================================================================
+
+// The fingerprint is only computed once since the machine ID doesn't change.
+var fingerprint struct {
+	sync.Once
+	value string
+}
+
+// MachineFingerprint returns a stable identifier of the machine derived from
+// its machine ID (e.g. /etc/machine-id on Linux), or an empty string if the
+// machine ID cannot be read. The machine ID is not sent itself; instead the
+// fingerprint is an HMAC of the application name keyed by the machine ID, as
+// recommended by machine-id(5), so that it can't be correlated with the IDs
+// used by other applications.
+func MachineFingerprint() string {
+	fingerprint.Do(func() {
+		id, err := machineID()
+		if err != nil || id == "" {
+			debug("could not read the machine id, requests are not fingerprinted: %v", err)
+			return
+		}
+
+		mac := hmac.New(sha256.New, []byte(strings.ToLower(id)))
+		mac.Write([]byte("kekahu"))
+		fingerprint.value = hex.EncodeToString(mac.Sum(nil))[:32]
+	})
+	return fingerprint.value
+}
@@ -0,0 +1,26 @@
+package agent
+
+import (
+	"errors"
+	"io/ioutil"
+	"strings"
+)
+
+// Paths of the machine ID set by systemd, or by dbus on older systems.
+var machineIDPaths = []string{"/etc/machine-id", "/var/lib/dbus/machine-id"}
+
+// Returns the machine ID of the host from the first machine-id file that
+// exists. Unlike the boot ID it doesn't change when the host restarts.
+func machineID() (string, error) {
+	for _, path := range machineIDPaths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+
+		if id := strings.TrimSpace(string(data)); id != "" {
+			return id, nil
+		}
+	}
+	return "", errors.New("no machine-id file found")
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package agent
+
+import "github.com/shirou/gopsutil/host"
+
+// Returns the ID of the host reported by the OS, e.g. the IOPlatformUUID on
+// macOS or the hostid on FreeBSD.
+func machineID() (string, error) {
+	info, err := host.Info()
+	if err != nil {
+		return "", err
+	}
+	return info.HostID, nil
+}
@@ -0,0 +1,219 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/bbengfort/x/peers"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Additional peers file formats, JSON, YAML, and TOML are shared with the
+// configuration template formats.
+const (
+	HostsFormat = "hosts" // /etc/hosts fragment
+	EtcdFormat  = "etcd"  // etcd --initial-cluster bootstrap list
+)
+
+// EtcdPeerPort is the port of the etcd peer URLs in the etcd bootstrap list.
+const EtcdPeerPort = "2380"
+
+// PeersEncoder renders the replicas fetched from Kahu in a file format.
+type PeersEncoder func(replicas []*peers.Peer) ([]byte, error)
+
+// RegisterPeersFormat adds or replaces the encoder for the peers format so
+// that sync can generate other files from the Kahu replicas.
+func RegisterPeersFormat(format string, encoder PeersEncoder) {
+	peersFormats.Lock()
+	defer peersFormats.Unlock()
+	peersFormats.encoders[strings.ToLower(format)] = encoder
+}
+
+// PeersFormats returns the names of the registered peers formats.
+func PeersFormats() []string {
+	peersFormats.RLock()
+	defer peersFormats.RUnlock()
+
+	formats := make([]string, 0, len(peersFormats.encoders))
+	for format := range peersFormats.encoders {
+		formats = append(formats, format)
+	}
+	sort.Strings(formats)
+	return formats
+}
+
+// EncodePeers renders the replicas in the specified peers format.
+func EncodePeers(format string, replicas []*peers.Peer) ([]byte, error) {
+	peersFormats.RLock()
+	encoder, ok := peersFormats.encoders[strings.ToLower(format)]
+	peersFormats.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown peers format '%s', use one of %s", format, strings.Join(PeersFormats(), ", "))
+	}
+	return encoder(replicas)
+}
+
+// The registry of peers formats, safe for concurrent registration.
+var peersFormats = struct {
+	sync.RWMutex
+	encoders map[string]PeersEncoder
+}{encoders: map[string]PeersEncoder{
+	JSONFormat:  encodePeersJSON,
+	YAMLFormat:  encodePeersYAML,
+	TOMLFormat:  encodePeersTOML,
+	HostsFormat: encodePeersHosts,
+	EtcdFormat:  encodePeersEtcd,
+}}
+
+//===========================================================================
+// Peers Encoders
+//===========================================================================
+
+// Encodes the fluidfs-style peers.json with the sync time in the info.
+func encodePeersJSON(replicas []*peers.Peer) ([]byte, error) {
+	info, err := peersInfo(replicas)
+	if err != nil {
+		return nil, err
+	}
+	info["updated"] = time.Now()
+
+	return json.MarshalIndent(&peers.Peers{Info: info, Peers: replicas}, "", "  ")
+}
+
+// Encodes the peers document with the same keys as the JSON format. The sync
+// time is omitted so that the file only changes when the membership does.
+func encodePeersYAML(replicas []*peers.Peer) ([]byte, error) {
+	doc, err := peersDocument(replicas)
+	if err != nil {
+		return nil, err
+	}
+
+	// Unmarshal the JSON as YAML (a superset of JSON) to preserve key order
+	var slice yaml.MapSlice
+	if err := yaml.Unmarshal(doc, &slice); err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(slice)
+}
+
+// Encodes the peers document with the same keys as the JSON format, with the
+// replicas as an array of tables.
+func encodePeersTOML(replicas []*peers.Peer) ([]byte, error) {
+	doc, err := peersDocument(replicas)
+	if err != nil {
+		return nil, err
+	}
+
+	var data map[string]interface{}
+	if err := json.Unmarshal(doc, &data); err != nil {
+		return nil, err
+	}
+
+	buf := new(bytes.Buffer)
+	if err := toml.NewEncoder(buf).Encode(integers(data)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Encodes a hosts file fragment mapping each replica's IP address to its
+// domain, hostname, and name. Replicas without an IP address are skipped.
+func encodePeersHosts(replicas []*peers.Peer) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	fmt.Fprintln(buf, "# kekahu replicas synchronized from Kahu")
+
+	for _, replica := range replicas {
+		if replica.IPAddr == "" {
+			continue
+		}
+
+		names := make([]string, 0, 3)
+		for _, name := range []string{replica.Domain, replica.Hostname, replica.Name} {
+			if name != "" && !containsString(names, name) {
+				names = append(names, name)
+			}
+		}
+
+		if len(names) > 0 {
+			fmt.Fprintf(buf, "%s\t%s\n", replica.IPAddr, strings.Join(names, " "))
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Encodes the replicas as the etcd --initial-cluster list of name=peerURL
+// pairs using the replica's IP address and the default etcd peer port.
+func encodePeersEtcd(replicas []*peers.Peer) ([]byte, error) {
+	members := make([]string, 0, len(replicas))
+	for _, replica := range replicas {
+		if replica.IPAddr == "" {
+			continue
+		}
+		addr := net.JoinHostPort(replica.IPAddr, EtcdPeerPort)
+		members = append(members, fmt.Sprintf("%s=http://%s", replica.Name, addr))
+	}
+	return []byte(strings.Join(members, ",") + "\n"), nil
+}
+
+// Returns the JSON peers document without the sync time.
+func peersDocument(replicas []*peers.Peer) ([]byte, error) {
+	info, err := peersInfo(replicas)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&peers.Peers{Info: info, Peers: replicas})
+}
+
+// Returns the info block of the peers document with the number of replicas
+// and the checksum of the replicas, which is verified when the file is loaded.
+func peersInfo(replicas []*peers.Peer) (map[string]interface{}, error) {
+	checksum, err := PeersChecksum(replicas)
+	if err != nil {
+		return nil, err
+	}
+
+	info := make(map[string]interface{})
+	info["num_replicas"] = len(replicas)
+	info[PeersChecksumKey] = checksum
+	return info, nil
+}
+
+// Converts the whole number float64 values decoded from JSON into integers
+// so that they are not encoded as floats (e.g. "port = 3264.0" in TOML).
+func integers(val interface{}) interface{} {
+	switch v := val.(type) {
+	case float64:
+		if v == math.Trunc(v) {
+			return int64(v)
+		}
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = integers(item)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = integers(item)
+		}
+	}
+	return val
+}
+
+// Returns true if the string is in the list.
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,220 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bbengfort/kekahu/kahu"
+	"github.com/bbengfort/kekahu/ping"
+)
+
+// MaxGossipPeers is the number of latency summaries the echo server includes
+// in a ping reply, the peers with the most samples are shared first. It keeps
+// the reply small enough for a UDP datagram.
+const MaxGossipPeers = 12
+
+// GossipExpiry is how long the latencies gossiped by a host are kept in the
+// latency matrix after they were last received.
+const GossipExpiry = 15 * time.Minute
+
+//===========================================================================
+// Latency Gossip
+//===========================================================================
+
+// Returns the latency summaries the echo server shares with the clients that
+// request them, none if gossip_latency is disabled.
+func (k *KeKahu) gossipLatencies() []*ping.LatencySummary {
+	if !k.conf().GossipLatency {
+		return nil
+	}
+	return k.network.Summaries(MaxGossipPeers)
+}
+
+// Adds the latency summaries the echo server of the target included in its
+// reply to the latency matrix.
+func (k *KeKahu) collectGossip(target string, reply *ping.Packet) {
+	if len(reply.Latencies) == 0 {
+		return
+	}
+
+	k.matrix.Update(target, reply.Latencies)
+	gossipLog.debug("%s gossiped its latencies to %d peers", target, len(reply.Latencies))
+}
+
+// LatencyMatrix returns the latencies between the hosts of the network that
+// the local host measured or that its neighbors gossiped on their ping
+// replies, with gossip_latency enabled.
+func (k *KeKahu) LatencyMatrix() kahu.MatrixRequests {
+	return k.matrix.Entries(time.Now())
+}
+
+// ReportMatrix posts the latency matrix to Kahu, then schedules the next report
+// after the gossip interval. The matrix is usually reported much less often
+// than the latencies are measured since Kahu also receives the latencies that
+// each host measures itself.
+func (k *KeKahu) ReportMatrix(ctx context.Context) {
+	interval, err := k.conf().GetGossipInterval()
+	if err != nil || interval <= 0 || ctx.Err() != nil {
+		return
+	}
+	defer k.schedule(interval, k.ReportMatrix)
+
+	matrix := k.LatencyMatrix()
+	if len(matrix) == 0 {
+		gossipLog.debug("no gossiped latencies to report")
+		return
+	}
+
+	if err := k.api.ReportMatrix(ctx, matrix); err != nil {
+		k.echan <- gossipLog.wrap(err)
+	}
+}
+
+// Summaries returns the summaries of the latencies to the hosts with the most
+// samples, at most limit of them (all of them if limit is zero), to gossip to
+// the peers. The buckets of pings of other payload sizes are not gossiped.
+func (n *Network) Summaries(limit int) []*ping.LatencySummary {
+	n.RLock()
+	defer n.RUnlock()
+
+	summaries := make([]*ping.LatencySummary, 0, len(n.metrics))
+	for host, metrics := range n.metrics {
+		if metrics.Samples+metrics.Timeouts == 0 || isPingBucket(host) {
+			continue
+		}
+
+		p50, _, p99 := metrics.Histogram.Percentiles()
+		summaries = append(summaries, &ping.LatencySummary{
+			Target:  host,
+			Samples: metrics.Samples,
+			Mean:    int64(castSeconds(metrics.Mean())),
+			P50:     int64(p50),
+			P99:     int64(p99),
+			Loss:    metrics.Loss(),
+		})
+	}
+
+	sort.Slice(summaries, func(i, j int) bool {
+		if summaries[i].Samples != summaries[j].Samples {
+			return summaries[i].Samples > summaries[j].Samples
+		}
+		return summaries[i].Target < summaries[j].Target
+	})
+
+	if limit > 0 && len(summaries) > limit {
+		summaries = summaries[:limit]
+	}
+	return summaries
+}
+
+//===========================================================================
+// Latency Matrix
+//===========================================================================
+
+// LatencyMatrix is a partial matrix of the latencies between the hosts of the
+// network, built from the latency summaries that the echo servers of the
+// neighbors piggyback on their ping replies and the latencies of the local
+// host. Each row holds the latencies reported by a source host and is replaced
+// whenever the host gossips again; rows expire after the GossipExpiry. The
+// matrix is thread-safe.
+type LatencyMatrix struct {
+	sync.RWMutex
+	rows map[string]*matrixRow
+}
+
+// The latencies reported by a host and when they were received.
+type matrixRow struct {
+	updated   time.Time
+	latencies []*ping.LatencySummary
+}
+
+// NewLatencyMatrix returns an empty latency matrix.
+func NewLatencyMatrix() *LatencyMatrix {
+	return &LatencyMatrix{rows: make(map[string]*matrixRow)}
+}
+
+// Update replaces the latencies reported by the source.
+func (m *LatencyMatrix) Update(source string, latencies []*ping.LatencySummary) {
+	if len(latencies) == 0 {
+		return
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	m.rows[source] = &matrixRow{updated: time.Now(), latencies: latencies}
+}
+
+// Entries returns the latencies in the matrix ordered by source and target,
+// dropping the rows that have expired by now.
+func (m *LatencyMatrix) Entries(now time.Time) kahu.MatrixRequests {
+	m.Lock()
+	defer m.Unlock()
+
+	sources := make([]string, 0, len(m.rows))
+	for source, row := range m.rows {
+		if now.Sub(row.updated) > GossipExpiry {
+			delete(m.rows, source)
+			continue
+		}
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+
+	entries := make(kahu.MatrixRequests, 0, len(sources))
+	for _, source := range sources {
+		row := m.rows[source]
+		for _, latency := range row.latencies {
+			entries = append(entries, &kahu.MatrixRequest{
+				Source:  source,
+				Target:  latency.Target,
+				Samples: latency.Samples,
+				Mean:    float64(latency.Mean) / float64(time.Millisecond),
+				P50:     float64(latency.P50) / float64(time.Millisecond),
+				P99:     float64(latency.P99) / float64(time.Millisecond),
+				Loss:    latency.Loss,
+				Age:     now.Sub(row.updated).Seconds(),
+			})
+		}
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].Source != entries[j].Source {
+			return entries[i].Source < entries[j].Source
+		}
+		return entries[i].Target < entries[j].Target
+	})
+	return entries
+}
+
+// Writes the latency matrix as Prometheus gauges labeled by source and target.
+func (m *LatencyMatrix) write(w io.Writer) {
+	entries := m.Entries(time.Now())
+
+	writeHeader(w, "kekahu_gossip_latency_seconds", "gauge", "Mean latency from the source to the target, reported by the source.")
+	for _, entry := range entries {
+		fmt.Fprintf(w, "kekahu_gossip_latency_seconds{source=%q,target=%q} %g\n", entry.Source, entry.Target, entry.Mean/1000.0)
+	}
+
+	writeHeader(w, "kekahu_gossip_latency_p99_seconds", "gauge", "99th percentile latency from the source to the target, reported by the source.")
+	for _, entry := range entries {
+		fmt.Fprintf(w, "kekahu_gossip_latency_p99_seconds{source=%q,target=%q} %g\n", entry.Source, entry.Target, entry.P99/1000.0)
+	}
+
+	writeHeader(w, "kekahu_gossip_loss_percent", "gauge", "Percentage of pings from the source to the target that timed out, reported by the source.")
+	for _, entry := range entries {
+		fmt.Fprintf(w, "kekahu_gossip_loss_percent{source=%q,target=%q} %g\n", entry.Source, entry.Target, entry.Loss)
+	}
+
+	writeHeader(w, "kekahu_gossip_age_seconds", "gauge", "Time since the source last reported its latencies.")
+	var last string
+	for _, entry := range entries {
+		if entry.Source != last {
+			fmt.Fprintf(w, "kekahu_gossip_age_seconds{source=%q} %.3f\n", entry.Source, entry.Age)
+			last = entry.Source
+		}
+	}
+}
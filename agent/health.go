@@ -0,0 +1,148 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/bbengfort/kekahu/doctor"
+	"github.com/bbengfort/kekahu/kahu"
+	"github.com/bbengfort/kekahu/ping"
+)
+
+// Health reports the system status to Kahu using the system HealthCheck.
+func (k *KeKahu) Health(ctx context.Context) {
+	trace("executing system health check")
+
+	// Get the health check form the system
+	health, err := collectHealth(ctx, k.conf())
+	if err != nil {
+		// TODO: should we really be logging these errors if we're going to fail?
+		k.echan <- healthLog.wrap(err)
+		return
+	}
+
+	// Record the health report to export to OpenTelemetry
+	k.metrics.Health(health)
+
+	// Add the heartbeats and errors of the service to the process status
+	if health.Process != nil {
+		k.state.Process(health.Process)
+	}
+
+	// Add the pings received by the echo server so Kahu can cross-check links
+	if k.conf().HealthEchoStats {
+		health.Echo = k.EchoStats()
+	}
+
+	// Add the clock skew so Kahu can discount latencies from skewed hosts
+	health.SkewMS = k.skewMS()
+
+	// Evaluate the health rules, still reporting the health if they fail
+	if err := k.checkAlerts(health); err != nil {
+		k.echan <- healthLog.wrap(err)
+	}
+
+	// The health is only collected locally until the API key is provisioned
+	if k.LocalOnly() {
+		healthLog.debug("running local-only, health report not sent to kahu")
+		return
+	}
+
+	// Post the health report to Kahu, identified by the assigned replica name
+	health.Replica = k.identity.Replica()
+	if err := k.reportHealth(ctx, health); err != nil {
+		k.echan <- healthLog.wrap(err)
+	}
+}
+
+// Returns the system health of the local host with the state of the service,
+// evaluated against the configured health rules but without alerting.
+func (k *KeKahu) localHealth() (*kahu.SystemStatus, error) {
+	health, err := systemHealth(k.conf())
+	if err != nil {
+		return nil, err
+	}
+
+	if health.Process != nil {
+		k.state.Process(health.Process)
+	}
+
+	if k.conf().HealthEchoStats {
+		health.Echo = k.EchoStats()
+	}
+
+	health.SkewMS = k.skewMS()
+	return health, nil
+}
+
+// Returns the system health of the configured disks evaluated against the
+// configured health rules.
+func systemHealth(conf *Config) (*kahu.SystemStatus, error) {
+	health, err := collectHealth(context.Background(), conf)
+	if err != nil {
+		return nil, err
+	}
+
+	rules, err := conf.GetHealthRules()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := health.Evaluate(rules); err != nil {
+		return nil, err
+	}
+	return health, nil
+}
+
+// Collects the system health of the configured disks within the configured
+// timeout. If only some of the status components fail, their errors are
+// logged and the partial status is returned.
+func collectHealth(ctx context.Context, conf *Config) (*kahu.SystemStatus, error) {
+	timeout, err := conf.GetHealthTimeout()
+	if err != nil {
+		return nil, err
+	}
+
+	sample, err := conf.GetCPUSample()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	health, err := doctor.HealthCheckScope(ctx, true, sample, conf.GetHealthScope(), conf.GetDiskPaths()...)
+	if health == nil {
+		return nil, err
+	}
+
+	// The image can't be found from inside the container unless it's configured
+	if health.Container != nil && conf.ContainerImage != "" {
+		health.Container.Image = conf.ContainerImage
+	}
+
+	if err != nil {
+		healthLog.warne(err)
+	}
+	return health, nil
+}
+
+// RemoteHealth requests the system health of the target directly from its
+// echo server at addr over gRPC, regardless of the configured ping transport.
+// The request is signed with the cluster secret like a ping.
+func (k *KeKahu) RemoteHealth(ctx context.Context, source, target, addr string) (*kahu.SystemStatus, error) {
+	addr = resolveAddr(addr)
+	healthLog.debug("requesting health from %s at %s", target, addr)
+
+	reply, err := k.remote.Health(ctx, addr, &ping.Packet{Source: source, Target: target})
+	if err != nil {
+		return nil, err
+	}
+
+	status := new(kahu.SystemStatus)
+	if err := json.Unmarshal(reply.Status, status); err != nil {
+		return nil, fmt.Errorf("could not parse health from %s: %s", reply.Source, err)
+	}
+	return status, nil
+}
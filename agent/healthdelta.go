@@ -0,0 +1,137 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/bbengfort/kekahu/kahu"
+)
+
+// Fields of the system status that are sent with every delta.
+var healthDeltaKeys = []string{"replica", "hostname"}
+
+//===========================================================================
+// Health Report Deltas
+//===========================================================================
+
+// Posts the health report to Kahu. If delta reports are enabled, only the
+// fields that changed since the last report are posted, and the full report
+// is posted first, after a report fails, and every health refresh interval
+// so that Kahu can recover from missed changes.
+func (k *KeKahu) reportHealth(ctx context.Context, health *kahu.SystemStatus) error {
+	k.reports.Lock()
+	defer k.reports.Unlock()
+
+	if !k.conf().HealthDelta {
+		k.reports.last = nil
+		return k.api.Health(ctx, health)
+	}
+
+	current, err := statusFields(health)
+	if err != nil {
+		return err
+	}
+
+	refresh, err := k.conf().GetHealthRefresh()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if delta := k.reports.delta(current, refresh, now); delta != nil {
+		if err := k.api.HealthDelta(ctx, health, delta); err != nil {
+			k.reports.last = nil
+			return err
+		}
+
+		healthLog.debug("sent the changes to the health report since %s", k.reports.full.Format(time.RFC3339))
+		k.reports.last = current
+		return nil
+	}
+
+	if err := k.api.Health(ctx, health); err != nil {
+		k.reports.last = nil
+		return err
+	}
+
+	k.reports.last = current
+	k.reports.full = now
+	return nil
+}
+
+// healthReports remembers the last health report that Kahu received so that
+// only the changes are sent in delta mode. Access is synchronized by its lock,
+// which is held while a report is sent so that reports are sent in order.
+type healthReports struct {
+	sync.Mutex
+	last map[string]interface{} // fields of the last report Kahu has, nil if unknown
+	full time.Time              // when the last full report was sent
+}
+
+// Returns the changes from the last report to the current fields, or nil if a
+// full report must be sent (not thread-safe).
+func (h *healthReports) delta(current map[string]interface{}, refresh time.Duration, now time.Time) kahu.HealthDelta {
+	if h.last == nil || (refresh > 0 && now.Sub(h.full) >= refresh) {
+		return nil
+	}
+
+	delta := kahu.HealthDelta(mergePatch(h.last, current))
+	for _, key := range healthDeltaKeys {
+		if value, ok := current[key]; ok {
+			delta[key] = value
+		}
+	}
+	delta["delta"] = true
+	return delta
+}
+
+// Returns the fields of the system status as they are encoded in the report.
+func statusFields(health *kahu.SystemStatus) (map[string]interface{}, error) {
+	data, err := json.Marshal(health)
+	if err != nil {
+		return nil, fmt.Errorf("could not encode health report: %s", err)
+	}
+
+	fields := make(map[string]interface{})
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, fmt.Errorf("could not decode health report: %s", err)
+	}
+	return fields, nil
+}
+
+// Returns the JSON merge patch (RFC 7386) that turns the previous document
+// into the current one: changed values are replaced, objects are patched
+// recursively, and removed fields are null.
+func mergePatch(previous, current map[string]interface{}) map[string]interface{} {
+	patch := make(map[string]interface{})
+	for key, value := range current {
+		old, ok := previous[key]
+		if !ok {
+			patch[key] = value
+			continue
+		}
+
+		if reflect.DeepEqual(old, value) {
+			continue
+		}
+
+		oldObj, isObj := old.(map[string]interface{})
+		newObj, isNewObj := value.(map[string]interface{})
+		if isObj && isNewObj {
+			patch[key] = mergePatch(oldObj, newObj)
+			continue
+		}
+		patch[key] = value
+	}
+
+	for key := range previous {
+		if _, ok := current[key]; !ok {
+			patch[key] = nil
+		}
+	}
+	return patch
+}
@@ -0,0 +1,170 @@
+package agent
+
+import (
+	"context"
+	"time"
+
+	"github.com/bbengfort/kekahu/kahu"
+)
+
+// Heartbeat sends a heartbeat POST message to the Kahu endpoint, notifying
+// the management service that the localhost is alive and well. The next
+// heartbeat is sent on the heartbeat schedule by RunHeartbeats.
+//
+// Any http errors that occur are sent on the error channel to be logged by
+// the application. These errors are not fatal and do not cause the heartbeat
+// schedule to stop. No heartbeat is sent once the context is canceled.
+func (k *KeKahu) Heartbeat(ctx context.Context) {
+	if ctx.Err() != nil {
+		return
+	}
+	heartbeatLog.trace("executing heartbeat")
+
+	// Do not send heartbeats during maintenance if they are suppressed so that
+	// Kahu does not alert on planned downtime, the next one is still scheduled
+	if maint := k.Maintenance(time.Now()); maint.Active && maint.Mode == MaintenanceSuppress {
+		heartbeatLog.info("heartbeat suppressed during maintenance (%s)", maint.Reason)
+		return
+	}
+
+	// Do not send heartbeats once Kahu rejected one with a status that stops
+	// them, until the configuration is reloaded
+	if reason := k.HeartbeatsStopped(); reason != "" {
+		heartbeatLog.debug("heartbeat not sent: %s", reason)
+		return
+	}
+	k.sendHeartbeat(ctx)
+}
+
+// Sends a single heartbeat to Kahu, then runs the latency and health routines
+// if the heartbeat was successful. The next heartbeat is not scheduled, so it
+// can also be used to trigger an extra heartbeat from the control socket.
+func (k *KeKahu) sendHeartbeat(ctx context.Context) {
+	if k.LocalOnly() {
+		heartbeatLog.info("running local-only, no heartbeat sent until an api key is provisioned")
+		return
+	}
+
+	// Record whether or not the heartbeat was successful on return
+	var success bool
+	defer func() { k.metrics.Heartbeat(success) }()
+
+	// Compose JSON to post
+	data, err := k.heartbeatRequest(ctx)
+	if err != nil {
+		k.echan <- heartbeatLog.wrap(err)
+		k.heartbeatFailed(err)
+		return
+	}
+
+	// Post the heartbeat, buffering it to replay later if Kahu is unreachable
+	hb, err := k.api.Heartbeat(ctx, data)
+	if err != nil {
+		k.echan <- heartbeatLog.wrap(err)
+		k.heartbeatFailed(err)
+		k.heartbeatRejected(err)
+
+		// Keep measuring latencies to the discovered neighbors during outages
+		if k.conf().NeighborFallback != "" && k.latencyOnHeartbeat() {
+			k.spawn(func(ctx context.Context) { k.Latency(ctx, true) })
+		}
+		return
+	}
+
+	// Log the response if in debug mode
+	heartbeatLog.debug("%s", hb)
+	k.state.Heartbeat(hb)
+	k.assignIdentity(hb)
+	k.heartbeatSucceeded(hb)
+	k.rejects.Reset()
+	success = true
+
+	// Authenticate pings with the cluster secret distributed by Kahu unless
+	// a secret is configured for the host
+	if hb.Secret != "" && k.conf().PingSecret == "" {
+		k.auth.SetSecret(hb.Secret)
+	}
+
+	// If we're active and the heartbeat was successful then run ping routine
+	// to collect latency measurements from all other active hosts, unless
+	// latencies are measured on their own interval.
+	if hb.Success && hb.Active && k.latencyOnHeartbeat() {
+		k.spawn(func(ctx context.Context) { k.Latency(ctx, true) })
+	}
+
+	// If we're sending health checks, then send the health report
+	if k.conf().SendHealth {
+		k.spawn(k.Health)
+	}
+}
+
+// SendHeartbeat sends a single heartbeat to Kahu and returns the response. It
+// does not schedule the next heartbeat or ping the neighbors, so that hosts
+// that only wake periodically (e.g. from a cron job) can check in with Kahu
+// without running the service.
+func (k *KeKahu) SendHeartbeat(ctx context.Context) (*kahu.HeartbeatResponse, error) {
+	data, err := k.heartbeatRequest(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	hb, err := k.api.Heartbeat(ctx, data)
+	if err != nil {
+		return nil, err
+	}
+
+	heartbeatLog.debug("%s", hb)
+	k.state.Heartbeat(hb)
+	k.assignIdentity(hb)
+	return hb, nil
+}
+
+// Composes the heartbeat with the public IP address and hostname of the host,
+// the configured tags, and the status of the configured local services.
+func (k *KeKahu) heartbeatRequest(ctx context.Context) (*kahu.HeartbeatRequest, error) {
+	data := new(kahu.HeartbeatRequest)
+	if err := data.Load(ctx, k.conf()); err != nil {
+		return nil, err
+	}
+
+	// Identify the host by the replica name assigned by Kahu, if any, so that
+	// it keeps its identity if its hostname or IP address changes
+	data.Replica = k.identity.Replica()
+
+	// Add the configured tags so Kahu can group and filter replicas
+	tags, err := k.conf().GetTags()
+	if err != nil {
+		return nil, err
+	}
+	if len(tags) > 0 {
+		data.Tags = tags
+	}
+
+	// Add the ports and versions of the local services, if any are configured
+	if data.Services, err = k.probeServices(ctx); err != nil {
+		return nil, err
+	}
+
+	// Flag the heartbeat so that Kahu does not alert during planned downtime
+	data.Maintenance = k.Maintenance(time.Now()).Active
+
+	// Report the clock skew of the host measured with NTP, if any
+	data.SkewMS = k.skewMS()
+
+	return data, nil
+}
+
+// Probes the configured local services concurrently, returning nil if there
+// are no services so that the block is omitted from the heartbeat.
+func (k *KeKahu) probeServices(ctx context.Context) ([]*kahu.ServiceStatus, error) {
+	services, err := k.conf().GetServices()
+	if err != nil || len(services) == 0 {
+		return nil, err
+	}
+
+	timeout, err := k.conf().GetServiceTimeout()
+	if err != nil {
+		return nil, err
+	}
+	return ProbeServices(ctx, services, timeout), nil
+}
@@ -0,0 +1,105 @@
+package agent
+
+import (
+	"math"
+	"math/bits"
+	"sort"
+	"time"
+)
+
+// Precision of the latency histograms: latencies below HistogramSubBuckets
+// microseconds are counted exactly, larger latencies are counted in buckets
+// whose width is at most 1/128th (< 1%) of the latencies they contain.
+const (
+	HistogramSubBuckets = 256
+	histogramHalfCount  = HistogramSubBuckets / 2
+	histogramHalfShift  = 7 // log2(histogramHalfCount)
+)
+
+// Histogram is a high dynamic range histogram of ping latencies in the style
+// of HdrHistogram: latencies are counted in log-linear buckets so that any
+// percentile of the distribution can be reported to within 1% no matter how
+// wide the range of latencies is, in constant memory per bucket. Only the
+// buckets that have been counted are stored, so that the histogram can be
+// persisted with the rest of the latency statistics. Histogram is not
+// thread-safe, access is synchronized by the Network.
+type Histogram struct {
+	Counts map[int]uint64 `json:"counts"` // number of latencies in each bucket
+	Total  uint64         `json:"total"`  // total number of latencies counted
+}
+
+// Record the latency in the histogram, latencies are rounded down to the
+// microsecond and latencies below a microsecond are counted as 1µs.
+func (h *Histogram) Record(latency time.Duration) {
+	if h.Counts == nil {
+		h.Counts = make(map[int]uint64)
+	}
+
+	value := int64(latency / time.Microsecond)
+	if value < 1 {
+		value = 1
+	}
+
+	h.Counts[histogramIndex(value)]++
+	h.Total++
+}
+
+// Percentile returns the latency at the percentile (0-100) of the recorded
+// latencies, e.g. 99 for the p99 latency. As in HdrHistogram, the highest
+// latency that is equivalent to the bucket of the percentile is returned. It
+// returns zero if no latencies have been recorded.
+func (h *Histogram) Percentile(percentile float64) time.Duration {
+	if h.Total == 0 {
+		return 0
+	}
+
+	// The rank of the latency at the percentile, at least the first latency
+	rank := uint64(math.Ceil(math.Min(math.Max(percentile, 0), 100) / 100 * float64(h.Total)))
+	if rank == 0 {
+		rank = 1
+	}
+
+	indices := make([]int, 0, len(h.Counts))
+	for idx := range h.Counts {
+		indices = append(indices, idx)
+	}
+	sort.Ints(indices)
+
+	var seen uint64
+	for _, idx := range indices {
+		seen += h.Counts[idx]
+		if seen >= rank {
+			return time.Duration(histogramHighest(idx)) * time.Microsecond
+		}
+	}
+
+	return time.Duration(histogramHighest(indices[len(indices)-1])) * time.Microsecond
+}
+
+// Percentiles returns the median, 95th, and 99th percentile latencies.
+func (h *Histogram) Percentiles() (p50, p95, p99 time.Duration) {
+	return h.Percentile(50), h.Percentile(95), h.Percentile(99)
+}
+
+// Returns the index of the bucket that counts the value in microseconds.
+// Values below the sub bucket count are their own bucket, larger values keep
+// their highest 8 bits and are counted in the bucket of the shifted value.
+func histogramIndex(value int64) int {
+	if value < HistogramSubBuckets {
+		return int(value)
+	}
+
+	shift := bits.Len64(uint64(value)) - 1 - histogramHalfShift
+	return shift*histogramHalfCount + int(value>>uint(shift))
+}
+
+// Returns the highest value in microseconds counted by the bucket at index.
+func histogramHighest(idx int) int64 {
+	if idx < HistogramSubBuckets {
+		return int64(idx)
+	}
+
+	shift := idx/histogramHalfCount - 1
+	sub := int64(idx - shift*histogramHalfCount)
+	return (sub+1)<<uint(shift) - 1
+}
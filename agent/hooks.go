@@ -0,0 +1,324 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bbengfort/kekahu/kahu"
+)
+
+// Events that hooks may be run on.
+const (
+	FailureEvent    = "failure"    // heartbeats failed hook_failures times in a row
+	ActiveEvent     = "active"     // Kahu reported that the host became active
+	InactiveEvent   = "inactive"   // Kahu reported that the host became inactive
+	LatencyEvent    = "latency"    // the latency to a neighbor exceeded hook_latency
+	MembershipEvent = "membership" // the replicas in the peers file changed
+	DeadmanEvent    = "deadman"    // heartbeats failed deadman_failures times in a row
+	StoppedEvent    = "stopped"    // heartbeats were stopped because Kahu rejected one, see heartbeat_actions
+)
+
+// MaxHookOutput is the number of bytes of the output of a hook that is logged.
+const MaxHookOutput = 4096
+
+// HookEvents returns the names of the events that hooks may be run on.
+func HookEvents() []string {
+	return []string{FailureEvent, ActiveEvent, InactiveEvent, LatencyEvent, MembershipEvent, DeadmanEvent, StoppedEvent}
+}
+
+// Hook is a command that is run when an event occurs. The command is run
+// directly rather than by a shell, in a sandbox with a minimal environment.
+type Hook struct {
+	Event   string   // the event the command is run on
+	Command []string // the command and its arguments
+}
+
+// ParseHooks parses a semicolon separated list of hooks, each the name of an
+// event followed by the command to run, e.g. "failure /usr/local/bin/page;
+// membership systemctl reload app". Any number of hooks may be run on an event.
+func ParseHooks(s string) ([]*Hook, error) {
+	hooks := make([]*Hook, 0)
+	for _, entry := range strings.Split(s, ";") {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("hook '%s' must be an event followed by a command", strings.TrimSpace(entry))
+		}
+
+		event := strings.ToLower(fields[0])
+		if !isHookEvent(event) {
+			return nil, fmt.Errorf("unknown hook event '%s', must be one of %s", fields[0], strings.Join(HookEvents(), ", "))
+		}
+
+		hooks = append(hooks, &Hook{Event: event, Command: fields[1:]})
+	}
+	return hooks, nil
+}
+
+func isHookEvent(event string) bool {
+	for _, name := range HookEvents() {
+		if event == name {
+			return true
+		}
+	}
+	return false
+}
+
+// String returns the event and command of the hook.
+func (h *Hook) String() string {
+	return fmt.Sprintf("%s %s", h.Event, strings.Join(h.Command, " "))
+}
+
+// Run the hook command for the event, killing it (and any processes it
+// started) if it runs longer than the timeout. The event is described by
+// KEKAHU_* variables in the environment of the command; the rest of the
+// environment of the service, including the API key, is not passed on.
+func (h *Hook) Run(ctx context.Context, event *HookEvent, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, h.Command[0], h.Command[1:]...)
+	cmd.Dir = os.TempDir()
+	cmd.Env = event.Environ()
+	cmd.WaitDelay = time.Second
+	sandboxHook(cmd)
+
+	out, err := cmd.CombinedOutput()
+	out = bytes.TrimSpace(out)
+	if len(out) > MaxHookOutput {
+		out = out[:MaxHookOutput]
+	}
+
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("%s hook %s killed after %s", h.Event, h.Command[0], timeout)
+		}
+		return fmt.Errorf("%s hook %s failed: %s: %s", h.Event, h.Command[0], err, out)
+	}
+
+	hookLog.debug("%s hook %s executed: %s", h.Event, h.Command[0], out)
+	return nil
+}
+
+//===========================================================================
+// Hook Events
+//===========================================================================
+
+// HookEvent describes an event that hooks are run on.
+type HookEvent struct {
+	Name    string            // the name of the event
+	Time    time.Time         // when the event occurred
+	Replica string            // the replica identity of the host, if assigned
+	Details map[string]string // variables that describe the event, e.g. TARGET
+}
+
+// NewHookEvent creates an event with the details, which are given as pairs of
+// variable names (without the KEKAHU_ prefix) and values.
+func NewHookEvent(name string, details ...string) *HookEvent {
+	event := &HookEvent{Name: name, Time: time.Now(), Details: make(map[string]string)}
+	for i := 0; i+1 < len(details); i += 2 {
+		event.Details[details[i]] = details[i+1]
+	}
+	return event
+}
+
+// Environ returns the environment of hooks run on the event. Only the PATH,
+// HOME, and TMPDIR of the service are kept so that commands can be found and
+// can write temporary files.
+func (e *HookEvent) Environ() []string {
+	env := make([]string, 0, len(e.Details)+6)
+	for _, key := range []string{"PATH", "HOME", "TMPDIR"} {
+		if val, ok := os.LookupEnv(key); ok {
+			env = append(env, key+"="+val)
+		}
+	}
+
+	env = append(env,
+		"KEKAHU_EVENT="+e.Name,
+		"KEKAHU_TIME="+e.Time.Format(time.RFC3339),
+		"KEKAHU_REPLICA="+e.Replica,
+	)
+
+	for key, val := range e.Details {
+		env = append(env, "KEKAHU_"+strings.ToUpper(key)+"="+val)
+	}
+	return env
+}
+
+//===========================================================================
+// KeKahu Hooks
+//===========================================================================
+
+// Tracks the state the hook events are detected from so that hooks are only
+// run on transitions rather than every time a heartbeat fails or a neighbor
+// is slow.
+type hookTracker struct {
+	sync.Mutex
+	failures int             // consecutive heartbeat failures
+	active   *bool           // whether the host was active at the last heartbeat
+	slow     map[string]bool // neighbors whose latency exceeds the threshold
+}
+
+// Failure records a failed heartbeat and returns the number of consecutive
+// failures, including this one.
+func (t *hookTracker) Failure() int {
+	t.Lock()
+	defer t.Unlock()
+	t.failures++
+	return t.failures
+}
+
+// Success records a successful heartbeat and returns true if the active state
+// of the host changed since the last successful heartbeat. The first heartbeat
+// is not a transition since the previous state is unknown.
+func (t *hookTracker) Success(active bool) bool {
+	t.Lock()
+	defer t.Unlock()
+	t.failures = 0
+
+	changed := t.active != nil && *t.active != active
+	t.active = &active
+	return changed
+}
+
+// Latency records whether the latency to the neighbor exceeds the threshold
+// and returns true if it did not exceed the threshold at the last measurement.
+func (t *hookTracker) Latency(target string, slow bool) bool {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.slow == nil {
+		t.slow = make(map[string]bool)
+	}
+
+	raised := slow && !t.slow[target]
+	if slow {
+		t.slow[target] = true
+	} else {
+		delete(t.slow, target)
+	}
+	return raised
+}
+
+// Runs the hooks configured for the event in the background, sending any
+// errors to the error channel. Hooks are run concurrently so that a slow hook
+// does not delay the others or the heartbeats. Hooks are only run by the
+// service, not when the client is used from the CLI (e.g. kekahu sync).
+func (k *KeKahu) runHooks(event *HookEvent) {
+	if k.echan == nil {
+		return
+	}
+
+	hooks, err := k.conf().GetHooks()
+	if err != nil {
+		k.echan <- hookLog.wrap(err)
+		return
+	}
+
+	timeout, err := k.conf().GetHookTimeout()
+	if err != nil {
+		k.echan <- hookLog.wrap(err)
+		return
+	}
+
+	event.Replica = k.identity.Replica()
+	for _, hook := range hooks {
+		if hook.Event != event.Name {
+			continue
+		}
+
+		hook := hook
+		hookLog.info("running %s hook %s", hook.Event, hook.Command[0])
+		k.spawn(func(ctx context.Context) {
+			if err := hook.Run(ctx, event, timeout); err != nil {
+				k.echan <- hookLog.wrap(err)
+			}
+		})
+	}
+}
+
+// Records a failed heartbeat, calling the heartbeat callbacks and running the
+// failure hooks when the number of consecutive failures reaches the streak.
+func (k *KeKahu) heartbeatFailed(err error) {
+	if k.ctx.Err() == nil || !isCanceled(err) {
+		k.notify.heartbeat(nil, err)
+	}
+	failures := k.hooks.Failure()
+	k.deadmanFailure(failures, err)
+	if k.conf().HookFailures > 0 && failures == k.conf().HookFailures {
+		k.runHooks(NewHookEvent(FailureEvent,
+			"FAILURES", fmt.Sprintf("%d", failures),
+			"ERROR", err.Error(),
+		))
+	}
+}
+
+// Records a successful heartbeat, calling the heartbeat callbacks and running
+// the active or inactive hooks if Kahu reported that the active state of the
+// host changed.
+func (k *KeKahu) heartbeatSucceeded(hb *kahu.HeartbeatResponse) {
+	active := hb.Success && hb.Active
+	k.notify.heartbeat(hb, nil)
+	k.deadmanReset()
+	if !k.hooks.Success(active) {
+		return
+	}
+
+	name := InactiveEvent
+	if active {
+		name = ActiveEvent
+	}
+	k.runHooks(NewHookEvent(name, "ACTIVE", fmt.Sprintf("%t", active)))
+}
+
+// Checks the mean latency of a round of pings to the target against the
+// latency threshold, running the latency hooks when it is first exceeded.
+func (k *KeKahu) checkLatency(target string, latencies []time.Duration) {
+	threshold, err := k.conf().GetHookLatency()
+	if err != nil || threshold <= 0 || !reachable(latencies) {
+		return
+	}
+
+	var total time.Duration
+	var count int64
+	for _, latency := range latencies {
+		if latency > 0 {
+			total += latency
+			count++
+		}
+	}
+
+	mean := total / time.Duration(count)
+	if k.hooks.Latency(target, mean > threshold) {
+		k.runHooks(NewHookEvent(LatencyEvent,
+			"TARGET", target,
+			"LATENCY", mean.String(),
+			"THRESHOLD", threshold.String(),
+		))
+	}
+}
+
+// Runs the membership hooks after the peers file is rewritten. The names of
+// the changed replicas are only known for JSON peers files.
+func (k *KeKahu) membershipChanged(path string, replicas int, diff *PeersDiff) {
+	event := NewHookEvent(MembershipEvent,
+		"PEERS_PATH", path,
+		"REPLICAS", fmt.Sprintf("%d", replicas),
+	)
+
+	if diff != nil {
+		event.Details["ADDED"] = strings.Join(diff.Added, ",")
+		event.Details["REMOVED"] = strings.Join(diff.Removed, ",")
+		event.Details["UPDATED"] = strings.Join(diff.Updated, ",")
+	}
+	k.runHooks(event)
+}
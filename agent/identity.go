@@ -0,0 +1,143 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/bbengfort/kekahu/kahu"
+)
+
+// Identity is the replica identity that Kahu assigned to the local host. It
+// is persisted to disk and sent with every report so that the host keeps its
+// identity if its hostname or public IP address changes.
+type Identity struct {
+	sync.RWMutex
+	path     string    // where the identity is persisted
+	replica  string    // the name of the replica assigned by Kahu
+	assigned time.Time // when Kahu assigned the replica name
+}
+
+// The identity as it is saved to disk.
+type identityFile struct {
+	Replica  string    `json:"replica"`
+	Assigned time.Time `json:"assigned"`
+}
+
+// LoadIdentity reads the identity persisted at the path. If the file does not
+// exist the identity is empty until Kahu assigns one in a heartbeat response.
+func LoadIdentity(path string) (*Identity, error) {
+	identity := &Identity{path: path}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return identity, nil
+		}
+		return nil, fmt.Errorf("could not read replica identity: %s", err)
+	}
+
+	stored := new(identityFile)
+	if err := json.Unmarshal(data, stored); err != nil {
+		return nil, fmt.Errorf("could not parse replica identity at %s: %s", path, err)
+	}
+
+	identity.replica = stored.Replica
+	identity.assigned = stored.Assigned
+	return identity, nil
+}
+
+// Replica returns the name of the replica assigned by Kahu, or an empty
+// string if Kahu has not yet assigned one.
+func (i *Identity) Replica() string {
+	if i == nil {
+		return ""
+	}
+
+	i.RLock()
+	defer i.RUnlock()
+	return i.replica
+}
+
+// Assign the replica name from a heartbeat response, saving the identity to
+// disk if it changed. Returns true if the identity changed.
+func (i *Identity) Assign(replica string) (bool, error) {
+	if i == nil || replica == "" {
+		return false, nil
+	}
+
+	i.Lock()
+	defer i.Unlock()
+
+	if replica == i.replica {
+		return false, nil
+	}
+
+	i.replica = replica
+	i.assigned = time.Now()
+
+	data, err := json.MarshalIndent(&identityFile{Replica: i.replica, Assigned: i.assigned}, "", "  ")
+	if err != nil {
+		return true, err
+	}
+
+	if err := writeFileAtomic(i.path, append(data, '\n'), 0644); err != nil {
+		return true, fmt.Errorf("could not save replica identity: %s", err)
+	}
+	return true, nil
+}
+
+// Clear the replica identity, e.g. after Kahu removed the host, deleting the
+// identity saved to disk so that Kahu assigns a new one.
+func (i *Identity) Clear() error {
+	if i == nil {
+		return nil
+	}
+
+	i.Lock()
+	defer i.Unlock()
+
+	i.replica = ""
+	i.assigned = time.Time{}
+	if err := os.Remove(i.path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("could not remove replica identity: %s", err)
+	}
+	return nil
+}
+
+// Serialize the identity to report in the status of the service.
+func (i *Identity) Serialize() map[string]interface{} {
+	i.RLock()
+	defer i.RUnlock()
+
+	return map[string]interface{}{
+		"replica":  i.replica,
+		"assigned": i.assigned,
+		"path":     i.path,
+	}
+}
+
+// Records the replica name assigned in the heartbeat response, logging when
+// Kahu assigns the host a new identity. The identity is not saved in dry run
+// mode since the responses do not come from Kahu.
+func (k *KeKahu) assignIdentity(hb *kahu.HeartbeatResponse) {
+	if k.conf().DryRun {
+		return
+	}
+
+	previous := k.identity.Replica()
+	changed, err := k.identity.Assign(hb.Replica)
+	if err != nil {
+		heartbeatLog.warne(err)
+	}
+
+	if changed {
+		if previous == "" {
+			heartbeatLog.status("kahu assigned replica identity %s", hb.Replica)
+		} else {
+			heartbeatLog.status("kahu changed replica identity from %s to %s", previous, hb.Replica)
+		}
+	}
+}
@@ -0,0 +1,378 @@
+package agent
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bbengfort/kekahu/kahu"
+	xnet "github.com/bbengfort/x/net"
+)
+
+// Sources of the IP address reported in heartbeats.
+const (
+	PublicIPSource    = "public"    // look up the public IP address with an external web service
+	StaticIPSource    = "static"    // the configured ip_address
+	InterfaceIPSource = "interface" // the address of the ip_interface network interface
+	STUNIPSource      = "stun"      // the mapped address reported by the stun_server
+	MetadataIPSource  = "metadata"  // the address returned by the cloud metadata_url
+)
+
+// IPSources returns the names of the sources of the heartbeat IP address.
+func IPSources() []string {
+	return []string{PublicIPSource, StaticIPSource, InterfaceIPSource, STUNIPSource, MetadataIPSource}
+}
+
+// NoIPSource disables the discovery of the IPv6 address reported in heartbeats.
+const NoIPSource = "none"
+
+// IPv6Sources returns the names of the sources of the heartbeat IPv6 address.
+func IPv6Sources() []string {
+	return []string{PublicIPSource, StaticIPSource, InterfaceIPSource, NoIPSource}
+}
+
+// PublicIPv6URL is the web service that returns the public IPv6 address of the
+// host as plain text, it is requested over IPv6 only.
+const PublicIPv6URL = "https://api6.ipify.org"
+
+// DefaultMetadataURL is the metadata service endpoint that returns the public
+// IPv4 address of EC2 (and compatible) instances if metadata_url is empty.
+const DefaultMetadataURL = "http://169.254.169.254/latest/meta-data/public-ipv4"
+
+// IPSourceTimeout is the maximum amount of time to discover the IP address.
+const IPSourceTimeout = 5 * time.Second
+
+// LocalHostname returns the hostname reported in heartbeats, the configured
+// hostname if set, otherwise the hostname of the system.
+func (c *Config) LocalHostname() (string, error) {
+	if c != nil && c.Hostname != "" {
+		return c.Hostname, nil
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", fmt.Errorf("could not get hostname: %s", err)
+	}
+	return hostname, nil
+}
+
+// DiscoverIP returns the IP address reported in heartbeats from the configured
+// IP source, or the public IP address if the config is nil.
+func (c *Config) DiscoverIP(ctx context.Context) (string, error) {
+	source := PublicIPSource
+	if c != nil && c.IPSource != "" {
+		source = strings.ToLower(c.IPSource)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, IPSourceTimeout)
+	defer cancel()
+
+	var ip string
+	var err error
+	switch source {
+	case PublicIPSource:
+		ip, err = xnet.PublicIP()
+	case StaticIPSource:
+		if ip = c.IPAddress; ip == "" {
+			err = errors.New("specify the ip_address to report")
+		}
+	case InterfaceIPSource:
+		ip, err = interfaceIP(c.IPInterface, c.PreferIP)
+	case STUNIPSource:
+		ip, err = stunIP(ctx, c.STUNServer)
+	case MetadataIPSource:
+		ip, err = metadataIP(ctx, c.MetadataURL)
+	default:
+		return "", fmt.Errorf("unknown ip source '%s', must be one of %s", source, strings.Join(IPSources(), ", "))
+	}
+
+	if err != nil {
+		return "", fmt.Errorf("could not get %s IP: %s", source, err)
+	}
+
+	if net.ParseIP(ip) == nil {
+		return "", fmt.Errorf("%s ip source returned an invalid IP address '%s'", source, ip)
+	}
+	return ip, nil
+}
+
+// DiscoverIPv6 returns the IPv6 address reported in heartbeats from the
+// configured IPv6 source, or the public IPv6 address if the config is nil. It
+// returns an empty address if IPv6 discovery is disabled.
+func (c *Config) DiscoverIPv6(ctx context.Context) (string, error) {
+	source := PublicIPSource
+	if c != nil && c.IPv6Source != "" {
+		source = strings.ToLower(c.IPv6Source)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, IPSourceTimeout)
+	defer cancel()
+
+	var ip string
+	var err error
+	switch source {
+	case NoIPSource:
+		return "", nil
+	case PublicIPSource:
+		ip, err = publicIPv6(ctx)
+	case StaticIPSource:
+		if ip = c.IPv6Address; ip == "" {
+			err = errors.New("specify the ip6_address to report")
+		}
+	case InterfaceIPSource:
+		ip, err = interfaceIP(c.IPInterface, IPv6)
+	default:
+		return "", fmt.Errorf("unknown ipv6 source '%s', must be one of %s", source, strings.Join(IPv6Sources(), ", "))
+	}
+
+	if err != nil {
+		return "", fmt.Errorf("could not get %s IPv6: %s", source, err)
+	}
+
+	if parsed := net.ParseIP(ip); parsed == nil || parsed.To4() != nil {
+		return "", fmt.Errorf("%s ipv6 source returned an invalid IPv6 address '%s'", source, ip)
+	}
+	return ip, nil
+}
+
+//===========================================================================
+// IP Sources
+//===========================================================================
+
+// Returns the first global unicast address of the network interface, from the
+// preferred IP family if it has one (ipv4 if no family is preferred).
+func interfaceIP(name, prefer string) (string, error) {
+	if name == "" {
+		return "", errors.New("specify the ip_interface to get the address of")
+	}
+
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return "", err
+	}
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return "", err
+	}
+
+	var fallback string
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || !ipnet.IP.IsGlobalUnicast() {
+			continue
+		}
+
+		isv4 := ipnet.IP.To4() != nil
+		if (prefer != IPv6 && isv4) || (prefer == IPv6 && !isv4) {
+			return ipnet.IP.String(), nil
+		}
+		if fallback == "" {
+			fallback = ipnet.IP.String()
+		}
+	}
+
+	if fallback == "" {
+		return "", fmt.Errorf("interface %s has no global unicast addresses", name)
+	}
+	return fallback, nil
+}
+
+// STUN (RFC 5389) message types, attributes, and the magic cookie.
+const (
+	stunBindingRequest  = 0x0001
+	stunBindingSuccess  = 0x0101
+	stunMappedAddress   = 0x0001
+	stunXORMappedAddr   = 0x0020
+	stunMagicCookie     = 0x2112A442
+	stunHeaderLength    = 20
+	stunMaxMessageBytes = 1024
+)
+
+// Sends a STUN binding request to the server and returns the address that the
+// server saw the request come from, i.e. the address of the host after NAT.
+func stunIP(ctx context.Context, server string) (string, error) {
+	if server == "" {
+		return "", errors.New("specify the stun_server to discover the address with")
+	}
+
+	conn, err := new(net.Dialer).DialContext(ctx, "udp", server)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	req := make([]byte, stunHeaderLength)
+	binary.BigEndian.PutUint16(req[0:2], stunBindingRequest)
+	binary.BigEndian.PutUint32(req[4:8], stunMagicCookie)
+	if _, err = rand.Read(req[8:20]); err != nil {
+		return "", err
+	}
+
+	if _, err = conn.Write(req); err != nil {
+		return "", err
+	}
+
+	rep := make([]byte, stunMaxMessageBytes)
+	n, err := conn.Read(rep)
+	if err != nil {
+		return "", err
+	}
+	return parseSTUN(rep[:n], req[8:20])
+}
+
+// Parses the mapped address from a STUN binding success response with the
+// transaction id, preferring the XOR-MAPPED-ADDRESS attribute.
+func parseSTUN(msg, txid []byte) (string, error) {
+	if len(msg) < stunHeaderLength || binary.BigEndian.Uint16(msg[0:2]) != stunBindingSuccess {
+		return "", errors.New("invalid stun response")
+	}
+
+	if binary.BigEndian.Uint32(msg[4:8]) != stunMagicCookie || string(msg[8:20]) != string(txid) {
+		return "", errors.New("stun response does not match the request")
+	}
+
+	var mapped net.IP
+	attrs := msg[stunHeaderLength:]
+	for len(attrs) >= 4 {
+		kind := binary.BigEndian.Uint16(attrs[0:2])
+		size := int(binary.BigEndian.Uint16(attrs[2:4]))
+		if len(attrs) < 4+size {
+			break
+		}
+
+		value := attrs[4 : 4+size]
+		switch kind {
+		case stunXORMappedAddr:
+			if ip := stunAddress(value, msg[4:20]); ip != nil {
+				return ip.String(), nil
+			}
+		case stunMappedAddress:
+			mapped = stunAddress(value, nil)
+		}
+
+		// Attributes are padded to a multiple of 4 bytes
+		size = (size + 3) &^ 3
+		if len(attrs) < 4+size {
+			break
+		}
+		attrs = attrs[4+size:]
+	}
+
+	if mapped == nil {
+		return "", errors.New("stun response has no mapped address")
+	}
+	return mapped.String(), nil
+}
+
+// Decodes the IP of a (XOR-)MAPPED-ADDRESS attribute value. If the key (the
+// magic cookie followed by the transaction id) is given, the address is XORed
+// with it as described by RFC 5389 section 15.2.
+func stunAddress(value, key []byte) net.IP {
+	if len(value) < 4 {
+		return nil
+	}
+
+	var ip net.IP
+	switch value[1] {
+	case 0x01:
+		if len(value) < 8 {
+			return nil
+		}
+		ip = net.IP(append([]byte{}, value[4:8]...))
+	case 0x02:
+		if len(value) < 20 {
+			return nil
+		}
+		ip = net.IP(append([]byte{}, value[4:20]...))
+	default:
+		return nil
+	}
+
+	if key != nil {
+		for i := range ip {
+			ip[i] ^= key[i]
+		}
+	}
+	return ip
+}
+
+// Requests the IP address from the cloud metadata service, which must return
+// it as plain text (e.g. the EC2 public-ipv4 or GCP external-ip endpoints).
+func metadataIP(ctx context.Context, url string) (string, error) {
+	if url == "" {
+		url = DefaultMetadataURL
+	}
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+
+	// Required by the GCP metadata server, ignored by others
+	req.Header.Set("Metadata-Flavor", "Google")
+
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer kahu.CloseResponse(res)
+
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("metadata service responded %s", res.Status)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+// Requests the public IPv6 address from the web service, connecting over IPv6
+// so that dual-stack hosts don't report their IPv4 address instead.
+func publicIPv6(ctx context.Context) (string, error) {
+	dialer := new(net.Dialer)
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return dialer.DialContext(ctx, "tcp6", addr)
+			},
+		},
+	}
+
+	req, err := http.NewRequest(http.MethodGet, PublicIPv6URL, nil)
+	if err != nil {
+		return "", err
+	}
+
+	res, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer kahu.CloseResponse(res)
+
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s responded %s", PublicIPv6URL, res.Status)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(body)), nil
+}
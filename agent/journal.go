@@ -0,0 +1,133 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ServiceComponent is the component of errors that are not caused by a
+// specific part of the service, e.g. errors during shutdown.
+const ServiceComponent = "service"
+
+// Journal is a ring buffer of the most recent non-fatal errors of the service
+// that is persisted to a JSON file so that the errors can be inspected with
+// `kekahu errors` after the fact, e.g. to find out why latency reporting
+// stopped overnight. Errors are written to the journal before they are
+// logged, and the file is replaced atomically so that it is not corrupted if
+// the service is killed while writing it.
+type Journal struct {
+	sync.Mutex
+	path    string          // path to the JSON journal file
+	maxSize int             // maximum number of errors, oldest dropped first
+	entries []*JournalEntry // the recorded errors in order
+}
+
+// JournalEntry is an error recorded in the journal.
+type JournalEntry struct {
+	Time      time.Time `json:"time"`      // when the error was received
+	Component string    `json:"component"` // the component that caused the error
+	Message   string    `json:"message"`   // the error message
+}
+
+// Init the journal and load the previously recorded errors from disk.
+func (j *Journal) Init(path string, maxSize int) (err error) {
+	j.Lock()
+	defer j.Unlock()
+
+	j.path = path
+	j.maxSize = maxSize
+	if j.entries, err = ReadJournal(path); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Record the error of the component, dropping the oldest errors if the
+// journal exceeds its maximum size, and write the journal to disk.
+func (j *Journal) Record(component string, err error) error {
+	j.Lock()
+	defer j.Unlock()
+
+	j.entries = append(j.entries, &JournalEntry{
+		Time: time.Now(), Component: component, Message: err.Error(),
+	})
+
+	if j.maxSize > 0 && len(j.entries) > j.maxSize {
+		j.entries = j.entries[len(j.entries)-j.maxSize:]
+	}
+
+	return j.save()
+}
+
+// Entries returns the recorded errors, oldest first.
+func (j *Journal) Entries() []*JournalEntry {
+	j.Lock()
+	defer j.Unlock()
+
+	entries := make([]*JournalEntry, len(j.entries))
+	copy(entries, j.entries)
+	return entries
+}
+
+// Clear the recorded errors and write the empty journal to disk.
+func (j *Journal) Clear() error {
+	j.Lock()
+	defer j.Unlock()
+
+	j.entries = make([]*JournalEntry, 0)
+	return j.save()
+}
+
+// Writes the journal to a temporary file and renames it to the journal path
+// so that readers never see a partially written journal (not thread-safe).
+func (j *Journal) save() error {
+	data, err := json.Marshal(j.entries)
+	if err != nil {
+		return fmt.Errorf("could not encode error journal: %s", err)
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(j.path), ".kekahu-journal")
+	if err != nil {
+		return fmt.Errorf("could not write error journal: %s", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("could not write error journal: %s", err)
+	}
+
+	if err := os.Rename(tmp.Name(), j.path); err != nil {
+		return fmt.Errorf("could not write error journal: %s", err)
+	}
+	return nil
+}
+
+// ReadJournal reads the errors recorded in the journal file at the path,
+// oldest first, so that they can be displayed whether or not the service is
+// running. No errors are returned if the journal does not exist.
+func ReadJournal(path string) ([]*JournalEntry, error) {
+	entries := make([]*JournalEntry, 0)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return entries, nil
+		}
+		return nil, fmt.Errorf("could not read error journal: %s", err)
+	}
+
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("could not parse error journal: %s", err)
+	}
+	return entries, nil
+}
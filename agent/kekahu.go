@@ -0,0 +1,840 @@
+// Package agent is the kekahu service: it sends heartbeats to Kahu, pings the
+// neighbors of the host and reports their latencies and the health of the
+// host, and syncs the peers file with the replicas in Kahu. The echo server and
+// pingers it measures the latencies with are implemented by the net package,
+// the requests to Kahu by the kahu package, and the health checks by the
+// doctor package.
+package agent
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bbengfort/kekahu/kahu"
+	knet "github.com/bbengfort/kekahu/net"
+)
+
+// PackageVersion of the KeKahu application
+const PackageVersion = "1.6"
+
+// ShutdownTimeout is the maximum amount of time Shutdown waits for in-flight
+// heartbeats, pings, and reports to be canceled before cleaning up.
+const ShutdownTimeout = 10 * time.Second
+
+//===========================================================================
+// Package Initialization
+//===========================================================================
+
+// Initialize the package and random numbers, etc.
+func init() {
+	// Set the random seed to something different each time.
+	rand.Seed(time.Now().UnixNano())
+
+	// Initialize our debug logging with our prefix
+	logger = log.New(os.Stdout, "[kekahu] ", log.Lmicroseconds)
+
+	// Log the retries and buffered requests of the Kahu API client
+	kahu.SetLogger(print)
+
+	// Log the pings and replies of the pingers and the echo server
+	knet.SetLogger(output)
+}
+
+//===========================================================================
+// Kekahu Client
+//===========================================================================
+
+// New constructs a KeKahu client from an api key and url pair. If a URL is
+// not specified (e.g. an empty string) then the DefaultKahuURL is used. If no
+// API key is provided, the service runs local-only until one is provisioned,
+// see LocalOnly.
+func New(options *Config) (*KeKahu, error) {
+	// Create default configuration, which is validated once it is updated
+	// from the options since they may set required values like the API key
+	config := new(Config)
+	if err := config.load(); err != nil {
+		return nil, err
+	}
+
+	// Update the configuration from the options, allowing the API key to be
+	// missing so that the service can run local-only until it is provisioned
+	local := new(localMode)
+	if err := config.Update(options); err != nil {
+		if config.APIKey != "" {
+			return nil, err
+		}
+
+		if err := config.validateLocal(); err != nil {
+			return nil, err
+		}
+		local.Start()
+	}
+
+	// Read the API key from the OS keychain or decrypt it if it is kept secret
+	if err := config.ResolveAPIKey(); err != nil {
+		return nil, err
+	}
+
+	// Set the logging level, format, and outputs
+	SetLogLevel(uint8(config.Verbosity))
+	if err := SetLogFormat(config.LogFormat); err != nil {
+		return nil, err
+	}
+
+	if err := config.openLogOutputs(); err != nil {
+		return nil, err
+	}
+
+	// Move the state files of earlier versions into the state directory
+	if err := config.MigrateState(); err != nil {
+		warn("%s", err)
+	}
+
+	// Create the telemetry collector
+	metrics := new(Telemetry)
+	metrics.Init()
+
+	// Create the Echo server
+	server := new(knet.Server)
+	server.Init("", config.Hostname)
+	server.Metrics = metrics
+
+	// Secure the Echo server with mutual TLS if configured
+	creds, err := config.ServerCredentials()
+	if err != nil {
+		return nil, err
+	}
+	server.Creds = creds
+
+	if server.TLSConfig, err = config.ServerTLSConfig(); err != nil {
+		return nil, err
+	}
+
+	// Sign and verify pings with the cluster secret, if configured or from Kahu
+	auth := knet.NewPingAuth(config.PingSecret, config.PingAuth)
+	server.Auth = auth
+
+	// Listen for pings on the configured transports
+	if server.Transports, err = config.GetEchoTransports(); err != nil {
+		return nil, err
+	}
+
+	// Log, count, and recover the gRPC requests with the configured interceptors
+	server.Interceptors = config.GetEchoInterceptors()
+
+	// Create the ping connection pool, secured with TLS if configured
+	clientCreds, err := config.ClientCredentials()
+	if err != nil {
+		return nil, err
+	}
+
+	idle, _ := config.GetPingIdle()
+	pool := new(knet.ConnPool)
+	pool.Init(clientCreds, idle)
+
+	// Send pings with the configured transport
+	clientTLS, err := config.ClientTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	timeout, _ := config.GetPingTimeout()
+	pinger, err := knet.NewPinger(config.PingTransport, pool, clientTLS, timeout, auth)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check that the pings are not too large to send with the transport
+	if _, err := config.GetPingSize(); err != nil {
+		return nil, err
+	}
+
+	// Send the pings to the targets behind a proxy through the proxy
+	proxies, err := config.GetPingProxies()
+	if err != nil {
+		return nil, err
+	}
+
+	// Create the ping latencies map, restoring metrics from disk if persisted
+	network := new(Network)
+	network.Init()
+
+	filter, err := config.GetSampleFilter()
+	if err != nil {
+		return nil, err
+	}
+	network.Filter(filter)
+	if config.PersistLatency {
+		if err := network.Load(config.GetLatencyPath()); err != nil {
+			return nil, err
+		}
+	}
+
+	// Collect the latencies gossiped by the neighbors into a latency matrix
+	matrix := NewLatencyMatrix()
+	metrics.matrix = matrix
+
+	// Create the spool to buffer reports when Kahu is unreachable
+	var spool *kahu.Spool
+	if path := config.GetSpoolPath(); path != "" {
+		ttl, _ := config.GetSpoolTTL()
+		spool = new(kahu.Spool)
+		if err := spool.Init(path, config.SpoolSize, ttl); err != nil {
+			return nil, err
+		}
+	}
+
+	// Create the journal to record errors for post-mortems
+	var journal *Journal
+	if config.JournalSize > 0 {
+		journal = new(Journal)
+		if err := journal.Init(config.GetJournalPath(), config.JournalSize); err != nil {
+			return nil, err
+		}
+	}
+
+	// Record every ping result for offline analysis, if configured
+	var record *Recorder
+	if config.RecordPath != "" {
+		rotation, err := config.GetRecordRotation()
+		if err != nil {
+			return nil, err
+		}
+
+		if record, err = NewRecorder(config.RecordPath, config.RecordFormat, rotation); err != nil {
+			return nil, err
+		}
+	}
+
+	// Restore the replica identity previously assigned by Kahu
+	identity, err := LoadIdentity(config.GetIdentityPath())
+	if err != nil {
+		return nil, err
+	}
+
+	// Create the HTTP client to make requests to the Kahu API, sharing the
+	// configuration so that reloads apply to the next request
+	shared := newSharedConfig(config)
+	client := new(HTTPClient)
+	if err := client.init(shared, metrics, spool); err != nil {
+		return nil, err
+	}
+	metrics.api = client.Stats()
+
+	// Fan out reports to any additional Kahu services
+	var api KahuClient = client
+	upstreams, err := config.GetUpstreams()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(upstreams) > 0 {
+		if api, err = NewFederatedClient(client, config, upstreams); err != nil {
+			return nil, err
+		}
+	}
+
+	// Log the reports instead of sending them to Kahu in dry run mode
+	if config.DryRun {
+		api = NewDryRunClient(client)
+	}
+
+	kekahu := &KeKahu{
+		config: shared, options: options, api: api, server: server, network: network,
+		state: new(ServiceState), metrics: metrics, pinger: pinger, auth: auth, alerts: new(alertTracker),
+		journal: journal, remote: knet.NewGRPCPinger(pool, timeout, auth), maint: new(downtime),
+		identity: identity, hooks: new(hookTracker), record: record, notify: new(callbacks),
+		anomaly: new(anomalies), picker: new(targetPicker), trial: new(probation), deadman: new(deadmanSwitch),
+		verbose: &verbosity{base: uint8(config.Verbosity)}, reports: new(healthReports), local: local,
+		sched: newScheduler(), matrix: matrix, clock: new(clockSkew), rejects: new(rejections),
+		proxies: knet.NewProxyPingers(proxies, clientCreds, idle, timeout, auth),
+	}
+	server.Report = kekahu.localHealth
+	server.Gossip = kekahu.gossipLatencies
+	kekahu.ctx, kekahu.cancel = context.WithCancel(context.Background())
+
+	return kekahu, nil
+}
+
+//===========================================================================
+// KeKahu Struct and Methods
+//===========================================================================
+
+// KeKahu is the Kahu client that performs service requests to Kahu. It's
+// state manages the URL and API Key that should be passed in via New()
+type KeKahu struct {
+	config  *sharedConfig      // KeKahu service configuration, replaced when it is reloaded
+	options *Config            // Options passed to New that override the configuration
+	api     KahuClient         // Client to perform requests to the Kahu API
+	server  *knet.Server       // Echo server to respond to ping requests
+	sched   *scheduler         // Schedule of the heartbeats, replaced when the configuration is reloaded
+	echan   chan error         // Channel to listen for non-fatal errors on
+	done    chan bool          // Channel to listen for shutdown signal
+	network *Network           // Ping latency to other peers in the network
+	matrix  *LatencyMatrix     // Latencies between other peers gossiped on ping replies
+	state   *ServiceState      // State of the service reported by the status server
+	httpd   []*http.Server     // Local status and metrics servers that are running
+	control net.Listener       // Control socket listener for the CLI
+	metrics *Telemetry         // Counters and histograms exported to Prometheus
+	pid     *PID               // PID file of the running service
+	pinger  knet.Pinger        // Transport to send pings to other echo servers
+	auth    *knet.PingAuth     // Signs and verifies pings with the cluster secret
+	remote  *knet.GRPCPinger   // Requests the health of other echo servers over gRPC
+	alerts  *alertTracker      // Health rules that are currently alerting
+	journal *Journal           // Recent errors persisted to disk, nil if disabled
+	maint   *downtime          // Maintenance mode set from the CLI
+	hooks   *hookTracker       // State the events that run hooks are detected from
+	anomaly *anomalies         // Targets pinged more often while their latency is anomalous
+	picker  *targetPicker      // Selects the neighbors pinged in each latency cycle
+	trial   *probation         // When the neighbors that Kahu reports as down were last pinged
+	deadman *deadmanSwitch     // Escalates when heartbeats fail repeatedly
+	record  *Recorder          // Raw ping results for offline analysis, nil if disabled
+	notify  *callbacks         // Callbacks registered by programs that embed the service
+	verbose *verbosity         // Log level set from the CLI, reverted if temporary
+	reports *healthReports     // Last health report sent to Kahu, for delta reports
+	local   *localMode         // Whether the service runs without Kahu until an API key is provisioned
+	clock   *clockSkew         // Offset of the local clock from the NTP servers
+	rejects *rejections        // Backoff or stop of the heartbeats that Kahu rejected
+	proxies *knet.ProxyPingers // Send pings to the targets in restricted networks through proxies
+
+	// The replica identity assigned by Kahu, sent with every report
+	identity *Identity
+
+	// The service context is canceled on Shutdown to abort in-flight requests,
+	// the tasks started with it are tracked so Shutdown can wait for them.
+	ctx    context.Context
+	cancel context.CancelFunc
+	tasks  sync.WaitGroup
+	tasksm sync.Mutex
+
+	// Closed once the service has stopped, Shutdown only runs once
+	stopped chan struct{}
+	stopper sync.Once
+	stopErr error
+
+	// Set when the service is started by Run, which restarts the process into
+	// the release installed by AutoUpdate once the service has stopped
+	running bool
+	restart string
+}
+
+// Returns the current configuration of the service, which is replaced when it
+// is reloaded. Tasks that read several fields should keep the configuration
+// returned so that they see the fields of a single configuration.
+func (k *KeKahu) conf() *Config {
+	return k.config.Load()
+}
+
+// SetClient replaces the client used to make requests to Kahu, e.g. with a
+// mock client from the kekahutest package. It must be called before Start.
+func (k *KeKahu) SetClient(client KahuClient) {
+	k.api = client
+}
+
+// Request sends an ad-hoc request to the Kahu API, see HTTPClient.Request.
+// The caller must close the body of the response.
+func (k *KeKahu) Request(ctx context.Context, request *kahu.APIRequest) (*http.Response, error) {
+	client, ok := k.httpClient()
+	if !ok {
+		return nil, errors.New("ad-hoc requests require the http client")
+	}
+	return client.Request(ctx, request)
+}
+
+// Run the keep-alive heartbeat service with the interval specified. The
+// service will log any http errors to to standard out - otherwise it will
+// continue running until it is shutdown by OS signals: SIGINT and SIGTERM stop
+// the service and SIGHUP reloads the configuration. Programs that embed the
+// service should use Start and Stop, which do not handle signals.
+func (k *KeKahu) Run() (err error) {
+	k.tasksm.Lock()
+	k.running = true
+	k.tasksm.Unlock()
+
+	if err = k.Start(context.Background()); err != nil {
+		return err
+	}
+
+	// Run the OS signal handlers, the error of Stop is also returned by Wait,
+	// and report to the Windows service control manager if started by it
+	go signalHandler(k.Stop, k.Reload)
+	go serviceControl(k.Stop, k.stopped)
+	err = k.Wait()
+
+	// Restart into the release installed by AutoUpdate now that the service
+	// has shut down and released the PID file and listeners
+	if version := k.restartVersion(); version != "" {
+		status("restarting to run kekahu %s", version)
+		return Restart()
+	}
+	return err
+}
+
+// Start the keep-alive heartbeat service in the background, returning once
+// the echo, control, status, and metrics servers are listening. Errors that
+// occur while the service runs are logged, recorded in the journal, and passed
+// to the OnError callbacks. The service runs until Stop is called or the
+// context is canceled. A service that has been stopped cannot be started again.
+func (k *KeKahu) Start(ctx context.Context) (err error) {
+	k.tasksm.Lock()
+	if k.echan != nil {
+		k.tasksm.Unlock()
+		return errors.New("the kekahu service has already been started")
+	}
+
+	// Initialize the listener channels
+	k.echan = make(chan error)
+	k.done = make(chan bool, 1)
+	k.stopped = make(chan struct{})
+	k.tasksm.Unlock()
+
+	go k.listen()
+	if err = k.start(); err != nil {
+		k.Stop()
+		return err
+	}
+
+	// Stop the service when the context is canceled
+	go func() {
+		select {
+		case <-ctx.Done():
+			k.Stop()
+		case <-k.stopped:
+		}
+	}()
+	return nil
+}
+
+// Stop the service started with Start or Run, canceling outstanding requests
+// and cleaning up like Shutdown, then wait for the service to exit. It is safe
+// to call Stop more than once and from multiple go routines.
+func (k *KeKahu) Stop() error {
+	if k.stopped == nil {
+		return errors.New("the kekahu service has not been started")
+	}
+
+	err := k.Shutdown()
+	<-k.stopped
+	return err
+}
+
+// Wait blocks until the service started with Start has stopped, returning
+// the error of the shutdown, if any (Shutdown has already run, so it is not
+// run again).
+func (k *KeKahu) Wait() error {
+	if k.stopped == nil {
+		return errors.New("the kekahu service has not been started")
+	}
+
+	<-k.stopped
+	return k.Shutdown()
+}
+
+// Starts the servers and the background tasks of the service.
+func (k *KeKahu) start() (err error) {
+	k.state.Start()
+
+	// Lock the PID file so the CLI can find the running service and so that
+	// only one service runs on the host. Force only replaces a stale PID file
+	// whose process id was reused, never that of a service that still answers
+	// on the control socket, since the two services would share the echo port
+	k.pid = NewPID(k.conf().GetPidPath())
+	force := k.conf().Force && !Controllable(k.conf().GetControlPath())
+	if err = k.pid.Lock(force); err != nil {
+		return err
+	}
+
+	// Serve the control socket so the CLI can send commands to the service
+	if err = k.runControlServer(k.conf().GetControlPath()); err != nil {
+		return err
+	}
+
+	// Start the local echo server
+	if err = k.server.Run(k.echan); err != nil {
+		return err
+	}
+
+	// Start the local status server if configured
+	if k.conf().StatusAddr != "" {
+		if err = k.runStatusServer(k.conf().StatusAddr); err != nil {
+			return err
+		}
+	}
+
+	// Start the Prometheus metrics server if configured
+	if k.conf().MetricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", k.metrics)
+		if err = k.serveHTTP("metrics", k.conf().MetricsAddr, mux); err != nil {
+			return err
+		}
+	}
+
+	// Schedule the heartbeats
+	schedule, err := k.conf().GetSchedule()
+	if err != nil {
+		return err
+	}
+	k.sched.Set(schedule)
+
+	// Start checkpointing the latency metrics to disk
+	if k.conf().PersistLatency {
+		checkpoint, err := k.conf().GetCheckpoint()
+		if err != nil {
+			return err
+		}
+		k.schedule(checkpoint, k.Checkpoint)
+	}
+
+	// Start pushing metrics to the OpenTelemetry collector if configured
+	if k.conf().OTLPEndpoint != "" {
+		interval, err := k.conf().GetOTLPInterval()
+		if err != nil {
+			return err
+		}
+		k.schedule(interval, k.ExportTelemetry)
+	}
+
+	// Start measuring the clock skew of the host if configured
+	if interval, err := k.conf().GetClockInterval(); err != nil {
+		return err
+	} else if interval > 0 {
+		k.spawn(k.CheckClock)
+	}
+
+	// Start checking for new releases to install
+	if k.conf().AutoUpdate {
+		k.spawn(k.AutoUpdate)
+	}
+
+	// Run local-only until the API key is provisioned, otherwise start the
+	// heartbeats and the measurements reported to Kahu
+	if k.LocalOnly() {
+		warn("no api key configured, running local-only until one is provisioned")
+		k.spawn(k.RunLocal)
+		return nil
+	}
+	return k.startKahu()
+}
+
+// Starts the heartbeats and the background tasks that report to Kahu, when
+// the service starts or once the API key is provisioned.
+func (k *KeKahu) startKahu() error {
+	// Negotiate the schemas of the reports before the first heartbeat
+	k.spawn(func(ctx context.Context) {
+		k.NegotiateSchemas(ctx)
+		k.RunHeartbeats(ctx)
+	})
+
+	// Start measuring latencies on their own interval if configured, rather
+	// than after every heartbeat
+	if interval, err := k.conf().GetLatencyInterval(); err != nil {
+		return err
+	} else if interval > 0 {
+		k.schedule(interval, k.MeasureLatency)
+	}
+
+	// Start measuring the bandwidth to neighbors if configured, on its own
+	// schedule since each measurement saturates the link for a while
+	if interval, err := k.conf().GetBandwidthInterval(); err != nil {
+		return err
+	} else if interval > 0 {
+		k.schedule(interval, k.Bandwidth)
+	}
+
+	// Start reporting the gossiped latency matrix to Kahu if configured
+	if interval, err := k.conf().GetGossipInterval(); err != nil {
+		return err
+	} else if interval > 0 {
+		k.schedule(interval, k.ReportMatrix)
+	}
+
+	// Start periodically syncing the peers file if configured
+	if interval, err := k.conf().GetSyncInterval(); err != nil {
+		return err
+	} else if interval > 0 {
+		k.spawn(k.AutoSync)
+	}
+
+	return nil
+}
+
+// Logs the errors of the service, recording them in the journal and passing
+// them to the error callbacks, until the service is shut down.
+func (k *KeKahu) listen() {
+	defer close(k.stopped)
+
+	for {
+		select {
+		case err := <-k.echan:
+			// Requests aborted by shutdown are expected and not logged as warnings
+			if k.ctx.Err() != nil && isCanceled(err) {
+				trace("canceled: %s", err)
+				continue
+			}
+
+			// Record the error in the journal before logging it
+			component := errorComponent(err)
+			if k.journal != nil {
+				if jerr := k.journal.Record(component, err); jerr != nil {
+					warne(jerr)
+				}
+			}
+
+			if cerr, ok := err.(*ComponentError); ok {
+				output(Warn, cerr.Component, "%s", cerr.Err)
+			} else {
+				warne(err)
+			}
+			k.state.Error(err)
+			k.notify.error(component, err)
+		case done := <-k.done:
+			if done {
+				return
+			}
+		}
+	}
+}
+
+// Shutdown the KeKahu service and clean up the PID file. Outstanding
+// requests to Kahu and pings to other hosts are canceled and Shutdown waits
+// up to the ShutdownTimeout for them to return before cleaning up. The
+// service is only shut down once, later calls return the same error.
+func (k *KeKahu) Shutdown() error {
+	k.stopper.Do(func() { k.stopErr = k.shutdown() })
+	return k.stopErr
+}
+
+// Shuts down the service, see Shutdown.
+func (k *KeKahu) shutdown() (err error) {
+	info("shutting down the kekahu service")
+	k.verbose.Stop()
+
+	// Cancel in-flight requests and wait for the tasks to exit
+	k.tasksm.Lock()
+	k.cancel()
+	k.tasksm.Unlock()
+
+	stopped := make(chan struct{})
+	go func() {
+		k.tasks.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(ShutdownTimeout):
+		warn("timed out waiting for in-flight requests to be canceled")
+	}
+
+	// Shutdown the server
+	if err = k.server.Shutdown(); err != nil {
+		k.echan <- err
+	}
+
+	// Save the latency metrics to restore on restart
+	if k.conf().PersistLatency {
+		if err = k.network.Dump(k.conf().GetLatencyPath()); err != nil {
+			k.echan <- err
+		}
+	}
+
+	// Summarize the requests to Kahu so that flaky endpoints stand out
+	k.summarizeAPIStats()
+
+	// Close connections to other echo servers
+	if err = k.pinger.Close(); err != nil {
+		k.echan <- err
+	}
+
+	if err = k.remote.Close(); err != nil {
+		k.echan <- err
+	}
+
+	if err = k.proxies.Close(); err != nil {
+		k.echan <- err
+	}
+
+	// Close the ping recording
+	if err = k.record.Close(); err != nil {
+		k.echan <- err
+	}
+
+	// Close the control socket, removing the socket file
+	if k.control != nil {
+		if err = k.control.Close(); err != nil {
+			k.echan <- err
+		}
+	}
+
+	// Shutdown the status and metrics servers
+	for _, srv := range k.httpd {
+		if err = srv.Close(); err != nil {
+			k.echan <- err
+		}
+	}
+
+	// Clean up the PID file
+	if k.pid != nil {
+		if err = k.pid.Free(); err != nil {
+			k.echan <- err
+		}
+	}
+
+	// Notify the run method we're done
+	// NOTE: do this last or the cleanup proceedure won't be done.
+	if k.done != nil {
+		k.done <- true
+	}
+	return nil
+}
+
+// Checkpoint saves the latency metrics to disk so that the ping history isn't
+// lost if the service is restarted without a clean shutdown, then schedules
+// the next checkpoint.
+func (k *KeKahu) Checkpoint(ctx context.Context) {
+	if !k.conf().PersistLatency || ctx.Err() != nil {
+		return
+	}
+
+	if checkpoint, err := k.conf().GetCheckpoint(); err == nil {
+		defer k.schedule(checkpoint, k.Checkpoint)
+	}
+
+	if err := k.network.Dump(k.conf().GetLatencyPath()); err != nil {
+		k.echan <- pingLog.wrap(err)
+		return
+	}
+	pingLog.debug("saved latency metrics to %s", k.conf().GetLatencyPath())
+}
+
+// Reload the configuration from the config file and environment, reapplying
+// the options passed to New, then apply the heartbeat schedule, api timeout,
+// verbosity, log format, and log outputs to the running service. Log files
+// are reopened so that they can be moved by an external tool. Other values
+// such as the URL and API key are used by the next request. The echo server
+// is not restarted, so changes to its TLS configuration require a restart.
+// If the service runs local-only and the API key has been provisioned, the
+// service registers with Kahu. Called when the process receives SIGHUP.
+func (k *KeKahu) Reload() error {
+	info("reloading the kekahu configuration")
+
+	config := new(Config)
+	if err := config.load(); err != nil {
+		return err
+	}
+
+	if k.options != nil {
+		config.update(k.options)
+	}
+
+	// The API key may still be missing while the service runs local-only
+	if k.LocalOnly() && config.APIKey == "" {
+		if err := config.validateLocal(); err != nil {
+			return err
+		}
+	} else if err := config.validate(); err != nil {
+		return err
+	}
+
+	if err := config.ResolveAPIKey(); err != nil {
+		return err
+	}
+
+	// Parse the durations before applying any changes
+	schedule, err := config.GetSchedule()
+	if err != nil {
+		return err
+	}
+
+	if _, err := config.clientOptions(); err != nil {
+		return err
+	}
+
+	if err := SetLogFormat(config.LogFormat); err != nil {
+		return err
+	}
+
+	if err := config.openLogOutputs(); err != nil {
+		return err
+	}
+
+	k.verbose.Configure(uint8(config.Verbosity))
+	k.config.Store(config)
+	k.sched.Set(schedule)
+	if client, ok := k.httpClient(); ok {
+		if err := client.Reload(); err != nil {
+			return err
+		}
+	}
+
+	status("configuration reloaded")
+
+	// Resume the heartbeats stopped because Kahu rejected them, e.g. once a
+	// revoked API key has been replaced
+	if k.rejects.Resume() {
+		heartbeatLog.status("resuming heartbeats")
+	}
+
+	// Register with Kahu once the API key is provisioned
+	if k.conf().APIKey != "" && k.local.End() {
+		status("api key provisioned, registering with kahu")
+		return k.startKahu()
+	}
+	return nil
+}
+
+//===========================================================================
+// Internal Methods
+//===========================================================================
+
+// Runs the task in a go routine with the service context, tracking it so that
+// Shutdown can wait for it to complete. No task is started after Shutdown.
+func (k *KeKahu) spawn(task func(context.Context)) {
+	k.tasksm.Lock()
+	defer k.tasksm.Unlock()
+
+	if k.ctx.Err() != nil {
+		return
+	}
+
+	k.tasks.Add(1)
+	go func() {
+		defer k.tasks.Done()
+		task(k.ctx)
+	}()
+}
+
+// Returns the HTTP client used to make requests to Kahu, unwrapping the dry
+// run and federated clients, or false if the client has been replaced, e.g. by a mock.
+func (k *KeKahu) httpClient() (*HTTPClient, bool) {
+	api := k.api
+	if dryrun, ok := api.(*DryRunClient); ok {
+		api = dryrun.client
+	}
+	if federated, ok := api.(*FederatedClient); ok {
+		api = federated.primary
+	}
+
+	client, ok := api.(*HTTPClient)
+	return client, ok
+}
+
+// Spawns the task after the delay, e.g. to run the next heartbeat.
+func (k *KeKahu) schedule(delay time.Duration, task func(context.Context)) {
+	time.AfterFunc(delay, func() { k.spawn(task) })
+}
+
+// Returns true if the error was caused by a canceled context; since errors
+// are wrapped as strings throughout, the message is checked.
+func isCanceled(err error) bool {
+	return err == context.Canceled || strings.Contains(err.Error(), context.Canceled.Error())
+}
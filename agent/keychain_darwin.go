@@ -0,0 +1,14 @@
+package agent
+
+// The API key is stored as a generic password in the login keychain (or the
+// system keychain if run as root) with the security tool.
+const keychainName = "macOS keychain"
+
+func keychainGet(account string) (string, error) {
+	return runKeychain("", "security", "find-generic-password", "-s", ServiceLabel, "-a", account, "-w")
+}
+
+func keychainSet(account, key string) error {
+	_, err := runKeychain("", "security", "add-generic-password", "-U", "-s", ServiceLabel, "-a", account, "-w", key)
+	return err
+}
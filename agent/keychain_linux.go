@@ -0,0 +1,28 @@
+package agent
+
+// The API key is stored in the persistent kernel keyring of the user with
+// keyctl, falling back to the user keyring if persistent keyrings are not
+// supported by the kernel.
+const keychainName = "kernel keyring"
+
+func keychainGet(account string) (string, error) {
+	ring := userKeyring()
+	id, err := runKeychain("", "keyctl", "search", ring, "user", keychainService(account))
+	if err != nil {
+		return "", err
+	}
+	return runKeychain("", "keyctl", "pipe", id)
+}
+
+func keychainSet(account, key string) error {
+	_, err := runKeychain(key, "keyctl", "padd", "user", keychainService(account), userKeyring())
+	return err
+}
+
+// Returns the id of the persistent keyring of the user, or the user keyring.
+func userKeyring() string {
+	if ring, err := runKeychain("", "keyctl", "get_persistent", "@u"); err == nil && ring != "" {
+		return ring
+	}
+	return "@u"
+}
@@ -0,0 +1,15 @@
+//go:build !linux && !darwin && !windows
+// +build !linux,!darwin,!windows
+
+package agent
+
+// There is no supported keychain on this platform.
+const keychainName = ""
+
+func keychainGet(account string) (string, error) {
+	return "", errNoKeychain
+}
+
+func keychainSet(account, key string) error {
+	return errNoKeychain
+}
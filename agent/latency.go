@@ -0,0 +1,299 @@
+package agent
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bbengfort/kekahu/kahu"
+)
+
+// Latency is a hard working method that sends a request to the Kahu server for
+// all targets associated with the current host, then sends a ping request to
+// each of them, measuring the latency of the ping. It then reports the results
+// of the pings to all targets back to Kahu in a single batched request.
+//
+// Latency is called routinely from the heartbeat method, and will only be
+// executed if the host is active and the heartbeat was successful. Canceling
+// the context aborts the pings and the report.
+func (k *KeKahu) Latency(ctx context.Context, report bool) {
+	pingLog.trace("executing latency measures to neighbors")
+
+	// Fetch the source and the targets. If there is no response, or no targets
+	// then return, we're not going to be doing any work!
+	source, targets := k.Neighbors(ctx)
+	if source == "" || targets == nil || len(targets) == 0 {
+		pingLog.debug("no active neighbors to ping")
+		return
+	}
+
+	// Only ping the subset of the neighbors selected for this cycle, and the
+	// neighbors that are down only on their probation schedule
+	up, probing, skipped := k.checkTargets(targets)
+	targets = append(k.selectTargets(source, up), probing...)
+
+	// Execute the pings against each of the returned sources
+	group := new(sync.WaitGroup)
+	collect := make(chan *kahu.UpdateLatencyRequest, len(targets)+len(skipped))
+	for _, target := range skipped {
+		collect <- kahu.SkippedLatency(target)
+	}
+
+	for _, target := range targets {
+		group.Add(1)
+		go func(target *kahu.Neighbor) {
+			defer group.Done()
+			for _, update := range k.measureTarget(ctx, source, target) {
+				collect <- update
+			}
+		}(target)
+	}
+
+	// Wait for all pings to complete and close the collect
+	go func() {
+		group.Wait()
+		close(collect)
+	}()
+
+	// Gather all the results
+	requests := make(kahu.UpdateLatencyRequests, 0, len(targets)+len(skipped))
+	for update := range collect {
+		requests = append(requests, update)
+	}
+
+	// Add the latencies of the local host to the gossiped latency matrix
+	if k.conf().GossipLatency {
+		k.matrix.Update(source, k.network.Summaries(0))
+	}
+
+	// Send the metrics back to Kahu as one batch if report is true
+	if report && len(requests) > 0 {
+		if err := k.UpdateLatency(ctx, requests); err != nil {
+			k.echan <- pingLog.wrap(err)
+		}
+	}
+}
+
+// Sends the pings to the target and updates the metrics, returning the latency
+// reports of each ping. If the target could not be pinged, the report of a TCP
+// probe of the target is returned instead, if probes are enabled.
+func (k *KeKahu) measureTarget(ctx context.Context, source string, target *kahu.Neighbor) []*kahu.UpdateLatencyRequest {
+	// Send the pings and record the durations
+	latencies := k.pingTarget(ctx, source, target)
+
+	// Compare the latencies to the baseline before they are added to it, then
+	// update the metrics and run the latency hooks if the target is slow
+	anomaly := k.checkAnomaly(source, target, latencies)
+	kinds := k.network.Update(target.Hostname, latencies...)
+	k.checkLatency(target.Hostname, latencies)
+	loss, jitter := k.network.Quality(target.Hostname)
+	skew, asymmetry, clocked := k.network.Skew(target.Hostname)
+	p50, p95, p99, ranked := k.network.Percentiles(target.Hostname)
+
+	// Create the update requests for each ping
+	transport := k.pingerFor(target.Hostname, target.IPAddr).Transport()
+	updates := make([]*kahu.UpdateLatencyRequest, 0, len(latencies))
+	for i, latency := range latencies {
+		if kinds[i] == WarmupSample && k.conf().DiscardWarmup() {
+			continue
+		}
+		k.metrics.Ping(target.Hostname, transport, latency)
+
+		update := new(kahu.UpdateLatencyRequest)
+		update.Init(target.Hostname, latency)
+		update.Transport = transport
+		update.Size = k.conf().PingSize
+		update.Warmup = kinds[i] == WarmupSample
+		update.Outlier = kinds[i] == OutlierSample
+		update.Loss = loss
+		update.Jitter = float64(jitter) / float64(time.Millisecond)
+		if anomaly != nil {
+			update.Anomaly = true
+			update.Baseline = float64(anomaly.Baseline) / float64(time.Millisecond)
+		}
+		if ranked {
+			update.P50 = float64(p50) / float64(time.Millisecond)
+			update.P95 = float64(p95) / float64(time.Millisecond)
+			update.P99 = float64(p99) / float64(time.Millisecond)
+		}
+		if clocked && k.conf().ReportSkew {
+			update.Skew = float64(skew) / float64(time.Millisecond)
+			update.Asymmetry = float64(asymmetry) / float64(time.Millisecond)
+		}
+		updates = append(updates, update)
+	}
+
+	// If the echo server did not respond, probe the host with a TCP
+	// connect so Kahu can distinguish a down host from a down kekahu.
+	if !reachable(latencies) && k.conf().ProbeFallback && ctx.Err() == nil {
+		if fallback, err := k.Probe(ctx, target.IPAddr); err != nil {
+			pingLog.warne(err)
+		} else {
+			update := new(kahu.UpdateLatencyRequest)
+			update.Init(target.Hostname, fallback)
+			update.Probe = kahu.TCPProbe
+			updates = []*kahu.UpdateLatencyRequest{update}
+		}
+	}
+
+	return updates
+}
+
+// MeasureLatency pings the neighbors and reports the latencies to Kahu, then
+// schedules the next measurement after the latency interval, so that pings
+// are sent independently of heartbeats. No pings are sent while the last
+// heartbeat reported that the host is not active, but measurements continue
+// while heartbeats fail so that the latencies are still reported to Kahu (or
+// to the discovered neighbors) during outages.
+func (k *KeKahu) MeasureLatency(ctx context.Context) {
+	interval, err := k.conf().GetLatencyInterval()
+	if err != nil || interval <= 0 || ctx.Err() != nil {
+		return
+	}
+	defer k.schedule(interval, k.MeasureLatency)
+
+	if k.state.Inactive() {
+		pingLog.debug("host is not active, skipping latency measurements")
+		return
+	}
+	k.Latency(ctx, true)
+}
+
+// Returns true if latencies are measured after each successful heartbeat
+// rather than on their own interval.
+func (k *KeKahu) latencyOnHeartbeat() bool {
+	interval, err := k.conf().GetLatencyInterval()
+	return err != nil || interval <= 0
+}
+
+// Sends the configured burst of pings to the target, returning the latencies
+// of each ping with zero for timeouts. If no pings to the target's IP address
+// succeed, then the pings are sent to the address resolved from the target's
+// domain, if it has one, and the latencies of those pings are returned instead
+// if any of them succeed.
+func (k *KeKahu) pingTarget(ctx context.Context, source string, target *kahu.Neighbor) []time.Duration {
+	latencies := k.pingAddr(ctx, source, target.Hostname, target.IPAddr)
+	if target.Domain == "" || reachable(latencies) || ctx.Err() != nil {
+		return latencies
+	}
+
+	addr, err := resolveDomain(target.Domain, strings.ToLower(k.conf().PreferIP))
+	if err != nil {
+		pingLog.warne(err)
+		return latencies
+	}
+
+	if addr == target.IPAddr {
+		return latencies
+	}
+
+	// Only the pings of one of the addresses are reported, so that a target
+	// that is only reachable by its domain does not appear lossy
+	pingLog.debug("falling back to %s (%s) to ping %s", target.Domain, addr, target.Hostname)
+	if fallback := k.pingAddr(ctx, source, target.Hostname, addr); reachable(fallback) {
+		return fallback
+	}
+	return latencies
+}
+
+// Sends the configured burst of pings to the target at the addr. A single
+// gRPC ping uses the unary RPC so that echo servers that don't implement
+// streams can still be measured.
+func (k *KeKahu) pingAddr(ctx context.Context, source, target, addr string) []time.Duration {
+	sequence := k.network.Next(target)
+
+	if k.conf().PingBurst <= 1 {
+		latency, err := k.Ping(ctx, source, target, addr, sequence)
+		if err != nil {
+			pingLog.warne(err) // Don't send to echan or ping is blocked
+		}
+		return []time.Duration{latency}
+	}
+
+	latencies, err := k.PingStream(ctx, source, target, addr, sequence, uint64(k.conf().PingBurst))
+	if err != nil {
+		pingLog.warne(err) // Don't send to echan or ping is blocked
+	}
+	return latencies
+}
+
+// Returns true if any of the pings did not time out.
+func reachable(latencies []time.Duration) bool {
+	for _, latency := range latencies {
+		if latency > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// UpdateLatency is a helper method to send the latency information for the
+// specified host to the Kahu API.
+func (k *KeKahu) UpdateLatency(ctx context.Context, data kahu.UpdateLatencyRequests) error {
+	// Identify the host the pings were sent from by its assigned replica name
+	if replica := k.identity.Replica(); replica != "" {
+		for _, update := range data {
+			update.Source = replica
+		}
+	}
+
+	// Post the batch, buffering it to replay later if Kahu is unreachable
+	info, err := k.api.ReportLatency(ctx, data)
+	if err != nil {
+		return err
+	}
+
+	// Log the response if in debug mode
+	pingLog.debug(
+		"updated latency statistics from %d pings", len(info),
+	)
+
+	return nil
+}
+
+// Neighbors fetches the targets information from the Kahu server by performing
+// a GET request against the /api/latency endpoint. It returns the source name
+// of the requesting server as well as a list of target information.
+//
+// If Kahu is unreachable and a neighbor fallback is configured, the neighbors
+// are discovered from the peers file or DNS instead so that the latency
+// measurements continue during Kahu outages.
+func (k *KeKahu) Neighbors(ctx context.Context) (source string, targets []*kahu.Neighbor) {
+	info, err := k.FetchNeighbors(ctx)
+	if err != nil {
+		k.echan <- pingLog.wrap(err)
+		if k.conf().NeighborFallback == "" || ctx.Err() != nil {
+			return "", nil
+		}
+
+		if source, targets, err = k.DiscoverNeighbors(ctx); err != nil {
+			k.echan <- pingLog.wrap(err)
+			return "", nil
+		}
+
+		pingLog.warn("discovered %d neighbors from %s while kahu is unreachable", len(targets), k.conf().NeighborFallback)
+		return source, targets
+	}
+
+	k.state.Neighbors(info.Source, info.Targets)
+	return info.Source, info.Targets
+}
+
+// FetchNeighbors performs the GET request against the neighbors endpoint and
+// returns the response or any error that occurred.
+func (k *KeKahu) FetchNeighbors(ctx context.Context) (*kahu.NeighborsResponse, error) {
+	return k.api.Neighbors(ctx)
+}
+
+// LastLatency returns the most recent successful ping latency to the host
+// from the local metrics, and false if the host has never been pinged.
+func (k *KeKahu) LastLatency(host string) (time.Duration, bool) {
+	return k.network.Last(host)
+}
+
+// Metrics returns access to the latency metrics so that the command line
+// can print them out on demand.
+func (k *KeKahu) Metrics() map[string]map[string]interface{} {
+	return k.network.Report()
+}
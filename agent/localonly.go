@@ -0,0 +1,113 @@
+package agent
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+//===========================================================================
+// Local-Only Mode
+//===========================================================================
+
+// LocalOnly returns true if the service runs local-only because no API key
+// has been provisioned yet. The echo server, control socket, status and
+// metrics servers run as usual and the health is collected locally, but no
+// requests are made to Kahu until the API key appears in the configuration.
+func (k *KeKahu) LocalOnly() bool {
+	return k.local.Active()
+}
+
+// RunLocal collects the system health locally every heartbeat interval while
+// the service runs local-only, so that it is recorded in the metrics and the
+// health rules are evaluated, and checks the configuration file and the
+// environment for the API key. Once the API key is provisioned the
+// configuration is reloaded and the service registers with Kahu.
+func (k *KeKahu) RunLocal(ctx context.Context) {
+	if ctx.Err() != nil || !k.LocalOnly() {
+		return
+	}
+
+	// Reloading the configuration registers with Kahu
+	if k.provisioned() {
+		err := k.Reload()
+		if err == nil {
+			return
+		}
+		k.echan <- heartbeatLog.wrap(err)
+	}
+
+	defer k.schedule(k.sched.Next(time.Now()), k.RunLocal)
+	if k.conf().SendHealth {
+		k.Health(ctx)
+	}
+}
+
+// Returns true if the configuration file or the options passed to New now
+// have an API key.
+func (k *KeKahu) provisioned() bool {
+	config := new(Config)
+	if err := config.load(); err != nil {
+		return false
+	}
+
+	if k.options != nil {
+		config.update(k.options)
+	}
+	return config.APIKey != ""
+}
+
+// Tracks whether the service runs local-only and since when. It is
+// thread-safe and a nil localMode is never active.
+type localMode struct {
+	sync.RWMutex
+	active bool
+	since  time.Time
+}
+
+// Start running local-only.
+func (l *localMode) Start() {
+	l.Lock()
+	defer l.Unlock()
+	l.active = true
+	l.since = time.Now()
+}
+
+// End running local-only, returning true if the service was local-only so
+// that the service registers with Kahu only once.
+func (l *localMode) End() bool {
+	if l == nil {
+		return false
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	active := l.active
+	l.active = false
+	return active
+}
+
+// Active returns true while the service runs local-only.
+func (l *localMode) Active() bool {
+	if l == nil {
+		return false
+	}
+
+	l.RLock()
+	defer l.RUnlock()
+	return l.active
+}
+
+// Since returns when the service started running local-only, zero if it isn't.
+func (l *localMode) Since() time.Time {
+	if l == nil {
+		return time.Time{}
+	}
+
+	l.RLock()
+	defer l.RUnlock()
+	if !l.active {
+		return time.Time{}
+	}
+	return l.since
+}
@@ -0,0 +1,170 @@
+package agent
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MaxLogLevelDuration is the longest time a temporary log level is kept
+// before it reverts to the configured verbosity.
+const MaxLogLevelDuration = 24 * time.Hour
+
+// ParseLogLevel parses a log level by name (e.g. "debug") or number (0 for
+// trace up to 6 for silent).
+func ParseLogLevel(s string) (uint8, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	for level, name := range logLevelStrings {
+		if s == name {
+			return uint8(level), nil
+		}
+	}
+
+	level, err := strconv.ParseUint(s, 10, 8)
+	if err != nil || level > uint64(Silent) {
+		return 0, fmt.Errorf("could not parse log level '%s', specify %s or 0-%d", s, strings.Join(logLevelStrings[:], ", "), Silent)
+	}
+	return uint8(level), nil
+}
+
+// LogLevelStatus reports the log level of the running service, it is returned
+// by the set-verbosity control command.
+type LogLevelStatus struct {
+	Level  string     `json:"level"`            // the current log level
+	Until  *time.Time `json:"until,omitempty"`  // when a temporary log level reverts
+	Revert string     `json:"revert,omitempty"` // the log level that is reverted to
+}
+
+// String returns a human readable description of the log level.
+func (s *LogLevelStatus) String() string {
+	if s.Until == nil {
+		return fmt.Sprintf("log level is %s", s.Level)
+	}
+	return fmt.Sprintf("log level is %s until %s, then %s", s.Level, s.Until.Format(time.RFC3339), s.Revert)
+}
+
+// SetVerbosity changes the log level of the running service. If the duration
+// is not zero, the log level reverts to the configured verbosity after it,
+// e.g. to debug intermittent heartbeat failures for a few minutes. Otherwise
+// the log level is kept until the configuration is reloaded.
+func (k *KeKahu) SetVerbosity(level uint8, duration time.Duration) (*LogLevelStatus, error) {
+	if duration < 0 || duration > MaxLogLevelDuration {
+		return nil, fmt.Errorf("log level duration must be between 0 and %s", MaxLogLevelDuration)
+	}
+
+	k.verbose.Set(level, duration)
+	if duration > 0 {
+		status("log level set to %s for %s", LogLevel(), duration)
+	} else {
+		status("log level set to %s", LogLevel())
+	}
+	return k.verbose.Status(), nil
+}
+
+//===========================================================================
+// Log Level Overrides
+//===========================================================================
+
+// verbosity tracks the log level set from the CLI so that temporary log
+// levels revert to the configured verbosity. A nil verbosity sets the log
+// level directly.
+type verbosity struct {
+	sync.Mutex
+	base  uint8       // configured log level that temporary log levels revert to
+	until time.Time   // when the temporary log level reverts, zero if not temporary
+	timer *time.Timer // reverts the temporary log level
+}
+
+// Set the log level, reverting to the configured log level after the duration
+// unless it is zero. Any earlier temporary log level is canceled.
+func (v *verbosity) Set(level uint8, duration time.Duration) {
+	if v == nil {
+		SetLogLevel(level)
+		return
+	}
+
+	v.Lock()
+	defer v.Unlock()
+	v.cancel()
+
+	SetLogLevel(level)
+	if duration <= 0 {
+		v.base = level
+		return
+	}
+
+	v.until = time.Now().Add(duration)
+	v.timer = time.AfterFunc(duration, v.revert)
+}
+
+// Configure sets the configured log level, e.g. when the configuration is
+// reloaded. It is applied now unless a temporary log level is set, in which
+// case it is applied when the temporary log level reverts.
+func (v *verbosity) Configure(level uint8) {
+	if v == nil {
+		SetLogLevel(level)
+		return
+	}
+
+	v.Lock()
+	defer v.Unlock()
+	v.base = level
+	if v.timer == nil {
+		SetLogLevel(level)
+	}
+}
+
+// Status returns the current log level and when it reverts.
+func (v *verbosity) Status() *LogLevelStatus {
+	status := &LogLevelStatus{Level: LogLevel()}
+	if v == nil {
+		return status
+	}
+
+	v.Lock()
+	defer v.Unlock()
+	if v.timer != nil {
+		until := v.until
+		status.Until = &until
+		status.Revert = logLevelStrings[v.base]
+	}
+	return status
+}
+
+// Stop cancels the temporary log level without reverting it, e.g. on
+// shutdown.
+func (v *verbosity) Stop() {
+	if v == nil {
+		return
+	}
+
+	v.Lock()
+	defer v.Unlock()
+	v.cancel()
+}
+
+// Reverts the temporary log level to the configured log level.
+func (v *verbosity) revert() {
+	v.Lock()
+	defer v.Unlock()
+
+	if v.timer == nil || time.Now().Before(v.until) {
+		return
+	}
+
+	v.timer = nil
+	v.until = time.Time{}
+	SetLogLevel(v.base)
+	status("log level reverted to %s", LogLevel())
+}
+
+// Stops the timer of the temporary log level (not thread-safe).
+func (v *verbosity) cancel() {
+	if v.timer != nil {
+		v.timer.Stop()
+		v.timer = nil
+	}
+	v.until = time.Time{}
+}
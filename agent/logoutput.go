@@ -0,0 +1,442 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of destinations that log messages may be written to.
+const (
+	StdoutOutput   = "stdout"   // the standard output of the process
+	StderrOutput   = "stderr"   // the standard error of the process
+	FileOutput     = "file"     // a file that is rotated by size and age, e.g. file:/var/log/kekahu.log
+	SyslogOutput   = "syslog"   // the local syslog daemon, or a remote one, e.g. syslog:udp://logs:514
+	JournaldOutput = "journald" // the native protocol of the systemd journal
+)
+
+// LogOutputs returns the kinds of destinations log messages may be written to.
+func LogOutputs() []string {
+	return []string{StdoutOutput, StderrOutput, FileOutput, SyslogOutput, JournaldOutput}
+}
+
+// JournaldSocket is the socket the systemd journal receives messages on.
+const JournaldSocket = "/run/systemd/journal/socket"
+
+// LogOutput is a destination that log messages are written to.
+type LogOutput struct {
+	Kind   string // stdout, stderr, file, syslog, or journald
+	Target string // the path of the file or the address of the syslog server
+	Level  int    // the lowest level of messages written, -1 for the verbosity
+}
+
+// LogRotation limits how large and how old a log file may get before it is
+// renamed with a timestamp and a new file is started, and how many of the
+// renamed backups are kept. Rotation is disabled for zero limits.
+type LogRotation struct {
+	MaxSize    int64         // bytes the log file may grow to
+	MaxAge     time.Duration // time the log file may be written to after it is opened
+	MaxBackups int           // the number of rotated files to keep, all are kept if 0
+}
+
+// ParseLogOutputs parses a comma separated list of log outputs, each the kind
+// of destination, followed by a colon and the target of file and syslog
+// outputs, and optionally by an @ and the name or number of the lowest level
+// of messages written to it, e.g. "stdout, file:/var/log/kekahu.log@debug,
+// journald@warn". Outputs without a level use the verbosity.
+func ParseLogOutputs(s string) ([]*LogOutput, error) {
+	outputs := make([]*LogOutput, 0)
+	for _, entry := range strings.Split(s, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+
+		output := &LogOutput{Level: -1}
+		if idx := strings.LastIndex(entry, "@"); idx >= 0 {
+			if level, err := parseLogLevel(entry[idx+1:]); err == nil {
+				output.Level = int(level)
+				entry = entry[:idx]
+			}
+		}
+
+		output.Kind = strings.ToLower(entry)
+		if idx := strings.Index(entry, ":"); idx >= 0 {
+			output.Kind = strings.ToLower(entry[:idx])
+			output.Target = entry[idx+1:]
+		}
+
+		switch output.Kind {
+		case StdoutOutput, StderrOutput, JournaldOutput:
+			if output.Target != "" {
+				return nil, fmt.Errorf("%s log output does not take a target", output.Kind)
+			}
+		case FileOutput:
+			if output.Target == "" {
+				return nil, errors.New("file log output requires a path, e.g. file:/var/log/kekahu.log")
+			}
+		case SyslogOutput:
+		default:
+			return nil, fmt.Errorf("unknown log output '%s', must be one of %s", output.Kind, strings.Join(LogOutputs(), ", "))
+		}
+
+		outputs = append(outputs, output)
+	}
+	return outputs, nil
+}
+
+// Parses the name (e.g. debug) or number (e.g. 1) of a log level.
+func parseLogLevel(s string) (uint8, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	for level, name := range logLevelStrings {
+		if s == name {
+			return uint8(level), nil
+		}
+	}
+
+	level, err := strconv.ParseUint(s, 10, 8)
+	if err != nil || level > uint64(Silent) {
+		return 0, fmt.Errorf("unknown log level '%s'", s)
+	}
+	return uint8(level), nil
+}
+
+// String returns the output in the form it is parsed from.
+func (o *LogOutput) String() string {
+	s := o.Kind
+	if o.Target != "" {
+		s += ":" + o.Target
+	}
+	if o.Level >= 0 && o.Level < len(logLevelStrings) {
+		s += "@" + logLevelStrings[o.Level]
+	}
+	return s
+}
+
+//===========================================================================
+// Log Sinks
+//===========================================================================
+
+// The log outputs that messages are written to, stdout if there are none.
+var (
+	logSinks []*logSink
+	logMu    sync.RWMutex
+)
+
+// logSink writes messages at or above its level to a log output.
+type logSink struct {
+	output *LogOutput
+	writer logWriter
+}
+
+// logWriter writes a formatted message to a log output.
+type logWriter interface {
+	write(level uint8, component, msg string) error
+	Close() error
+}
+
+// SetLogOutputs opens the log outputs and replaces the outputs that messages
+// are currently written to, closing them. Files are reopened, so it may be
+// called after the log files are moved by an external tool. If any output
+// cannot be opened, the current outputs are kept and an error is returned.
+func SetLogOutputs(outputs []*LogOutput, rotation *LogRotation) error {
+	sinks := make([]*logSink, 0, len(outputs))
+	for _, output := range outputs {
+		writer, err := openLogOutput(output, rotation)
+		if err != nil {
+			for _, sink := range sinks {
+				sink.writer.Close()
+			}
+			return fmt.Errorf("could not open %s log output: %s", output, err)
+		}
+		sinks = append(sinks, &logSink{output: output, writer: writer})
+	}
+
+	logMu.Lock()
+	defer logMu.Unlock()
+	for _, sink := range logSinks {
+		sink.writer.Close()
+	}
+	logSinks = sinks
+	return nil
+}
+
+// Opens the log outputs of the configuration, rotating log files as configured.
+func (c *Config) openLogOutputs() error {
+	outputs, err := c.GetLogOutputs()
+	if err != nil {
+		return err
+	}
+
+	rotation, err := c.GetLogRotation()
+	if err != nil {
+		return err
+	}
+	return SetLogOutputs(outputs, rotation)
+}
+
+// Opens the writer of the log output.
+func openLogOutput(output *LogOutput, rotation *LogRotation) (logWriter, error) {
+	switch output.Kind {
+	case StdoutOutput:
+		return &streamWriter{logger: logger}, nil
+	case StderrOutput:
+		return &streamWriter{logger: newLogger(os.Stderr, false)}, nil
+	case FileOutput:
+		if rotation == nil {
+			rotation = new(LogRotation)
+		}
+		file := &rotatingFile{path: output.Target, rotation: *rotation}
+		if err := file.open(); err != nil {
+			return nil, err
+		}
+		return &streamWriter{logger: newLogger(file, true), dated: true, closer: file}, nil
+	case SyslogOutput:
+		return openSyslog(output.Target)
+	case JournaldOutput:
+		return openJournald()
+	default:
+		return nil, fmt.Errorf("unknown log output '%s'", output.Kind)
+	}
+}
+
+// Writes the message to every log output whose level it is at or above, or
+// to stdout if the verbosity allows and no log outputs have been set.
+func writeLog(level uint8, component, msg string) {
+	logMu.RLock()
+	defer logMu.RUnlock()
+
+	if len(logSinks) == 0 {
+		if level >= currentLogLevel() {
+			formatLog(logger, level, component, msg)
+		}
+		return
+	}
+
+	for _, sink := range logSinks {
+		threshold := currentLogLevel()
+		if sink.output.Level >= 0 {
+			threshold = uint8(sink.output.Level)
+		}
+
+		if level >= threshold {
+			// Errors cannot be logged without recursing, so they are dropped
+			sink.writer.write(level, component, msg)
+		}
+	}
+}
+
+// Returns true if the message would not be written to any log output.
+func discardLog(level uint8) bool {
+	current := currentLogLevel()
+	if current == Silent {
+		return true
+	}
+
+	logMu.RLock()
+	defer logMu.RUnlock()
+	for _, sink := range logSinks {
+		if sink.output.Level >= 0 && level >= uint8(sink.output.Level) {
+			return false
+		}
+	}
+	return level < current
+}
+
+// Writes the message to the logger in the current log format.
+func formatLog(l *log.Logger, level uint8, component, msg string) {
+	if jsonLogs() {
+		l.Println(jsonRecord(level, component, msg))
+		return
+	}
+
+	if component != "" {
+		msg = component + ": " + msg
+	}
+	l.Println(strings.TrimSuffix(msg, "\n"))
+}
+
+// Creates a logger with the prefix and flags of the current log format. Files
+// are dated since they are read long after, the stdout of a service usually
+// goes to a journal that adds the date.
+func newLogger(w interface{ Write([]byte) (int, error) }, dated bool) *log.Logger {
+	l := log.New(w, "", 0)
+	configureLogger(l, dated)
+	return l
+}
+
+// Sets the prefix and flags of the logger for the current log format.
+func configureLogger(l *log.Logger, dated bool) {
+	if jsonLogs() {
+		l.SetPrefix("")
+		l.SetFlags(0)
+		return
+	}
+
+	l.SetPrefix("[kekahu] ")
+	if dated {
+		l.SetFlags(log.Ldate | log.Lmicroseconds)
+	} else {
+		l.SetFlags(log.Lmicroseconds)
+	}
+}
+
+// Writes formatted messages to stdout, stderr, or a log file.
+type streamWriter struct {
+	logger *log.Logger
+	dated  bool
+	closer interface{ Close() error }
+}
+
+func (w *streamWriter) write(level uint8, component, msg string) error {
+	formatLog(w.logger, level, component, msg)
+	return nil
+}
+
+// Close the log file, stdout and stderr are left open.
+func (w *streamWriter) Close() error {
+	if w.closer != nil {
+		return w.closer.Close()
+	}
+	return nil
+}
+
+//===========================================================================
+// Log Rotation
+//===========================================================================
+
+// The layout of the timestamp added to the names of rotated log files.
+const rotatedLayout = "2006-01-02T15-04-05.000"
+
+// rotatingFile is a log file that is renamed with the time it was rotated,
+// e.g. kekahu-2018-06-01T12-00-00.000.log, and replaced by a new file when it
+// exceeds the max size or max age of the rotation. The oldest rotated files
+// beyond the max backups are removed. It is thread-safe.
+type rotatingFile struct {
+	sync.Mutex
+	path     string      // the path of the current log file
+	rotation LogRotation // when to rotate the file and how many backups to keep
+	file     *os.File    // the open log file
+	size     int64       // the size of the open log file
+	opened   time.Time   // when the log file was opened
+	header   []byte      // written at the start of every new file, e.g. CSV columns
+}
+
+// Write the data to the log file, rotating it first if the data would exceed
+// the max size or the file is older than the max age.
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.file == nil {
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	oversize := f.rotation.MaxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.rotation.MaxSize
+	expired := f.rotation.MaxAge > 0 && time.Since(f.opened) >= f.rotation.MaxAge
+	if oversize || expired {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// Close the log file.
+func (f *rotatingFile) Close() error {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.file == nil {
+		return nil
+	}
+
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+// Opens the log file for appending, creating it and its directory if needed.
+func (f *rotatingFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(f.path), 0755); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	f.file, f.size, f.opened = file, info.Size(), time.Now()
+	if f.size == 0 && len(f.header) > 0 {
+		n, err := f.file.Write(f.header)
+		f.size += int64(n)
+		return err
+	}
+	return nil
+}
+
+// Renames the log file with the current time, opens a new log file, and
+// removes the backups beyond the max backups.
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	f.file = nil
+
+	ext := filepath.Ext(f.path)
+	base := strings.TrimSuffix(f.path, ext)
+	backup := fmt.Sprintf("%s-%s%s", base, time.Now().Format(rotatedLayout), ext)
+	if err := os.Rename(f.path, backup); err != nil {
+		return err
+	}
+
+	if err := f.open(); err != nil {
+		return err
+	}
+
+	if f.rotation.MaxBackups > 0 {
+		backups := rotatedFiles(f.path)
+		for len(backups) > f.rotation.MaxBackups {
+			os.Remove(backups[0])
+			backups = backups[1:]
+		}
+	}
+	return nil
+}
+
+// Returns the rotated backups of the file at the path, oldest first.
+func rotatedFiles(path string) []string {
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+
+	// The timestamps sort in the order the files were rotated
+	matches, _ := filepath.Glob(base + "-*" + ext)
+	backups := make([]string, 0, len(matches))
+	for _, match := range matches {
+		stamp := strings.TrimSuffix(strings.TrimPrefix(match, base+"-"), ext)
+		if _, err := time.Parse(rotatedLayout, stamp); err == nil {
+			backups = append(backups, match)
+		}
+	}
+
+	sort.Strings(backups)
+	return backups
+}
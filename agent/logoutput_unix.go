@@ -0,0 +1,100 @@
+//go:build !windows
+// +build !windows
+
+package agent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log/syslog"
+	"net"
+	"net/url"
+)
+
+// Opens the syslog daemon at the address, e.g. udp://logs:514, or the local
+// syslog daemon if the address is empty.
+func openSyslog(addr string) (logWriter, error) {
+	var network, raddr string
+	if addr != "" {
+		u, err := url.Parse(addr)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("syslog address '%s' must be in the form udp://host:port", addr)
+		}
+		network, raddr = u.Scheme, u.Host
+	}
+
+	w, err := syslog.Dial(network, raddr, syslog.LOG_DAEMON|syslog.LOG_INFO, "kekahu")
+	if err != nil {
+		return nil, err
+	}
+	return &syslogWriter{w}, nil
+}
+
+// Writes messages to syslog with the priority of their level.
+type syslogWriter struct {
+	*syslog.Writer
+}
+
+func (w *syslogWriter) write(level uint8, component, msg string) error {
+	if component != "" {
+		msg = component + ": " + msg
+	}
+
+	switch level {
+	case Trace, Debug:
+		return w.Debug(msg)
+	case Info:
+		return w.Info(msg)
+	case Status:
+		return w.Notice(msg)
+	case Warn:
+		return w.Warning(msg)
+	default:
+		return w.Err(msg)
+	}
+}
+
+// Opens the native protocol socket of the systemd journal.
+func openJournald() (logWriter, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: JournaldSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &journaldWriter{conn}, nil
+}
+
+// Writes messages to the systemd journal with the syslog priority of their
+// level and the component in the KEKAHU_COMPONENT field.
+type journaldWriter struct {
+	*net.UnixConn
+}
+
+func (w *journaldWriter) write(level uint8, component, msg string) error {
+	priority := "3"
+	switch level {
+	case Trace, Debug:
+		priority = "7"
+	case Info:
+		priority = "6"
+	case Status:
+		priority = "5"
+	case Warn:
+		priority = "4"
+	}
+
+	buf := new(bytes.Buffer)
+	buf.WriteString("PRIORITY=" + priority + "\n")
+	buf.WriteString("SYSLOG_IDENTIFIER=kekahu\n")
+	if component != "" {
+		buf.WriteString("KEKAHU_COMPONENT=" + component + "\n")
+	}
+
+	// The message may contain newlines, so it is sent with its length
+	buf.WriteString("MESSAGE\n")
+	binary.Write(buf, binary.LittleEndian, uint64(len(msg)))
+	buf.WriteString(msg + "\n")
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
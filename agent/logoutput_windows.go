@@ -0,0 +1,16 @@
+//go:build windows
+// +build windows
+
+package agent
+
+import "errors"
+
+// Syslog is not available on Windows.
+func openSyslog(addr string) (logWriter, error) {
+	return nil, errors.New("syslog is not supported on windows")
+}
+
+// The systemd journal is not available on Windows.
+func openJournald() (logWriter, error) {
+	return nil, errors.New("journald is not supported on windows")
+}
@@ -0,0 +1,217 @@
+package agent
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Maintenance modes determine how heartbeats are sent during maintenance.
+const (
+	MaintenanceTag      = "tag"      // send heartbeats with the maintenance flag set
+	MaintenanceSuppress = "suppress" // do not send scheduled heartbeats
+)
+
+// MaxMaintenanceWindow is the longest duration of a maintenance window.
+const MaxMaintenanceWindow = 7 * 24 * time.Hour
+
+//===========================================================================
+// Maintenance Status
+//===========================================================================
+
+// MaintenanceStatus reports whether the host is in maintenance and why, it is
+// returned by the maintenance control command and included in the status.
+type MaintenanceStatus struct {
+	Active bool       `json:"active"`           // whether the host is in maintenance
+	Mode   string     `json:"mode"`             // whether heartbeats are tagged or suppressed
+	Reason string     `json:"reason,omitempty"` // the manual toggle or the window that is active
+	Until  *time.Time `json:"until,omitempty"`  // when the manual toggle expires, if ever
+}
+
+// String returns a human readable description of the maintenance status.
+func (s *MaintenanceStatus) String() string {
+	if !s.Active {
+		return "not in maintenance"
+	}
+
+	msg := fmt.Sprintf("in maintenance (%s), heartbeats are %s", s.Reason, s.action())
+	if s.Until != nil {
+		msg += fmt.Sprintf(" until %s", s.Until.Format(time.RFC3339))
+	}
+	return msg
+}
+
+func (s *MaintenanceStatus) action() string {
+	if s.Mode == MaintenanceSuppress {
+		return "suppressed"
+	}
+	return "tagged"
+}
+
+// Maintenance returns the maintenance status of the host at the time, the
+// host is in maintenance if it was put into maintenance from the CLI or if
+// one of the configured maintenance windows is open.
+func (k *KeKahu) Maintenance(now time.Time) *MaintenanceStatus {
+	status := &MaintenanceStatus{Mode: k.conf().GetMaintenanceMode()}
+	if until, ok := k.maint.Active(now); ok {
+		status.Active = true
+		status.Reason = "manual"
+		if !until.IsZero() {
+			status.Until = &until
+		}
+		return status
+	}
+
+	// The windows are parsed on every check so that reloads are applied
+	windows, err := k.conf().GetMaintenanceWindows()
+	if err != nil {
+		heartbeatLog.warn("could not parse maintenance windows: %s", err)
+		return status
+	}
+
+	for _, window := range windows {
+		if window.Active(now) {
+			status.Active = true
+			status.Reason = fmt.Sprintf("window %s", window)
+			return status
+		}
+	}
+	return status
+}
+
+// SetMaintenance puts the host into maintenance for the duration, or until it
+// is taken out of maintenance if the duration is zero. If enabled is false,
+// the host is taken out of manual maintenance, configured windows still apply.
+func (k *KeKahu) SetMaintenance(enabled bool, duration time.Duration) *MaintenanceStatus {
+	if enabled {
+		k.maint.Enable(duration)
+		status("maintenance mode enabled")
+	} else {
+		k.maint.Disable()
+		status("maintenance mode disabled")
+	}
+	return k.Maintenance(time.Now())
+}
+
+// downtime is the maintenance mode set from the CLI, which is kept in memory
+// so that restarting the service takes the host out of maintenance.
+type downtime struct {
+	sync.Mutex
+	enabled bool      // if the host was put into maintenance
+	until   time.Time // when the maintenance expires, zero for never
+}
+
+// Enable maintenance for the duration, or indefinitely if the duration is 0.
+func (m *downtime) Enable(duration time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.enabled = true
+	m.until = time.Time{}
+	if duration > 0 {
+		m.until = time.Now().Add(duration)
+	}
+}
+
+// Disable maintenance.
+func (m *downtime) Disable() {
+	m.Lock()
+	defer m.Unlock()
+	m.enabled = false
+	m.until = time.Time{}
+}
+
+// Active returns true if maintenance is enabled and has not expired at the
+// time, along with when it expires.
+func (m *downtime) Active(now time.Time) (time.Time, bool) {
+	if m == nil {
+		return time.Time{}, false
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	if m.enabled && !m.until.IsZero() && !now.Before(m.until) {
+		m.enabled = false
+		m.until = time.Time{}
+	}
+	return m.until, m.enabled
+}
+
+//===========================================================================
+// Maintenance Windows
+//===========================================================================
+
+// MaintenanceWindow is a recurring period of planned downtime that starts at
+// the times matched by a cron expression and lasts for the duration.
+type MaintenanceWindow struct {
+	Schedule string        // the five field cron expression of the start times
+	Duration time.Duration // how long the window stays open after it starts
+	start    *cronExpr     // the parsed cron expression of the start times
+}
+
+// ParseMaintenanceWindows parses a semicolon separated list of maintenance
+// windows, each a cron expression of the start of the window followed by its
+// duration, e.g. "0 2 * * sun 2h; 30 12 1 * * 45m". The cron expressions are
+// evaluated in the local time zone of the host.
+func ParseMaintenanceWindows(s string) ([]*MaintenanceWindow, error) {
+	windows := make([]*MaintenanceWindow, 0)
+	for _, entry := range strings.Split(s, ";") {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+
+		if len(fields) != 6 {
+			return nil, fmt.Errorf("maintenance window '%s' must be a five field cron expression and a duration", strings.TrimSpace(entry))
+		}
+
+		window, err := ParseMaintenanceWindow(strings.Join(fields[:5], " "), fields[5])
+		if err != nil {
+			return nil, err
+		}
+		windows = append(windows, window)
+	}
+	return windows, nil
+}
+
+// ParseMaintenanceWindow parses the cron expression of the start of a window
+// and its duration. Each field of the expression may be a *, a value, a range
+// (a-b), or a list of them separated by commas, optionally followed by a step
+// (e.g. */15). Months and days of the week may also be three letter names.
+func ParseMaintenanceWindow(schedule, duration string) (*MaintenanceWindow, error) {
+	window := &MaintenanceWindow{Schedule: schedule}
+
+	var err error
+	if window.Duration, err = time.ParseDuration(duration); err != nil {
+		return nil, fmt.Errorf("maintenance window '%s' has an invalid duration: %s", schedule, err)
+	}
+
+	if window.Duration <= 0 || window.Duration > MaxMaintenanceWindow {
+		return nil, fmt.Errorf("maintenance window '%s' must last longer than 0 and at most %s", schedule, MaxMaintenanceWindow)
+	}
+
+	if window.start, err = parseCronExpr(schedule); err != nil {
+		return nil, fmt.Errorf("maintenance window '%s': %s", schedule, err)
+	}
+	return window, nil
+}
+
+// Active returns true if the window is open at the time, e.g. if the window
+// started at a time matched by the cron expression less than its duration ago.
+func (w *MaintenanceWindow) Active(now time.Time) bool {
+	start := now.Truncate(time.Minute)
+	for elapsed := now.Sub(start); elapsed < w.Duration; elapsed += time.Minute {
+		if w.start.matches(start) {
+			return true
+		}
+		start = start.Add(-time.Minute)
+	}
+	return false
+}
+
+// String returns the cron expression and duration of the window.
+func (w *MaintenanceWindow) String() string {
+	return fmt.Sprintf("%s %s", w.Schedule, w.Duration)
+}
@@ -0,0 +1,434 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Network keeps track of latency statistics between peers when running the
+// echo ping protocol on each heartbeat. This struct serves primarily as a
+// thread-safe access to a map of hostnames to LatencyStats objects.
+type Network struct {
+	sync.RWMutex
+	metrics map[string]*LatencyStats
+	filter  *SampleFilter // excludes warm-up pings and outliers, nil accepts all
+}
+
+// PingBucket returns the name that the latency metrics of the pings to the
+// host with a payload of the size are kept under, e.g. "alpha/65536B", so that
+// the latencies of different message sizes are kept separately.
+func PingBucket(host string, size int) string {
+	return fmt.Sprintf("%s/%dB", host, size)
+}
+
+// Returns true if the metrics are kept under the bucket of a payload size
+// rather than a host; hostnames never contain a slash.
+func isPingBucket(name string) bool {
+	return strings.Contains(name, "/")
+}
+
+// Init the internal mapping of metrics objects.
+func (n *Network) Init() {
+	n.Lock()
+	defer n.Unlock()
+	n.metrics = make(map[string]*LatencyStats)
+}
+
+// Filter sets the filter that decides which latencies are added to the
+// statistics of each host, a nil filter adds all latencies.
+func (n *Network) Filter(filter *SampleFilter) {
+	n.Lock()
+	defer n.Unlock()
+	n.filter = filter
+}
+
+// Update the network with the latencies for the given host, returning the
+// kind of each sample. Warm-up samples are left out of the statistics, and
+// outliers are only kept with the recent latencies.
+func (n *Network) Update(host string, latencies ...time.Duration) []SampleKind {
+	n.Lock()
+	defer n.Unlock()
+	metrics := n.get(host)
+
+	now := time.Now()
+	kinds := make([]SampleKind, 0, len(latencies))
+	for _, latency := range latencies {
+		kind := n.filter.classify(metrics, latency, now)
+		switch kind {
+		case AcceptedSample:
+			metrics.Update(latency)
+		case OutlierSample:
+			metrics.remember(latency)
+		}
+		kinds = append(kinds, kind)
+	}
+	return kinds
+}
+
+// Next returns the next sequence id for the specified host.
+func (n *Network) Next(host string) uint64 {
+	n.Lock()
+	defer n.Unlock()
+	metrics := n.get(host)
+	return metrics.N() + 1
+}
+
+// Last returns the most recent successful latency to the host and false if
+// there have been no successful pings to the host.
+func (n *Network) Last(host string) (time.Duration, bool) {
+	n.RLock()
+	defer n.RUnlock()
+
+	metrics, ok := n.metrics[host]
+	if !ok || metrics.Samples == 0 {
+		return 0, false
+	}
+	return castSeconds(metrics.Last), true
+}
+
+// Clock updates the clock skew estimate of the host with the timestamps of a
+// ping to its echo server.
+func (n *Network) Clock(host string, sample *ClockSample) {
+	n.Lock()
+	defer n.Unlock()
+	metrics := n.get(host)
+	metrics.Clock(sample)
+}
+
+// Skew returns the estimated clock offset of the host from the local clock
+// and the asymmetry of the one-way delays to it (outbound minus inbound), and
+// false if its echo server has not timestamped any pings.
+func (n *Network) Skew(host string) (skew, asymmetry time.Duration, ok bool) {
+	n.RLock()
+	defer n.RUnlock()
+
+	metrics, ok := n.metrics[host]
+	if !ok || metrics.Clocks == 0 {
+		return 0, 0, false
+	}
+	return castSeconds(metrics.Skew), castSeconds(metrics.Asymmetry), true
+}
+
+// Quality returns the packet loss percentage and the RFC 3550 interarrival
+// jitter of the pings to the host.
+func (n *Network) Quality(host string) (loss float64, jitter time.Duration) {
+	n.RLock()
+	defer n.RUnlock()
+
+	metrics, ok := n.metrics[host]
+	if !ok {
+		return 0.0, 0
+	}
+	return metrics.Loss(), castSeconds(metrics.Jitter)
+}
+
+// Percentiles returns the median, 95th, and 99th percentile latencies to the
+// host, and false if there have been no successful pings to the host.
+func (n *Network) Percentiles(host string) (p50, p95, p99 time.Duration, ok bool) {
+	n.RLock()
+	defer n.RUnlock()
+
+	metrics, ok := n.metrics[host]
+	if !ok || metrics.Histogram.Total == 0 {
+		return 0, 0, 0, false
+	}
+
+	p50, p95, p99 = metrics.Histogram.Percentiles()
+	return p50, p95, p99, true
+}
+
+// Serialize the benchmark for a specific host to post to Kahu. Note that
+// this returns float values in milliseconds for timing purposes.
+func (n *Network) Serialize(host string) map[string]interface{} {
+	n.Lock()
+	defer n.Unlock()
+
+	// Instantiate data structures
+	metrics := n.get(host)
+	data := make(map[string]interface{})
+
+	// Add information in milliseconds to the data structure
+	data["target"] = host
+	data["messages"] = metrics.N()
+	data["timeouts"] = metrics.Timeouts
+	data["total"] = metrics.Total * 1000.0
+	data["mean"] = metrics.Mean() * 1000.0
+	data["stddev"] = metrics.StdDev() * 1000.0
+	data["variance"] = metrics.Variance() * 1000.0
+	data["fastest"] = metrics.Minimum * 1000.0
+	data["slowest"] = metrics.Maximum * 1000.0
+	data["range"] = metrics.Range() * 1000.0
+	data["loss"] = metrics.Loss()
+	data["jitter"] = metrics.Jitter * 1000.0
+
+	p50, p95, p99 := metrics.Histogram.Percentiles()
+	data["p50"] = float64(p50) / float64(time.Millisecond)
+	data["p95"] = float64(p95) / float64(time.Millisecond)
+	data["p99"] = float64(p99) / float64(time.Millisecond)
+
+	if metrics.Clocks > 0 {
+		data["skew"] = metrics.Skew * 1000.0
+		data["asymmetry"] = metrics.Asymmetry * 1000.0
+	}
+
+	return data
+}
+
+// Report returns a JSON representation of the metrics.
+func (n *Network) Report() map[string]map[string]interface{} {
+	n.RLock()
+	defer n.RUnlock()
+	data := make(map[string]map[string]interface{})
+	for host, metrics := range n.metrics {
+		data[host] = metrics.Serialize()
+	}
+	return data
+}
+
+// Dump the latency statistics for all hosts to a JSON file at the path so
+// that they can be restored with Load when the service is restarted.
+func (n *Network) Dump(path string) error {
+	n.RLock()
+	data, err := json.Marshal(n.metrics)
+	n.RUnlock()
+
+	if err != nil {
+		return fmt.Errorf("could not encode latency metrics: %s", err)
+	}
+
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("could not write latency metrics: %s", err)
+	}
+	return nil
+}
+
+// Load the latency statistics from a JSON file written by Dump, replacing
+// the current statistics. If the file does not exist, nothing is loaded.
+func (n *Network) Load(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("could not read latency metrics: %s", err)
+	}
+
+	metrics := make(map[string]*LatencyStats)
+	if err := json.Unmarshal(data, &metrics); err != nil {
+		return fmt.Errorf("could not parse latency metrics: %s", err)
+	}
+
+	n.Lock()
+	defer n.Unlock()
+	n.metrics = metrics
+	return nil
+}
+
+// metrics returns the benchmark for the specified host (not thread-safe).
+func (n *Network) get(host string) *LatencyStats {
+	// Get the stats object from the map
+	metrics, ok := n.metrics[host]
+	if !ok {
+		metrics = new(LatencyStats)
+		n.metrics[host] = metrics
+	}
+
+	return metrics
+}
+
+//===========================================================================
+// Latency Statistics
+//===========================================================================
+
+// RecentLatencies is the number of the most recent latencies to each host that
+// are kept, e.g. to plot the latency over time on the dashboard.
+const RecentLatencies = 32
+
+// LatencyStats keeps track of the online distribution of ping latencies to a
+// host in seconds. Unlike stats.Benchmark, all of the state is exported so
+// that it can be persisted across restarts, and the latencies are also
+// counted in a histogram so that percentiles can be reported. LatencyStats is not thread-safe,
+// access is synchronized by the Network. The state of the connection to the
+// host is not persisted since connections don't survive a restart.
+type LatencyStats struct {
+	Samples  uint64  `json:"samples"`  // number of successful pings
+	Timeouts uint64  `json:"timeouts"` // number of pings that timed out
+	Total    float64 `json:"total"`    // sum of the latencies in seconds
+	Squares  float64 `json:"squares"`  // sum of the squares of the latencies
+	Minimum  float64 `json:"minimum"`  // fastest latency in seconds
+	Maximum  float64 `json:"maximum"`  // slowest latency in seconds
+	Last     float64 `json:"last"`     // most recent latency in seconds
+	Jitter   float64 `json:"jitter"`   // RFC 3550 interarrival jitter in seconds
+
+	// The most recent latencies in seconds including outliers, zero for timeouts, oldest first
+	Recent []float64 `json:"recent"`
+
+	// The distribution of the successful latencies for percentiles
+	Histogram Histogram `json:"histogram"`
+
+	// Clock skew estimates from the timestamps of the echo server
+	Clocks    uint64  `json:"clocks"`     // number of pings timestamped by the echo server
+	Skew      float64 `json:"skew"`       // clock offset of the host in seconds
+	SkewDelay float64 `json:"skew_delay"` // round trip delay of the sample the skew is from
+	SkewAge   uint64  `json:"skew_age"`   // number of samples since the skew was estimated
+	Asymmetry float64 `json:"asymmetry"`  // outbound minus inbound one-way delay in seconds
+
+	warm int       // pings on the current connection, up to the warm-up pings
+	seen time.Time // when the host was last pinged
+}
+
+// Update the statistics with latencies, a zero latency is a timeout.
+func (s *LatencyStats) Update(latencies ...time.Duration) {
+	for _, latency := range latencies {
+		s.remember(latency)
+		if latency == 0 {
+			s.Timeouts++
+			continue
+		}
+
+		// Estimate jitter from the difference between consecutive latencies
+		// as described in RFC 3550 section 6.4.1.
+		sample := latency.Seconds()
+		if s.Samples > 0 {
+			s.Jitter += (math.Abs(sample-s.Last) - s.Jitter) / 16.0
+		}
+
+		s.Samples++
+		s.Histogram.Record(latency)
+		s.Total += sample
+		s.Squares += sample * sample
+		s.Last = sample
+
+		if s.Samples == 1 || sample < s.Minimum {
+			s.Minimum = sample
+		}
+
+		if s.Samples == 1 || sample > s.Maximum {
+			s.Maximum = sample
+		}
+	}
+}
+
+// Adds the latency to the most recent latencies.
+func (s *LatencyStats) remember(latency time.Duration) {
+	s.Recent = append(s.Recent, latency.Seconds())
+	if len(s.Recent) > RecentLatencies {
+		s.Recent = s.Recent[len(s.Recent)-RecentLatencies:]
+	}
+}
+
+// Clock updates the clock skew estimate with the timestamps of a ping. As in
+// NTP, the skew is the offset of the sample with the lowest round trip delay
+// (within the last SkewWindow samples) since it is the least affected by
+// queueing. The one-way delays of each sample are corrected by the skew to
+// estimate the asymmetry of the path, smoothed in the same way as jitter.
+func (s *LatencyStats) Clock(sample *ClockSample) {
+	delay := sample.Delay.Seconds()
+	s.SkewAge++
+
+	if s.Clocks == 0 || delay <= s.SkewDelay || s.SkewAge >= SkewWindow {
+		s.Skew = sample.Offset.Seconds()
+		s.SkewDelay = delay
+		s.SkewAge = 0
+	}
+
+	// Outbound - skew minus inbound + skew is the asymmetry of the path
+	asymmetry := (sample.Outbound - sample.Inbound).Seconds() - 2*s.Skew
+	if s.Clocks == 0 {
+		s.Asymmetry = asymmetry
+	} else {
+		s.Asymmetry += (asymmetry - s.Asymmetry) / 16.0
+	}
+	s.Clocks++
+}
+
+// N returns the number of successful pings.
+func (s *LatencyStats) N() uint64 {
+	return s.Samples
+}
+
+// Mean returns the average latency in seconds.
+func (s *LatencyStats) Mean() float64 {
+	if s.Samples > 0 {
+		return s.Total / float64(s.Samples)
+	}
+	return 0.0
+}
+
+// Variance returns the sample variance of the latencies in seconds.
+func (s *LatencyStats) Variance() float64 {
+	if s.Samples > 1 {
+		n := float64(s.Samples)
+		return (n*s.Squares - s.Total*s.Total) / (n * (n - 1))
+	}
+	return 0.0
+}
+
+// StdDev returns the sample standard deviation of the latencies in seconds.
+func (s *LatencyStats) StdDev() float64 {
+	return math.Sqrt(s.Variance())
+}
+
+// Loss returns the percentage of pings that timed out.
+func (s *LatencyStats) Loss() float64 {
+	if sent := s.Samples + s.Timeouts; sent > 0 {
+		return float64(s.Timeouts) / float64(sent) * 100.0
+	}
+	return 0.0
+}
+
+// Range returns the difference between the slowest and fastest latency.
+func (s *LatencyStats) Range() float64 {
+	return s.Maximum - s.Minimum
+}
+
+// Serialize returns a map of summary statistics as human readable durations.
+func (s *LatencyStats) Serialize() map[string]interface{} {
+	data := make(map[string]interface{})
+	data["samples"] = s.Samples
+	data["timeouts"] = s.Timeouts
+	data["total"] = castSeconds(s.Total).String()
+	data["mean"] = castSeconds(s.Mean()).String()
+	data["stddev"] = castSeconds(s.StdDev()).String()
+	data["variance"] = castSeconds(s.Variance()).String()
+	data["fastest"] = castSeconds(s.Minimum).String()
+	data["slowest"] = castSeconds(s.Maximum).String()
+	data["range"] = castSeconds(s.Range()).String()
+	data["jitter"] = castSeconds(s.Jitter).String()
+	data["loss"] = s.Loss()
+
+	p50, p95, p99 := s.Histogram.Percentiles()
+	data["p50"] = p50.String()
+	data["p95"] = p95.String()
+	data["p99"] = p99.String()
+
+	recent := make([]string, 0, len(s.Recent))
+	for _, latency := range s.Recent {
+		recent = append(recent, castSeconds(latency).String())
+	}
+	data["recent"] = recent
+
+	if s.Clocks > 0 {
+		data["skew"] = castSeconds(s.Skew).String()
+		data["asymmetry"] = castSeconds(s.Asymmetry).String()
+	}
+
+	if s.Total > 0 {
+		data["throughput"] = float64(s.Samples) / s.Total
+	} else {
+		data["throughput"] = 0.0
+	}
+
+	return data
+}
+
+// Cast float64 seconds into a duration
+func castSeconds(seconds float64) time.Duration {
+	return time.Duration(float64(time.Second) * seconds)
+}
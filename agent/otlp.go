@@ -0,0 +1,381 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// OTLPMetricsPath is the path of the metrics endpoint of an OTLP/HTTP
+// collector that is used if the configured endpoint does not have a path.
+const OTLPMetricsPath = "/v1/metrics"
+
+// OTLP aggregation temporality of sums, all counters of the service are
+// cumulative since the service started.
+const otlpCumulative = 2
+
+// ExportTelemetry pushes the metrics of the service to the OpenTelemetry
+// collector at the configured OTLP endpoint, then schedules the next export
+// after the OTLP interval. The metrics are encoded with the OTLP/HTTP JSON
+// protocol, so the collector must have the otlp receiver's http protocol
+// enabled. Errors are sent on the error channel and do not stop the exports.
+func (k *KeKahu) ExportTelemetry(ctx context.Context) {
+	if k.conf().OTLPEndpoint == "" || ctx.Err() != nil {
+		return
+	}
+
+	if interval, err := k.conf().GetOTLPInterval(); err == nil {
+		defer k.schedule(interval, k.ExportTelemetry)
+	}
+
+	if err := k.exportOTLP(ctx); err != nil {
+		k.echan <- telemetryLog.wrap(err)
+		return
+	}
+	telemetryLog.debug("exported metrics to %s", k.conf().OTLPEndpoint)
+}
+
+// Posts the metrics to the OTLP endpoint with the configured headers.
+func (k *KeKahu) exportOTLP(ctx context.Context) error {
+	endpoint, err := k.conf().GetOTLPEndpoint()
+	if err != nil {
+		return err
+	}
+
+	headers, err := k.conf().GetOTLPHeaders()
+	if err != nil {
+		return err
+	}
+
+	timeout, err := k.conf().GetAPITimeout()
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(k.otlpMetrics(time.Now()))
+	if err != nil {
+		return fmt.Errorf("could not encode otlp metrics: %s", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("could not create otlp request: %s", err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	client := &http.Client{Timeout: timeout}
+	res, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not export metrics to %s: %s", endpoint, err)
+	}
+	defer res.Body.Close()
+	defer io.Copy(ioutil.Discard, res.Body)
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("could not export metrics to %s: %s", endpoint, res.Status)
+	}
+	return nil
+}
+
+// Collects the heartbeat and ping counters, the ping latency gauges of each
+// neighbor, and the gauges of the last health report into an OTLP export
+// request. The resource is identified by the hostname and the replica name
+// returned by Kahu with the last heartbeat.
+func (k *KeKahu) otlpMetrics(now time.Time) *otlpRequest {
+	resource := otlpAttributes(map[string]string{
+		"service.name":    "kekahu",
+		"service.version": PackageVersion,
+	})
+
+	if hostname, err := os.Hostname(); err == nil {
+		resource = append(resource, otlpAttribute("host.name", hostname))
+	}
+
+	k.state.RLock()
+	if k.state.lastReply != nil && k.state.lastReply.Replica != "" {
+		resource = append(resource, otlpAttribute("kahu.replica", k.state.lastReply.Replica))
+	}
+	k.state.RUnlock()
+
+	// Metrics without any data points (e.g. no pings yet) are not exported
+	metrics := make([]*otlpMetric, 0)
+	for _, metric := range append(k.metrics.otlpMetrics(now), k.network.otlpMetrics(now)...) {
+		if metric.points() > 0 {
+			metrics = append(metrics, metric)
+		}
+	}
+
+	return &otlpRequest{
+		ResourceMetrics: []*otlpResourceMetrics{{
+			Resource: &otlpResource{Attributes: resource},
+			ScopeMetrics: []*otlpScopeMetrics{{
+				Scope:   &otlpScope{Name: "github.com/bbengfort/kekahu", Version: PackageVersion},
+				Metrics: metrics,
+			}},
+		}},
+	}
+}
+
+// Returns the counters and the last health report as OTLP metrics.
+func (t *Telemetry) otlpMetrics(now time.Time) []*otlpMetric {
+	t.Lock()
+	defer t.Unlock()
+
+	start := otlpTime(t.started)
+	metrics := make([]*otlpMetric, 0, 8)
+
+	heartbeats := newOTLPCounter("kekahu.heartbeats", "Heartbeats sent to Kahu by result.", "{heartbeat}")
+	for _, result := range sortedKeys(t.heartbeats) {
+		heartbeats.Sum.add(start, now, t.heartbeats[result], "result", result)
+	}
+	metrics = append(metrics, heartbeats)
+
+	apiErrors := newOTLPCounter("kekahu.api.errors", "Failed requests to the Kahu API by endpoint.", "{error}")
+	for _, endpoint := range sortedKeys(t.apiErrors) {
+		apiErrors.Sum.add(start, now, t.apiErrors[endpoint], "endpoint", endpoint)
+	}
+	metrics = append(metrics, apiErrors)
+
+	served := newOTLPCounter("kekahu.pings.served", "Pings replied to by the echo server.", "{ping}")
+	served.Sum.add(start, now, t.pingsServed)
+	metrics = append(metrics, served)
+
+	rejected := newOTLPCounter("kekahu.pings.rejected", "Unauthenticated pings rejected by the echo server.", "{ping}")
+	rejected.Sum.add(start, now, t.rejected)
+	metrics = append(metrics, rejected)
+
+	timeouts := newOTLPCounter("kekahu.ping.timeouts", "Pings to the target that timed out.", "{ping}")
+	for _, target := range sortedKeys(t.timeouts) {
+		timeouts.Sum.add(start, now, t.timeouts[target], "target", target)
+	}
+	metrics = append(metrics, timeouts)
+
+	if t.health != nil {
+		// Utilization is reported as a ratio as in the OpenTelemetry semantic conventions
+		cpu := newOTLPGauge("system.cpu.utilization", "Fraction of all CPU cores in use.", "1")
+		cpu.Gauge.add(now, t.health.CPUPercent/100)
+
+		ram := newOTLPGauge("system.memory.utilization", "Fraction of RAM used by programs.", "1")
+		ram.Gauge.add(now, t.health.UsedRAMPercent/100)
+
+		disk := newOTLPGauge("system.filesystem.utilization", "Fraction of disk space used by mount point.", "1")
+		for _, status := range t.health.Disks {
+			disk.Gauge.add(now, status.UsedPercent/100, "mountpoint", status.Path)
+		}
+		if len(t.health.Disks) == 0 {
+			disk.Gauge.add(now, t.health.UsedDiskPercent/100)
+		}
+
+		metrics = append(metrics, cpu, ram, disk)
+	}
+
+	return metrics
+}
+
+// Returns the latency gauges of each neighbor as OTLP metrics.
+func (n *Network) otlpMetrics(now time.Time) []*otlpMetric {
+	n.RLock()
+	defer n.RUnlock()
+
+	hosts := make([]string, 0, len(n.metrics))
+	for host := range n.metrics {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	last := newOTLPGauge("kekahu.ping.latency", "Latency of the most recent ping to the target.", "s")
+	mean := newOTLPGauge("kekahu.ping.latency.mean", "Mean latency of pings to the target.", "s")
+	p50 := newOTLPGauge("kekahu.ping.latency.p50", "Median latency of pings to the target.", "s")
+	p95 := newOTLPGauge("kekahu.ping.latency.p95", "95th percentile latency of pings to the target.", "s")
+	p99 := newOTLPGauge("kekahu.ping.latency.p99", "99th percentile latency of pings to the target.", "s")
+	loss := newOTLPGauge("kekahu.ping.loss", "Percentage of pings to the target that timed out.", "%")
+
+	for _, host := range hosts {
+		metrics := n.metrics[host]
+		loss.Gauge.add(now, metrics.Loss(), "target", host)
+		if metrics.Samples == 0 {
+			continue
+		}
+
+		median, high, highest := metrics.Histogram.Percentiles()
+		last.Gauge.add(now, metrics.Last, "target", host)
+		mean.Gauge.add(now, metrics.Mean(), "target", host)
+		p50.Gauge.add(now, median.Seconds(), "target", host)
+		p95.Gauge.add(now, high.Seconds(), "target", host)
+		p99.Gauge.add(now, highest.Seconds(), "target", host)
+	}
+
+	return []*otlpMetric{last, mean, p50, p95, p99, loss}
+}
+
+//===========================================================================
+// OTLP JSON Request Objects
+//===========================================================================
+
+// The OTLP/HTTP JSON encoding of an ExportMetricsServiceRequest, see
+// opentelemetry-proto. 64 bit integers are encoded as strings.
+type otlpRequest struct {
+	ResourceMetrics []*otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     *otlpResource       `json:"resource"`
+	ScopeMetrics []*otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpResource struct {
+	Attributes []*otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   *otlpScope    `json:"scope"`
+	Metrics []*otlpMetric `json:"metrics"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+type otlpMetric struct {
+	Name        string     `json:"name"`
+	Description string     `json:"description,omitempty"`
+	Unit        string     `json:"unit,omitempty"`
+	Sum         *otlpSum   `json:"sum,omitempty"`
+	Gauge       *otlpGauge `json:"gauge,omitempty"`
+}
+
+type otlpSum struct {
+	DataPoints             []*otlpDataPoint `json:"dataPoints"`
+	AggregationTemporality int              `json:"aggregationTemporality"`
+	IsMonotonic            bool             `json:"isMonotonic"`
+}
+
+type otlpGauge struct {
+	DataPoints []*otlpDataPoint `json:"dataPoints"`
+}
+
+type otlpDataPoint struct {
+	Attributes        []*otlpKeyValue `json:"attributes,omitempty"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano,omitempty"`
+	TimeUnixNano      string          `json:"timeUnixNano"`
+	AsInt             string          `json:"asInt,omitempty"`
+	AsDouble          *float64        `json:"asDouble,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string        `json:"key"`
+	Value *otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+// Returns a monotonic cumulative sum metric.
+func newOTLPCounter(name, description, unit string) *otlpMetric {
+	return &otlpMetric{
+		Name: name, Description: description, Unit: unit,
+		Sum: &otlpSum{DataPoints: make([]*otlpDataPoint, 0), AggregationTemporality: otlpCumulative, IsMonotonic: true},
+	}
+}
+
+// Returns a gauge metric.
+func newOTLPGauge(name, description, unit string) *otlpMetric {
+	return &otlpMetric{
+		Name: name, Description: description, Unit: unit,
+		Gauge: &otlpGauge{DataPoints: make([]*otlpDataPoint, 0)},
+	}
+}
+
+// Returns the number of data points of the metric.
+func (m *otlpMetric) points() int {
+	if m.Sum != nil {
+		return len(m.Sum.DataPoints)
+	}
+	if m.Gauge != nil {
+		return len(m.Gauge.DataPoints)
+	}
+	return 0
+}
+
+// Adds a data point with the count since start and the key/value attributes.
+func (s *otlpSum) add(start string, now time.Time, count uint64, attrs ...string) {
+	s.DataPoints = append(s.DataPoints, &otlpDataPoint{
+		Attributes:        otlpPairs(attrs...),
+		StartTimeUnixNano: start,
+		TimeUnixNano:      otlpTime(now),
+		AsInt:             strconv.FormatUint(count, 10),
+	})
+}
+
+// Adds a data point with the value and the key/value attributes.
+func (g *otlpGauge) add(now time.Time, value float64, attrs ...string) {
+	g.DataPoints = append(g.DataPoints, &otlpDataPoint{
+		Attributes:   otlpPairs(attrs...),
+		TimeUnixNano: otlpTime(now),
+		AsDouble:     &value,
+	})
+}
+
+// Returns the attributes in sorted order of their keys.
+func otlpAttributes(attrs map[string]string) []*otlpKeyValue {
+	keys := make([]string, 0, len(attrs))
+	for key := range attrs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	kvs := make([]*otlpKeyValue, 0, len(keys))
+	for _, key := range keys {
+		kvs = append(kvs, otlpAttribute(key, attrs[key]))
+	}
+	return kvs
+}
+
+// Returns the attributes from alternating keys and values.
+func otlpPairs(pairs ...string) []*otlpKeyValue {
+	kvs := make([]*otlpKeyValue, 0, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		kvs = append(kvs, otlpAttribute(pairs[i], pairs[i+1]))
+	}
+	return kvs
+}
+
+func otlpAttribute(key, value string) *otlpKeyValue {
+	return &otlpKeyValue{Key: key, Value: &otlpAnyValue{StringValue: value}}
+}
+
+func otlpTime(ts time.Time) string {
+	return strconv.FormatInt(ts.UnixNano(), 10)
+}
+
+// Returns the collector endpoint with the OTLP metrics path if it has none.
+func otlpEndpoint(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+
+	if u.Scheme == "" || u.Host == "" {
+		return "", fmt.Errorf("otlp endpoint '%s' must be an http or https url", endpoint)
+	}
+
+	if u.Path == "" || u.Path == "/" {
+		u.Path = OTLPMetricsPath
+	}
+	return u.String(), nil
+}
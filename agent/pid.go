@@ -0,0 +1,215 @@
+// Handling process id information and enables cross-process communication
+// between the server and the command line client.
+
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+//===========================================================================
+// PID File
+//===========================================================================
+
+// PID describes the contents of the PID file written by the running kekahu
+// service so that the command line client can find and signal the process.
+type PID struct {
+	PID     int       `json:"pid"`     // the process id of the service
+	PPID    int       `json:"ppid"`    // the parent process id of the service
+	Started time.Time `json:"started"` // when the service was started
+	path    string    // path the PID file is written to
+}
+
+// ErrNotRunning is returned when there is no PID file for the service.
+var ErrNotRunning = errors.New("kekahu is not running (no pid file)")
+
+// AlreadyRunningError is returned by Lock when another kekahu service is
+// running on the host.
+type AlreadyRunningError struct {
+	PID  *PID   // the PID file of the running service
+	Path string // the path of the PID file
+}
+
+// Error describes the running service and how to replace a stale PID file.
+func (e *AlreadyRunningError) Error() string {
+	return fmt.Sprintf(
+		"kekahu is already running (pid %d, up %s, pid file %s): stop it first, or use --force if the pid file is stale",
+		e.PID.PID, e.PID.Uptime().Round(time.Second), e.Path,
+	)
+}
+
+// NewPID creates a PID for the current process to be saved at the path.
+func NewPID(path string) *PID {
+	return &PID{
+		PID:     os.Getpid(),
+		PPID:    os.Getppid(),
+		Started: time.Now(),
+		path:    path,
+	}
+}
+
+// LoadPID reads the PID file of the running service from the path.
+func LoadPID(path string) (*PID, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotRunning
+		}
+		return nil, fmt.Errorf("could not read pid file: %s", err)
+	}
+
+	pid := &PID{path: path}
+	if err := json.Unmarshal(data, pid); err != nil {
+		return nil, fmt.Errorf("could not parse pid file: %s", err)
+	}
+	return pid, nil
+}
+
+// Save the PID file to disk, overwriting any previous PID file.
+func (p *PID) Save() error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return fmt.Errorf("could not encode pid file: %s", err)
+	}
+
+	if err := ioutil.WriteFile(p.path, data, 0644); err != nil {
+		return fmt.Errorf("could not write pid file: %s", err)
+	}
+
+	debug("pid file written to %s", p.path)
+	return nil
+}
+
+// Lock writes the PID file unless it belongs to another kekahu process that
+// is still running, so that only one service heartbeats from the host. The
+// file is created exclusively so that two services that start at the same
+// time cannot both lock it. PID files of processes that are no longer running
+// are replaced, as is the PID file of a running process if force is true. The
+// caller must only force the lock if it is stale, i.e. the process id has been
+// reused by a process that is not a kekahu service.
+func (p *PID) Lock(force bool) error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return fmt.Errorf("could not encode pid file: %s", err)
+	}
+
+	for attempt := 0; attempt < 2; attempt++ {
+		f, err := os.OpenFile(p.path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			_, err = f.Write(data)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return fmt.Errorf("could not write pid file: %s", err)
+			}
+
+			debug("pid file locked at %s", p.path)
+			return nil
+		}
+
+		if !os.IsExist(err) {
+			return fmt.Errorf("could not write pid file: %s", err)
+		}
+
+		// The PID file exists, check if its process is another running service
+		other, err := LoadPID(p.path)
+		switch {
+		case err != nil:
+			warn("replacing unreadable pid file: %s", err)
+		case other.PID == p.PID:
+			debug("replacing pid file of this process")
+		case other.Running() && !force:
+			return &AlreadyRunningError{PID: other, Path: p.path}
+		case other.Running():
+			warn("replacing stale pid file of process %d, which is not a kekahu service", other.PID)
+		default:
+			info("replacing stale pid file of process %d", other.PID)
+		}
+
+		if err := os.Remove(p.path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("could not remove pid file: %s", err)
+		}
+	}
+
+	return fmt.Errorf("could not lock pid file %s: another service is starting", p.path)
+}
+
+// Free removes the PID file from disk if it exists and belongs to this
+// process, so that a service started with --force does not remove the PID
+// file of the service it replaced.
+func (p *PID) Free() error {
+	if other, err := LoadPID(p.path); err == nil && other.PID != p.PID {
+		return nil
+	}
+
+	if err := os.Remove(p.path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("could not remove pid file: %s", err)
+	}
+	return nil
+}
+
+// Running checks if the process described by the PID file is still alive.
+func (p *PID) Running() bool {
+	return processRunning(p.PID)
+}
+
+// Uptime returns the duration since the service was started.
+func (p *PID) Uptime() time.Duration {
+	return time.Since(p.Started)
+}
+
+// Stop sends SIGTERM to the running service to shut it down cleanly.
+func (p *PID) Stop() error {
+	if !p.Running() {
+		return fmt.Errorf("kekahu process %d is not running (stale pid file)", p.PID)
+	}
+
+	proc, err := os.FindProcess(p.PID)
+	if err != nil {
+		return err
+	}
+	return proc.Signal(syscall.SIGTERM)
+}
+
+//===========================================================================
+// OS Signal Handlers
+//===========================================================================
+
+// Handles OS signals: SIGINT and SIGTERM call shutdown and return its error,
+// while SIGHUP calls reload (if not nil) and continues handling signals. The
+// process is not exited, so the caller decides how to exit.
+func signalHandler(shutdown func() error, reload func() error) error {
+	// Make signal channel and register notifiers for Interupt, Terminate, and Hangup
+	sigchan := make(chan os.Signal, 1)
+	signal.Notify(sigchan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(sigchan)
+
+	// Block until we receive a shutdown signal on the channel
+	for sig := range sigchan {
+		if sig != syscall.SIGHUP {
+			break
+		}
+
+		if reload == nil {
+			continue
+		}
+
+		if err := reload(); err != nil {
+			warn("could not reload configuration: %s", err)
+		}
+	}
+
+	// Shutdown now that we've received the signal
+	if err := shutdown(); err != nil {
+		return fmt.Errorf("shutdown error: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,21 @@
+//go:build !windows
+// +build !windows
+
+package agent
+
+import (
+	"os"
+	"syscall"
+)
+
+// Checks if the process is alive by sending it the null signal. A process of
+// another user that can't be signaled is still alive.
+func processRunning(pid int) bool {
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+
+	err = proc.Signal(syscall.Signal(0))
+	return err == nil || err == syscall.EPERM
+}
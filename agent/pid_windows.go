@@ -0,0 +1,30 @@
+//go:build windows
+// +build windows
+
+package agent
+
+import "syscall"
+
+// Constants of the process API, see winnt.h and minwinbase.h.
+const (
+	processQueryLimitedInformation = 0x1000
+	stillActive                    = 259
+	errorAccessDenied              = 5
+)
+
+// Checks if the process is alive by opening it and checking that it has not
+// exited, since processes can't be sent the null signal on Windows. A process
+// of another user that can't be opened is still alive.
+func processRunning(pid int) bool {
+	handle, err := syscall.OpenProcess(processQueryLimitedInformation, false, uint32(pid))
+	if err != nil {
+		return err == syscall.Errno(errorAccessDenied)
+	}
+	defer syscall.CloseHandle(handle)
+
+	var code uint32
+	if err := syscall.GetExitCodeProcess(handle, &code); err != nil {
+		return false
+	}
+	return code == stillActive
+}
@@ -0,0 +1,267 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bbengfort/kekahu/kahu"
+	knet "github.com/bbengfort/kekahu/net"
+)
+
+// SendNPings is a helper function that looks up the neighbors from the API,
+// then sends N pings to them, keeping track of internal metrics. This method
+// is meant to be run from the command line, so it doesn't use the standard
+// logger but instead directly prints to the command line. All of the pings
+// are sent at once, so it measures the latency of a burst of pings; see
+// PacePings to measure the steady-state latency.
+func (k *KeKahu) SendNPings(ctx context.Context, n uint64) error {
+	return k.sendNPings(ctx, n, k.conf().PingSize, os.Stderr)
+}
+
+// PacePings looks up the neighbors from the API, then sends a ping to each of
+// them every interval until n pings were sent to each, like the classic ping
+// command, keeping track of internal metrics. A line is written for every
+// reply or timeout with the sequence number, target, and round trip time, and
+// the statistics of each neighbor once the pings were sent or the context is
+// canceled. If the interval is zero, all of the pings are sent at once like
+// SendNPings.
+//
+// Each ping carries a payload of the size in bytes, the configured ping size
+// if the size is zero. The latencies of pings of any other size than the
+// configured ping size are kept in the metrics of their own bucket of the
+// neighbor and size (see PingBucket), so that the latencies of different
+// message sizes are not mixed.
+func (k *KeKahu) PacePings(ctx context.Context, n uint64, size int, interval time.Duration, w io.Writer) error {
+	size, err := k.pingSize(size)
+	if err != nil {
+		return err
+	}
+
+	if interval <= 0 {
+		return k.sendNPings(ctx, n, size, w)
+	}
+
+	source, targets := k.Neighbors(ctx)
+	if source == "" || len(targets) == 0 {
+		fmt.Fprintln(w, "no active neighbors to ping")
+		return nil
+	}
+
+	fmt.Fprintf(w, "sending %d pings%s to %d neighbors every %s ...\n", n, ofSize(size), len(targets), interval)
+
+	summaries := make([]*PingSummary, 0, len(targets))
+	for _, target := range targets {
+		summaries = append(summaries, &PingSummary{Target: target.Hostname})
+	}
+
+	// Send a ping to every neighbor each round, waiting for the replies
+	output := new(sync.Mutex)
+rounds:
+	for seq := uint64(0); seq < n; seq++ {
+		started := time.Now()
+		group := new(sync.WaitGroup)
+		for i, target := range targets {
+			group.Add(1)
+			go func(target *kahu.Neighbor, summary *PingSummary) {
+				defer group.Done()
+				bucket := k.pingBucket(target.Hostname, size)
+				latency, _ := k.ping(ctx, source, target.Hostname, target.IPAddr, k.network.Next(bucket), size)
+				k.network.Update(bucket, latency)
+
+				output.Lock()
+				defer output.Unlock()
+				summary.Add(latency)
+				if latency == 0 {
+					fmt.Fprintf(w, "seq=%d target=%s timeout\n", seq, target.Hostname)
+				} else {
+					fmt.Fprintf(w, "seq=%d target=%s time=%s\n", seq, target.Hostname, latency)
+				}
+			}(target, summaries[i])
+		}
+		group.Wait()
+
+		if seq+1 == n {
+			break
+		}
+
+		select {
+		case <-time.After(interval - time.Since(started)):
+		case <-ctx.Done():
+			break rounds
+		}
+	}
+
+	fmt.Fprintln(w)
+	for _, summary := range summaries {
+		fmt.Fprintln(w, summary)
+	}
+	return nil
+}
+
+// Sends N pings with a payload of the size to each neighbor, printing the
+// progress to the writer.
+func (k *KeKahu) sendNPings(ctx context.Context, n uint64, size int, w io.Writer) error {
+	// Fetch the source and the targets. If there is no response, or no targets
+	// then return, we're not going to be doing any work!
+	source, targets := k.Neighbors(ctx)
+	if source == "" || targets == nil || len(targets) == 0 {
+		fmt.Fprintln(w, "no active neighbors to ping")
+		return nil
+	}
+
+	fmt.Fprintf(w, "sending %d pings%s to %d neighbors ...\n", n, ofSize(size), len(targets))
+
+	// Stream the pings to each of the returned sources
+	group := new(sync.WaitGroup)
+	for _, target := range targets {
+		group.Add(1)
+		go func(target *kahu.Neighbor) {
+			defer group.Done()
+
+			// Send the pings and record the durations
+			bucket := k.pingBucket(target.Hostname, size)
+			sequence := k.network.Next(bucket)
+			latencies, _ := k.pingStream(ctx, source, target.Hostname, target.IPAddr, sequence, n, size)
+			for _, latency := range latencies {
+				if latency == 0 {
+					fmt.Fprint(w, "x")
+				} else {
+					fmt.Fprint(w, ".")
+				}
+			}
+
+			// Update the metrics
+			k.network.Update(bucket, latencies...)
+
+		}(target)
+	}
+
+	// Wait for all pings to complete and end the progress line
+	group.Wait()
+	fmt.Fprint(w, "\n")
+	return nil
+}
+
+// PingHost sends n pings directly to the echo server at the addr, a hostname
+// or IP address with an optional port (the port of DefaultAddr if omitted),
+// without looking it up in the neighbors from Kahu, e.g. to check that a new
+// host that is not yet registered with Kahu can be reached. The latencies are
+// returned in order with zero for timeouts and are not recorded in the
+// latency metrics of the neighbors. Each ping carries a payload of the size in
+// bytes, the configured ping size if the size is zero.
+func (k *KeKahu) PingHost(ctx context.Context, addr string, n uint64, size int) ([]time.Duration, error) {
+	size, err := k.pingSize(size)
+	if err != nil {
+		return nil, err
+	}
+
+	// Identify the host by its replica name if Kahu has assigned one
+	source := k.identity.Replica()
+	if source == "" {
+		if source, err = k.conf().LocalHostname(); err != nil {
+			return nil, err
+		}
+	}
+
+	// The target is named by the host of the address
+	target := addr
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		target = host
+	}
+	target = strings.TrimSuffix(strings.TrimPrefix(target, "["), "]")
+
+	if n <= 1 {
+		latency, err := k.ping(ctx, source, target, addr, 0, size)
+		return []time.Duration{latency}, err
+	}
+	return k.pingStream(ctx, source, target, addr, 0, n, size)
+}
+
+// Returns the payload size of the pings sent from the command line, the
+// configured ping size if the size is zero.
+func (k *KeKahu) pingSize(size int) (int, error) {
+	if size == 0 {
+		return k.conf().GetPingSize()
+	}
+
+	if size < 0 || size > knet.MaxPingSize {
+		return 0, fmt.Errorf("ping size must be between 0 and %d bytes", knet.MaxPingSize)
+	}
+	return size, nil
+}
+
+// Returns the name the latency metrics of pings to the target with a payload
+// of the size are kept under: the target itself for pings of the configured
+// ping size, which are measured on every heartbeat, otherwise the bucket of the
+// target and size.
+func (k *KeKahu) pingBucket(target string, size int) string {
+	if size == k.conf().PingSize {
+		return target
+	}
+	return PingBucket(target, size)
+}
+
+// Describes the payload size of the pings, e.g. " of 1024 bytes", or an empty
+// string if the pings carry no payload.
+func ofSize(size int) string {
+	if size <= 0 {
+		return ""
+	}
+	return fmt.Sprintf(" of %d bytes", size)
+}
+
+//===========================================================================
+// Ping Statistics
+//===========================================================================
+
+// PingSummary is the statistics of the pings sent to a target, e.g. to report
+// them once the pings from the command line were sent.
+type PingSummary struct {
+	Target   string        // the target the pings were sent to
+	Sent     int           // the number of pings sent
+	Received int           // the number of replies received
+	Min      time.Duration // the lowest latency of the replies
+	Max      time.Duration // the highest latency of the replies
+	Total    time.Duration // the sum of the latencies of the replies
+}
+
+// Add the latency of a ping to the statistics, zero if it timed out.
+func (s *PingSummary) Add(latency time.Duration) {
+	s.Sent++
+	if latency == 0 {
+		return
+	}
+
+	if s.Received == 0 || latency < s.Min {
+		s.Min = latency
+	}
+	if latency > s.Max {
+		s.Max = latency
+	}
+	s.Total += latency
+	s.Received++
+}
+
+// Loss returns the percentage of the pings that timed out.
+func (s *PingSummary) Loss() float64 {
+	if s.Sent == 0 {
+		return 0
+	}
+	return float64(s.Sent-s.Received) / float64(s.Sent) * 100
+}
+
+// String returns the statistics on a single line like the classic ping, e.g.
+// "10 pings sent to alpha, 9 received, 10.0% loss, min/avg/max = ...".
+func (s *PingSummary) String() string {
+	out := fmt.Sprintf("%d pings sent to %s, %d received, %.1f%% loss", s.Sent, s.Target, s.Received, s.Loss())
+	if s.Received > 0 {
+		out += fmt.Sprintf(", min/avg/max = %s/%s/%s", s.Min, s.Total/time.Duration(s.Received), s.Max)
+	}
+	return out
+}
@@ -0,0 +1,91 @@
+package agent
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bbengfort/kekahu/kahu"
+)
+
+//===========================================================================
+// Down Neighbors
+//===========================================================================
+
+// Tracks when the neighbors that Kahu reports as down were last pinged, so
+// that they are only pinged on the slower probation schedule rather than in
+// every latency cycle. The probation is thread-safe.
+type probation struct {
+	sync.Mutex
+	last map[string]time.Time
+}
+
+// Due returns true and records the ping if the target has not been pinged
+// within the interval. Targets are never due if the interval is zero.
+func (p *probation) Due(target string, interval time.Duration, now time.Time) bool {
+	if interval <= 0 {
+		return false
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	if p.last == nil {
+		p.last = make(map[string]time.Time)
+	}
+
+	if last, ok := p.last[target]; ok && now.Sub(last) < interval {
+		return false
+	}
+
+	p.last[target] = now
+	return true
+}
+
+// Release ends the probation of the target, e.g. when Kahu reports that it is
+// up again, so that it is pinged as soon as it is down again.
+func (p *probation) Release(target string) {
+	p.Lock()
+	defer p.Unlock()
+	delete(p.last, target)
+}
+
+// Splits the neighbors into the targets that are up, the targets that are
+// down but due to be pinged on probation, and the targets that are down and
+// skipped in this cycle, by their state reported by Kahu.
+func (k *KeKahu) checkTargets(targets []*kahu.Neighbor) (up, probing, skipped []*kahu.Neighbor) {
+	down := k.conf().GetDownStates()
+	if len(down) == 0 {
+		return targets, nil, nil
+	}
+
+	interval, err := k.conf().GetProbationInterval()
+	if err != nil {
+		k.echan <- pingLog.wrap(err)
+		interval = 0
+	}
+
+	now := time.Now()
+	up = make([]*kahu.Neighbor, 0, len(targets))
+	for _, target := range targets {
+		if !containsString(down, strings.ToLower(target.State)) {
+			k.trial.Release(target.Hostname)
+			up = append(up, target)
+			continue
+		}
+
+		if k.trial.Due(target.Hostname, interval, now) {
+			probing = append(probing, target)
+		} else {
+			skipped = append(skipped, target)
+		}
+	}
+
+	if len(probing) > 0 || len(skipped) > 0 {
+		pingLog.debug(
+			"%d neighbors are down, pinging %d on probation and skipping %d",
+			len(probing)+len(skipped), len(probing), len(skipped),
+		)
+	}
+	return up, probing, skipped
+}
@@ -0,0 +1,58 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Probe measures the latency to the host at addr with a TCP connect to the
+// configured probe port. This is used as a fallback when the echo server on
+// the target isn't responding to distinguish a down host from a down kekahu
+// service. Because the handshake only requires a round trip to the host's
+// network stack, a refused connection still indicates the host is reachable.
+func (k *KeKahu) Probe(ctx context.Context, addr string) (time.Duration, error) {
+	// Replace any port in the address with the probe port
+	host, _, err := net.SplitHostPort(resolveAddr(addr))
+	if err != nil {
+		return 0, fmt.Errorf("could not parse probe address: %s", err)
+	}
+	addr = net.JoinHostPort(host, strconv.Itoa(k.conf().ProbePort))
+
+	timeout, err := k.conf().GetPingTimeout()
+	if err != nil {
+		return 0, err
+	}
+
+	dialer := &net.Dialer{Timeout: timeout}
+	start := time.Now()
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	latency := time.Since(start)
+
+	if err != nil {
+		if isConnRefused(err) {
+			pingLog.debug("tcp probe to %s refused in %s", addr, latency)
+			return latency, nil
+		}
+		return 0, fmt.Errorf("could not probe %s: %s", addr, err)
+	}
+
+	conn.Close()
+	pingLog.debug("tcp probe to %s in %s", addr, latency)
+	return latency, nil
+}
+
+// Returns true if the error is caused by the remote host refusing the
+// connection, which requires that the host is up to send the reset.
+func isConnRefused(err error) bool {
+	if oerr, ok := err.(*net.OpError); ok {
+		if serr, ok := oerr.Err.(*os.SyscallError); ok {
+			return serr.Err == syscall.ECONNREFUSED
+		}
+	}
+	return false
+}
@@ -0,0 +1,215 @@
+package agent
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Formats of the measurement recordings.
+const (
+	CSVRecord   = "csv"   // comma separated values with a header row
+	JSONLRecord = "jsonl" // one JSON object per line
+)
+
+// RecordFormats returns the supported formats of the measurement recordings.
+func RecordFormats() []string {
+	return []string{CSVRecord, JSONLRecord}
+}
+
+// Returns true if the format is a supported recording format.
+func isRecordFormat(format string) bool {
+	for _, f := range RecordFormats() {
+		if format == f {
+			return true
+		}
+	}
+	return false
+}
+
+// recordColumns are the header of CSV recordings.
+var recordColumns = []string{"timestamp", "source", "target", "seq", "rtt_ms", "timeout", "transport", "size"}
+
+// PingSample is the raw result of a single ping, recorded for offline
+// analysis of the latencies. Timeouts are recorded with a zero RTT.
+type PingSample struct {
+	Timestamp time.Time `json:"timestamp"` // when the ping was sent
+	Source    string    `json:"source"`    // hostname the ping was sent from
+	Target    string    `json:"target"`    // hostname the ping was sent to
+	Sequence  uint64    `json:"seq"`       // sequence number of the ping to the target
+	RTT       float64   `json:"rtt_ms"`    // round trip time in milliseconds
+	Timeout   bool      `json:"timeout"`   // the ping was not replied to
+	Transport string    `json:"transport"` // transport the ping was sent with
+	Size      int       `json:"size"`      // size in bytes of the payload of the ping
+}
+
+//===========================================================================
+// Measurement Recorder
+//===========================================================================
+
+// Recorder appends every ping result to a rotating CSV or JSONL file. The
+// file is rotated like the log files and the rotated recordings are bundled
+// by ExportRecordings. It is thread-safe and a nil recorder records nothing.
+type Recorder struct {
+	format string
+	file   *rotatingFile
+}
+
+// NewRecorder returns a recorder that appends samples in the format to the
+// file at the path, creating it when the first sample is recorded.
+func NewRecorder(path, format string, rotation *LogRotation) (*Recorder, error) {
+	format = strings.ToLower(format)
+	if !isRecordFormat(format) {
+		return nil, fmt.Errorf("unknown record format '%s', use one of %s", format, strings.Join(RecordFormats(), ", "))
+	}
+
+	if rotation == nil {
+		rotation = new(LogRotation)
+	}
+
+	r := &Recorder{format: format, file: &rotatingFile{path: path, rotation: *rotation}}
+	if format == CSVRecord {
+		r.file.header = []byte(strings.Join(recordColumns, ",") + "\n")
+	}
+	return r, nil
+}
+
+// Record appends the sample to the recording.
+func (r *Recorder) Record(sample *PingSample) error {
+	if r == nil {
+		return nil
+	}
+
+	var line []byte
+	switch r.format {
+	case JSONLRecord:
+		data, err := json.Marshal(sample)
+		if err != nil {
+			return err
+		}
+		line = append(data, '\n')
+	default:
+		buf := new(bytes.Buffer)
+		w := csv.NewWriter(buf)
+		w.Write([]string{
+			sample.Timestamp.UTC().Format(time.RFC3339Nano), sample.Source, sample.Target,
+			strconv.FormatUint(sample.Sequence, 10), strconv.FormatFloat(sample.RTT, 'f', -1, 64),
+			strconv.FormatBool(sample.Timeout), sample.Transport, strconv.Itoa(sample.Size),
+		})
+		w.Flush()
+		line = buf.Bytes()
+	}
+
+	// A single write keeps concurrent samples on separate lines
+	_, err := r.file.Write(line)
+	return err
+}
+
+// Close the recording, it is reopened by the next sample.
+func (r *Recorder) Close() error {
+	if r == nil {
+		return nil
+	}
+	return r.file.Close()
+}
+
+// Records the result of a ping sent with the transport at the timestamp in
+// nanoseconds, which is zero if the ping failed before it was sent. Pings
+// canceled by shutdown are ignored so that they are not mistaken for timeouts.
+func (k *KeKahu) recordPing(transport string, sent int64, source, target string, seq uint64, size int, latency time.Duration) {
+	if k.record == nil || k.ctx.Err() != nil {
+		return
+	}
+
+	timestamp := time.Now()
+	if sent != 0 {
+		timestamp = time.Unix(0, sent)
+	}
+
+	sample := &PingSample{
+		Timestamp: timestamp, Source: source, Target: target, Sequence: seq,
+		RTT:     float64(latency) / float64(time.Millisecond),
+		Timeout: latency <= 0, Transport: transport, Size: size,
+	}
+
+	if err := k.record.Record(sample); err != nil {
+		pingLog.warn("could not record ping: %s", err)
+	}
+}
+
+//===========================================================================
+// Export Recordings
+//===========================================================================
+
+// ExportRecordings writes the recording at the path and its rotated backups
+// to w as a gzip compressed tar archive, oldest first, returning the names of
+// the files that were archived.
+func ExportRecordings(path string, w io.Writer) ([]string, error) {
+	files := rotatedFiles(path)
+	if _, err := os.Stat(path); err == nil {
+		files = append(files, path)
+	}
+
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no recordings found at %s", path)
+	}
+
+	gz := gzip.NewWriter(w)
+	archive := tar.NewWriter(gz)
+	for _, file := range files {
+		if err := archiveFile(archive, file); err != nil {
+			return nil, fmt.Errorf("could not archive %s: %s", file, err)
+		}
+	}
+
+	if err := archive.Close(); err != nil {
+		return nil, err
+	}
+
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// Adds the file to the archive by its base name.
+func archiveFile(archive *tar.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if !info.Mode().IsRegular() {
+		return errors.New("not a regular file")
+	}
+
+	hdr, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	hdr.Name = filepath.Base(path)
+
+	if err := archive.WriteHeader(hdr); err != nil {
+		return err
+	}
+
+	// The recording may still be appended to, so only its current size is copied
+	_, err = io.CopyN(archive, f, hdr.Size)
+	return err
+}
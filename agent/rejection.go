@@ -0,0 +1,252 @@
+package agent
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bbengfort/kekahu/kahu"
+)
+
+// Actions taken when Kahu rejects a heartbeat with a non 2xx status.
+const (
+	RetryAction      = "retry"      // keep sending heartbeats on the schedule
+	BackoffAction    = "backoff"    // delay the next heartbeats exponentially up to heartbeat_backoff
+	StopAction       = "stop"       // stop sending heartbeats until the configuration is reloaded
+	DeregisterAction = "deregister" // forget the replica identity, then stop sending heartbeats
+)
+
+// DefaultHeartbeatActions are the actions taken on the statuses that Kahu
+// rejects a heartbeat with, which the heartbeat_actions configuration
+// overrides: heartbeats stop if the API key was revoked, the host forgets its
+// identity if Kahu removed it, and heartbeats back off if Kahu is overloaded.
+// Heartbeats rejected with any other status are retried on the schedule.
+const DefaultHeartbeatActions = "401=stop,403=stop,410=deregister,429=backoff,5xx=backoff"
+
+// HeartbeatActions maps the statuses of rejected heartbeats to the actions
+// taken on them, either by status code or by class (e.g. 5xx).
+type HeartbeatActions struct {
+	codes   map[int]string
+	classes map[int]string
+}
+
+// ParseHeartbeatActions parses a comma separated list of status=action pairs,
+// where the status is a code (e.g. 401) or a class (e.g. 5xx) and the action
+// is one of retry, backoff, stop, or deregister. Later pairs override earlier
+// pairs for the same status, and codes take precedence over classes.
+func ParseHeartbeatActions(s string) (*HeartbeatActions, error) {
+	actions := &HeartbeatActions{codes: make(map[int]string), classes: make(map[int]string)}
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("heartbeat action '%s' must be a status=action pair", pair)
+		}
+
+		status := strings.ToLower(strings.TrimSpace(parts[0]))
+		action := strings.ToLower(strings.TrimSpace(parts[1]))
+		if !isHeartbeatAction(action) {
+			return nil, fmt.Errorf("unknown heartbeat action '%s', must be one of %s", parts[1], strings.Join(heartbeatActions(), ", "))
+		}
+
+		if class := strings.TrimSuffix(status, "xx"); class != status && len(class) == 1 {
+			code, err := strconv.Atoi(class)
+			if err != nil || code < 1 || code > 5 {
+				return nil, fmt.Errorf("'%s' is not a status class", parts[0])
+			}
+			actions.classes[code] = action
+			continue
+		}
+
+		code, err := strconv.Atoi(status)
+		if err != nil || code < 100 || code > 599 {
+			return nil, fmt.Errorf("'%s' is not a status code or class", parts[0])
+		}
+		actions.codes[code] = action
+	}
+	return actions, nil
+}
+
+func heartbeatActions() []string {
+	return []string{RetryAction, BackoffAction, StopAction, DeregisterAction}
+}
+
+func isHeartbeatAction(action string) bool {
+	for _, name := range heartbeatActions() {
+		if action == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Action returns the action taken on a heartbeat rejected with the status.
+func (a *HeartbeatActions) Action(status int) string {
+	if action, ok := a.codes[status]; ok {
+		return action
+	}
+
+	if action, ok := a.classes[status/100]; ok {
+		return action
+	}
+	return RetryAction
+}
+
+// String returns the status=action pairs ordered by status.
+func (a *HeartbeatActions) String() string {
+	pairs := make([]string, 0, len(a.codes)+len(a.classes))
+	for code, action := range a.codes {
+		pairs = append(pairs, fmt.Sprintf("%d=%s", code, action))
+	}
+
+	for class, action := range a.classes {
+		pairs = append(pairs, fmt.Sprintf("%dxx=%s", class, action))
+	}
+
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+//===========================================================================
+// Rejected Heartbeats
+//===========================================================================
+
+// Takes the action configured for the status of a heartbeat that Kahu
+// rejected. Heartbeats that failed for any other reason, e.g. because Kahu is
+// unreachable, are retried on the schedule.
+func (k *KeKahu) heartbeatRejected(err error) {
+	rejected, ok := err.(*kahu.APIError)
+	if !ok {
+		return
+	}
+
+	actions, err := k.conf().GetHeartbeatActions()
+	if err != nil {
+		k.echan <- heartbeatLog.wrap(err)
+		return
+	}
+
+	switch action := actions.Action(rejected.StatusCode); action {
+	case BackoffAction:
+		backoffs := k.rejects.Backoff(rejected.RetryAfter)
+		heartbeatLog.info("kahu rejected the heartbeat with %s, backing off (%d in a row)", rejected.Status, backoffs)
+	case StopAction, DeregisterAction:
+		if action == DeregisterAction && !k.conf().DryRun {
+			if err := k.identity.Clear(); err != nil {
+				heartbeatLog.warne(err)
+			}
+		}
+
+		reason := fmt.Sprintf("kahu rejected the heartbeat with %s", rejected.Status)
+		if !k.rejects.Stop(action, reason) {
+			return
+		}
+
+		heartbeatLog.error("%s, no heartbeats are sent until the configuration is reloaded (%s)", reason, action)
+		k.runHooks(NewHookEvent(StoppedEvent,
+			"STATUS", strconv.Itoa(rejected.StatusCode),
+			"ACTION", action,
+			"ERROR", rejected.Error(),
+		))
+	}
+}
+
+// HeartbeatsStopped returns the reason that heartbeats were stopped because
+// Kahu rejected them, and an empty string if heartbeats are sent.
+func (k *KeKahu) HeartbeatsStopped() string {
+	stopped, _ := k.rejects.Stopped()
+	return stopped
+}
+
+// Tracks the heartbeats that Kahu rejected, whether the next heartbeats are
+// delayed and whether they are stopped. It is thread-safe.
+type rejections struct {
+	sync.Mutex
+	backoffs   int           // consecutive heartbeats that backed off
+	retryAfter time.Duration // the delay Kahu asked for with the last rejection
+	action     string        // the action heartbeats were stopped by, empty if they are sent
+	reason     string        // why heartbeats were stopped
+	since      time.Time     // when heartbeats were stopped
+}
+
+// Backoff records a heartbeat that backs off, returning the number of
+// consecutive heartbeats that backed off.
+func (r *rejections) Backoff(retryAfter time.Duration) int {
+	r.Lock()
+	defer r.Unlock()
+	r.backoffs++
+	r.retryAfter = retryAfter
+	return r.backoffs
+}
+
+// Delay returns the delay until the next heartbeat, which doubles the delay of
+// the schedule for every consecutive heartbeat that backed off up to the max,
+// unless Kahu asked for a longer delay.
+func (r *rejections) Delay(delay, max time.Duration) time.Duration {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.backoffs == 0 {
+		return delay
+	}
+
+	for i := 0; i < r.backoffs && delay < max; i++ {
+		delay *= 2
+	}
+
+	if delay > max {
+		delay = max
+	}
+
+	if r.retryAfter > delay {
+		delay = r.retryAfter
+	}
+	return delay
+}
+
+// Reset the backoff after a successful heartbeat.
+func (r *rejections) Reset() {
+	r.Lock()
+	defer r.Unlock()
+	r.backoffs = 0
+	r.retryAfter = 0
+}
+
+// Stop sending heartbeats, returning false if they were already stopped.
+func (r *rejections) Stop(action, reason string) bool {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.action != "" {
+		return false
+	}
+
+	r.action, r.reason, r.since = action, reason, time.Now()
+	return true
+}
+
+// Stopped returns why heartbeats were stopped and since when, an empty reason
+// if they are sent.
+func (r *rejections) Stopped() (string, time.Time) {
+	r.Lock()
+	defer r.Unlock()
+	return r.reason, r.since
+}
+
+// Resume sending heartbeats, returning true if they were stopped.
+func (r *rejections) Resume() bool {
+	r.Lock()
+	defer r.Unlock()
+
+	stopped := r.action != ""
+	r.action, r.reason, r.since = "", "", time.Time{}
+	r.backoffs, r.retryAfter = 0, 0
+	return stopped
+}
@@ -0,0 +1,35 @@
+package agent
+
+import (
+	"time"
+
+	"github.com/bbengfort/kekahu/kahu"
+)
+
+// GetRetryPolicy returns the retry policy for the specified endpoint, using
+// the per-endpoint attempts overrides for heartbeats and latency reports.
+func (c *Config) GetRetryPolicy(endpoint string) (*kahu.RetryPolicy, error) {
+	policy := &kahu.RetryPolicy{Attempts: c.RetryAttempts}
+
+	var err error
+	if policy.Delay, err = time.ParseDuration(c.RetryDelay); err != nil {
+		return nil, err
+	}
+
+	if policy.MaxDelay, err = time.ParseDuration(c.RetryMaxDelay); err != nil {
+		return nil, err
+	}
+
+	switch endpoint {
+	case kahu.HeartbeatEndpoint:
+		policy.Attempts = c.HeartbeatAttempts
+	case kahu.LatencyEndpoint:
+		policy.Attempts = c.LatencyAttempts
+	}
+
+	if policy.Attempts < 1 {
+		policy.Attempts = 1
+	}
+
+	return policy, nil
+}
@@ -0,0 +1,290 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+//===========================================================================
+// Heartbeat Schedules
+//===========================================================================
+
+// Schedule determines when the next heartbeat is sent. The interval of the
+// configuration is parsed into a schedule by ParseSchedule.
+type Schedule interface {
+	Next(now time.Time) time.Duration // the delay after now until the next heartbeat
+	String() string                   // the interval the schedule was parsed from
+}
+
+// ParseSchedule parses the heartbeat interval, which is one of:
+//
+//   - a duration, e.g. "2m", heartbeats are sent every interval with jitter
+//   - cron expressions separated by semicolons, e.g. "*/5 * * * *",
+//     heartbeats are sent at every minute matched by one of them
+//   - time window rules separated by semicolons, each a cron expression of
+//     the minutes the window covers followed by an interval, and a default
+//     interval, e.g. "* 9-17 * * mon-fri 1m; 15m", heartbeats are sent every
+//     interval of the first window that covers the time, or of the default
+//
+// The jitter applies to the intervals of durations and time windows but not
+// to cron expressions. Cron expressions are evaluated in the local time zone.
+func ParseSchedule(interval string, jitter time.Duration) (Schedule, error) {
+	if delay, err := time.ParseDuration(strings.TrimSpace(interval)); err == nil {
+		if delay <= 0 {
+			return nil, errors.New("interval must be longer than 0")
+		}
+		return &intervalSchedule{expr: interval, delay: delay, jitter: jitter}, nil
+	}
+
+	// Parse the entries into cron expressions or time windows
+	crons := &cronSchedule{expr: interval}
+	windows := &windowSchedule{expr: interval, jitter: jitter}
+	for _, entry := range strings.Split(interval, ";") {
+		fields := strings.Fields(entry)
+		switch len(fields) {
+		case 0:
+			continue
+		case 1:
+			if windows.fallback != 0 {
+				return nil, fmt.Errorf("interval '%s' has more than one default interval", interval)
+			}
+
+			delay, err := time.ParseDuration(fields[0])
+			if err != nil || delay <= 0 {
+				return nil, fmt.Errorf("interval '%s' has an invalid default interval '%s'", interval, fields[0])
+			}
+			windows.fallback = delay
+		case 5:
+			cron, err := parseCronExpr(entry)
+			if err != nil {
+				return nil, fmt.Errorf("interval '%s': %s", strings.TrimSpace(entry), err)
+			}
+
+			if _, ok := cron.next(time.Now()); !ok {
+				return nil, fmt.Errorf("interval '%s' never matches", strings.TrimSpace(entry))
+			}
+			crons.times = append(crons.times, cron)
+		case 6:
+			cron, err := parseCronExpr(strings.Join(fields[:5], " "))
+			if err != nil {
+				return nil, fmt.Errorf("interval '%s': %s", strings.TrimSpace(entry), err)
+			}
+
+			delay, err := time.ParseDuration(fields[5])
+			if err != nil || delay <= 0 {
+				return nil, fmt.Errorf("interval '%s' has an invalid interval '%s'", strings.TrimSpace(entry), fields[5])
+			}
+			windows.rules = append(windows.rules, &windowRule{cover: cron, delay: delay})
+		default:
+			return nil, fmt.Errorf("interval '%s' must be a duration, a cron expression, or a cron expression and a duration", strings.TrimSpace(entry))
+		}
+	}
+
+	switch {
+	case len(crons.times) > 0 && (len(windows.rules) > 0 || windows.fallback != 0):
+		return nil, fmt.Errorf("interval '%s' cannot mix cron expressions and time windows", interval)
+	case len(crons.times) > 0:
+		return crons, nil
+	case len(windows.rules) == 0:
+		return nil, fmt.Errorf("invalid interval '%s'", interval)
+	case windows.fallback == 0:
+		return nil, fmt.Errorf("interval '%s' must have a default interval, e.g. '%s; 15m'", interval, strings.TrimSpace(interval))
+	default:
+		return windows, nil
+	}
+}
+
+// GetInterval parses the interval duration and returns it, it returns an
+// error if the interval is cron expressions or time windows rather than a
+// duration, use GetSchedule to parse those.
+func (c *Config) GetInterval() (time.Duration, error) {
+	delay, err := time.ParseDuration(strings.TrimSpace(c.Interval))
+	if err != nil {
+		if _, err = ParseSchedule(c.Interval, 0); err != nil {
+			return 0, err
+		}
+		return 0, fmt.Errorf("interval '%s' is a schedule, not a duration", c.Interval)
+	}
+	return delay, nil
+}
+
+// Heartbeats are sent every interval with jitter.
+type intervalSchedule struct {
+	expr   string
+	delay  time.Duration
+	jitter time.Duration
+}
+
+func (s *intervalSchedule) Next(now time.Time) time.Duration {
+	return jitterDelay(s.delay, s.jitter)
+}
+
+func (s *intervalSchedule) String() string {
+	return s.expr
+}
+
+// Heartbeats are sent at the minutes matched by any of the cron expressions.
+type cronSchedule struct {
+	expr  string
+	times []*cronExpr
+}
+
+func (s *cronSchedule) Next(now time.Time) time.Duration {
+	var next time.Time
+	for _, cron := range s.times {
+		if t, ok := cron.next(now); ok && (next.IsZero() || t.Before(next)) {
+			next = t
+		}
+	}
+
+	// The expressions are checked when they are parsed, but guard against
+	// the schedule stalling, e.g. if the clock jumps
+	if next.IsZero() {
+		return time.Hour
+	}
+	return next.Sub(now)
+}
+
+func (s *cronSchedule) String() string {
+	return s.expr
+}
+
+// Heartbeats are sent every interval of the first time window that covers
+// the time, or of the default interval if none do.
+type windowSchedule struct {
+	expr     string
+	rules    []*windowRule
+	fallback time.Duration
+	jitter   time.Duration
+}
+
+// A time window that covers the minutes matched by the cron expression.
+type windowRule struct {
+	cover *cronExpr
+	delay time.Duration
+}
+
+// Returns the interval at the time, which is shortened if the interval changes
+// before it elapses so that e.g. the first heartbeat of business hours is not
+// delayed by the slower interval of the night.
+func (s *windowSchedule) Next(now time.Time) time.Duration {
+	current := s.interval(now)
+	delay := jitterDelay(current, s.jitter)
+
+	for t := now.Truncate(time.Minute).Add(time.Minute); t.Sub(now) < delay; t = t.Add(time.Minute) {
+		if s.interval(t) != current {
+			return t.Sub(now)
+		}
+	}
+	return delay
+}
+
+func (s *windowSchedule) String() string {
+	return s.expr
+}
+
+// Returns the interval of the first window that covers the time.
+func (s *windowSchedule) interval(t time.Time) time.Duration {
+	for _, rule := range s.rules {
+		if rule.cover.matches(t) {
+			return rule.delay
+		}
+	}
+	return s.fallback
+}
+
+// Returns a random delay within the jitter before or after the delay, so that
+// not all replicas report in at the exact same time. There is no jitter if it
+// is not positive.
+func jitterDelay(delay, jitter time.Duration) time.Duration {
+	if jitter <= 0 {
+		return delay
+	}
+
+	// Compute the range for selecting a duration
+	minv := int64(delay) - int64(jitter)
+	maxv := int64(delay) + int64(jitter)
+
+	// If the floor of the range is zero, then make the floor the delay
+	if minv <= 0 {
+		minv = int64(delay)
+	}
+
+	// Return the duration
+	return time.Duration(rand.Int63n(maxv-minv) + minv)
+}
+
+//===========================================================================
+// Heartbeat Scheduler
+//===========================================================================
+
+// Runs the heartbeats on the schedule, which is replaced when the
+// configuration is reloaded. The scheduler is thread-safe.
+type scheduler struct {
+	sync.Mutex
+	schedule Schedule
+	reset    chan struct{}
+}
+
+func newScheduler() *scheduler {
+	return &scheduler{reset: make(chan struct{}, 1)}
+}
+
+// Set the schedule, rescheduling the next heartbeat if the schedule changed so
+// that the delay of the old schedule does not apply.
+func (s *scheduler) Set(schedule Schedule) {
+	s.Lock()
+	changed := s.schedule != nil && s.schedule.String() != schedule.String()
+	s.schedule = schedule
+	s.Unlock()
+
+	if changed {
+		select {
+		case s.reset <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Next returns the delay after now until the next heartbeat.
+func (s *scheduler) Next(now time.Time) time.Duration {
+	s.Lock()
+	defer s.Unlock()
+	return s.schedule.Next(now)
+}
+
+// RunHeartbeats sends a heartbeat and then sends the next heartbeats on the
+// schedule until the context is canceled. The next heartbeat is rescheduled
+// immediately if the schedule changes when the configuration is reloaded, and
+// delayed while Kahu rejects the heartbeats with a status that backs off.
+func (k *KeKahu) RunHeartbeats(ctx context.Context) {
+	k.Heartbeat(ctx)
+
+	for {
+		// Back off from the schedule while Kahu rejects the heartbeats
+		now := time.Now()
+		delay := k.sched.Next(now)
+		if max, err := k.conf().GetHeartbeatBackoff(); err == nil {
+			delay = k.rejects.Delay(delay, max)
+		}
+		k.state.NextHeartbeat(now.Add(delay))
+		heartbeatLog.trace("next heartbeat in %s", delay)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-k.sched.reset:
+			timer.Stop()
+			heartbeatLog.info("heartbeat schedule changed, rescheduling the next heartbeat")
+		case <-timer.C:
+			k.Heartbeat(ctx)
+		}
+	}
+}
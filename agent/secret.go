@@ -0,0 +1,250 @@
+package agent
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+//===========================================================================
+// API Key Secrets
+//===========================================================================
+
+// Prefixes of api_key values that refer to a secret rather than being the API
+// key itself, so that the API key is not stored in plaintext in the config.
+const (
+	KeychainPrefix  = "keychain:" // the API key is stored in the OS keychain
+	EncryptedPrefix = "enc:"      // the API key is encrypted with a passphrase
+)
+
+// DefaultKeychainAccount is the account the API key is stored under in the OS
+// keychain if api_key is "keychain:" without an account.
+const DefaultKeychainAccount = "api_key"
+
+// Parameters of the encryption of the API key: the key is derived from the
+// passphrase with PBKDF2-SHA256 and a random salt and the API key is sealed
+// with AES-256-GCM.
+const (
+	secretVersion    = 1
+	secretSaltSize   = 16
+	secretKeySize    = 32
+	secretIterations = 200000
+)
+
+// ErrNoPassphrase is returned if the API key is encrypted but neither the
+// passphrase nor a command that prints it is configured.
+var ErrNoPassphrase = errors.New("no passphrase for the encrypted api key: set key_passphrase (KEKAHU_KEY_PASSPHRASE) or key_pass_command")
+
+// ResolveAPIKey replaces an api_key that refers to the OS keychain or that is
+// encrypted with the API key itself. Plaintext API keys are left unchanged.
+// The service resolves the API key once when its configuration is loaded, so
+// printing the configuration shows the reference rather than the secret.
+func (c *Config) ResolveAPIKey() error {
+	switch {
+	case strings.HasPrefix(c.APIKey, KeychainPrefix):
+		account := strings.TrimPrefix(c.APIKey, KeychainPrefix)
+		if account == "" {
+			account = DefaultKeychainAccount
+		}
+
+		key, err := ReadKeychain(account)
+		if err != nil {
+			return err
+		}
+		c.APIKey = key
+
+	case strings.HasPrefix(c.APIKey, EncryptedPrefix):
+		passphrase, err := c.GetKeyPassphrase()
+		if err != nil {
+			return err
+		}
+
+		key, err := DecryptSecret(c.APIKey, passphrase)
+		if err != nil {
+			return err
+		}
+		c.APIKey = key
+	}
+	return nil
+}
+
+// GetKeyPassphrase returns the passphrase that decrypts the API key, printed
+// by the key_pass_command if configured (e.g. a command that decrypts it with
+// a cloud KMS) or from key_passphrase otherwise.
+func (c *Config) GetKeyPassphrase() (string, error) {
+	if c.KeyPassCommand != "" {
+		args := strings.Fields(c.KeyPassCommand)
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+
+		out, err := exec.CommandContext(ctx, args[0], args[1:]...).Output()
+		if err != nil {
+			return "", fmt.Errorf("key_pass_command failed: %s", err)
+		}
+
+		passphrase := strings.TrimRight(string(out), "\r\n")
+		if passphrase == "" {
+			return "", errors.New("key_pass_command did not print a passphrase")
+		}
+		return passphrase, nil
+	}
+
+	if c.KeyPassphrase == "" {
+		return "", ErrNoPassphrase
+	}
+	return c.KeyPassphrase, nil
+}
+
+// EncryptSecret encrypts the secret with the passphrase, returning the value
+// to store as the api_key, prefixed with EncryptedPrefix.
+func EncryptSecret(secret, passphrase string) (string, error) {
+	if passphrase == "" {
+		return "", ErrNoPassphrase
+	}
+
+	salt := make([]byte, secretSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	aead, err := secretCipher(passphrase, salt)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	// The version and salt are authenticated along with the secret
+	header := append([]byte{secretVersion}, salt...)
+	sealed := aead.Seal(nil, nonce, []byte(secret), header)
+
+	data := append(append(header, nonce...), sealed...)
+	return EncryptedPrefix + base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// DecryptSecret decrypts a value returned by EncryptSecret with the passphrase.
+func DecryptSecret(value, passphrase string) (string, error) {
+	data, err := parseSecret(value)
+	if err != nil {
+		return "", err
+	}
+
+	header := data[:1+secretSaltSize]
+	aead, err := secretCipher(passphrase, header[1:])
+	if err != nil {
+		return "", err
+	}
+
+	data = data[len(header):]
+	if len(data) < aead.NonceSize()+aead.Overhead() {
+		return "", errors.New("encrypted api key is truncated")
+	}
+
+	nonce, sealed := data[:aead.NonceSize()], data[aead.NonceSize():]
+	secret, err := aead.Open(nil, nonce, sealed, header)
+	if err != nil {
+		return "", errors.New("could not decrypt the api key: wrong passphrase or corrupted value")
+	}
+	return string(secret), nil
+}
+
+// Decodes the encrypted value and checks its version, without decrypting it.
+func parseSecret(value string) ([]byte, error) {
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(value, EncryptedPrefix))
+	if err != nil {
+		return nil, fmt.Errorf("could not decode encrypted api key: %s", err)
+	}
+
+	if len(data) < 1+secretSaltSize {
+		return nil, errors.New("encrypted api key is truncated")
+	}
+
+	if data[0] != secretVersion {
+		return nil, fmt.Errorf("unknown encrypted api key version %d", data[0])
+	}
+	return data, nil
+}
+
+// Returns the AES-GCM cipher keyed by the passphrase and salt.
+func secretCipher(passphrase string, salt []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(pbkdf2.Key([]byte(passphrase), salt, secretIterations, secretKeySize, sha256.New))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// ReadKeychain returns the API key stored under the account in the OS keychain.
+func ReadKeychain(account string) (string, error) {
+	if keychainName == "" {
+		return "", errNoKeychain
+	}
+
+	key, err := keychainGet(account)
+	if err != nil {
+		return "", fmt.Errorf("could not read the api key from the %s: %s", keychainName, err)
+	}
+
+	if key == "" {
+		return "", fmt.Errorf("no api key stored in the %s for %s", keychainName, account)
+	}
+	return key, nil
+}
+
+// StoreKeychain stores the API key under the account in the OS keychain,
+// replacing the key that is stored under the account.
+func StoreKeychain(account, key string) error {
+	if keychainName == "" {
+		return errNoKeychain
+	}
+
+	if err := keychainSet(account, key); err != nil {
+		return fmt.Errorf("could not store the api key in the %s: %s", keychainName, err)
+	}
+	return nil
+}
+
+// KeychainName returns the name of the OS keychain, or an empty string if
+// there is no supported keychain on the platform.
+func KeychainName() string {
+	return keychainName
+}
+
+// Returned on platforms without a supported keychain.
+var errNoKeychain = errors.New("no supported keychain on this platform, encrypt the api key instead")
+
+// Returns the name the API key is stored under in the keychain.
+func keychainService(account string) string {
+	return ServiceLabel + ":" + account
+}
+
+// Runs the keychain command, returning its trimmed output and including its
+// error output in the error.
+func runKeychain(stdin string, name string, args ...string) (string, error) {
+	cmd := exec.Command(name, args...)
+	if stdin != "" {
+		cmd.Stdin = strings.NewReader(stdin)
+	}
+
+	out, err := cmd.Output()
+	if err != nil {
+		if exit, ok := err.(*exec.ExitError); ok && len(exit.Stderr) > 0 {
+			return "", errors.New(strings.TrimSpace(string(exit.Stderr)))
+		}
+		return "", err
+	}
+	return strings.TrimRight(string(out), "\r\n"), nil
+}
@@ -0,0 +1,131 @@
+package agent
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bbengfort/kekahu/kahu"
+)
+
+// Strategies to select the neighbors that are pinged in each latency cycle.
+const (
+	AllTargets        = "all"         // every neighbor is pinged every cycle
+	RandomTargets     = "random"      // a random subset of target_count neighbors each cycle
+	HashTargets       = "hash"        // a consistent subset of target_count neighbors, rotated every target_rotation
+	RoundRobinTargets = "round-robin" // the next target_count neighbors in order each cycle
+)
+
+// TargetSelections returns the names of the target selection strategies.
+func TargetSelections() []string {
+	return []string{AllTargets, RandomTargets, HashTargets, RoundRobinTargets}
+}
+
+// Selects the subset of the neighbors to ping in each latency cycle so that
+// hosts in large fleets ping a bounded number of targets per cycle while all
+// of the neighbors are measured over time. The picker is thread-safe.
+type targetPicker struct {
+	sync.Mutex
+	cursor int        // the index of the next target for round robin
+	rand   *rand.Rand // the source of random subsets
+}
+
+// Select returns at most n of the targets with the strategy. All targets are
+// returned if n is zero or there are no more than n targets. The epoch is
+// only used by the hash strategy, which selects the same subset for the same
+// epoch and a different subset when the epoch changes.
+func (s *targetPicker) Select(strategy, source string, targets []*kahu.Neighbor, n int, epoch int64) ([]*kahu.Neighbor, error) {
+	strategy = strings.ToLower(strategy)
+	if strategy == "" || strategy == AllTargets || n <= 0 || len(targets) <= n {
+		return targets, nil
+	}
+
+	// Order the targets by name so that selections do not depend on the order
+	// the neighbors were returned in.
+	sorted := make([]*kahu.Neighbor, len(targets))
+	copy(sorted, targets)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Hostname < sorted[j].Hostname })
+
+	switch strategy {
+	case RandomTargets:
+		return s.random(sorted, n), nil
+	case HashTargets:
+		return hashTargets(source, sorted, n, epoch), nil
+	case RoundRobinTargets:
+		return s.roundRobin(sorted, n), nil
+	default:
+		return nil, fmt.Errorf("unknown target selection '%s', must be one of %s", strategy, strings.Join(TargetSelections(), ", "))
+	}
+}
+
+// Returns a random subset of n of the targets.
+func (s *targetPicker) random(targets []*kahu.Neighbor, n int) []*kahu.Neighbor {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.rand == nil {
+		s.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+
+	selected := make([]*kahu.Neighbor, 0, n)
+	for _, idx := range s.rand.Perm(len(targets))[:n] {
+		selected = append(selected, targets[idx])
+	}
+	return selected
+}
+
+// Returns the next n targets after the targets returned by the last call,
+// wrapping around to the first target. If neighbors join or leave, some
+// targets may be skipped or repeated in the cycle the membership changes.
+func (s *targetPicker) roundRobin(targets []*kahu.Neighbor, n int) []*kahu.Neighbor {
+	s.Lock()
+	defer s.Unlock()
+
+	selected := make([]*kahu.Neighbor, 0, n)
+	for i := 0; i < n; i++ {
+		selected = append(selected, targets[(s.cursor+i)%len(targets)])
+	}
+	s.cursor = (s.cursor + n) % len(targets)
+	return selected
+}
+
+// Returns the n targets with the highest rendezvous hash of the source, the
+// target, and the epoch. The subset is stable while the epoch is the same, and
+// when neighbors join or leave only the targets that hash near them change.
+func hashTargets(source string, targets []*kahu.Neighbor, n int, epoch int64) []*kahu.Neighbor {
+	weights := make(map[*kahu.Neighbor]uint64, len(targets))
+	for _, target := range targets {
+		h := fnv.New64a()
+		fmt.Fprintf(h, "%s\x00%s\x00%d", source, target.Hostname, epoch)
+		weights[target] = h.Sum64()
+	}
+
+	ranked := make([]*kahu.Neighbor, len(targets))
+	copy(ranked, targets)
+	sort.SliceStable(ranked, func(i, j int) bool { return weights[ranked[i]] > weights[ranked[j]] })
+	return ranked[:n]
+}
+
+// Selects the neighbors to ping in this latency cycle with the configured
+// target selection strategy, logging how many of the neighbors were selected.
+func (k *KeKahu) selectTargets(source string, targets []*kahu.Neighbor) []*kahu.Neighbor {
+	var epoch int64
+	if rotation, err := k.conf().GetTargetRotation(); err == nil && rotation > 0 {
+		epoch = time.Now().UnixNano() / int64(rotation)
+	}
+
+	selected, err := k.picker.Select(k.conf().TargetSelection, source, targets, k.conf().TargetCount, epoch)
+	if err != nil {
+		k.echan <- pingLog.wrap(err)
+		return targets
+	}
+
+	if len(selected) < len(targets) {
+		pingLog.debug("pinging %d of %d neighbors selected by %s", len(selected), len(targets), k.conf().TargetSelection)
+	}
+	return selected
+}
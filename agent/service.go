@@ -0,0 +1,229 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/joho/godotenv"
+)
+
+// Names the service is installed under.
+const (
+	ServiceName  = "kekahu"              // the systemd unit and Windows service name
+	ServiceLabel = "com.bengfort.kekahu" // the launchd label
+	EnvFileName  = "kekahu.env"          // the environment file with the API key
+)
+
+// ServiceConfig describes the service that kekahu install registers with the
+// service manager of the platform: a systemd unit on Linux, a launchd plist
+// on macOS, and a service registered with the service control manager on
+// Windows (a scheduled task that starts at logon for the user). The API key
+// and other environment variables are kept in an environment file that only
+// its owner can read rather than in the service definition.
+type ServiceConfig struct {
+	Binary  string            // absolute path of the kekahu binary the service runs
+	EnvFile string            // environment file the service loads the API key from
+	Env     map[string]string // variables to add to the environment file, e.g. KEKAHU_API_KEY
+	User    bool              // run as the current user rather than system-wide
+}
+
+// NewServiceConfig returns the service configuration for the running binary
+// with the default environment file of the platform, for the current user or
+// system-wide.
+func NewServiceConfig(user bool) (*ServiceConfig, error) {
+	binary, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("could not find the kekahu binary: %s", err)
+	}
+
+	if binary, err = filepath.Abs(binary); err != nil {
+		return nil, fmt.Errorf("could not find the kekahu binary: %s", err)
+	}
+
+	return &ServiceConfig{
+		Binary: binary, EnvFile: defaultEnvFile(user), Env: make(map[string]string), User: user,
+	}, nil
+}
+
+// Manager returns the name of the service manager of the platform, or an
+// empty string if services can't be installed on the platform.
+func (s *ServiceConfig) Manager() string {
+	return serviceManager
+}
+
+// Path returns the path of the service definition, or an empty string if the
+// service manager keeps the definition itself.
+func (s *ServiceConfig) Path() string {
+	return servicePath(s.User)
+}
+
+// Render returns the service definition, or the command that registers the
+// service if the service manager keeps the definition itself.
+func (s *ServiceConfig) Render() ([]byte, error) {
+	if serviceManager == "" {
+		return nil, errUnsupportedService
+	}
+	return renderService(s)
+}
+
+// HasAPIKey returns true if the API key is added to the environment file or
+// is already in it.
+func (s *ServiceConfig) HasAPIKey() bool {
+	if s.Env["KEKAHU_API_KEY"] != "" {
+		return true
+	}
+
+	env, err := godotenv.Read(s.EnvFile)
+	return err == nil && env["KEKAHU_API_KEY"] != ""
+}
+
+// Install writes the environment file and the service definition, then
+// enables the service so that it starts at boot (or login) and starts it.
+func (s *ServiceConfig) Install() error {
+	if serviceManager == "" {
+		return errUnsupportedService
+	}
+
+	if err := s.writeEnvFile(); err != nil {
+		return err
+	}
+
+	if path := s.Path(); path != "" {
+		data, err := s.Render()
+		if err != nil {
+			return err
+		}
+
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return fmt.Errorf("could not create %s: %s", filepath.Dir(path), err)
+		}
+
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			return fmt.Errorf("could not write service definition: %s", err)
+		}
+	}
+	return enableService(s)
+}
+
+// Uninstall stops and disables the service and removes its definition. The
+// environment file is only removed if purge is true, so that the API key is
+// kept if the service is installed again.
+func (s *ServiceConfig) Uninstall(purge bool) error {
+	if serviceManager == "" {
+		return errUnsupportedService
+	}
+
+	if path := s.Path(); path != "" {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return fmt.Errorf("kekahu service is not installed at %s", path)
+		}
+	}
+
+	if err := disableService(s); err != nil {
+		return err
+	}
+
+	if path := s.Path(); path != "" {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("could not remove service definition: %s", err)
+		}
+
+		if err := reloadManager(s); err != nil {
+			return err
+		}
+	}
+
+	if purge {
+		if err := os.Remove(s.EnvFile); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("could not remove environment file: %s", err)
+		}
+	}
+	return nil
+}
+
+// Adds the variables to the environment file, keeping the variables that are
+// already in it, and makes it readable only by its owner.
+func (s *ServiceConfig) writeEnvFile() error {
+	env, err := godotenv.Read(s.EnvFile)
+	if err != nil {
+		if _, serr := os.Stat(s.EnvFile); serr == nil {
+			return fmt.Errorf("could not read environment file: %s", err)
+		}
+		env = make(map[string]string)
+	}
+
+	for key, value := range s.Env {
+		if value != "" {
+			env[key] = value
+		}
+	}
+
+	data, err := godotenv.Marshal(env)
+	if err != nil {
+		return fmt.Errorf("could not write environment file: %s", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.EnvFile), 0700); err != nil {
+		return fmt.Errorf("could not create %s: %s", filepath.Dir(s.EnvFile), err)
+	}
+
+	if err := ioutil.WriteFile(s.EnvFile, []byte(data+"\n"), 0600); err != nil {
+		return fmt.Errorf("could not write environment file: %s", err)
+	}
+
+	// The file may have existed with wider permissions
+	return os.Chmod(s.EnvFile, 0600)
+}
+
+// Returned on platforms without a supported service manager.
+var errUnsupportedService = errors.New("kekahu can't be installed as a service on this platform")
+
+// Functions available to the service definition templates.
+var serviceFuncs = template.FuncMap{
+	"xml": func(s string) string {
+		buf := new(bytes.Buffer)
+		xml.EscapeText(buf, []byte(s))
+		return buf.String()
+	},
+	"quote": func(s string) string {
+		if strings.ContainsAny(s, " \t\"\\") {
+			return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+		}
+		return s
+	},
+}
+
+// Renders the service definition template with the service configuration or
+// with a struct that embeds it.
+func renderTemplate(text string, data interface{}) ([]byte, error) {
+	tmpl, err := template.New(ServiceName).Funcs(serviceFuncs).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := new(bytes.Buffer)
+	if err := tmpl.Execute(buf, data); err != nil {
+		return nil, fmt.Errorf("could not render service definition: %s", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// Runs the command of the service manager, including its output in the error.
+func runManager(name string, args ...string) error {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			return fmt.Errorf("%s %s failed: %s", name, strings.Join(args, " "), msg)
+		}
+		return fmt.Errorf("%s %s failed: %s", name, strings.Join(args, " "), err)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package agent
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+)
+
+// Services are managed by launchd on macOS.
+const serviceManager = "launchd"
+
+// The launchd plist, launchd can't load environment files so kekahu loads it
+// with --env-file. The service is restarted unless it exits cleanly, e.g.
+// with kekahu stop.
+const launchdPlist = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+    <key>Label</key>
+    <string>{{ xml .Label }}</string>
+
+    <key>ProgramArguments</key>
+    <array>
+        <string>{{ xml .Binary }}</string>
+        <string>--env-file</string>
+        <string>{{ xml .EnvFile }}</string>
+        <string>run</string>
+    </array>
+
+    <key>RunAtLoad</key>
+    <true/>
+
+    <key>KeepAlive</key>
+    <dict>
+        <key>SuccessfulExit</key>
+        <false/>
+    </dict>
+
+    <key>StandardOutPath</key>
+    <string>{{ xml .LogPath }}</string>
+
+    <key>StandardErrorPath</key>
+    <string>{{ xml .LogPath }}</string>
+</dict>
+</plist>
+`
+
+// Returns the path of the launchd plist, a launch agent if user is true or a
+// launch daemon otherwise.
+func servicePath(user bool) string {
+	if user {
+		return filepath.Join(homeDir(), "Library", "LaunchAgents", ServiceLabel+".plist")
+	}
+	return filepath.Join("/Library", "LaunchDaemons", ServiceLabel+".plist")
+}
+
+// Returns the default environment file, in the user's application support
+// directory if user is true.
+func defaultEnvFile(user bool) string {
+	if user {
+		return filepath.Join(homeDir(), "Library", "Application Support", "kekahu", EnvFileName)
+	}
+	return filepath.Join("/Library", "Application Support", "kekahu", EnvFileName)
+}
+
+func renderService(s *ServiceConfig) ([]byte, error) {
+	logs := filepath.Join("/Library", "Logs", "kekahu.log")
+	if s.User {
+		logs = filepath.Join(homeDir(), "Library", "Logs", "kekahu.log")
+	}
+
+	return renderTemplate(launchdPlist, &struct {
+		*ServiceConfig
+		Label   string
+		LogPath string
+	}{s, ServiceLabel, logs})
+}
+
+// Loads the plist, which starts the service and enables it at boot (or login).
+func enableService(s *ServiceConfig) error {
+	return runManager("launchctl", "load", "-w", s.Path())
+}
+
+// Unloads the plist, which stops the service and disables it.
+func disableService(s *ServiceConfig) error {
+	return runManager("launchctl", "unload", "-w", s.Path())
+}
+
+// Launchd doesn't need to be reloaded once the plist is removed.
+func reloadManager(s *ServiceConfig) error {
+	return nil
+}
+
+// Returns the home directory of the current user.
+func homeDir() string {
+	if u, err := user.Current(); err == nil && u.HomeDir != "" {
+		return u.HomeDir
+	}
+	return os.Getenv("HOME")
+}
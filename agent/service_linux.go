@@ -0,0 +1,107 @@
+package agent
+
+import (
+	"errors"
+	"os"
+	"os/user"
+	"path/filepath"
+)
+
+// Services are managed by systemd on Linux.
+const serviceManager = "systemd"
+
+// The systemd unit, the environment file is optional so that the service
+// still runs local-only if it was removed.
+const systemdUnit = `[Unit]
+Description=KeKahu Service
+Documentation=https://github.com/bbengfort/kekahu
+Wants=network-online.target
+After=network-online.target
+
+[Service]
+Type=simple
+EnvironmentFile=-{{ .EnvFile }}
+ExecStart={{ quote .Binary }} run
+ExecReload=/bin/kill -HUP $MAINPID
+Restart=on-failure
+RestartSec=10
+
+[Install]
+WantedBy={{ if .User }}default.target{{ else }}multi-user.target{{ end }}
+`
+
+// Returns the path of the systemd unit, in the user's systemd directory if
+// user is true.
+func servicePath(user bool) string {
+	if user {
+		return filepath.Join(userConfigDir(), "systemd", "user", ServiceName+".service")
+	}
+	return filepath.Join("/etc", "systemd", "system", ServiceName+".service")
+}
+
+// Returns the default environment file, in the user's config directory if
+// user is true.
+func defaultEnvFile(user bool) string {
+	if user {
+		return filepath.Join(userConfigDir(), "kekahu", EnvFileName)
+	}
+	return filepath.Join("/etc", "kekahu", EnvFileName)
+}
+
+func renderService(s *ServiceConfig) ([]byte, error) {
+	return renderTemplate(systemdUnit, s)
+}
+
+// Reloads the units and enables and starts the service.
+func enableService(s *ServiceConfig) error {
+	if err := checkSystemd(); err != nil {
+		return err
+	}
+
+	if err := runManager("systemctl", systemctlArgs(s, "daemon-reload")...); err != nil {
+		return err
+	}
+	return runManager("systemctl", systemctlArgs(s, "enable", "--now", ServiceName+".service")...)
+}
+
+// Stops and disables the service.
+func disableService(s *ServiceConfig) error {
+	if err := checkSystemd(); err != nil {
+		return err
+	}
+	return runManager("systemctl", systemctlArgs(s, "disable", "--now", ServiceName+".service")...)
+}
+
+// Reloads the units once the unit file is removed.
+func reloadManager(s *ServiceConfig) error {
+	return runManager("systemctl", systemctlArgs(s, "daemon-reload")...)
+}
+
+// Returns an error if the host isn't running systemd, e.g. in a container.
+func checkSystemd() error {
+	if _, err := os.Stat("/run/systemd/system"); err != nil {
+		return errors.New("systemd is not running on this host")
+	}
+	return nil
+}
+
+// Returns the arguments of systemctl for the system or user service manager.
+func systemctlArgs(s *ServiceConfig, args ...string) []string {
+	if s.User {
+		return append([]string{"--user"}, args...)
+	}
+	return args
+}
+
+// Returns $XDG_CONFIG_HOME or ~/.config.
+func userConfigDir() string {
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" && filepath.IsAbs(dir) {
+		return dir
+	}
+
+	home := os.TempDir()
+	if u, err := user.Current(); err == nil && u.HomeDir != "" {
+		home = u.HomeDir
+	}
+	return filepath.Join(home, ".config")
+}
@@ -0,0 +1,31 @@
+//go:build !linux && !darwin && !windows
+// +build !linux,!darwin,!windows
+
+package agent
+
+// There is no supported service manager on this platform.
+const serviceManager = ""
+
+func servicePath(user bool) string {
+	return ""
+}
+
+func defaultEnvFile(user bool) string {
+	return ""
+}
+
+func renderService(s *ServiceConfig) ([]byte, error) {
+	return nil, errUnsupportedService
+}
+
+func enableService(s *ServiceConfig) error {
+	return errUnsupportedService
+}
+
+func disableService(s *ServiceConfig) error {
+	return errUnsupportedService
+}
+
+func reloadManager(s *ServiceConfig) error {
+	return nil
+}
@@ -0,0 +1,148 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Services are registered with the service control manager on Windows, which
+// starts kekahu run at boot as the system account and restarts it if it fails
+// (kekahu run implements the service control protocol, see servicectl_windows.go).
+// Services installed for the current user are scheduled tasks that start at
+// logon instead, since a service can only run as a user with their password.
+const serviceManager = "sc.exe"
+
+// Service descriptions shown by the service control manager.
+const (
+	serviceDisplayName = "KeKahu"
+	serviceDescription = "Sends heartbeats and latency measurements to the Kahu service"
+)
+
+// The service control manager keeps the definition so there is no file to write.
+func servicePath(user bool) string {
+	return ""
+}
+
+// Returns the default environment file, in the user's local application data
+// directory if user is true or in the program data directory otherwise.
+func defaultEnvFile(user bool) string {
+	dir := os.Getenv("ProgramData")
+	if user {
+		dir = os.Getenv("LOCALAPPDATA")
+	}
+
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "kekahu", EnvFileName)
+}
+
+// Returns the sc.exe (or schtasks) commands that register the service.
+func renderService(s *ServiceConfig) ([]byte, error) {
+	if s.User {
+		return []byte(commandLine("schtasks", schtasksCreate(s)) + "\n"), nil
+	}
+
+	lines := []string{commandLine("sc.exe", scCreate(s, "create"))}
+	for _, args := range scConfigure() {
+		lines = append(lines, commandLine("sc.exe", args))
+	}
+	return []byte(strings.Join(lines, "\n") + "\n"), nil
+}
+
+// Registers the service and starts it, updating the service if it is already
+// registered. A service that is already running keeps running the old
+// configuration until it is restarted.
+func enableService(s *ServiceConfig) error {
+	if s.User {
+		if err := runManager("schtasks", schtasksCreate(s)...); err != nil {
+			return err
+		}
+		return runManager("schtasks", "/Run", "/TN", ServiceName)
+	}
+
+	command := "create"
+	if runManager("sc.exe", "query", ServiceName) == nil {
+		command = "config"
+	}
+
+	if err := runManager("sc.exe", scCreate(s, command)...); err != nil {
+		return err
+	}
+
+	for _, args := range scConfigure() {
+		if err := runManager("sc.exe", args...); err != nil {
+			return err
+		}
+	}
+
+	// ERROR_SERVICE_ALREADY_RUNNING
+	if err := runManager("sc.exe", "start", ServiceName); err != nil && !strings.Contains(err.Error(), "1056") {
+		return err
+	}
+	return nil
+}
+
+// Stops the service if it is running and deletes it.
+func disableService(s *ServiceConfig) error {
+	if s.User {
+		// The task may not be running
+		runManager("schtasks", "/End", "/TN", ServiceName)
+		return runManager("schtasks", "/Delete", "/TN", ServiceName, "/F")
+	}
+
+	// The service may not be running
+	runManager("sc.exe", "stop", ServiceName)
+	return runManager("sc.exe", "delete", ServiceName)
+}
+
+// The service control manager doesn't need to be reloaded once the service
+// is deleted.
+func reloadManager(s *ServiceConfig) error {
+	return nil
+}
+
+// Returns the arguments of sc.exe that create (or config) the service, which
+// runs kekahu as the system account and starts automatically at boot.
+func scCreate(s *ServiceConfig, command string) []string {
+	return []string{
+		command, ServiceName, "binPath=", runCommand(s), "start=", "auto",
+		"obj=", "LocalSystem", "DisplayName=", serviceDisplayName,
+	}
+}
+
+// Returns the arguments of sc.exe that describe the service and restart it
+// when it fails, including when it stops without being asked to, e.g. to run
+// a release installed by auto_update.
+func scConfigure() [][]string {
+	return [][]string{
+		{"description", ServiceName, serviceDescription},
+		{"failure", ServiceName, "reset=", "86400", "actions=", "restart/5000/restart/30000/restart/60000"},
+		{"failureflag", ServiceName, "1"},
+	}
+}
+
+// Returns the arguments of schtasks that create the task, which runs as the
+// current user at logon.
+func schtasksCreate(s *ServiceConfig) []string {
+	return []string{"/Create", "/TN", ServiceName, "/TR", runCommand(s), "/SC", "ONLOGON", "/F"}
+}
+
+// Returns the command line that runs the service with its environment file.
+func runCommand(s *ServiceConfig) string {
+	return `"` + s.Binary + `" --env-file "` + s.EnvFile + `" run`
+}
+
+// Returns the command with its arguments quoted as needed to print it.
+func commandLine(name string, args []string) string {
+	quoted := make([]string, 0, len(args)+1)
+	quoted = append(quoted, name)
+	for _, arg := range args {
+		if strings.ContainsAny(arg, " \t\"") {
+			arg = `"` + strings.Replace(arg, `"`, `\"`, -1) + `"`
+		}
+		quoted = append(quoted, arg)
+	}
+	return strings.Join(quoted, " ")
+}
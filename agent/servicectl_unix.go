@@ -0,0 +1,7 @@
+//go:build !windows
+// +build !windows
+
+package agent
+
+// Services are stopped with signals outside of Windows, see signalHandler.
+func serviceControl(stop func() error, stopped <-chan struct{}) {}
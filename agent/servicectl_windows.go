@@ -0,0 +1,159 @@
+//go:build windows
+// +build windows
+
+package agent
+
+import (
+	"runtime"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// Constants of the service control protocol, see winsvc.h.
+const (
+	serviceWin32OwnProcess = 0x10
+
+	serviceStopped     = 1
+	serviceStopPending = 3
+	serviceRunning     = 4
+
+	serviceAcceptStop     = 1
+	serviceAcceptShutdown = 4
+
+	serviceControlStop        = 1
+	serviceControlInterrogate = 4
+	serviceControlShutdown    = 5
+
+	errorServiceSpecificError           = 1066
+	errorFailedServiceControllerConnect = 1063
+)
+
+var (
+	procStartServiceCtrlDispatcher   = advapi32.NewProc("StartServiceCtrlDispatcherW")
+	procRegisterServiceCtrlHandlerEx = advapi32.NewProc("RegisterServiceCtrlHandlerExW")
+	procSetServiceStatus             = advapi32.NewProc("SetServiceStatus")
+)
+
+// The SERVICE_STATUS struct reported to the service control manager.
+type serviceStatus struct {
+	ServiceType             uint32
+	CurrentState            uint32
+	ControlsAccepted        uint32
+	Win32ExitCode           uint32
+	ServiceSpecificExitCode uint32
+	CheckPoint              uint32
+	WaitHint                uint32
+}
+
+// The SERVICE_TABLE_ENTRYW struct passed to the dispatcher.
+type serviceTableEntry struct {
+	ServiceName *uint16
+	ServiceProc uintptr
+}
+
+// Reports the state of the service to the service control manager and stops
+// the service when the service control manager asks it to.
+type serviceController struct {
+	stop     func() error
+	stopped  <-chan struct{}
+	requests chan struct{}
+
+	sync.Mutex
+	handle uintptr
+	status serviceStatus
+}
+
+// Connects kekahu run to the service control manager if it was started as a
+// Windows service, returning once the service has stopped. Otherwise, e.g.
+// when kekahu run is started from a console, it returns immediately.
+func serviceControl(stop func() error, stopped <-chan struct{}) {
+	// The dispatcher runs on the calling thread until the service stops
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	name, err := syscall.UTF16PtrFromString(ServiceName)
+	if err != nil {
+		return
+	}
+
+	ctl := &serviceController{stop: stop, stopped: stopped, requests: make(chan struct{}, 1)}
+	table := []serviceTableEntry{{name, syscall.NewCallback(ctl.main)}, {nil, 0}}
+	if ok, _, err := procStartServiceCtrlDispatcher.Call(uintptr(unsafe.Pointer(&table[0]))); ok == 0 {
+		if err != syscall.Errno(errorFailedServiceControllerConnect) {
+			warn("could not connect to the service control manager: %s", err)
+		}
+	}
+}
+
+// The ServiceMain of the service, which is called by the dispatcher once the
+// service control manager has started it and reports that it is running until
+// the service stops. The service is reported to have failed if it stops
+// without being asked to, so that the recovery actions restart it.
+func (c *serviceController) main(argc, argv uintptr) uintptr {
+	name, _ := syscall.UTF16PtrFromString(ServiceName)
+	handle, _, err := procRegisterServiceCtrlHandlerEx.Call(uintptr(unsafe.Pointer(name)), syscall.NewCallback(c.control), 0)
+	if handle == 0 {
+		warn("could not register the service control handler: %s", err)
+		return 0
+	}
+
+	c.Lock()
+	c.handle = handle
+	c.Unlock()
+	c.report(serviceRunning, serviceAcceptStop|serviceAcceptShutdown, 0)
+
+	select {
+	case <-c.requests:
+		c.report(serviceStopPending, 0, 0)
+		go c.stop()
+		<-c.stopped
+		c.report(serviceStopped, 0, 0)
+	case <-c.stopped:
+		c.report(serviceStopped, 0, errorServiceSpecificError)
+	}
+	return 0
+}
+
+// The HandlerEx of the service, which is called with the controls sent by the
+// service control manager.
+func (c *serviceController) control(ctrl, eventType, eventData, context uintptr) uintptr {
+	switch ctrl {
+	case serviceControlStop, serviceControlShutdown:
+		select {
+		case c.requests <- struct{}{}:
+		default:
+		}
+	case serviceControlInterrogate:
+		c.Lock()
+		status := c.status
+		c.Unlock()
+		c.report(status.CurrentState, status.ControlsAccepted, status.Win32ExitCode)
+	}
+	return 0
+}
+
+// Reports the state of the service to the service control manager.
+func (c *serviceController) report(state, accepts, exitCode uint32) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.status = serviceStatus{
+		ServiceType:      serviceWin32OwnProcess,
+		CurrentState:     state,
+		ControlsAccepted: accepts,
+		Win32ExitCode:    exitCode,
+	}
+
+	if exitCode == errorServiceSpecificError {
+		c.status.ServiceSpecificExitCode = 1
+	}
+
+	if state == serviceStopPending {
+		c.status.WaitHint = uint32((ShutdownTimeout + ShutdownTimeout/2).Nanoseconds() / 1e6)
+	}
+
+	if ok, _, err := procSetServiceStatus.Call(c.handle, uintptr(unsafe.Pointer(&c.status))); ok == 0 {
+		warn("could not report the service status: %s", err)
+	}
+}
@@ -0,0 +1,102 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bbengfort/kekahu/kahu"
+)
+
+// LocalService is a service running on the host that is reported to Kahu
+// with every heartbeat so that the deployed versions of the replica software
+// can be tracked across the fleet.
+type LocalService struct {
+	Name    string   // name of the service reported to Kahu
+	Port    int      // local port the service should be listening on, 0 if none
+	Command []string // command that prints the version of the service, if any
+}
+
+// ParseServices parses a semicolon separated list of local services, each a
+// name and port optionally followed by the command that prints the version of
+// the service, e.g. "nginx 80 nginx -v; postgres 5432 postgres --version".
+// The command is executed directly rather than by a shell, and a port of 0
+// means the service does not listen on a port.
+func ParseServices(s string) ([]*LocalService, error) {
+	services := make([]*LocalService, 0)
+	for _, entry := range strings.Split(s, ";") {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("service '%s' must be a name and port optionally followed by a version command", strings.TrimSpace(entry))
+		}
+
+		port, err := strconv.Atoi(fields[1])
+		if err != nil || port < 0 || port > 65535 {
+			return nil, fmt.Errorf("service '%s' has an invalid port '%s'", fields[0], fields[1])
+		}
+
+		services = append(services, &LocalService{
+			Name: fields[0], Port: port, Command: fields[2:],
+		})
+	}
+	return services, nil
+}
+
+// ProbeServices checks if each service is listening on its port and runs its
+// version command concurrently, returning the status of the services in the
+// order they were configured. Each probe is limited by the timeout so that a
+// hung command cannot delay the heartbeat for long.
+func ProbeServices(ctx context.Context, services []*LocalService, timeout time.Duration) []*kahu.ServiceStatus {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	statuses := make([]*kahu.ServiceStatus, len(services))
+	done := make(chan struct{}, len(services))
+	for i, service := range services {
+		go func(i int, service *LocalService) {
+			statuses[i] = service.Probe(ctx)
+			done <- struct{}{}
+		}(i, service)
+	}
+
+	for range services {
+		<-done
+	}
+	return statuses
+}
+
+// Probe the service, returning its status. Errors running the version command
+// are reported in the status rather than returned since they are not errors
+// of the kekahu service.
+func (s *LocalService) Probe(ctx context.Context) *kahu.ServiceStatus {
+	status := &kahu.ServiceStatus{Name: s.Name, Port: s.Port}
+
+	if s.Port > 0 {
+		dialer := new(net.Dialer)
+		if conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort("localhost", strconv.Itoa(s.Port))); err == nil {
+			status.Listening = true
+			conn.Close()
+		}
+	}
+
+	if len(s.Command) > 0 {
+		// Many programs print their version to stderr (e.g. nginx -v)
+		out, err := exec.CommandContext(ctx, s.Command[0], s.Command[1:]...).CombinedOutput()
+		if err != nil {
+			status.Error = fmt.Sprintf("could not probe version: %s", err)
+		} else {
+			status.Version = strings.TrimSpace(strings.SplitN(strings.TrimSpace(string(out)), "\n", 2)[0])
+		}
+	}
+
+	heartbeatLog.debug("service %s listening: %t version: %q", s.Name, status.Listening, status.Version)
+	return status
+}
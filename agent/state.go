@@ -0,0 +1,231 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/bbengfort/kekahu/kahu"
+)
+
+//===========================================================================
+// Service State
+//===========================================================================
+
+// ServiceState keeps track of the state of the running kekahu service so that
+// it can be inspected by the CLI and external tools via the status server.
+type ServiceState struct {
+	sync.RWMutex
+	started    time.Time               // when the service was started
+	heartbeats uint64                  // number of successful heartbeats
+	lastBeat   time.Time               // timestamp of the last successful heartbeat
+	lastReply  *kahu.HeartbeatResponse // the last heartbeat response from Kahu
+	nextBeat   time.Time               // when the next heartbeat is scheduled
+	errors     uint64                  // number of errors logged by the service
+	lastError  string                  // the last error logged by the service
+	errorTime  time.Time               // timestamp of the last error
+	source     string                  // the local host name returned by Kahu
+	neighbors  []*kahu.Neighbor        // the last neighbors returned by Kahu
+	lastSync   time.Time               // timestamp of the last peers sync
+	replicas   int                     // number of replicas in the last peers sync
+}
+
+// Start marks the time the service started.
+func (s *ServiceState) Start() {
+	s.Lock()
+	defer s.Unlock()
+	s.started = time.Now()
+}
+
+// Heartbeat records a successful heartbeat response from Kahu.
+func (s *ServiceState) Heartbeat(hb *kahu.HeartbeatResponse) {
+	s.Lock()
+	defer s.Unlock()
+	s.heartbeats++
+	s.lastBeat = time.Now()
+	s.lastReply = hb
+}
+
+// Inactive returns true if the last heartbeat response from Kahu was not
+// successful or reported that the host is not active, and false if no
+// heartbeat has been sent yet.
+func (s *ServiceState) Inactive() bool {
+	s.RLock()
+	defer s.RUnlock()
+	return s.lastReply != nil && !(s.lastReply.Success && s.lastReply.Active)
+}
+
+// NextHeartbeat records when the next heartbeat is scheduled.
+func (s *ServiceState) NextHeartbeat(next time.Time) {
+	s.Lock()
+	defer s.Unlock()
+	s.nextBeat = next
+}
+
+// Error records an error logged by the service.
+func (s *ServiceState) Error(err error) {
+	s.Lock()
+	defer s.Unlock()
+	s.errors++
+	s.lastError = err.Error()
+	s.errorTime = time.Now()
+}
+
+// Neighbors records the last neighbors response from Kahu.
+func (s *ServiceState) Neighbors(source string, targets []*kahu.Neighbor) {
+	s.Lock()
+	defer s.Unlock()
+	s.source = source
+	s.neighbors = targets
+}
+
+// Sync records a successful sync of the peers file.
+func (s *ServiceState) Sync(replicas int) {
+	s.Lock()
+	defer s.Unlock()
+	s.lastSync = time.Now()
+	s.replicas = replicas
+}
+
+// Serialize the heartbeat state of the service to report as JSON.
+func (s *ServiceState) Serialize() map[string]interface{} {
+	s.RLock()
+	defer s.RUnlock()
+
+	data := make(map[string]interface{})
+	data["pid"] = os.Getpid()
+	data["version"] = PackageVersion
+	data["started"] = s.started
+	data["uptime"] = time.Since(s.started).String()
+	data["heartbeats"] = s.heartbeats
+	data["last_heartbeat"] = s.lastBeat
+	data["next_heartbeat"] = s.nextBeat
+	data["errors"] = s.errors
+	data["last_error"] = s.lastError
+	data["last_error_time"] = s.errorTime
+
+	if s.lastReply != nil {
+		data["replica"] = s.lastReply.Replica
+		data["active"] = s.lastReply.Active
+		data["success"] = s.lastReply.Success
+	}
+
+	return data
+}
+
+// Peers serializes the last neighbors and peers sync to report as JSON.
+func (s *ServiceState) Peers() map[string]interface{} {
+	s.RLock()
+	defer s.RUnlock()
+
+	data := make(map[string]interface{})
+	data["source"] = s.source
+	data["neighbors"] = s.neighbors
+	data["last_sync"] = s.lastSync
+	data["num_replicas"] = s.replicas
+	return data
+}
+
+//===========================================================================
+// Local HTTP Servers
+//===========================================================================
+
+// Run a local HTTP server on the specified address that serves the state of
+// the service, the network latency report, the peers, and the statistics of
+// the echo server as JSON.
+func (k *KeKahu) runStatusServer(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", k.serveJSON(func() interface{} { return k.statusReport() }))
+	mux.HandleFunc("/metrics", k.serveJSON(func() interface{} { return k.Metrics() }))
+	mux.HandleFunc("/peers", k.serveJSON(func() interface{} { return k.state.Peers() }))
+	mux.HandleFunc("/echo", k.serveJSON(func() interface{} { return k.EchoStats() }))
+
+	return k.serveHTTP("status", addr, mux)
+}
+
+// Returns the state of the service to report as JSON, including the status
+// of any additional Kahu services that reports are sent to.
+func (k *KeKahu) statusReport() map[string]interface{} {
+	data := k.state.Serialize()
+
+	api := k.api
+	if dryrun, ok := api.(*DryRunClient); ok {
+		api = dryrun.client
+	}
+
+	if federated, ok := api.(*FederatedClient); ok {
+		data["upstreams"] = federated.Upstreams()
+	}
+
+	data["maintenance"] = k.Maintenance(time.Now())
+	data["identity"] = k.identity.Serialize()
+	data["log_level"] = k.verbose.Status()
+	data["local_only"] = k.LocalOnly()
+	if schemas := k.APISchemas(); schemas != nil {
+		data["api_schemas"] = schemas
+	}
+	if stats := k.APIStats(); stats != nil {
+		data["api_stats"] = stats
+	}
+	if reason, since := k.rejects.Stopped(); reason != "" {
+		data["heartbeats_stopped"] = reason
+		data["stopped_since"] = since
+	}
+	if since := k.local.Since(); !since.IsZero() {
+		data["local_since"] = since
+	}
+	return data
+}
+
+// Run a local HTTP server with the handler on the specified address, the
+// server is closed when the service is shutdown.
+func (k *KeKahu) serveHTTP(name, addr string, handler http.Handler) error {
+	sock, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("could not listen on '%s': %s", addr, err)
+	}
+
+	status("serving %s on http://%s", name, sock.Addr())
+	srv := &http.Server{Handler: handler}
+	k.httpd = append(k.httpd, srv)
+
+	go func() {
+		if err := srv.Serve(sock); err != nil && err != http.ErrServerClosed {
+			k.echan <- serverLog.wrap(err)
+		}
+	}()
+
+	return nil
+}
+
+// Returns an http handler that writes the data from the getter as JSON.
+func (k *KeKahu) serveJSON(get func() interface{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(get()); err != nil {
+			warn("could not encode status response: %s", err)
+		}
+	}
+}
+
+// Process reports the heartbeats and errors of the service in the status.
+func (s *ServiceState) Process(p *kahu.ProcessStatus) {
+	s.RLock()
+	defer s.RUnlock()
+
+	p.Heartbeats = s.heartbeats
+	p.Errors = s.errors
+	p.LastError = s.lastError
+	if !s.lastBeat.IsZero() {
+		p.LastBeat = s.lastBeat.Format(time.RFC3339)
+	}
+}
@@ -0,0 +1,293 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+)
+
+// Names of the files kept in the state directory unless their paths are
+// configured.
+const (
+	PIDFile      = "kekahu.pid"   // the PID file of the running service
+	IdentityFile = "replica.json" // the replica identity assigned by Kahu
+	LatencyFile  = "latency.json" // the checkpoint of the latency metrics
+)
+
+// Legacy locations of the state files, used before the state directory.
+const (
+	legacyPIDPath      = "/tmp/kekahu.pid"
+	legacyIdentityFile = ".kekahu.replica.json"
+)
+
+// DefaultStateDir returns the platform's directory for durable application
+// state: $XDG_DATA_HOME/kekahu or ~/.local/share/kekahu on Linux and other
+// unix systems, ~/Library/Application Support/kekahu on macOS, and
+// %LOCALAPPDATA%\kekahu on Windows.
+func DefaultStateDir() string {
+	home := os.TempDir()
+	if user, err := user.Current(); err == nil && user.HomeDir != "" {
+		home = user.HomeDir
+	}
+
+	switch runtime.GOOS {
+	case "darwin":
+		return filepath.Join(home, "Library", "Application Support", "kekahu")
+	case "windows":
+		if appdata := os.Getenv("LOCALAPPDATA"); appdata != "" {
+			return filepath.Join(appdata, "kekahu")
+		}
+		return filepath.Join(home, "AppData", "Local", "kekahu")
+	default:
+		if data := os.Getenv("XDG_DATA_HOME"); data != "" && filepath.IsAbs(data) {
+			return filepath.Join(data, "kekahu")
+		}
+		return filepath.Join(home, ".local", "share", "kekahu")
+	}
+}
+
+//===========================================================================
+// State Directory
+//===========================================================================
+
+// StateDir is the directory that the service keeps its durable state in: the
+// PID file, the replica identity, the latency checkpoint, and the spool of
+// buffered reports. Relative paths of state files are resolved in it, so the
+// state doesn't depend on the working directory the service is started from.
+type StateDir struct {
+	path string
+}
+
+// NewStateDir returns the state directory at the path, or the default state
+// directory of the platform if the path is empty.
+func NewStateDir(path string) *StateDir {
+	if path == "" {
+		path = DefaultStateDir()
+	}
+	return &StateDir{path: filepath.Clean(path)}
+}
+
+// Path returns the path of the state directory.
+func (s *StateDir) Path() string {
+	return s.path
+}
+
+// Join returns the path of the file with the name in the state directory, or
+// the name unchanged if it is an absolute path.
+func (s *StateDir) Join(name string) string {
+	if filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(s.path, name)
+}
+
+// Init creates the state directory if it doesn't exist, only readable by the
+// user since it holds the replica identity and buffered reports.
+func (s *StateDir) Init() error {
+	if err := os.MkdirAll(s.path, 0700); err != nil {
+		return fmt.Errorf("could not create state directory: %s", err)
+	}
+	return nil
+}
+
+// Migrate moves the file at the legacy path to the path if it doesn't exist
+// yet, returning true if the file was moved. Files are copied if they can't
+// be renamed, e.g. from another file system.
+func (s *StateDir) Migrate(legacy, path string) (bool, error) {
+	if legacy == "" || legacy == path {
+		return false, nil
+	}
+
+	if _, err := os.Stat(legacy); err != nil {
+		return false, nil
+	}
+
+	if _, err := os.Stat(path); err == nil {
+		return false, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return false, fmt.Errorf("could not migrate %s: %s", legacy, err)
+	}
+
+	if err := os.Rename(legacy, path); err != nil {
+		if err = copyFile(legacy, path); err != nil {
+			return false, fmt.Errorf("could not migrate %s: %s", legacy, err)
+		}
+
+		if err = os.Remove(legacy); err != nil {
+			warn("could not remove %s after migrating it: %s", legacy, err)
+		}
+	}
+	return true, nil
+}
+
+// Remove deletes the files from the state directory (and any other paths they
+// are configured at), returning the files that were removed. The state
+// directory itself is removed if it is empty afterwards.
+func (s *StateDir) Remove(paths ...string) ([]string, error) {
+	removed := make([]string, 0, len(paths))
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+
+		if err := os.Remove(path); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return removed, fmt.Errorf("could not remove %s: %s", path, err)
+		}
+		removed = append(removed, path)
+	}
+
+	// Only succeeds if the directory is empty
+	os.Remove(s.path)
+	return removed, nil
+}
+
+// Copies the file at src to dst with the same mode.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	if !info.Mode().IsRegular() {
+		return errors.New("not a regular file")
+	}
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
+
+//===========================================================================
+// State Files
+//===========================================================================
+
+// GetStateDir returns the configured state directory, or the default state
+// directory of the platform.
+func (c *Config) GetStateDir() *StateDir {
+	return NewStateDir(c.StateDir)
+}
+
+// GetPidPath returns the path of the PID file of the running service, in the
+// state directory unless an absolute path is configured.
+func (c *Config) GetPidPath() string {
+	if c.PidPath == "" {
+		return c.GetStateDir().Join(PIDFile)
+	}
+	return c.GetStateDir().Join(c.PidPath)
+}
+
+// GetIdentityPath returns the path of the replica identity assigned by Kahu,
+// in the state directory unless an absolute path is configured.
+func (c *Config) GetIdentityPath() string {
+	if c.IdentityPath == "" {
+		return c.GetStateDir().Join(IdentityFile)
+	}
+	return c.GetStateDir().Join(c.IdentityPath)
+}
+
+// GetLatencyPath returns the path the latency metrics are checkpointed to, in
+// the state directory unless an absolute path is configured.
+func (c *Config) GetLatencyPath() string {
+	if c.LatencyPath == "" {
+		return c.GetStateDir().Join(LatencyFile)
+	}
+	return c.GetStateDir().Join(c.LatencyPath)
+}
+
+// GetSpoolPath returns the path of the spool of buffered reports, in the state
+// directory unless an absolute path is configured, or an empty string if the
+// spool is disabled.
+func (c *Config) GetSpoolPath() string {
+	if c.SpoolPath == "" {
+		return ""
+	}
+	return c.GetStateDir().Join(c.SpoolPath)
+}
+
+// GetStateFiles returns the paths of the state files that kekahu state clean
+// removes, including the replica identity if identity is true.
+func (c *Config) GetStateFiles(identity bool) []string {
+	files := []string{c.GetPidPath(), c.GetLatencyPath()}
+	if spool := c.GetSpoolPath(); spool != "" {
+		files = append(files, spool)
+	}
+
+	if identity {
+		files = append(files, c.GetIdentityPath())
+	}
+	return files
+}
+
+// MigrateState creates the state directory and moves the state files from the
+// locations used by earlier versions into it: the PID file from /tmp, the
+// replica identity from the home directory, and the latency checkpoint and
+// spool from the working directory (where relative paths used to resolve).
+// Files that can't be migrated are left in place with a warning.
+func (c *Config) MigrateState() error {
+	state := c.GetStateDir()
+	if err := state.Init(); err != nil {
+		return err
+	}
+
+	migrations := make(map[string]string)
+	if c.PidPath == "" {
+		migrations[legacyPIDPath] = c.GetPidPath()
+	}
+
+	if c.IdentityPath == "" {
+		if user, err := user.Current(); err == nil {
+			migrations[filepath.Join(user.HomeDir, legacyIdentityFile)] = c.GetIdentityPath()
+		}
+	}
+
+	latency := c.LatencyPath
+	if latency == "" {
+		latency = LatencyFile
+	}
+
+	for _, path := range []string{latency, c.SpoolPath} {
+		if path == "" || filepath.IsAbs(path) {
+			continue
+		}
+
+		if legacy, err := filepath.Abs(path); err == nil {
+			migrations[legacy] = state.Join(path)
+		}
+	}
+
+	for legacy, path := range migrations {
+		moved, err := state.Migrate(legacy, path)
+		if err != nil {
+			warn("%s", err)
+			continue
+		}
+
+		if moved {
+			info("migrated %s to %s", legacy, path)
+		}
+	}
+	return nil
+}
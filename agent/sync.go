@@ -0,0 +1,247 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/bbengfort/x/peers"
+)
+
+// Sync the peers.json file from Kahu. If no path is specified then the peers
+// file will be synced to the path specified by the peers package, most
+// likely ~/.fluidfs/peers.json unless the $PEERS_PATH is set.
+//
+// The peers are written in the configured peers format. JSON peers files are
+// compared to the peers already on disk and only rewritten if the membership
+// changed, in which case a summary of the added, removed, and updated peers is
+// logged; files in other formats are only rewritten if their contents changed.
+// The membership hooks are run whenever the peers file is rewritten. The file
+// is replaced atomically and the previous version is kept as a backup. The
+// sync callbacks are called after every sync, whether it succeeded or not.
+func (k *KeKahu) Sync(ctx context.Context, path string) error {
+	// Determine the path to synchronize the peers to.
+	if path == "" {
+		path = k.conf().PeersPath
+	}
+
+	replicas, err := k.syncPeers(ctx, path)
+	k.notify.sync(path, replicas, err)
+	return err
+}
+
+// Syncs the peers file at the path, returning the number of replicas fetched
+// from Kahu, see Sync.
+func (k *KeKahu) syncPeers(ctx context.Context, path string) (int, error) {
+	// Fetch the replicas from the Kahu service
+	replicas, err := k.api.Replicas(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	// Render the replicas in the configured format
+	format := strings.ToLower(k.conf().PeersFormat)
+	data, err := EncodePeers(format, replicas)
+	if err != nil {
+		return 0, err
+	}
+	k.state.Sync(len(replicas))
+
+	// Compare the replicas to the peers on disk, if any
+	var diff *PeersDiff
+	summary := "contents changed"
+	if format == JSONFormat {
+		current, err := LoadPeers(path)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				syncLog.warn("could not load %s, it will be replaced: %s", path, err)
+			}
+			current = new(peers.Peers)
+		}
+
+		// Files written before checksums were added are rewritten once
+		diff = DiffPeers(current.Peers, replicas)
+		if diff.Empty() && current.Info[PeersChecksumKey] != nil {
+			syncLog.debug("%d replicas unchanged, not rewriting %s", len(replicas), path)
+			return len(replicas), nil
+		}
+		summary = diff.String()
+	} else if current, err := ioutil.ReadFile(path); err == nil && bytes.Equal(current, data) {
+		syncLog.debug("%d replicas unchanged, not rewriting %s", len(replicas), path)
+		return len(replicas), nil
+	}
+
+	// Save the peers to disk at the specified path
+	if err := WritePeers(path, data); err != nil {
+		return 0, err
+	}
+
+	syncLog.info("synchronized %d replicas to %s as %s: %s", len(replicas), path, format, summary)
+	k.membershipChanged(path, len(replicas), diff)
+	return len(replicas), nil
+}
+
+// AutoSync syncs the peers file to the configured path and schedules the next
+// sync after the sync interval, unless periodic syncs are disabled.
+func (k *KeKahu) AutoSync(ctx context.Context) {
+	interval, err := k.conf().GetSyncInterval()
+	if err != nil || interval <= 0 || ctx.Err() != nil {
+		return
+	}
+	defer k.schedule(interval, k.AutoSync)
+
+	if err := k.Sync(ctx, ""); err != nil {
+		k.echan <- syncLog.wrap(err)
+	}
+}
+
+//===========================================================================
+// Peers File
+//===========================================================================
+
+// PeersChecksumKey is the key of the checksum of the replicas in the info
+// block of the peers file.
+const PeersChecksumKey = "checksum"
+
+// PeersBackupExt is appended to the path of the peers file for the backup of
+// the previous version, which is replaced every time the peers file is.
+const PeersBackupExt = ".bak"
+
+// PeersChecksum returns the SHA-256 checksum of the replicas, e.g.
+// "sha256:9f86d08...", computed over their compact JSON encoding.
+func PeersChecksum(replicas []*peers.Peer) (string, error) {
+	if replicas == nil {
+		replicas = []*peers.Peer{}
+	}
+
+	data, err := json.Marshal(replicas)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:]), nil
+}
+
+// LoadPeers loads the JSON peers file at the path and verifies the checksum in
+// its info block, returning an error if the replicas do not match it, e.g. if
+// the file was truncated or edited by hand. Files without a checksum, such as
+// those written by older versions of kekahu, are loaded without verification.
+func LoadPeers(path string) (*peers.Peers, error) {
+	replicas := new(peers.Peers)
+	if err := replicas.Load(path); err != nil {
+		return nil, err
+	}
+
+	expected, ok := replicas.Info[PeersChecksumKey].(string)
+	if !ok {
+		return replicas, nil
+	}
+
+	checksum, err := PeersChecksum(replicas.Peers)
+	if err != nil {
+		return nil, err
+	}
+
+	if checksum != expected {
+		return nil, fmt.Errorf("checksum of %s does not match its replicas, the file may be corrupt", path)
+	}
+	return replicas, nil
+}
+
+// WritePeers replaces the peers file at the path with the data atomically, so
+// that a crash while writing never leaves a partially written peers file. The
+// previous version of the file, if any, is kept at the path with the backup
+// extension, replacing the previous backup.
+func WritePeers(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	// The backup is copied rather than renamed so the peers file always exists
+	if previous, err := ioutil.ReadFile(path); err == nil {
+		if err := writeFileAtomic(path+PeersBackupExt, previous, 0644); err != nil {
+			return fmt.Errorf("could not back up %s: %s", path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	return writeFileAtomic(path, data, 0644)
+}
+
+//===========================================================================
+// Peers Diff
+//===========================================================================
+
+// PeersDiff describes the changes in membership between two lists of peers
+// by the names of the peers that were added, removed, or updated.
+type PeersDiff struct {
+	Added   []string // peers that are new
+	Removed []string // peers that no longer exist
+	Updated []string // peers whose address or other information changed
+}
+
+// DiffPeers compares the previous peers to the current peers by name.
+func DiffPeers(previous, current []*peers.Peer) *PeersDiff {
+	diff := &PeersDiff{Added: []string{}, Removed: []string{}, Updated: []string{}}
+
+	before := make(map[string]*peers.Peer, len(previous))
+	for _, peer := range previous {
+		before[peer.Name] = peer
+	}
+
+	after := make(map[string]*peers.Peer, len(current))
+	for _, peer := range current {
+		after[peer.Name] = peer
+
+		if prev, ok := before[peer.Name]; !ok {
+			diff.Added = append(diff.Added, peer.Name)
+		} else if !reflect.DeepEqual(prev, peer) {
+			diff.Updated = append(diff.Updated, peer.Name)
+		}
+	}
+
+	for name := range before {
+		if _, ok := after[name]; !ok {
+			diff.Removed = append(diff.Removed, name)
+		}
+	}
+
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+	sort.Strings(diff.Updated)
+	return diff
+}
+
+// Empty returns true if the membership did not change.
+func (d *PeersDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Updated) == 0
+}
+
+// String returns a summary of the changes, e.g. "1 added (alpha), 2 removed (bravo, charlie)".
+func (d *PeersDiff) String() string {
+	if d.Empty() {
+		return "no changes"
+	}
+
+	changes := make([]string, 0, 3)
+	for _, change := range []struct {
+		action string
+		names  []string
+	}{{"added", d.Added}, {"removed", d.Removed}, {"updated", d.Updated}} {
+		if len(change.names) > 0 {
+			changes = append(changes, fmt.Sprintf("%d %s (%s)", len(change.names), change.action, strings.Join(change.names, ", ")))
+		}
+	}
+	return strings.Join(changes, ", ")
+}
@@ -0,0 +1,391 @@
+package agent
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bbengfort/kekahu/kahu"
+)
+
+// LatencyBuckets are the upper bounds in seconds of the ping latency
+// histogram buckets exported to Prometheus.
+var LatencyBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Telemetry collects counters and histograms about the kekahu service that
+// are exported in the Prometheus text exposition format. All methods are
+// thread-safe and may be called on a nil Telemetry, in which case nothing is
+// recorded (e.g. if the server is run without the KeKahu client).
+type Telemetry struct {
+	sync.Mutex
+	heartbeats  map[string]uint64     // heartbeats sent by result
+	apiErrors   map[string]uint64     // Kahu API errors by endpoint
+	streak      uint64                // consecutive heartbeat failures
+	trips       uint64                // times the dead man's switch was tripped
+	pingsServed uint64                // pings served by the echo server
+	received    map[string]uint64     // pings served by the echo server by source
+	lastSeen    map[string]time.Time  // when the echo server last served a ping by source
+	rejected    uint64                // unauthenticated pings rejected by the echo server
+	requests    map[echoKey]uint64    // echo server requests by source, method, and code
+	panics      map[string]uint64     // panics recovered by the echo server by method
+	timeouts    map[string]uint64     // ping timeouts by target
+	latencies   map[string]*histogram // ping latency by target
+	transports  map[string]string     // transport of the last ping by target
+	health      *kahu.SystemStatus    // the last health report, exported to OTLP
+	matrix      *LatencyMatrix        // latencies gossiped by the neighbors, may be nil
+	api         *kahu.APIStats        // requests to each Kahu endpoint, may be nil
+	started     time.Time             // when the counters were initialized
+}
+
+// Init the internal maps of the telemetry collector.
+func (t *Telemetry) Init() {
+	t.Lock()
+	defer t.Unlock()
+	t.heartbeats = make(map[string]uint64)
+	t.apiErrors = make(map[string]uint64)
+	t.timeouts = make(map[string]uint64)
+	t.requests = make(map[echoKey]uint64)
+	t.received = make(map[string]uint64)
+	t.lastSeen = make(map[string]time.Time)
+	t.panics = make(map[string]uint64)
+	t.latencies = make(map[string]*histogram)
+	t.transports = make(map[string]string)
+	t.started = time.Now()
+}
+
+// Heartbeat records a heartbeat that was sent, whether or not it failed.
+func (t *Telemetry) Heartbeat(success bool) {
+	if t == nil {
+		return
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	if success {
+		t.heartbeats["success"]++
+	} else {
+		t.heartbeats["failure"]++
+	}
+}
+
+// HeartbeatStreak records the number of consecutive heartbeat failures.
+func (t *Telemetry) HeartbeatStreak(failures int) {
+	if t == nil {
+		return
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	t.streak = uint64(failures)
+}
+
+// DeadmanTrip records that the dead man's switch was tripped.
+func (t *Telemetry) DeadmanTrip() {
+	if t == nil {
+		return
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	t.trips++
+}
+
+// APIError records a failed request to the specified Kahu API endpoint.
+func (t *Telemetry) APIError(endpoint string) {
+	if t == nil {
+		return
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	t.apiErrors[endpoint]++
+}
+
+// PingServed records a ping from the source that was received at the time and
+// replied to by the echo server.
+func (t *Telemetry) PingServed(source string, received time.Time) {
+	if t == nil {
+		return
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	t.pingsServed++
+	t.received[source]++
+	t.lastSeen[source] = received
+}
+
+// PingRejected records an unauthenticated ping rejected by the echo server.
+func (t *Telemetry) PingRejected() {
+	if t == nil {
+		return
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	t.rejected++
+}
+
+// EchoRequest records a gRPC request handled by the echo server from the
+// source address with the method and the status code of the reply.
+func (t *Telemetry) EchoRequest(source, method, code string) {
+	if t == nil {
+		return
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	t.requests[echoKey{source, method, code}]++
+}
+
+// EchoPanic records a panic in the method recovered by the echo server.
+func (t *Telemetry) EchoPanic(method string) {
+	if t == nil {
+		return
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	t.panics[method]++
+}
+
+// Ping records the latency of a ping to the target sent with the transport,
+// zero is a timeout.
+func (t *Telemetry) Ping(target, transport string, latency time.Duration) {
+	if t == nil {
+		return
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	t.transports[target] = transport
+	if latency == 0 {
+		t.timeouts[target]++
+		return
+	}
+
+	hist, ok := t.latencies[target]
+	if !ok {
+		hist = newHistogram(LatencyBuckets)
+		t.latencies[target] = hist
+	}
+	hist.Observe(latency.Seconds())
+}
+
+// Health records the last health report of the system.
+func (t *Telemetry) Health(status *kahu.SystemStatus) {
+	if t == nil {
+		return
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	t.health = status
+}
+
+// WriteTo writes the metrics in the Prometheus text exposition format.
+func (t *Telemetry) WriteTo(w io.Writer) (int64, error) {
+	t.Lock()
+	defer t.Unlock()
+
+	buf := new(bytes.Buffer)
+
+	writeHeader(buf, "kekahu_heartbeats_total", "counter", "Heartbeats sent to Kahu by result.")
+	for _, result := range sortedKeys(t.heartbeats) {
+		fmt.Fprintf(buf, "kekahu_heartbeats_total{result=%q} %d\n", result, t.heartbeats[result])
+	}
+
+	writeHeader(buf, "kekahu_heartbeat_failure_streak", "gauge", "Consecutive heartbeats that failed.")
+	fmt.Fprintf(buf, "kekahu_heartbeat_failure_streak %d\n", t.streak)
+
+	writeHeader(buf, "kekahu_deadman_trips_total", "counter", "Times heartbeats failed deadman_failures times in a row.")
+	fmt.Fprintf(buf, "kekahu_deadman_trips_total %d\n", t.trips)
+
+	writeHeader(buf, "kekahu_api_errors_total", "counter", "Failed requests to the Kahu API by endpoint.")
+	for _, endpoint := range sortedKeys(t.apiErrors) {
+		fmt.Fprintf(buf, "kekahu_api_errors_total{endpoint=%q} %d\n", endpoint, t.apiErrors[endpoint])
+	}
+
+	if t.api != nil {
+		writeAPIStats(buf, t.api.Endpoints())
+	}
+
+	writeHeader(buf, "kekahu_pings_served_total", "counter", "Pings replied to by the echo server.")
+	fmt.Fprintf(buf, "kekahu_pings_served_total %d\n", t.pingsServed)
+
+	writeHeader(buf, "kekahu_echo_pings_received_total", "counter", "Pings replied to by the echo server by source.")
+	for _, source := range sortedKeys(t.received) {
+		fmt.Fprintf(buf, "kekahu_echo_pings_received_total{source=%q} %d\n", source, t.received[source])
+	}
+
+	writeHeader(buf, "kekahu_echo_last_seen_timestamp_seconds", "gauge", "When the echo server last replied to a ping by source.")
+	for _, source := range sortedKeys(t.received) {
+		seconds := float64(t.lastSeen[source].UnixNano()) / float64(time.Second)
+		fmt.Fprintf(buf, "kekahu_echo_last_seen_timestamp_seconds{source=%q} %.3f\n", source, seconds)
+	}
+
+	writeHeader(buf, "kekahu_pings_rejected_total", "counter", "Unauthenticated pings rejected by the echo server.")
+	fmt.Fprintf(buf, "kekahu_pings_rejected_total %d\n", t.rejected)
+
+	writeHeader(buf, "kekahu_echo_requests_total", "counter", "Requests handled by the echo server by source, method, and code.")
+	keys := make([]echoKey, 0, len(t.requests))
+	for key := range t.requests {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].less(keys[j]) })
+
+	for _, key := range keys {
+		fmt.Fprintf(buf, "kekahu_echo_requests_total{source=%q,method=%q,code=%q} %d\n", key.source, key.method, key.code, t.requests[key])
+	}
+
+	writeHeader(buf, "kekahu_echo_panics_total", "counter", "Panics recovered by the echo server by method.")
+	for _, method := range sortedKeys(t.panics) {
+		fmt.Fprintf(buf, "kekahu_echo_panics_total{method=%q} %d\n", method, t.panics[method])
+	}
+
+	writeHeader(buf, "kekahu_ping_timeouts_total", "counter", "Pings to the target that timed out.")
+	for _, target := range sortedKeys(t.timeouts) {
+		fmt.Fprintf(buf, "kekahu_ping_timeouts_total{target=%q} %d\n", target, t.timeouts[target])
+	}
+
+	writeHeader(buf, "kekahu_ping_latency_seconds", "histogram", "Latency of pings to the target.")
+	targets := make([]string, 0, len(t.latencies))
+	for target := range t.latencies {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+
+	for _, target := range targets {
+		t.latencies[target].write(buf, "kekahu_ping_latency_seconds", "target", target)
+	}
+
+	writeHeader(buf, "kekahu_ping_transport_info", "gauge", "Transport of the last ping to the target, e.g. grpc+socks5 through a proxy.")
+	targets = make([]string, 0, len(t.transports))
+	for target := range t.transports {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+
+	for _, target := range targets {
+		fmt.Fprintf(buf, "kekahu_ping_transport_info{target=%q,transport=%q} 1\n", target, t.transports[target])
+	}
+
+	if t.matrix != nil {
+		t.matrix.write(buf)
+	}
+
+	return buf.WriteTo(w)
+}
+
+// ServeHTTP implements http.Handler to serve the metrics to Prometheus.
+func (t *Telemetry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if _, err := t.WriteTo(w); err != nil {
+		warn("could not write metrics: %s", err)
+	}
+}
+
+// The labels of the echo server request counter.
+type echoKey struct {
+	source string // the address of the peer without the port
+	method string // the full gRPC method name
+	code   string // the status code of the reply
+}
+
+// Orders the labels by source, then method, then code.
+func (k echoKey) less(o echoKey) bool {
+	if k.source != o.source {
+		return k.source < o.source
+	}
+	if k.method != o.method {
+		return k.method < o.method
+	}
+	return k.code < o.code
+}
+
+//===========================================================================
+// Helpers
+//===========================================================================
+
+// histogram is a cumulative Prometheus histogram (not thread-safe).
+type histogram struct {
+	bounds []float64 // upper bounds of the buckets
+	counts []uint64  // cumulative counts of observations in each bucket
+	count  uint64    // total number of observations
+	sum    float64   // sum of all observations
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds))}
+}
+
+// Observe adds the value to every bucket whose upper bound it is within.
+func (h *histogram) Observe(val float64) {
+	h.count++
+	h.sum += val
+	for i, bound := range h.bounds {
+		if val <= bound {
+			h.counts[i]++
+		}
+	}
+}
+
+// Writes the bucket, sum, and count series of the histogram with the label.
+func (h *histogram) write(w io.Writer, name, label, value string) {
+	for i, bound := range h.bounds {
+		fmt.Fprintf(w, "%s_bucket{%s=%q,le=\"%g\"} %d\n", name, label, value, bound, h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{%s=%q,le=\"+Inf\"} %d\n", name, label, value, h.count)
+	fmt.Fprintf(w, "%s_sum{%s=%q} %g\n", name, label, value, h.sum)
+	fmt.Fprintf(w, "%s_count{%s=%q} %d\n", name, label, value, h.count)
+}
+
+// Writes the requests, retries, and latency of each Kahu API endpoint.
+func writeAPIStats(w io.Writer, stats map[string]*kahu.EndpointStats) {
+	endpoints := make([]string, 0, len(stats))
+	for endpoint := range stats {
+		endpoints = append(endpoints, endpoint)
+	}
+	sort.Strings(endpoints)
+
+	writeHeader(w, "kekahu_api_requests_total", "counter", "Attempted requests to the Kahu API by endpoint, including retries.")
+	for _, endpoint := range endpoints {
+		fmt.Fprintf(w, "kekahu_api_requests_total{endpoint=%q} %d\n", endpoint, stats[endpoint].Requests)
+	}
+
+	writeHeader(w, "kekahu_api_retries_total", "counter", "Failed requests to the Kahu API that were retried by endpoint.")
+	for _, endpoint := range endpoints {
+		fmt.Fprintf(w, "kekahu_api_retries_total{endpoint=%q} %d\n", endpoint, stats[endpoint].Retries)
+	}
+
+	writeHeader(w, "kekahu_api_request_seconds", "summary", "Latency of the requests to the Kahu API by endpoint.")
+	for _, endpoint := range endpoints {
+		total, _ := stats[endpoint].Latency()
+		fmt.Fprintf(w, "kekahu_api_request_seconds_sum{endpoint=%q} %g\n", endpoint, total.Seconds())
+		fmt.Fprintf(w, "kekahu_api_request_seconds_count{endpoint=%q} %d\n", endpoint, stats[endpoint].Requests)
+	}
+
+	writeHeader(w, "kekahu_api_request_max_seconds", "gauge", "Highest latency of a request to the Kahu API by endpoint.")
+	for _, endpoint := range endpoints {
+		_, max := stats[endpoint].Latency()
+		fmt.Fprintf(w, "kekahu_api_request_max_seconds{endpoint=%q} %g\n", endpoint, max.Seconds())
+	}
+}
+
+func writeHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
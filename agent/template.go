@@ -0,0 +1,143 @@
+// Generates commented configuration templates for first-time setup.
+
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/fatih/camelcase"
+	"github.com/fatih/structs"
+	"github.com/koding/multiconfig"
+)
+
+// Configuration template formats supported by WriteConfigTemplate.
+const (
+	TOMLFormat = "toml"
+	YAMLFormat = "yaml"
+	JSONFormat = "json"
+)
+
+// ConfigFormat returns the template format from the extension of the path,
+// or an empty string if the extension isn't a recognized config format.
+func ConfigFormat(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		return TOMLFormat
+	case ".yml", ".yaml":
+		return YAMLFormat
+	case ".json":
+		return JSONFormat
+	default:
+		return ""
+	}
+}
+
+// WriteConfigTemplate writes a configuration template populated with the
+// default values to the specified path. If format is empty, it is inferred
+// from the path's extension. The file is not overwritten unless force is true.
+func WriteConfigTemplate(path, format string, force bool) error {
+	if format == "" {
+		if format = ConfigFormat(path); format == "" {
+			return fmt.Errorf("cannot determine config format of '%s'", path)
+		}
+	}
+
+	if !force {
+		if _, err := os.Stat(path); err == nil {
+			return fmt.Errorf("config file already exists at '%s'", path)
+		}
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("could not create config file: %s", err)
+	}
+	defer f.Close()
+
+	return ConfigTemplate(f, format)
+}
+
+// ConfigTemplate writes a configuration template in the specified format to
+// the writer. Every field is written with its default value; TOML and YAML
+// templates also describe the validation rule and environment variable for
+// each field in comments (JSON does not support comments).
+func ConfigTemplate(w io.Writer, format string) error {
+	// Populate a config with only the default values
+	conf := new(Config)
+	if err := (&multiconfig.TagLoader{}).Load(conf); err != nil {
+		return err
+	}
+
+	switch strings.ToLower(format) {
+	case TOMLFormat:
+		return writeCommentedTemplate(w, conf, formatTOMLField)
+	case YAMLFormat, "yml":
+		return writeCommentedTemplate(w, conf, formatYAMLField)
+	case JSONFormat:
+		data, err := json.MarshalIndent(conf, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(data))
+		return err
+	default:
+		return fmt.Errorf("unknown config format '%s'", format)
+	}
+}
+
+// Writes each field of the config with a comment header using the format
+// function to produce the key/value line for the specific file format.
+func writeCommentedTemplate(w io.Writer, conf *Config, line func(*structs.Field) string) error {
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "# KeKahu v%s configuration\n", PackageVersion)
+
+	for _, field := range structs.Fields(conf) {
+		fmt.Fprintf(buf, "\n# %s\n", field.Name())
+
+		if field.Tag("required") == "true" {
+			fmt.Fprintln(buf, "#   required: true")
+		} else {
+			fmt.Fprintf(buf, "#   default: %s\n", field.Tag("default"))
+		}
+
+		if rule := field.Tag("validate"); rule != "" {
+			fmt.Fprintf(buf, "#   validate: %s\n", rule)
+		}
+
+		fmt.Fprintf(buf, "#   env: %s\n", envVarName(field.Name()))
+		fmt.Fprintln(buf, line(field))
+	}
+
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+// TOML keys are matched case-insensitively to the struct field names.
+func formatTOMLField(field *structs.Field) string {
+	return fmt.Sprintf("%s = %s", field.Name(), formatValue(field.Value()))
+}
+
+// YAML keys are the lowercased struct field names.
+func formatYAMLField(field *structs.Field) string {
+	return fmt.Sprintf("%s: %s", strings.ToLower(field.Name()), formatValue(field.Value()))
+}
+
+// Quotes strings and formats all other values with their default format.
+func formatValue(val interface{}) string {
+	if s, ok := val.(string); ok {
+		return fmt.Sprintf("%q", s)
+	}
+	return fmt.Sprintf("%v", val)
+}
+
+// Returns the environment variable name in the same manner as the
+// multiconfig.EnvironmentLoader used by Config.Load.
+func envVarName(name string) string {
+	return "KEKAHU_" + strings.ToUpper(strings.Join(camelcase.Split(name), "_"))
+}
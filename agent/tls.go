@@ -0,0 +1,182 @@
+package agent
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"google.golang.org/grpc/credentials"
+)
+
+// TLSEnabled returns true if a certificate and key have been configured to
+// secure the echo server and ping client with mutual TLS.
+func (c *Config) TLSEnabled() bool {
+	return c.TLSCert != "" || c.TLSKey != ""
+}
+
+// ServerCredentials returns the transport credentials for the echo server,
+// which requires and verifies client certificates signed by the CA. If TLS is
+// not configured then nil credentials are returned for backwards compatibility.
+func (c *Config) ServerCredentials() (credentials.TransportCredentials, error) {
+	conf, err := c.ServerTLSConfig()
+	if conf == nil || err != nil {
+		return nil, err
+	}
+	return credentials.NewTLS(conf), nil
+}
+
+// ClientCredentials returns the transport credentials for the ping client,
+// which presents its certificate to the remote echo server and verifies the
+// server's certificate with the CA. If TLS is not configured, nil is returned.
+func (c *Config) ClientCredentials() (credentials.TransportCredentials, error) {
+	conf, err := c.ClientTLSConfig()
+	if conf == nil || err != nil {
+		return nil, err
+	}
+	return credentials.NewTLS(conf), nil
+}
+
+// ServerTLSConfig returns the TLS configuration of the echo server, see
+// ServerCredentials, which also secures QUIC pings. If TLS is not configured,
+// nil is returned.
+func (c *Config) ServerTLSConfig() (*tls.Config, error) {
+	if !c.TLSEnabled() {
+		return nil, nil
+	}
+
+	conf, err := c.loadTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		Certificates: conf.Certificates,
+		ClientCAs:    conf.RootCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}, nil
+}
+
+// ClientTLSConfig returns the TLS configuration of the ping client, see
+// ClientCredentials, which also secures QUIC pings. If TLS is not configured,
+// nil is returned.
+func (c *Config) ClientTLSConfig() (*tls.Config, error) {
+	if !c.TLSEnabled() {
+		return nil, nil
+	}
+	return c.loadTLSConfig()
+}
+
+// Loads the certificate key pair and the CA pool from the configured paths.
+func (c *Config) loadTLSConfig() (*tls.Config, error) {
+	if c.TLSCert == "" || c.TLSKey == "" {
+		return nil, errors.New("both tls_cert and tls_key are required for mutual TLS")
+	}
+
+	if c.TLSCA == "" {
+		return nil, errors.New("tls_ca is required for mutual TLS")
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.TLSCert, c.TLSKey)
+	if err != nil {
+		return nil, fmt.Errorf("could not load tls key pair: %s", err)
+	}
+
+	ca, err := ioutil.ReadFile(c.TLSCA)
+	if err != nil {
+		return nil, fmt.Errorf("could not read tls ca: %s", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("could not parse certificates from %s", c.TLSCA)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+	}, nil
+}
+
+// HTTPTransport returns the transport for requests to the Kahu API, which
+// uses the configured proxy (or the proxy from the environment), verifies the
+// Kahu server with the system roots and the configured CA bundle, and presents
+// the client certificate if one is configured.
+func (c *Config) HTTPTransport() (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if err := c.tuneTransport(transport); err != nil {
+		return nil, err
+	}
+
+	if c.KahuProxy != "" {
+		proxy, err := url.Parse(c.KahuProxy)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse kahu proxy: %s", err)
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+
+	if c.KahuCA == "" && c.KahuCert == "" && c.KahuKey == "" && !c.KahuInsecure {
+		return transport, nil
+	}
+
+	conf := &tls.Config{InsecureSkipVerify: c.KahuInsecure}
+	if c.KahuInsecure {
+		warn("verification of the Kahu server certificate is disabled, requests (including the api key) may be intercepted; do not set kahu_insecure in production")
+	}
+
+	if c.KahuCA != "" {
+		// Add the CA bundle to the system roots so public servers still verify
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+
+		ca, err := ioutil.ReadFile(c.KahuCA)
+		if err != nil {
+			return nil, fmt.Errorf("could not read kahu ca: %s", err)
+		}
+
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("could not parse certificates from %s", c.KahuCA)
+		}
+		conf.RootCAs = pool
+	}
+
+	if c.KahuCert != "" || c.KahuKey != "" {
+		if c.KahuCert == "" || c.KahuKey == "" {
+			return nil, errors.New("both kahu_cert and kahu_key are required for a client certificate")
+		}
+
+		cert, err := tls.LoadX509KeyPair(c.KahuCert, c.KahuKey)
+		if err != nil {
+			return nil, fmt.Errorf("could not load kahu key pair: %s", err)
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+
+	transport.TLSClientConfig = conf
+	return transport, nil
+}
+
+// Keeps connections to Kahu alive between heartbeats so that requests on
+// short intervals do not each pay for a TCP and TLS handshake. The transport
+// only keeps a few idle connections since all requests go to the same host.
+func (c *Config) tuneTransport(transport *http.Transport) (err error) {
+	if transport.IdleConnTimeout, err = c.GetAPIIdleTimeout(); err != nil {
+		return err
+	}
+
+	if transport.TLSHandshakeTimeout, err = c.GetAPITLSTimeout(); err != nil {
+		return err
+	}
+
+	transport.MaxIdleConns = c.APIMaxIdleConns
+	transport.MaxIdleConnsPerHost = c.APIMaxIdleConns
+	transport.DisableKeepAlives = c.APIMaxIdleConns == 0
+	transport.DisableCompression = !c.APICompression
+	return nil
+}
@@ -0,0 +1,243 @@
+package agent
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// Defaults for hop-by-hop traceroutes to neighbors.
+const (
+	DefaultTraceHops    = 30               // maximum number of hops before giving up
+	DefaultTraceQueries = 3                // number of probes sent to each hop
+	DefaultTraceWait    = 2 * time.Second  // time to wait for the reply to each probe
+	traceBasePort       = 33434            // first destination port of the UDP probes
+	icmpTimeExceeded    = 11               // ICMP type sent by routers when the TTL expires
+	icmpUnreachable     = 3                // ICMP type sent by the target for a closed port
+	icmpPortUnreachable = 3                // ICMP code for a closed port
+	traceReadBuffer     = 1500             // size of the buffer to read ICMP replies into
+	tracePayload        = "kekahu-tracert" // payload of the UDP probes
+)
+
+// TraceOptions configure a traceroute; zero values use the defaults.
+type TraceOptions struct {
+	MaxHops int           // maximum number of hops before giving up
+	Queries int           // number of probes sent to each hop
+	Wait    time.Duration // time to wait for the reply to each probe
+	Resolve bool          // look up the hostnames of the hops
+}
+
+// Route is the result of a traceroute to a target.
+type Route struct {
+	Target  string        `json:"target"`             // the address that was traced
+	Hops    []*RouteHop   `json:"hops"`               // the hops to the target in order
+	Reached bool          `json:"reached"`            // whether the target replied
+	Echo    time.Duration `json:"echo,omitempty"`     // latency of the gRPC echo ping, if sent
+	EchoErr string        `json:"echo_err,omitempty"` // error of the gRPC echo ping, if it failed
+}
+
+// RouteHop is a router (or the target) on the path to the target and the
+// round trip time of each probe sent to it, zero if the probe timed out.
+type RouteHop struct {
+	TTL  int             `json:"ttl"`            // the time to live of the probes
+	Addr string          `json:"addr,omitempty"` // the address that replied, empty if none did
+	Name string          `json:"name,omitempty"` // the hostname of the address if resolved
+	RTTs []time.Duration `json:"rtts"`           // round trip time of each probe
+}
+
+// Last returns the round trip time of the last hop that replied, which is the
+// network latency to the target if it was reached.
+func (r *Route) Last() time.Duration {
+	for i := len(r.Hops) - 1; i >= 0; i-- {
+		if rtt := r.Hops[i].Best(); rtt > 0 {
+			return rtt
+		}
+	}
+	return 0
+}
+
+// Best returns the fastest round trip time to the hop, zero if all timed out.
+func (h *RouteHop) Best() time.Duration {
+	var best time.Duration
+	for _, rtt := range h.RTTs {
+		if rtt > 0 && (best == 0 || rtt < best) {
+			best = rtt
+		}
+	}
+	return best
+}
+
+// Traceroute sends UDP probes to the IPv4 address with increasing TTLs and
+// listens for the ICMP time exceeded replies from each router on the path
+// until the target replies that the port is unreachable. Listening for ICMP
+// requires a raw socket, so the process must be run as root (or have the
+// CAP_NET_RAW capability on Linux).
+func Traceroute(ctx context.Context, addr string, opts *TraceOptions) (*Route, error) {
+	if opts == nil {
+		opts = new(TraceOptions)
+	}
+
+	maxHops, queries, wait := opts.MaxHops, opts.Queries, opts.Wait
+	if maxHops <= 0 {
+		maxHops = DefaultTraceHops
+	}
+	if queries <= 0 {
+		queries = DefaultTraceQueries
+	}
+	if wait <= 0 {
+		wait = DefaultTraceWait
+	}
+
+	// Resolve the target, stripping any port from the address
+	host := addr
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		host = h
+	}
+
+	target, err := net.ResolveIPAddr("ip4", host)
+	if err != nil {
+		return nil, fmt.Errorf("could not resolve IPv4 address of %s: %s", host, err)
+	}
+
+	icmp, err := net.ListenPacket("ip4:icmp", "0.0.0.0")
+	if err != nil {
+		return nil, fmt.Errorf("could not listen for ICMP replies (traceroute requires root): %s", err)
+	}
+	defer icmp.Close()
+
+	route := &Route{Target: target.String(), Hops: make([]*RouteHop, 0, maxHops)}
+	for ttl := 1; ttl <= maxHops && !route.Reached; ttl++ {
+		hop := &RouteHop{TTL: ttl, RTTs: make([]time.Duration, queries)}
+		for query := 0; query < queries; query++ {
+			if err := ctx.Err(); err != nil {
+				return route, err
+			}
+
+			port := traceBasePort + (ttl-1)*queries + query
+			from, rtt, reached, err := traceProbe(ctx, icmp, target.IP, port, ttl, wait)
+			if err != nil {
+				return route, err
+			}
+
+			if from != "" {
+				hop.Addr = from
+				hop.RTTs[query] = rtt
+				route.Reached = route.Reached || reached
+			}
+		}
+
+		if hop.Addr != "" && opts.Resolve {
+			if names, err := net.LookupAddr(hop.Addr); err == nil && len(names) > 0 {
+				hop.Name = strings.TrimSuffix(names[0], ".")
+			}
+		}
+
+		route.Hops = append(route.Hops, hop)
+	}
+
+	return route, nil
+}
+
+// Traceroute performs a traceroute to the neighbor at the address and then sends a
+// echo ping to it, so that the network latency to the host can be
+// compared to the application latency of the kekahu echo server.
+func (k *KeKahu) Traceroute(ctx context.Context, source, target, addr string, opts *TraceOptions) (*Route, error) {
+	route, err := Traceroute(ctx, addr, opts)
+	if err != nil {
+		return route, err
+	}
+
+	latency, err := k.Ping(ctx, source, target, addr, k.network.Next(target))
+	if err != nil {
+		route.EchoErr = err.Error()
+	} else {
+		route.Echo = latency
+	}
+
+	return route, nil
+}
+
+//===========================================================================
+// Helpers
+//===========================================================================
+
+// Sends a single UDP probe to the destination port with the ttl and waits for
+// the matching ICMP reply, returning the address that replied (empty if the
+// probe timed out), the round trip time, and whether the target was reached.
+func traceProbe(ctx context.Context, icmp net.PacketConn, dst net.IP, port, ttl int, wait time.Duration) (string, time.Duration, bool, error) {
+	conn, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: dst, Port: port})
+	if err != nil {
+		return "", 0, false, fmt.Errorf("could not create probe: %s", err)
+	}
+	defer conn.Close()
+
+	if err = setTTL(conn, ttl); err != nil {
+		return "", 0, false, fmt.Errorf("could not set probe ttl: %s", err)
+	}
+
+	deadline := time.Now().Add(wait)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	icmp.SetReadDeadline(deadline)
+
+	start := time.Now()
+	if _, err = conn.Write([]byte(tracePayload)); err != nil {
+		return "", 0, false, fmt.Errorf("could not send probe: %s", err)
+	}
+
+	buf := make([]byte, traceReadBuffer)
+	for {
+		n, from, err := icmp.ReadFrom(buf)
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				return "", 0, false, nil
+			}
+			return "", 0, false, fmt.Errorf("could not read ICMP reply: %s", err)
+		}
+		rtt := time.Since(start)
+
+		kind, code, origDst, origPort, err := parseICMPReply(buf[:n])
+		if err != nil || origPort != port || !origDst.Equal(dst) {
+			// Not a reply to this probe, keep waiting
+			continue
+		}
+
+		switch kind {
+		case icmpTimeExceeded:
+			return from.String(), rtt, false, nil
+		case icmpUnreachable:
+			return from.String(), rtt, code == icmpPortUnreachable, nil
+		}
+	}
+}
+
+// Parses an ICMP error message, returning the type and code along with the
+// destination address and port of the original UDP probe that caused it.
+func parseICMPReply(msg []byte) (kind, code int, dst net.IP, port int, err error) {
+	// Some platforms include the IPv4 header of the reply, strip it if present
+	if len(msg) > 20 && msg[0]>>4 == 4 {
+		msg = msg[int(msg[0]&0x0f)*4:]
+	}
+
+	// The ICMP header is 8 bytes followed by the original IPv4 header and the
+	// first 8 bytes of the original datagram (the UDP header).
+	if len(msg) < 8+20 {
+		return 0, 0, nil, 0, errors.New("ICMP message too short")
+	}
+
+	kind, code = int(msg[0]), int(msg[1])
+	orig := msg[8:]
+	ihl := int(orig[0]&0x0f) * 4
+	if orig[0]>>4 != 4 || orig[9] != 17 || len(orig) < ihl+4 {
+		return 0, 0, nil, 0, errors.New("ICMP message is not in reply to a UDP probe")
+	}
+
+	dst = net.IP(orig[16:20])
+	port = int(binary.BigEndian.Uint16(orig[ihl+2 : ihl+4]))
+	return kind, code, dst, port, nil
+}
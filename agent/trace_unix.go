@@ -0,0 +1,25 @@
+//go:build !windows
+// +build !windows
+
+package agent
+
+import (
+	"net"
+	"syscall"
+)
+
+// Sets the IPv4 time to live of packets sent on the connection.
+func setTTL(conn *net.UDPConn, ttl int) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var serr error
+	if err = raw.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TTL, ttl)
+	}); err != nil {
+		return err
+	}
+	return serr
+}
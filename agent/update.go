@@ -0,0 +1,378 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/blang/semver"
+)
+
+// Defaults for checking for and downloading new releases.
+const (
+	DefaultUpdateURL     = "https://api.github.com/repos/bbengfort/kekahu/releases/latest"
+	DefaultUpdateTimeout = 5 * time.Minute
+)
+
+// ReleaseKey is the base64 encoded ed25519 public key that release binaries
+// are signed with, pinned when the binary is linked, e.g. with
+// -ldflags "-X github.com/bbengfort/kekahu/agent.ReleaseKey=$(RELEASE_KEY)"
+// (see the Makefile). Releases are not installed unless they are signed with
+// this key, the update_key of the configuration is only used if no key is
+// pinned.
+var ReleaseKey string
+
+// ReleaseManifest returns the manifest of a release binary that is signed by
+// its detached signature. The manifest binds the checksum of the binary to the
+// version and platform of the release, e.g.
+//
+//	kekahu v1.7 linux/amd64 sha256:<hex encoded checksum>
+//
+// so that a signed binary of one release cannot be served as another release
+// or for another platform.
+func ReleaseManifest(version, goos, goarch, checksum string) []byte {
+	return []byte(fmt.Sprintf("kekahu %s %s/%s sha256:%s", version, goos, goarch, strings.ToLower(checksum)))
+}
+
+// Release describes a published kekahu release in the format returned by the
+// GitHub releases API, which Kahu can also serve to manage fleet versions.
+type Release struct {
+	Version string          `json:"tag_name"` // the version tag of the release, e.g. v1.7
+	Assets  []*ReleaseAsset `json:"assets"`   // the binaries and checksums of the release
+}
+
+// ReleaseAsset is a file attached to a release.
+type ReleaseAsset struct {
+	Name string `json:"name"`                 // the name of the file
+	URL  string `json:"browser_download_url"` // the url to download the file from
+}
+
+// CheckUpdate fetches the latest release from the url and returns it along
+// with whether or not it is newer than the running version.
+func CheckUpdate(ctx context.Context, url string) (*Release, bool, error) {
+	res, err := fetch(ctx, url)
+	if err != nil {
+		return nil, false, fmt.Errorf("could not check for updates: %s", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return nil, false, fmt.Errorf("could not check for updates: %s", res.Status)
+	}
+
+	release := new(Release)
+	if err := json.NewDecoder(res.Body).Decode(release); err != nil {
+		return nil, false, fmt.Errorf("could not parse release: %s", err)
+	}
+
+	latest, err := semver.ParseTolerant(release.Version)
+	if err != nil {
+		return nil, false, fmt.Errorf("could not parse release version: %s", err)
+	}
+
+	current, err := semver.ParseTolerant(PackageVersion)
+	if err != nil {
+		return nil, false, fmt.Errorf("could not parse package version: %s", err)
+	}
+
+	return release, latest.GT(current), nil
+}
+
+// Binary returns the release asset for the current platform along with its
+// SHA256 checksum and the ed25519 signature of its manifest, named
+// kekahu-GOOS-GOARCH, kekahu-GOOS-GOARCH.sha256, and kekahu-GOOS-GOARCH.sig.
+func (r *Release) Binary() (binary, checksum, signature *ReleaseAsset, err error) {
+	name := fmt.Sprintf("kekahu-%s-%s", runtime.GOOS, runtime.GOARCH)
+	for _, asset := range r.Assets {
+		switch asset.Name {
+		case name:
+			binary = asset
+		case name + ".sha256":
+			checksum = asset
+		case name + ".sig":
+			signature = asset
+		}
+	}
+
+	if binary == nil {
+		return nil, nil, nil, fmt.Errorf("release %s has no binary for %s/%s", r.Version, runtime.GOOS, runtime.GOARCH)
+	}
+
+	if checksum == nil {
+		return nil, nil, nil, fmt.Errorf("release %s has no checksum for %s", r.Version, name)
+	}
+
+	if signature == nil {
+		return nil, nil, nil, fmt.Errorf("release %s has no signature for %s", r.Version, name)
+	}
+
+	return binary, checksum, signature, nil
+}
+
+// Install downloads the binary for the current platform, verifies it against
+// the published checksum, whose manifest must be signed with the public key
+// (see ReleaseManifest), and atomically replaces the running executable. The
+// signature ensures that the release was published by the holder of the
+// private key rather than whoever controls the release endpoint, and that the
+// checksum belongs to this version and platform. The new binary is not used
+// until the process is restarted.
+func (r *Release) Install(ctx context.Context, key ed25519.PublicKey) error {
+	if len(key) != ed25519.PublicKeySize {
+		return errors.New("no release signing key is pinned, cannot verify the release")
+	}
+
+	binary, checksum, signature, err := r.Binary()
+	if err != nil {
+		return err
+	}
+
+	// Locate the running executable, resolving any symlinks to it
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("could not find executable: %s", err)
+	}
+
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return fmt.Errorf("could not find executable: %s", err)
+	}
+
+	// Fetch the expected checksum of the binary
+	expected, err := fetchChecksum(ctx, checksum.URL)
+	if err != nil {
+		return err
+	}
+
+	// Verify the signature of the manifest before downloading the binary, so
+	// that only the binary the holder of the private key published is used
+	sig, err := fetchSignature(ctx, signature.URL)
+	if err != nil {
+		return err
+	}
+
+	if !ed25519.Verify(key, ReleaseManifest(r.Version, runtime.GOOS, runtime.GOARCH, expected), sig) {
+		return fmt.Errorf("invalid signature for %s %s, the release was not signed with the pinned key", binary.Name, r.Version)
+	}
+
+	// Download the binary to the same directory so the rename is atomic
+	tmp, err := ioutil.TempFile(filepath.Dir(exe), ".kekahu-update-")
+	if err != nil {
+		return fmt.Errorf("could not create update file: %s", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	actual, err := download(ctx, binary.URL, tmp)
+	tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	if actual != expected {
+		return fmt.Errorf("checksum mismatch for %s: expected %s got %s", binary.Name, expected, actual)
+	}
+
+	if err := os.Chmod(tmp.Name(), 0755); err != nil {
+		return fmt.Errorf("could not make update executable: %s", err)
+	}
+
+	if err := replaceExecutable(tmp.Name(), exe); err != nil {
+		return fmt.Errorf("could not replace executable: %s", err)
+	}
+
+	status("installed kekahu %s to %s", r.Version, exe)
+	return nil
+}
+
+//===========================================================================
+// KeKahu Auto Update
+//===========================================================================
+
+// AutoUpdate checks for a new release and if there is one, installs it and
+// stops the service so that Run restarts it. Otherwise it schedules the next
+// update check. Releases are only installed by the kekahu run process, never
+// by programs that embed the service, since the running executable is replaced.
+func (k *KeKahu) AutoUpdate(ctx context.Context) {
+	if !k.conf().AutoUpdate || ctx.Err() != nil {
+		return
+	}
+
+	if err := k.restartable(); err != nil {
+		k.echan <- updateLog.wrap(fmt.Errorf("auto_update is disabled: %s", err))
+		return
+	}
+
+	key, err := k.conf().GetUpdateKey()
+	if err != nil {
+		k.echan <- updateLog.wrap(fmt.Errorf("auto_update is disabled: %s", err))
+		return
+	}
+
+	release, newer, err := CheckUpdate(ctx, k.conf().GetUpdateURL())
+	if err != nil {
+		k.echan <- updateLog.wrap(err)
+		k.scheduleUpdate()
+		return
+	}
+
+	if !newer {
+		debug("kekahu %s is up to date (latest is %s)", PackageVersion, release.Version)
+		k.scheduleUpdate()
+		return
+	}
+
+	if err := release.Install(ctx, key); err != nil {
+		k.echan <- updateLog.wrap(err)
+		k.scheduleUpdate()
+		return
+	}
+
+	// Stop the service in the background (Shutdown waits for this task) so
+	// that the state is saved, then Run restarts into the new release
+	k.tasksm.Lock()
+	k.restart = release.Version
+	k.tasksm.Unlock()
+	go k.Stop()
+}
+
+// Schedules the next automatic check for new releases.
+func (k *KeKahu) scheduleUpdate() {
+	if interval, err := k.conf().GetUpdateInterval(); err == nil {
+		k.schedule(interval, k.AutoUpdate)
+	}
+}
+
+// Returns an error if the process cannot be replaced by a new release: the
+// service must have been started by Run from the kekahu executable.
+func (k *KeKahu) restartable() error {
+	k.tasksm.Lock()
+	running := k.running
+	k.tasksm.Unlock()
+
+	if !running {
+		return errors.New("the service was not started by kekahu run")
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("could not find executable: %s", err)
+	}
+
+	if name := strings.TrimSuffix(filepath.Base(exe), ".exe"); name != "kekahu" {
+		return fmt.Errorf("the service is embedded in %s rather than the kekahu executable", name)
+	}
+	return nil
+}
+
+// Returns the version of the release installed by AutoUpdate that the process
+// should be restarted into once the service has stopped, if any.
+func (k *KeKahu) restartVersion() string {
+	k.tasksm.Lock()
+	defer k.tasksm.Unlock()
+	return k.restart
+}
+
+//===========================================================================
+// Helpers
+//===========================================================================
+
+// Fetches the hex encoded SHA256 checksum from a checksum file, which may be
+// in the format output by sha256sum (checksum followed by the filename).
+func fetchChecksum(ctx context.Context, url string) (string, error) {
+	res, err := fetch(ctx, url)
+	if err != nil {
+		return "", fmt.Errorf("could not fetch checksum: %s", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return "", fmt.Errorf("could not fetch checksum: %s", res.Status)
+	}
+
+	scanner := bufio.NewScanner(res.Body)
+	if !scanner.Scan() {
+		return "", errors.New("checksum file is empty")
+	}
+
+	fields := strings.Fields(scanner.Text())
+	if len(fields) == 0 {
+		return "", errors.New("checksum file is empty")
+	}
+	return strings.ToLower(fields[0]), nil
+}
+
+// Fetches the base64 encoded detached ed25519 signature of a binary.
+func fetchSignature(ctx context.Context, url string) ([]byte, error) {
+	res, err := fetch(ctx, url)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch signature: %s", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return nil, fmt.Errorf("could not fetch signature: %s", res.Status)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch signature: %s", err)
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return nil, errors.New("signature file is not a base64 encoded ed25519 signature")
+	}
+	return sig, nil
+}
+
+// Parses a base64 encoded ed25519 public key.
+func parseReleaseKey(value string) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("not a base64 encoded ed25519 public key")
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// Downloads the url to the writer, returning the hex encoded SHA256 checksum.
+func download(ctx context.Context, url string, w io.Writer) (string, error) {
+	res, err := fetch(ctx, url)
+	if err != nil {
+		return "", fmt.Errorf("could not download update: %s", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return "", fmt.Errorf("could not download update: %s", res.Status)
+	}
+
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(w, hash), res.Body); err != nil {
+		return "", fmt.Errorf("could not download update: %s", err)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Performs a GET request to the url that is canceled with the context.
+func fetch(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{Timeout: DefaultUpdateTimeout}
+	return client.Do(req.WithContext(ctx))
+}
@@ -0,0 +1,27 @@
+//go:build !windows
+// +build !windows
+
+package agent
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// Replaces the executable with the downloaded release, the rename is atomic
+// and the running process keeps the replaced file open until it exits.
+func replaceExecutable(path, exe string) error {
+	return os.Rename(path, exe)
+}
+
+// Restart replaces the current process with the executable on disk, using the
+// same arguments and environment (and therefore the same process id).
+func Restart() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("could not find executable: %s", err)
+	}
+
+	return syscall.Exec(exe, os.Args, os.Environ())
+}
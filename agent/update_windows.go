@@ -0,0 +1,33 @@
+//go:build windows
+// +build windows
+
+package agent
+
+import "os"
+
+// Replaces the executable with the downloaded release. The running executable
+// can't be replaced or removed on Windows, but it can be renamed, so it is
+// moved out of the way to exe.old first, which is removed by the next update.
+func replaceExecutable(path, exe string) error {
+	old := exe + ".old"
+	if err := os.Remove(old); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := os.Rename(exe, old); err != nil {
+		return err
+	}
+
+	if err := os.Rename(path, exe); err != nil {
+		os.Rename(old, exe)
+		return err
+	}
+	return nil
+}
+
+// Restart returns without restarting, since the process can't be replaced on
+// Windows. The service has reported that it stopped on its own, so the
+// recovery actions of the service start the new release once kekahu run exits.
+func Restart() error {
+	return nil
+}
@@ -0,0 +1,166 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/bbengfort/kekahu/kahu"
+)
+
+// ValidationResult is the outcome of a single check performed by Validate.
+type ValidationResult struct {
+	Check   string `json:"check"`   // the name of the check
+	Passed  bool   `json:"passed"`  // whether or not the check passed
+	Message string `json:"message"` // details about the result of the check
+}
+
+// Validate checks that the service is ready to run on this host by checking
+// that the Kahu URL is reachable, that the API key is accepted by Kahu, and
+// that the files the service writes to are writable. The configuration itself
+// is validated by New. All checks are performed even if earlier ones fail.
+func (k *KeKahu) Validate(ctx context.Context) []*ValidationResult {
+	results := make([]*ValidationResult, 0)
+	check := func(name string, err error, message string) {
+		result := &ValidationResult{Check: name, Passed: err == nil, Message: message}
+		if err != nil {
+			result.Message = err.Error()
+		}
+		results = append(results, result)
+	}
+
+	if client, ok := k.httpClient(); ok {
+		// Check that Kahu can be reached at all, without authentication
+		status, err := client.checkURL(ctx)
+		check("kahu url", err, fmt.Sprintf("%s responded %s", k.conf().URL, status))
+
+		// Check that the API key authenticates with Kahu
+		_, err = client.checkAPIKey(ctx)
+		check("api key", err, "api key accepted by Kahu")
+	} else {
+		// Other clients are checked by fetching the replicas
+		_, err := k.api.Replicas(ctx)
+		check("kahu client", err, "replicas fetched from Kahu")
+	}
+
+	// Check the files the service writes to
+	check("peers path", checkWritable(k.conf().PeersPath), k.conf().PeersPath+" is writable")
+
+	if strings.ToLower(k.conf().PeersFormat) == JSONFormat {
+		if _, err := os.Stat(k.conf().PeersPath); err == nil {
+			_, err := LoadPeers(k.conf().PeersPath)
+			check("peers file", err, k.conf().PeersPath+" checksum verified")
+		}
+	}
+	check("pid path", checkWritable(k.conf().GetPidPath()), k.conf().GetPidPath()+" is writable")
+
+	if k.conf().PersistLatency {
+		check("latency path", checkWritable(k.conf().GetLatencyPath()), k.conf().GetLatencyPath()+" is writable")
+	}
+
+	if k.conf().GetSpoolPath() != "" {
+		check("spool path", checkWritable(k.conf().GetSpoolPath()), k.conf().GetSpoolPath()+" is writable")
+	}
+
+	if k.conf().HealthHook != "" {
+		check("health hook", checkExecutable(k.conf().HealthHook), k.conf().HealthHook+" is executable")
+	}
+
+	if hooks, err := k.conf().GetHooks(); err == nil {
+		for _, hook := range hooks {
+			path, err := exec.LookPath(hook.Command[0])
+			check(hook.Event+" hook", err, path+" is executable")
+		}
+	}
+
+	return results
+}
+
+// Makes an unauthenticated request to the base URL, returning the status.
+func (c *HTTPClient) checkURL(ctx context.Context) (string, error) {
+	config := c.config.Load()
+	req, err := http.NewRequest(http.MethodGet, config.URL, nil)
+	if err != nil {
+		return "", fmt.Errorf("could not create request: %s", err)
+	}
+
+	timeout, err := config.GetAPITimeout()
+	if err != nil {
+		return "", err
+	}
+
+	client := &http.Client{Timeout: timeout, Transport: c.transport}
+	res, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", fmt.Errorf("could not reach %s: %s", config.URL, err)
+	}
+	kahu.CloseResponse(res)
+
+	return res.Status, nil
+}
+
+// Makes a single authenticated request to Kahu to check the API key, returning
+// true if the request failed because Kahu rejected the key.
+func (c *HTTPClient) checkAPIKey(ctx context.Context) (bool, error) {
+	res, err := c.Request(ctx, &kahu.APIRequest{Endpoint: kahu.ReplicasEndpoint})
+	if err != nil {
+		return false, err
+	}
+
+	if res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden {
+		kahu.CloseResponse(res)
+		return true, fmt.Errorf("api key was rejected by Kahu: %s", res.Status)
+	}
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		kahu.CloseResponse(res)
+		return false, &kahu.APIError{StatusCode: res.StatusCode, Status: res.Status}
+	}
+	return false, kahu.CloseResponse(res)
+}
+
+// Checks that the file at the path can be written to without modifying it,
+// or if it doesn't exist, that a file can be created in its directory.
+func checkWritable(path string) error {
+	info, err := os.Stat(path)
+	if err == nil {
+		if info.IsDir() {
+			return fmt.Errorf("%s is a directory", path)
+		}
+
+		f, err := os.OpenFile(path, os.O_WRONLY, 0)
+		if err != nil {
+			return fmt.Errorf("%s is not writable: %s", path, err)
+		}
+		return f.Close()
+	}
+
+	if !os.IsNotExist(err) {
+		return fmt.Errorf("could not stat %s: %s", path, err)
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), ".kekahu-validate-")
+	if err != nil {
+		return fmt.Errorf("%s cannot be created: %s", path, err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// Checks that the file at the path exists and can be executed.
+func checkExecutable(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("could not stat %s: %s", path, err)
+	}
+
+	if info.IsDir() || info.Mode()&0111 == 0 {
+		return fmt.Errorf("%s is not executable", path)
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	rdebug "runtime/debug"
+	"strings"
+
+	"github.com/bbengfort/kekahu/kahu"
+)
+
+// Build metadata that is set when the binary is linked, e.g. with
+// -ldflags "-X github.com/bbengfort/kekahu/agent.GitCommit=$(git rev-parse --short HEAD)"
+// (see the Makefile). If the commit is not set it is read from the version
+// control information that go build embeds in module mode, if any.
+var (
+	GitCommit string // the git commit the binary was built from
+	BuildDate string // when the binary was built, in RFC 3339 format
+)
+
+//===========================================================================
+// Version Information
+//===========================================================================
+
+// VersionInfo describes the build of the kekahu binary and, if it could be
+// requested, the version of the Kahu API it reports to.
+type VersionInfo struct {
+	Version   string        `json:"version"`              // semantic version of kekahu
+	GitCommit string        `json:"git_commit,omitempty"` // the git commit kekahu was built from
+	BuildDate string        `json:"build_date,omitempty"` // when kekahu was built
+	GoVersion string        `json:"go_version"`           // the Go version kekahu was built with
+	Platform  string        `json:"platform"`             // the os/arch kekahu was built for
+	Kahu      *kahu.Version `json:"kahu,omitempty"`       // the version reported by Kahu, if requested
+}
+
+// BuildInfo returns the version information of the kekahu binary.
+func BuildInfo() *VersionInfo {
+	info := &VersionInfo{
+		Version:   PackageVersion,
+		GitCommit: GitCommit,
+		BuildDate: BuildDate,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+	}
+
+	if build, ok := rdebug.ReadBuildInfo(); ok {
+		for _, setting := range build.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				if info.GitCommit == "" && len(setting.Value) >= 7 {
+					info.GitCommit = setting.Value[:7]
+				}
+			case "vcs.time":
+				if info.BuildDate == "" {
+					info.BuildDate = setting.Value
+				}
+			}
+		}
+	}
+	return info
+}
+
+// String returns the version information on a single line, e.g. "kekahu 1.6
+// (commit 4ea5178, built 2019-02-01T12:00:00Z, go1.11 linux/amd64)".
+func (v *VersionInfo) String() string {
+	details := make([]string, 0, 3)
+	if v.GitCommit != "" {
+		details = append(details, "commit "+v.GitCommit)
+	}
+	if v.BuildDate != "" {
+		details = append(details, "built "+v.BuildDate)
+	}
+	details = append(details, v.GoVersion+" "+v.Platform)
+
+	s := fmt.Sprintf("kekahu %s (%s)", v.Version, strings.Join(details, ", "))
+	if v.Kahu != nil {
+		s += "\n" + v.Kahu.String()
+	}
+	return s
+}
+
+// NegotiateSchemas requests the schemas of the heartbeats, latency reports,
+// and health reports that Kahu accepts, so that the service keeps reporting
+// to a Kahu server that is older than it. If Kahu cannot be asked, the latest
+// schemas are sent and each is downgraded if Kahu rejects it as a bad
+// request. Nothing is negotiated if api_schema pins the schema or with mock
+// clients; additional upstreams only downgrade the schemas they reject.
+func (k *KeKahu) NegotiateSchemas(ctx context.Context) {
+	client, ok := k.httpClient()
+	if !ok {
+		return
+	}
+
+	version, err := client.Negotiate(ctx)
+	if err != nil {
+		heartbeatLog.warn("could not negotiate the report schemas with kahu, sending the latest schemas: %s", err)
+		return
+	}
+
+	if version != nil {
+		heartbeatLog.info("%s accepts heartbeat schema %d, latency schema %d, health schema %d", version,
+			version.Schema(kahu.HeartbeatSchema), version.Schema(kahu.LatencySchema), version.Schema(kahu.HealthSchema))
+	}
+}
+
+// APISchemas returns the schema version each report is sent to Kahu with,
+// nil if they are not sent with the HTTP client.
+func (k *KeKahu) APISchemas() map[string]int {
+	client, ok := k.httpClient()
+	if !ok {
+		return nil
+	}
+
+	schemas := make(map[string]int)
+	for _, payload := range kahu.Schemas() {
+		schemas[payload] = client.Schema(payload)
+	}
+	return schemas
+}
+
+// KahuVersion requests the version of the Kahu server and its API. It is only
+// supported by the HTTP client, not by mock clients.
+func (k *KeKahu) KahuVersion(ctx context.Context) (*kahu.Version, error) {
+	client, ok := k.httpClient()
+	if !ok {
+		return nil, errors.New("the kahu version can only be requested from the http client")
+	}
+	return client.Version(ctx)
+}
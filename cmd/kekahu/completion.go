@@ -0,0 +1,26 @@
+package main
+
+// Completion scripts that ask kekahu for the commands and flags that can
+// follow the words typed so far using the --generate-bash-completion flag.
+const bashCompletion = `_kekahu_complete() {
+  local cur opts
+  COMPREPLY=()
+  cur="${COMP_WORDS[COMP_CWORD]}"
+  if [[ "$cur" == "-"* ]]; then
+    opts=$( ${COMP_WORDS[@]:0:$COMP_CWORD} ${cur} --generate-bash-completion )
+  else
+    opts=$( ${COMP_WORDS[@]:0:$COMP_CWORD} --generate-bash-completion )
+  fi
+  COMPREPLY=( $(compgen -W "${opts}" -- ${cur}) )
+  return 0
+}
+
+complete -o bashdefault -o default -F _kekahu_complete kekahu
+`
+
+// Zsh loads the bash completion script with bashcompinit.
+const zshCompletion = `#compdef kekahu
+autoload -U +X compinit && compinit
+autoload -U +X bashcompinit && bashcompinit
+
+`
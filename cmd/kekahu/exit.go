@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/bbengfort/kekahu/agent"
+	"github.com/bbengfort/kekahu/kahu"
+	"github.com/urfave/cli"
+)
+
+// Exit codes of the kekahu command so that scripts and process supervisors
+// can tell why a command failed without parsing its error message.
+const (
+	ExitOK          = 0 // the command succeeded
+	ExitFailure     = 1 // the command failed for any other reason
+	ExitConfig      = 2 // the configuration could not be loaded or is invalid
+	ExitAuth        = 3 // Kahu rejected the api key
+	ExitUnreachable = 4 // Kahu or the running service could not be reached
+	ExitUnhealthy   = 5 // the host has health alerts or validation checks failed
+	ExitNotRunning  = 6 // the kekahu service is not running
+	ExitUsage       = 7 // the command was called with invalid arguments
+	ExitRunning     = 8 // another kekahu service is already running
+)
+
+// The kind of error reported with each exit code in JSON errors.
+var exitKinds = map[int]string{
+	ExitFailure:     "failure",
+	ExitConfig:      "config",
+	ExitAuth:        "auth",
+	ExitUnreachable: "unreachable",
+	ExitUnhealthy:   "unhealthy",
+	ExitNotRunning:  "not_running",
+	ExitUsage:       "usage",
+	ExitRunning:     "already_running",
+}
+
+// If true, errors are written to stderr as JSON, set by the --json flag.
+var jsonErrors bool
+
+// A command error written to stderr with the --json flag.
+type exitMessage struct {
+	Error string `json:"error"`
+	Code  int    `json:"code"`
+	Kind  string `json:"kind"`
+}
+
+// Returns an error that exits the command with the code. If the --json flag
+// is set the error is written to stderr as JSON, otherwise the message of the
+// error is printed by the cli when it exits.
+func exitError(err error, code int) error {
+	if !jsonErrors {
+		return cli.NewExitError(err.Error(), code)
+	}
+
+	data, _ := json.Marshal(&exitMessage{Error: err.Error(), Code: code, Kind: exitKinds[code]})
+	fmt.Fprintln(os.Stderr, string(data))
+	return cli.NewExitError("", code)
+}
+
+// Returns an error with a formatted message that exits with the code.
+func exitErrorf(code int, format string, a ...interface{}) error {
+	return exitError(fmt.Errorf(format, a...), code)
+}
+
+// Returns an error that exits with the code for the type of the error, errors
+// that already have an exit code are returned unchanged.
+func fail(err error) error {
+	if exit, ok := err.(cli.ExitCoder); ok {
+		return exit
+	}
+	return exitError(err, exitCode(err))
+}
+
+// Returns the exit code for errors from the kekahu package.
+func exitCode(err error) int {
+	switch err := err.(type) {
+	case *kahu.APIError:
+		if err.Unauthorized() {
+			return ExitAuth
+		}
+	case *kahu.RequestError, net.Error:
+		return ExitUnreachable
+	case *agent.ComponentError:
+		return exitCode(err.Err)
+	case *agent.AlreadyRunningError:
+		return ExitRunning
+	}
+
+	if err == agent.ErrNotRunning {
+		return ExitNotRunning
+	}
+	return ExitFailure
+}
@@ -1,11 +1,25 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
 
-	"github.com/bbengfort/kekahu"
+	"github.com/bbengfort/kekahu/agent"
+	"github.com/bbengfort/kekahu/doctor"
+	"github.com/bbengfort/kekahu/kahu"
+	knet "github.com/bbengfort/kekahu/net"
 	"github.com/joho/godotenv"
 	"github.com/koding/multiconfig"
 	"github.com/urfave/cli"
@@ -19,35 +33,103 @@ func main() {
 	// TODO: keep KeKahu version consistent with Kahu version
 	app := cli.NewApp()
 	app.Name = "kekahu"
-	app.Version = kekahu.PackageVersion
+	app.Version = agent.PackageVersion
+	cli.VersionPrinter = func(c *cli.Context) { fmt.Println(agent.BuildInfo()) }
 	app.Usage = "Keep alive client for the Kahu service"
+	app.EnableBashCompletion = true
+	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:   "profile",
+			Usage:  "apply the named profile from the config file, e.g. staging",
+			EnvVar: agent.ProfileEnv,
+		},
+		cli.StringFlag{
+			Name:   "k, key",
+			Usage:  "api key of the local host",
+			EnvVar: "KEKAHU_API_KEY",
+		},
+		cli.StringFlag{
+			Name:   "u, url",
+			Usage:  "kahu service url if different from default",
+			EnvVar: "KEKAHU_URL",
+		},
+		cli.IntFlag{
+			Name:   "verbosity",
+			Usage:  "set log level from 0-5, lower is more verbose",
+			EnvVar: "KEKAHU_VERBOSITY",
+		},
+		cli.StringFlag{
+			Name:   "log-format",
+			Usage:  "log output format, either text or json",
+			EnvVar: "KEKAHU_LOG_FORMAT",
+		},
+		cli.BoolFlag{
+			Name:   "json",
+			Usage:  "write errors to stderr as JSON with the exit code",
+			EnvVar: "KEKAHU_JSON_ERRORS",
+		},
+		cli.BoolFlag{
+			Name:   "trace-http",
+			Usage:  "log the sanitized http requests and responses exchanged with kahu",
+			EnvVar: "KEKAHU_TRACE_HTTP",
+		},
+		cli.StringFlag{
+			Name:  "env-file",
+			Usage: "load environment variables such as the api key from the file",
+		},
+	}
+	app.Before = setGlobals
 
 	app.Commands = []cli.Command{
 		{
 			Name:   "run",
 			Usage:  "run the kahu heartbeat program",
-			Before: initClient,
+			Before: initService,
 			Action: run,
 			Flags: []cli.Flag{
 				cli.StringFlag{
 					Name:   "d, delay",
-					Usage:  "parsable duration of the delay between heartbeats",
+					Usage:  "delay between heartbeats, or cron expressions or time windows, e.g. \"* 9-17 * * mon-fri 1m; 15m\"",
 					EnvVar: "KEKAHU_INTERVAL",
 				},
 				cli.StringFlag{
-					Name:   "k, key",
-					Usage:  "api key of the local host",
-					EnvVar: "KEKAHU_API_KEY",
+					Name:   "j, jitter",
+					Usage:  "parsable duration of random jitter before or after the delay",
+					EnvVar: "KEKAHU_JITTER",
 				},
-				cli.StringFlag{
-					Name:   "u, url",
-					Usage:  "kahu service url if different from default",
-					EnvVar: "KEKAHU_URL",
+				cli.StringSliceFlag{
+					Name:  "t, tag",
+					Usage: "key=value label to send with heartbeats (repeatable)",
 				},
-				cli.IntFlag{
-					Name:   "verbosity",
-					Usage:  "set log level from 0-4, lower is more verbose",
-					EnvVar: "KEKAHU_VERBOSITY",
+				cli.BoolFlag{
+					Name:   "n, dry-run",
+					Usage:  "log the reports to Kahu instead of sending them",
+					EnvVar: "KEKAHU_DRY_RUN",
+				},
+				cli.BoolFlag{
+					Name:  "force",
+					Usage: "replace a stale pid file whose process is not a kekahu service",
+				},
+			},
+		},
+		{
+			Name:   "heartbeat",
+			Usage:  "send a heartbeat to kahu without running the service",
+			Before: initClient,
+			Action: heartbeat,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "once",
+					Usage: "send a single heartbeat and exit",
+				},
+				cli.StringSliceFlag{
+					Name:  "t, tag",
+					Usage: "key=value label to send with the heartbeat (repeatable)",
+				},
+				cli.BoolFlag{
+					Name:   "n, dry-run",
+					Usage:  "log the heartbeat instead of sending it",
+					EnvVar: "KEKAHU_DRY_RUN",
 				},
 			},
 		},
@@ -64,47 +146,155 @@ func main() {
 					EnvVar: "PEERS_PATH",
 				},
 				cli.StringFlag{
-					Name:   "k, key",
-					Usage:  "api key of the local host",
-					EnvVar: "KEKAHU_API_KEY",
-				},
-				cli.StringFlag{
-					Name:   "u, url",
-					Usage:  "kahu service url",
-					EnvVar: "KEKAHU_URL",
-				},
-				cli.IntFlag{
-					Name:   "verbosity",
-					Usage:  "set log level from 0-4, lower is more verbose",
-					EnvVar: "KEKAHU_VERBOSITY",
+					Name:   "f, format",
+					Usage:  "format of the peers file: json, yaml, toml, hosts, or etcd",
+					EnvVar: "KEKAHU_PEERS_FORMAT",
 				},
 			},
 		},
 		{
-			Name:   "ping",
-			Usage:  "ping another kekahu server to determine latency",
-			Before: initClient,
-			Action: ping,
+			Name:      "ping",
+			Usage:     "ping the neighbors or a kekahu echo server to determine latency",
+			ArgsUsage: "[host[:port]]",
+			Action:    ping,
 			Flags: []cli.Flag{
 				cli.Uint64Flag{
 					Name:  "n, number",
 					Usage: "number of pings to send",
 					Value: 1,
 				},
+				cli.DurationFlag{
+					Name:  "i, interval",
+					Usage: "time between the pings to each neighbor",
+					Value: time.Second,
+				},
+				cli.BoolFlag{
+					Name:  "f, flood",
+					Usage: "send all of the pings to the neighbors at once",
+				},
+				cli.IntFlag{
+					Name:  "s, size",
+					Usage: "size in bytes of the payload of each ping, ping_size if 0",
+				},
+			},
+		},
+		{
+			Name:   "peers",
+			Usage:  "list the neighbors of the local host from Kahu",
+			Before: initClient,
+			Action: peers,
+			Flags: []cli.Flag{
+				cli.StringSliceFlag{
+					Name:  "s, state",
+					Usage: "only list neighbors in the specified state (repeatable)",
+				},
+				cli.BoolFlag{
+					Name:  "j, json",
+					Usage: "print the neighbors as JSON instead of a table",
+				},
+			},
+		},
+		{
+			Name:      "api",
+			Usage:     "send a request to an endpoint of the kahu api and print the response",
+			ArgsUsage: "[method] endpoint",
+			Before:    initClient,
+			Action:    api,
+			Flags: []cli.Flag{
 				cli.StringFlag{
-					Name:   "k, key",
-					Usage:  "api key of the local host",
-					EnvVar: "KEKAHU_API_KEY",
+					Name:  "X, method",
+					Usage: "http method of the request if not an argument (default GET, or POST with data)",
 				},
 				cli.StringFlag{
-					Name:   "u, url",
-					Usage:  "kahu service url",
-					EnvVar: "KEKAHU_URL",
+					Name:  "d, data",
+					Usage: "json body of the request, @path to read it from a file or @- from stdin",
+				},
+				cli.BoolFlag{
+					Name:  "i, include",
+					Usage: "print the status and headers of the response",
+				},
+				cli.StringSliceFlag{
+					Name:  "H, header",
+					Usage: "'name: value' header to add to the request (repeatable)",
+				},
+				cli.BoolFlag{
+					Name:  "r, retry",
+					Usage: "retry with the retry policy of the endpoint like the service does",
+				},
+			},
+		},
+		{
+			Name:      "trace",
+			Usage:     "traceroute to a neighbor and compare to the echo ping latency",
+			ArgsUsage: "target",
+			Before:    initClient,
+			Action:    trace,
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:  "m, max-hops",
+					Usage: "maximum number of hops before giving up",
+					Value: agent.DefaultTraceHops,
 				},
 				cli.IntFlag{
-					Name:   "verbosity",
-					Usage:  "set log level from 0-4, lower is more verbose",
-					EnvVar: "KEKAHU_VERBOSITY",
+					Name:  "q, queries",
+					Usage: "number of probes to send to each hop",
+					Value: agent.DefaultTraceQueries,
+				},
+				cli.DurationFlag{
+					Name:  "w, wait",
+					Usage: "time to wait for the reply to each probe",
+					Value: agent.DefaultTraceWait,
+				},
+				cli.BoolFlag{
+					Name:  "n, numeric",
+					Usage: "do not look up the hostnames of the hops",
+				},
+			},
+		},
+		{
+			Name:   "serve",
+			Usage:  "run only the echo server to respond to pings",
+			Action: serve,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "a, addr",
+					Usage: "address to bind the echo server to",
+					Value: knet.DefaultAddr,
+				},
+				cli.StringFlag{
+					Name:  "n, name",
+					Usage: "name of the server to reply with (defaults to hostname)",
+				},
+				cli.StringFlag{
+					Name:   "t, transports",
+					Usage:  "comma separated transports to listen for pings on (grpc, udp, quic)",
+					Value:  knet.GRPCTransport,
+					EnvVar: "KEKAHU_ECHO_TRANSPORTS",
+				},
+				cli.StringFlag{
+					Name:   "ping-secret",
+					Usage:  "cluster secret to verify that pings are signed with",
+					EnvVar: "KEKAHU_PING_SECRET",
+				},
+				cli.BoolFlag{
+					Name:   "ping-auth",
+					Usage:  "reject pings that are not signed with the ping secret",
+					EnvVar: "KEKAHU_PING_AUTH",
+				},
+				cli.StringFlag{
+					Name:   "tls-cert",
+					Usage:  "path to the certificate for mutual TLS pings",
+					EnvVar: "KEKAHU_TLS_CERT",
+				},
+				cli.StringFlag{
+					Name:   "tls-key",
+					Usage:  "path to the private key for mutual TLS pings",
+					EnvVar: "KEKAHU_TLS_KEY",
+				},
+				cli.StringFlag{
+					Name:   "tls-ca",
+					Usage:  "path to the CA certificate to verify peers",
+					EnvVar: "KEKAHU_TLS_CA",
 				},
 			},
 		},
@@ -112,11 +302,327 @@ func main() {
 			Name:   "config",
 			Usage:  "print the current KeKahu configuration",
 			Action: config,
+			Subcommands: []cli.Command{
+				{
+					Name:   "init",
+					Usage:  "write a commented configuration template",
+					Action: configInit,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "p, path",
+							Usage: "path to write the config file to",
+							Value: "kekahu.toml",
+						},
+						cli.StringFlag{
+							Name:  "f, format",
+							Usage: "toml, yaml, or json (if empty inferred from path)",
+						},
+						cli.BoolFlag{
+							Name:  "force",
+							Usage: "overwrite the config file if it exists",
+						},
+					},
+				},
+				{
+					Name:      "get",
+					Usage:     "print the value of a configuration key",
+					ArgsUsage: "key",
+					Action:    configGet,
+				},
+				{
+					Name:      "set",
+					Usage:     "set the value of a key in the configuration file",
+					ArgsUsage: "key value",
+					Action:    configSet,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "p, path",
+							Usage: "config file to edit if not the one that is loaded",
+						},
+					},
+				},
+				{
+					Name:      "set-key",
+					Usage:     "store the api key in the os keychain or encrypted in the configuration file",
+					ArgsUsage: "[key]",
+					Action:    configSetKey,
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "e, encrypt",
+							Usage: "encrypt the key with the passphrase from key_passphrase or key_pass_command",
+						},
+						cli.StringFlag{
+							Name:  "a, account",
+							Usage: "account to store the key under in the keychain",
+							Value: agent.DefaultKeychainAccount,
+						},
+						cli.StringFlag{
+							Name:  "p, path",
+							Usage: "config file to edit if not the one that is loaded",
+						},
+					},
+				},
+				{
+					Name:   "profiles",
+					Usage:  "list the profiles in the configuration file",
+					Action: configProfiles,
+				},
+			},
+		},
+		{
+			Name:   "status",
+			Usage:  "report if the kekahu service is running",
+			Action: status,
+		},
+		{
+			Name:      "control",
+			Usage:     "send a command to the running kekahu service",
+			ArgsUsage: "status|metrics|health|ping|trigger-heartbeat|trigger-sync|set-verbosity|maintenance [key=value ...]",
+			Action:    control,
+		},
+		{
+			Name:      "maintenance",
+			Usage:     "tag or suppress heartbeats of the running service during planned downtime",
+			ArgsUsage: "on|off|status",
+			Action:    maintenance,
+			Flags: []cli.Flag{
+				cli.DurationFlag{
+					Name:  "f, for",
+					Usage: "leave maintenance mode automatically after the duration",
+				},
+			},
+		},
+		{
+			Name:      "log-level",
+			Usage:     "report or change the log level of the running service",
+			ArgsUsage: "[trace|debug|info|status|warn|error|silent]",
+			Action:    logLevel,
+			Flags: []cli.Flag{
+				cli.DurationFlag{
+					Name:  "f, for",
+					Usage: "revert to the configured verbosity after the duration",
+				},
+			},
+		},
+		{
+			Name:   "top",
+			Usage:  "live dashboard of the running kekahu service",
+			Action: top,
+			Flags: []cli.Flag{
+				cli.DurationFlag{
+					Name:  "r, refresh",
+					Usage: "interval between dashboard refreshes",
+					Value: time.Second,
+				},
+			},
+		},
+		{
+			Name:   "errors",
+			Usage:  "show the recent errors of the kekahu service",
+			Action: errors,
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:  "n, number",
+					Usage: "number of the most recent errors to show, all if zero",
+					Value: 20,
+				},
+				cli.StringFlag{
+					Name:  "c, component",
+					Usage: "only show errors of the component, e.g. heartbeat or ping",
+				},
+				cli.DurationFlag{
+					Name:  "s, since",
+					Usage: "only show errors within the duration, e.g. 12h",
+				},
+				cli.BoolFlag{
+					Name:  "j, json",
+					Usage: "print the errors as JSON",
+				},
+			},
+		},
+		{
+			Name:   "stop",
+			Usage:  "stop the running kekahu service",
+			Action: stop,
+		},
+		{
+			Name:   "validate",
+			Usage:  "check the configuration and that kekahu can run on this host",
+			Action: validate,
+		},
+		{
+			Name:   "enroll",
+			Usage:  "exchange an enrollment token for the api key of the host and store it",
+			Action: enroll,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:   "t, token",
+					Usage:  "short-lived enrollment token created in kahu",
+					EnvVar: agent.EnrollTokenEnv,
+				},
+				cli.BoolFlag{
+					Name:  "e, encrypt",
+					Usage: "encrypt the key with the passphrase from key_passphrase or key_pass_command",
+				},
+				cli.StringFlag{
+					Name:  "a, account",
+					Usage: "account to store the key under in the keychain",
+					Value: agent.DefaultKeychainAccount,
+				},
+				cli.StringFlag{
+					Name:  "p, path",
+					Usage: "config file to edit if not the one that is loaded",
+				},
+			},
+		},
+		{
+			Name:   "doctor",
+			Usage:  "diagnose connectivity to Kahu and the neighbors with hints to fix problems",
+			Action: diagnose,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "j, json",
+					Usage: "print the diagnostics as JSON",
+				},
+			},
+		},
+		{
+			Name:   "update",
+			Usage:  "install the latest release of kekahu",
+			Action: update,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "c, check",
+					Usage: "only check if a new release is available",
+				},
+				cli.StringFlag{
+					Name:  "u, url",
+					Usage: "release endpoint to check for new versions",
+				},
+			},
 		},
 		{
 			Name:   "health",
 			Usage:  "print out KeKahu's view of the system status",
 			Action: health,
+			Flags: []cli.Flag{
+				cli.StringSliceFlag{
+					Name:  "d, disk",
+					Usage: "mount point to report disk usage for (repeatable)",
+				},
+				cli.DurationFlag{
+					Name:  "s, sample",
+					Usage: "window to measure cpu utilization over (default from cpu_sample)",
+				},
+				cli.StringFlag{
+					Name:  "scope",
+					Usage: "report memory and cpu of the host, container, or auto (default from health_scope)",
+				},
+				cli.StringFlag{
+					Name:  "H, host",
+					Usage: "request the health of a neighbor from its echo server",
+				},
+			},
+		},
+		{
+			Name:   "export",
+			Usage:  "bundle the ping recordings into a compressed archive",
+			Action: export,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "p, path",
+					Usage: "path of the recording (default from record_path)",
+				},
+				cli.StringFlag{
+					Name:  "o, output",
+					Usage: "path of the archive, - for stdout (default kekahu-recordings-TIMESTAMP.tar.gz)",
+				},
+			},
+		},
+		{
+			Name:   "install",
+			Usage:  "install kekahu as a service that starts at boot",
+			Action: install,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "user",
+					Usage: "install the service for the current user rather than system-wide",
+				},
+				cli.StringFlag{
+					Name:  "b, binary",
+					Usage: "path of the kekahu binary the service runs (default this binary)",
+				},
+				cli.StringFlag{
+					Name:  "e, env-file",
+					Usage: "environment file the service loads the api key from (default per platform)",
+				},
+				cli.BoolFlag{
+					Name:  "n, dry-run",
+					Usage: "print the service definition instead of installing it",
+				},
+			},
+		},
+		{
+			Name:   "uninstall",
+			Usage:  "stop and remove the kekahu service",
+			Action: uninstall,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "user",
+					Usage: "uninstall the service of the current user",
+				},
+				cli.BoolFlag{
+					Name:  "purge",
+					Usage: "also remove the environment file with the api key",
+				},
+			},
+		},
+		{
+			Name:   "state",
+			Usage:  "list the files in the kekahu state directory",
+			Action: state,
+			Subcommands: []cli.Command{
+				{
+					Name:   "clean",
+					Usage:  "remove the state files, keeping the replica identity",
+					Action: stateClean,
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "a, all",
+							Usage: "also remove the replica identity assigned by kahu",
+						},
+						cli.BoolFlag{
+							Name:  "n, dry-run",
+							Usage: "list the files that would be removed",
+						},
+						cli.BoolFlag{
+							Name:  "force",
+							Usage: "remove the state files even if kekahu is running",
+						},
+					},
+				},
+			},
+		},
+		{
+			Name:   "version",
+			Usage:  "print the version of kekahu and of the kahu api",
+			Action: version,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "l, local",
+					Usage: "do not request the version of the kahu api",
+				},
+				cli.BoolFlag{
+					Name:  "j, json",
+					Usage: "print the version information as json",
+				},
+			},
+		},
+		{
+			Name:      "completion",
+			Usage:     "print the shell completion script for bash or zsh",
+			ArgsUsage: "bash|zsh",
+			Action:    completion,
 		},
 	}
 
@@ -128,37 +634,89 @@ func main() {
 // Commands
 //===========================================================================
 
-var client *kekahu.KeKahu
+var client *agent.KeKahu
 
-// Initialize the kekahu client
-func initClient(c *cli.Context) error {
-	config := &kekahu.Config{
-		Interval:  c.String("delay"),
+// The configuration set by the global flags, which override the configuration
+// loaded from the config file and the environment.
+var globals *agent.Config
+
+// Sets the global flags before any command runs. The profile is set in the
+// environment so that every configuration loaded by the command applies it.
+func setGlobals(c *cli.Context) error {
+	jsonErrors = c.Bool("json")
+	globals = &agent.Config{
+		APIKey:    c.String("key"),
 		URL:       c.String("url"),
 		Verbosity: c.Int("verbosity"),
-		APIKey:    c.String("key"),
+		LogFormat: c.String("log-format"),
+		TraceHTTP: c.Bool("trace-http"),
+	}
+
+	if profile := c.String("profile"); profile != "" {
+		if err := os.Setenv(agent.ProfileEnv, profile); err != nil {
+			return fail(err)
+		}
+	}
+
+	// The environment file doesn't override variables that are already set
+	if path := c.String("env-file"); path != "" {
+		if err := godotenv.Load(path); err != nil {
+			return exitErrorf(ExitConfig, "could not load environment file: %s", err)
+		}
+	}
+	return nil
+}
+
+// Initialize the kekahu client for commands that make requests to Kahu,
+// which require an API key
+func initClient(c *cli.Context) error {
+	if err := initService(c); err != nil {
+		return err
+	}
+
+	if client.LocalOnly() {
+		return exitErrorf(ExitConfig, "no api key configured, set api_key in the config file or KEKAHU_API_KEY")
+	}
+	return nil
+}
+
+// Initialize the kekahu service, which runs local-only if no API key is
+// configured
+func initService(c *cli.Context) error {
+	config := &agent.Config{
+		Interval:    c.String("delay"),
+		Jitter:      c.String("jitter"),
+		URL:         globals.URL,
+		Verbosity:   globals.Verbosity,
+		LogFormat:   globals.LogFormat,
+		Tags:        strings.Join(c.StringSlice("tag"), ","),
+		APIKey:      globals.APIKey,
+		PeersFormat: c.String("format"),
+		DryRun:      c.Bool("dry-run"),
+		Force:       c.Bool("force"),
+		TraceHTTP:   globals.TraceHTTP,
 	}
 
 	var err error
-	if client, err = kekahu.New(config); err != nil {
-		return cli.NewExitError(err.Error(), 1)
+	if client, err = agent.New(config); err != nil {
+		return exitError(err, ExitConfig)
 	}
 	return nil
 }
 
 // Print the current configuration of KeKahu
 func config(c *cli.Context) error {
-	conf := new(kekahu.Config)
+	conf := new(agent.Config)
 	if err := conf.Load(); err != nil {
-		return cli.NewExitError(err.Error(), 1)
+		return exitError(err, ExitConfig)
 	}
 
-	data, err := json.MarshalIndent(conf, "", "  ")
+	data, err := json.MarshalIndent(redactConfig(conf), "", "  ")
 	if err != nil {
-		return cli.NewExitError(err.Error(), 1)
+		return fail(err)
 	}
 
-	if path, err := kekahu.FindConfigPath(); err == nil {
+	if path, err := agent.FindConfigPath(); err == nil {
 		fmt.Println("\nConfig File\n-----------")
 		fmt.Printf("  %s\n\n", path)
 	}
@@ -171,52 +729,1277 @@ func config(c *cli.Context) error {
 	return nil
 }
 
-// Run the keep-alive server
-func run(c *cli.Context) error {
-	if err := client.Run(); err != nil {
-		return cli.NewExitError(err.Error(), 1)
+// Returns a copy of the configuration with the secrets redacted so that they
+// are not shown when the configuration is printed.
+func redactConfig(conf *agent.Config) *agent.Config {
+	redacted := *conf
+	for _, secret := range []*string{&redacted.KeyPassphrase, &redacted.SigningKey, &redacted.SigningKeyAlt, &redacted.PingSecret} {
+		if *secret != "" {
+			*secret = "[REDACTED]"
+		}
 	}
+	return &redacted
+}
+
+// Write a configuration template to disk
+func configInit(c *cli.Context) error {
+	path := c.String("path")
+	if err := agent.WriteConfigTemplate(path, c.String("format"), c.Bool("force")); err != nil {
+		return fail(err)
+	}
+
+	fmt.Printf("configuration template written to %s\n", path)
 	return nil
 }
 
-// Sync the local peers.json file
-func sync(c *cli.Context) error {
-	if err := client.Sync(c.String("path")); err != nil {
-		return cli.NewExitError(err.Error(), 1)
+// Print the value of a configuration key from the defaults, file, and env
+func configGet(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return exitErrorf(ExitUsage, "specify the configuration key to get")
+	}
+
+	value, err := agent.GetConfigValue(c.Args().First())
+	if err != nil {
+		return exitError(err, ExitConfig)
 	}
 
+	fmt.Println(value)
 	return nil
 }
 
-// Ping the remote host to determine latency
-func ping(c *cli.Context) error {
-	kekahu.SetLogLevel(kekahu.Silent)
+// Set the value of a key in the configuration file, creating it if needed
+func configSet(c *cli.Context) error {
+	if c.NArg() != 2 {
+		return exitErrorf(ExitUsage, "specify the configuration key and value to set")
+	}
 
-	// Send the pings
-	if err := client.SendNPings(c.Uint64("number")); err != nil {
-		return cli.NewExitError(err.Error(), 1)
+	path := c.String("path")
+	if path == "" {
+		var err error
+		if path, err = agent.FindConfigPath(); err != nil {
+			path = "kekahu.toml"
+		}
 	}
 
-	// Report the averages
-	metrics := client.Metrics()
-	data, _ := json.MarshalIndent(metrics, "", "  ")
-	fmt.Println(string(data))
+	key, err := agent.ConfigKey(c.Args().Get(0))
+	if err != nil {
+		return exitError(err, ExitConfig)
+	}
+
+	if err := agent.SetConfigValue(path, key, c.Args().Get(1)); err != nil {
+		return exitError(err, ExitConfig)
+	}
 
+	fmt.Printf("set %s in %s\n", key, path)
 	return nil
 }
 
-// Perform a health check and view the system status
-func health(c *cli.Context) error {
-	status, err := kekahu.HealthCheck(true)
+// Store the api key in the OS keychain or encrypt it, then set api_key in the
+// configuration file to refer to it
+func configSetKey(c *cli.Context) error {
+	if c.NArg() > 1 {
+		return exitErrorf(ExitUsage, "specify the api key or enter it on stdin")
+	}
+
+	// Read the key from stdin so that it is not kept in the shell history
+	key := c.Args().First()
+	if key == "" {
+		if info, err := os.Stdin.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+			fmt.Fprint(os.Stderr, "api key: ")
+		}
+
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return exitErrorf(ExitUsage, "no api key entered")
+		}
+		key = strings.TrimSpace(line)
+	}
+
+	if key == "" {
+		return exitErrorf(ExitUsage, "no api key entered")
+	}
+
+	path, where, err := saveAPIKey(c, key)
 	if err != nil {
-		return cli.NewExitError(err.Error(), 1)
+		return err
 	}
 
-	data, err := status.Dump(2)
+	fmt.Printf("api key %s, set api_key in %s\n", where, path)
+	return nil
+}
+
+// Exchange an enrollment token for the api key of the host and store it
+func enroll(c *cli.Context) error {
+	if c.NArg() > 0 {
+		return exitErrorf(ExitUsage, "pass the enrollment token with --token or set %s", agent.EnrollTokenEnv)
+	}
+
+	// The configuration is not valid until the host has an api key
+	conf := new(agent.Config)
+	conf.Load()
+	if globals.URL != "" {
+		conf.URL = globals.URL
+	}
+
+	enrolled, err := agent.Enroll(context.Background(), conf, c.String("token"))
 	if err != nil {
-		return cli.NewExitError("couldn't dump status to JSON", 1)
+		return fail(err)
 	}
 
-	fmt.Println(string(data))
+	path, where, err := saveAPIKey(c, enrolled.APIKey)
+	if err != nil {
+		return err
+	}
+
+	if enrolled.Replica != "" {
+		fmt.Printf("enrolled as %s, ", enrolled.Replica)
+	}
+	fmt.Printf("api key %s, set api_key in %s\n", where, path)
+
+	if _, running := controlSocket(); running {
+		fmt.Println("a local-only service registers with kahu on its next heartbeat, otherwise reload the service with SIGHUP")
+	}
+	return nil
+}
+
+// Store the api key as set by the encrypt, account, and path flags, returning
+// the config file that api_key was set in and where the key was stored.
+func saveAPIKey(c *cli.Context, key string) (path, where string, err error) {
+	// The passphrase is loaded even if the configuration is not valid
+	conf := new(agent.Config)
+	conf.Load()
+
+	account := c.String("account")
+	if c.Bool("encrypt") {
+		where = "encrypted"
+	} else {
+		where = fmt.Sprintf("stored in the %s as %s", agent.KeychainName(), account)
+	}
+
+	if path = c.String("path"); path == "" {
+		if path, err = agent.FindConfigPath(); err != nil {
+			path = "kekahu.toml"
+		}
+	}
+
+	if err = conf.SaveAPIKey(path, key, account, c.Bool("encrypt")); err != nil {
+		return "", "", exitError(err, ExitConfig)
+	}
+	return path, where, nil
+}
+
+// List the profiles in the configuration file, marking the selected profile
+func configProfiles(c *cli.Context) error {
+	profiles, err := agent.Profiles()
+	if err != nil {
+		return exitError(err, ExitConfig)
+	}
+
+	selected, _ := agent.GetConfigValue("profile")
+	for _, name := range profiles {
+		if strings.EqualFold(name, fmt.Sprint(selected)) {
+			fmt.Printf("* %s\n", name)
+		} else {
+			fmt.Printf("  %s\n", name)
+		}
+	}
+	return nil
+}
+
+// Run the keep-alive server
+func run(c *cli.Context) error {
+	if err := client.Run(); err != nil {
+		return fail(err)
+	}
+	return nil
+}
+
+// List the neighbors of the local host with their last known latency
+func peers(c *cli.Context) error {
+	info, err := client.FetchNeighbors(context.Background())
+	if err != nil {
+		return fail(err)
+	}
+
+	// Filter the neighbors by state if requested
+	states := c.StringSlice("state")
+	rows := make([]*peerRow, 0, len(info.Targets))
+	for _, target := range info.Targets {
+		if len(states) == 0 || contains(states, target.State) {
+			row := &peerRow{Neighbor: target}
+			if last, ok := client.LastLatency(target.Hostname); ok {
+				row.Latency = last.String()
+			}
+			rows = append(rows, row)
+		}
+	}
+
+	if c.Bool("json") {
+		data, err := json.MarshalIndent(rows, "", "  ")
+		if err != nil {
+			return fail(err)
+		}
+		fmt.Println(string(data))
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "HOSTNAME\tSTATE\tIP ADDRESS\tDOMAIN\tLATENCY")
+	for _, row := range rows {
+		latency := row.Latency
+		if latency == "" {
+			latency = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", row.Hostname, row.State, row.IPAddr, row.Domain, latency)
+	}
+	return w.Flush()
+}
+
+// A neighbor with the last known latency from the local metrics
+type peerRow struct {
+	*kahu.Neighbor
+	Latency string `json:"latency,omitempty"`
+}
+
+// Returns true if the string is in the list, ignoring case
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Traceroute to a neighbor (or any address) and then ping its echo server
+func trace(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return exitErrorf(ExitUsage, "specify a neighbor name or address to trace")
+	}
+
+	// Look up the address of the target if it is a neighbor
+	target, addr := c.Args().First(), c.Args().First()
+	source, _ := os.Hostname()
+	if info, err := client.FetchNeighbors(context.Background()); err == nil {
+		source = info.Source
+		for _, neighbor := range info.Targets {
+			if neighbor.Hostname == target {
+				addr = neighbor.IPAddr
+				break
+			}
+		}
+	}
+
+	opts := &agent.TraceOptions{
+		MaxHops: c.Int("max-hops"),
+		Queries: c.Int("queries"),
+		Wait:    c.Duration("wait"),
+		Resolve: !c.Bool("numeric"),
+	}
+
+	route, err := client.Traceroute(context.Background(), source, target, addr, opts)
+	if err != nil {
+		return fail(err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "HOP\tADDRESS\tNAME\tRTT")
+	for _, hop := range route.Hops {
+		rtts := make([]string, 0, len(hop.RTTs))
+		for _, rtt := range hop.RTTs {
+			if rtt == 0 {
+				rtts = append(rtts, "*")
+			} else {
+				rtts = append(rtts, rtt.String())
+			}
+		}
+
+		addr, name := hop.Addr, hop.Name
+		if addr == "" {
+			addr = "*"
+		}
+		if name == "" {
+			name = "-"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", hop.TTL, addr, name, strings.Join(rtts, " "))
+	}
+	if err := w.Flush(); err != nil {
+		return fail(err)
+	}
+
+	// Compare the network latency to the application latency
+	fmt.Println()
+	if !route.Reached {
+		fmt.Printf("%s did not reply within %d hops\n", route.Target, len(route.Hops))
+	} else {
+		fmt.Printf("network latency: %s\n", route.Last())
+	}
+
+	if route.EchoErr != "" {
+		fmt.Printf("echo latency:    failed (%s)\n", route.EchoErr)
+	} else {
+		fmt.Printf("echo latency:    %s\n", route.Echo)
+		if route.Reached && route.Echo > route.Last() {
+			fmt.Printf("echo overhead:   %s\n", route.Echo-route.Last())
+		}
+	}
+	return nil
+}
+
+// Run only the echo server without heartbeats
+func serve(c *cli.Context) error {
+	verbosity := 3
+	if c.GlobalIsSet("verbosity") {
+		verbosity = globals.Verbosity
+	}
+
+	agent.SetLogLevel(uint8(verbosity))
+	if err := agent.SetLogFormat(globals.LogFormat); err != nil {
+		return exitError(err, ExitConfig)
+	}
+
+	conf := &agent.Config{
+		EchoTransports: c.String("transports"),
+		PingSecret:     c.String("ping-secret"),
+		PingAuth:       c.Bool("ping-auth"),
+		TLSCert:        c.String("tls-cert"),
+		TLSKey:         c.String("tls-key"),
+		TLSCA:          c.String("tls-ca"),
+	}
+
+	if err := agent.Serve(c.String("addr"), c.String("name"), conf); err != nil {
+		return fail(err)
+	}
+	return nil
+}
+
+// Send a single heartbeat to Kahu and print the response
+func heartbeat(c *cli.Context) error {
+	if !c.Bool("once") {
+		return exitErrorf(ExitUsage, "specify --once to send a single heartbeat, use kekahu run to send heartbeats on an interval")
+	}
+
+	hb, err := client.SendHeartbeat(context.Background())
+	if err != nil {
+		return fail(err)
+	}
+
+	// Don't print the cluster secret used to authenticate pings
+	hb.Secret = ""
+	data, _ := json.MarshalIndent(hb, "", "  ")
+	fmt.Println(string(data))
+
+	if !hb.Success {
+		return exitErrorf(ExitFailure, "heartbeat was not successful")
+	}
+	return nil
+}
+
+// Sync the local peers.json file
+func sync(c *cli.Context) error {
+	if err := client.Sync(context.Background(), c.String("path")); err != nil {
+		return fail(err)
+	}
+
+	return nil
+}
+
+// Ping the remote host to determine latency
+func ping(c *cli.Context) error {
+	// Ping the echo server directly if one is specified
+	if c.NArg() > 1 {
+		return exitErrorf(ExitUsage, "specify at most one host to ping")
+	}
+
+	if c.NArg() == 1 {
+		return pingHost(c, c.Args().First())
+	}
+
+	// Send the pings at once if flooding, otherwise every interval
+	interval := c.Duration("interval")
+	if c.Bool("flood") {
+		interval = 0
+	}
+
+	// Send the pings from the running service if there is one
+	if path, ok := controlSocket(); ok {
+		args := map[string]string{"number": strconv.FormatUint(c.Uint64("number"), 10)}
+		if interval > 0 {
+			args["interval"] = interval.String()
+		}
+		if size := c.Int("size"); size != 0 {
+			args["size"] = strconv.Itoa(size)
+		}
+		result, err := agent.Control(path, agent.PingCommand, args)
+		if err != nil {
+			return fail(err)
+		}
+		return printJSON(result)
+	}
+
+	if err := initClient(c); err != nil {
+		return err
+	}
+	agent.SetLogLevel(agent.Silent)
+
+	// Print the statistics of the pings sent so far on interrupt
+	if interval > 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		interrupt := make(chan os.Signal, 1)
+		signal.Notify(interrupt, os.Interrupt)
+		defer signal.Stop(interrupt)
+		go func() {
+			select {
+			case <-interrupt:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		if err := client.PacePings(ctx, c.Uint64("number"), c.Int("size"), interval, os.Stdout); err != nil {
+			return fail(err)
+		}
+		return nil
+	}
+
+	// Send the pings
+	if err := client.PacePings(context.Background(), c.Uint64("number"), c.Int("size"), 0, os.Stderr); err != nil {
+		return fail(err)
+	}
+
+	// Report the averages
+	metrics := client.Metrics()
+	data, _ := json.MarshalIndent(metrics, "", "  ")
+	fmt.Println(string(data))
+
+	return nil
+}
+
+// Ping the echo server at the address without looking up the neighbors
+func pingHost(c *cli.Context, addr string) error {
+	// Pinging does not need the Kahu API, so the host can be pinged even if
+	// no API key is configured or the service runs local-only
+	if err := initService(c); err != nil {
+		return err
+	}
+	agent.SetLogLevel(agent.Silent)
+
+	n := c.Uint64("number")
+	if n == 0 {
+		n = 1
+	}
+
+	latencies, err := client.PingHost(context.Background(), addr, n, c.Int("size"))
+
+	summary := &agent.PingSummary{Target: addr}
+	for seq, latency := range latencies {
+		summary.Add(latency)
+		if latency == 0 {
+			fmt.Printf("seq=%d timeout\n", seq+1)
+			continue
+		}
+		fmt.Printf("seq=%d time=%s\n", seq+1, latency)
+	}
+	fmt.Println(summary)
+
+	if summary.Received == 0 {
+		if err == nil {
+			err = fmt.Errorf("no replies from %s", addr)
+		}
+		return fail(err)
+	}
+	return nil
+}
+
+// Report the status of the running kekahu service from the PID file
+func status(c *cli.Context) error {
+	pid, err := loadPID()
+	if err != nil {
+		return fail(err)
+	}
+
+	if !pid.Running() {
+		return exitErrorf(ExitNotRunning, "kekahu is not running (stale pid file for process %d)", pid.PID)
+	}
+
+	fmt.Printf("kekahu is running (pid %d) up %s\n", pid.PID, pid.Uptime())
+
+	// Print the state of the service if it can be reached
+	if path, ok := controlSocket(); ok {
+		result, err := agent.Control(path, agent.StatusCommand, nil)
+		if err != nil {
+			return fail(err)
+		}
+		return printJSON(result)
+	}
+	return nil
+}
+
+// Show the recent errors recorded in the error journal
+func errors(c *cli.Context) error {
+	// The journal path is loaded even if the configuration is not valid
+	conf := new(agent.Config)
+	conf.Load()
+
+	entries, err := agent.ReadJournal(conf.GetJournalPath())
+	if err != nil {
+		return fail(err)
+	}
+
+	// Filter the errors by component and age
+	filtered := make([]*agent.JournalEntry, 0, len(entries))
+	for _, entry := range entries {
+		if component := c.String("component"); component != "" && entry.Component != component {
+			continue
+		}
+		if since := c.Duration("since"); since > 0 && time.Since(entry.Time) > since {
+			continue
+		}
+		filtered = append(filtered, entry)
+	}
+
+	if n := c.Int("number"); n > 0 && len(filtered) > n {
+		filtered = filtered[len(filtered)-n:]
+	}
+
+	if c.Bool("json") {
+		data, _ := json.MarshalIndent(filtered, "", "  ")
+		fmt.Println(string(data))
+		return nil
+	}
+
+	if len(filtered) == 0 {
+		fmt.Println("no errors recorded")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tCOMPONENT\tMESSAGE")
+	for _, entry := range filtered {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", entry.Time.Format(time.RFC3339), entry.Component, entry.Message)
+	}
+	return w.Flush()
+}
+
+// Render a live dashboard of the running kekahu service
+func top(c *cli.Context) error {
+	path, ok := controlSocket()
+	if !ok {
+		return exitErrorf(ExitNotRunning, "kekahu is not running (could not connect to the control socket)")
+	}
+
+	if c.Duration("refresh") <= 0 {
+		return exitErrorf(ExitUsage, "specify a positive refresh interval")
+	}
+
+	if err := runDashboard(path, c.Duration("refresh")); err != nil {
+		return fail(err)
+	}
+	return nil
+}
+
+// Print the shell completion script, e.g. source <(kekahu completion bash)
+func completion(c *cli.Context) error {
+	shell := "bash"
+	if c.NArg() > 0 {
+		shell = c.Args().First()
+	}
+
+	switch shell {
+	case "bash":
+		fmt.Print(bashCompletion)
+	case "zsh":
+		fmt.Print(zshCompletion + bashCompletion)
+	default:
+		return exitErrorf(ExitUsage, "no completion script for %s, specify bash or zsh", shell)
+	}
+	return nil
+}
+
+// Send a command to the running kekahu service on its control socket
+func control(c *cli.Context) error {
+	if c.NArg() == 0 {
+		return exitErrorf(ExitUsage, "specify a command to send to the kekahu service")
+	}
+
+	args := make(map[string]string)
+	for _, arg := range c.Args().Tail() {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) != 2 {
+			return exitErrorf(ExitUsage, "could not parse argument '%s', use key=value", arg)
+		}
+		args[parts[0]] = parts[1]
+	}
+
+	path, ok := controlSocket()
+	if !ok {
+		return exitErrorf(ExitNotRunning, "kekahu is not running (no control socket at %s)", path)
+	}
+
+	result, err := agent.Control(path, c.Args().First(), args)
+	if err != nil {
+		return fail(err)
+	}
+	return printJSON(result)
+}
+
+// Put the running service into or out of maintenance mode
+func maintenance(c *cli.Context) error {
+	args := make(map[string]string)
+	switch c.Args().First() {
+	case "on":
+		args["enabled"] = "true"
+		if c.Duration("for") > 0 {
+			args["duration"] = c.Duration("for").String()
+		}
+	case "off":
+		if c.IsSet("for") {
+			return exitErrorf(ExitUsage, "--for can only be used with maintenance on")
+		}
+		args["enabled"] = "false"
+	case "", "status":
+	default:
+		return exitErrorf(ExitUsage, "unknown maintenance command '%s', specify on, off, or status", c.Args().First())
+	}
+
+	path, ok := controlSocket()
+	if !ok {
+		return exitErrorf(ExitNotRunning, "kekahu is not running (no control socket at %s)", path)
+	}
+
+	result, err := agent.Control(path, agent.MaintenanceCommand, args)
+	if err != nil {
+		return fail(err)
+	}
+
+	status := new(agent.MaintenanceStatus)
+	if err := json.Unmarshal(result, status); err != nil {
+		return fail(err)
+	}
+
+	fmt.Println(status)
+	return nil
+}
+
+// Report or change the log level of the running service, temporarily if --for
+// is given
+func logLevel(c *cli.Context) error {
+	args := make(map[string]string)
+	if level := c.Args().First(); level != "" {
+		args["level"] = level
+		if c.Duration("for") > 0 {
+			args["duration"] = c.Duration("for").String()
+		}
+	} else if c.IsSet("for") {
+		return exitErrorf(ExitUsage, "--for can only be used when setting the log level")
+	}
+
+	path, ok := controlSocket()
+	if !ok {
+		return exitErrorf(ExitNotRunning, "kekahu is not running (no control socket at %s)", path)
+	}
+
+	result, err := agent.Control(path, agent.SetVerbosityCommand, args)
+	if err != nil {
+		return fail(err)
+	}
+
+	status := new(agent.LogLevelStatus)
+	if err := json.Unmarshal(result, status); err != nil {
+		return fail(err)
+	}
+
+	fmt.Println(status)
+	return nil
+}
+
+// Stop the running kekahu service by sending it SIGTERM
+func stop(c *cli.Context) error {
+	pid, err := loadPID()
+	if err != nil {
+		return fail(err)
+	}
+
+	if err := pid.Stop(); err != nil {
+		return fail(err)
+	}
+
+	fmt.Printf("sent stop signal to kekahu (pid %d)\n", pid.PID)
+	return nil
+}
+
+// Validate the configuration and report a table of the checks that passed
+func validate(c *cli.Context) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CHECK\tRESULT\tDETAILS")
+
+	// Load and validate the configuration from files, env, and flags
+	config := &agent.Config{APIKey: globals.APIKey, URL: globals.URL}
+	client, err := agent.New(config)
+	if err != nil {
+		fmt.Fprintf(w, "configuration\tFAIL\t%s\n", err)
+		w.Flush()
+		return exitErrorf(ExitConfig, "configuration is invalid")
+	}
+
+	path, err := agent.FindConfigPath()
+	if err != nil {
+		path = "defaults and environment"
+	}
+	fmt.Fprintf(w, "configuration\tPASS\tloaded from %s\n", path)
+
+	failed := 0
+	for _, result := range client.Validate(context.Background()) {
+		status := "PASS"
+		if !result.Passed {
+			status = "FAIL"
+			failed++
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", result.Check, status, result.Message)
+	}
+
+	if err := w.Flush(); err != nil {
+		return fail(err)
+	}
+
+	if failed > 0 {
+		return exitErrorf(ExitUnhealthy, "%d checks failed", failed)
+	}
+	return nil
+}
+
+// Run connectivity diagnostics and print a report with remediation hints
+func diagnose(c *cli.Context) error {
+	config := &agent.Config{APIKey: globals.APIKey, URL: globals.URL}
+	client, err := agent.New(config)
+	if err != nil {
+		return exitErrorf(ExitConfig, "configuration is invalid: %s", err)
+	}
+
+	results := client.Diagnose(context.Background())
+	failed := 0
+	for _, result := range results {
+		if result.Result == agent.DiagnosisFail {
+			failed++
+		}
+	}
+
+	if c.Bool("json") {
+		data, err := json.MarshalIndent(results, "", "  ")
+		if err != nil {
+			return fail(err)
+		}
+		fmt.Println(string(data))
+	} else {
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "CHECK\tRESULT\tDETAILS")
+		for _, result := range results {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", result.Check, strings.ToUpper(result.Result), result.Message)
+			if result.Hint != "" {
+				fmt.Fprintf(w, "\t\thint: %s\n", result.Hint)
+			}
+		}
+
+		if err := w.Flush(); err != nil {
+			return fail(err)
+		}
+	}
+
+	if failed > 0 {
+		return exitErrorf(ExitUnhealthy, "%d checks failed", failed)
+	}
+	return nil
+}
+
+// Check for a new release and install it if one is available
+func update(c *cli.Context) error {
+	// The update url and key are read even if the configuration is not valid
+	conf := new(agent.Config)
+	conf.Load()
+
+	url := c.String("url")
+	if url == "" {
+		url = conf.GetUpdateURL()
+	}
+
+	release, newer, err := agent.CheckUpdate(context.Background(), url)
+	if err != nil {
+		return fail(err)
+	}
+
+	if !newer {
+		fmt.Printf("kekahu %s is up to date (latest release is %s)\n", agent.PackageVersion, release.Version)
+		return nil
+	}
+
+	if c.Bool("check") {
+		fmt.Printf("kekahu %s is available (running %s)\n", release.Version, agent.PackageVersion)
+		return nil
+	}
+
+	key, err := conf.GetUpdateKey()
+	if err != nil {
+		return fail(err)
+	}
+
+	if err := release.Install(context.Background(), key); err != nil {
+		return fail(err)
+	}
+
+	fmt.Printf("updated kekahu from %s to %s, restart the service to use it\n", agent.PackageVersion, release.Version)
+	return nil
+}
+
+// Bundle the ping recording and its rotated files into a tar.gz archive
+func export(c *cli.Context) error {
+	path := c.String("path")
+	if path == "" {
+		// The record path is loaded even if the configuration is not valid
+		conf := new(agent.Config)
+		conf.Load()
+		if path = conf.RecordPath; path == "" {
+			return exitErrorf(ExitUsage, "no recording to export, specify a path or set record_path")
+		}
+	}
+
+	output := c.String("output")
+	if output == "" {
+		output = fmt.Sprintf("kekahu-recordings-%s.tar.gz", time.Now().Format("20060102T150405"))
+	}
+
+	if output == "-" {
+		_, err := agent.ExportRecordings(path, os.Stdout)
+		if err != nil {
+			return fail(err)
+		}
+		return nil
+	}
+
+	f, err := os.Create(output)
+	if err != nil {
+		return fail(err)
+	}
+
+	files, err := agent.ExportRecordings(path, f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		os.Remove(output)
+		return fail(err)
+	}
+
+	fmt.Printf("exported %d recordings to %s\n", len(files), output)
+	return nil
+}
+
+// Print the build information of kekahu and the version of the Kahu API. If
+// Kahu cannot be reached the local version is still printed.
+func version(c *cli.Context) error {
+	info := agent.BuildInfo()
+	if !c.Bool("local") {
+		config := &agent.Config{APIKey: globals.APIKey, URL: globals.URL, Verbosity: 4}
+		client, err := agent.New(config)
+		if err == nil {
+			info.Kahu, err = client.KahuVersion(context.Background())
+		}
+
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not get the kahu version: %s\n", err)
+		}
+	}
+
+	if c.Bool("json") {
+		data, err := json.Marshal(info)
+		if err != nil {
+			return fail(err)
+		}
+		return printJSON(data)
+	}
+
+	fmt.Println(info)
+	return nil
+}
+
+// Load the PID file from the path in the configuration
+// Returns the path of the control socket and whether the service is running
+// and listening on it.
+func controlSocket() (string, bool) {
+	// The control path is loaded even if the configuration is not valid
+	conf := new(agent.Config)
+	conf.Load()
+
+	path := conf.GetControlPath()
+	return path, agent.Controllable(path)
+}
+
+// Print the JSON result of a control command, indented
+func printJSON(data json.RawMessage) error {
+	buf := new(bytes.Buffer)
+	if err := json.Indent(buf, data, "", "  "); err != nil {
+		return fail(err)
+	}
+
+	fmt.Println(buf.String())
+	return nil
+}
+
+func loadPID() (*agent.PID, error) {
+	// The PID path is loaded even if no API key is configured, since the
+	// service runs local-only until one is provisioned
+	conf := new(agent.Config)
+	conf.Load()
+
+	// Find the PID file of a service started by an earlier version
+	if err := conf.MigrateState(); err != nil {
+		return nil, fail(err)
+	}
+	return agent.LoadPID(conf.GetPidPath())
+}
+
+// List the state directory and the state files in it
+func state(c *cli.Context) error {
+	// The state paths are loaded even if the configuration is not valid
+	conf := new(agent.Config)
+	conf.Load()
+
+	fmt.Printf("state directory: %s\n", conf.GetStateDir().Path())
+	for _, path := range conf.GetStateFiles(true) {
+		if info, err := os.Stat(path); err == nil {
+			fmt.Printf("  %s (%d bytes, modified %s)\n", path, info.Size(), info.ModTime().Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+// Remove the state files of the service, which must be stopped first so that
+// it doesn't write them again on shutdown
+func stateClean(c *cli.Context) error {
+	// The state paths are loaded even if the configuration is not valid
+	conf := new(agent.Config)
+	conf.Load()
+
+	if pid, err := agent.LoadPID(conf.GetPidPath()); err == nil && pid.Running() && !c.Bool("force") {
+		return exitErrorf(ExitRunning, "kekahu is running (pid %d): stop it first or use --force", pid.PID)
+	}
+
+	files := conf.GetStateFiles(c.Bool("all"))
+	if c.Bool("dry-run") {
+		for _, path := range files {
+			if _, err := os.Stat(path); err == nil {
+				fmt.Printf("would remove %s\n", path)
+			}
+		}
+		return nil
+	}
+
+	removed, err := conf.GetStateDir().Remove(files...)
+	for _, path := range removed {
+		fmt.Printf("removed %s\n", path)
+	}
+
+	if err != nil {
+		return fail(err)
+	}
+
+	if len(removed) == 0 {
+		fmt.Println("no state files to remove")
+	}
+	return nil
+}
+
+// Send an ad-hoc request to the Kahu API and print the response
+func api(c *cli.Context) error {
+	req := &kahu.APIRequest{Method: c.String("method"), Retry: c.Bool("retry")}
+	switch c.NArg() {
+	case 1:
+		req.Endpoint = c.Args().First()
+	case 2:
+		if req.Method != "" {
+			return exitErrorf(ExitUsage, "specify the method either as an argument or with --method")
+		}
+		req.Method, req.Endpoint = c.Args().Get(0), c.Args().Get(1)
+	default:
+		return exitErrorf(ExitUsage, "specify the endpoint to request, e.g. GET %s", kahu.ReplicasEndpoint)
+	}
+
+	// The body is read before the request so that it can be sent again on retry
+	if data := c.String("data"); data != "" {
+		body := []byte(data)
+		if strings.HasPrefix(data, "@") {
+			var err error
+			if data == "@-" {
+				body, err = ioutil.ReadAll(os.Stdin)
+			} else {
+				body, err = ioutil.ReadFile(data[1:])
+			}
+
+			if err != nil {
+				return exitErrorf(ExitUsage, "could not read request body: %s", err)
+			}
+		}
+
+		req.Body = bytes.NewReader(body)
+		if req.Method == "" {
+			req.Method = "POST"
+		}
+	}
+
+	for _, header := range c.StringSlice("header") {
+		parts := strings.SplitN(header, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return exitErrorf(ExitUsage, "header '%s' must be 'name: value'", header)
+		}
+
+		if req.Header == nil {
+			req.Header = make(http.Header)
+		}
+		req.Header.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+
+	res, err := client.Request(context.Background(), req)
+	if err != nil {
+		return fail(err)
+	}
+	defer res.Body.Close()
+
+	if c.Bool("include") {
+		fmt.Printf("%s %s\n", res.Proto, res.Status)
+		res.Header.Write(os.Stdout)
+		fmt.Println()
+	}
+
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return fail(err)
+	}
+
+	// Indent JSON responses, printing other responses as they are
+	buf := new(bytes.Buffer)
+	if err := json.Indent(buf, data, "", "  "); err == nil {
+		data = buf.Bytes()
+	}
+
+	if data = bytes.TrimRight(data, "\r\n"); len(data) > 0 {
+		os.Stdout.Write(data)
+		fmt.Println()
+	}
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fail(&kahu.APIError{StatusCode: res.StatusCode, Status: res.Status})
+	}
+	return nil
+}
+
+// Install kekahu as a service with the service manager of the platform
+func install(c *cli.Context) error {
+	svc, err := agent.NewServiceConfig(c.Bool("user"))
+	if err != nil {
+		return fail(err)
+	}
+
+	if svc.Manager() == "" {
+		return exitErrorf(ExitUsage, "kekahu can't be installed as a service on this platform")
+	}
+
+	if path := c.String("binary"); path != "" {
+		if svc.Binary, err = filepath.Abs(path); err != nil {
+			return fail(err)
+		}
+	}
+
+	if path := c.String("env-file"); path != "" {
+		if svc.EnvFile, err = filepath.Abs(path); err != nil {
+			return fail(err)
+		}
+	}
+
+	svc.Env["KEKAHU_API_KEY"] = globals.APIKey
+	svc.Env["KEKAHU_URL"] = globals.URL
+
+	if c.Bool("dry-run") {
+		data, err := svc.Render()
+		if err != nil {
+			return fail(err)
+		}
+
+		if path := svc.Path(); path != "" {
+			fmt.Printf("would write %s:\n\n", path)
+		}
+		fmt.Printf("%s\nwould write the environment file %s\n", data, svc.EnvFile)
+		return nil
+	}
+
+	if err := svc.Install(); err != nil {
+		return fail(err)
+	}
+
+	if path := svc.Path(); path != "" {
+		fmt.Printf("installed %s\n", path)
+	}
+	fmt.Printf("kekahu service enabled and started with %s (environment in %s)\n", svc.Manager(), svc.EnvFile)
+
+	if !svc.HasAPIKey() {
+		fmt.Printf(
+			"no api key configured: the service runs local-only until KEKAHU_API_KEY is added to %s and the service is restarted\n",
+			svc.EnvFile,
+		)
+	}
+	return nil
+}
+
+// Stop and remove the kekahu service
+func uninstall(c *cli.Context) error {
+	svc, err := agent.NewServiceConfig(c.Bool("user"))
+	if err != nil {
+		return fail(err)
+	}
+
+	if svc.Manager() == "" {
+		return exitErrorf(ExitUsage, "kekahu can't be installed as a service on this platform")
+	}
+
+	if err := svc.Uninstall(c.Bool("purge")); err != nil {
+		return fail(err)
+	}
+
+	if path := svc.Path(); path != "" {
+		fmt.Printf("removed %s\n", path)
+	}
+
+	if c.Bool("purge") {
+		fmt.Printf("removed %s\n", svc.EnvFile)
+	}
+	fmt.Println("kekahu service stopped and uninstalled")
+	return nil
+}
+
+// Perform a health check and view the system status
+func health(c *cli.Context) error {
+	if c.String("host") != "" {
+		return remoteHealth(c)
+	}
+
+	// Use the configured disk paths, health rules, and timeouts if available
+	var rules []*kahu.HealthRule
+	disks := c.StringSlice("disk")
+	sample, timeout := doctor.DefaultCPUSample, 2*doctor.DefaultCPUSample
+	scope, image := doctor.AutoScope, ""
+	conf := new(agent.Config)
+	if err := conf.Load(); err == nil {
+		if len(disks) == 0 {
+			disks = conf.GetDiskPaths()
+		}
+		rules, _ = conf.GetHealthRules()
+		sample, _ = conf.GetCPUSample()
+		timeout, _ = conf.GetHealthTimeout()
+		scope, image = conf.GetHealthScope(), conf.ContainerImage
+	}
+
+	if c.IsSet("scope") {
+		conf.HealthScope = c.String("scope")
+		if scope = conf.GetHealthScope(); !strings.EqualFold(scope, c.String("scope")) {
+			return exitErrorf(ExitUsage, "scope must be %s, %s, or %s", doctor.AutoScope, doctor.HostScope, doctor.ContainerScope)
+		}
+	}
+
+	// Leave time to collect the other components after a long cpu sample
+	if c.IsSet("sample") {
+		sample = c.Duration("sample")
+		if timeout <= sample {
+			timeout = sample + doctor.DefaultCPUSample
+		}
+	}
+
+	// Report the health of the running service if there is one
+	if path, ok := controlSocket(); ok && len(c.StringSlice("disk")) == 0 && !c.IsSet("sample") && !c.IsSet("scope") {
+		result, err := agent.Control(path, agent.HealthCommand, nil)
+		if err != nil {
+			return fail(err)
+		}
+
+		if err := printJSON(result); err != nil {
+			return err
+		}
+
+		status := new(kahu.SystemStatus)
+		if err := json.Unmarshal(result, status); err != nil {
+			return fail(err)
+		}
+		return healthAlerts(status)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// Report the components that failed if the status is incomplete
+	status, err := doctor.HealthCheckScope(ctx, true, sample, scope, disks...)
+	if status == nil {
+		return fail(err)
+	}
+
+	if status.Container != nil && image != "" {
+		status.Container.Image = image
+	}
+
+	if err != nil && !jsonErrors {
+		fmt.Fprintln(os.Stderr, err)
+	}
+
+	if err := status.Evaluate(rules); err != nil {
+		return fail(err)
+	}
+
+	data, err := status.Dump(2)
+	if err != nil {
+		return exitErrorf(ExitFailure, "couldn't dump status to JSON")
+	}
+
+	fmt.Println(string(data))
+	return healthAlerts(status)
+}
+
+// Request the health of a neighbor (or any address) from its echo server
+func remoteHealth(c *cli.Context) error {
+	if err := initClient(c); err != nil {
+		return err
+	}
+	agent.SetLogLevel(agent.Silent)
+
+	// Look up the address of the host if it is a neighbor
+	target, addr := c.String("host"), c.String("host")
+	source, _ := os.Hostname()
+	if info, err := client.FetchNeighbors(context.Background()); err == nil {
+		source = info.Source
+		for _, neighbor := range info.Targets {
+			if neighbor.Hostname == target {
+				addr = neighbor.IPAddr
+				break
+			}
+		}
+	}
+
+	status, err := client.RemoteHealth(context.Background(), source, target, addr)
+	if err != nil {
+		return fail(err)
+	}
+
+	data, err := status.Dump(2)
+	if err != nil {
+		return exitErrorf(ExitFailure, "couldn't dump status to JSON")
+	}
+
+	fmt.Println(string(data))
+	return healthAlerts(status)
+}
+
+// Exits as unhealthy if any health rules were crossed
+func healthAlerts(status *kahu.SystemStatus) error {
+	if len(status.Alerts) > 0 {
+		return exitErrorf(ExitUnhealthy, "%d health alerts", len(status.Alerts))
+	}
 	return nil
 }
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bbengfort/kekahu/agent"
+	"github.com/bbengfort/kekahu/kahu"
+)
+
+// Terminal control sequences used to redraw the dashboard in place.
+const (
+	clearScreen = "\033[H\033[2J"
+	hideCursor  = "\033[?25l"
+	showCursor  = "\033[?25h"
+)
+
+// The health report samples the CPU and disks, so it is refreshed less often.
+const healthRefresh = 10 * time.Second
+
+// Characters of the latency sparklines from fastest to slowest.
+var sparks = []rune("▁▂▃▄▅▆▇█")
+
+// The state of the service as reported by the status control command.
+type topStatus struct {
+	Replica       string    `json:"replica"`
+	Active        bool      `json:"active"`
+	Success       bool      `json:"success"`
+	Uptime        string    `json:"uptime"`
+	PID           int       `json:"pid"`
+	Heartbeats    uint64    `json:"heartbeats"`
+	LastHeartbeat time.Time `json:"last_heartbeat"`
+	NextHeartbeat time.Time `json:"next_heartbeat"`
+	Errors        uint64    `json:"errors"`
+	LastError     string    `json:"last_error"`
+}
+
+// The latency statistics of a neighbor as reported by the metrics command.
+type topLatency struct {
+	Samples uint64   `json:"samples"`
+	Mean    string   `json:"mean"`
+	Loss    float64  `json:"loss"`
+	Recent  []string `json:"recent"`
+	Skew    string   `json:"skew"`
+}
+
+// Dashboard renders the state of the running service, refreshing it from
+// the control socket at the path until it is interrupted.
+type dashboard struct {
+	path    string                 // the control socket of the service
+	health  *kahu.SystemStatus     // the last health report
+	checked time.Time              // when the health report was fetched
+	err     error                  // the last error fetching the health report
+	status  *topStatus             // the last status of the service
+	metrics map[string]*topLatency // the last latency statistics
+}
+
+// Run the dashboard, redrawing it every refresh interval.
+func runDashboard(path string, refresh time.Duration) error {
+	d := &dashboard{path: path}
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(quit)
+
+	fmt.Print(hideCursor)
+	defer fmt.Print(showCursor)
+
+	done := make(chan struct{})
+	defer close(done)
+
+	reports := make(chan healthReport)
+	go d.refreshHealth(reports, done)
+
+	ticker := time.NewTicker(refresh)
+	defer ticker.Stop()
+
+	for {
+		buf := new(bytes.Buffer)
+		d.render(buf)
+		fmt.Print(clearScreen + buf.String())
+
+		select {
+		case <-ticker.C:
+		case report := <-reports:
+			d.err = report.err
+			if report.err == nil {
+				d.health = report.health
+				d.checked = time.Now()
+			}
+		case <-quit:
+			fmt.Println()
+			return nil
+		}
+	}
+}
+
+// A health report fetched in the background or the error fetching it.
+type healthReport struct {
+	health *kahu.SystemStatus
+	err    error
+}
+
+// Fetches the health report in the background since it takes a moment to
+// sample the CPU usage, sending it to the dashboard until done is closed.
+func (d *dashboard) refreshHealth(reports chan<- healthReport, done <-chan struct{}) {
+	for {
+		report := healthReport{health: new(kahu.SystemStatus)}
+		result, err := agent.Control(d.path, agent.HealthCommand, nil)
+		if err == nil {
+			err = json.Unmarshal(result, report.health)
+		}
+		report.err = err
+
+		select {
+		case reports <- report:
+		case <-done:
+			return
+		}
+
+		select {
+		case <-time.After(healthRefresh):
+		case <-done:
+			return
+		}
+	}
+}
+
+// Fetches the status and metrics and writes the dashboard to w.
+func (d *dashboard) render(w io.Writer) {
+	now := time.Now()
+	fmt.Fprintf(w, "kekahu top - %s\n\n", now.Format("Jan 02 15:04:05"))
+
+	if err := d.fetch(); err != nil {
+		fmt.Fprintf(w, "could not reach the kekahu service: %s\n", err)
+	} else {
+		d.renderStatus(w, now)
+		d.renderNeighbors(w)
+	}
+
+	d.renderHealth(w, now)
+	fmt.Fprintln(w, "\npress ctrl+c to quit")
+}
+
+// Fetches the status and metrics of the service from the control socket.
+func (d *dashboard) fetch() error {
+	result, err := agent.Control(d.path, agent.StatusCommand, nil)
+	if err != nil {
+		return err
+	}
+
+	status := new(topStatus)
+	if err := json.Unmarshal(result, status); err != nil {
+		return err
+	}
+
+	if result, err = agent.Control(d.path, agent.MetricsCommand, nil); err != nil {
+		return err
+	}
+
+	metrics := make(map[string]*topLatency)
+	if err := json.Unmarshal(result, &metrics); err != nil {
+		return err
+	}
+
+	d.status = status
+	d.metrics = metrics
+	return nil
+}
+
+// Writes the heartbeat countdown and the last response from Kahu.
+func (d *dashboard) renderStatus(w io.Writer, now time.Time) {
+	s := d.status
+	replica := s.Replica
+	if replica == "" {
+		replica = "unknown replica"
+	}
+
+	fmt.Fprintf(w, "%s (pid %d) up %s\n", replica, s.PID, s.Uptime)
+
+	next := "not scheduled"
+	if !s.NextHeartbeat.IsZero() {
+		next = "in " + roundDuration(s.NextHeartbeat.Sub(now)).String()
+		if now.After(s.NextHeartbeat) {
+			next = "sending"
+		}
+	}
+
+	last := "never"
+	if !s.LastHeartbeat.IsZero() {
+		last = roundDuration(now.Sub(s.LastHeartbeat)).String() + " ago"
+	}
+
+	fmt.Fprintf(w, "heartbeat:  next %s, last %s (%d sent)\n", next, last, s.Heartbeats)
+	fmt.Fprintf(w, "response:   success %t, active %t\n", s.Success, s.Active)
+	fmt.Fprintf(w, "errors:     %d", s.Errors)
+	if s.LastError != "" {
+		fmt.Fprintf(w, " (last: %s)", truncate(s.LastError, 60))
+	}
+	fmt.Fprint(w, "\n\n")
+}
+
+// Writes the latency statistics and a sparkline of each neighbor.
+func (d *dashboard) renderNeighbors(w io.Writer) {
+	if len(d.metrics) == 0 {
+		fmt.Fprint(w, "no neighbors have been pinged yet\n\n")
+		return
+	}
+
+	hosts := make([]string, 0, len(d.metrics))
+	for host := range d.metrics {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NEIGHBOR\tLAST\tMEAN\tLOSS\tSKEW\tLATENCY")
+	for _, host := range hosts {
+		m := d.metrics[host]
+
+		recent := make([]time.Duration, 0, len(m.Recent))
+		for _, latency := range m.Recent {
+			if dur, err := time.ParseDuration(latency); err == nil {
+				recent = append(recent, dur)
+			}
+		}
+
+		last := "-"
+		if len(recent) > 0 {
+			last = formatLatency(recent[len(recent)-1])
+		}
+
+		skew := m.Skew
+		if skew == "" {
+			skew = "-"
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%0.1f%%\t%s\t%s\n", host, last, m.Mean, m.Loss, skew, sparkline(recent))
+	}
+	tw.Flush()
+	fmt.Fprintln(w)
+}
+
+// Writes gauges of the CPU, memory, and disk usage from the health report.
+func (d *dashboard) renderHealth(w io.Writer, now time.Time) {
+	if d.health == nil {
+		if d.err != nil {
+			fmt.Fprintf(w, "system health unavailable: %s\n", d.err)
+		} else {
+			fmt.Fprintln(w, "checking system health ...")
+		}
+		return
+	}
+
+	fmt.Fprintf(w, "system health (%s ago)\n", roundDuration(now.Sub(d.checked)))
+	fmt.Fprintf(w, "  cpu   %s\n", gauge(d.health.CPUPercent))
+	fmt.Fprintf(w, "  ram   %s\n", gauge(d.health.UsedRAMPercent))
+
+	if len(d.health.Disks) == 0 {
+		fmt.Fprintf(w, "  disk  %s\n", gauge(d.health.UsedDiskPercent))
+	}
+	for _, disk := range d.health.Disks {
+		fmt.Fprintf(w, "  disk  %s %s\n", gauge(disk.UsedPercent), disk.Path)
+	}
+
+	for _, alert := range d.health.Alerts {
+		fmt.Fprintf(w, "  alert %s\n", alert.Message)
+	}
+}
+
+//===========================================================================
+// Dashboard Helpers
+//===========================================================================
+
+// Returns a sparkline of the latencies scaled from the fastest to the
+// slowest, with timeouts marked by an x.
+func sparkline(latencies []time.Duration) string {
+	var min, max time.Duration
+	for _, latency := range latencies {
+		if latency == 0 {
+			continue
+		}
+		if min == 0 || latency < min {
+			min = latency
+		}
+		if latency > max {
+			max = latency
+		}
+	}
+
+	line := make([]rune, 0, len(latencies))
+	for _, latency := range latencies {
+		switch {
+		case latency == 0:
+			line = append(line, 'x')
+		case max == min:
+			line = append(line, sparks[0])
+		default:
+			idx := int(float64(latency-min) / float64(max-min) * float64(len(sparks)-1))
+			line = append(line, sparks[idx])
+		}
+	}
+	return string(line)
+}
+
+// Returns a bar gauge of the percentage.
+func gauge(percent float64) string {
+	const width = 30
+	filled := int(percent / 100 * width)
+	if filled > width {
+		filled = width
+	}
+	if filled < 0 {
+		filled = 0
+	}
+	return fmt.Sprintf("[%s%s] %5.1f%%", strings.Repeat("#", filled), strings.Repeat(".", width-filled), percent)
+}
+
+// Formats the latency in milliseconds, or timeout if it is zero.
+func formatLatency(latency time.Duration) string {
+	if latency == 0 {
+		return "timeout"
+	}
+	return fmt.Sprintf("%0.2fms", float64(latency)/float64(time.Millisecond))
+}
+
+// Rounds the duration to seconds for countdowns.
+func roundDuration(d time.Duration) time.Duration {
+	return d.Round(time.Second)
+}
+
+// Truncates the string to n characters with an ellipsis.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n-3] + "..."
+}
@@ -0,0 +1,132 @@
+// Package kekahu is a compatibility facade of the kekahu service, which is
+// implemented by the agent, net, kahu, and doctor packages. The names that
+// the flat kekahu package exported before it was split are aliases of or
+// wrappers around the names in those packages. New programs should import
+// the packages they use directly, the names added since the split are only
+// exported by those packages.
+package kekahu
+
+import (
+	"context"
+	"time"
+
+	"github.com/bbengfort/kekahu/agent"
+	"github.com/bbengfort/kekahu/doctor"
+	"github.com/bbengfort/kekahu/kahu"
+	knet "github.com/bbengfort/kekahu/net"
+)
+
+//===========================================================================
+// KeKahu Service
+//===========================================================================
+
+// PackageVersion of the KeKahu application.
+const PackageVersion = agent.PackageVersion
+
+// New constructs a KeKahu client from an api key and url pair, see agent.New.
+func New(options *Config) (*KeKahu, error) {
+	return agent.New(options)
+}
+
+// KeKahu is the Kahu client that performs service requests to Kahu, see
+// agent.KeKahu.
+type KeKahu = agent.KeKahu
+
+// Network keeps track of latency statistics between peers when running the
+// echo ping protocol on each heartbeat, see agent.Network.
+type Network = agent.Network
+
+//===========================================================================
+// Configuration
+//===========================================================================
+
+// Config uses the multiconfig loader and validators to store configuration
+// values required for the kekahu service and to parse complex types, see
+// agent.Config.
+type Config = agent.Config
+
+// ComplexValidator validates complex types that multiconfig doesn't
+// understand, see agent.ComplexValidator.
+type ComplexValidator = agent.ComplexValidator
+
+// FindConfigPath returns the first file in path search list that exists, see
+// agent.FindConfigPath.
+func FindConfigPath() (string, error) {
+	return agent.FindConfigPath()
+}
+
+//===========================================================================
+// Logging
+//===========================================================================
+
+// Levels for implementing the debug and trace message functionality.
+const (
+	Trace  = agent.Trace
+	Debug  = agent.Debug
+	Info   = agent.Info
+	Status = agent.Status
+	Warn   = agent.Warn
+	Silent = agent.Silent
+)
+
+// LogLevel returns a string representation of the current level, see
+// agent.LogLevel.
+func LogLevel() string {
+	return agent.LogLevel()
+}
+
+// SetLogLevel modifies the log level for messages at runtime, see
+// agent.SetLogLevel.
+func SetLogLevel(level uint8) {
+	agent.SetLogLevel(level)
+}
+
+//===========================================================================
+// Echo Server
+//===========================================================================
+
+// DefaultAddr is the default port that the server listens on.
+const DefaultAddr = knet.DefaultAddr
+
+// Server implements the Echo service to respond to ping requests from other
+// hosts in order to measure inter-host latencies over time, see knet.Server.
+type Server = knet.Server
+
+//===========================================================================
+// Kahu API
+//===========================================================================
+
+// Endpoints on the Kahu RESTful API
+const (
+	HeartbeatEndpoint = kahu.HeartbeatEndpoint
+	LatencyEndpoint   = kahu.LatencyEndpoint
+	NeighborsEndpoint = kahu.NeighborsEndpoint
+	ReplicasEndpoint  = kahu.ReplicasEndpoint
+	HealthEndpoint    = kahu.HealthEndpoint
+)
+
+// Requests and responses of the Kahu API.
+type (
+	HeartbeatRequest       = kahu.HeartbeatRequest
+	HeartbeatResponse      = kahu.HeartbeatResponse
+	NeighborsResponse      = kahu.NeighborsResponse
+	Neighbor               = kahu.Neighbor
+	UpdateLatencyRequests  = kahu.UpdateLatencyRequests
+	UpdateLatencyRequest   = kahu.UpdateLatencyRequest
+	UpdateLatencyResponses = kahu.UpdateLatencyResponses
+	UpdateLatencyResponse  = kahu.UpdateLatencyResponse
+)
+
+//===========================================================================
+// System Health
+//===========================================================================
+
+// SystemStatus is the system health reported to the Kahu API, see
+// kahu.SystemStatus.
+type SystemStatus = kahu.SystemStatus
+
+// HealthCheck returns the system health of the local host, see
+// doctor.HealthCheck.
+func HealthCheck(ctx context.Context, ignoreErrors bool, sample time.Duration, diskPaths ...string) (*SystemStatus, error) {
+	return doctor.HealthCheck(ctx, ignoreErrors, sample, diskPaths...)
+}
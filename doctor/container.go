@@ -0,0 +1,75 @@
+package doctor
+
+import (
+	"context"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/bbengfort/kekahu/kahu"
+)
+
+// Scopes of the memory and CPU fields of the health report.
+const (
+	AutoScope      = "auto"      // report the container's resources if running in a container
+	HostScope      = "host"      // always report the resources of the host
+	ContainerScope = "container" // always report the resources of the cgroup of the process
+)
+
+// Get the container status of the process, measuring the CPU utilization of
+// the cgroup over the sample window. The cgroup is only read if a container
+// is detected or the scope is container.
+func getContainerStatus(ctx context.Context, s *kahu.SystemStatus, sample time.Duration, scope string) error {
+	container, inContainer := detectContainer()
+	s.InContainer = inContainer
+	if !inContainer && !strings.EqualFold(scope, ContainerScope) {
+		return nil
+	}
+
+	if err := getCgroupStatus(ctx, container, sample); err != nil {
+		if inContainer {
+			s.Container = container
+		}
+		return err
+	}
+
+	s.Container = container
+	return nil
+}
+
+// Replaces the host-level memory and CPU fields of the status with those of
+// the container, depending on the scope.
+func applyScope(s *kahu.SystemStatus, scope string) {
+	if s.Container == nil || s.Container.Cgroup == 0 {
+		return
+	}
+
+	switch strings.ToLower(scope) {
+	case HostScope:
+		return
+	case ContainerScope:
+	default:
+		if !s.InContainer {
+			return
+		}
+	}
+
+	c := s.Container
+	if c.MemoryLimit > 0 && (s.TotalRAM == 0 || c.MemoryLimit < s.TotalRAM) {
+		s.TotalRAM = c.MemoryLimit
+	}
+
+	if s.TotalRAM > 0 {
+		s.UsedRAM = c.MemoryUsage
+		s.AvailableRAM = 0
+		if c.MemoryUsage < s.TotalRAM {
+			s.AvailableRAM = s.TotalRAM - c.MemoryUsage
+		}
+		s.UsedRAMPercent = float64(c.MemoryUsage) / float64(s.TotalRAM) * 100
+	}
+
+	if c.CPULimit > 0 {
+		s.CPUCores = int32(math.Ceil(c.CPULimit))
+	}
+	s.CPUPercent = c.CPUPercent
+}
@@ -0,0 +1,355 @@
+package doctor
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bbengfort/kekahu/kahu"
+	"github.com/shirou/gopsutil/mem"
+)
+
+// The root of the cgroup file system.
+const cgroupRoot = "/sys/fs/cgroup"
+
+// Memory limits of cgroup v1 at or above this are unlimited (the kernel
+// reports the largest page aligned value instead of a sentinel).
+const cgroupUnlimited = 1 << 62
+
+// Container IDs are 64 hex characters in the cgroup paths and mounts of the
+// container, e.g. /docker/<id> or /kubepods/.../cri-containerd-<id>.scope.
+var containerID = regexp.MustCompile(`[0-9a-f]{64}`)
+
+// Markers of the container runtimes in the cgroup paths of the process.
+var cgroupRuntimes = []struct{ marker, runtime string }{
+	{"kubepods", "kubernetes"},
+	{"libpod", "podman"},
+	{"docker", "docker"},
+	{"containerd", "containerd"},
+	{"lxc", "lxc"},
+}
+
+// Detects whether the process runs in a container from the files and
+// environment variables that container runtimes create and from the cgroup
+// paths of the process, returning the container with its ID, image and
+// runtime as far as they can be found.
+func detectContainer() (*kahu.ContainerStatus, bool) {
+	container := new(kahu.ContainerStatus)
+	cgroups, _ := ioutil.ReadFile("/proc/self/cgroup")
+	for _, item := range cgroupRuntimes {
+		if bytes.Contains(cgroups, []byte(item.marker)) {
+			container.Runtime = item.runtime
+			break
+		}
+	}
+
+	if container.Runtime == "" {
+		switch {
+		case os.Getenv("KUBERNETES_SERVICE_HOST") != "":
+			container.Runtime = "kubernetes"
+		case fileExists("/.dockerenv"):
+			container.Runtime = "docker"
+		case fileExists("/run/.containerenv"):
+			container.Runtime = "podman"
+		default:
+			// Set by systemd-nspawn, lxc, and podman in the environment of PID 1
+			container.Runtime = os.Getenv("container")
+		}
+	}
+
+	// Podman describes the container in a file mounted into it
+	if env, err := ioutil.ReadFile("/run/.containerenv"); err == nil {
+		for _, line := range strings.Split(string(env), "\n") {
+			parts := strings.SplitN(line, "=", 2)
+			if len(parts) != 2 {
+				continue
+			}
+
+			value := strings.Trim(strings.TrimSpace(parts[1]), `"`)
+			switch strings.TrimSpace(parts[0]) {
+			case "id":
+				container.ID = value
+			case "image":
+				container.Image = value
+			}
+		}
+	}
+
+	// With cgroup namespaces the ID is only in the mounts of the container
+	if container.ID == "" {
+		if id := containerID.Find(cgroups); id != nil {
+			container.ID = string(id)
+		} else if mounts, err := ioutil.ReadFile("/proc/self/mountinfo"); err == nil && container.Runtime != "" {
+			if id := containerID.Find(mounts); id != nil {
+				container.ID = string(id)
+			}
+		}
+	}
+
+	return container, container.Runtime != ""
+}
+
+// Reads the memory and CPU limits and usage of the cgroup of the process,
+// measuring the CPU utilization over the sample window.
+func getCgroupStatus(ctx context.Context, c *kahu.ContainerStatus, sample time.Duration) error {
+	cgroup, err := openCgroup()
+	if err != nil {
+		return err
+	}
+
+	before, err := cgroup.cpuUsage()
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+
+	if c.MemoryLimit, c.MemoryUsage, err = cgroup.memory(); err != nil {
+		return err
+	}
+
+	if c.CPULimit, err = cgroup.cpuLimit(); err != nil {
+		return err
+	}
+
+	select {
+	case <-time.After(sample):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	after, err := cgroup.cpuUsage()
+	if err != nil {
+		return err
+	}
+
+	// Percentages are relative to the limits, or the host if unlimited
+	if c.MemoryLimit > 0 {
+		c.MemoryPercent = float64(c.MemoryUsage) / float64(c.MemoryLimit) * 100
+	} else if info, err := mem.VirtualMemory(); err == nil && info.Total > 0 {
+		c.MemoryPercent = float64(c.MemoryUsage) / float64(info.Total) * 100
+	}
+
+	cpus := c.CPULimit
+	if cpus <= 0 {
+		cpus = float64(runtime.NumCPU())
+	}
+
+	if elapsed := time.Since(start); elapsed > 0 && after >= before {
+		c.CPUPercent = math.Min((after-before).Seconds()/elapsed.Seconds()/cpus*100, 100)
+	}
+
+	c.Cgroup = cgroup.version
+	return nil
+}
+
+//===========================================================================
+// Cgroup File System
+//===========================================================================
+
+// The directories of the memory and CPU controllers of the cgroup of the
+// process. In cgroup v2 they are the same directory.
+type cgroupDirs struct {
+	version int
+	memDir  string
+	cpuDir  string
+	acctDir string
+}
+
+// Finds the cgroup of the process from /proc/self/cgroup. Each line is the
+// hierarchy ID, the comma separated controllers (empty in cgroup v2), and the
+// path of the cgroup relative to the mount of the hierarchy.
+func openCgroup() (*cgroupDirs, error) {
+	data, err := ioutil.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return nil, fmt.Errorf("could not read cgroup: %s", err)
+	}
+
+	paths := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+
+		for _, controller := range strings.Split(parts[1], ",") {
+			paths[controller] = parts[2]
+		}
+	}
+
+	if fileExists(filepath.Join(cgroupRoot, "cgroup.controllers")) {
+		dir := cgroupDir(cgroupRoot, paths[""])
+		return &cgroupDirs{version: 2, memDir: dir, cpuDir: dir, acctDir: dir}, nil
+	}
+
+	cgroup := &cgroupDirs{
+		version: 1,
+		memDir:  cgroupDir(filepath.Join(cgroupRoot, "memory"), paths["memory"]),
+		cpuDir:  cgroupDir(filepath.Join(cgroupRoot, "cpu"), paths["cpu"]),
+		acctDir: cgroupDir(filepath.Join(cgroupRoot, "cpuacct"), paths["cpuacct"]),
+	}
+
+	if !fileExists(cgroup.memDir) {
+		return nil, errors.New("could not find the memory cgroup")
+	}
+	return cgroup, nil
+}
+
+// Returns the directory of the cgroup path in the mount of the hierarchy. In
+// a cgroup namespace the mount is the cgroup of the process, so the mount is
+// returned if the path isn't in it.
+func cgroupDir(mount, path string) string {
+	dir := filepath.Join(mount, path)
+	if path == "" || !fileExists(dir) {
+		return mount
+	}
+	return dir
+}
+
+// Returns the memory limit (zero if unlimited) and the memory usage of the
+// cgroup without the inactive file caches, which the kernel reclaims before
+// the limit is hit.
+func (c *cgroupDirs) memory() (limit, usage uint64, err error) {
+	limitFile, usageFile, inactiveKey := "memory.max", "memory.current", "inactive_file"
+	if c.version == 1 {
+		limitFile, usageFile, inactiveKey = "memory.limit_in_bytes", "memory.usage_in_bytes", "total_inactive_file"
+	}
+
+	value, err := readCgroupFile(c.memDir, limitFile)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if value != "max" {
+		if limit, err = strconv.ParseUint(value, 10, 64); err != nil {
+			return 0, 0, fmt.Errorf("could not parse %s: %s", limitFile, err)
+		}
+
+		if limit >= cgroupUnlimited {
+			limit = 0
+		}
+	}
+
+	if value, err = readCgroupFile(c.memDir, usageFile); err != nil {
+		return 0, 0, err
+	}
+
+	if usage, err = strconv.ParseUint(value, 10, 64); err != nil {
+		return 0, 0, fmt.Errorf("could not parse %s: %s", usageFile, err)
+	}
+
+	if stat, err := readCgroupFile(c.memDir, "memory.stat"); err == nil {
+		for _, line := range strings.Split(stat, "\n") {
+			fields := strings.Fields(line)
+			if len(fields) != 2 || fields[0] != inactiveKey {
+				continue
+			}
+
+			if inactive, err := strconv.ParseUint(fields[1], 10, 64); err == nil && inactive < usage {
+				usage -= inactive
+			}
+		}
+	}
+	return limit, usage, nil
+}
+
+// Returns the CPU quota of the cgroup in cores, or zero if it is unlimited.
+func (c *cgroupDirs) cpuLimit() (float64, error) {
+	var quota, period string
+	if c.version == 2 {
+		value, err := readCgroupFile(c.cpuDir, "cpu.max")
+		if err != nil {
+			// The cpu controller isn't enabled for the cgroup
+			return 0, nil
+		}
+
+		fields := strings.Fields(value)
+		if len(fields) != 2 {
+			return 0, fmt.Errorf("could not parse cpu.max: %q", value)
+		}
+		quota, period = fields[0], fields[1]
+	} else {
+		var err error
+		if quota, err = readCgroupFile(c.cpuDir, "cpu.cfs_quota_us"); err != nil {
+			return 0, nil
+		}
+
+		if period, err = readCgroupFile(c.cpuDir, "cpu.cfs_period_us"); err != nil {
+			return 0, err
+		}
+	}
+
+	if quota == "max" || quota == "-1" {
+		return 0, nil
+	}
+
+	q, err := strconv.ParseFloat(quota, 64)
+	if err != nil {
+		return 0, fmt.Errorf("could not parse cpu quota: %s", err)
+	}
+
+	p, err := strconv.ParseFloat(period, 64)
+	if err != nil || p <= 0 {
+		return 0, fmt.Errorf("could not parse cpu period: %q", period)
+	}
+	return q / p, nil
+}
+
+// Returns the total CPU time used by the cgroup.
+func (c *cgroupDirs) cpuUsage() (time.Duration, error) {
+	if c.version == 1 {
+		value, err := readCgroupFile(c.acctDir, "cpuacct.usage")
+		if err != nil {
+			return 0, err
+		}
+
+		usage, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("could not parse cpuacct.usage: %s", err)
+		}
+		return time.Duration(usage), nil
+	}
+
+	stat, err := readCgroupFile(c.acctDir, "cpu.stat")
+	if err != nil {
+		return 0, err
+	}
+
+	for _, line := range strings.Split(stat, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "usage_usec" {
+			usage, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("could not parse cpu.stat: %s", err)
+			}
+			return time.Duration(usage) * time.Microsecond, nil
+		}
+	}
+	return 0, errors.New("no cpu usage in cpu.stat")
+}
+
+// Reads the trimmed contents of the file in the cgroup directory.
+func readCgroupFile(dir, name string) (string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return "", fmt.Errorf("could not read cgroup %s: %s", name, err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// Returns true if the file exists.
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,22 @@
+//go:build !linux
+// +build !linux
+
+package doctor
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/bbengfort/kekahu/kahu"
+)
+
+// Containers are only detected on Linux, where their limits are read from the
+// cgroup file system.
+func detectContainer() (*kahu.ContainerStatus, bool) {
+	return new(kahu.ContainerStatus), false
+}
+
+func getCgroupStatus(ctx context.Context, c *kahu.ContainerStatus, sample time.Duration) error {
+	return errors.New("cgroups are only supported on linux")
+}
@@ -0,0 +1,347 @@
+// Package doctor checks the health of the host that kekahu runs on: its
+// operating system, memory, disks, CPU utilization, load, network interfaces,
+// temperatures, container limits, and the kekahu process itself, along with
+// the custom components of registered health providers. The system status is
+// reported to Kahu by the kekahu service, see the kahu package.
+package doctor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bbengfort/kekahu/kahu"
+	"github.com/bbengfort/x/unique"
+	"github.com/opalmer/check-go-version/api"
+	"github.com/shirou/gopsutil/cpu"
+	"github.com/shirou/gopsutil/disk"
+	"github.com/shirou/gopsutil/host"
+	"github.com/shirou/gopsutil/mem"
+)
+
+// DefaultCPUSample is the window that CPU utilization is measured over if no
+// sample window is specified.
+const DefaultCPUSample = 5 * time.Second
+
+// HealthCheck returns the system status, fetching all components of the status.
+// The components are fetched concurrently until they complete or the context
+// is done, components that have not completed by then fail with the error of
+// the context. Note that fetching system information can fail in several
+// places, all status components are attempted, then aggregated into a single
+// HealthError with the error of each component that failed. If ignoreErrors is
+// true, the partially populated status is returned along with the HealthError
+// unless ALL status components fail. If it is false, no status is returned if
+// any one status component fails.
+//
+// The CPU utilization is measured over the sample window, or DefaultCPUSample
+// if it is zero. The disk usage is reported for each of the specified mount
+// points, or for the DefaultDiskPaths if none are specified.
+//
+// The memory and CPU fields report the limits and usage of the container if
+// kekahu runs in one, see HealthCheckScope.
+//
+// It is recommended to call this function with ignoreErrors=true
+func HealthCheck(ctx context.Context, ignoreErrors bool, sample time.Duration, diskPaths ...string) (*kahu.SystemStatus, error) {
+	return HealthCheckScope(ctx, ignoreErrors, sample, AutoScope, diskPaths...)
+}
+
+// HealthCheckScope is HealthCheck with the scope of the memory and CPU fields
+// of the status. The container component detects whether kekahu runs in a
+// container and reports it in the container field. With the auto scope the
+// memory and CPU fields report the container's limits and usage if it does,
+// since the host-level numbers mislead inside a container. The container
+// scope reports the cgroup of the process even if no container is detected,
+// e.g. a systemd service with resource limits, and the host scope always
+// reports the host-level numbers. Load averages and disks are host-level.
+func HealthCheckScope(ctx context.Context, ignoreErrors bool, sample time.Duration, scope string, diskPaths ...string) (*kahu.SystemStatus, error) {
+	if len(diskPaths) == 0 {
+		diskPaths = DefaultDiskPaths()
+	}
+
+	if sample <= 0 {
+		sample = DefaultCPUSample
+	}
+
+	// Status components to call to populate the system information.
+	statusComponents := []statusComponent{
+		{"host", func(ctx context.Context, s *kahu.SystemStatus) error { return getHostStatus(s) }},
+		{"memory", func(ctx context.Context, s *kahu.SystemStatus) error { return getMemStatus(s) }},
+		{"disk", func(ctx context.Context, s *kahu.SystemStatus) error { return getDiskStatus(s, diskPaths) }},
+		{"cpu", func(ctx context.Context, s *kahu.SystemStatus) error { return getCPUStatus(s) }},
+		{"utilization", func(ctx context.Context, s *kahu.SystemStatus) error { return getUtilizationStatus(ctx, s, sample) }},
+		{"load", func(ctx context.Context, s *kahu.SystemStatus) error { return getLoadStatus(s) }},
+		{"network", func(ctx context.Context, s *kahu.SystemStatus) error { return getNetworkStatus(s) }},
+		{"temperature", func(ctx context.Context, s *kahu.SystemStatus) error { return getTemperatureStatus(s) }},
+		{"runtime", func(ctx context.Context, s *kahu.SystemStatus) error { return getGoRuntime(s) }},
+		{"process", func(ctx context.Context, s *kahu.SystemStatus) error { return getProcessStatus(s) }},
+		{"extensions", func(ctx context.Context, s *kahu.SystemStatus) error { return getExtensions(ctx, s) }},
+		{"container", func(ctx context.Context, s *kahu.SystemStatus) error {
+			return getContainerStatus(ctx, s, sample, scope)
+		}},
+	}
+
+	// Each component populates its own status so that components that are
+	// still running when the context is done cannot modify the status.
+	type result struct {
+		idx  int
+		part *kahu.SystemStatus
+		err  error
+	}
+
+	results := make(chan result, len(statusComponents))
+	for i, component := range statusComponents {
+		go func(i int, component statusComponent) {
+			part := new(kahu.SystemStatus)
+			err := component.check(ctx, part)
+			results <- result{i, part, err}
+		}(i, component)
+	}
+
+	// Merge the components as they complete, keeping track of the errors
+	status := new(kahu.SystemStatus)
+	statusErrors := &HealthError{Components: make(map[string]error), Checked: len(statusComponents)}
+	completed := make([]bool, len(statusComponents))
+
+wait:
+	for pending := len(statusComponents); pending > 0; pending-- {
+		select {
+		case r := <-results:
+			completed[r.idx] = true
+			merge(status, r.part)
+			if r.err != nil {
+				statusErrors.Components[statusComponents[r.idx].name] = r.err
+			}
+		case <-ctx.Done():
+			for i, component := range statusComponents {
+				if !completed[i] {
+					statusErrors.Components[component.name] = ctx.Err()
+				}
+			}
+			break wait
+		}
+	}
+
+	applyScope(status, scope)
+	if len(statusErrors.Components) == 0 {
+		return status, nil
+	}
+
+	// Return no status if all status components failed or errors are not ignored
+	if !ignoreErrors || len(statusErrors.Components) == len(statusComponents) {
+		return nil, statusErrors
+	}
+	return status, statusErrors
+}
+
+// A named component of the system status, the check populates the fields of
+// the status for the component.
+type statusComponent struct {
+	name  string
+	check func(context.Context, *kahu.SystemStatus) error
+}
+
+// HealthError is returned by HealthCheck when status components fail, with
+// the error of each failed component by name.
+type HealthError struct {
+	Components map[string]error // the errors of the failed components by name
+	Checked    int              // the number of components that were checked
+}
+
+// Error lists the failed components with their errors in alphabetical order.
+func (e *HealthError) Error() string {
+	names := make([]string, 0, len(e.Components))
+	for name := range e.Components {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for i, name := range names {
+		names[i] = fmt.Sprintf("%s: %s", name, e.Components[name])
+	}
+
+	return fmt.Sprintf(
+		"%d of %d health status components failed: %s",
+		len(e.Components), e.Checked, strings.Join(names, "; "),
+	)
+}
+
+// DefaultDiskPaths returns the mount points to report disk usage for if none
+// are specified: the system drive on Windows and the root directory otherwise.
+func DefaultDiskPaths() []string {
+	if runtime.GOOS == "windows" {
+		if drive := os.Getenv("SystemDrive"); drive != "" {
+			return []string{drive + "\\"}
+		}
+		return []string{"C:\\"}
+	}
+	return []string{"/"}
+}
+
+// Copies the fields of the status that were populated by a status component,
+// since each component populates separate fields of the status.
+func merge(s, part *kahu.SystemStatus) {
+	dst := reflect.ValueOf(s).Elem()
+	src := reflect.ValueOf(part).Elem()
+	for i := 0; i < src.NumField(); i++ {
+		if field := src.Field(i); !field.IsZero() {
+			dst.Field(i).Set(field)
+		}
+	}
+}
+
+// Get the host info elements of the status
+func getHostStatus(s *kahu.SystemStatus) (err error) {
+	// Get the host information
+	var info *host.InfoStat
+	if info, err = host.Info(); err != nil {
+		return err
+	}
+
+	// Populate the status with the host info
+	s.Hostname = info.Hostname
+	s.OS = info.OS
+	s.Platform = info.Platform
+	s.PlatformVersion = info.PlatformVersion
+	s.ActiveProcesses = info.Procs
+	s.Uptime = info.Uptime
+
+	return nil
+}
+
+// Get the memory info elements of the status
+func getMemStatus(s *kahu.SystemStatus) (err error) {
+	// Get the memory information
+	var info *mem.VirtualMemoryStat
+	if info, err = mem.VirtualMemory(); err != nil {
+		return err
+	}
+
+	//Populate the status with memory info
+	s.TotalRAM = info.Total
+	s.AvailableRAM = info.Available
+	s.UsedRAM = info.Used
+	s.UsedRAMPercent = info.UsedPercent
+
+	return nil
+}
+
+// Get the disk info elements of the status for each of the mount points. The
+// first mount point also populates the top level disk fields of the status.
+// Mount points whose usage cannot be read are skipped and reported in the error.
+func getDiskStatus(s *kahu.SystemStatus, paths []string) (err error) {
+	s.Disks = make([]*kahu.DiskStatus, 0, len(paths))
+	failed := make([]string, 0)
+
+	for _, path := range paths {
+		// Get the disk information
+		var info *disk.UsageStat
+		if info, err = disk.Usage(path); err != nil {
+			failed = append(failed, fmt.Sprintf("%s (%s)", path, err))
+			continue
+		}
+
+		// Populate the status with disk info
+		s.Disks = append(s.Disks, &kahu.DiskStatus{
+			Path:        path,
+			Filesystem:  info.Fstype,
+			Total:       info.Total,
+			Free:        info.Free,
+			Used:        info.Used,
+			UsedPercent: info.UsedPercent,
+		})
+	}
+
+	if len(s.Disks) > 0 {
+		s.Filesystem = s.Disks[0].Filesystem
+		s.TotalDisk = s.Disks[0].Total
+		s.FreeDisk = s.Disks[0].Free
+		s.UsedDisk = s.Disks[0].Used
+		s.UsedDiskPercent = s.Disks[0].UsedPercent
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("could not get disk usage for %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// Get the CPU info elements of the status
+func getCPUStatus(s *kahu.SystemStatus) (err error) {
+	// Get the cpu information
+	var info []cpu.InfoStat
+	if info, err = cpu.Info(); err != nil {
+		return err
+	}
+
+	// All CPU model names detected
+	names := make([]string, 0, len(info))
+
+	// Populate the status with memory info
+	for _, i := range info {
+		names = append(names, i.ModelName)
+		s.CPUCores += i.Cores
+	}
+
+	// Get only the unique CPU model names
+	names = unique.Strings(names)
+	s.CPUModel = strings.Join(names, ", ")
+
+	return nil
+}
+
+// Get the CPU percent utilization element of the status, measured as the
+// percentage of time that the CPUs were busy over the sample window.
+func getUtilizationStatus(ctx context.Context, s *kahu.SystemStatus, sample time.Duration) (err error) {
+	// Get utilization information at the start and end of the window
+	// Note that percpu is false, so only the combined times are returned
+	var before, after []cpu.TimesStat
+	if before, err = cpu.Times(false); err != nil {
+		return err
+	}
+
+	select {
+	case <-time.After(sample):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	if after, err = cpu.Times(false); err != nil {
+		return err
+	}
+
+	if len(before) == 0 || len(after) == 0 {
+		return errors.New("no cpu times reported")
+	}
+
+	// Populate status with utilization info
+	total := after[0].Total() - before[0].Total()
+	idle := after[0].Idle - before[0].Idle
+	if total > 0 {
+		s.CPUPercent = math.Min(math.Max((total-idle)/total*100, 0), 100)
+	}
+
+	return nil
+}
+
+// Get the Go runtime version information
+func getGoRuntime(s *kahu.SystemStatus) (err error) {
+	// Get runtime information
+	var info *api.Version
+	if info, err = api.GetRunningVersion(); err != nil {
+		return err
+	}
+
+	// Populate the status with runtime info
+	s.GoVersion = info.FullVersion
+	s.GoPlatform = info.Platform
+	s.GoArchitecture = info.Architecture
+
+	return nil
+}
@@ -0,0 +1,110 @@
+package doctor
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/bbengfort/kekahu/kahu"
+	"github.com/shirou/gopsutil/host"
+)
+
+// Get the 1, 5, and 15 minute load averages from the /proc filesystem.
+func getLoadStatus(s *kahu.SystemStatus) error {
+	data, err := ioutil.ReadFile("/proc/loadavg")
+	if err != nil {
+		return fmt.Errorf("could not read load average: %s", err)
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) < 3 {
+		return fmt.Errorf("could not parse load average: %q", data)
+	}
+
+	loads := make([]float64, 3)
+	for i := range loads {
+		if loads[i], err = strconv.ParseFloat(fields[i], 64); err != nil {
+			return fmt.Errorf("could not parse load average: %s", err)
+		}
+	}
+
+	s.Load1, s.Load5, s.Load15 = loads[0], loads[1], loads[2]
+	return nil
+}
+
+// Get the traffic and error counters of each network interface from the
+// /proc filesystem. Each line after the two header lines is the name of the
+// interface followed by 8 receive and 8 transmit counters.
+func getNetworkStatus(s *kahu.SystemStatus) error {
+	data, err := ioutil.ReadFile("/proc/net/dev")
+	if err != nil {
+		return fmt.Errorf("could not read network interfaces: %s", err)
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 0; scanner.Scan(); line++ {
+		parts := strings.SplitN(scanner.Text(), ":", 2)
+		if line < 2 || len(parts) != 2 {
+			continue
+		}
+
+		fields := strings.Fields(parts[1])
+		if len(fields) < 12 {
+			return fmt.Errorf("could not parse network interface %s", strings.TrimSpace(parts[0]))
+		}
+
+		counters := make([]uint64, 12)
+		for i := range counters {
+			if counters[i], err = strconv.ParseUint(fields[i], 10, 64); err != nil {
+				return fmt.Errorf("could not parse network interface %s: %s", strings.TrimSpace(parts[0]), err)
+			}
+		}
+
+		s.Interfaces = append(s.Interfaces, &kahu.InterfaceStatus{
+			Name:        strings.TrimSpace(parts[0]),
+			BytesRecv:   counters[0],
+			PacketsRecv: counters[1],
+			ErrorsIn:    counters[2],
+			DroppedIn:   counters[3],
+			BytesSent:   counters[8],
+			PacketsSent: counters[9],
+			ErrorsOut:   counters[10],
+			DroppedOut:  counters[11],
+		})
+	}
+	return nil
+}
+
+// Get the current temperature of each hardware sensor from sysfs. Hosts
+// without sensors, such as most virtual machines, report no temperatures.
+func getTemperatureStatus(s *kahu.SystemStatus) error {
+	sensors, err := host.SensorsTemperatures()
+	if err != nil {
+		return fmt.Errorf("could not read temperature sensors: %s", err)
+	}
+
+	// Only the current readings are reported, not the alarm thresholds
+	for _, sensor := range sensors {
+		if !strings.HasSuffix(sensor.SensorKey, "input") {
+			continue
+		}
+
+		s.Temperatures = append(s.Temperatures, &kahu.TemperatureStatus{
+			Sensor:      strings.TrimSuffix(strings.TrimSuffix(sensor.SensorKey, "input"), "_"),
+			Temperature: sensor.Temperature,
+		})
+
+		if sensor.Temperature > s.MaxTemperature {
+			s.MaxTemperature = sensor.Temperature
+		}
+	}
+
+	sort.Slice(s.Temperatures, func(i, j int) bool {
+		return s.Temperatures[i].Sensor < s.Temperatures[j].Sensor
+	})
+	return nil
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package doctor
+
+import "github.com/bbengfort/kekahu/kahu"
+
+// The load averages, network interfaces, and temperatures are only reported
+// on Linux, where they can be read without cgo.
+func getLoadStatus(s *kahu.SystemStatus) error {
+	return nil
+}
+
+func getNetworkStatus(s *kahu.SystemStatus) error {
+	return nil
+}
+
+func getTemperatureStatus(s *kahu.SystemStatus) error {
+	return nil
+}
@@ -0,0 +1,36 @@
+package doctor
+
+import (
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/bbengfort/kekahu/kahu"
+)
+
+// The time the process started, used to report the uptime of the daemon.
+var processStarted = time.Now()
+
+// Get the status of the kekahu process from the Go runtime and the OS.
+func getProcessStatus(s *kahu.SystemStatus) error {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	s.Process = &kahu.ProcessStatus{
+		PID:          os.Getpid(),
+		Uptime:       time.Since(processStarted).Seconds(),
+		Goroutines:   runtime.NumGoroutine(),
+		HeapAlloc:    mem.HeapAlloc,
+		HeapSys:      mem.HeapSys,
+		Sys:          mem.Sys,
+		NumGC:        mem.NumGC,
+		GCPauseTotal: float64(mem.PauseTotalNs) / float64(time.Millisecond),
+	}
+
+	if mem.NumGC > 0 {
+		last := mem.PauseNs[(mem.NumGC+255)%256]
+		s.Process.GCPauseLast = float64(last) / float64(time.Millisecond)
+	}
+
+	return getResources(s.Process)
+}
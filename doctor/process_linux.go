@@ -0,0 +1,41 @@
+package doctor
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/bbengfort/kekahu/kahu"
+)
+
+// Get the resident set size and open file descriptors of the process from
+// the /proc filesystem.
+func getResources(p *kahu.ProcessStatus) error {
+	// The second field of statm is the number of resident pages
+	data, err := ioutil.ReadFile("/proc/self/statm")
+	if err != nil {
+		return fmt.Errorf("could not read process memory: %s", err)
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) < 2 {
+		return fmt.Errorf("could not parse process memory: %q", data)
+	}
+
+	pages, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return fmt.Errorf("could not parse process memory: %s", err)
+	}
+	p.RSS = pages * uint64(os.Getpagesize())
+
+	// Each open file descriptor is a link in the fd directory
+	fds, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		return fmt.Errorf("could not list open files: %s", err)
+	}
+	p.OpenFiles = len(fds)
+
+	return nil
+}
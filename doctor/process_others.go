@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package doctor
+
+import "github.com/bbengfort/kekahu/kahu"
+
+// The resident set size and open file descriptors are only reported on Linux.
+func getResources(p *kahu.ProcessStatus) error {
+	return nil
+}
@@ -0,0 +1,149 @@
+package doctor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bbengfort/kekahu/kahu"
+)
+
+// HealthProviderTimeout is the maximum amount of time a provider may take to
+// check its component before the check is canceled.
+const HealthProviderTimeout = 10 * time.Second
+
+// HealthProvider adds a custom component to the system health report, e.g.
+// the status of a local database or GPU statistics. Providers are registered
+// with RegisterHealthProvider and their results are aggregated under the
+// extensions map of the kahu.SystemStatus by provider name.
+type HealthProvider interface {
+	Name() string                                       // the unique key of the component in the extensions map
+	Check(ctx context.Context) (json.RawMessage, error) // return the JSON status of the component
+}
+
+// NewHealthProvider creates a HealthProvider from a name and check function.
+func NewHealthProvider(name string, check func(ctx context.Context) (json.RawMessage, error)) HealthProvider {
+	return &funcProvider{name: name, check: check}
+}
+
+// RegisterHealthProvider adds the provider to every subsequent health check.
+// An error is returned if a provider with the same name is already registered.
+func RegisterHealthProvider(provider HealthProvider) error {
+	healthProviders.Lock()
+	defer healthProviders.Unlock()
+
+	name := provider.Name()
+	if name == "" {
+		return errors.New("health provider must have a name")
+	}
+
+	if _, ok := healthProviders.registry[name]; ok {
+		return fmt.Errorf("health provider '%s' is already registered", name)
+	}
+
+	healthProviders.registry[name] = provider
+	return nil
+}
+
+// UnregisterHealthProvider removes the provider with the name, if registered.
+func UnregisterHealthProvider(name string) {
+	healthProviders.Lock()
+	defer healthProviders.Unlock()
+	delete(healthProviders.registry, name)
+}
+
+// HealthProviders returns the registered providers sorted by name.
+func HealthProviders() []HealthProvider {
+	healthProviders.RLock()
+	defer healthProviders.RUnlock()
+
+	providers := make([]HealthProvider, 0, len(healthProviders.registry))
+	for _, provider := range healthProviders.registry {
+		providers = append(providers, provider)
+	}
+
+	sort.Slice(providers, func(i, j int) bool {
+		return providers[i].Name() < providers[j].Name()
+	})
+	return providers
+}
+
+// The registry of health providers, safe for concurrent registration.
+var healthProviders = struct {
+	sync.RWMutex
+	registry map[string]HealthProvider
+}{registry: make(map[string]HealthProvider)}
+
+//===========================================================================
+// SystemStatus Extensions
+//===========================================================================
+
+// Get the status of each registered provider concurrently. Providers that fail
+// are reported in the extensions map with their error so that Kahu knows the
+// component is unhealthy, and are aggregated into the returned error.
+func getExtensions(ctx context.Context, s *kahu.SystemStatus) (err error) {
+	providers := HealthProviders()
+	if len(providers) == 0 {
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	results := make([]json.RawMessage, len(providers))
+	errs := make([]error, len(providers))
+
+	for i, provider := range providers {
+		wg.Add(1)
+		go func(i int, provider HealthProvider) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, HealthProviderTimeout)
+			defer cancel()
+			results[i], errs[i] = provider.Check(ctx)
+		}(i, provider)
+	}
+	wg.Wait()
+
+	s.Extensions = make(map[string]json.RawMessage, len(providers))
+	failed := make([]string, 0)
+
+	for i, provider := range providers {
+		if errs[i] == nil && !json.Valid(results[i]) {
+			errs[i] = errors.New("invalid JSON status")
+		}
+
+		if errs[i] != nil {
+			failed = append(failed, fmt.Sprintf("%s (%s)", provider.Name(), errs[i]))
+			s.Extensions[provider.Name()], _ = json.Marshal(map[string]string{"error": errs[i].Error()})
+			continue
+		}
+
+		s.Extensions[provider.Name()] = results[i]
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("health providers failed: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+//===========================================================================
+// Helpers
+//===========================================================================
+
+// Implements HealthProvider with a check function.
+type funcProvider struct {
+	name  string
+	check func(ctx context.Context) (json.RawMessage, error)
+}
+
+func (p *funcProvider) Name() string {
+	return p.name
+}
+
+func (p *funcProvider) Check(ctx context.Context) (json.RawMessage, error) {
+	return p.check(ctx)
+}
@@ -0,0 +1,185 @@
+package kahu
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Comparison operators for health rules, longer operators must come first.
+var healthRuleOperators = []string{">=", "<=", ">", "<"}
+
+// Size suffixes that may be used in health rule thresholds, e.g. 500MB.
+var healthRuleUnits = []struct {
+	suffix string
+	scale  float64
+}{
+	{"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}, {"%", 1},
+}
+
+// HealthRule is a threshold on a numeric metric of the SystemStatus that
+// raises an alert when crossed, e.g. used_disk_percent > 90. Metrics are
+// referred to by their JSON name in the health report.
+type HealthRule struct {
+	Metric    string  // JSON name of the SystemStatus metric
+	Operator  string  // one of >, >=, <, or <=
+	Threshold float64 // the value the metric is compared to
+}
+
+// ParseHealthRules parses a comma separated list of health rules.
+func ParseHealthRules(s string) ([]*HealthRule, error) {
+	rules := make([]*HealthRule, 0)
+	for _, expr := range strings.Split(s, ",") {
+		if expr = strings.TrimSpace(expr); expr == "" {
+			continue
+		}
+
+		rule, err := ParseHealthRule(expr)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// ParseHealthRule parses a rule in the form "metric op threshold" where the
+// threshold may have a size suffix (KB, MB, GB, TB) or a percent sign.
+func ParseHealthRule(expr string) (*HealthRule, error) {
+	rule := new(HealthRule)
+	for _, op := range healthRuleOperators {
+		if idx := strings.Index(expr, op); idx > 0 {
+			rule.Metric = strings.TrimSpace(expr[:idx])
+			rule.Operator = op
+			expr = strings.TrimSpace(expr[idx+len(op):])
+			break
+		}
+	}
+
+	if rule.Operator == "" {
+		return nil, fmt.Errorf("health rule '%s' has no comparison operator", expr)
+	}
+
+	if _, err := new(SystemStatus).Metric(rule.Metric); err != nil {
+		return nil, err
+	}
+
+	scale := 1.0
+	for _, unit := range healthRuleUnits {
+		if strings.HasSuffix(strings.ToUpper(expr), unit.suffix) {
+			expr = strings.TrimSpace(expr[:len(expr)-len(unit.suffix)])
+			scale = unit.scale
+			break
+		}
+	}
+
+	threshold, err := strconv.ParseFloat(expr, 64)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse threshold of %s rule: %s", rule.Metric, err)
+	}
+	rule.Threshold = threshold * scale
+
+	return rule, nil
+}
+
+// Check returns an alert if the metric in the status crosses the threshold
+// of the rule, otherwise nil is returned.
+func (r *HealthRule) Check(status *SystemStatus) (*Alert, error) {
+	val, err := status.Metric(r.Metric)
+	if err != nil {
+		return nil, err
+	}
+
+	var crossed bool
+	switch r.Operator {
+	case ">":
+		crossed = val > r.Threshold
+	case ">=":
+		crossed = val >= r.Threshold
+	case "<":
+		crossed = val < r.Threshold
+	case "<=":
+		crossed = val <= r.Threshold
+	default:
+		return nil, fmt.Errorf("unknown health rule operator '%s'", r.Operator)
+	}
+
+	if !crossed {
+		return nil, nil
+	}
+
+	return &Alert{
+		Rule:      r.String(),
+		Metric:    r.Metric,
+		Value:     val,
+		Threshold: r.Threshold,
+		Message:   fmt.Sprintf("%s is %s (threshold %s %s)", r.Metric, formatMetric(val), r.Operator, formatMetric(r.Threshold)),
+	}, nil
+}
+
+// String returns the rule as an expression with the threshold in base units.
+func (r *HealthRule) String() string {
+	return fmt.Sprintf("%s %s %s", r.Metric, r.Operator, formatMetric(r.Threshold))
+}
+
+// Formats a metric value without exponents, rounded to two decimal places.
+func formatMetric(val float64) string {
+	return strconv.FormatFloat(math.Round(val*100)/100, 'f', -1, 64)
+}
+
+// Alert is raised when a metric in the system status crosses the threshold of
+// a health rule and is reported to Kahu with the health check.
+type Alert struct {
+	Rule      string  `json:"rule"`      // the health rule that was crossed
+	Metric    string  `json:"metric"`    // the metric the rule applies to
+	Value     float64 `json:"value"`     // the value of the metric when checked
+	Threshold float64 `json:"threshold"` // the threshold of the rule
+	Message   string  `json:"message"`   // human readable description of the alert
+}
+
+//===========================================================================
+// SystemStatus Rules
+//===========================================================================
+
+// Evaluate the health rules against the status, populating the alerts of the
+// status with every rule whose threshold is crossed.
+func (s *SystemStatus) Evaluate(rules []*HealthRule) error {
+	s.Alerts = make([]*Alert, 0)
+	for _, rule := range rules {
+		alert, err := rule.Check(s)
+		if err != nil {
+			return err
+		}
+
+		if alert != nil {
+			s.Alerts = append(s.Alerts, alert)
+		}
+	}
+	return nil
+}
+
+// Metric returns the value of the numeric status field with the JSON name.
+func (s *SystemStatus) Metric(name string) (float64, error) {
+	val := reflect.ValueOf(s).Elem()
+	for i := 0; i < val.NumField(); i++ {
+		tag := strings.Split(val.Type().Field(i).Tag.Get("json"), ",")[0]
+		if tag != name {
+			continue
+		}
+
+		field := val.Field(i)
+		switch field.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return float64(field.Int()), nil
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			return float64(field.Uint()), nil
+		case reflect.Float32, reflect.Float64:
+			return field.Float(), nil
+		default:
+			return 0, fmt.Errorf("health metric '%s' is not numeric", name)
+		}
+	}
+	return 0, fmt.Errorf("unknown health metric '%s'", name)
+}
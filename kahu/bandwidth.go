@@ -0,0 +1,16 @@
+package kahu
+
+//===========================================================================
+// Bandwidth Request Objects
+//===========================================================================
+
+// BandwidthRequests to POST multiple bandwidth measurements to Kahu.
+type BandwidthRequests []*BandwidthRequest
+
+// BandwidthRequest sends a measurement of the throughput to the target to Kahu.
+type BandwidthRequest struct {
+	Target   string  `json:"target"`   // unique name of target host
+	Mbps     float64 `json:"mbps"`     // throughput to the target in megabits per second
+	Bytes    uint64  `json:"bytes"`    // number of bytes received by the target
+	Duration float64 `json:"duration"` // time to stream the bytes in milliseconds
+}
@@ -0,0 +1,626 @@
+package kahu
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bbengfort/x/peers"
+)
+
+// The most bytes of a response body that are read to reuse its connection.
+const maxDrainBody = 64 * 1024
+
+// FingerprintHeader is the header of requests to Kahu that carries the
+// fingerprint of the machine, so that Kahu can correlate the requests of a
+// host whose hostname or IP address changes.
+const FingerprintHeader = "X-Kahu-Fingerprint"
+
+// Options configure the requests of the HTTPClient.
+type Options struct {
+	URL           string                  // base URL of the Kahu API the endpoints are resolved against
+	APIKey        string                  // sent as the bearer token of every request
+	UserAgent     string                  // User-Agent sent to Kahu, the Go default if empty
+	Fingerprint   string                  // fingerprint of the machine sent in the FingerprintHeader, if any
+	Timeout       time.Duration           // timeout of each request, no timeout if zero
+	Transport     http.RoundTripper       // transport of the requests, http.DefaultTransport if nil
+	RateLimit     float64                 // max requests per second, unlimited if zero
+	RateBurst     int                     // max requests sent at once before rate limiting
+	Gzip          bool                    // compress large request bodies with gzip, Kahu must accept them
+	GzipThreshold int                     // only compress request bodies of at least this many bytes
+	SigningKeys   []string                // HMAC keys POST requests are signed with, see SignRequest
+	Retry         *RetryPolicy            // retry policy of the requests, requests are not retried if nil
+	Retries       map[string]*RetryPolicy // retry policies of specific endpoints that override Retry
+	Spool         *Spool                  // buffers reports while Kahu is unreachable, may be nil
+	OnError       func(endpoint string)   // called with the path of every failed request, may be nil
+	Schema        int                     // schema version of the payloads posted to Kahu, negotiated if zero
+	Stats         *APIStats               // records the requests to each endpoint, may be nil
+}
+
+//===========================================================================
+// HTTP Client
+//===========================================================================
+
+// HTTPClient implements Client with requests to the Kahu RESTful API.
+// Requests are authenticated with the API key, rate limited, and retried
+// according to the retry policy of the endpoint. If a spool is set,
+// heartbeats and latency reports that fail because Kahu is unreachable are
+// buffered and replayed after the next successful heartbeat.
+type HTTPClient struct {
+	sync.RWMutex
+	opts    *Options       // options of the next request
+	client  *http.Client   // HTTP client to perform requests
+	limiter *RateLimiter   // Limits the rate of requests to Kahu
+	nogzip  bool           // Set if Kahu rejected a gzip compressed request body
+	schemas map[string]int // Schema versions of the payloads negotiated with Kahu
+}
+
+// Init the client with the options. It may be called again with new options,
+// e.g. when a configuration is reloaded, which apply to the next request; the
+// rate limiter is only reset if its rate or burst changed.
+func (c *HTTPClient) Init(opts *Options) error {
+	if _, err := url.Parse(opts.URL); err != nil {
+		return fmt.Errorf("could not parse kahu url: %s", err)
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if c.opts == nil || c.opts.RateLimit != opts.RateLimit || c.opts.RateBurst != opts.RateBurst {
+		c.limiter = new(RateLimiter)
+		c.limiter.Init(opts.RateLimit, opts.RateBurst)
+	}
+
+	c.opts = opts
+	c.client = &http.Client{Timeout: opts.Timeout, Transport: opts.Transport}
+	return nil
+}
+
+// SetTimeout of the HTTP requests, e.g. when the configuration is reloaded.
+func (c *HTTPClient) SetTimeout(timeout time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.client = &http.Client{Timeout: timeout, Transport: c.client.Transport}
+}
+
+// Heartbeat posts the heartbeat to Kahu, buffering it in the spool if Kahu is
+// unreachable. Once a heartbeat succeeds, any buffered reports are replayed.
+func (c *HTTPClient) Heartbeat(ctx context.Context, data *HeartbeatRequest) (*HeartbeatResponse, error) {
+	schema := c.Schema(HeartbeatSchema)
+	body, err := encodeHeartbeat(data, schema)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := c.newSchemaRequest(ctx, HeartbeatEndpoint, schema, body)
+	if err != nil {
+		return nil, err
+	}
+
+	// Perform the request, buffering it to replay later if Kahu is unreachable
+	res, err := c.doRequest(req)
+	if err != nil {
+		if c.downgrade(HeartbeatSchema, schema, err) {
+			return c.Heartbeat(ctx, data)
+		}
+		c.spoolRequest(HeartbeatEndpoint, req, res)
+		return nil, err
+	}
+
+	hb := new(HeartbeatResponse)
+	if err := hb.Parse(res); err != nil {
+		return nil, err
+	}
+
+	// Now that Kahu is reachable, replay any buffered reports
+	c.replaySpool(ctx)
+	return hb, nil
+}
+
+// Neighbors gets the source name of the local host and the targets to ping,
+// fetching every page of the targets if Kahu paginates them.
+func (c *HTTPClient) Neighbors(ctx context.Context) (*NeighborsResponse, error) {
+	info := new(NeighborsResponse)
+	if err := c.getPages(ctx, NeighborsEndpoint, info.decodePage); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// ReportLatency posts the batch of ping records to Kahu, buffering it in the
+// spool if Kahu is unreachable.
+func (c *HTTPClient) ReportLatency(ctx context.Context, data UpdateLatencyRequests) (UpdateLatencyResponses, error) {
+	schema := c.Schema(LatencySchema)
+	body, err := encodeLatency(data, schema)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := c.newSchemaRequest(ctx, LatencyEndpoint, schema, body)
+	if err != nil {
+		return nil, err
+	}
+
+	// Perform the request, buffering it to replay later if Kahu is unreachable
+	res, err := c.doRequest(req)
+	if err != nil {
+		if c.downgrade(LatencySchema, schema, err) {
+			return c.ReportLatency(ctx, data)
+		}
+		c.spoolRequest(LatencyEndpoint, req, res)
+		return nil, err
+	}
+
+	defer CloseResponse(res)
+	info := make(UpdateLatencyResponses, 0)
+	if err := json.NewDecoder(res.Body).Decode(&info); err != nil {
+		return nil, fmt.Errorf("could not parse kahu response: %s", err)
+	}
+
+	return info, nil
+}
+
+// Replicas gets the replicas to sync the peers file from, fetching every page
+// of the replicas if Kahu paginates them.
+func (c *HTTPClient) Replicas(ctx context.Context) ([]*peers.Peer, error) {
+	replicas := make([]*peers.Peer, 0)
+	decode := func(data []byte) (*pageLinks, error) { return decodeReplicas(&replicas, data) }
+	if err := c.getPages(ctx, ReplicasEndpoint, decode); err != nil {
+		return nil, err
+	}
+	return replicas, nil
+}
+
+// Health posts the system status of the local host to Kahu.
+func (c *HTTPClient) Health(ctx context.Context, status *SystemStatus) error {
+	schema := c.Schema(HealthSchema)
+	body, err := encodeHealth(status, schema)
+	if err != nil {
+		return err
+	}
+
+	req, err := c.newSchemaRequest(ctx, HealthEndpoint, schema, body)
+	if err != nil {
+		return err
+	}
+
+	res, err := c.doRequest(req)
+	if err != nil {
+		if c.downgrade(HealthSchema, schema, err) {
+			return c.Health(ctx, status)
+		}
+		return err
+	}
+	CloseResponse(res)
+
+	debug("health status report: %d %s", res.StatusCode, res.Status)
+	return nil
+}
+
+// HealthDelta posts the changes to the system status since the last report
+// to Kahu. If Kahu responds 409 Conflict because it has no report to apply
+// the changes to, e.g. after it was restarted, the full status is posted, as
+// it is if Kahu only accepts health reports of schema 1, which has no deltas.
+func (c *HTTPClient) HealthDelta(ctx context.Context, status *SystemStatus, delta HealthDelta) error {
+	schema := c.Schema(HealthSchema)
+	if schema < SchemaV2 {
+		return c.Health(ctx, status)
+	}
+
+	body, err := encodeRequest(delta)
+	if err != nil {
+		return err
+	}
+
+	req, err := c.newSchemaRequest(ctx, HealthEndpoint, schema, body)
+	if err != nil {
+		return err
+	}
+
+	res, err := c.doRequest(req)
+	if err != nil {
+		if c.downgrade(HealthSchema, schema, err) {
+			return c.Health(ctx, status)
+		}
+		if apiErr, ok := err.(*APIError); ok && apiErr.StatusCode == http.StatusConflict {
+			info("kahu has no health report to apply the changes to, sending the full report")
+			return c.Health(ctx, status)
+		}
+		return err
+	}
+	CloseResponse(res)
+
+	debug("health delta report: %d %s", res.StatusCode, res.Status)
+	return nil
+}
+
+// ReportBandwidth posts the batch of bandwidth measurements to Kahu.
+func (c *HTTPClient) ReportBandwidth(ctx context.Context, data BandwidthRequests) error {
+	body, err := encodeRequest(data)
+	if err != nil {
+		return err
+	}
+
+	req, err := c.newRequest(ctx, http.MethodPost, BandwidthEndpoint, body)
+	if err != nil {
+		return err
+	}
+
+	res, err := c.doRequest(req)
+	if err != nil {
+		return err
+	}
+	CloseResponse(res)
+
+	debug("bandwidth report: %d %s", res.StatusCode, res.Status)
+	return nil
+}
+
+// ReportMatrix posts the latency matrix gossiped between the hosts to Kahu.
+func (c *HTTPClient) ReportMatrix(ctx context.Context, data MatrixRequests) error {
+	body, err := encodeRequest(data)
+	if err != nil {
+		return err
+	}
+
+	req, err := c.newRequest(ctx, http.MethodPost, MatrixEndpoint, body)
+	if err != nil {
+		return err
+	}
+
+	res, err := c.doRequest(req)
+	if err != nil {
+		return err
+	}
+	CloseResponse(res)
+
+	debug("latency matrix report: %d %s", res.StatusCode, res.Status)
+	return nil
+}
+
+// Version gets the version of the Kahu server and its API. The request is not
+// retried since it is only made interactively from the CLI.
+func (c *HTTPClient) Version(ctx context.Context) (*Version, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, VersionEndpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := c.tryRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer CloseResponse(res)
+	version := new(Version)
+	if err := json.NewDecoder(res.Body).Decode(version); err != nil {
+		return nil, fmt.Errorf("could not parse Kahu response %s", err)
+	}
+
+	return version, nil
+}
+
+// APIRequest is an ad-hoc request to an endpoint of the Kahu API, e.g. to
+// debug a mismatch with the API or to explore a new endpoint.
+type APIRequest struct {
+	Method   string      // HTTP method of the request, GET if empty
+	Endpoint string      // path of the endpoint, resolved against the Kahu URL
+	Body     io.Reader   // JSON body of the request, may be nil
+	Header   http.Header // headers added to the request, may be nil
+	Retry    bool        // retry with the retry policy of the endpoint
+}
+
+// Request sends an ad-hoc request to the Kahu API. It is authenticated, rate
+// limited, and signed like the other requests. If the request is retried, it
+// is retried with the retry policy of the endpoint and an error is returned
+// for a non 2xx status like the other requests, otherwise the response is
+// returned whatever its status. The caller must close the body of the response.
+func (c *HTTPClient) Request(ctx context.Context, request *APIRequest) (*http.Response, error) {
+	method := strings.ToUpper(request.Method)
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	req, err := c.newRequest(ctx, method, request.Endpoint, request.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	for key, values := range request.Header {
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+
+	if request.Retry {
+		return c.doRequest(req)
+	}
+
+	c.RLock()
+	client, limiter := c.client, c.limiter
+	c.RUnlock()
+
+	if err := limiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+
+	if err := c.signRequest(req); err != nil {
+		return nil, err
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, &RequestError{Err: err}
+	}
+	return res, nil
+}
+
+//===========================================================================
+// HTTP Client Internal Methods
+//===========================================================================
+
+// Returns the options of the next request.
+func (c *HTTPClient) options() *Options {
+	c.RLock()
+	defer c.RUnlock()
+	return c.opts
+}
+
+// Construct a URL from the given endpoint and add API key header to the
+// http request -- all things required to perform an Kahu API request. The
+// request is canceled if the context is canceled.
+func (c *HTTPClient) newRequest(ctx context.Context, method, endpoint string, body io.Reader) (*http.Request, error) {
+	opts := c.options()
+
+	// Parse the endpoint
+	ep, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse endpoint: %s", err)
+	}
+
+	// Resolve the URL reference
+	baseURL, err := url.Parse(opts.URL)
+	if err != nil {
+		return nil, err
+	}
+	url := baseURL.ResolveReference(ep)
+
+	// Compress large request bodies if configured
+	var gzipped bool
+	if body != nil && c.gzipRequests() {
+		if body, gzipped, err = compressBody(body, opts.GzipThreshold); err != nil {
+			return nil, err
+		}
+	}
+
+	// Construct the request
+	req, err := http.NewRequest(method, url.String(), body)
+	if err != nil {
+		return nil, fmt.Errorf("could not create request: %s", err)
+	}
+
+	// Add the headers
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", opts.APIKey))
+	req.Header.Set("Accept", "application/json")
+	if opts.UserAgent != "" {
+		req.Header.Set("User-Agent", opts.UserAgent)
+	}
+	if opts.Fingerprint != "" {
+		req.Header.Set(FingerprintHeader, opts.Fingerprint)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if gzipped {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+
+	trace("created %s request to %s", method, url)
+	return req.WithContext(ctx), nil
+}
+
+// Do the request, retrying with exponential backoff according to the retry
+// policy of the endpoint, and also return an error for non 200 status.
+func (c *HTTPClient) doRequest(req *http.Request) (res *http.Response, err error) {
+	endpoint := requestEndpoint(req)
+	policy := c.options().retryPolicy(endpoint)
+
+	for attempt := 1; ; attempt++ {
+		if res, err = c.tryRequest(req); err == nil {
+			return res, nil
+		}
+
+		// Give up if out of attempts, if the error is not transient, or if the
+		// request body cannot be rewound to be sent again.
+		if attempt >= policy.Attempts || !retryable(res) || (req.Body != nil && req.GetBody == nil) {
+			return res, err
+		}
+
+		delay := policy.Backoff(attempt)
+		debug("retrying %s in %s (attempt %d of %d): %s", endpoint, delay, attempt, policy.Attempts, err)
+		c.options().Stats.Retry(endpoint)
+
+		// Wait for the backoff unless the request is canceled
+		select {
+		case <-time.After(delay):
+		case <-req.Context().Done():
+			return res, &RequestError{Err: req.Context().Err()}
+		}
+
+		// Rewind the body of the request to send it again
+		if req.GetBody != nil {
+			if req.Body, err = req.GetBody(); err != nil {
+				return nil, fmt.Errorf("could not rewind request body: %s", err)
+			}
+		}
+	}
+}
+
+// Make a single attempt of the request and return an error for non 200 status
+func (c *HTTPClient) tryRequest(req *http.Request) (*http.Response, error) {
+	c.RLock()
+	client, limiter, opts := c.client, c.limiter, c.opts
+	c.RUnlock()
+
+	// Wait for the rate limiter so that bursts of requests don't overwhelm Kahu
+	if err := limiter.Wait(req.Context()); err != nil {
+		return nil, err
+	}
+
+	// Sign the request with a fresh timestamp for every attempt
+	if err := c.signRequest(req); err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	res, err := client.Do(req)
+	endpoint, latency := requestEndpoint(req), time.Since(start)
+	if err != nil {
+		opts.failed(req)
+		err = &RequestError{Err: err}
+		opts.Stats.Request(endpoint, latency, err)
+		return res, err
+	}
+
+	debug("%s %s %s", req.Method, req.URL.String(), res.Status)
+
+	// If Kahu does not accept compressed requests, send it again uncompressed
+	// and do not compress any more requests
+	if res.StatusCode == http.StatusUnsupportedMediaType && req.Header.Get("Content-Encoding") == "gzip" {
+		CloseResponse(res)
+		opts.Stats.Request(endpoint, latency, &APIError{StatusCode: res.StatusCode, Status: res.Status})
+		warn("kahu rejected a gzip compressed request, disabling request compression")
+		c.Lock()
+		c.nogzip = true
+		c.Unlock()
+
+		if err := decompressRequest(req); err != nil {
+			return nil, err
+		}
+		return c.tryRequest(req)
+	}
+
+	// Check the status from the client
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		CloseResponse(res)
+		opts.failed(req)
+		err = &APIError{StatusCode: res.StatusCode, Status: res.Status, RetryAfter: retryAfter(res)}
+		opts.Stats.Request(endpoint, latency, err)
+		return res, err
+	}
+
+	opts.Stats.Request(endpoint, latency, nil)
+	return res, nil
+}
+
+// Reports the failed request to the OnError callback, if any.
+func (o *Options) failed(req *http.Request) {
+	if o.OnError != nil {
+		o.OnError(req.URL.Path)
+	}
+}
+
+// Encode a generic request to the Kahu API into a buffer with JSON data
+func encodeRequest(data interface{}) (body io.Reader, err error) {
+	buf := new(bytes.Buffer)
+	if err := json.NewEncoder(buf).Encode(data); err != nil {
+		return nil, fmt.Errorf("could not encode request: %s", err)
+	}
+	return buf, nil
+}
+
+// CloseResponse reads the rest of the response body before closing it so that
+// the connection can be reused for the next request. Bodies larger than 64KiB
+// are not read, the connection is closed instead.
+func CloseResponse(res *http.Response) error {
+	io.CopyN(ioutil.Discard, res.Body, maxDrainBody)
+	return res.Body.Close()
+}
+
+//===========================================================================
+// Request Compression
+//===========================================================================
+
+// Returns true if request bodies should be compressed, i.e. if compression is
+// enabled and Kahu has not rejected a compressed request.
+func (c *HTTPClient) gzipRequests() bool {
+	c.RLock()
+	defer c.RUnlock()
+	return c.opts.Gzip && !c.nogzip
+}
+
+// Reads the body and compresses it with gzip if it is at least threshold bytes
+// long, returning a rewindable reader of the (possibly compressed) body and
+// true if it was compressed.
+func compressBody(body io.Reader, threshold int) (io.Reader, bool, error) {
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, false, fmt.Errorf("could not read request body: %s", err)
+	}
+
+	if len(data) < threshold {
+		return bytes.NewReader(data), false, nil
+	}
+
+	buf := new(bytes.Buffer)
+	gz := gzip.NewWriter(buf)
+	if _, err = gz.Write(data); err == nil {
+		err = gz.Close()
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("could not compress request body: %s", err)
+	}
+
+	trace("compressed %d byte request body to %d bytes", len(data), buf.Len())
+	return bytes.NewReader(buf.Bytes()), true, nil
+}
+
+// Returns the uncompressed body of the request, which must be rewindable.
+func requestBody(req *http.Request) ([]byte, error) {
+	if req.GetBody == nil {
+		return nil, errors.New("request body cannot be rewound")
+	}
+
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	var reader io.Reader = body
+	if req.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		reader = gz
+	}
+	return ioutil.ReadAll(reader)
+}
+
+// Replaces the compressed body of the request with the uncompressed body.
+func decompressRequest(req *http.Request) error {
+	data, err := requestBody(req)
+	if err != nil {
+		return fmt.Errorf("could not decompress request body: %s", err)
+	}
+
+	req.Header.Del("Content-Encoding")
+	req.ContentLength = int64(len(data))
+	req.Body = ioutil.NopCloser(bytes.NewReader(data))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package kahu
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+//===========================================================================
+// Enrollment JSON Request and Response Objects
+//===========================================================================
+
+// EnrollRequest JSON data structure to POST to Kahu /api/enroll/
+type EnrollRequest struct {
+	Hostname    string            `json:"hostname"`
+	Fingerprint string            `json:"fingerprint,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+}
+
+// EnrollResponse JSON data struct to parse Kahu /api/enroll/ response.
+type EnrollResponse struct {
+	APIKey  string `json:"api_key"`           // the permanent API key of the host
+	Replica string `json:"replica,omitempty"` // the name Kahu registered the host as
+}
+
+// Enroll exchanges a short-lived enrollment token for the permanent API key of
+// the host. The request is authenticated with the token rather than the API
+// key, which the host does not have yet. It is not retried since Kahu may
+// only accept the token once.
+func (c *HTTPClient) Enroll(ctx context.Context, token string, data *EnrollRequest) (*EnrollResponse, error) {
+	if token == "" {
+		return nil, errors.New("no enrollment token")
+	}
+
+	body, err := encodeRequest(data)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := c.newRequest(ctx, http.MethodPost, EnrollEndpoint, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+
+	res, err := c.tryRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer CloseResponse(res)
+	enrolled := new(EnrollResponse)
+	if err := json.NewDecoder(res.Body).Decode(enrolled); err != nil {
+		return nil, fmt.Errorf("could not parse kahu response: %s", err)
+	}
+
+	if enrolled.APIKey == "" {
+		return nil, errors.New("kahu did not return an api key for the host")
+	}
+	return enrolled, nil
+}
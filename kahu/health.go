@@ -0,0 +1,173 @@
+package kahu
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+//===========================================================================
+// System Health Request Objects
+//===========================================================================
+
+// SystemStatus provides a simple machine health status report, implemented
+// from github.com/rebeccabilbro/doctor. It contains OS and Go version and
+// platform information as well as information about system resources such as
+// disk, memory, and CPU.
+type SystemStatus struct {
+	Replica         string  `json:"replica,omitempty"`           // replica name assigned to the host by Kahu
+	Hostname        string  `json:"hostname,omitempty"`          // hostname identified by OS
+	OS              string  `json:"os,omitempty"`                // operating system name, e.g. darwin, linux
+	Platform        string  `json:"platform,omitempty"`          // specific os version e.g. ubuntu, linuxmint
+	PlatformVersion string  `json:"platform_version,omitempty"`  // operating system version number
+	ActiveProcesses uint64  `json:"active_procs,omitempty"`      // number of active processes
+	Uptime          uint64  `json:"uptime,omitempty"`            // number of seconds the host has been online
+	TotalRAM        uint64  `json:"total_ram,omitempty"`         // total amount of RAM on the system
+	AvailableRAM    uint64  `json:"available_ram,omitempty"`     // RAM available for programs to allocate (from kernel)
+	UsedRAM         uint64  `json:"used_ram,omitempty"`          // amount of RAM used by programs (from kernel)
+	UsedRAMPercent  float64 `json:"used_ram_percent,omitempty"`  // percentage of RAM used by programs
+	Filesystem      string  `json:"filesystem,omitempty"`        // the type of filesystem at root
+	TotalDisk       uint64  `json:"total_disk,omitempty"`        // total amount of disk space available at root directory
+	FreeDisk        uint64  `json:"free_disk,omitempty"`         // total amount of unused disk space at root directory
+	UsedDisk        uint64  `json:"used_disk,omitempty"`         // total amount of disk space used by root directory
+	UsedDiskPercent float64 `json:"used_disk_percent,omitempty"` // percentage of disk space used by root directory
+	CPUModel        string  `json:"cpu_model,omitempty"`         // the model of CPU on the machine
+	CPUCores        int32   `json:"cpu_cores,omitempty"`         // the number of CPU cores detected
+	CPUPercent      float64 `json:"cpu_percent,omitempty"`       // the percentage of all cores being used over the last 5 seconds
+	Load1           float64 `json:"load1,omitempty"`             // the load average over the last minute
+	Load5           float64 `json:"load5,omitempty"`             // the load average over the last 5 minutes
+	Load15          float64 `json:"load15,omitempty"`            // the load average over the last 15 minutes
+	MaxTemperature  float64 `json:"max_temperature,omitempty"`   // the highest temperature of the hardware sensors in Celsius
+	SkewMS          float64 `json:"skew_ms,omitempty"`           // offset of the NTP server's clock from the local clock in milliseconds
+	GoVersion       string  `json:"go_version,omitempty"`        // the version of Go for the currently running instance
+	GoPlatform      string  `json:"go_platform,omitempty"`       // the platform compiled for the currently running instance
+	GoArchitecture  string  `json:"go_architecture,omitempty"`   // the chip architecture compiled for the currently running instance
+
+	// Disk usage of each of the monitored mount points, the disk fields above
+	// report the usage of the first mount point for backwards compatibility.
+	Disks []*DiskStatus `json:"disks,omitempty"`
+
+	// Traffic and error counters of each network interface since boot.
+	Interfaces []*InterfaceStatus `json:"interfaces,omitempty"`
+
+	// Current temperature of each hardware sensor, where available.
+	Temperatures []*TemperatureStatus `json:"temperatures,omitempty"`
+
+	// Alerts raised by health rules whose thresholds are crossed by the status.
+	Alerts []*Alert `json:"alerts,omitempty"`
+
+	// The status of the kekahu process itself, e.g. its memory and goroutines.
+	Process *ProcessStatus `json:"process,omitempty"`
+
+	// The pings received by the echo server by source, if health_echo_stats.
+	Echo []*SourceStats `json:"echo,omitempty"`
+
+	// Whether kekahu runs in a container, and the container with the limits
+	// and usage of its cgroup if it does (or if the scope is container).
+	InContainer bool             `json:"in_container,omitempty"`
+	Container   *ContainerStatus `json:"container,omitempty"`
+
+	// Custom components added by registered health providers, keyed by name.
+	Extensions map[string]json.RawMessage `json:"extensions,omitempty"`
+}
+
+// DiskStatus reports the disk usage of a single mount point.
+type DiskStatus struct {
+	Path        string  `json:"path"`                   // the mount point of the disk
+	Filesystem  string  `json:"filesystem,omitempty"`   // the type of filesystem at the mount point
+	Total       uint64  `json:"total,omitempty"`        // total amount of disk space on the mount point
+	Free        uint64  `json:"free,omitempty"`         // total amount of unused disk space on the mount point
+	Used        uint64  `json:"used,omitempty"`         // total amount of disk space used on the mount point
+	UsedPercent float64 `json:"used_percent,omitempty"` // percentage of disk space used on the mount point
+}
+
+// InterfaceStatus reports the traffic and error counters of a network
+// interface since the host booted.
+type InterfaceStatus struct {
+	Name        string `json:"name"`                  // the name of the interface, e.g. eth0
+	BytesSent   uint64 `json:"bytes_sent"`            // number of bytes sent
+	BytesRecv   uint64 `json:"bytes_recv"`            // number of bytes received
+	PacketsSent uint64 `json:"packets_sent"`          // number of packets sent
+	PacketsRecv uint64 `json:"packets_recv"`          // number of packets received
+	ErrorsOut   uint64 `json:"errors_out,omitempty"`  // number of errors while sending
+	ErrorsIn    uint64 `json:"errors_in,omitempty"`   // number of errors while receiving
+	DroppedOut  uint64 `json:"dropped_out,omitempty"` // number of outgoing packets dropped
+	DroppedIn   uint64 `json:"dropped_in,omitempty"`  // number of incoming packets dropped
+}
+
+// TemperatureStatus reports the current temperature of a hardware sensor.
+type TemperatureStatus struct {
+	Sensor      string  `json:"sensor"`      // the chip and label of the sensor, e.g. coretemp_core0
+	Temperature float64 `json:"temperature"` // the temperature in Celsius
+}
+
+// Dump the system status to JSON with the specified indent
+func (s *SystemStatus) Dump(indent int) (data []byte, err error) {
+	if indent == 0 {
+		return json.Marshal(s)
+	}
+
+	sindent := strings.Repeat(" ", indent)
+	return json.MarshalIndent(s, "", sindent)
+}
+
+// ContainerStatus reports the container that kekahu runs in, with the memory
+// and CPU limits and usage of its cgroup. The memory usage excludes inactive
+// file caches like docker stats, and the CPU utilization is the percentage of
+// the CPU limit (or of the available CPUs if there is no limit) used over the
+// CPU sample window.
+type ContainerStatus struct {
+	ID            string  `json:"id,omitempty"`             // the container ID, if it can be found
+	Image         string  `json:"image,omitempty"`          // the image the container runs, if it can be found
+	Runtime       string  `json:"runtime,omitempty"`        // the container runtime, e.g. docker, podman, kubernetes
+	Cgroup        int     `json:"cgroup_version,omitempty"` // version of the cgroup hierarchy the limits are read from
+	MemoryLimit   uint64  `json:"memory_limit,omitempty"`   // the memory limit of the cgroup, zero if unlimited
+	MemoryUsage   uint64  `json:"memory_usage,omitempty"`   // the memory used by the cgroup
+	MemoryPercent float64 `json:"memory_percent,omitempty"` // percentage of the memory limit (or host memory) used
+	CPULimit      float64 `json:"cpu_limit,omitempty"`      // the CPU quota of the cgroup in cores, zero if unlimited
+	CPUPercent    float64 `json:"cpu_percent,omitempty"`    // percentage of the CPU limit used over the sample window
+}
+
+// ProcessStatus describes the kekahu process itself rather than the host, so
+// that a leaking or stalled daemon can be detected from its health reports.
+// The resident memory and open file descriptors are only reported on Linux;
+// the heartbeats and errors are only reported by the running service.
+type ProcessStatus struct {
+	PID          int     `json:"pid"`                      // the process id of the kekahu process
+	Uptime       float64 `json:"uptime"`                   // number of seconds the process has been running
+	RSS          uint64  `json:"rss,omitempty"`            // resident set size of the process in bytes
+	OpenFiles    int     `json:"open_files,omitempty"`     // number of open file descriptors
+	Goroutines   int     `json:"goroutines"`               // number of goroutines that currently exist
+	HeapAlloc    uint64  `json:"heap_alloc"`               // bytes of allocated heap objects
+	HeapSys      uint64  `json:"heap_sys"`                 // bytes of heap memory obtained from the OS
+	Sys          uint64  `json:"sys"`                      // total bytes of memory obtained from the OS
+	NumGC        uint32  `json:"num_gc"`                   // number of completed GC cycles
+	GCPauseTotal float64 `json:"gc_pause_total"`           // cumulative GC stop-the-world pause in milliseconds
+	GCPauseLast  float64 `json:"gc_pause_last"`            // most recent GC stop-the-world pause in milliseconds
+	Heartbeats   uint64  `json:"heartbeats,omitempty"`     // number of successful heartbeats sent by the service
+	Errors       uint64  `json:"errors,omitempty"`         // number of errors logged by the service
+	LastError    string  `json:"last_error,omitempty"`     // the last error logged by the service
+	LastBeat     string  `json:"last_heartbeat,omitempty"` // timestamp of the last successful heartbeat
+}
+
+// SourceStats are the statistics of the pings received by the echo server
+// from a source, so that Kahu can compare them with the latencies reported by
+// the source to cross-check both directions of the link. The inter-arrival
+// times are in milliseconds.
+type SourceStats struct {
+	Source      string    `json:"source"`              // name of the host that sent the pings
+	Pings       uint64    `json:"pings"`               // pings received and replied to
+	FirstSeen   time.Time `json:"first_seen"`          // when the first ping was received
+	LastSeen    time.Time `json:"last_seen"`           // when the last ping was received
+	MeanArrival float64   `json:"mean_interarrival"`   // mean time between pings
+	StdArrival  float64   `json:"stddev_interarrival"` // standard deviation of the time between pings
+	MinArrival  float64   `json:"min_interarrival"`    // shortest time between pings
+	MaxArrival  float64   `json:"max_interarrival"`    // longest time between pings
+}
+
+// HealthDelta is a health report with only the fields of the system status
+// that changed since the last report, as a JSON merge patch (RFC 7386) of
+// the last report with "delta" set to true. Fields that are no longer
+// reported are null. The replica and hostname are always included so that
+// Kahu can find the report to apply the changes to.
+type HealthDelta map[string]interface{}
@@ -0,0 +1,106 @@
+package kahu
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+//===========================================================================
+// Heartbeat JSON Resquest and Response Objects
+//===========================================================================
+
+// HeartbeatRequest JSON data structure to POST to Kahu /api/heartbeat/
+type HeartbeatRequest struct {
+	IPAddr      string            `json:"ip_address"`
+	IP6Addr     string            `json:"ip6_address,omitempty"`
+	Hostname    string            `json:"hostname"`
+	Replica     string            `json:"replica,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	Services    []*ServiceStatus  `json:"services,omitempty"`
+	Maintenance bool              `json:"maintenance,omitempty"`
+	SkewMS      float64           `json:"skew_ms,omitempty"`
+}
+
+// HostInfo discovers the IP addresses and hostname of the host that are sent
+// with the heartbeat, e.g. the configuration of the kekahu agent.
+type HostInfo interface {
+	DiscoverIP(ctx context.Context) (string, error)
+	DiscoverIPv6(ctx context.Context) (string, error)
+	LocalHostname() (string, error)
+}
+
+// Load the current hostname and IP addresses of the host into the heartbeat
+// from the host info, e.g. behind NAT or if the canonical name of the host
+// differs from its hostname. The IPv4 and IPv6 addresses are discovered
+// concurrently and the IPv6 address is omitted if the host doesn't have one.
+func (hb *HeartbeatRequest) Load(ctx context.Context, host HostInfo) (err error) {
+	// First collect the IP addresses of the host
+	var ip6err error
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		hb.IP6Addr, ip6err = host.DiscoverIPv6(ctx)
+	}()
+
+	hb.IPAddr, err = host.DiscoverIP(ctx)
+	wg.Wait()
+	if err != nil {
+		return err
+	}
+	debug("ip address is %s", hb.IPAddr)
+
+	// Most hosts don't have a public IPv6 address, so failures aren't warnings
+	if ip6err != nil {
+		debug("no ipv6 address: %s", ip6err)
+	} else if hb.IP6Addr != "" {
+		debug("ipv6 address is %s", hb.IP6Addr)
+	}
+
+	// Then collect the hostname of the host
+	hb.Hostname, err = host.LocalHostname()
+	if err != nil {
+		return err
+	}
+	debug("hostname is %s", hb.Hostname)
+
+	return nil
+}
+
+// ServiceStatus is the state of a local service sent with the heartbeat.
+type ServiceStatus struct {
+	Name      string `json:"name"`              // name of the service
+	Port      int    `json:"port,omitempty"`    // local port of the service
+	Listening bool   `json:"listening"`         // if the port accepted a connection
+	Version   string `json:"version,omitempty"` // first line of the version command output
+	Error     string `json:"error,omitempty"`   // why the version could not be probed
+}
+
+// HeartbeatResponse JSON data struct to parse Kahu /api/heartbeat/ response.
+type HeartbeatResponse struct {
+	Success bool   `json:"success"`
+	Replica string `json:"replica"`
+	Active  bool   `json:"active"`
+	Secret  string `json:"cluster_secret,omitempty"` // shared secret to sign pings with
+}
+
+// Parse the Kahu heartbeat HTTP response body
+func (hb *HeartbeatResponse) Parse(res *http.Response) error {
+	defer CloseResponse(res)
+
+	if err := json.NewDecoder(res.Body).Decode(&hb); err != nil {
+		return fmt.Errorf("could not parse kahu response: %s", err)
+	}
+
+	return nil
+}
+
+func (hb *HeartbeatResponse) String() string {
+	return fmt.Sprintf(
+		"updated %s success: %t active: %t",
+		hb.Replica, hb.Success, hb.Active,
+	)
+}
@@ -0,0 +1,75 @@
+// Package kahu is the client of the Kahu API: the requests and responses that
+// kekahu exchanges with Kahu, the Client interface that performs them, and the
+// HTTPClient that implements it with authenticated, signed, rate limited, and
+// retried requests. The package only depends on the standard library and the
+// peers package so that programs can report to Kahu or mock it without the
+// system health checks of the doctor package and their dependencies.
+package kahu
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/bbengfort/x/peers"
+)
+
+// Endpoints on the Kahu RESTful API
+const (
+	HeartbeatEndpoint = "/api/heartbeat/"
+	LatencyEndpoint   = "/api/latency/"
+	NeighborsEndpoint = "/api/latency/neighbors/"
+	ReplicasEndpoint  = "/api/replicas/"
+	HealthEndpoint    = "/api/health/"
+	BandwidthEndpoint = "/api/bandwidth/"
+	MatrixEndpoint    = "/api/latency/matrix/"
+	VersionEndpoint   = "/api/version/"
+	EnrollEndpoint    = "/api/enroll/"
+)
+
+// Client performs the requests to the Kahu API. The HTTPClient is used by
+// default; programs can be tested without a live Kahu server by passing a
+// mock client (see the kekahutest package) instead.
+type Client interface {
+	Heartbeat(ctx context.Context, data *HeartbeatRequest) (*HeartbeatResponse, error)             // POST a heartbeat from the local host
+	Neighbors(ctx context.Context) (*NeighborsResponse, error)                                     // GET the neighbors to send pings to
+	ReportLatency(ctx context.Context, data UpdateLatencyRequests) (UpdateLatencyResponses, error) // POST a batch of ping latencies
+	Replicas(ctx context.Context) ([]*peers.Peer, error)                                           // GET the replicas to sync the peers file from
+	Health(ctx context.Context, status *SystemStatus) error                                        // POST the system health of the local host
+	HealthDelta(ctx context.Context, status *SystemStatus, delta HealthDelta) error                // POST the changes to the system health since the last report
+	ReportBandwidth(ctx context.Context, data BandwidthRequests) error                             // POST a batch of bandwidth measurements
+	ReportMatrix(ctx context.Context, data MatrixRequests) error                                   // POST the latency matrix gossiped between hosts
+}
+
+//===========================================================================
+// Errors
+//===========================================================================
+
+// RequestError is returned when a request to the Kahu API could not be made,
+// e.g. because the service is unreachable or the request timed out.
+type RequestError struct {
+	Err error // the underlying error from the http client
+}
+
+// Error returns the message of the underlying error.
+func (e *RequestError) Error() string {
+	return fmt.Sprintf("could not make http request: %s", e.Err)
+}
+
+// APIError is returned when the Kahu API responds with a non 2xx status.
+type APIError struct {
+	StatusCode int           // the http status code of the response
+	Status     string        // the http status of the response, e.g. "401 Unauthorized"
+	RetryAfter time.Duration // the delay Kahu asked for in the Retry-After header, if any
+}
+
+// Error returns the status of the response.
+func (e *APIError) Error() string {
+	return fmt.Sprintf("could not access Kahu service: %s", e.Status)
+}
+
+// Unauthorized returns true if Kahu rejected the api key of the request.
+func (e *APIError) Unauthorized() bool {
+	return e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden
+}
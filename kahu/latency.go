@@ -0,0 +1,118 @@
+package kahu
+
+import "time"
+
+// Probe types that identify how a latency measurement was taken.
+const (
+	EchoProbe = "echo" // gRPC ping to the kekahu echo server
+	TCPProbe  = "tcp"  // TCP connect to the host when the echo server is down
+)
+
+//===========================================================================
+// Latency Request and Response Objects
+//===========================================================================
+
+// NeighborsResponse from the Kahu API with active targets and addresses to
+// send pings and then post latencies for.
+type NeighborsResponse struct {
+	Source  string      `json:"source"`  // the unique name identifying the local host
+	Targets []*Neighbor `json:"targets"` // a list of neighbors on the network to ping
+}
+
+// Neighbor represents a host on the network to send a ping to.
+type Neighbor struct {
+	Hostname string `json:"name"`       // unique name for the target host
+	State    string `json:"state"`      // the current health of the target
+	IPAddr   string `json:"ip_address"` // the external IP address of the target
+	Domain   string `json:"domain"`     // the external domain name of the target
+}
+
+// UpdateLatencyRequests to POST multiple ping records to Kahu.
+type UpdateLatencyRequests []*UpdateLatencyRequest
+
+// UpdateLatencyRequest sends a record of a ping to the target to Kahu.
+type UpdateLatencyRequest struct {
+	Source    string  `json:"source,omitempty"`    // replica name assigned to the local host by Kahu
+	Target    string  `json:"target"`              // unique name of target host
+	Latency   float64 `json:"latency"`             // ping latency in milliseconds
+	Timeout   bool    `json:"timeout"`             // whether or not the ping timed out
+	Probe     string  `json:"probe"`               // the type of probe used to measure latency
+	Transport string  `json:"transport,omitempty"` // the transport of echo probes, e.g. grpc, udp, or quic
+	Size      int     `json:"size,omitempty"`      // size in bytes of the payload of echo probes
+	Loss      float64 `json:"loss"`                // percentage of pings to the target that timed out
+	Jitter    float64 `json:"jitter"`              // interarrival jitter of pings to the target in milliseconds
+	Warmup    bool    `json:"warmup,omitempty"`    // the ping was sent on a new connection and is not in the statistics
+	Outlier   bool    `json:"outlier,omitempty"`   // the ping was rejected from the statistics as an outlier
+	Skipped   bool    `json:"skipped,omitempty"`   // the target was not pinged since Kahu reports it is down
+	State     string  `json:"state,omitempty"`     // the state of a skipped target reported by Kahu
+
+	// Percentiles of all pings to the target in milliseconds, omitted if none succeeded
+	P50 float64 `json:"p50,omitempty"` // median latency to the target
+	P95 float64 `json:"p95,omitempty"` // 95th percentile latency to the target
+	P99 float64 `json:"p99,omitempty"` // 99th percentile latency to the target
+
+	// Flags pings in a round whose mean latency deviates from the recent baseline
+	Anomaly  bool    `json:"anomaly,omitempty"`  // whether the latency to the target is anomalous
+	Baseline float64 `json:"baseline,omitempty"` // mean of the recent latencies to the target in milliseconds
+
+	// Clock skew estimates, only reported if report_skew is enabled
+	Skew      float64 `json:"skew,omitempty"`      // clock offset of the target from the local host in milliseconds
+	Asymmetry float64 `json:"asymmetry,omitempty"` // outbound minus inbound one-way delay to the target in milliseconds
+}
+
+// Init the update latency request with a ping duration and target.
+func (req *UpdateLatencyRequest) Init(target string, latency time.Duration) {
+	req.Target = target
+	req.Probe = EchoProbe
+
+	if latency == 0 {
+		req.Timeout = true
+		req.Latency = 0
+	} else {
+		req.Timeout = false
+		req.Latency = float64(latency) / float64(time.Millisecond)
+	}
+}
+
+// SkippedLatency returns the update latency request for a target that was
+// not pinged because Kahu reports it is down, which is not a timeout.
+func SkippedLatency(target *Neighbor) *UpdateLatencyRequest {
+	return &UpdateLatencyRequest{Target: target.Hostname, Probe: EchoProbe, Skipped: true, State: target.State}
+}
+
+// UpdateLatencyResponses for each target posted in the request.
+type UpdateLatencyResponses []*UpdateLatencyResponse
+
+// UpdateLatencyResponse is returned from the Kahu API with details about the
+// current distribution of latencies to the targets specified in the request.
+type UpdateLatencyResponse struct {
+	Source   string  `json:"source"`   // the current local host
+	Target   string  `json:"target"`   // the target of the pings
+	Messages uint64  `json:"messages"` // number of messages sent
+	Timeouts uint64  `json:"timeouts"` // number of timeouts
+	Fastest  float64 `json:"fastest"`  // fastest ping in ms
+	Slowest  float64 `json:"slowest"`  // slowest ping in ms
+	Mean     float64 `json:"mean"`     // average ping time in ms
+	StdDev   float64 `json:"stddev"`   // standard deviation of ping time in ms
+	Range    float64 `json:"range"`    // range of ping time in ms
+}
+
+//===========================================================================
+// Latency Matrix Request Objects
+//===========================================================================
+
+// MatrixRequests to POST the latency matrix to Kahu.
+type MatrixRequests []*MatrixRequest
+
+// MatrixRequest sends the latency from the source to the target, as reported
+// by the source, to Kahu. Latencies are in milliseconds.
+type MatrixRequest struct {
+	Source  string  `json:"source"`  // unique name of the host that measured the latencies
+	Target  string  `json:"target"`  // unique name of the host the latencies were measured to
+	Samples uint64  `json:"samples"` // number of successful pings to the target
+	Mean    float64 `json:"mean"`    // mean latency in milliseconds
+	P50     float64 `json:"p50"`     // median latency in milliseconds
+	P99     float64 `json:"p99"`     // 99th percentile latency in milliseconds
+	Loss    float64 `json:"loss"`    // percentage of pings that timed out
+	Age     float64 `json:"age"`     // seconds since the source reported the latencies
+}
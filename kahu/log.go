@@ -0,0 +1,59 @@
+package kahu
+
+import "sync"
+
+// Levels of the messages logged by the client, which are the same as the
+// levels of the kekahu logger.
+const (
+	LogTrace uint8 = iota
+	LogDebug
+	LogInfo
+	LogStatus
+	LogWarn
+)
+
+// Logger receives the messages logged by the client at their level, the
+// arguments are handled in the manner of fmt.Printf.
+type Logger func(level uint8, msg string, a ...interface{})
+
+// The logger set by SetLogger, messages are discarded if it is nil.
+var logger struct {
+	sync.RWMutex
+	logf Logger
+}
+
+// SetLogger sets the logger the messages of the client are logged with, e.g.
+// retries and buffered requests. Messages are discarded if it is nil, which is
+// the default.
+func SetLogger(logf Logger) {
+	logger.Lock()
+	defer logger.Unlock()
+	logger.logf = logf
+}
+
+// Logs the message with the logger if one is set.
+func logf(level uint8, msg string, a ...interface{}) {
+	logger.RLock()
+	logf := logger.logf
+	logger.RUnlock()
+
+	if logf != nil {
+		logf(level, msg, a...)
+	}
+}
+
+func warn(msg string, a ...interface{}) {
+	logf(LogWarn, msg, a...)
+}
+
+func info(msg string, a ...interface{}) {
+	logf(LogInfo, msg, a...)
+}
+
+func debug(msg string, a ...interface{}) {
+	logf(LogDebug, msg, a...)
+}
+
+func trace(msg string, a ...interface{}) {
+	logf(LogTrace, msg, a...)
+}
@@ -0,0 +1,185 @@
+package kahu
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/bbengfort/x/peers"
+)
+
+// MaxPages is the most pages of a paginated Kahu response that are fetched,
+// so that a server that always returns a next page cannot loop forever.
+const MaxPages = 1000
+
+// PageTokenParam is the query parameter the next page token is sent in.
+const PageTokenParam = "page_token"
+
+// pageLinks are the fields of a paginated Kahu response that locate the next
+// page, either a link to it (as in Django REST framework) or a token that is
+// sent back in the page_token query parameter. Both are empty on the last page
+// and in responses that are not paginated.
+type pageLinks struct {
+	Next      string `json:"next,omitempty"`
+	NextToken string `json:"next_page_token,omitempty"`
+}
+
+//===========================================================================
+// Paginated Requests
+//===========================================================================
+
+// Gets the endpoint and every page that follows it, passing the body of each
+// page to the decode function, which returns the page links of the body. The
+// next page is found from the page links or from the Link header with
+// rel="next". Next links must be on the Kahu host so that the API key is not
+// sent elsewhere.
+func (c *HTTPClient) getPages(ctx context.Context, endpoint string, decode func([]byte) (*pageLinks, error)) error {
+	start := endpoint
+	seen := make(map[string]bool)
+	for page := 1; endpoint != ""; page++ {
+		if page > MaxPages {
+			return fmt.Errorf("kahu returned more than %d pages from %s", MaxPages, start)
+		}
+
+		if seen[endpoint] {
+			return fmt.Errorf("kahu returned a loop of pages at %s", endpoint)
+		}
+		seen[endpoint] = true
+
+		req, err := c.newRequest(ctx, http.MethodGet, endpoint, nil)
+		if err != nil {
+			return err
+		}
+
+		res, err := c.doRequest(req)
+		if err != nil {
+			return err
+		}
+
+		data, err := ioutil.ReadAll(res.Body)
+		CloseResponse(res)
+		if err != nil {
+			return fmt.Errorf("could not read kahu response: %s", err)
+		}
+
+		links, err := decode(data)
+		if err != nil {
+			return fmt.Errorf("could not parse kahu response: %s", err)
+		}
+
+		if endpoint, err = nextPage(req.URL, links, res.Header.Get("Link")); err != nil {
+			return err
+		}
+
+		if endpoint != "" {
+			trace("fetching page %d of %s", page+1, start)
+		}
+	}
+	return nil
+}
+
+// Returns the URL of the next page after the current page, or an empty string
+// if the current page is the last one.
+func nextPage(current *url.URL, links *pageLinks, header string) (string, error) {
+	next := linkNext(header)
+	if links != nil && links.Next != "" {
+		next = links.Next
+	}
+
+	if next == "" {
+		if links == nil || links.NextToken == "" {
+			return "", nil
+		}
+
+		u := *current
+		query := u.Query()
+		query.Set(PageTokenParam, links.NextToken)
+		u.RawQuery = query.Encode()
+		return u.String(), nil
+	}
+
+	ref, err := url.Parse(next)
+	if err != nil {
+		return "", fmt.Errorf("could not parse next page link: %s", err)
+	}
+
+	u := current.ResolveReference(ref)
+	if u.Host != current.Host {
+		return "", fmt.Errorf("next page link %s is not on the kahu host %s", u, current.Host)
+	}
+	return u.String(), nil
+}
+
+// Returns the target of the rel="next" link of a Link header (RFC 8288).
+func linkNext(header string) string {
+	for _, link := range strings.Split(header, ",") {
+		parts := strings.Split(link, ";")
+		target := strings.TrimSpace(parts[0])
+		if !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+			continue
+		}
+
+		for _, param := range parts[1:] {
+			param = strings.Replace(strings.TrimSpace(param), " ", "", -1)
+			if param == `rel="next"` || param == "rel=next" {
+				return target[1 : len(target)-1]
+			}
+		}
+	}
+	return ""
+}
+
+//===========================================================================
+// Paginated Responses
+//===========================================================================
+
+// Decodes a page of neighbors, appending its targets to the response.
+func (r *NeighborsResponse) decodePage(data []byte) (*pageLinks, error) {
+	page := &struct {
+		NeighborsResponse
+		pageLinks
+		Results []*Neighbor `json:"results"`
+	}{}
+
+	if err := json.Unmarshal(data, page); err != nil {
+		return nil, err
+	}
+
+	if r.Source == "" {
+		r.Source = page.Source
+	}
+
+	r.Targets = append(r.Targets, page.Targets...)
+	r.Targets = append(r.Targets, page.Results...)
+	return &page.pageLinks, nil
+}
+
+// Decodes a page of replicas, which is either a list of replicas or an
+// object with the replicas in its results, appending them to the replicas.
+func decodeReplicas(replicas *[]*peers.Peer, data []byte) (*pageLinks, error) {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		page := make([]*peers.Peer, 0)
+		if err := json.Unmarshal(data, &page); err != nil {
+			return nil, err
+		}
+		*replicas = append(*replicas, page...)
+		return nil, nil
+	}
+
+	page := &struct {
+		pageLinks
+		Results []*peers.Peer `json:"results"`
+	}{}
+
+	if err := json.Unmarshal(data, page); err != nil {
+		return nil, err
+	}
+
+	*replicas = append(*replicas, page.Results...)
+	return &page.pageLinks, nil
+}
@@ -0,0 +1,83 @@
+package kahu
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket that limits the number of requests made to
+// the Kahu API so that bursts of heartbeats, latency reports, spool replays,
+// and retries don't hammer the service. Tokens are added at the rate up to
+// the burst size; each request takes a token, waiting for one if none are
+// available. A zero rate disables the limiter.
+type RateLimiter struct {
+	sync.Mutex
+	rate   float64   // tokens added per second, zero for no limit
+	burst  float64   // maximum number of tokens in the bucket
+	tokens float64   // tokens currently available
+	last   time.Time // when the tokens were last updated
+}
+
+// Init the limiter with the requests per second and the burst size, the
+// bucket starts full so that the first burst of requests is not delayed.
+func (r *RateLimiter) Init(rate float64, burst int) {
+	r.Lock()
+	defer r.Unlock()
+
+	if burst < 1 {
+		burst = 1
+	}
+
+	r.rate = rate
+	r.burst = float64(burst)
+	r.tokens = r.burst
+	r.last = time.Now()
+}
+
+// Wait until a token is available or the context is canceled.
+func (r *RateLimiter) Wait(ctx context.Context) error {
+	delay := r.reserve()
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		// Return the reserved token so later requests aren't delayed by it
+		r.Lock()
+		r.tokens++
+		r.Unlock()
+		return fmt.Errorf("rate limited request canceled: %s", ctx.Err())
+	}
+}
+
+// Take a token from the bucket and return how long to wait before it is
+// available; the token count goes negative to queue waiting requests.
+func (r *RateLimiter) reserve() time.Duration {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.rate <= 0 {
+		return 0
+	}
+
+	now := time.Now()
+	r.tokens += now.Sub(r.last).Seconds() * r.rate
+	if r.tokens > r.burst {
+		r.tokens = r.burst
+	}
+	r.last = now
+
+	r.tokens--
+	if r.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-r.tokens / r.rate * float64(time.Second))
+}
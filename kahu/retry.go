@@ -0,0 +1,89 @@
+package kahu
+
+import (
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RetryPolicy describes how a failed Kahu API request is retried with
+// exponential backoff and jitter between attempts.
+type RetryPolicy struct {
+	Attempts int           // maximum number of attempts, 1 means no retries
+	Delay    time.Duration // base delay before the first retry
+	MaxDelay time.Duration // upper bound on the delay between retries
+}
+
+// Backoff returns the delay before the specified retry (starting at 1). The
+// delay grows exponentially from the base delay up to the max delay, then a
+// random amount of jitter is selected so that not all replicas retry at the
+// exact same time.
+func (p *RetryPolicy) Backoff(retry int) time.Duration {
+	if p.Delay <= 0 {
+		return 0
+	}
+
+	delay := float64(p.Delay) * math.Pow(2, float64(retry-1))
+	if p.MaxDelay > 0 && delay > float64(p.MaxDelay) {
+		delay = float64(p.MaxDelay)
+	}
+
+	// Select a delay between half and all of the backoff
+	half := int64(delay / 2)
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
+// Returns the retry policy of the endpoint, a single attempt if none is set.
+func (o *Options) retryPolicy(endpoint string) *RetryPolicy {
+	policy := o.Retry
+	if override, ok := o.Retries[endpoint]; ok {
+		policy = override
+	}
+
+	if policy == nil {
+		return &RetryPolicy{Attempts: 1}
+	}
+	return policy
+}
+
+// Returns the Kahu endpoint that the request path refers to.
+func requestEndpoint(req *http.Request) string {
+	// NOTE: longer endpoints must be checked first since they share prefixes
+	for _, endpoint := range []string{NeighborsEndpoint, MatrixEndpoint, HeartbeatEndpoint, LatencyEndpoint, ReplicasEndpoint, HealthEndpoint, BandwidthEndpoint} {
+		if strings.HasSuffix(req.URL.Path, endpoint) {
+			return endpoint
+		}
+	}
+	return req.URL.Path
+}
+
+// Returns true if the request can be retried given the response status; a
+// nil response indicates a network error. Client errors are not retried.
+func retryable(res *http.Response) bool {
+	if res == nil {
+		return true
+	}
+	return res.StatusCode >= 500 || res.StatusCode == http.StatusTooManyRequests
+}
+
+// Returns the delay that Kahu asked the client to wait before the next request
+// in the Retry-After header of the response, either in seconds or as a date,
+// and zero if the header is not set.
+func retryAfter(res *http.Response) time.Duration {
+	value := strings.TrimSpace(res.Header.Get("Retry-After"))
+	if value == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if date, err := http.ParseTime(value); err == nil && date.After(time.Now()) {
+		return time.Until(date)
+	}
+	return 0
+}
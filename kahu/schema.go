@@ -0,0 +1,235 @@
+package kahu
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// Versions of the schemas of the heartbeats, latency reports, and health
+// reports posted to Kahu. The client negotiates the latest schema of each
+// payload that Kahu accepts, so that hosts keep reporting to a Kahu server
+// that is older than the client.
+const (
+	SchemaV1     = 1 // the payloads of the first Kahu API: the address of a heartbeat, the latency of a ping, and the resources of a health report
+	SchemaV2     = 2 // the current payloads, with tags, services, statistics, and delta health reports
+	LatestSchema = SchemaV2
+)
+
+// SchemaHeader is the header of the heartbeats, latency reports, and health
+// reports posted to Kahu that carries the schema version of the payload.
+const SchemaHeader = "X-Kahu-Schema"
+
+// Payloads whose schema is negotiated, the keys of Version.Schemas.
+const (
+	HeartbeatSchema = "heartbeat"
+	LatencySchema   = "latency"
+	HealthSchema    = "health"
+)
+
+// Schemas returns the payloads whose schema is negotiated.
+func Schemas() []string {
+	return []string{HeartbeatSchema, LatencySchema, HealthSchema}
+}
+
+// Schema returns the latest schema of the payload that Kahu accepts, the
+// latest schema of the client if Kahu did not report it, e.g. because Kahu
+// predates schema negotiation.
+func (v *Version) Schema(payload string) int {
+	schema, ok := v.Schemas[payload]
+	if !ok || schema > LatestSchema {
+		return LatestSchema
+	}
+
+	if schema < SchemaV1 {
+		return SchemaV1
+	}
+	return schema
+}
+
+//===========================================================================
+// Schema Negotiation
+//===========================================================================
+
+// Negotiate requests the version of Kahu and the schemas of the payloads it
+// accepts, which are sent from then on. If the request fails, the schemas are
+// left unchanged so that the latest schemas are sent, and downgraded if Kahu
+// rejects them. Nothing is requested if the schema is pinned by the options.
+func (c *HTTPClient) Negotiate(ctx context.Context) (*Version, error) {
+	if c.options().Schema > 0 {
+		return nil, nil
+	}
+
+	version, err := c.Version(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	c.schemas = make(map[string]int)
+	for _, payload := range Schemas() {
+		c.schemas[payload] = version.Schema(payload)
+	}
+	return version, nil
+}
+
+// Schema returns the schema version the payload is sent with: the schema
+// pinned by the options, otherwise the negotiated schema, the latest schema
+// if none was negotiated.
+func (c *HTTPClient) Schema(payload string) int {
+	c.RLock()
+	defer c.RUnlock()
+
+	if c.opts != nil && c.opts.Schema > 0 {
+		return c.opts.Schema
+	}
+
+	if schema, ok := c.schemas[payload]; ok {
+		return schema
+	}
+	return LatestSchema
+}
+
+// Returns true if the payload was sent with the schema and Kahu rejected it
+// as a bad request, after downgrading the payload to the previous schema so
+// that it can be sent again. Pinned schemas are never downgraded.
+func (c *HTTPClient) downgrade(payload string, schema int, err error) bool {
+	rejected, ok := err.(*APIError)
+	if !ok || schema <= SchemaV1 {
+		return false
+	}
+
+	if rejected.StatusCode != http.StatusBadRequest && rejected.StatusCode != http.StatusUnprocessableEntity {
+		return false
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if c.opts != nil && c.opts.Schema > 0 {
+		return false
+	}
+
+	if c.schemas == nil {
+		c.schemas = make(map[string]int)
+	}
+
+	// Another request may have already downgraded the payload
+	if current, ok := c.schemas[payload]; ok && current < schema {
+		return true
+	}
+
+	c.schemas[payload] = schema - 1
+	warn("kahu rejected the %s with schema %d (%s), sending schema %d", payload, schema, rejected.Status, schema-1)
+	return true
+}
+
+// Creates the POST request of the payload encoded with the schema.
+func (c *HTTPClient) newSchemaRequest(ctx context.Context, endpoint string, schema int, body io.Reader) (*http.Request, error) {
+	req, err := c.newRequest(ctx, http.MethodPost, endpoint, body)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set(SchemaHeader, strconv.Itoa(schema))
+	return req, nil
+}
+
+//===========================================================================
+// Versioned Encoders
+//===========================================================================
+
+// Heartbeat of schema 1, the address of the host.
+type heartbeatV1 struct {
+	IPAddr   string `json:"ip_address"`
+	Hostname string `json:"hostname"`
+}
+
+// Latency report of schema 1, the latency of a ping.
+type latencyV1 struct {
+	Target  string  `json:"target"`
+	Latency float64 `json:"latency"`
+	Timeout bool    `json:"timeout"`
+}
+
+// Health report of schema 1, the resources of the host.
+type healthV1 struct {
+	Hostname        string  `json:"hostname,omitempty"`
+	OS              string  `json:"os,omitempty"`
+	Platform        string  `json:"platform,omitempty"`
+	PlatformVersion string  `json:"platform_version,omitempty"`
+	ActiveProcesses uint64  `json:"active_procs,omitempty"`
+	Uptime          uint64  `json:"uptime,omitempty"`
+	TotalRAM        uint64  `json:"total_ram,omitempty"`
+	AvailableRAM    uint64  `json:"available_ram,omitempty"`
+	UsedRAM         uint64  `json:"used_ram,omitempty"`
+	UsedRAMPercent  float64 `json:"used_ram_percent,omitempty"`
+	Filesystem      string  `json:"filesystem,omitempty"`
+	TotalDisk       uint64  `json:"total_disk,omitempty"`
+	FreeDisk        uint64  `json:"free_disk,omitempty"`
+	UsedDisk        uint64  `json:"used_disk,omitempty"`
+	UsedDiskPercent float64 `json:"used_disk_percent,omitempty"`
+	CPUModel        string  `json:"cpu_model,omitempty"`
+	CPUCores        int32   `json:"cpu_cores,omitempty"`
+	CPUPercent      float64 `json:"cpu_percent,omitempty"`
+	GoVersion       string  `json:"go_version,omitempty"`
+	GoPlatform      string  `json:"go_platform,omitempty"`
+	GoArchitecture  string  `json:"go_architecture,omitempty"`
+}
+
+// Encodes the heartbeat with the schema.
+func encodeHeartbeat(data *HeartbeatRequest, schema int) (io.Reader, error) {
+	if schema >= SchemaV2 {
+		return encodeRequest(data)
+	}
+	return encodeRequest(&heartbeatV1{IPAddr: data.IPAddr, Hostname: data.Hostname})
+}
+
+// Encodes the latency report with the schema. Schema 1 has no notion of
+// targets that were not pinged, so they are left out of the report.
+func encodeLatency(data UpdateLatencyRequests, schema int) (io.Reader, error) {
+	if schema >= SchemaV2 {
+		return encodeRequest(data)
+	}
+
+	latencies := make([]*latencyV1, 0, len(data))
+	for _, latency := range data {
+		if latency.Skipped {
+			continue
+		}
+		latencies = append(latencies, &latencyV1{Target: latency.Target, Latency: latency.Latency, Timeout: latency.Timeout})
+	}
+	return encodeRequest(latencies)
+}
+
+// Encodes the health report with the schema.
+func encodeHealth(status *SystemStatus, schema int) (io.Reader, error) {
+	if schema >= SchemaV2 {
+		return encodeRequest(status)
+	}
+
+	return encodeRequest(&healthV1{
+		Hostname:        status.Hostname,
+		OS:              status.OS,
+		Platform:        status.Platform,
+		PlatformVersion: status.PlatformVersion,
+		ActiveProcesses: status.ActiveProcesses,
+		Uptime:          status.Uptime,
+		TotalRAM:        status.TotalRAM,
+		AvailableRAM:    status.AvailableRAM,
+		UsedRAM:         status.UsedRAM,
+		UsedRAMPercent:  status.UsedRAMPercent,
+		Filesystem:      status.Filesystem,
+		TotalDisk:       status.TotalDisk,
+		FreeDisk:        status.FreeDisk,
+		UsedDisk:        status.UsedDisk,
+		UsedDiskPercent: status.UsedDiskPercent,
+		CPUModel:        status.CPUModel,
+		CPUCores:        status.CPUCores,
+		CPUPercent:      status.CPUPercent,
+		GoVersion:       status.GoVersion,
+		GoPlatform:      status.GoPlatform,
+		GoArchitecture:  status.GoArchitecture,
+	})
+}
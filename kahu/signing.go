@@ -0,0 +1,172 @@
+package kahu
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SignatureHeader is the header of requests to Kahu that carries the HMAC
+// signature of the request, e.g. "t=1527811200,sha256=9f86d08...,v1=5d41...".
+const SignatureHeader = "X-Kahu-Signature"
+
+// SignatureWindow is how far the timestamp of a signed request may be from the
+// time it is verified by Kahu, so that captured requests can't be replayed
+// later. It must be larger than the clock skew between kekahu and Kahu.
+const SignatureWindow = 5 * time.Minute
+
+// Errors returned when a signed request cannot be verified.
+var (
+	ErrUnsignedRequest    = errors.New("request is not signed")
+	ErrMalformedSignature = errors.New("could not parse request signature header")
+	ErrInvalidDigest      = errors.New("request body does not match its digest")
+	ErrRequestSignature   = errors.New("request signature is invalid")
+	ErrExpiredRequest     = errors.New("request was signed outside of the signature window")
+)
+
+//===========================================================================
+// Request Signing
+//===========================================================================
+
+// SignRequest sets the signature header of the request to the time and the
+// SHA-256 digest of the body followed by the HMAC-SHA256 of the request with
+// each of the keys, so that Kahu can verify the request with whichever key it
+// has while keys are rotated. The body is the body as it is sent, i.e. after
+// compression. Empty keys are skipped and the header is removed if there are
+// no keys.
+func SignRequest(req *http.Request, body []byte, now time.Time, keys ...string) {
+	digest := sha256.Sum256(body)
+	timestamp := now.Unix()
+
+	fields := []string{
+		fmt.Sprintf("t=%d", timestamp),
+		fmt.Sprintf("sha256=%s", hex.EncodeToString(digest[:])),
+	}
+
+	for _, key := range keys {
+		if key != "" {
+			mac := requestMAC([]byte(key), timestamp, req, digest[:])
+			fields = append(fields, "v1="+hex.EncodeToString(mac))
+		}
+	}
+
+	if len(fields) == 2 {
+		req.Header.Del(SignatureHeader)
+		return
+	}
+	req.Header.Set(SignatureHeader, strings.Join(fields, ","))
+}
+
+// VerifyRequest checks that the signature header of the request has a
+// signature made with the key within the signature window of now, and that the
+// body (as it was sent, before decompression) matches the signed digest.
+func VerifyRequest(req *http.Request, body []byte, now time.Time, key string) error {
+	header := req.Header.Get(SignatureHeader)
+	if header == "" {
+		return ErrUnsignedRequest
+	}
+
+	var (
+		timestamp  int64
+		digest     []byte
+		signatures [][]byte
+		err        error
+	)
+
+	for _, field := range strings.Split(header, ",") {
+		parts := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(parts) != 2 {
+			return ErrMalformedSignature
+		}
+
+		switch parts[0] {
+		case "t":
+			if timestamp, err = strconv.ParseInt(parts[1], 10, 64); err != nil {
+				return ErrMalformedSignature
+			}
+		case "sha256":
+			if digest, err = hex.DecodeString(parts[1]); err != nil {
+				return ErrMalformedSignature
+			}
+		case "v1":
+			sig, err := hex.DecodeString(parts[1])
+			if err != nil {
+				return ErrMalformedSignature
+			}
+			signatures = append(signatures, sig)
+		}
+	}
+
+	if timestamp == 0 || digest == nil || len(signatures) == 0 {
+		return ErrMalformedSignature
+	}
+
+	actual := sha256.Sum256(body)
+	if !hmac.Equal(digest, actual[:]) {
+		return ErrInvalidDigest
+	}
+
+	expected := requestMAC([]byte(key), timestamp, req, digest)
+	valid := false
+	for _, sig := range signatures {
+		if hmac.Equal(sig, expected) {
+			valid = true
+		}
+	}
+
+	if !valid {
+		return ErrRequestSignature
+	}
+
+	if age := now.Sub(time.Unix(timestamp, 0)); age > SignatureWindow || age < -SignatureWindow {
+		return ErrExpiredRequest
+	}
+	return nil
+}
+
+// Returns the HMAC of the timestamp, method, path and query, and body digest
+// of the request, each on its own line.
+func requestMAC(key []byte, timestamp int64, req *http.Request, digest []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%d\n%s\n%s\n%s", timestamp, req.Method, req.URL.RequestURI(), hex.EncodeToString(digest))
+	return mac.Sum(nil)
+}
+
+// Signs POST requests to Kahu with the signing keys of the options before
+// each attempt, so that retries are signed with a fresh timestamp.
+func (c *HTTPClient) signRequest(req *http.Request) error {
+	if req.Method != http.MethodPost {
+		return nil
+	}
+
+	keys := c.options().SigningKeys
+	if strings.Join(keys, "") == "" {
+		return nil
+	}
+
+	var body []byte
+	if req.GetBody != nil {
+		rc, err := req.GetBody()
+		if err != nil {
+			return fmt.Errorf("could not sign request: %s", err)
+		}
+
+		body, err = ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return fmt.Errorf("could not sign request: %s", err)
+		}
+	} else if req.Body != nil {
+		return errors.New("could not sign request: request body cannot be rewound")
+	}
+
+	SignRequest(req, body, time.Now(), keys...)
+	return nil
+}
@@ -0,0 +1,235 @@
+package kahu
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Spool is a persistent queue of POST requests to Kahu that failed because
+// the service was unreachable. The requests are buffered in a JSON file on
+// disk and replayed in order once connectivity is restored.
+type Spool struct {
+	sync.Mutex
+	path      string        // path to the JSON spool file
+	maxSize   int           // maximum number of buffered requests, oldest dropped first
+	ttl       time.Duration // requests older than the ttl are dropped, no expiration if zero
+	replaying bool          // prevents concurrent replays from sending duplicates
+	entries   []*SpoolEntry // the buffered requests in order
+}
+
+// SpoolEntry is a buffered POST request to a Kahu endpoint.
+type SpoolEntry struct {
+	Endpoint string          `json:"endpoint"` // the Kahu endpoint to POST to
+	Body     json.RawMessage `json:"body"`     // the JSON body of the request
+	Created  time.Time       `json:"created"`  // when the request was first attempted
+}
+
+// Init the spool and load any previously buffered requests from disk.
+func (s *Spool) Init(path string, maxSize int, ttl time.Duration) error {
+	s.Lock()
+	defer s.Unlock()
+
+	s.path = path
+	s.maxSize = maxSize
+	s.ttl = ttl
+	s.entries = make([]*SpoolEntry, 0)
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("could not read spool: %s", err)
+	}
+
+	if err := json.Unmarshal(data, &s.entries); err != nil {
+		return fmt.Errorf("could not parse spool: %s", err)
+	}
+
+	if len(s.entries) > 0 {
+		info("loaded %d buffered requests from %s", len(s.entries), path)
+	}
+	return nil
+}
+
+// Len returns the number of buffered requests.
+func (s *Spool) Len() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.entries)
+}
+
+// Push a failed request onto the end of the spool, dropping the oldest
+// requests if the spool exceeds its maximum size.
+func (s *Spool) Push(endpoint string, body []byte) error {
+	s.Lock()
+	defer s.Unlock()
+
+	s.entries = append(s.entries, &SpoolEntry{
+		Endpoint: endpoint, Body: json.RawMessage(body), Created: time.Now(),
+	})
+
+	if s.maxSize > 0 && len(s.entries) > s.maxSize {
+		dropped := len(s.entries) - s.maxSize
+		s.entries = s.entries[dropped:]
+		warn("spool is full, dropped %d buffered requests", dropped)
+	}
+
+	return s.save()
+}
+
+// Replay the buffered requests in order with the send function, stopping at
+// the first failure so that the remaining requests stay in order. Expired
+// requests are dropped without being sent. Returns the number of requests sent.
+func (s *Spool) Replay(send func(*SpoolEntry) error) (n int, err error) {
+	s.Lock()
+	if s.replaying {
+		s.Unlock()
+		return 0, nil
+	}
+	s.replaying = true
+	s.Unlock()
+
+	defer func() {
+		s.Lock()
+		s.replaying = false
+		s.Unlock()
+	}()
+
+	for {
+		entry, err := s.peek()
+		if entry == nil || err != nil {
+			return n, err
+		}
+
+		// Send the request without holding the lock so failures can be pushed
+		if err = send(entry); err != nil {
+			return n, err
+		}
+
+		if err = s.pop(); err != nil {
+			return n, err
+		}
+		n++
+	}
+}
+
+// Returns the first unexpired request in the spool or nil if empty.
+func (s *Spool) peek() (*SpoolEntry, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.ttl > 0 {
+		expired := 0
+		for _, entry := range s.entries {
+			if time.Since(entry.Created) <= s.ttl {
+				break
+			}
+			expired++
+		}
+
+		if expired > 0 {
+			s.entries = s.entries[expired:]
+			warn("dropped %d expired buffered requests", expired)
+			if err := s.save(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if len(s.entries) == 0 {
+		return nil, nil
+	}
+	return s.entries[0], nil
+}
+
+// Removes the first request from the spool.
+func (s *Spool) pop() error {
+	s.Lock()
+	defer s.Unlock()
+
+	if len(s.entries) > 0 {
+		s.entries = s.entries[1:]
+	}
+	return s.save()
+}
+
+// Writes the spool to disk (not thread-safe).
+func (s *Spool) save() error {
+	data, err := json.Marshal(s.entries)
+	if err != nil {
+		return fmt.Errorf("could not encode spool: %s", err)
+	}
+
+	if err := ioutil.WriteFile(s.path, data, 0600); err != nil {
+		return fmt.Errorf("could not write spool: %s", err)
+	}
+	return nil
+}
+
+//===========================================================================
+// HTTP Client Spool Methods
+//===========================================================================
+
+// Buffers the POST request if the spool is enabled and the request failed
+// because Kahu was unreachable (client errors are not buffered).
+func (c *HTTPClient) spoolRequest(endpoint string, req *http.Request, res *http.Response) {
+	spool := c.options().Spool
+	if spool == nil || req.GetBody == nil || !retryable(res) {
+		return
+	}
+
+	// Buffer the uncompressed body, it is compressed again when it is replayed
+	data, err := requestBody(req)
+	if err != nil {
+		warn("could not buffer request: %s", err)
+		return
+	}
+
+	if err := spool.Push(endpoint, bytes.TrimSpace(data)); err != nil {
+		warn("%s", err)
+		return
+	}
+	debug("buffered %s request to replay later (%d buffered)", endpoint, spool.Len())
+}
+
+// Replays buffered requests in order now that Kahu is reachable.
+func (c *HTTPClient) replaySpool(ctx context.Context) {
+	spool := c.options().Spool
+	if spool == nil || spool.Len() == 0 {
+		return
+	}
+
+	n, err := spool.Replay(func(entry *SpoolEntry) error {
+		req, err := c.newRequest(ctx, http.MethodPost, entry.Endpoint, bytes.NewReader(entry.Body))
+		if err != nil {
+			return err
+		}
+
+		// Drop requests that Kahu rejects rather than blocking the spool
+		res, err := c.tryRequest(req)
+		if err != nil {
+			if retryable(res) {
+				return err
+			}
+			warn("dropping buffered %s request: %s", entry.Endpoint, err)
+			return nil
+		}
+		return CloseResponse(res)
+	})
+
+	if n > 0 {
+		info("replayed %d buffered requests", n)
+	}
+
+	if err != nil {
+		warn("could not replay buffered requests: %s", err)
+	}
+}
@@ -0,0 +1,108 @@
+package kahu
+
+import (
+	"sync"
+	"time"
+)
+
+//===========================================================================
+// API Statistics
+//===========================================================================
+
+// APIStats counts the requests to each endpoint of the Kahu API, the requests
+// that failed or were retried, and their latency, so that an operator can see
+// which endpoint is flaky. Every attempt of a retried request is counted as a
+// request. It is thread-safe and a nil APIStats records nothing.
+type APIStats struct {
+	sync.Mutex
+	endpoints map[string]*EndpointStats
+}
+
+// EndpointStats are the statistics of the requests to an endpoint.
+type EndpointStats struct {
+	Requests    uint64    `json:"requests"`               // attempts made, including retries
+	Failures    uint64    `json:"failures"`               // attempts that could not be made or had a non 2xx status
+	Retries     uint64    `json:"retries"`                // attempts that retried a failed attempt
+	MeanLatency float64   `json:"mean_latency_ms"`        // mean latency of the attempts in milliseconds
+	MaxLatency  float64   `json:"max_latency_ms"`         // highest latency of the attempts in milliseconds
+	LastError   string    `json:"last_error,omitempty"`   // the error of the last failed attempt
+	LastFailure time.Time `json:"last_failure,omitempty"` // when the last attempt failed
+
+	latency time.Duration // total latency of the attempts
+	max     time.Duration // highest latency of the attempts
+}
+
+// NewAPIStats returns statistics with no requests.
+func NewAPIStats() *APIStats {
+	return &APIStats{endpoints: make(map[string]*EndpointStats)}
+}
+
+// Request records an attempt of a request to the endpoint that took the
+// latency, failed if the error is not nil.
+func (s *APIStats) Request(endpoint string, latency time.Duration, err error) {
+	if s == nil {
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	stats := s.endpoint(endpoint)
+	stats.Requests++
+	stats.latency += latency
+	if latency > stats.max {
+		stats.max = latency
+	}
+
+	if err != nil {
+		stats.Failures++
+		stats.LastError = err.Error()
+		stats.LastFailure = time.Now()
+	}
+}
+
+// Retry records that a failed request to the endpoint is retried.
+func (s *APIStats) Retry(endpoint string) {
+	if s == nil {
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.endpoint(endpoint).Retries++
+}
+
+// Endpoints returns a copy of the statistics of each endpoint requested so
+// far, with the mean and max latencies in milliseconds.
+func (s *APIStats) Endpoints() map[string]*EndpointStats {
+	if s == nil {
+		return nil
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	endpoints := make(map[string]*EndpointStats, len(s.endpoints))
+	for endpoint, stats := range s.endpoints {
+		snapshot := *stats
+		if stats.Requests > 0 {
+			snapshot.MeanLatency = float64(stats.latency) / float64(stats.Requests) / float64(time.Millisecond)
+		}
+		snapshot.MaxLatency = float64(stats.max) / float64(time.Millisecond)
+		endpoints[endpoint] = &snapshot
+	}
+	return endpoints
+}
+
+// Latency returns the total and highest latency of the attempts.
+func (e *EndpointStats) Latency() (total, max time.Duration) {
+	return e.latency, e.max
+}
+
+// Returns the statistics of the endpoint, creating them if necessary.
+func (s *APIStats) endpoint(endpoint string) *EndpointStats {
+	stats, ok := s.endpoints[endpoint]
+	if !ok {
+		stats = new(EndpointStats)
+		s.endpoints[endpoint] = stats
+	}
+	return stats
+}
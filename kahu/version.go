@@ -0,0 +1,18 @@
+package kahu
+
+import "fmt"
+
+// Version is the version reported by the Kahu /api/version/ endpoint.
+type Version struct {
+	Version    string         `json:"version"`               // the version of the Kahu server
+	APIVersion string         `json:"api_version,omitempty"` // the version of the Kahu API
+	Schemas    map[string]int `json:"schemas,omitempty"`     // the latest schema of each payload Kahu accepts, see Schema
+}
+
+// String returns the Kahu server and API versions.
+func (v *Version) String() string {
+	if v.APIVersion == "" {
+		return fmt.Sprintf("kahu %s", v.Version)
+	}
+	return fmt.Sprintf("kahu %s (api %s)", v.Version, v.APIVersion)
+}
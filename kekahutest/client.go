@@ -0,0 +1,213 @@
+/*
+Package kekahutest provides mocks of Kahu and of the echo servers of other
+hosts so that the heartbeat, latency, sync, and health routines of the kekahu
+service can be tested without a live Kahu server or network.
+
+Client is a mock Kahu API client: pass it to the SetClient method of the
+service, set the responses (or errors) that each request should return, and
+then inspect the requests that were sent to it. Server is an in-process mock
+of the Kahu HTTP API for integration tests that exercise the real HTTP client;
+pass its Options to agent.New. EchoServer replies to pings from the service
+with simulated delays, loss, and errors; add its Neighbor to the neighbors
+response of the mock so that the service pings it.
+*/
+package kekahutest
+
+import (
+	"context"
+	"sync"
+
+	"github.com/bbengfort/kekahu/agent"
+	"github.com/bbengfort/kekahu/kahu"
+	"github.com/bbengfort/x/peers"
+)
+
+// Names of the KahuClient methods, used to set errors and count calls.
+const (
+	HeartbeatMethod     = "Heartbeat"
+	NeighborsMethod     = "Neighbors"
+	ReportLatencyMethod = "ReportLatency"
+	ReplicasMethod      = "Replicas"
+	HealthMethod        = "Health"
+	HealthDeltaMethod   = "HealthDelta"
+	BandwidthMethod     = "ReportBandwidth"
+	MatrixMethod        = "ReportMatrix"
+)
+
+// Client is a mock implementation of agent.KahuClient that returns canned
+// responses and records the requests that are made to it. It is safe for
+// concurrent use, though the fields should be set before the service runs.
+type Client struct {
+	sync.Mutex
+
+	// Responses returned by each method, empty responses are returned if nil.
+	HeartbeatResponse *kahu.HeartbeatResponse
+	NeighborsResponse *kahu.NeighborsResponse
+	LatencyResponses  kahu.UpdateLatencyResponses
+	ReplicasResponse  []*peers.Peer
+
+	// Errors returned by the methods instead of a response, by method name.
+	Errors map[string]error
+
+	// Requests made to the client, in the order they were made.
+	Heartbeats    []*kahu.HeartbeatRequest
+	Latencies     []kahu.UpdateLatencyRequests
+	HealthReports []*kahu.SystemStatus
+	HealthDeltas  []kahu.HealthDelta
+	Bandwidths    []kahu.BandwidthRequests
+	Matrices      []kahu.MatrixRequests
+
+	calls map[string]int
+}
+
+// NewClient returns a mock client for an active replica with no neighbors.
+func NewClient() *Client {
+	return &Client{
+		HeartbeatResponse: &kahu.HeartbeatResponse{Success: true, Active: true},
+		NeighborsResponse: &kahu.NeighborsResponse{Targets: []*kahu.Neighbor{}},
+		Errors:            make(map[string]error),
+	}
+}
+
+// Heartbeat records the heartbeat request and returns the heartbeat response.
+func (c *Client) Heartbeat(ctx context.Context, data *kahu.HeartbeatRequest) (*kahu.HeartbeatResponse, error) {
+	if err := c.call(ctx, HeartbeatMethod); err != nil {
+		return nil, err
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	c.Heartbeats = append(c.Heartbeats, data)
+
+	if c.HeartbeatResponse == nil {
+		return new(kahu.HeartbeatResponse), nil
+	}
+	return c.HeartbeatResponse, nil
+}
+
+// Neighbors returns the neighbors response.
+func (c *Client) Neighbors(ctx context.Context) (*kahu.NeighborsResponse, error) {
+	if err := c.call(ctx, NeighborsMethod); err != nil {
+		return nil, err
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if c.NeighborsResponse == nil {
+		return new(kahu.NeighborsResponse), nil
+	}
+	return c.NeighborsResponse, nil
+}
+
+// ReportLatency records the batch of latencies and returns the latency
+// responses, or a response for each request if none are set.
+func (c *Client) ReportLatency(ctx context.Context, data kahu.UpdateLatencyRequests) (kahu.UpdateLatencyResponses, error) {
+	if err := c.call(ctx, ReportLatencyMethod); err != nil {
+		return nil, err
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	c.Latencies = append(c.Latencies, data)
+
+	if c.LatencyResponses == nil {
+		responses := make(kahu.UpdateLatencyResponses, 0, len(data))
+		for _, req := range data {
+			responses = append(responses, &kahu.UpdateLatencyResponse{Target: req.Target})
+		}
+		return responses, nil
+	}
+	return c.LatencyResponses, nil
+}
+
+// Replicas returns the replicas response.
+func (c *Client) Replicas(ctx context.Context) ([]*peers.Peer, error) {
+	if err := c.call(ctx, ReplicasMethod); err != nil {
+		return nil, err
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if c.ReplicasResponse == nil {
+		return []*peers.Peer{}, nil
+	}
+	return c.ReplicasResponse, nil
+}
+
+// Health records the health report.
+func (c *Client) Health(ctx context.Context, status *kahu.SystemStatus) error {
+	if err := c.call(ctx, HealthMethod); err != nil {
+		return err
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	c.HealthReports = append(c.HealthReports, status)
+	return nil
+}
+
+// HealthDelta records the changes to the health report.
+func (c *Client) HealthDelta(ctx context.Context, status *kahu.SystemStatus, delta kahu.HealthDelta) error {
+	if err := c.call(ctx, HealthDeltaMethod); err != nil {
+		return err
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	c.HealthDeltas = append(c.HealthDeltas, delta)
+	return nil
+}
+
+// ReportBandwidth records the batch of bandwidth measurements.
+func (c *Client) ReportBandwidth(ctx context.Context, data kahu.BandwidthRequests) error {
+	if err := c.call(ctx, BandwidthMethod); err != nil {
+		return err
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	c.Bandwidths = append(c.Bandwidths, data)
+	return nil
+}
+
+// ReportMatrix records the latency matrix.
+func (c *Client) ReportMatrix(ctx context.Context, data kahu.MatrixRequests) error {
+	if err := c.call(ctx, MatrixMethod); err != nil {
+		return err
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	c.Matrices = append(c.Matrices, data)
+	return nil
+}
+
+// Calls returns the number of times the method was called, including calls
+// that returned an error.
+func (c *Client) Calls(method string) int {
+	c.Lock()
+	defer c.Unlock()
+	return c.calls[method]
+}
+
+// Counts the call and returns the context error or the error set for the
+// method, if any.
+func (c *Client) call(ctx context.Context, method string) error {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.calls == nil {
+		c.calls = make(map[string]int)
+	}
+	c.calls[method]++
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.Errors[method]
+}
+
+// Ensure the mock implements the interface.
+var _ agent.KahuClient = &Client{}
@@ -0,0 +1,275 @@
+package kekahutest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/bbengfort/kekahu/kahu"
+	knet "github.com/bbengfort/kekahu/net"
+	"github.com/bbengfort/kekahu/ping"
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	grpcstatus "google.golang.org/grpc/status"
+)
+
+// EchoServer is an in-process echo server that replies to gRPC and UDP pings
+// from the service on the same local port, with injectable delays, loss, and
+// errors to simulate network conditions. Pings are not authenticated. It is
+// safe for concurrent use, so conditions can be changed while pings are sent.
+type EchoServer struct {
+	sync.Mutex
+
+	// The system health replied to health requests, an empty report if nil.
+	HealthStatus *kahu.SystemStatus
+
+	name   string
+	addr   string
+	srv    *grpc.Server
+	conn   net.PacketConn
+	rand   *rand.Rand
+	delay  time.Duration // added to every reply
+	jitter time.Duration // random range added to the delay
+	loss   float64       // fraction of pings that are never replied to
+	err    error         // returned to gRPC pings instead of replies
+	pings  []*ping.Packet
+}
+
+// NewEchoServer starts an echo server with the name on a random local port.
+// Close the server when the test is done.
+func NewEchoServer(name string) (*EchoServer, error) {
+	sock, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenPacket("udp", sock.Addr().String())
+	if err != nil {
+		sock.Close()
+		return nil, fmt.Errorf("could not listen for udp pings: %s", err)
+	}
+
+	s := &EchoServer{
+		name: name, addr: sock.Addr().String(), srv: grpc.NewServer(), conn: conn,
+		rand: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+
+	ping.RegisterEchoServer(s.srv, s)
+	go s.srv.Serve(sock)
+	go s.serveUDP()
+	return s, nil
+}
+
+// Addr returns the address the server listens for pings on.
+func (s *EchoServer) Addr() string {
+	return s.addr
+}
+
+// Neighbor returns the server as a neighbor to add to the neighbors response
+// of a mock client or server so that the service pings it.
+func (s *EchoServer) Neighbor() *kahu.Neighbor {
+	return &kahu.Neighbor{Hostname: s.name, State: "Online", IPAddr: s.addr}
+}
+
+// SetDelay adds the delay plus a random duration up to the jitter to every
+// reply, simulating the latency of a remote host.
+func (s *EchoServer) SetDelay(delay, jitter time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+	s.delay, s.jitter = delay, jitter
+}
+
+// SetLoss drops the fraction (0 to 1) of pings without replying, so that
+// they time out. Lost gRPC pings are held until the caller gives up.
+func (s *EchoServer) SetLoss(rate float64) {
+	s.Lock()
+	defer s.Unlock()
+	s.loss = rate
+}
+
+// SetError makes gRPC pings fail with the error (UDP pings are dropped) until
+// it is set to nil, simulating a host whose echo server is broken.
+func (s *EchoServer) SetError(err error) {
+	s.Lock()
+	defer s.Unlock()
+	s.err = err
+}
+
+// Pings returns the pings that were replied to, in the order they were sent.
+func (s *EchoServer) Pings() []*ping.Packet {
+	s.Lock()
+	defer s.Unlock()
+	pings := make([]*ping.Packet, len(s.pings))
+	copy(pings, s.pings)
+	return pings
+}
+
+// Close stops the server, closing any open connections.
+func (s *EchoServer) Close() error {
+	s.srv.Stop()
+	return s.conn.Close()
+}
+
+//===========================================================================
+// Echo Service
+//===========================================================================
+
+// Ping implements the ping.EchoServer interface.
+func (s *EchoServer) Ping(ctx context.Context, in *ping.Packet) (*ping.Packet, error) {
+	return s.reply(ctx, in)
+}
+
+// Stream implements the ping.EchoServer interface.
+func (s *EchoServer) Stream(stream ping.Echo_StreamServer) error {
+	for {
+		in, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		out, err := s.reply(stream.Context(), in)
+		if err != nil {
+			return err
+		}
+
+		if err = stream.Send(out); err != nil {
+			return err
+		}
+	}
+}
+
+// Health implements the ping.EchoServer interface.
+func (s *EchoServer) Health(ctx context.Context, in *ping.Packet) (*ping.HealthReply, error) {
+	if _, err := s.reply(ctx, in); err != nil {
+		return nil, err
+	}
+
+	s.Lock()
+	status := s.HealthStatus
+	s.Unlock()
+
+	if status == nil {
+		status = new(kahu.SystemStatus)
+	}
+
+	data, err := json.Marshal(status)
+	if err != nil {
+		return nil, grpcstatus.Error(codes.Internal, err.Error())
+	}
+	return &ping.HealthReply{Source: s.name, Status: data}, nil
+}
+
+// Throughput implements the ping.EchoServer interface.
+func (s *EchoServer) Throughput(stream ping.Echo_ThroughputServer) error {
+	received := time.Now()
+	var total uint64
+	for {
+		in, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		total += uint64(len(in.Data))
+	}
+
+	return stream.SendAndClose(&ping.ThroughputReply{
+		Source: s.name, Bytes: total, Received: received.UnixNano(), Replied: time.Now().UnixNano(),
+	})
+}
+
+// Replies to UDP pings until the server is closed.
+func (s *EchoServer) serveUDP() {
+	buf := make([]byte, knet.MaxDatagramSize)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		in := new(ping.Packet)
+		if err := proto.Unmarshal(buf[:n], in); err != nil {
+			continue
+		}
+
+		go func(addr net.Addr) {
+			out, err := s.reply(context.Background(), in)
+			if err != nil {
+				return
+			}
+
+			if data, err := proto.Marshal(out); err == nil {
+				s.conn.WriteTo(data, addr)
+			}
+		}(addr)
+	}
+}
+
+// errLost is returned for pings that are dropped.
+var errLost = errors.New("ping lost")
+
+// Applies the network conditions to the ping and returns the reply.
+func (s *EchoServer) reply(ctx context.Context, in *ping.Packet) (*ping.Packet, error) {
+	s.Lock()
+	delay, err := s.delay, s.err
+	if s.jitter > 0 {
+		delay += time.Duration(s.rand.Int63n(int64(s.jitter)))
+	}
+	lost := s.loss > 0 && s.rand.Float64() < s.loss
+	s.Unlock()
+
+	if err != nil {
+		return nil, grpcstatus.Error(codes.Unavailable, err.Error())
+	}
+
+	if lost {
+		if _, ok := ctx.Deadline(); ok {
+			<-ctx.Done()
+		}
+		return nil, errLost
+	}
+
+	// The delay is split around the timestamps of the reply, as if it were
+	// the network latency, so that the clocks still appear synchronized
+	if err := sleep(ctx, delay/2); err != nil {
+		return nil, err
+	}
+
+	in.Received = time.Now().UnixNano()
+	in.Replied = in.Received
+	if err := sleep(ctx, delay-delay/2); err != nil {
+		return nil, err
+	}
+
+	s.Lock()
+	s.pings = append(s.pings, in)
+	s.Unlock()
+
+	in.Target = s.name
+	return in, nil
+}
+
+// Waits for the duration or until the context is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+
+	select {
+	case <-time.After(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
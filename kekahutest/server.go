@@ -0,0 +1,434 @@
+package kekahutest
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bbengfort/kekahu/agent"
+	"github.com/bbengfort/kekahu/kahu"
+	"github.com/bbengfort/x/peers"
+)
+
+// DefaultAPIKey is the API key the mock server accepts if none is set.
+const DefaultAPIKey = "kekahutest"
+
+// Server is an in-process mock of the Kahu HTTP API that the real HTTP client
+// of the service can be pointed at, so that integration tests cover request
+// encoding, authentication, retries, and spooling. It implements the
+// heartbeat, neighbors, latency, replicas, health, bandwidth, latency matrix,
+// enrollment, and version endpoints, returning the canned responses and recording the requests
+// like Client. Delays and failures can be injected per endpoint with SetDelay
+// and Fail. It is safe for concurrent use.
+type Server struct {
+	sync.Mutex
+
+	// The API key that requests must be authenticated with.
+	APIKey string
+
+	// Reject POST requests that are not signed with this key, if it is set.
+	SigningKey string
+
+	// The enrollment token that the enroll endpoint exchanges for the API key
+	// once, after which it is cleared. No hosts are enrolled if it is empty.
+	EnrollToken string
+
+	// Paginate the neighbors and replicas with this many per page, linking to
+	// the next page like Django REST framework, if greater than zero.
+	PageSize int
+
+	// Responses returned by each endpoint, empty responses are returned if nil.
+	HeartbeatResponse *kahu.HeartbeatResponse
+	NeighborsResponse *kahu.NeighborsResponse
+	LatencyResponses  kahu.UpdateLatencyResponses
+	ReplicasResponse  []*peers.Peer
+
+	// Version returned by the version endpoint. Heartbeats, latency reports,
+	// and health reports posted with a later schema than it lists are
+	// rejected with 400 Bad Request, like an older Kahu server would.
+	Version *kahu.Version
+
+	// Requests made to the server, in the order they were made.
+	Heartbeats    []*kahu.HeartbeatRequest
+	Latencies     []kahu.UpdateLatencyRequests
+	HealthReports []*kahu.SystemStatus
+	HealthDeltas  []kahu.HealthDelta
+	Bandwidths    []kahu.BandwidthRequests
+	Matrices      []kahu.MatrixRequests
+	Enrollments   []*kahu.EnrollRequest
+
+	srv    *httptest.Server
+	calls  map[string]int
+	faults map[string]*fault
+}
+
+// A failure or delay injected into the responses of an endpoint.
+type fault struct {
+	delay  time.Duration // time to wait before responding
+	status int           // status code to respond with, no failure if zero
+	times  int           // number of requests to fail, all requests if negative
+}
+
+// NewServer starts a mock Kahu server for an active replica with no neighbors
+// on a local port. Close the server when the test is done.
+func NewServer() *Server {
+	s := &Server{
+		APIKey:            DefaultAPIKey,
+		HeartbeatResponse: &kahu.HeartbeatResponse{Success: true, Active: true},
+		NeighborsResponse: &kahu.NeighborsResponse{Targets: []*kahu.Neighbor{}},
+		calls:             make(map[string]int),
+		faults:            make(map[string]*fault),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(kahu.HeartbeatEndpoint, s.handle(kahu.HeartbeatEndpoint, http.MethodPost, s.heartbeat))
+	mux.HandleFunc(kahu.NeighborsEndpoint, s.handle(kahu.NeighborsEndpoint, http.MethodGet, s.neighbors))
+	mux.HandleFunc(kahu.LatencyEndpoint, s.handle(kahu.LatencyEndpoint, http.MethodPost, s.latency))
+	mux.HandleFunc(kahu.ReplicasEndpoint, s.handle(kahu.ReplicasEndpoint, http.MethodGet, s.replicas))
+	mux.HandleFunc(kahu.HealthEndpoint, s.handle(kahu.HealthEndpoint, http.MethodPost, s.health))
+	mux.HandleFunc(kahu.BandwidthEndpoint, s.handle(kahu.BandwidthEndpoint, http.MethodPost, s.bandwidth))
+	mux.HandleFunc(kahu.MatrixEndpoint, s.handle(kahu.MatrixEndpoint, http.MethodPost, s.matrix))
+	mux.HandleFunc(kahu.EnrollEndpoint, s.handle(kahu.EnrollEndpoint, http.MethodPost, s.enroll))
+	mux.HandleFunc(kahu.VersionEndpoint, s.handle(kahu.VersionEndpoint, http.MethodGet, s.version))
+
+	s.srv = httptest.NewServer(mux)
+	return s
+}
+
+// URL returns the base URL of the server.
+func (s *Server) URL() string {
+	return s.srv.URL
+}
+
+// Options returns the options to pass to agent.New so that the service
+// reports to the server with its API key.
+func (s *Server) Options() *agent.Config {
+	s.Lock()
+	defer s.Unlock()
+	return &agent.Config{URL: s.srv.URL, APIKey: s.APIKey}
+}
+
+// Close the server, blocking until all outstanding requests have completed.
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+// SetDelay makes the endpoint wait for the delay before responding to every
+// request, e.g. to test timeouts. A zero delay removes the delay.
+func (s *Server) SetDelay(endpoint string, delay time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+	s.fault(endpoint).delay = delay
+}
+
+// Fail makes the endpoint respond to the next n requests with the status code
+// instead of handling them, or to all requests if n is negative, e.g. to test
+// retries and spooling. A zero status code stops the failures.
+func (s *Server) Fail(endpoint string, status, n int) {
+	s.Lock()
+	defer s.Unlock()
+
+	f := s.fault(endpoint)
+	f.status, f.times = status, n
+	if status == 0 {
+		f.times = 0
+	}
+}
+
+// Calls returns the number of requests made to the endpoint, including the
+// requests that failed.
+func (s *Server) Calls(endpoint string) int {
+	s.Lock()
+	defer s.Unlock()
+	return s.calls[endpoint]
+}
+
+// Returns the fault of the endpoint, creating it if necessary.
+func (s *Server) fault(endpoint string) *fault {
+	f, ok := s.faults[endpoint]
+	if !ok {
+		f = new(fault)
+		s.faults[endpoint] = f
+	}
+	return f
+}
+
+//===========================================================================
+// Handlers
+//===========================================================================
+
+// Returns a handler that checks the method, API key (the enrollment token of
+// the enroll endpoint), and signature of the request and injects the faults of the endpoint before calling the handler, which
+// returns the response to encode as JSON.
+func (s *Server) handle(endpoint, method string, handler func(*http.Request) (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.Lock()
+		s.calls[endpoint]++
+		f := *s.fault(endpoint)
+		if f.status != 0 && f.times != 0 {
+			s.faults[endpoint].times--
+		}
+		apikey, signingKey := s.APIKey, s.SigningKey
+		if endpoint == kahu.EnrollEndpoint {
+			apikey = s.EnrollToken
+		}
+		accepted := s.schema(endpoint)
+		s.Unlock()
+
+		if f.delay > 0 {
+			select {
+			case <-time.After(f.delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+
+		if f.status != 0 && f.times != 0 {
+			http.Error(w, http.StatusText(f.status), f.status)
+			return
+		}
+
+		if r.Method != method {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		unenrolled := endpoint == kahu.EnrollEndpoint && apikey == ""
+		if unenrolled || (apikey != "" && r.Header.Get("Authorization") != "Bearer "+apikey) {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		if schema, _ := strconv.Atoi(r.Header.Get(kahu.SchemaHeader)); schema > accepted {
+			http.Error(w, fmt.Sprintf("unsupported schema %d", schema), http.StatusBadRequest)
+			return
+		}
+
+		if signingKey != "" && r.Method == http.MethodPost {
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			if err := kahu.VerifyRequest(r, body, time.Now(), signingKey); err != nil {
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+
+		rep, err := handler(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rep)
+	}
+}
+
+func (s *Server) heartbeat(r *http.Request) (interface{}, error) {
+	data := new(kahu.HeartbeatRequest)
+	if err := decode(r, data); err != nil {
+		return nil, err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.Heartbeats = append(s.Heartbeats, data)
+
+	if s.HeartbeatResponse == nil {
+		return new(kahu.HeartbeatResponse), nil
+	}
+	return s.HeartbeatResponse, nil
+}
+
+func (s *Server) neighbors(r *http.Request) (interface{}, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	rep := s.NeighborsResponse
+	if rep == nil {
+		rep = new(kahu.NeighborsResponse)
+	}
+
+	if s.PageSize <= 0 {
+		return rep, nil
+	}
+
+	start, end, next := s.page(r, len(rep.Targets))
+	return map[string]interface{}{"source": rep.Source, "targets": rep.Targets[start:end], "next": next}, nil
+}
+
+func (s *Server) latency(r *http.Request) (interface{}, error) {
+	data := make(kahu.UpdateLatencyRequests, 0)
+	if err := decode(r, &data); err != nil {
+		return nil, err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.Latencies = append(s.Latencies, data)
+
+	if s.LatencyResponses == nil {
+		responses := make(kahu.UpdateLatencyResponses, 0, len(data))
+		for _, req := range data {
+			responses = append(responses, &kahu.UpdateLatencyResponse{Source: req.Source, Target: req.Target})
+		}
+		return responses, nil
+	}
+	return s.LatencyResponses, nil
+}
+
+func (s *Server) replicas(r *http.Request) (interface{}, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	replicas := s.ReplicasResponse
+	if replicas == nil {
+		replicas = []*peers.Peer{}
+	}
+
+	if s.PageSize <= 0 {
+		return replicas, nil
+	}
+
+	start, end, next := s.page(r, len(replicas))
+	return map[string]interface{}{"count": len(replicas), "results": replicas[start:end], "next": next}, nil
+}
+
+func (s *Server) health(r *http.Request) (interface{}, error) {
+	var data json.RawMessage
+	if err := decode(r, &data); err != nil {
+		return nil, err
+	}
+
+	delta := make(kahu.HealthDelta)
+	if err := json.Unmarshal(data, &delta); err != nil {
+		return nil, err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if isDelta, _ := delta["delta"].(bool); isDelta {
+		s.HealthDeltas = append(s.HealthDeltas, delta)
+		return map[string]bool{"success": true}, nil
+	}
+
+	status := new(kahu.SystemStatus)
+	if err := json.Unmarshal(data, status); err != nil {
+		return nil, err
+	}
+	s.HealthReports = append(s.HealthReports, status)
+	return map[string]bool{"success": true}, nil
+}
+
+func (s *Server) bandwidth(r *http.Request) (interface{}, error) {
+	data := make(kahu.BandwidthRequests, 0)
+	if err := decode(r, &data); err != nil {
+		return nil, err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.Bandwidths = append(s.Bandwidths, data)
+	return map[string]bool{"success": true}, nil
+}
+
+func (s *Server) matrix(r *http.Request) (interface{}, error) {
+	data := make(kahu.MatrixRequests, 0)
+	if err := decode(r, &data); err != nil {
+		return nil, err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.Matrices = append(s.Matrices, data)
+	return map[string]bool{"success": true}, nil
+}
+
+func (s *Server) enroll(r *http.Request) (interface{}, error) {
+	data := new(kahu.EnrollRequest)
+	if err := decode(r, data); err != nil {
+		return nil, err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.Enrollments = append(s.Enrollments, data)
+	s.EnrollToken = ""
+	return &kahu.EnrollResponse{APIKey: s.APIKey, Replica: data.Hostname}, nil
+}
+
+func (s *Server) version(r *http.Request) (interface{}, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.Version == nil {
+		return &kahu.Version{Version: "kekahutest"}, nil
+	}
+	return s.Version, nil
+}
+
+// Returns the latest schema of the payload posted to the endpoint that the
+// server accepts.
+func (s *Server) schema(endpoint string) int {
+	if s.Version == nil {
+		return kahu.LatestSchema
+	}
+
+	switch endpoint {
+	case kahu.HeartbeatEndpoint:
+		return s.Version.Schema(kahu.HeartbeatSchema)
+	case kahu.LatencyEndpoint:
+		return s.Version.Schema(kahu.LatencySchema)
+	case kahu.HealthEndpoint:
+		return s.Version.Schema(kahu.HealthSchema)
+	default:
+		return kahu.LatestSchema
+	}
+}
+
+// Returns the range of the items on the page in the page query parameter of
+// the request and the link to the next page, which is nil on the last page.
+func (s *Server) page(r *http.Request, items int) (start, end int, next interface{}) {
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+
+	start = (page - 1) * s.PageSize
+	if start > items {
+		start = items
+	}
+
+	end = start + s.PageSize
+	if end >= items {
+		return start, items, nil
+	}
+	return start, end, fmt.Sprintf("http://%s%s?page=%d", r.Host, r.URL.Path, page+1)
+}
+
+// Decodes the JSON body of the request, which may be gzip compressed.
+func decode(r *http.Request, v interface{}) error {
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		body = gz
+	}
+	return json.NewDecoder(body).Decode(v)
+}
@@ -0,0 +1,124 @@
+package net
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/bbengfort/kekahu/ping"
+)
+
+// AuthWindow is how far the time a ping was sent may be from the time it is
+// verified by the echo server, so that captured pings can't be replayed later.
+// It must be larger than the clock skew between the hosts.
+const AuthWindow = 5 * time.Minute
+
+// Errors returned when a ping cannot be authenticated.
+var (
+	ErrNoSecret         = errors.New("no cluster secret to authenticate pings with")
+	ErrUnsignedPing     = errors.New("ping is not signed")
+	ErrInvalidSignature = errors.New("ping signature is invalid")
+	ErrExpiredPing      = errors.New("ping was sent outside of the authentication window")
+)
+
+// PingAuth signs pings with an HMAC-SHA256 of the ping using a secret shared
+// by the cluster, and verifies the signature of pings received by the echo
+// server so that only hosts with the secret can send pings. The secret is
+// either configured or distributed by Kahu in heartbeat responses, so it can
+// be replaced while the service is running. All methods are thread-safe and
+// may be called on a nil PingAuth, in which case pings are not signed and all
+// pings are accepted.
+type PingAuth struct {
+	sync.RWMutex
+	secret  []byte // the shared cluster secret, pings are not signed if empty
+	require bool   // reject pings that are not signed with the secret
+}
+
+// NewPingAuth creates the authenticator with the secret (which may be empty
+// until it is distributed by Kahu). If require is true, the echo server
+// rejects pings that are not signed with the secret.
+func NewPingAuth(secret string, require bool) *PingAuth {
+	return &PingAuth{secret: []byte(secret), require: require}
+}
+
+// SetSecret replaces the shared cluster secret.
+func (a *PingAuth) SetSecret(secret string) {
+	if a == nil {
+		return
+	}
+
+	a.Lock()
+	defer a.Unlock()
+	a.secret = []byte(secret)
+}
+
+// Sign the ping with the cluster secret, if there is one. The ping must be
+// signed after its sent timestamp is set since the timestamp is signed.
+func (a *PingAuth) Sign(msg *ping.Packet) {
+	if a == nil {
+		return
+	}
+
+	a.RLock()
+	defer a.RUnlock()
+	if len(a.secret) > 0 {
+		msg.Signature = signPing(a.secret, msg)
+	}
+}
+
+// Verify that the ping was signed with the cluster secret within the
+// authentication window. No error is returned if authentication is not
+// required, even if the ping is unsigned or its signature is invalid.
+func (a *PingAuth) Verify(msg *ping.Packet) error {
+	if a == nil {
+		return nil
+	}
+
+	a.RLock()
+	defer a.RUnlock()
+
+	if !a.require {
+		return nil
+	}
+
+	if len(a.secret) == 0 {
+		return ErrNoSecret
+	}
+
+	if len(msg.Signature) == 0 {
+		return ErrUnsignedPing
+	}
+
+	if !hmac.Equal(msg.Signature, signPing(a.secret, msg)) {
+		return ErrInvalidSignature
+	}
+
+	if age := time.Since(time.Unix(0, msg.Sent)); age > AuthWindow || age < -AuthWindow {
+		return ErrExpiredPing
+	}
+
+	return nil
+}
+
+// Returns the HMAC of the fields of the ping set by the client. The fields
+// are length prefixed so that the boundaries between them are unambiguous.
+func signPing(secret []byte, msg *ping.Packet) []byte {
+	mac := hmac.New(sha256.New, secret)
+	buf := make([]byte, 8)
+
+	for _, field := range []string{msg.Source, msg.Target} {
+		binary.BigEndian.PutUint64(buf, uint64(len(field)))
+		mac.Write(buf)
+		mac.Write([]byte(field))
+	}
+
+	binary.BigEndian.PutUint64(buf, msg.Sequence)
+	mac.Write(buf)
+	binary.BigEndian.PutUint64(buf, uint64(msg.Sent))
+	mac.Write(buf)
+
+	return mac.Sum(nil)
+}
@@ -0,0 +1,105 @@
+package net
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/bbengfort/kekahu/ping"
+	"google.golang.org/grpc/codes"
+	grpcstatus "google.golang.org/grpc/status"
+)
+
+// MaxBandwidthPayload is the largest chunk of data that is streamed to measure
+// bandwidth, well below the 4MB maximum gRPC message size of echo servers.
+const MaxBandwidthPayload = 1024 * 1024
+
+//===========================================================================
+// Throughput Streams
+//===========================================================================
+
+// Throughput streams chunks of data of the payload size to the echo server at
+// addr until the duration has passed, and returns the number of bytes that
+// the echo server received and the time from the first chunk until its reply.
+// gRPC flow control blocks sends when the link is saturated, so the elapsed
+// time includes draining the data that was buffered when the stream closed.
+func (p *GRPCPinger) Throughput(ctx context.Context, addr string, header *ping.Packet, payload int, duration time.Duration) (uint64, time.Duration, error) {
+	client, err := p.pool.Get(ctx, addr, p.timeout)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, duration+p.timeout)
+	defer cancel()
+
+	stream, err := client.Throughput(ctx)
+	if err != nil {
+		p.pool.Remove(addr)
+		return 0, 0, fmt.Errorf("could not open throughput stream to %s: %s", addr, err)
+	}
+
+	start := time.Now()
+	header.Sent = start.UnixNano()
+	p.auth.Sign(header)
+
+	chunk := &ping.Chunk{Header: header, Data: make([]byte, payload)}
+	for time.Since(start) < duration {
+		if err = stream.Send(chunk); err != nil {
+			if err == io.EOF {
+				// The server closed the stream, its error is returned by CloseAndRecv
+				break
+			}
+			p.pool.Remove(addr)
+			return 0, 0, fmt.Errorf("could not stream data to %s: %s", addr, err)
+		}
+		chunk.Header = nil
+	}
+
+	reply, err := stream.CloseAndRecv()
+	if err != nil {
+		return 0, 0, fmt.Errorf("could not measure throughput to %s: %s", addr, err)
+	}
+
+	return reply.Bytes, time.Since(start), nil
+}
+
+// Throughput implements the ping.EchoServer interface, counting the bytes of
+// data streamed by the client until it closes the stream. The first chunk of
+// the stream must be authenticated like a ping.
+func (s *Server) Throughput(stream ping.Echo_ThroughputServer) error {
+	in, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+
+	received := time.Now()
+	header := in.Header
+	if header == nil {
+		header = new(ping.Packet)
+	}
+
+	if err = s.authenticate(header); err != nil {
+		return grpcstatus.Error(codes.Unauthenticated, err.Error())
+	}
+
+	total := uint64(len(in.Data))
+	for {
+		in, err = stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		total += uint64(len(in.Data))
+	}
+
+	serverLog.info("received %d bytes from %s in %s", total, header.Source, time.Since(received))
+	return stream.SendAndClose(&ping.ThroughputReply{
+		Source:   s.name,
+		Bytes:    total,
+		Received: received.UnixNano(),
+		Replied:  time.Now().UnixNano(),
+	})
+}
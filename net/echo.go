@@ -0,0 +1,299 @@
+// Package net implements the echo server that replies to pings from other
+// hosts and the pingers that measure the round trip latency to echo servers,
+// over gRPC, UDP, or QUIC and directly or through a proxy. Pings are signed and
+// verified with a secret shared by the cluster. The package does not depend on
+// the kekahu service or the health checks, so programs can run an echo server
+// or ping one on their own.
+package net
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"github.com/bbengfort/kekahu/kahu"
+	"github.com/bbengfort/kekahu/ping"
+	"github.com/bbengfort/kekahu/ping/health"
+	"github.com/bbengfort/kekahu/ping/reflection"
+	"github.com/quic-go/quic-go"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	grpcstatus "google.golang.org/grpc/status"
+)
+
+// DefaultAddr is the default port that the server listens on.
+const DefaultAddr = ":3284"
+
+// EchoService is the name of the echo service reported by health checks.
+const EchoService = "ping.Echo"
+
+// MaxPingSize is the largest payload a ping may carry, well below the 4MB
+// maximum gRPC message size of echo servers.
+const MaxPingSize = 1024 * 1024
+
+//===========================================================================
+// Echo Server
+//===========================================================================
+
+// EchoMetrics collects the metrics of the pings and requests served by the echo
+// server, e.g. to expose them on a metrics endpoint.
+type EchoMetrics interface {
+	PingServed(source string, received time.Time) // a ping from the source was replied to
+	PingRejected()                                // an unauthenticated ping was rejected
+	EchoRequest(source, method, code string)      // a gRPC request was handled with the status code
+	EchoPanic(method string)                      // a panic in the handler of the method was recovered
+}
+
+// Server implements the Echo service to respond to ping requests from other
+// hosts in order to measure inter-host latencies over time. The exported
+// fields configure the server and must be set before it is run.
+type Server struct {
+	Transports   []string                           // transports to listen for pings on, grpc if empty
+	Interceptors []string                           // interceptors of the grpc server, none if empty
+	Creds        credentials.TransportCredentials   // TLS credentials, insecure if nil
+	TLSConfig    *tls.Config                        // TLS configuration of QUIC pings, self-signed if nil
+	Metrics      EchoMetrics                        // metrics collector, may be nil
+	Auth         *PingAuth                          // verifies pings are signed, accepts all if nil
+	Report       func() (*kahu.SystemStatus, error) // system health reported to peers, unimplemented if nil
+	Gossip       func() []*ping.LatencySummary      // latencies shared with clients that request them, none if nil
+	name         string                             // host information for the server
+	addr         string                             // address to bind the server to
+	quic         *quic.Transport                    // UDP socket shared by the udp and quic transports
+	health       *health.Server                     // grpc.health.v1 service for probes
+	messages     uint64                             // number of messages responded to
+	rejected     uint64                             // number of unauthenticated pings rejected
+	stats        *echoStats                         // statistics of the pings received by source
+	closers      []func()                           // close the listeners of each transport
+	stopped      chan struct{}                      // closed when the server is shut down
+}
+
+// Init the server with the name and address. If name is empty, use hostname.
+// If addr is empty string, then use the default address.
+func (s *Server) Init(addr, name string) {
+	s.addr = addr
+	s.name = name
+	s.stats = new(echoStats)
+
+	if s.name == "" {
+		s.name, _ = os.Hostname()
+	}
+
+	if s.addr == "" {
+		s.addr = DefaultAddr
+	}
+}
+
+// Run the server on the specified address, listening for pings on each of
+// the transports of the server and responding to them as quickly as possible.
+// All transports listen on the same port (TCP for gRPC, UDP for udp and quic).
+func (s *Server) Run(echan chan<- error) (err error) {
+	transports := s.Transports
+	if len(transports) == 0 {
+		transports = []string{GRPCTransport}
+	}
+
+	s.stopped = make(chan struct{})
+
+	for _, transport := range transports {
+		switch transport {
+		case GRPCTransport:
+			err = s.runGRPC(echan)
+		case UDPTransport:
+			err = s.runUDP(echan)
+		case QUICTransport:
+			err = s.runQUIC(echan)
+		default:
+			err = fmt.Errorf("unknown ping transport '%s'", transport)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Run the gRPC echo service on the address of the server. The standard gRPC
+// health checking and server reflection services are also registered so that
+// external tools (e.g. grpcurl, load balancers, and Kubernetes probes) can
+// check that the echo server is alive without crafting a ping.Packet.
+func (s *Server) runGRPC(echan chan<- error) error {
+	// Create the TCP socket to listen on
+	sock, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return fmt.Errorf("could not listen on '%s': %s", s.addr, err)
+	}
+
+	// Log taht we're listening on the socket
+	serverLog.status("listening for pings on %s", s.addr)
+
+	// Create the gRPC server and handler, secured with TLS if configured
+	opts := s.interceptors()
+	if s.Creds != nil {
+		opts = append(opts, grpc.Creds(s.Creds))
+	}
+
+	srv := grpc.NewServer(opts...)
+	ping.RegisterEchoServer(srv, s)
+	s.closers = append(s.closers, srv.Stop)
+
+	s.health = health.NewServer()
+	s.health.SetServingStatus(EchoService, health.HealthCheckResponse_SERVING)
+	health.RegisterHealthServer(srv, s.health)
+	reflection.Register(srv)
+
+	// Run the server in its own go routine
+	go func() {
+		defer sock.Close()
+		if err = srv.Serve(sock); err != nil {
+			echan <- serverLog.wrap(err)
+		}
+	}()
+
+	return nil
+}
+
+// Name returns the name of the host the server replies to pings as.
+func (s *Server) Name() string {
+	return s.name
+}
+
+// Addr returns the address the server listens for pings on.
+func (s *Server) Addr() string {
+	return s.addr
+}
+
+// Stats returns the statistics of the pings received by the server from each
+// source since it was initialized, ordered by source.
+func (s *Server) Stats() []*kahu.SourceStats {
+	return s.stats.snapshot()
+}
+
+// Shutdown the server with a status message, reporting NOT_SERVING to health
+// checks so that probes stop routing pings to the host, then close the
+// listeners so that the address can be reused.
+func (s *Server) Shutdown() error {
+	if s.health != nil {
+		s.health.Shutdown()
+	}
+
+	if s.stopped != nil {
+		close(s.stopped)
+		for _, stop := range s.closers {
+			stop()
+		}
+		s.stopped, s.closers, s.quic = nil, nil, nil
+	}
+	serverLog.status("replied to %d pings", s.messages)
+	if s.rejected > 0 {
+		serverLog.status("rejected %d unauthenticated pings", s.rejected)
+	}
+	return nil
+}
+
+// Ping implements the ping.EchoServer interface. Server handling is simply to
+// log the message has been received and to
+func (s *Server) Ping(ctx context.Context, in *ping.Packet) (*ping.Packet, error) {
+	if err := s.authenticate(in); err != nil {
+		return nil, grpcstatus.Error(codes.Unauthenticated, err.Error())
+	}
+	return s.echo(in), nil
+}
+
+// Stream implements the ping.EchoServer interface, replying to each packet
+// received on the stream as quickly as possible until the client closes it.
+func (s *Server) Stream(stream ping.Echo_StreamServer) error {
+	for {
+		in, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if err = s.authenticate(in); err != nil {
+			return grpcstatus.Error(codes.Unauthenticated, err.Error())
+		}
+
+		if err = stream.Send(s.echo(in)); err != nil {
+			return err
+		}
+	}
+}
+
+// Health implements the ping.EchoServer interface, replying with the JSON
+// encoded system status of the host so that peers can check its health
+// directly rather than through Kahu. The request is authenticated like a ping.
+func (s *Server) Health(ctx context.Context, in *ping.Packet) (*ping.HealthReply, error) {
+	if err := s.authenticate(in); err != nil {
+		return nil, grpcstatus.Error(codes.Unauthenticated, err.Error())
+	}
+
+	if s.Report == nil {
+		return nil, grpcstatus.Error(codes.Unimplemented, "the echo server does not report its health")
+	}
+
+	status, err := s.Report()
+	if err != nil {
+		return nil, grpcstatus.Error(codes.Internal, err.Error())
+	}
+
+	data, err := json.Marshal(status)
+	if err != nil {
+		return nil, grpcstatus.Error(codes.Internal, err.Error())
+	}
+
+	serverLog.info("sent health to %s", in.Source)
+	return &ping.HealthReply{Source: s.name, Status: data}, nil
+}
+
+// Verifies that the packet is signed with the cluster secret if the server
+// requires authentication. Rejected pings are counted separately from the
+// pings that are replied to and are only logged in debug mode so that
+// unauthenticated hosts cannot flood the logs.
+func (s *Server) authenticate(in *ping.Packet) error {
+	if err := s.Auth.Verify(in); err != nil {
+		s.rejected++
+		if s.Metrics != nil {
+			s.Metrics.PingRejected()
+		}
+		serverLog.debug("rejected ping %d from %s: %s", in.Sequence, in.Source, err)
+		return err
+	}
+	return nil
+}
+
+// Log that the packet has been received and return it as the reply. The
+// reply is timestamped when the packet is received and when it is returned so
+// that the client can estimate the clock skew between the hosts, and carries
+// the latency summaries of the host if the client requested them. The payload
+// of the packet is echoed back so that the round trip time measures a message
+// of its size in both directions.
+func (s *Server) echo(in *ping.Packet) *ping.Packet {
+	received := time.Now()
+	in.Received = received.UnixNano()
+	s.messages++
+	source := s.stats.record(in.Source, received)
+	if s.Metrics != nil {
+		s.Metrics.PingServed(source, received)
+	}
+	serverLog.info("received ping %d from %s", in.Sequence, in.Source)
+
+	// Piggyback the latencies of the host on the reply if the client asks
+	in.Latencies = nil
+	if in.Gossip && s.Gossip != nil {
+		in.Latencies = s.Gossip()
+	}
+
+	in.Target = s.name
+	in.Replied = time.Now().UnixNano()
+	return in
+}
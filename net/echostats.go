@@ -0,0 +1,115 @@
+package net
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bbengfort/kekahu/kahu"
+)
+
+// MaxEchoSources is the most sources the echo server keeps statistics for,
+// the pings from any other sources are counted under OtherEchoSource so that
+// hosts sending pings with random names can't exhaust the memory.
+const MaxEchoSources = 1024
+
+// OtherEchoSource is the source the pings from sources beyond the first
+// MaxEchoSources are counted under.
+const OtherEchoSource = "other"
+
+//===========================================================================
+// Echo Server Statistics
+//===========================================================================
+
+// echoStats keeps the statistics of the pings received by the echo server by
+// source. It is thread-safe and a nil echoStats records nothing.
+type echoStats struct {
+	sync.Mutex
+	sources map[string]*sourceStats
+}
+
+// The running statistics of the pings from a single source, the inter-arrival
+// times are computed with Welford's online algorithm.
+type sourceStats struct {
+	pings uint64
+	first time.Time
+	last  time.Time
+	mean  float64 // mean inter-arrival time in milliseconds
+	m2    float64 // sum of squared differences from the mean
+	min   float64
+	max   float64
+}
+
+// Records a ping from the source received at the time, returning the source
+// it was counted under.
+func (e *echoStats) record(source string, received time.Time) string {
+	if e == nil {
+		return source
+	}
+
+	e.Lock()
+	defer e.Unlock()
+
+	if e.sources == nil {
+		e.sources = make(map[string]*sourceStats)
+	}
+
+	stats, ok := e.sources[source]
+	if !ok {
+		if len(e.sources) >= MaxEchoSources {
+			source = OtherEchoSource
+			stats = e.sources[source]
+		}
+
+		if stats == nil {
+			stats = &sourceStats{first: received}
+			e.sources[source] = stats
+		}
+	}
+
+	if stats.pings > 0 {
+		arrival := float64(received.Sub(stats.last)) / float64(time.Millisecond)
+		intervals := float64(stats.pings)
+		delta := arrival - stats.mean
+		stats.mean += delta / intervals
+		stats.m2 += delta * (arrival - stats.mean)
+
+		if stats.pings == 1 || arrival < stats.min {
+			stats.min = arrival
+		}
+		if arrival > stats.max {
+			stats.max = arrival
+		}
+	}
+
+	stats.pings++
+	stats.last = received
+	return source
+}
+
+// Returns the statistics of each source, ordered by source.
+func (e *echoStats) snapshot() []*kahu.SourceStats {
+	report := make([]*kahu.SourceStats, 0)
+	if e == nil {
+		return report
+	}
+
+	e.Lock()
+	defer e.Unlock()
+
+	for source, stats := range e.sources {
+		item := &kahu.SourceStats{
+			Source: source, Pings: stats.pings, FirstSeen: stats.first, LastSeen: stats.last,
+			MeanArrival: stats.mean, MinArrival: stats.min, MaxArrival: stats.max,
+		}
+
+		if stats.pings > 2 {
+			item.StdArrival = math.Sqrt(stats.m2 / float64(stats.pings-2))
+		}
+		report = append(report, item)
+	}
+
+	sort.Slice(report, func(i, j int) bool { return report[i].Source < report[j].Source })
+	return report
+}
@@ -0,0 +1,174 @@
+package net
+
+import (
+	"net"
+	rdebug "runtime/debug"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	grpcstatus "google.golang.org/grpc/status"
+)
+
+// Interceptors that can be enabled on the gRPC echo server.
+const (
+	LoggingInterceptor  = "logging"  // log each request with the peer address, code, and latency
+	MetricsInterceptor  = "metrics"  // count the requests from each source on the metrics endpoint
+	RecoveryInterceptor = "recovery" // recover from panics in handlers, replying with an internal error
+)
+
+// Interceptors returns the names of the echo server interceptors in the order
+// they are applied to requests, outermost first. Recovery is the innermost
+// interceptor so that recovered panics are logged and counted as errors.
+func Interceptors() []string {
+	return []string{LoggingInterceptor, MetricsInterceptor, RecoveryInterceptor}
+}
+
+//===========================================================================
+// Server Interceptors
+//===========================================================================
+
+// Returns the server options that install the enabled interceptors on the
+// gRPC server. The version of gRPC that is vendored only allows one unary and
+// one stream interceptor, so the enabled interceptors are chained here.
+func (s *Server) interceptors() []grpc.ServerOption {
+	unary := make([]grpc.UnaryServerInterceptor, 0, len(s.Interceptors))
+	stream := make([]grpc.StreamServerInterceptor, 0, len(s.Interceptors))
+	for _, name := range s.Interceptors {
+		switch name {
+		case LoggingInterceptor:
+			unary = append(unary, s.logUnary)
+			stream = append(stream, s.logStream)
+		case MetricsInterceptor:
+			unary = append(unary, s.countUnary)
+			stream = append(stream, s.countStream)
+		case RecoveryInterceptor:
+			unary = append(unary, s.recoverUnary)
+			stream = append(stream, s.recoverStream)
+		}
+	}
+
+	if len(unary) == 0 {
+		return nil
+	}
+
+	return []grpc.ServerOption{
+		grpc.UnaryInterceptor(chainUnary(unary)),
+		grpc.StreamInterceptor(chainStream(stream)),
+	}
+}
+
+// Logs each unary request with the address of the peer, the status code of the
+// reply, and how long it took to handle.
+func (s *Server) logUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	rep, err := handler(ctx, req)
+	serverLog.debug("%s from %s: %s in %s", info.FullMethod, peerAddr(ctx), grpcstatus.Code(err), time.Since(start))
+	return rep, err
+}
+
+// Logs each stream with the address of the peer, the status code the stream
+// was closed with, and how long it was open.
+func (s *Server) logStream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	err := handler(srv, ss)
+	serverLog.debug("%s from %s: %s in %s", info.FullMethod, peerAddr(ss.Context()), grpcstatus.Code(err), time.Since(start))
+	return err
+}
+
+// Counts each unary request by the address of the peer, method, and code.
+func (s *Server) countUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	rep, err := handler(ctx, req)
+	if s.Metrics != nil {
+		s.Metrics.EchoRequest(peerHost(ctx), info.FullMethod, grpcstatus.Code(err).String())
+	}
+	return rep, err
+}
+
+// Counts each stream by the address of the peer, method, and code.
+func (s *Server) countStream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	err := handler(srv, ss)
+	if s.Metrics != nil {
+		s.Metrics.EchoRequest(peerHost(ss.Context()), info.FullMethod, grpcstatus.Code(err).String())
+	}
+	return err
+}
+
+// Recovers from a panic while handling a unary request, e.g. caused by a
+// malformed packet, so that it cannot kill the service.
+func (s *Server) recoverUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (rep interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = s.recovered(ctx, info.FullMethod, r)
+		}
+	}()
+	return handler(ctx, req)
+}
+
+// Recovers from a panic while handling a stream, closing the stream with an
+// internal error.
+func (s *Server) recoverStream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = s.recovered(ss.Context(), info.FullMethod, r)
+		}
+	}()
+	return handler(srv, ss)
+}
+
+// Logs and counts a recovered panic and returns the error replied with.
+func (s *Server) recovered(ctx context.Context, method string, r interface{}) error {
+	serverLog.warn("recovered from panic in %s from %s: %v\n%s", method, peerAddr(ctx), r, rdebug.Stack())
+	if s.Metrics != nil {
+		s.Metrics.EchoPanic(method)
+	}
+	return grpcstatus.Errorf(codes.Internal, "panic in %s", method)
+}
+
+// Chains the unary interceptors so that the first is the outermost.
+func chainUnary(interceptors []grpc.UnaryServerInterceptor) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		next := handler
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			interceptor, inner := interceptors[i], next
+			next = func(ctx context.Context, req interface{}) (interface{}, error) {
+				return interceptor(ctx, req, info, inner)
+			}
+		}
+		return next(ctx, req)
+	}
+}
+
+// Chains the stream interceptors so that the first is the outermost.
+func chainStream(interceptors []grpc.StreamServerInterceptor) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		next := handler
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			interceptor, inner := interceptors[i], next
+			next = func(srv interface{}, ss grpc.ServerStream) error {
+				return interceptor(srv, ss, info, inner)
+			}
+		}
+		return next(srv, ss)
+	}
+}
+
+// Returns the address of the peer that sent the request, or "unknown".
+func peerAddr(ctx context.Context) string {
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		return p.Addr.String()
+	}
+	return "unknown"
+}
+
+// Returns the host of the peer that sent the request without the port, so
+// that requests from the same source are counted together.
+func peerHost(ctx context.Context) string {
+	addr := peerAddr(ctx)
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
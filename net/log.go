@@ -0,0 +1,93 @@
+package net
+
+import "sync"
+
+// Levels of the messages logged by the echo server and the pingers, which are
+// the same as the levels of the kekahu logger.
+const (
+	LogTrace uint8 = iota
+	LogDebug
+	LogInfo
+	LogStatus
+	LogWarn
+)
+
+// Logger receives the messages logged by the echo server and the pingers at
+// their level with the component that logged them (server or ping), the
+// arguments are handled in the manner of fmt.Printf.
+type Logger func(level uint8, component, msg string, a ...interface{})
+
+// The logger set by SetLogger, messages are discarded if it is nil.
+var logger struct {
+	sync.RWMutex
+	logf Logger
+}
+
+// Component loggers add the component to the messages so that they can be
+// filtered by the part of the service that emitted them.
+var (
+	serverLog = &componentLogger{"server"}
+	pingLog   = &componentLogger{"ping"}
+)
+
+// SetLogger sets the logger the messages of the echo server and the pingers
+// are logged with. Messages are discarded if it is nil, which is the default.
+func SetLogger(logf Logger) {
+	logger.Lock()
+	defer logger.Unlock()
+	logger.logf = logf
+}
+
+// Logs the message with the logger if one is set.
+func logf(level uint8, component, msg string, a ...interface{}) {
+	logger.RLock()
+	logf := logger.logf
+	logger.RUnlock()
+
+	if logf != nil {
+		logf(level, component, msg, a...)
+	}
+}
+
+//===========================================================================
+// Component logging
+//===========================================================================
+
+// componentLogger adds the component name to every message it logs.
+type componentLogger struct {
+	component string
+}
+
+func (l *componentLogger) warn(msg string, a ...interface{}) {
+	logf(LogWarn, l.component, msg, a...)
+}
+
+func (l *componentLogger) status(msg string, a ...interface{}) {
+	logf(LogStatus, l.component, msg, a...)
+}
+
+func (l *componentLogger) info(msg string, a ...interface{}) {
+	logf(LogInfo, l.component, msg, a...)
+}
+
+func (l *componentLogger) debug(msg string, a ...interface{}) {
+	logf(LogDebug, l.component, msg, a...)
+}
+
+// Wraps the error with the component so that it is logged and recorded in the
+// error journal under the part of the service that caused it.
+func (l *componentLogger) wrap(err error) error {
+	return &ComponentError{Component: l.component, Err: err}
+}
+
+// ComponentError is a non-fatal error from a component of the service, e.g.
+// the echo server, that is sent to the error channel of the service.
+type ComponentError struct {
+	Component string // the component that caused the error
+	Err       error  // the underlying error
+}
+
+// Error returns the message of the underlying error.
+func (e *ComponentError) Error() string {
+	return e.Err.Error()
+}
@@ -0,0 +1,176 @@
+package net
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/bbengfort/kekahu/ping"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials"
+)
+
+// ConnPool reuses gRPC client connections to echo servers keyed by address so
+// that pings do not pay the TCP and HTTP/2 handshake on every request. Dialing
+// is lazy, unhealthy connections are redialed, and connections that have not
+// been used within the idle timeout are closed. Addresses are dialed without
+// holding the lock of the pool so that an unreachable echo server does not
+// stall the pings to the others, and concurrent requests for a connection to
+// the same address share a single dial.
+type ConnPool struct {
+	sync.Mutex
+	creds   credentials.TransportCredentials // TLS credentials, insecure if nil
+	idle    time.Duration                    // close connections unused for this long
+	conns   map[string]*pooledConn           // open connections by address
+	dialing map[string]*pendingDial          // connections being dialed by address
+	proxy   *PingProxy                       // proxy to connect through, direct if nil
+}
+
+// pooledConn is a client connection and when it was last used.
+type pooledConn struct {
+	conn   *grpc.ClientConn
+	client ping.EchoClient
+	used   time.Time
+}
+
+// pendingDial is a connection being dialed, the client and error are set once
+// the dial completes and done is closed.
+type pendingDial struct {
+	done   chan struct{}
+	client ping.EchoClient
+	err    error
+}
+
+// Init the pool with the transport credentials and the idle timeout.
+func (p *ConnPool) Init(creds credentials.TransportCredentials, idle time.Duration) {
+	p.Lock()
+	defer p.Unlock()
+	p.creds = creds
+	p.idle = idle
+	p.conns = make(map[string]*pooledConn)
+	p.dialing = make(map[string]*pendingDial)
+}
+
+// Get an echo client connected to the address, dialing if there is no
+// healthy connection in the pool. The dial blocks until the connection is
+// ready, the timeout expires, or the context is canceled so that the
+// handshake isn't measured as part of the ping latency. If the address is
+// already being dialed, Get waits for that dial instead.
+func (p *ConnPool) Get(ctx context.Context, addr string, timeout time.Duration) (ping.EchoClient, error) {
+	p.Lock()
+	p.evict()
+
+	if pc, ok := p.conns[addr]; ok {
+		switch pc.conn.GetState() {
+		case connectivity.TransientFailure, connectivity.Shutdown:
+			pingLog.debug("connection to %s is unhealthy, redialing", addr)
+			pc.conn.Close()
+			delete(p.conns, addr)
+		default:
+			pc.used = time.Now()
+			p.Unlock()
+			return pc.client, nil
+		}
+	}
+
+	// Wait for the connection if another request is dialing the address
+	if pending, ok := p.dialing[addr]; ok {
+		p.Unlock()
+		select {
+		case <-pending.done:
+			return pending.client, pending.err
+		case <-ctx.Done():
+			return nil, fmt.Errorf("could not connect to '%s': %s", addr, ctx.Err())
+		}
+	}
+
+	pending := &pendingDial{done: make(chan struct{})}
+	p.dialing[addr] = pending
+	creds, proxy := p.creds, p.proxy
+	p.Unlock()
+
+	conn, err := dialEcho(ctx, addr, timeout, creds, proxy)
+
+	p.Lock()
+	defer p.Unlock()
+	defer close(pending.done)
+	delete(p.dialing, addr)
+
+	if err != nil {
+		pending.err = fmt.Errorf("could not connect to '%s': %s", addr, err)
+		return nil, pending.err
+	}
+
+	// Keep the connection another request added while dialing, if any
+	if pc, ok := p.conns[addr]; ok {
+		conn.Close()
+		pc.used = time.Now()
+		pending.client = pc.client
+		return pending.client, nil
+	}
+
+	pc := &pooledConn{conn: conn, client: ping.NewEchoClient(conn), used: time.Now()}
+	p.conns[addr] = pc
+	pending.client = pc.client
+	return pending.client, nil
+}
+
+// Dials the echo server at the address with the credentials, through the
+// proxy if it is not nil, blocking until the connection is ready.
+func dialEcho(ctx context.Context, addr string, timeout time.Duration, creds credentials.TransportCredentials, proxy *PingProxy) (*grpc.ClientConn, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	opts := []grpc.DialOption{dialCredentials(creds), grpc.WithBlock()}
+	if proxy != nil {
+		opts = append(opts, grpc.WithDialer(proxy.Dial))
+	}
+	return grpc.DialContext(ctx, addr, opts...)
+}
+
+// Returns the dial option for the transport credentials, insecure if nil.
+func dialCredentials(creds credentials.TransportCredentials) grpc.DialOption {
+	if creds == nil {
+		return grpc.WithInsecure()
+	}
+	return grpc.WithTransportCredentials(creds)
+}
+
+// Remove closes the connection to the address, e.g. after a failed ping.
+func (p *ConnPool) Remove(addr string) {
+	p.Lock()
+	defer p.Unlock()
+	if pc, ok := p.conns[addr]; ok {
+		pc.conn.Close()
+		delete(p.conns, addr)
+	}
+}
+
+// Close all connections in the pool.
+func (p *ConnPool) Close() error {
+	p.Lock()
+	defer p.Unlock()
+	for addr, pc := range p.conns {
+		pc.conn.Close()
+		delete(p.conns, addr)
+	}
+	return nil
+}
+
+// Closes connections that have been idle longer than the timeout (not
+// thread-safe).
+func (p *ConnPool) evict() {
+	if p.idle <= 0 {
+		return
+	}
+
+	for addr, pc := range p.conns {
+		if time.Since(pc.used) > p.idle {
+			pingLog.debug("closing idle connection to %s", addr)
+			pc.conn.Close()
+			delete(p.conns, addr)
+		}
+	}
+}
@@ -0,0 +1,386 @@
+package net
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/bbengfort/kekahu/ping"
+	"github.com/golang/protobuf/proto"
+	"github.com/quic-go/quic-go"
+	"golang.org/x/net/context"
+)
+
+// QUICProtocol is the ALPN protocol of the QUIC echo service.
+const QUICProtocol = "kekahu-echo"
+
+// QUICIdleTimeout is how long a QUIC connection to an echo server is kept open
+// without any pings. Keep-alives are not sent between heartbeats, so the
+// connection is reopened with a new handshake if pings are sent less often.
+const QUICIdleTimeout = 5 * time.Minute
+
+//===========================================================================
+// QUIC Echo Server
+//===========================================================================
+
+// Listens for QUIC connections on the address of the server and replies to
+// the pings on each of their streams. Every ping and reply is a protocol
+// buffer encoded ping.Packet prefixed by its length, so a stream can carry any
+// number of pings. QUIC is always encrypted with TLS 1.3. If mutual TLS is not
+// configured the server presents a self-signed certificate, and the pings are
+// encrypted but the server is not authenticated.
+func (s *Server) runQUIC(echan chan<- error) error {
+	tr, err := s.quicTransport()
+	if err != nil {
+		return err
+	}
+
+	conf := s.TLSConfig
+	if conf == nil {
+		if conf, err = selfSignedTLS(s.name); err != nil {
+			return fmt.Errorf("could not create quic certificate: %s", err)
+		}
+		serverLog.warn("quic pings are encrypted with a self-signed certificate, configure tls to authenticate them")
+	}
+
+	conf = conf.Clone()
+	conf.MinVersion = tls.VersionTLS13
+	conf.NextProtos = []string{QUICProtocol}
+
+	ln, err := tr.Listen(conf, &quic.Config{MaxIdleTimeout: QUICIdleTimeout})
+	if err != nil {
+		return fmt.Errorf("could not listen on quic '%s': %s", s.addr, err)
+	}
+
+	serverLog.status("listening for quic pings on %s", s.addr)
+	stopped := s.stopped
+	s.closers = append(s.closers, func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept(context.Background())
+			if err != nil {
+				select {
+				case <-stopped:
+				default:
+					echan <- serverLog.wrap(fmt.Errorf("could not accept quic connection: %s", err))
+				}
+				return
+			}
+			go s.serveQUIC(conn)
+		}
+	}()
+
+	return nil
+}
+
+// Replies to the pings on every stream of the QUIC connection until the client
+// closes it or it is idle for longer than the QUICIdleTimeout.
+func (s *Server) serveQUIC(conn *quic.Conn) {
+	for {
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+
+		go func() {
+			defer stream.Close()
+			r := bufio.NewReader(stream)
+			for {
+				in := new(ping.Packet)
+				if err := readFrame(r, in); err != nil {
+					if err != io.EOF {
+						serverLog.debug("ignoring invalid quic ping from %s: %s", conn.RemoteAddr(), err)
+					}
+					return
+				}
+
+				// Unauthenticated pings are dropped and the stream is closed
+				if err := s.authenticate(in); err != nil {
+					return
+				}
+
+				if err := writeFrame(stream, s.echo(in)); err != nil {
+					serverLog.debug("could not reply to quic ping from %s: %s", conn.RemoteAddr(), err)
+					return
+				}
+			}
+		}()
+	}
+}
+
+// Returns the QUIC transport on the UDP socket of the server, opening the
+// socket the first time it is called. UDP pings are read from the same socket,
+// see listenPackets.
+func (s *Server) quicTransport() (*quic.Transport, error) {
+	if s.quic != nil {
+		return s.quic, nil
+	}
+
+	conn, err := net.ListenPacket("udp", s.addr)
+	if err != nil {
+		return nil, fmt.Errorf("could not listen on udp '%s': %s", s.addr, err)
+	}
+
+	s.quic = &quic.Transport{Conn: conn}
+	s.closers = append(s.closers, func() {
+		s.quic.Close()
+		conn.Close()
+	})
+	return s.quic, nil
+}
+
+// Reads the datagrams that are not QUIC packets from the QUIC transport. The
+// first byte of an encoded ping.Packet is the tag of its first field, at most
+// 0x20 since the sent timestamp of a ping is always set, while QUIC packets
+// always have the 0x40 or 0x80 bit of the first byte set.
+type nonQUICConn struct {
+	tr *quic.Transport
+}
+
+func (c nonQUICConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	return c.tr.ReadNonQUICPacket(context.Background(), b)
+}
+
+func (c nonQUICConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return c.tr.WriteTo(b, addr)
+}
+
+func (c nonQUICConn) Close() error {
+	return nil
+}
+
+//===========================================================================
+// QUIC Pinger
+//===========================================================================
+
+// QUICPinger sends pings on QUIC streams to the QUIC echo server, keeping a
+// connection open to each echo server so that the latency of a ping does not
+// include the handshake. Each Ping opens a new stream on the connection, which
+// does not require a round trip, and each Stream sends its pings on one stream.
+type QUICPinger struct {
+	sync.Mutex
+	tls     *tls.Config           // secures the connections to the echo servers
+	timeout time.Duration         // timeout to connect and for each ping
+	auth    *PingAuth             // signs the pings with the cluster secret
+	conns   map[string]*quic.Conn // open connections to the echo servers by address
+}
+
+// NewQUICPinger returns a pinger that secures the connections with the TLS
+// configuration. If it is nil, the certificates of the echo servers are not
+// verified (the pings are still encrypted).
+func NewQUICPinger(conf *tls.Config, timeout time.Duration, auth *PingAuth) *QUICPinger {
+	if conf == nil {
+		conf = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	conf = conf.Clone()
+	conf.MinVersion = tls.VersionTLS13
+	conf.NextProtos = []string{QUICProtocol}
+
+	return &QUICPinger{tls: conf, timeout: timeout, auth: auth, conns: make(map[string]*quic.Conn)}
+}
+
+// Transport implements the Pinger interface.
+func (p *QUICPinger) Transport() string {
+	return QUICTransport
+}
+
+// Ping implements the Pinger interface.
+func (p *QUICPinger) Ping(ctx context.Context, addr string, msg *ping.Packet) (reply *ping.Packet, latency time.Duration, err error) {
+	err = p.Stream(ctx, addr, []*ping.Packet{msg}, func(r *ping.Packet, l time.Duration) {
+		reply, latency = r, l
+	})
+	return reply, latency, err
+}
+
+// Stream implements the Pinger interface, sending the pings on one stream.
+func (p *QUICPinger) Stream(ctx context.Context, addr string, msgs []*ping.Packet, recv func(*ping.Packet, time.Duration)) error {
+	conn, err := p.conn(ctx, addr)
+	if err != nil {
+		return err
+	}
+
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		p.remove(addr, conn)
+		return fmt.Errorf("could not open ping stream to %s: %s", addr, err)
+	}
+	defer stream.Close()
+
+	// Unblock the stream if the context is canceled
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			stream.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	r := bufio.NewReader(stream)
+	for _, msg := range msgs {
+		start := time.Now()
+		msg.Sent = start.UnixNano()
+		p.auth.Sign(msg)
+
+		if ctx.Err() != nil {
+			return fmt.Errorf("could not send ping to %s: %s", addr, ctx.Err())
+		}
+
+		stream.SetDeadline(start.Add(p.timeout))
+		if err = writeFrame(stream, msg); err != nil {
+			p.remove(addr, conn)
+			return fmt.Errorf("could not send ping to %s: %s", addr, err)
+		}
+
+		reply := new(ping.Packet)
+		if err = readFrame(r, reply); err != nil {
+			p.remove(addr, conn)
+			return fmt.Errorf("could not receive ping from %s: %s", addr, err)
+		}
+
+		recv(reply, time.Since(start))
+	}
+
+	return nil
+}
+
+// Close implements the Pinger interface, closing the connections to the echo
+// servers.
+func (p *QUICPinger) Close() error {
+	p.Lock()
+	defer p.Unlock()
+
+	for addr, conn := range p.conns {
+		conn.CloseWithError(0, "")
+		delete(p.conns, addr)
+	}
+	return nil
+}
+
+// Returns the open connection to the echo server at addr, connecting to it if
+// there is no connection or if the connection has been closed.
+func (p *QUICPinger) conn(ctx context.Context, addr string) (*quic.Conn, error) {
+	p.Lock()
+	conn, ok := p.conns[addr]
+	p.Unlock()
+
+	if ok && conn.Context().Err() == nil {
+		return conn, nil
+	}
+
+	dctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	conn, err := quic.DialAddr(dctx, addr, p.tls, &quic.Config{MaxIdleTimeout: QUICIdleTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to '%s': %s", addr, err)
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	// Keep the connection that was opened first if pings raced to connect
+	if other, ok := p.conns[addr]; ok && other.Context().Err() == nil {
+		conn.CloseWithError(0, "")
+		return other, nil
+	}
+
+	p.conns[addr] = conn
+	return conn, nil
+}
+
+// Closes the connection to the echo server at addr after it failed, so that
+// the next ping reconnects.
+func (p *QUICPinger) remove(addr string, conn *quic.Conn) {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.conns[addr] == conn {
+		delete(p.conns, addr)
+	}
+	conn.CloseWithError(0, "")
+}
+
+//===========================================================================
+// Helpers
+//===========================================================================
+
+// Writes the packet prefixed by the varint encoded length of the packet.
+func writeFrame(w io.Writer, msg proto.Message) error {
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(data))
+	buf = append(buf[:binary.PutUvarint(buf, uint64(len(data)))], data...)
+	_, err = w.Write(buf)
+	return err
+}
+
+// Reads a packet written by writeFrame, returning io.EOF if the stream was
+// closed before the packet.
+func readFrame(r *bufio.Reader, msg proto.Message) error {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return err
+	}
+
+	// Pings are never larger than the maximum gRPC message
+	if size > MaxPingSize+64*1024 {
+		return errors.New("ping is too large")
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+	return proto.Unmarshal(data, msg)
+}
+
+// Returns a TLS configuration with a self-signed certificate for the name.
+func selfSignedTLS(name string) (*tls.Config, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{cert}, PrivateKey: key}},
+	}, nil
+}
@@ -0,0 +1,217 @@
+package net
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bbengfort/kekahu/ping"
+	"golang.org/x/net/context"
+)
+
+// Transports that pings can be sent and received with.
+const (
+	GRPCTransport = "grpc" // the gRPC echo service, secured with mutual TLS if configured
+	UDPTransport  = "udp"  // raw ping packets in UDP datagrams, lower overhead but insecure
+	QUICTransport = "quic" // ping packets on QUIC streams, encrypted without the overhead of HTTP/2
+)
+
+// Transports returns the names of the supported ping transports.
+func Transports() []string {
+	return []string{GRPCTransport, UDPTransport, QUICTransport}
+}
+
+// ParseTransports parses a comma separated list of ping transports, ignoring
+// duplicates. An error is returned if a transport is not supported.
+func ParseTransports(s string) ([]string, error) {
+	transports := make([]string, 0, 3)
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(s, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" || seen[name] {
+			continue
+		}
+
+		if !IsTransport(name) {
+			return nil, fmt.Errorf("unknown ping transport '%s', must be one of %s", name, strings.Join(Transports(), ", "))
+		}
+
+		seen[name] = true
+		transports = append(transports, name)
+	}
+	return transports, nil
+}
+
+// IsTransport returns true if the name is a supported ping transport.
+func IsTransport(name string) bool {
+	for _, transport := range Transports() {
+		if name == transport {
+			return true
+		}
+	}
+	return false
+}
+
+//===========================================================================
+// Pinger Interface
+//===========================================================================
+
+// Pinger sends ping packets to echo servers over a specific transport and
+// measures the round trip latency of each one. The Sent timestamp of each
+// packet is set by the pinger immediately before it is sent so that the
+// latency does not include connecting to the echo server. Pingers must be
+// safe to use from multiple go routines.
+type Pinger interface {
+	// Transport returns the name of the transport, e.g. grpc, udp, or quic.
+	Transport() string
+
+	// Ping sends the packet to the echo server at addr and returns the reply
+	// and the latency of the round trip.
+	Ping(ctx context.Context, addr string, msg *ping.Packet) (*ping.Packet, time.Duration, error)
+
+	// Stream sends the packets to the echo server at addr one at a time,
+	// waiting for the reply to each before the next is sent, and calls recv
+	// with each reply in order. An error is returned if the stream fails, in
+	// which case recv is not called for the remaining packets.
+	Stream(ctx context.Context, addr string, msgs []*ping.Packet, recv func(*ping.Packet, time.Duration)) error
+
+	// Close any connections to the echo servers.
+	Close() error
+}
+
+// NewPinger returns the pinger for the transport. gRPC pings reuse the
+// connections in the pool, QUIC pings are secured with the TLS configuration
+// (the server is not verified if it is nil), all pings time out after the
+// timeout, and pings are signed with the cluster secret of auth if it has one
+// (auth may be nil).
+func NewPinger(transport string, pool *ConnPool, tlsConf *tls.Config, timeout time.Duration, auth *PingAuth) (Pinger, error) {
+	switch strings.ToLower(transport) {
+	case GRPCTransport, "":
+		return NewGRPCPinger(pool, timeout, auth), nil
+	case UDPTransport:
+		return &UDPPinger{timeout: timeout, auth: auth}, nil
+	case QUICTransport:
+		return NewQUICPinger(tlsConf, timeout, auth), nil
+	default:
+		return nil, fmt.Errorf("unknown ping transport '%s'", transport)
+	}
+}
+
+//===========================================================================
+// gRPC Pinger
+//===========================================================================
+
+// GRPCPinger sends pings with the gRPC echo service, reusing connections to
+// the echo servers from the pool.
+type GRPCPinger struct {
+	pool    *ConnPool     // reusable connections to the echo servers
+	timeout time.Duration // timeout to connect and for each ping
+	auth    *PingAuth     // signs the pings with the cluster secret
+	proxy   *PingProxy    // the proxy the pool connects through, nil if direct
+}
+
+// NewGRPCPinger returns a pinger that sends pings with the connections of the
+// pool, timing out after the timeout and signed with the cluster secret of
+// auth if it has one (auth may be nil).
+func NewGRPCPinger(pool *ConnPool, timeout time.Duration, auth *PingAuth) *GRPCPinger {
+	return &GRPCPinger{pool: pool, timeout: timeout, auth: auth}
+}
+
+// Transport implements the Pinger interface, e.g. grpc+socks5 if the pings are
+// sent through a proxy.
+func (p *GRPCPinger) Transport() string {
+	if p.proxy != nil {
+		return p.proxy.Transport()
+	}
+	return GRPCTransport
+}
+
+// Ping implements the Pinger interface with the unary RPC so that echo servers
+// that don't implement streams can still be measured.
+func (p *GRPCPinger) Ping(ctx context.Context, addr string, msg *ping.Packet) (*ping.Packet, time.Duration, error) {
+	client, err := p.pool.Get(ctx, addr, p.timeout)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	start := time.Now()
+	msg.Sent = start.UnixNano()
+	p.auth.Sign(msg)
+	reply, err := client.Ping(ctx, msg)
+	if err != nil {
+		p.pool.Remove(addr)
+		return nil, 0, fmt.Errorf("could not send ping to %s: %s", addr, err)
+	}
+
+	return reply, time.Since(start), nil
+}
+
+// Stream implements the Pinger interface over a single bidirectional stream
+// so that the latency of every ping is measured without the overhead of a
+// new RPC. The stream must complete all pings within the timeout for each.
+func (p *GRPCPinger) Stream(ctx context.Context, addr string, msgs []*ping.Packet, recv func(*ping.Packet, time.Duration)) error {
+	client, err := p.pool.Get(ctx, addr, p.timeout)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.timeout*time.Duration(len(msgs)))
+	defer cancel()
+
+	stream, err := client.Stream(ctx)
+	if err != nil {
+		p.pool.Remove(addr)
+		return fmt.Errorf("could not open ping stream to %s: %s", addr, err)
+	}
+	defer stream.CloseSend()
+
+	for _, msg := range msgs {
+		start := time.Now()
+		msg.Sent = start.UnixNano()
+		p.auth.Sign(msg)
+		if err = stream.Send(msg); err != nil {
+			p.pool.Remove(addr)
+			return fmt.Errorf("could not send ping to %s: %s", addr, err)
+		}
+
+		reply, err := stream.Recv()
+		if err != nil {
+			p.pool.Remove(addr)
+			return fmt.Errorf("could not receive ping from %s: %s", addr, err)
+		}
+
+		recv(reply, time.Since(start))
+	}
+
+	return nil
+}
+
+// Health requests the system health of the echo server at addr with the
+// packet, which is signed like a ping so that echo servers that require
+// authentication reply to it.
+func (p *GRPCPinger) Health(ctx context.Context, addr string, msg *ping.Packet) (*ping.HealthReply, error) {
+	client, err := p.pool.Get(ctx, addr, p.timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	msg.Sent = time.Now().UnixNano()
+	p.auth.Sign(msg)
+	reply, err := client.Health(ctx, msg)
+	if err != nil {
+		return nil, fmt.Errorf("could not request health from %s: %s", addr, err)
+	}
+	return reply, nil
+}
+
+// Close implements the Pinger interface, closing the connections in the pool.
+func (p *GRPCPinger) Close() error {
+	return p.pool.Close()
+}
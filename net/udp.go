@@ -0,0 +1,211 @@
+package net
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/bbengfort/kekahu/ping"
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+)
+
+// MaxDatagramSize is the largest UDP ping packet that is sent or read, the
+// largest UDP payload over IPv4. Ping packets are only a few dozen bytes unless
+// they carry a payload to measure the latency of larger messages.
+const MaxDatagramSize = 65507
+
+// MaxUDPPingSize is the largest payload of a UDP ping, which leaves room in the
+// datagram for the other fields of the packet and the gossiped latencies.
+const MaxUDPPingSize = MaxDatagramSize - 1024
+
+//===========================================================================
+// UDP Echo Server
+//===========================================================================
+
+// Listens for ping packets in UDP datagrams on the address of the server and
+// replies to each one as quickly as possible. Each datagram contains a single
+// protocol buffer encoded ping.Packet, so the UDP echo server doesn't have the
+// overhead of HTTP/2 framing, but it also isn't secured with TLS.
+func (s *Server) runUDP(echan chan<- error) error {
+	conn, err := s.listenPackets()
+	if err != nil {
+		return err
+	}
+
+	serverLog.status("listening for udp pings on %s", s.addr)
+	if s.Creds != nil {
+		serverLog.warn("udp pings are not secured with tls")
+	}
+
+	stopped := s.stopped
+	s.closers = append(s.closers, func() { conn.Close() })
+
+	go func() {
+		defer conn.Close()
+		buf := make([]byte, MaxDatagramSize)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				select {
+				case <-stopped:
+				default:
+					echan <- serverLog.wrap(fmt.Errorf("could not read udp ping: %s", err))
+				}
+				return
+			}
+
+			in := new(ping.Packet)
+			if err := proto.Unmarshal(buf[:n], in); err != nil {
+				serverLog.debug("ignoring invalid udp ping from %s: %s", addr, err)
+				continue
+			}
+
+			// Unauthenticated pings are dropped without a reply
+			if err := s.authenticate(in); err != nil {
+				continue
+			}
+
+			reply := s.echo(in)
+			data, err := proto.Marshal(reply)
+
+			// Gossip that does not fit in a datagram is left out of the reply
+			if err == nil && len(data) > MaxDatagramSize && len(reply.Latencies) > 0 {
+				reply.Latencies = nil
+				data, err = proto.Marshal(reply)
+			}
+
+			if err != nil {
+				echan <- serverLog.wrap(fmt.Errorf("could not encode udp ping reply: %s", err))
+				continue
+			}
+
+			if _, err := conn.WriteTo(data, addr); err != nil {
+				echan <- serverLog.wrap(fmt.Errorf("could not reply to udp ping from %s: %s", addr, err))
+			}
+		}
+	}()
+
+	return nil
+}
+
+// The socket that UDP pings are read from and replied to.
+type datagramConn interface {
+	ReadFrom(b []byte) (int, net.Addr, error)
+	WriteTo(b []byte, addr net.Addr) (int, error)
+	Close() error
+}
+
+// Returns the socket of the UDP echo server. If the server also listens for
+// QUIC pings, which use the same port, the UDP pings are read from the QUIC
+// transport that owns the socket.
+func (s *Server) listenPackets() (datagramConn, error) {
+	for _, transport := range s.Transports {
+		if transport == QUICTransport {
+			tr, err := s.quicTransport()
+			if err != nil {
+				return nil, err
+			}
+			return nonQUICConn{tr}, nil
+		}
+	}
+
+	conn, err := net.ListenPacket("udp", s.addr)
+	if err != nil {
+		return nil, fmt.Errorf("could not listen on udp '%s': %s", s.addr, err)
+	}
+	return conn, nil
+}
+
+//===========================================================================
+// UDP Pinger
+//===========================================================================
+
+// UDPPinger sends pings as UDP datagrams to the UDP echo server. There is no
+// handshake, so each ping opens its own socket, and a ping times out if the
+// datagram or its reply is lost. Replies to earlier pings that timed out are
+// ignored by checking the sequence number of the reply.
+type UDPPinger struct {
+	timeout time.Duration // timeout for each ping
+	auth    *PingAuth     // signs the pings with the cluster secret
+}
+
+// Transport implements the Pinger interface.
+func (p *UDPPinger) Transport() string {
+	return UDPTransport
+}
+
+// Ping implements the Pinger interface.
+func (p *UDPPinger) Ping(ctx context.Context, addr string, msg *ping.Packet) (reply *ping.Packet, latency time.Duration, err error) {
+	err = p.Stream(ctx, addr, []*ping.Packet{msg}, func(r *ping.Packet, l time.Duration) {
+		reply, latency = r, l
+	})
+	return reply, latency, err
+}
+
+// Stream implements the Pinger interface, sending the pings from one socket.
+func (p *UDPPinger) Stream(ctx context.Context, addr string, msgs []*ping.Packet, recv func(*ping.Packet, time.Duration)) error {
+	dialer := new(net.Dialer)
+	conn, err := dialer.DialContext(ctx, "udp", addr)
+	if err != nil {
+		return fmt.Errorf("could not connect to '%s': %s", addr, err)
+	}
+	defer conn.Close()
+
+	// Unblock the socket if the context is canceled
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	buf := make([]byte, MaxDatagramSize)
+	for _, msg := range msgs {
+		start := time.Now()
+		msg.Sent = start.UnixNano()
+		p.auth.Sign(msg)
+		data, err := proto.Marshal(msg)
+		if err != nil {
+			return fmt.Errorf("could not encode ping to %s: %s", addr, err)
+		}
+
+		if len(data) > MaxDatagramSize {
+			return fmt.Errorf("ping to %s is too large for a udp datagram (%d bytes)", addr, len(data))
+		}
+
+		if ctx.Err() != nil {
+			return fmt.Errorf("could not send ping to %s: %s", addr, ctx.Err())
+		}
+
+		conn.SetDeadline(start.Add(p.timeout))
+		if _, err = conn.Write(data); err != nil {
+			return fmt.Errorf("could not send ping to %s: %s", addr, err)
+		}
+
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return fmt.Errorf("could not receive ping from %s: %s", addr, err)
+			}
+
+			reply := new(ping.Packet)
+			if err := proto.Unmarshal(buf[:n], reply); err != nil || reply.Sequence != msg.Sequence {
+				continue
+			}
+
+			recv(reply, time.Since(start))
+			break
+		}
+	}
+
+	return nil
+}
+
+// Close implements the Pinger interface, UDP pings have no open connections.
+func (p *UDPPinger) Close() error {
+	return nil
+}
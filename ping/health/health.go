@@ -0,0 +1,333 @@
+/*
+Package health implements the standard gRPC health checking protocol
+(grpc.health.v1.Health) so that external tooling such as grpcurl, load
+balancers, and Kubernetes probes can check whether the kekahu echo server is
+alive without crafting a ping.Packet message.
+
+The messages and service description are wire compatible with health.proto;
+they are maintained by hand because the grpc health package is not vendored.
+*/
+package health
+
+import (
+	"bytes"
+	"compress/gzip"
+
+	proto "github.com/golang/protobuf/proto"
+	descriptor "github.com/golang/protobuf/protoc-gen-go/descriptor"
+	context "golang.org/x/net/context"
+	grpc "google.golang.org/grpc"
+)
+
+// ServiceName is the fully qualified name of the health checking service.
+const ServiceName = "grpc.health.v1.Health"
+
+// FileName is the name the health.proto descriptor is registered under.
+const FileName = "grpc/health/v1/health.proto"
+
+//===========================================================================
+// Messages
+//===========================================================================
+
+// HealthCheckResponse_ServingStatus is the status of a service.
+type HealthCheckResponse_ServingStatus int32
+
+// Serving statuses, SERVICE_UNKNOWN is only used by the Watch method.
+const (
+	HealthCheckResponse_UNKNOWN         HealthCheckResponse_ServingStatus = 0
+	HealthCheckResponse_SERVING         HealthCheckResponse_ServingStatus = 1
+	HealthCheckResponse_NOT_SERVING     HealthCheckResponse_ServingStatus = 2
+	HealthCheckResponse_SERVICE_UNKNOWN HealthCheckResponse_ServingStatus = 3
+)
+
+var HealthCheckResponse_ServingStatus_name = map[int32]string{
+	0: "UNKNOWN",
+	1: "SERVING",
+	2: "NOT_SERVING",
+	3: "SERVICE_UNKNOWN",
+}
+
+var HealthCheckResponse_ServingStatus_value = map[string]int32{
+	"UNKNOWN":         0,
+	"SERVING":         1,
+	"NOT_SERVING":     2,
+	"SERVICE_UNKNOWN": 3,
+}
+
+func (x HealthCheckResponse_ServingStatus) String() string {
+	return proto.EnumName(HealthCheckResponse_ServingStatus_name, int32(x))
+}
+
+func (HealthCheckResponse_ServingStatus) EnumDescriptor() ([]byte, []int) {
+	return fileDescriptor, []int{1, 0}
+}
+
+// HealthCheckRequest names the service to check, the server overall if empty.
+type HealthCheckRequest struct {
+	Service string `protobuf:"bytes,1,opt,name=service" json:"service,omitempty"`
+}
+
+func (m *HealthCheckRequest) Reset()                    { *m = HealthCheckRequest{} }
+func (m *HealthCheckRequest) String() string            { return proto.CompactTextString(m) }
+func (*HealthCheckRequest) ProtoMessage()               {}
+func (*HealthCheckRequest) Descriptor() ([]byte, []int) { return fileDescriptor, []int{0} }
+
+func (m *HealthCheckRequest) GetService() string {
+	if m != nil {
+		return m.Service
+	}
+	return ""
+}
+
+// HealthCheckResponse reports the serving status of the service.
+type HealthCheckResponse struct {
+	Status HealthCheckResponse_ServingStatus `protobuf:"varint,1,opt,name=status,enum=grpc.health.v1.HealthCheckResponse_ServingStatus" json:"status,omitempty"`
+}
+
+func (m *HealthCheckResponse) Reset()                    { *m = HealthCheckResponse{} }
+func (m *HealthCheckResponse) String() string            { return proto.CompactTextString(m) }
+func (*HealthCheckResponse) ProtoMessage()               {}
+func (*HealthCheckResponse) Descriptor() ([]byte, []int) { return fileDescriptor, []int{1} }
+
+func (m *HealthCheckResponse) GetStatus() HealthCheckResponse_ServingStatus {
+	if m != nil {
+		return m.Status
+	}
+	return HealthCheckResponse_UNKNOWN
+}
+
+func init() {
+	proto.RegisterType((*HealthCheckRequest)(nil), "grpc.health.v1.HealthCheckRequest")
+	proto.RegisterType((*HealthCheckResponse)(nil), "grpc.health.v1.HealthCheckResponse")
+	proto.RegisterEnum("grpc.health.v1.HealthCheckResponse_ServingStatus", HealthCheckResponse_ServingStatus_name, HealthCheckResponse_ServingStatus_value)
+}
+
+//===========================================================================
+// Health Service
+//===========================================================================
+
+// HealthClient is the client API for the Health service.
+type HealthClient interface {
+	Check(ctx context.Context, in *HealthCheckRequest, opts ...grpc.CallOption) (*HealthCheckResponse, error)
+	Watch(ctx context.Context, in *HealthCheckRequest, opts ...grpc.CallOption) (Health_WatchClient, error)
+}
+
+type healthClient struct {
+	cc *grpc.ClientConn
+}
+
+// NewHealthClient returns a client of the Health service on the connection.
+func NewHealthClient(cc *grpc.ClientConn) HealthClient {
+	return &healthClient{cc}
+}
+
+func (c *healthClient) Check(ctx context.Context, in *HealthCheckRequest, opts ...grpc.CallOption) (*HealthCheckResponse, error) {
+	out := new(HealthCheckResponse)
+	err := grpc.Invoke(ctx, "/grpc.health.v1.Health/Check", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *healthClient) Watch(ctx context.Context, in *HealthCheckRequest, opts ...grpc.CallOption) (Health_WatchClient, error) {
+	stream, err := grpc.NewClientStream(ctx, &_Health_serviceDesc.Streams[0], c.cc, "/grpc.health.v1.Health/Watch", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &healthWatchClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Health_WatchClient interface {
+	Recv() (*HealthCheckResponse, error)
+	grpc.ClientStream
+}
+
+type healthWatchClient struct {
+	grpc.ClientStream
+}
+
+func (x *healthWatchClient) Recv() (*HealthCheckResponse, error) {
+	m := new(HealthCheckResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// HealthServer is the server API for the Health service.
+type HealthServer interface {
+	Check(context.Context, *HealthCheckRequest) (*HealthCheckResponse, error)
+	Watch(*HealthCheckRequest, Health_WatchServer) error
+}
+
+// RegisterHealthServer registers the Health service on the gRPC server.
+func RegisterHealthServer(s *grpc.Server, srv HealthServer) {
+	s.RegisterService(&_Health_serviceDesc, srv)
+}
+
+func _Health_Check_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(HealthCheckRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(HealthServer).Check(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/grpc.health.v1.Health/Check",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(HealthServer).Check(ctx, req.(*HealthCheckRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Health_Watch_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(HealthCheckRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(HealthServer).Watch(m, &healthWatchServer{stream})
+}
+
+type Health_WatchServer interface {
+	Send(*HealthCheckResponse) error
+	grpc.ServerStream
+}
+
+type healthWatchServer struct {
+	grpc.ServerStream
+}
+
+func (x *healthWatchServer) Send(m *HealthCheckResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+var _Health_serviceDesc = grpc.ServiceDesc{
+	ServiceName: ServiceName,
+	HandlerType: (*HealthServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Check",
+			Handler:    _Health_Check_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Watch",
+			Handler:       _Health_Watch_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: FileName,
+}
+
+//===========================================================================
+// File Descriptor
+//===========================================================================
+
+// The gzipped FileDescriptorProto of health.proto, built from the definition
+// below and registered so that it can be served by server reflection.
+var fileDescriptor []byte
+
+func init() {
+	var err error
+	if fileDescriptor, err = compress(healthProto()); err != nil {
+		panic(err)
+	}
+	proto.RegisterFile(FileName, fileDescriptor)
+}
+
+// Returns the descriptor of health.proto.
+func healthProto() *descriptor.FileDescriptorProto {
+	optional := descriptor.FieldDescriptorProto_LABEL_OPTIONAL.Enum()
+	return &descriptor.FileDescriptorProto{
+		Name:    proto.String(FileName),
+		Package: proto.String("grpc.health.v1"),
+		Syntax:  proto.String("proto3"),
+		Options: &descriptor.FileOptions{GoPackage: proto.String("health")},
+		MessageType: []*descriptor.DescriptorProto{
+			{
+				Name: proto.String("HealthCheckRequest"),
+				Field: []*descriptor.FieldDescriptorProto{
+					{
+						Name:     proto.String("service"),
+						JsonName: proto.String("service"),
+						Number:   proto.Int32(1),
+						Label:    optional,
+						Type:     descriptor.FieldDescriptorProto_TYPE_STRING.Enum(),
+					},
+				},
+			},
+			{
+				Name: proto.String("HealthCheckResponse"),
+				Field: []*descriptor.FieldDescriptorProto{
+					{
+						Name:     proto.String("status"),
+						JsonName: proto.String("status"),
+						Number:   proto.Int32(1),
+						Label:    optional,
+						Type:     descriptor.FieldDescriptorProto_TYPE_ENUM.Enum(),
+						TypeName: proto.String(".grpc.health.v1.HealthCheckResponse.ServingStatus"),
+					},
+				},
+				EnumType: []*descriptor.EnumDescriptorProto{
+					{
+						Name: proto.String("ServingStatus"),
+						Value: []*descriptor.EnumValueDescriptorProto{
+							{Name: proto.String("UNKNOWN"), Number: proto.Int32(0)},
+							{Name: proto.String("SERVING"), Number: proto.Int32(1)},
+							{Name: proto.String("NOT_SERVING"), Number: proto.Int32(2)},
+							{Name: proto.String("SERVICE_UNKNOWN"), Number: proto.Int32(3)},
+						},
+					},
+				},
+			},
+		},
+		Service: []*descriptor.ServiceDescriptorProto{
+			{
+				Name: proto.String("Health"),
+				Method: []*descriptor.MethodDescriptorProto{
+					{
+						Name:       proto.String("Check"),
+						InputType:  proto.String(".grpc.health.v1.HealthCheckRequest"),
+						OutputType: proto.String(".grpc.health.v1.HealthCheckResponse"),
+					},
+					{
+						Name:            proto.String("Watch"),
+						InputType:       proto.String(".grpc.health.v1.HealthCheckRequest"),
+						OutputType:      proto.String(".grpc.health.v1.HealthCheckResponse"),
+						ServerStreaming: proto.Bool(true),
+					},
+				},
+			},
+		},
+	}
+}
+
+// Marshals and gzips the file descriptor as expected by proto.RegisterFile.
+func compress(fd *descriptor.FileDescriptorProto) ([]byte, error) {
+	data, err := proto.Marshal(fd)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := new(bytes.Buffer)
+	zw := gzip.NewWriter(buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
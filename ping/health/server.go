@@ -0,0 +1,135 @@
+package health
+
+import (
+	"sync"
+
+	context "golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Server implements HealthServer, reporting the serving status of each
+// registered service. The empty service name is the status of the server
+// overall and is SERVING when the server is created.
+type Server struct {
+	sync.Mutex
+	shutdown bool                                                       // if true, all statuses are NOT_SERVING
+	statuses map[string]HealthCheckResponse_ServingStatus               // status of each service
+	watchers map[string]map[chan HealthCheckResponse_ServingStatus]bool // streams watching each service
+}
+
+// NewServer returns a health server with the overall status SERVING.
+func NewServer() *Server {
+	return &Server{
+		statuses: map[string]HealthCheckResponse_ServingStatus{"": HealthCheckResponse_SERVING},
+		watchers: make(map[string]map[chan HealthCheckResponse_ServingStatus]bool),
+	}
+}
+
+// Check returns the serving status of the service or a NotFound error if the
+// service is not registered with the health server.
+func (s *Server) Check(ctx context.Context, in *HealthCheckRequest) (*HealthCheckResponse, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if current, ok := s.statuses[in.Service]; ok {
+		return &HealthCheckResponse{Status: current}, nil
+	}
+	return nil, status.Error(codes.NotFound, "unknown service")
+}
+
+// Watch sends the serving status of the service and then sends it again each
+// time it changes until the client closes the stream. SERVICE_UNKNOWN is sent
+// if the service is not registered with the health server.
+func (s *Server) Watch(in *HealthCheckRequest, stream Health_WatchServer) error {
+	// Buffer the latest status so that slow clients don't block updates
+	update := make(chan HealthCheckResponse_ServingStatus, 1)
+
+	s.Lock()
+	current, ok := s.statuses[in.Service]
+	if !ok {
+		current = HealthCheckResponse_SERVICE_UNKNOWN
+	}
+	update <- current
+
+	if _, ok := s.watchers[in.Service]; !ok {
+		s.watchers[in.Service] = make(map[chan HealthCheckResponse_ServingStatus]bool)
+	}
+	s.watchers[in.Service][update] = true
+	s.Unlock()
+
+	defer func() {
+		s.Lock()
+		delete(s.watchers[in.Service], update)
+		s.Unlock()
+	}()
+
+	var last HealthCheckResponse_ServingStatus = -1
+	for {
+		select {
+		case current := <-update:
+			if current == last {
+				continue
+			}
+
+			last = current
+			if err := stream.Send(&HealthCheckResponse{Status: current}); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return status.Error(codes.Canceled, "stream has ended")
+		}
+	}
+}
+
+// SetServingStatus of the service, the empty string sets the status of the
+// server overall. If the server is shut down, the status is recorded but
+// NOT_SERVING is reported until Resume is called.
+func (s *Server) SetServingStatus(service string, status HealthCheckResponse_ServingStatus) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.shutdown {
+		return
+	}
+	s.setServingStatus(service, status)
+}
+
+// Shutdown sets all statuses to NOT_SERVING and ignores future updates until
+// Resume is called, e.g. while the server is gracefully stopping.
+func (s *Server) Shutdown() {
+	s.Lock()
+	defer s.Unlock()
+
+	s.shutdown = true
+	for service := range s.statuses {
+		s.setServingStatus(service, HealthCheckResponse_NOT_SERVING)
+	}
+}
+
+// Resume sets all statuses to SERVING and allows future updates.
+func (s *Server) Resume() {
+	s.Lock()
+	defer s.Unlock()
+
+	s.shutdown = false
+	for service := range s.statuses {
+		s.setServingStatus(service, HealthCheckResponse_SERVING)
+	}
+}
+
+// Records the status and notifies the watchers of the service (not thread-safe).
+func (s *Server) setServingStatus(service string, status HealthCheckResponse_ServingStatus) {
+	s.statuses[service] = status
+	for update := range s.watchers[service] {
+		// Replace any status the watcher has not sent yet with the latest
+		select {
+		case <-update:
+		default:
+		}
+		update <- status
+	}
+}
+
+// Ensure the server implements the interface.
+var _ HealthServer = &Server{}
@@ -9,6 +9,10 @@ It is generated from these files:
 
 It has these top-level messages:
 	Packet
+	HealthReply
+	Chunk
+	ThroughputReply
+	LatencySummary
 */
 package ping
 
@@ -33,9 +37,16 @@ var _ = math.Inf
 const _ = proto.ProtoPackageIsVersion2 // please upgrade the proto package
 
 type Packet struct {
-	Source   string `protobuf:"bytes,1,opt,name=source" json:"source,omitempty"`
-	Target   string `protobuf:"bytes,2,opt,name=target" json:"target,omitempty"`
-	Sequence uint64 `protobuf:"varint,3,opt,name=sequence" json:"sequence,omitempty"`
+	Source    string            `protobuf:"bytes,1,opt,name=source" json:"source,omitempty"`
+	Target    string            `protobuf:"bytes,2,opt,name=target" json:"target,omitempty"`
+	Sequence  uint64            `protobuf:"varint,3,opt,name=sequence" json:"sequence,omitempty"`
+	Sent      int64             `protobuf:"varint,4,opt,name=sent" json:"sent,omitempty"`
+	Received  int64             `protobuf:"varint,5,opt,name=received" json:"received,omitempty"`
+	Replied   int64             `protobuf:"varint,6,opt,name=replied" json:"replied,omitempty"`
+	Signature []byte            `protobuf:"bytes,7,opt,name=signature,proto3" json:"signature,omitempty"`
+	Gossip    bool              `protobuf:"varint,8,opt,name=gossip" json:"gossip,omitempty"`
+	Latencies []*LatencySummary `protobuf:"bytes,9,rep,name=latencies" json:"latencies,omitempty"`
+	Payload   []byte            `protobuf:"bytes,10,opt,name=payload,proto3" json:"payload,omitempty"`
 }
 
 func (m *Packet) Reset()                    { *m = Packet{} }
@@ -64,8 +75,209 @@ func (m *Packet) GetSequence() uint64 {
 	return 0
 }
 
+func (m *Packet) GetSent() int64 {
+	if m != nil {
+		return m.Sent
+	}
+	return 0
+}
+
+func (m *Packet) GetReceived() int64 {
+	if m != nil {
+		return m.Received
+	}
+	return 0
+}
+
+func (m *Packet) GetReplied() int64 {
+	if m != nil {
+		return m.Replied
+	}
+	return 0
+}
+
+func (m *Packet) GetSignature() []byte {
+	if m != nil {
+		return m.Signature
+	}
+	return nil
+}
+
+func (m *Packet) GetGossip() bool {
+	if m != nil {
+		return m.Gossip
+	}
+	return false
+}
+
+func (m *Packet) GetLatencies() []*LatencySummary {
+	if m != nil {
+		return m.Latencies
+	}
+	return nil
+}
+
+func (m *Packet) GetPayload() []byte {
+	if m != nil {
+		return m.Payload
+	}
+	return nil
+}
+
+// The system health of the echo server, requested with a signed packet
+type HealthReply struct {
+	Source string `protobuf:"bytes,1,opt,name=source" json:"source,omitempty"`
+	Status []byte `protobuf:"bytes,2,opt,name=status,proto3" json:"status,omitempty"`
+}
+
+func (m *HealthReply) Reset()                    { *m = HealthReply{} }
+func (m *HealthReply) String() string            { return proto.CompactTextString(m) }
+func (*HealthReply) ProtoMessage()               {}
+func (*HealthReply) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{1} }
+
+func (m *HealthReply) GetSource() string {
+	if m != nil {
+		return m.Source
+	}
+	return ""
+}
+
+func (m *HealthReply) GetStatus() []byte {
+	if m != nil {
+		return m.Status
+	}
+	return nil
+}
+
+// Data streamed to the echo server to measure throughput, the first chunk of
+// the stream has a signed header that authenticates it like a ping
+type Chunk struct {
+	Header *Packet `protobuf:"bytes,1,opt,name=header" json:"header,omitempty"`
+	Data   []byte  `protobuf:"bytes,2,opt,name=data,proto3" json:"data,omitempty"`
+}
+
+func (m *Chunk) Reset()                    { *m = Chunk{} }
+func (m *Chunk) String() string            { return proto.CompactTextString(m) }
+func (*Chunk) ProtoMessage()               {}
+func (*Chunk) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{2} }
+
+func (m *Chunk) GetHeader() *Packet {
+	if m != nil {
+		return m.Header
+	}
+	return nil
+}
+
+func (m *Chunk) GetData() []byte {
+	if m != nil {
+		return m.Data
+	}
+	return nil
+}
+
+// The number of bytes the echo server received on a throughput stream
+type ThroughputReply struct {
+	Source   string `protobuf:"bytes,1,opt,name=source" json:"source,omitempty"`
+	Bytes    uint64 `protobuf:"varint,2,opt,name=bytes" json:"bytes,omitempty"`
+	Received int64  `protobuf:"varint,3,opt,name=received" json:"received,omitempty"`
+	Replied  int64  `protobuf:"varint,4,opt,name=replied" json:"replied,omitempty"`
+}
+
+func (m *ThroughputReply) Reset()                    { *m = ThroughputReply{} }
+func (m *ThroughputReply) String() string            { return proto.CompactTextString(m) }
+func (*ThroughputReply) ProtoMessage()               {}
+func (*ThroughputReply) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{3} }
+
+func (m *ThroughputReply) GetSource() string {
+	if m != nil {
+		return m.Source
+	}
+	return ""
+}
+
+func (m *ThroughputReply) GetBytes() uint64 {
+	if m != nil {
+		return m.Bytes
+	}
+	return 0
+}
+
+func (m *ThroughputReply) GetReceived() int64 {
+	if m != nil {
+		return m.Received
+	}
+	return 0
+}
+
+func (m *ThroughputReply) GetReplied() int64 {
+	if m != nil {
+		return m.Replied
+	}
+	return 0
+}
+
+type LatencySummary struct {
+	Target  string  `protobuf:"bytes,1,opt,name=target" json:"target,omitempty"`
+	Samples uint64  `protobuf:"varint,2,opt,name=samples" json:"samples,omitempty"`
+	Mean    int64   `protobuf:"varint,3,opt,name=mean" json:"mean,omitempty"`
+	P50     int64   `protobuf:"varint,4,opt,name=p50" json:"p50,omitempty"`
+	P99     int64   `protobuf:"varint,5,opt,name=p99" json:"p99,omitempty"`
+	Loss    float64 `protobuf:"fixed64,6,opt,name=loss" json:"loss,omitempty"`
+}
+
+func (m *LatencySummary) Reset()                    { *m = LatencySummary{} }
+func (m *LatencySummary) String() string            { return proto.CompactTextString(m) }
+func (*LatencySummary) ProtoMessage()               {}
+func (*LatencySummary) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{4} }
+
+func (m *LatencySummary) GetTarget() string {
+	if m != nil {
+		return m.Target
+	}
+	return ""
+}
+
+func (m *LatencySummary) GetSamples() uint64 {
+	if m != nil {
+		return m.Samples
+	}
+	return 0
+}
+
+func (m *LatencySummary) GetMean() int64 {
+	if m != nil {
+		return m.Mean
+	}
+	return 0
+}
+
+func (m *LatencySummary) GetP50() int64 {
+	if m != nil {
+		return m.P50
+	}
+	return 0
+}
+
+func (m *LatencySummary) GetP99() int64 {
+	if m != nil {
+		return m.P99
+	}
+	return 0
+}
+
+func (m *LatencySummary) GetLoss() float64 {
+	if m != nil {
+		return m.Loss
+	}
+	return 0
+}
+
 func init() {
 	proto.RegisterType((*Packet)(nil), "ping.Packet")
+	proto.RegisterType((*HealthReply)(nil), "ping.HealthReply")
+	proto.RegisterType((*Chunk)(nil), "ping.Chunk")
+	proto.RegisterType((*ThroughputReply)(nil), "ping.ThroughputReply")
+	proto.RegisterType((*LatencySummary)(nil), "ping.LatencySummary")
 }
 
 // Reference imports to suppress errors if they are not otherwise used.
@@ -80,6 +292,9 @@ const _ = grpc.SupportPackageIsVersion4
 
 type EchoClient interface {
 	Ping(ctx context.Context, in *Packet, opts ...grpc.CallOption) (*Packet, error)
+	Stream(ctx context.Context, opts ...grpc.CallOption) (Echo_StreamClient, error)
+	Health(ctx context.Context, in *Packet, opts ...grpc.CallOption) (*HealthReply, error)
+	Throughput(ctx context.Context, opts ...grpc.CallOption) (Echo_ThroughputClient, error)
 }
 
 type echoClient struct {
@@ -99,10 +314,87 @@ func (c *echoClient) Ping(ctx context.Context, in *Packet, opts ...grpc.CallOpti
 	return out, nil
 }
 
+func (c *echoClient) Stream(ctx context.Context, opts ...grpc.CallOption) (Echo_StreamClient, error) {
+	stream, err := grpc.NewClientStream(ctx, &_Echo_serviceDesc.Streams[0], c.cc, "/ping.Echo/Stream", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &echoStreamClient{stream}
+	return x, nil
+}
+
+type Echo_StreamClient interface {
+	Send(*Packet) error
+	Recv() (*Packet, error)
+	grpc.ClientStream
+}
+
+type echoStreamClient struct {
+	grpc.ClientStream
+}
+
+func (x *echoStreamClient) Send(m *Packet) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *echoStreamClient) Recv() (*Packet, error) {
+	m := new(Packet)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *echoClient) Health(ctx context.Context, in *Packet, opts ...grpc.CallOption) (*HealthReply, error) {
+	out := new(HealthReply)
+	err := grpc.Invoke(ctx, "/ping.Echo/Health", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *echoClient) Throughput(ctx context.Context, opts ...grpc.CallOption) (Echo_ThroughputClient, error) {
+	stream, err := grpc.NewClientStream(ctx, &_Echo_serviceDesc.Streams[1], c.cc, "/ping.Echo/Throughput", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &echoThroughputClient{stream}
+	return x, nil
+}
+
+type Echo_ThroughputClient interface {
+	Send(*Chunk) error
+	CloseAndRecv() (*ThroughputReply, error)
+	grpc.ClientStream
+}
+
+type echoThroughputClient struct {
+	grpc.ClientStream
+}
+
+func (x *echoThroughputClient) Send(m *Chunk) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *echoThroughputClient) CloseAndRecv() (*ThroughputReply, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(ThroughputReply)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 // Server API for Echo service
 
 type EchoServer interface {
 	Ping(context.Context, *Packet) (*Packet, error)
+	Stream(Echo_StreamServer) error
+	Health(context.Context, *Packet) (*HealthReply, error)
+	Throughput(Echo_ThroughputServer) error
 }
 
 func RegisterEchoServer(s *grpc.Server, srv EchoServer) {
@@ -127,6 +419,76 @@ func _Echo_Ping_Handler(srv interface{}, ctx context.Context, dec func(interface
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Echo_Stream_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(EchoServer).Stream(&echoStreamServer{stream})
+}
+
+type Echo_StreamServer interface {
+	Send(*Packet) error
+	Recv() (*Packet, error)
+	grpc.ServerStream
+}
+
+type echoStreamServer struct {
+	grpc.ServerStream
+}
+
+func (x *echoStreamServer) Send(m *Packet) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *echoStreamServer) Recv() (*Packet, error) {
+	m := new(Packet)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _Echo_Health_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Packet)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(EchoServer).Health(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/ping.Echo/Health",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(EchoServer).Health(ctx, req.(*Packet))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Echo_Throughput_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(EchoServer).Throughput(&echoThroughputServer{stream})
+}
+
+type Echo_ThroughputServer interface {
+	SendAndClose(*ThroughputReply) error
+	Recv() (*Chunk, error)
+	grpc.ServerStream
+}
+
+type echoThroughputServer struct {
+	grpc.ServerStream
+}
+
+func (x *echoThroughputServer) SendAndClose(m *ThroughputReply) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *echoThroughputServer) Recv() (*Chunk, error) {
+	m := new(Chunk)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 var _Echo_serviceDesc = grpc.ServiceDesc{
 	ServiceName: "ping.Echo",
 	HandlerType: (*EchoServer)(nil),
@@ -135,22 +497,58 @@ var _Echo_serviceDesc = grpc.ServiceDesc{
 			MethodName: "Ping",
 			Handler:    _Echo_Ping_Handler,
 		},
+		{
+			MethodName: "Health",
+			Handler:    _Echo_Health_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Stream",
+			Handler:       _Echo_Stream_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "Throughput",
+			Handler:       _Echo_Throughput_Handler,
+			ClientStreams: true,
+		},
 	},
-	Streams:  []grpc.StreamDesc{},
 	Metadata: "ping.proto",
 }
 
 func init() { proto.RegisterFile("ping.proto", fileDescriptor0) }
 
 var fileDescriptor0 = []byte{
-	// 136 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xe2, 0xe2, 0x2a, 0xc8, 0xcc, 0x4b,
-	0xd7, 0x2b, 0x28, 0xca, 0x2f, 0xc9, 0x17, 0x62, 0x01, 0xb1, 0x95, 0x42, 0xb8, 0xd8, 0x02, 0x12,
-	0x93, 0xb3, 0x53, 0x4b, 0x84, 0xc4, 0xb8, 0xd8, 0x8a, 0xf3, 0x4b, 0x8b, 0x92, 0x53, 0x25, 0x18,
-	0x15, 0x18, 0x35, 0x38, 0x83, 0xa0, 0x3c, 0x90, 0x78, 0x49, 0x62, 0x51, 0x7a, 0x6a, 0x89, 0x04,
-	0x13, 0x44, 0x1c, 0xc2, 0x13, 0x92, 0xe2, 0xe2, 0x28, 0x4e, 0x2d, 0x2c, 0x4d, 0xcd, 0x4b, 0x4e,
-	0x95, 0x60, 0x56, 0x60, 0xd4, 0x60, 0x09, 0x82, 0xf3, 0x8d, 0x74, 0xb8, 0x58, 0x5c, 0x93, 0x33,
-	0xf2, 0x85, 0x54, 0xb8, 0x58, 0x02, 0x32, 0xf3, 0xd2, 0x85, 0x78, 0xf4, 0xc0, 0x16, 0x43, 0x6c,
-	0x92, 0x42, 0xe1, 0x29, 0x31, 0x24, 0xb1, 0x81, 0x1d, 0x64, 0x0c, 0x08, 0x00, 0x00, 0xff, 0xff,
-	0xf5, 0x31, 0x54, 0xa6, 0x9e, 0x00, 0x00, 0x00,
+	// 457 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x7c, 0x93, 0xcd, 0x6a, 0xdb, 0x40,
+	0x10, 0xc7, 0xb3, 0xb1, 0x2c, 0xdb, 0x63, 0xd3, 0x8f, 0x25, 0x2d, 0x8b, 0xe9, 0x41, 0x88, 0x1c,
+	0x44, 0x0b, 0x21, 0xb8, 0xed, 0x21, 0x87, 0x1e, 0x4a, 0x29, 0xf4, 0xd0, 0x43, 0xd8, 0xf4, 0x05,
+	0x36, 0xd2, 0x20, 0x89, 0xe8, 0x63, 0xbb, 0x1f, 0x05, 0xbd, 0x44, 0x1f, 0xa2, 0xaf, 0xd1, 0x97,
+	0x2b, 0xbb, 0x2b, 0xdb, 0x51, 0xa0, 0xbe, 0xfd, 0x7f, 0xb3, 0xb3, 0x9a, 0xd9, 0xff, 0x8c, 0x00,
+	0x64, 0xdd, 0x95, 0x57, 0x52, 0xf5, 0xa6, 0xa7, 0x91, 0xd3, 0xe9, 0x9f, 0x73, 0x88, 0x6f, 0x45,
+	0xfe, 0x80, 0x86, 0xbe, 0x86, 0x58, 0xf7, 0x56, 0xe5, 0xc8, 0x48, 0x42, 0xb2, 0x15, 0x1f, 0xc9,
+	0xc5, 0x8d, 0x50, 0x25, 0x1a, 0x76, 0x1e, 0xe2, 0x81, 0xe8, 0x16, 0x96, 0x1a, 0x7f, 0x5a, 0xec,
+	0x72, 0x64, 0xb3, 0x84, 0x64, 0x11, 0x3f, 0x30, 0xa5, 0x10, 0x69, 0xec, 0x0c, 0x8b, 0x12, 0x92,
+	0xcd, 0xb8, 0xd7, 0x2e, 0x5f, 0x61, 0x8e, 0xf5, 0x2f, 0x2c, 0xd8, 0xdc, 0xc7, 0x0f, 0x4c, 0x19,
+	0x2c, 0x14, 0xca, 0xa6, 0xc6, 0x82, 0xc5, 0xfe, 0x68, 0x8f, 0xf4, 0x0d, 0xac, 0x74, 0x5d, 0x76,
+	0xc2, 0x58, 0x85, 0x6c, 0x91, 0x90, 0x6c, 0xc3, 0x8f, 0x01, 0xd7, 0x5b, 0xd9, 0x6b, 0x5d, 0x4b,
+	0xb6, 0x4c, 0x48, 0xb6, 0xe4, 0x23, 0xd1, 0x1d, 0xac, 0x1a, 0x61, 0xb0, 0xcb, 0x6b, 0xd4, 0x6c,
+	0x95, 0xcc, 0xb2, 0xf5, 0xee, 0xe2, 0xca, 0x3f, 0xfe, 0xbb, 0x0f, 0x0f, 0x77, 0xb6, 0x6d, 0x85,
+	0x1a, 0xf8, 0x31, 0xcd, 0xf5, 0x20, 0xc5, 0xd0, 0xf4, 0xa2, 0x60, 0xe0, 0xeb, 0xec, 0x31, 0xfd,
+	0x04, 0xeb, 0x6f, 0x28, 0x1a, 0x53, 0x71, 0x94, 0xcd, 0x70, 0xca, 0x28, 0x6d, 0x84, 0xb1, 0xda,
+	0x1b, 0xb5, 0xe1, 0x23, 0xa5, 0x9f, 0x61, 0xfe, 0xa5, 0xb2, 0xdd, 0x03, 0xbd, 0x84, 0xb8, 0x42,
+	0x51, 0xa0, 0xf2, 0x17, 0xd7, 0xbb, 0x4d, 0x68, 0x29, 0xf8, 0xcf, 0xc7, 0x33, 0xe7, 0x5d, 0x21,
+	0x8c, 0x18, 0x3f, 0xe2, 0x75, 0x6a, 0xe1, 0xf9, 0x8f, 0x4a, 0xf5, 0xb6, 0xac, 0xa4, 0x35, 0xa7,
+	0xbb, 0xb8, 0x80, 0xf9, 0xfd, 0x60, 0x30, 0x34, 0x11, 0xf1, 0x00, 0x13, 0xf3, 0x67, 0xff, 0x37,
+	0x3f, 0x9a, 0x98, 0x9f, 0xfe, 0x26, 0xf0, 0x6c, 0x6a, 0xd8, 0xa3, 0x6d, 0x20, 0x93, 0x6d, 0x60,
+	0xb0, 0xd0, 0xa2, 0x95, 0xcd, 0xa1, 0xf0, 0x1e, 0xdd, 0x7b, 0x5a, 0x14, 0xdd, 0x58, 0xd6, 0x6b,
+	0xfa, 0x02, 0x66, 0xf2, 0xe3, 0xf5, 0x58, 0xce, 0x49, 0x1f, 0xb9, 0xb9, 0x19, 0x17, 0xc3, 0x49,
+	0x77, 0xaf, 0xe9, 0xb5, 0xf6, 0x0b, 0x41, 0xb8, 0xd7, 0xbb, 0xbf, 0x04, 0xa2, 0xaf, 0x79, 0xd5,
+	0xd3, 0x4b, 0x88, 0x6e, 0xeb, 0xae, 0xa4, 0x13, 0x0b, 0xb7, 0x13, 0x4a, 0xcf, 0xe8, 0x5b, 0x88,
+	0xef, 0x8c, 0x42, 0xd1, 0x9e, 0xce, 0xcb, 0xc8, 0x35, 0xa1, 0xef, 0x20, 0x0e, 0x43, 0x7e, 0x92,
+	0xfb, 0x32, 0xd0, 0xa3, 0x05, 0x48, 0xcf, 0xe8, 0x07, 0x80, 0xe3, 0x3c, 0xe8, 0x3a, 0xa4, 0xf8,
+	0x21, 0x6f, 0x5f, 0x05, 0x78, 0x32, 0x2e, 0x57, 0xe4, 0x3e, 0xf6, 0x7f, 0xde, 0xfb, 0x7f, 0x03,
+	0x00, 0xeb, 0xd4, 0xd3, 0xf6, 0x87, 0x03, 0x00, 0x00,
 }
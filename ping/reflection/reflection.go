@@ -0,0 +1,217 @@
+/*
+Package reflection implements the gRPC server reflection protocol
+(grpc.reflection.v1alpha.ServerReflection) so that tools such as grpcurl can
+list the services of the kekahu echo server and fetch the descriptors of
+their messages without a local copy of the proto files.
+
+The messages and service description are wire compatible with
+reflection.proto; they are maintained by hand because the grpc reflection
+package is not vendored. The oneof fields of the requests and responses are
+represented by optional pointer fields, at most one of which is set. Only the
+file and symbol lookups and listing services are supported: extension
+requests are answered with an UNIMPLEMENTED error response, and the
+descriptor of the reflection service itself is not served.
+*/
+package reflection
+
+import (
+	proto "github.com/golang/protobuf/proto"
+	context "golang.org/x/net/context"
+	grpc "google.golang.org/grpc"
+)
+
+// ServiceName is the fully qualified name of the server reflection service.
+const ServiceName = "grpc.reflection.v1alpha.ServerReflection"
+
+//===========================================================================
+// Messages
+//===========================================================================
+
+// ServerReflectionRequest is a request for a file descriptor or the list of
+// services; exactly one of the request fields should be set.
+type ServerReflectionRequest struct {
+	Host                      string            `protobuf:"bytes,1,opt,name=host" json:"host,omitempty"`
+	FileByFilename            *string           `protobuf:"bytes,3,opt,name=file_by_filename,json=fileByFilename" json:"file_by_filename,omitempty"`
+	FileContainingSymbol      *string           `protobuf:"bytes,4,opt,name=file_containing_symbol,json=fileContainingSymbol" json:"file_containing_symbol,omitempty"`
+	FileContainingExtension   *ExtensionRequest `protobuf:"bytes,5,opt,name=file_containing_extension,json=fileContainingExtension" json:"file_containing_extension,omitempty"`
+	AllExtensionNumbersOfType *string           `protobuf:"bytes,6,opt,name=all_extension_numbers_of_type,json=allExtensionNumbersOfType" json:"all_extension_numbers_of_type,omitempty"`
+	ListServices              *string           `protobuf:"bytes,7,opt,name=list_services,json=listServices" json:"list_services,omitempty"`
+}
+
+func (m *ServerReflectionRequest) Reset()         { *m = ServerReflectionRequest{} }
+func (m *ServerReflectionRequest) String() string { return proto.CompactTextString(m) }
+func (*ServerReflectionRequest) ProtoMessage()    {}
+
+// ExtensionRequest is a request for the file containing an extension.
+type ExtensionRequest struct {
+	ContainingType  string `protobuf:"bytes,1,opt,name=containing_type,json=containingType" json:"containing_type,omitempty"`
+	ExtensionNumber int32  `protobuf:"varint,2,opt,name=extension_number,json=extensionNumber" json:"extension_number,omitempty"`
+}
+
+func (m *ExtensionRequest) Reset()         { *m = ExtensionRequest{} }
+func (m *ExtensionRequest) String() string { return proto.CompactTextString(m) }
+func (*ExtensionRequest) ProtoMessage()    {}
+
+// ServerReflectionResponse is the response to a request; exactly one of the
+// response fields is set.
+type ServerReflectionResponse struct {
+	ValidHost              string                   `protobuf:"bytes,1,opt,name=valid_host,json=validHost" json:"valid_host,omitempty"`
+	OriginalRequest        *ServerReflectionRequest `protobuf:"bytes,2,opt,name=original_request,json=originalRequest" json:"original_request,omitempty"`
+	FileDescriptorResponse *FileDescriptorResponse  `protobuf:"bytes,4,opt,name=file_descriptor_response,json=fileDescriptorResponse" json:"file_descriptor_response,omitempty"`
+	ListServicesResponse   *ListServiceResponse     `protobuf:"bytes,6,opt,name=list_services_response,json=listServicesResponse" json:"list_services_response,omitempty"`
+	ErrorResponse          *ErrorResponse           `protobuf:"bytes,7,opt,name=error_response,json=errorResponse" json:"error_response,omitempty"`
+}
+
+func (m *ServerReflectionResponse) Reset()         { *m = ServerReflectionResponse{} }
+func (m *ServerReflectionResponse) String() string { return proto.CompactTextString(m) }
+func (*ServerReflectionResponse) ProtoMessage()    {}
+
+// FileDescriptorResponse contains the serialized (not gzipped)
+// FileDescriptorProto of the requested file and of its dependencies.
+type FileDescriptorResponse struct {
+	FileDescriptorProto [][]byte `protobuf:"bytes,1,rep,name=file_descriptor_proto,json=fileDescriptorProto" json:"file_descriptor_proto,omitempty"`
+}
+
+func (m *FileDescriptorResponse) Reset()         { *m = FileDescriptorResponse{} }
+func (m *FileDescriptorResponse) String() string { return proto.CompactTextString(m) }
+func (*FileDescriptorResponse) ProtoMessage()    {}
+
+// ListServiceResponse lists the services registered on the server.
+type ListServiceResponse struct {
+	Service []*ServiceResponse `protobuf:"bytes,1,rep,name=service" json:"service,omitempty"`
+}
+
+func (m *ListServiceResponse) Reset()         { *m = ListServiceResponse{} }
+func (m *ListServiceResponse) String() string { return proto.CompactTextString(m) }
+func (*ListServiceResponse) ProtoMessage()    {}
+
+// ServiceResponse is the fully qualified name of a service.
+type ServiceResponse struct {
+	Name string `protobuf:"bytes,1,opt,name=name" json:"name,omitempty"`
+}
+
+func (m *ServiceResponse) Reset()         { *m = ServiceResponse{} }
+func (m *ServiceResponse) String() string { return proto.CompactTextString(m) }
+func (*ServiceResponse) ProtoMessage()    {}
+
+// ErrorResponse is the gRPC status code and message of a failed request.
+type ErrorResponse struct {
+	ErrorCode    int32  `protobuf:"varint,1,opt,name=error_code,json=errorCode" json:"error_code,omitempty"`
+	ErrorMessage string `protobuf:"bytes,2,opt,name=error_message,json=errorMessage" json:"error_message,omitempty"`
+}
+
+func (m *ErrorResponse) Reset()         { *m = ErrorResponse{} }
+func (m *ErrorResponse) String() string { return proto.CompactTextString(m) }
+func (*ErrorResponse) ProtoMessage()    {}
+
+func init() {
+	proto.RegisterType((*ServerReflectionRequest)(nil), "grpc.reflection.v1alpha.ServerReflectionRequest")
+	proto.RegisterType((*ExtensionRequest)(nil), "grpc.reflection.v1alpha.ExtensionRequest")
+	proto.RegisterType((*ServerReflectionResponse)(nil), "grpc.reflection.v1alpha.ServerReflectionResponse")
+	proto.RegisterType((*FileDescriptorResponse)(nil), "grpc.reflection.v1alpha.FileDescriptorResponse")
+	proto.RegisterType((*ListServiceResponse)(nil), "grpc.reflection.v1alpha.ListServiceResponse")
+	proto.RegisterType((*ServiceResponse)(nil), "grpc.reflection.v1alpha.ServiceResponse")
+	proto.RegisterType((*ErrorResponse)(nil), "grpc.reflection.v1alpha.ErrorResponse")
+}
+
+//===========================================================================
+// Server Reflection Service
+//===========================================================================
+
+// ServerReflectionClient is the client API for the ServerReflection service.
+type ServerReflectionClient interface {
+	ServerReflectionInfo(ctx context.Context, opts ...grpc.CallOption) (ServerReflection_ServerReflectionInfoClient, error)
+}
+
+type serverReflectionClient struct {
+	cc *grpc.ClientConn
+}
+
+// NewServerReflectionClient returns a client of the ServerReflection service
+// on the connection.
+func NewServerReflectionClient(cc *grpc.ClientConn) ServerReflectionClient {
+	return &serverReflectionClient{cc}
+}
+
+func (c *serverReflectionClient) ServerReflectionInfo(ctx context.Context, opts ...grpc.CallOption) (ServerReflection_ServerReflectionInfoClient, error) {
+	stream, err := grpc.NewClientStream(ctx, &_ServerReflection_serviceDesc.Streams[0], c.cc, "/grpc.reflection.v1alpha.ServerReflection/ServerReflectionInfo", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &serverReflectionServerReflectionInfoClient{stream}
+	return x, nil
+}
+
+type ServerReflection_ServerReflectionInfoClient interface {
+	Send(*ServerReflectionRequest) error
+	Recv() (*ServerReflectionResponse, error)
+	grpc.ClientStream
+}
+
+type serverReflectionServerReflectionInfoClient struct {
+	grpc.ClientStream
+}
+
+func (x *serverReflectionServerReflectionInfoClient) Send(m *ServerReflectionRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *serverReflectionServerReflectionInfoClient) Recv() (*ServerReflectionResponse, error) {
+	m := new(ServerReflectionResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ServerReflectionServer is the server API for the ServerReflection service.
+type ServerReflectionServer interface {
+	ServerReflectionInfo(ServerReflection_ServerReflectionInfoServer) error
+}
+
+// RegisterServerReflectionServer registers the ServerReflection service on
+// the gRPC server.
+func RegisterServerReflectionServer(s *grpc.Server, srv ServerReflectionServer) {
+	s.RegisterService(&_ServerReflection_serviceDesc, srv)
+}
+
+func _ServerReflection_ServerReflectionInfo_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(ServerReflectionServer).ServerReflectionInfo(&serverReflectionServerReflectionInfoServer{stream})
+}
+
+type ServerReflection_ServerReflectionInfoServer interface {
+	Send(*ServerReflectionResponse) error
+	Recv() (*ServerReflectionRequest, error)
+	grpc.ServerStream
+}
+
+type serverReflectionServerReflectionInfoServer struct {
+	grpc.ServerStream
+}
+
+func (x *serverReflectionServerReflectionInfoServer) Send(m *ServerReflectionResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *serverReflectionServerReflectionInfoServer) Recv() (*ServerReflectionRequest, error) {
+	m := new(ServerReflectionRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+var _ServerReflection_serviceDesc = grpc.ServiceDesc{
+	ServiceName: ServiceName,
+	HandlerType: (*ServerReflectionServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "ServerReflectionInfo",
+			Handler:       _ServerReflection_ServerReflectionInfo_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "grpc/reflection/v1alpha/reflection.proto",
+}
@@ -0,0 +1,168 @@
+package reflection
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
+
+	proto "github.com/golang/protobuf/proto"
+	descriptor "github.com/golang/protobuf/protoc-gen-go/descriptor"
+	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Register the server reflection service on the gRPC server. The descriptors
+// are looked up in the files registered with the proto package, so the
+// services should be registered from generated code (e.g. ping.proto).
+func Register(s *grpc.Server) {
+	RegisterServerReflectionServer(s, &server{s: s})
+}
+
+// Implements ServerReflectionServer for the services of the gRPC server.
+type server struct {
+	s *grpc.Server
+}
+
+// Messages that describe their position in a registered file descriptor.
+type describable interface {
+	Descriptor() ([]byte, []int)
+}
+
+// ServerReflectionInfo answers each request on the stream until the client
+// closes it.
+func (s *server) ServerReflectionInfo(stream ServerReflection_ServerReflectionInfoServer) error {
+	for {
+		in, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		out := &ServerReflectionResponse{ValidHost: in.Host, OriginalRequest: in}
+		switch {
+		case in.FileByFilename != nil:
+			out.FileDescriptorResponse, err = s.fileDescriptors(*in.FileByFilename)
+		case in.FileContainingSymbol != nil:
+			var name string
+			if name, err = s.fileContainingSymbol(*in.FileContainingSymbol); err == nil {
+				out.FileDescriptorResponse, err = s.fileDescriptors(name)
+			}
+		case in.ListServices != nil:
+			out.ListServicesResponse = s.listServices()
+		default:
+			err = status.Error(codes.Unimplemented, "request is not supported by the kekahu echo server")
+		}
+
+		if err != nil {
+			out.FileDescriptorResponse = nil
+			out.ErrorResponse = &ErrorResponse{
+				ErrorCode:    int32(status.Code(err)),
+				ErrorMessage: status.Convert(err).Message(),
+			}
+		}
+
+		if err := stream.Send(out); err != nil {
+			return err
+		}
+	}
+}
+
+// Returns the names of the services registered on the server in sorted order.
+func (s *server) listServices() *ListServiceResponse {
+	names := make([]string, 0)
+	for name := range s.s.GetServiceInfo() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	out := &ListServiceResponse{Service: make([]*ServiceResponse, 0, len(names))}
+	for _, name := range names {
+		out.Service = append(out.Service, &ServiceResponse{Name: name})
+	}
+	return out
+}
+
+// Returns the name of the file that defines the symbol, which is either a
+// service (or one of its methods) registered on the server or a message type
+// registered with the proto package.
+func (s *server) fileContainingSymbol(symbol string) (string, error) {
+	for name, info := range s.s.GetServiceInfo() {
+		if symbol == name || strings.HasPrefix(symbol, name+".") {
+			if file, ok := info.Metadata.(string); ok {
+				return file, nil
+			}
+		}
+	}
+
+	if mt := proto.MessageType(symbol); mt != nil {
+		if msg, ok := reflect.Zero(mt).Interface().(describable); ok {
+			gz, _ := msg.Descriptor()
+			fd, _, err := decodeFileDescriptor(gz)
+			if err != nil {
+				return "", err
+			}
+			return fd.GetName(), nil
+		}
+	}
+
+	return "", status.Errorf(codes.NotFound, "symbol %s not found", symbol)
+}
+
+// Returns the serialized descriptor of the file followed by the descriptors
+// of its transitive dependencies.
+func (s *server) fileDescriptors(name string) (*FileDescriptorResponse, error) {
+	out := &FileDescriptorResponse{FileDescriptorProto: make([][]byte, 0, 1)}
+	seen := make(map[string]bool)
+	queue := []string{name}
+
+	for len(queue) > 0 {
+		name, queue = queue[0], queue[1:]
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		gz := proto.FileDescriptor(name)
+		if gz == nil {
+			return nil, status.Errorf(codes.NotFound, "file %s not found", name)
+		}
+
+		fd, data, err := decodeFileDescriptor(gz)
+		if err != nil {
+			return nil, err
+		}
+
+		out.FileDescriptorProto = append(out.FileDescriptorProto, data)
+		queue = append(queue, fd.Dependency...)
+	}
+
+	return out, nil
+}
+
+// Decompresses a gzipped file descriptor as registered with the proto package
+// and returns both the parsed descriptor and its serialized bytes.
+func decodeFileDescriptor(gz []byte) (*descriptor.FileDescriptorProto, []byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(gz))
+	if err != nil {
+		return nil, nil, status.Errorf(codes.Internal, "could not decompress file descriptor: %s", err)
+	}
+	defer zr.Close()
+
+	data, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return nil, nil, status.Errorf(codes.Internal, "could not decompress file descriptor: %s", err)
+	}
+
+	fd := new(descriptor.FileDescriptorProto)
+	if err := proto.Unmarshal(data, fd); err != nil {
+		return nil, nil, status.Errorf(codes.Internal, "could not parse file descriptor: %s", err)
+	}
+	return fd, data, nil
+}